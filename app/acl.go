@@ -0,0 +1,1329 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Connections authenticate as one of the users, the default one until
+// AUTH. A user is enabled or not, has passwords, stored as their SHA-256,
+// or none at all with nopass, and selectors: the commands, keys and
+// channels it may use. The root selector is the one of the rules given on
+// their own, the others are given in parentheses, like "(~cache:* +get)".
+// A command runs if one of the selectors allows it with all its keys and
+// channels. Users are changed with rules, like the ones of ACL SETUSER,
+// and described with the same rules. requirepass is the password of the
+// default user.
+
+const DEFAULT_USERNAME = "default"
+
+const (
+	USER_FLAG_ENABLED = 1 << iota
+	USER_FLAG_DISABLED
+	USER_FLAG_NOPASS
+	USER_FLAG_SANITIZE_PAYLOAD
+	USER_FLAG_SANITIZE_PAYLOAD_SKIP
+)
+
+// in the order ACL LIST shows them
+var aclUserFlags = []struct {
+	flag int
+	name string
+}{
+	{USER_FLAG_ENABLED, "on"},
+	{USER_FLAG_DISABLED, "off"},
+	{USER_FLAG_NOPASS, "nopass"},
+	{USER_FLAG_SANITIZE_PAYLOAD_SKIP, "skip-sanitize-payload"},
+	{USER_FLAG_SANITIZE_PAYLOAD, "sanitize-payload"},
+}
+
+const (
+	SELECTOR_FLAG_ROOT = 1 << iota
+	SELECTOR_FLAG_ALLKEYS
+	SELECTOR_FLAG_ALLCOMMANDS
+	SELECTOR_FLAG_ALLCHANNELS
+)
+
+// what a key pattern allows
+const (
+	ACL_READ_PERMISSION = 1 << iota
+	ACL_WRITE_PERMISSION
+	ACL_ALL_PERMISSION = ACL_READ_PERMISSION | ACL_WRITE_PERMISSION
+)
+
+// the command categories, a command has the bits of its categories
+var aclCommandCategories = []string{
+	"keyspace", "read", "write", "set", "sortedset", "list", "hash", "string",
+	"bitmap", "hyperloglog", "geo", "stream", "pubsub", "admin", "fast", "slow",
+	"blocking", "dangerous", "connection", "transaction", "scripting",
+}
+
+// the errors of the rules, as ACL SETUSER replies them
+var (
+	errAclSyntax          = errors.New("Syntax error")
+	errAclUnknownCommand  = errors.New("Unknown command or category name in ACL")
+	errAclKeyAfterAll     = errors.New("Adding a pattern after the * pattern (or the 'allkeys' flag) is not valid and does not have any effect. Try 'resetkeys' to start with an empty list of patterns")
+	errAclChannelAfterAll = errors.New("Adding a pattern after the * pattern (or the 'allchannels' flag) is not valid and does not have any effect. Try 'resetchannels' to start with an empty list of channels")
+	errAclNoSuchPassword  = errors.New("The password you are trying to remove from the user does not exist")
+	errAclBadHash         = errors.New("The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+)
+
+type aclUser struct {
+	name  string
+	flags int
+	// SHA-256 of the passwords, in hex
+	passwords []string
+	selectors []*aclSelector
+}
+
+type aclKeyPattern struct {
+	flags   int
+	pattern string
+}
+
+type aclSelector struct {
+	flags int
+	// the commands it allows by name, and for the ones it doesn't, the
+	// first arguments it allows them with
+	allowedCommands  map[string]bool
+	allowedFirstArgs map[string][]string
+	// set by +@all, the commands rules apply to all the commands rather
+	// than to none
+	baseAllCommands bool
+	// the command rules, as they are described after +@all or -@all
+	commandRules []string
+	patterns     []aclKeyPattern
+	channels     []string
+}
+
+func aclGetCommandCategoryFlagByName(name string) uint64 {
+	for i, category := range aclCommandCategories {
+		if category == name {
+			return 1 << i
+		}
+	}
+	return 0
+}
+
+// commandAclCategories are the categories the JSON of a command gives it,
+// and the ones its flags imply
+func commandAclCategories(names []string, flags int) uint64 {
+	categories := uint64(0)
+	for _, name := range names {
+		categories |= aclGetCommandCategoryFlagByName(strings.TrimPrefix(strings.ToLower(name), "@"))
+	}
+
+	category := aclGetCommandCategoryFlagByName
+	if flags&CMD_WRITE != 0 {
+		categories |= category("write")
+	}
+	if flags&CMD_READONLY != 0 && categories&category("scripting") == 0 {
+		categories |= category("read")
+	}
+	if flags&CMD_ADMIN != 0 {
+		categories |= category("admin") | category("dangerous")
+	}
+	if flags&CMD_PUBSUB != 0 {
+		categories |= category("pubsub")
+	}
+	if flags&CMD_FAST != 0 {
+		categories |= category("fast")
+	}
+	if categories&category("fast") == 0 {
+		categories |= category("slow")
+	}
+	return categories
+}
+
+func newAclSelector(flags int) *aclSelector {
+	return &aclSelector{
+		flags:            flags,
+		allowedCommands:  map[string]bool{},
+		allowedFirstArgs: map[string][]string{},
+	}
+}
+
+func (selector *aclSelector) dup() *aclSelector {
+	dup := *selector
+	dup.allowedCommands = make(map[string]bool, len(selector.allowedCommands))
+	for name, allowed := range selector.allowedCommands {
+		dup.allowedCommands[name] = allowed
+	}
+	dup.allowedFirstArgs = make(map[string][]string, len(selector.allowedFirstArgs))
+	for name, firstArgs := range selector.allowedFirstArgs {
+		dup.allowedFirstArgs[name] = append([]string{}, firstArgs...)
+	}
+	dup.commandRules = append([]string{}, selector.commandRules...)
+	dup.patterns = append([]aclKeyPattern{}, selector.patterns...)
+	dup.channels = append([]string{}, selector.channels...)
+	return &dup
+}
+
+// newAclUser creates a user that is disabled and can do nothing
+func newAclUser(name string) *aclUser {
+	return &aclUser{
+		name:      name,
+		flags:     USER_FLAG_DISABLED,
+		selectors: []*aclSelector{newAclSelector(SELECTOR_FLAG_ROOT)},
+	}
+}
+
+func (user *aclUser) dup() *aclUser {
+	dup := *user
+	dup.passwords = append([]string{}, user.passwords...)
+	dup.selectors = make([]*aclSelector, len(user.selectors))
+	for i, selector := range user.selectors {
+		dup.selectors[i] = selector.dup()
+	}
+	return &dup
+}
+
+func (user *aclUser) rootSelector() *aclSelector {
+	return user.selectors[0]
+}
+
+// aclInit creates the default user, that can do everything, with the
+// password of requirepass if any. The users of the config file, or of the
+// aclfile, are added, the default one replaced if they define it.
+func (server *RedisServer) aclInit() {
+	server.users = map[string]*aclUser{}
+	server.defaultUser = server.aclCreateDefaultUser()
+	server.users[DEFAULT_USERNAME] = server.defaultUser
+	server.aclUpdateDefaultUserPassword(server.Config.Requirepass)
+
+	if err := server.aclLoadConfiguredUsers(); err != nil {
+		fmt.Printf("Aborting Redis startup because of ACL errors: %v\n", err)
+		os.Exit(1)
+	}
+	if server.Config.AclFile != "" {
+		if err := server.aclLoadFromFile(server.Config.AclFile); err != nil {
+			fmt.Printf("Aborting Redis startup because of ACL errors: %v\n", err)
+			os.Exit(1)
+		}
+	}
+}
+
+// aclCreateDefaultUser is the default user of a new server, that can do
+// everything without a password
+func (server *RedisServer) aclCreateDefaultUser() *aclUser {
+	user := newAclUser(DEFAULT_USERNAME)
+	for _, op := range []string{"+@all", "~*", "&*", "on", "nopass", "sanitize-payload"} {
+		server.aclSetUser(user, op)
+	}
+	return user
+}
+
+// aclUpdateDefaultUserPassword makes the password the only one of the
+// default user, or lets it in without any when it is empty
+func (server *RedisServer) aclUpdateDefaultUserPassword(password string) {
+	server.aclSetUser(server.defaultUser, "resetpass")
+	if password != "" {
+		server.aclSetUser(server.defaultUser, ">"+password)
+	} else {
+		server.aclSetUser(server.defaultUser, "nopass")
+	}
+}
+
+func aclHashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+func aclCheckPasswordHash(hash string) error {
+	if len(hash) != 64 {
+		return errAclBadHash
+	}
+	for _, c := range hash {
+		if !(c >= '0' && c <= '9') && !(c >= 'a' && c <= 'f') {
+			return errAclBadHash
+		}
+	}
+	return nil
+}
+
+// aclSetUser applies a rule to the user. The ones that are not about the
+// user itself are about its root selector.
+func (server *RedisServer) aclSetUser(user *aclUser, op string) error {
+	if op == "" {
+		return errAclSyntax
+	}
+	lowerOp := strings.ToLower(op)
+	switch {
+	case lowerOp == "on":
+		user.flags |= USER_FLAG_ENABLED
+		user.flags &^= USER_FLAG_DISABLED
+	case lowerOp == "off":
+		user.flags |= USER_FLAG_DISABLED
+		user.flags &^= USER_FLAG_ENABLED
+	case lowerOp == "skip-sanitize-payload":
+		user.flags |= USER_FLAG_SANITIZE_PAYLOAD_SKIP
+		user.flags &^= USER_FLAG_SANITIZE_PAYLOAD
+	case lowerOp == "sanitize-payload":
+		user.flags |= USER_FLAG_SANITIZE_PAYLOAD
+		user.flags &^= USER_FLAG_SANITIZE_PAYLOAD_SKIP
+	case lowerOp == "nopass":
+		user.flags |= USER_FLAG_NOPASS
+		user.passwords = nil
+	case lowerOp == "resetpass":
+		user.flags &^= USER_FLAG_NOPASS
+		user.passwords = nil
+	case op[0] == '>' || op[0] == '#':
+		hash := op[1:]
+		if op[0] == '>' {
+			hash = aclHashPassword(op[1:])
+		} else if err := aclCheckPasswordHash(hash); err != nil {
+			return err
+		}
+		if !containsString(user.passwords, hash) {
+			user.passwords = append(user.passwords, hash)
+		}
+		user.flags &^= USER_FLAG_NOPASS
+	case op[0] == '<' || op[0] == '!':
+		hash := op[1:]
+		if op[0] == '<' {
+			hash = aclHashPassword(op[1:])
+		} else if err := aclCheckPasswordHash(hash); err != nil {
+			return err
+		}
+		if !containsString(user.passwords, hash) {
+			return errAclNoSuchPassword
+		}
+		user.passwords = removeString(user.passwords, hash)
+	case lowerOp == "reset":
+		for _, op := range []string{"resetpass", "resetkeys", "resetchannels", "off", "sanitize-payload", "clearselectors", "-@all"} {
+			server.aclSetUser(user, op)
+		}
+	case op[0] == '(' && op[len(op)-1] == ')':
+		selector := newAclSelector(0)
+		for _, selectorOp := range strings.Fields(op[1 : len(op)-1]) {
+			if err := server.aclSetSelector(selector, selectorOp); err != nil {
+				return err
+			}
+		}
+		user.selectors = append(user.selectors, selector)
+	case lowerOp == "clearselectors":
+		user.selectors = user.selectors[:1]
+	default:
+		return server.aclSetSelector(user.rootSelector(), op)
+	}
+	return nil
+}
+
+// aclSetSelector applies a rule about commands, keys or channels
+func (server *RedisServer) aclSetSelector(selector *aclSelector, op string) error {
+	lowerOp := strings.ToLower(op)
+	switch {
+	case lowerOp == "allkeys" || op == "~*":
+		selector.flags |= SELECTOR_FLAG_ALLKEYS
+		selector.patterns = nil
+	case lowerOp == "resetkeys":
+		selector.flags &^= SELECTOR_FLAG_ALLKEYS
+		selector.patterns = nil
+	case lowerOp == "allchannels" || op == "&*":
+		selector.flags |= SELECTOR_FLAG_ALLCHANNELS
+		selector.channels = nil
+	case lowerOp == "resetchannels":
+		selector.flags &^= SELECTOR_FLAG_ALLCHANNELS
+		selector.channels = nil
+	case lowerOp == "allcommands" || lowerOp == "+@all":
+		selector.flags |= SELECTOR_FLAG_ALLCOMMANDS
+		selector.baseAllCommands = true
+		for name := range redisCommandTable {
+			selector.allowedCommands[name] = true
+		}
+		selector.allowedFirstArgs = map[string][]string{}
+		selector.commandRules = nil
+	case lowerOp == "nocommands" || lowerOp == "-@all":
+		selector.flags &^= SELECTOR_FLAG_ALLCOMMANDS
+		selector.baseAllCommands = false
+		selector.allowedCommands = map[string]bool{}
+		selector.allowedFirstArgs = map[string][]string{}
+		selector.commandRules = nil
+	case op[0] == '~' || op[0] == '%':
+		return selector.addKeyPattern(op)
+	case op[0] == '&':
+		if selector.flags&SELECTOR_FLAG_ALLCHANNELS != 0 {
+			return errAclChannelAfterAll
+		}
+		if !containsString(selector.channels, op[1:]) {
+			selector.channels = append(selector.channels, op[1:])
+		}
+	case (op[0] == '+' || op[0] == '-') && len(op) > 1 && op[1] == '@':
+		category := aclGetCommandCategoryFlagByName(lowerOp[2:])
+		if category == 0 {
+			return errAclUnknownCommand
+		}
+		for name, command := range redisCommandTable {
+			if command.AclCategories&category != 0 {
+				selector.setCommand(name, op[0] == '+')
+			}
+		}
+		selector.updateCommandRules(lowerOp)
+	case op[0] == '+' || op[0] == '-':
+		name, firstArg, hasFirstArg := strings.Cut(op[1:], "|")
+		name = strings.ToUpper(name)
+		if _, ok := redisCommandTable[name]; !ok {
+			return errAclUnknownCommand
+		}
+		if !hasFirstArg {
+			selector.setCommand(name, op[0] == '+')
+			selector.updateCommandRules(lowerOp)
+			break
+		}
+		// only the first arguments of a command that is not allowed
+		// can be allowed
+		if firstArg == "" || strings.Contains(firstArg, "|") || op[0] == '-' {
+			return errAclSyntax
+		}
+		if !selector.allowedCommands[name] && !containsString(selector.allowedFirstArgs[name], strings.ToLower(firstArg)) {
+			selector.allowedFirstArgs[name] = append(selector.allowedFirstArgs[name], strings.ToLower(firstArg))
+		}
+		selector.updateCommandRules(lowerOp)
+	default:
+		return errAclSyntax
+	}
+	return nil
+}
+
+func (selector *aclSelector) setCommand(name string, allowed bool) {
+	selector.allowedCommands[name] = allowed
+	delete(selector.allowedFirstArgs, name)
+	if !allowed {
+		selector.flags &^= SELECTOR_FLAG_ALLCOMMANDS
+	}
+}
+
+// updateCommandRules appends the rule, in place of the ones about the same
+// command or category it overrides
+func (selector *aclSelector) updateCommandRules(rule string) {
+	name := rule[1:]
+	rules := selector.commandRules[:0]
+	for _, r := range selector.commandRules {
+		if r[1:] == name || strings.HasPrefix(r[1:], name+"|") {
+			continue
+		}
+		rules = append(rules, r)
+	}
+	selector.commandRules = append(rules, rule)
+}
+
+// addKeyPattern adds a ~pattern, or a %R~, %W~ or %RW~ one that only
+// allows reading or writing the keys
+func (selector *aclSelector) addKeyPattern(op string) error {
+	flags, offset := ACL_ALL_PERMISSION, 1
+	if op[0] == '%' {
+		flags = 0
+		for offset = 1; offset < len(op) && op[offset] != '~'; offset++ {
+			switch op[offset] {
+			case 'R', 'r':
+				flags |= ACL_READ_PERMISSION
+			case 'W', 'w':
+				flags |= ACL_WRITE_PERMISSION
+			default:
+				return errAclSyntax
+			}
+		}
+		if flags == 0 || offset == len(op) {
+			return errAclSyntax
+		}
+		offset++
+	}
+
+	if selector.flags&SELECTOR_FLAG_ALLKEYS != 0 {
+		return errAclKeyAfterAll
+	}
+	pattern := op[offset:]
+	if pattern == "*" && flags == ACL_ALL_PERMISSION {
+		selector.flags |= SELECTOR_FLAG_ALLKEYS
+		selector.patterns = nil
+		return nil
+	}
+	for i := range selector.patterns {
+		if selector.patterns[i].pattern == pattern {
+			selector.patterns[i].flags |= flags
+			return nil
+		}
+	}
+	selector.patterns = append(selector.patterns, aclKeyPattern{flags, pattern})
+	return nil
+}
+
+func (pattern aclKeyPattern) String() string {
+	switch pattern.flags {
+	case ACL_READ_PERMISSION:
+		return "%R~" + pattern.pattern
+	case ACL_WRITE_PERMISSION:
+		return "%W~" + pattern.pattern
+	}
+	return "~" + pattern.pattern
+}
+
+func (selector *aclSelector) describeKeys() string {
+	if selector.flags&SELECTOR_FLAG_ALLKEYS != 0 {
+		return "~*"
+	}
+	patterns := []string{}
+	for _, pattern := range selector.patterns {
+		patterns = append(patterns, pattern.String())
+	}
+	return strings.Join(patterns, " ")
+}
+
+func (selector *aclSelector) describeChannels() string {
+	if selector.flags&SELECTOR_FLAG_ALLCHANNELS != 0 {
+		return "&*"
+	}
+	channels := []string{}
+	for _, channel := range selector.channels {
+		channels = append(channels, "&"+channel)
+	}
+	return strings.Join(channels, " ")
+}
+
+func (selector *aclSelector) describeCommandRules() string {
+	rules := []string{"-@all"}
+	if selector.baseAllCommands {
+		rules = []string{"+@all"}
+	}
+	return strings.Join(append(rules, selector.commandRules...), " ")
+}
+
+// describe is the selector as the rules that create it
+func (selector *aclSelector) describe() string {
+	rules := []string{}
+	if keys := selector.describeKeys(); keys != "" {
+		rules = append(rules, keys)
+	}
+	if selector.flags&SELECTOR_FLAG_ALLCHANNELS == 0 {
+		rules = append(rules, "resetchannels")
+	}
+	if channels := selector.describeChannels(); channels != "" {
+		rules = append(rules, channels)
+	}
+	return strings.Join(append(rules, selector.describeCommandRules()), " ")
+}
+
+func (user *aclUser) describeFlags() []string {
+	flags := []string{}
+	for _, f := range aclUserFlags {
+		if user.flags&f.flag != 0 {
+			flags = append(flags, f.name)
+		}
+	}
+	return flags
+}
+
+// describe is the user as the rules that create it, the way ACL LIST shows
+// it
+func (user *aclUser) describe() string {
+	rules := user.describeFlags()
+	for _, hash := range user.passwords {
+		rules = append(rules, "#"+hash)
+	}
+	rules = append(rules, user.rootSelector().describe())
+	for _, selector := range user.selectors[1:] {
+		rules = append(rules, "("+selector.describe()+")")
+	}
+	return strings.Join(rules, " ")
+}
+
+// the results of the permission checks
+const (
+	ACL_OK = iota
+	ACL_DENIED_CMD
+	ACL_DENIED_KEY
+	ACL_DENIED_AUTH
+	ACL_DENIED_CHANNEL
+)
+
+// checkCommand tells if the selector allows the command, or its first
+// argument. The ones anybody can run before authenticating are allowed.
+func (selector *aclSelector) checkCommand(command RedisCommand, cmd string, args []interface{}) bool {
+	if selector.flags&SELECTOR_FLAG_ALLCOMMANDS != 0 || command.CmdFlags&CMD_NO_AUTH != 0 {
+		return true
+	}
+	if selector.allowedCommands[cmd] {
+		return true
+	}
+	if firstArgs := selector.allowedFirstArgs[cmd]; len(firstArgs) > 0 && len(args) > 0 {
+		firstArg, _ := args[0].(string)
+		return containsString(firstArgs, strings.ToLower(firstArg))
+	}
+	return false
+}
+
+// checkKey tells if a pattern of the selector matches the key, with the
+// permissions needed
+func (selector *aclSelector) checkKey(key string, flags int) bool {
+	if selector.flags&SELECTOR_FLAG_ALLKEYS != 0 {
+		return true
+	}
+	for _, pattern := range selector.patterns {
+		if pattern.flags&flags == flags && stringMatch(pattern.pattern, key, false) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkChannel tells if the selector allows the channel. A pattern
+// subscribed to must be one of the patterns of the selector, rather than
+// match one.
+func (selector *aclSelector) checkChannel(channel string, isPattern bool) bool {
+	if selector.flags&SELECTOR_FLAG_ALLCHANNELS != 0 {
+		return true
+	}
+	for _, pattern := range selector.channels {
+		if (isPattern && pattern == channel) || (!isPattern && stringMatch(pattern, channel, false)) {
+			return true
+		}
+	}
+	return false
+}
+
+// aclKeyPermissions are the permissions the keys of the command need.
+// Without key specs to tell how each key is used, the keys of a write
+// command need to be written, the ones of a read-only one to be read, and
+// the ones of other commands, like EVAL, both.
+func aclKeyPermissions(command RedisCommand) int {
+	switch {
+	case command.CmdFlags&CMD_WRITE != 0:
+		return ACL_WRITE_PERMISSION
+	case command.CmdFlags&CMD_READONLY != 0:
+		return ACL_READ_PERMISSION
+	}
+	return ACL_ALL_PERMISSION
+}
+
+// aclChannelArgs are the channels among the arguments of the command, or
+// the channel patterns
+func aclChannelArgs(cmd string, args []interface{}) (channels []interface{}, isPattern bool) {
+	switch cmd {
+	case "PUBLISH", "SPUBLISH":
+		return args[:1], false
+	case "SUBSCRIBE", "SSUBSCRIBE":
+		return args, false
+	case "PSUBSCRIBE":
+		return args, true
+	}
+	return nil, false
+}
+
+// checkCommandPerm checks the command, then its keys and its channels. It
+// returns the first argument denied, with its position among the keys or
+// channels.
+func (selector *aclSelector) checkCommandPerm(command RedisCommand, cmd string, args []interface{}) (int, string, int) {
+	if !selector.checkCommand(command, cmd, args) {
+		return ACL_DENIED_CMD, "", 0
+	}
+
+	// the shard channels are the keys of the commands that take them, for
+	// the cluster, but no keys of the ACLs
+	if command.CmdFlags&CMD_PUBSUB == 0 {
+		flags := aclKeyPermissions(command)
+		for i, key := range getKeysFromCommand(command, args) {
+			if !selector.checkKey(key, flags) {
+				return ACL_DENIED_KEY, key, i
+			}
+		}
+	}
+
+	channels, isPattern := aclChannelArgs(cmd, args)
+	for i, arg := range channels {
+		channel, _ := arg.(string)
+		if !selector.checkChannel(channel, isPattern) {
+			return ACL_DENIED_CHANNEL, channel, i
+		}
+	}
+	return ACL_OK, "", 0
+}
+
+// aclCheckAllUserCommandPerm tells if a selector of the user lets it run
+// the command. When none does, the error is the most relevant one: the
+// command if no selector allows it, or else the last key or channel denied.
+func aclCheckAllUserCommandPerm(user *aclUser, command RedisCommand, cmd string, args []interface{}) (int, string) {
+	relevantError, errArg, lastPos := ACL_DENIED_CMD, "", 0
+	for _, selector := range user.selectors {
+		result, arg, pos := selector.checkCommandPerm(command, cmd, args)
+		if result == ACL_OK {
+			return ACL_OK, ""
+		}
+		if result > relevantError || (result == relevantError && pos > lastPos) {
+			relevantError, errArg, lastPos = result, arg, pos
+		}
+	}
+	return relevantError, errArg
+}
+
+// aclCheckAllPerm checks the command against the user of the client
+func (server *RedisServer) aclCheckAllPerm(client *RedisClient, command RedisCommand, cmd string, args []interface{}) (int, string) {
+	return aclCheckAllUserCommandPerm(client.getUser(), command, cmd, args)
+}
+
+// aclErrorMessage tells why the user can't run the command. Unless verbose
+// it doesn't tell which key or channel is denied.
+func aclErrorMessage(result int, user *aclUser, cmd, errArg string, verbose bool) string {
+	switch result {
+	case ACL_DENIED_CMD:
+		return fmt.Sprintf("User %s has no permissions to run the '%s' command", user.name, strings.ToLower(cmd))
+	case ACL_DENIED_KEY:
+		if verbose {
+			return fmt.Sprintf("User %s has no permissions to access the '%s' key", user.name, errArg)
+		}
+		return "No permissions to access a key"
+	case ACL_DENIED_CHANNEL:
+		if verbose {
+			return fmt.Sprintf("User %s has no permissions to access the '%s' channel", user.name, errArg)
+		}
+		return "No permissions to access a channel"
+	}
+	return "Permission denied"
+}
+
+// aclKillPubsubClientsIfNeeded closes the clients of the user subscribed to
+// channels or patterns it no longer allows
+func (server *RedisServer) aclKillPubsubClientsIfNeeded(user *aclUser) {
+	allowed := func(subscriptions map[string]struct{}, isPattern bool) bool {
+		for channel := range subscriptions {
+			permitted := false
+			for _, selector := range user.selectors {
+				if selector.checkChannel(channel, isPattern) {
+					permitted = true
+					break
+				}
+			}
+			if !permitted {
+				return false
+			}
+		}
+		return true
+	}
+
+	server.clientsMu.Lock()
+	clients := []*RedisClient{}
+	for _, client := range server.clients {
+		if client.user != user {
+			continue
+		}
+		if !allowed(client.pubsubChannels, false) || !allowed(client.pubsubShardChannels, false) ||
+			!allowed(client.pubsubPatterns, true) {
+			clients = append(clients, client)
+		}
+	}
+	server.clientsMu.Unlock()
+
+	for _, client := range clients {
+		if client == server.currentClient {
+			client.Flags |= CLIENT_CLOSE_AFTER_COMMAND
+		} else {
+			client.close()
+		}
+	}
+}
+
+// authRequired tells a client that must authenticate before running
+// commands other than AUTH and HELLO
+func (server *RedisServer) authRequired(client *RedisClient) bool {
+	defaultUser := server.defaultUser
+	return (defaultUser.flags&USER_FLAG_NOPASS == 0 || defaultUser.flags&USER_FLAG_DISABLED != 0) && !client.authenticated
+}
+
+// checkUserPassword tells if the user exists, is enabled and has the
+// password. The hashes are compared, so the time it takes tells nothing of
+// the password.
+func (server *RedisServer) checkUserPassword(username, password string) *aclUser {
+	user := server.users[username]
+	if user == nil || user.flags&USER_FLAG_DISABLED != 0 {
+		return nil
+	}
+	if user.flags&USER_FLAG_NOPASS != 0 {
+		return user
+	}
+
+	hash := aclHashPassword(password)
+	for _, expected := range user.passwords {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(expected)) == 1 {
+			return user
+		}
+	}
+	return nil
+}
+
+// authenticateClient authenticates the client as the user, or returns the
+// error to reply with
+func (server *RedisServer) authenticateClient(client *RedisClient, username, password string) []byte {
+	user := server.checkUserPassword(username, password)
+	if user == nil {
+		context := ACL_LOG_CTX_TOPLEVEL
+		if server.inExec {
+			context = ACL_LOG_CTX_MULTI
+		}
+		server.addAclLogEntry(client, ACL_DENIED_AUTH, context, "AUTH", username)
+		return []byte("-WRONGPASS invalid username-password pair or user is disabled.\r\n")
+	}
+	client.user = user
+	client.authenticated = true
+	return nil
+}
+
+// handleAuthCommand is AUTH [username] password
+func (server *RedisServer) handleAuthCommand(cmd string, args []interface{}) []byte {
+	if len(args) > 2 {
+		return []byte("-ERR syntax error\r\n")
+	}
+
+	username, password := DEFAULT_USERNAME, ""
+	if len(args) == 1 {
+		if server.defaultUser.flags&USER_FLAG_NOPASS != 0 {
+			return []byte("-ERR AUTH <password> called without any password configured for the default user. " +
+				"Are you sure your configuration is correct?\r\n")
+		}
+		password, _ = args[0].(string)
+	} else {
+		username, _ = args[0].(string)
+		password, _ = args[1].(string)
+	}
+
+	if errReply := server.authenticateClient(server.currentClient, username, password); errReply != nil {
+		return errReply
+	}
+	return []byte("+OK\r\n")
+}
+
+func (server *RedisServer) handleAclCommand(cmd string, args []interface{}) []byte {
+	subcommand, _ := args[0].(string)
+	subcommand = strings.ToUpper(subcommand)
+	client := server.currentClient
+
+	switch {
+	case subcommand == "HELP" && len(args) == 1:
+		return addReplyHelp("ACL", []string{
+			"CAT [<category>]",
+			"    List all commands that belong to <category>, or all command categories",
+			"    when no category is specified.",
+			"DELUSER <username> [<username> ...]",
+			"    Delete a list of users.",
+			"GENPASS [<bits>]",
+			"    Generate a secure 256-bit user password. The optional `bits` argument can",
+			"    be used to specify a different size.",
+			"GETUSER <username>",
+			"    Get the user's details.",
+			"LIST",
+			"    Show users details in config file format.",
+			"LOAD",
+			"    Reload users from the ACL file.",
+			"LOG [<count> | RESET]",
+			"    List latest events denied because of ACLs.",
+			"SAVE",
+			"    Save the current config to the ACL file.",
+			"SETUSER <username> <attribute> [<attribute> ...]",
+			"    Create or modify a user with the specified attributes.",
+			"USERS",
+			"    List all the registered usernames.",
+			"WHOAMI",
+			"    Return the current connection username.",
+		})
+	case subcommand == "SETUSER" && len(args) >= 2:
+		return server.aclSetUserCommand(args[1:])
+	case subcommand == "GETUSER" && len(args) == 2:
+		username, _ := args[1].(string)
+		user := server.users[username]
+		if user == nil {
+			return client.addReplyNull()
+		}
+		return server.addReplyAclUser(client, user)
+	case subcommand == "DELUSER" && len(args) >= 2:
+		deleted := 0
+		for _, arg := range args[1:] {
+			username, _ := arg.(string)
+			if username == DEFAULT_USERNAME {
+				return []byte("-ERR The 'default' user cannot be removed\r\n")
+			}
+		}
+		for _, arg := range args[1:] {
+			username, _ := arg.(string)
+			if user := server.users[username]; user != nil {
+				delete(server.users, username)
+				server.disconnectAuthenticatedClients(user)
+				deleted++
+			}
+		}
+		return addReplyLongLong(int64(deleted))
+	case subcommand == "LIST" && len(args) == 1:
+		return addReplyArray(server.aclDescribeUsers())
+	case (subcommand == "LOAD" || subcommand == "SAVE") && len(args) == 1:
+		if server.Config.AclFile == "" {
+			return []byte("-ERR This Redis instance is not configured to use an ACL file. " +
+				"You may want to specify users via the ACL SETUSER command and then issue a CONFIG REWRITE " +
+				"(assuming you have a Redis configuration file set) in order to store users in the Redis configuration.\r\n")
+		}
+		if subcommand == "LOAD" {
+			if err := server.aclLoadFromFile(server.Config.AclFile); err != nil {
+				return []byte(fmt.Sprintf("-ERR %v\r\n", err))
+			}
+			return []byte("+OK\r\n")
+		}
+		if err := server.aclSaveToFile(server.Config.AclFile); err != nil {
+			fmt.Printf("Error saving ACLs: %v\n", err)
+			return []byte("-ERR There was an error trying to save the ACLs. Please check the server logs for more information\r\n")
+		}
+		return []byte("+OK\r\n")
+	case subcommand == "LOG" && len(args) <= 2:
+		return server.handleAclLogCommand(client, args[1:])
+	case subcommand == "GENPASS" && len(args) <= 2:
+		bits := 256
+		if len(args) == 2 {
+			arg, _ := args[1].(string)
+			n, err := strconv.Atoi(arg)
+			if err != nil || n <= 0 || n > 4096 {
+				return []byte("-ERR ACL GENPASS argument must be the number of bits for the output password, a positive number up to 4096\r\n")
+			}
+			bits = n
+		}
+		// a hex char is 4 bits
+		return addReplyBulk([]interface{}{getRandomHexChars((bits + 3) / 4)})
+	case subcommand == "USERS" && len(args) == 1:
+		return addReplyArray(server.aclUserNames())
+	case subcommand == "WHOAMI" && len(args) == 1:
+		return addReplyBulk([]interface{}{client.getUser().name})
+	case subcommand == "CAT" && len(args) <= 2:
+		if len(args) == 1 {
+			return addReplyArray(aclCommandCategories)
+		}
+		name, _ := args[1].(string)
+		category := aclGetCommandCategoryFlagByName(strings.ToLower(name))
+		if category == 0 {
+			return []byte(fmt.Sprintf("-ERR Unknown category '%s'\r\n", name))
+		}
+		commands := []string{}
+		for cmdName, command := range redisCommandTable {
+			if command.AclCategories&category != 0 {
+				commands = append(commands, strings.ToLower(cmdName))
+			}
+		}
+		sort.Strings(commands)
+		return addReplyArray(commands)
+	}
+	return addReplySubcommandSyntaxError("ACL", subcommand)
+}
+
+// aclSetUserCommand creates the user if needed and applies the rules, all
+// of them or none if one is wrong
+func (server *RedisServer) aclSetUserCommand(args []interface{}) []byte {
+	username, _ := args[0].(string)
+	if strings.ContainsAny(username, " \x00") {
+		return []byte("-ERR Usernames can't contain spaces or null characters\r\n")
+	}
+
+	rules := make([]string, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		rule, _ := arg.(string)
+		rules = append(rules, rule)
+	}
+	ops, err := aclMergeSelectorArguments(rules)
+	if err != nil {
+		return []byte(fmt.Sprintf("-ERR %v\r\n", err))
+	}
+
+	user := server.users[username]
+	updated := newAclUser(username)
+	if user != nil {
+		updated = user.dup()
+	}
+	for _, op := range ops {
+		if err := server.aclSetUser(updated, op); err != nil {
+			return []byte(fmt.Sprintf("-ERR Error in ACL SETUSER modifier '%s': %v\r\n", op, err))
+		}
+	}
+
+	// the clients authenticated as the user keep it, unless subscribed to
+	// channels it no longer allows
+	if user != nil {
+		*user = *updated
+		server.aclKillPubsubClientsIfNeeded(user)
+	} else {
+		server.users[username] = updated
+	}
+	return []byte("+OK\r\n")
+}
+
+// aclMergeSelectorArguments joins the arguments of a selector given as
+// several, like "(~cache:*" "+get)"
+func aclMergeSelectorArguments(args []string) ([]string, error) {
+	ops := []string{}
+	selector := []string{}
+	for _, op := range args {
+		switch {
+		case len(selector) > 0:
+			selector = append(selector, op)
+			if strings.HasSuffix(op, ")") {
+				ops = append(ops, strings.Join(selector, " "))
+				selector = nil
+			}
+		case strings.HasPrefix(op, "(") && !strings.HasSuffix(op, ")"):
+			selector = append(selector, op)
+		default:
+			ops = append(ops, op)
+		}
+	}
+	if len(selector) > 0 {
+		return nil, fmt.Errorf("Unmatched parenthesis in acl selector starting at '%s'.", selector[0])
+	}
+	return ops, nil
+}
+
+func (server *RedisServer) addReplyAclUser(client *RedisClient, user *aclUser) []byte {
+	reply := bytes.Buffer{}
+	reply.Write(client.addReplyMapLen(6))
+	writeReplyValue(&reply, "flags")
+	writeReplyValue(&reply, user.describeFlags())
+	writeReplyValue(&reply, "passwords")
+	writeReplyValue(&reply, append([]string{}, user.passwords...))
+	writeAclSelectorFields(&reply, user.rootSelector())
+
+	writeReplyValue(&reply, "selectors")
+	reply.Write(addReplyArrayLen(len(user.selectors) - 1))
+	for _, selector := range user.selectors[1:] {
+		reply.Write(client.addReplyMapLen(3))
+		writeAclSelectorFields(&reply, selector)
+	}
+	return reply.Bytes()
+}
+
+// writeAclSelectorFields writes the fields of ACL GETUSER about what the
+// selector allows
+func writeAclSelectorFields(reply *bytes.Buffer, selector *aclSelector) {
+	for _, field := range []string{
+		"commands", selector.describeCommandRules(),
+		"keys", selector.describeKeys(),
+		"channels", selector.describeChannels(),
+	} {
+		writeReplyValue(reply, field)
+	}
+}
+
+func (server *RedisServer) aclUserNames() []string {
+	names := make([]string, 0, len(server.users))
+	for name := range server.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// disconnectAuthenticatedClients closes the clients authenticated as a user
+// that was deleted, the current one once it has its reply
+func (server *RedisServer) disconnectAuthenticatedClients(user *aclUser) {
+	server.clientsMu.Lock()
+	clients := []*RedisClient{}
+	for _, client := range server.clients {
+		if client.user == user {
+			clients = append(clients, client)
+		}
+	}
+	server.clientsMu.Unlock()
+
+	for _, client := range clients {
+		if client == server.currentClient {
+			client.Flags |= CLIENT_CLOSE_AFTER_COMMAND
+		} else {
+			client.close()
+		}
+	}
+}
+
+// aclDescribeUsers is a line per user in the format of the aclfile, the one
+// of ACL LIST
+func (server *RedisServer) aclDescribeUsers() []string {
+	lines := []string{}
+	for _, name := range server.aclUserNames() {
+		lines = append(lines, "user "+name+" "+server.users[name].describe())
+	}
+	return lines
+}
+
+// aclLoadFromFile replaces the users with the ones of the aclfile, a line
+// like "user <name> <rule> ..." each. The users are left as they were if a
+// line is wrong. Without a default user in the file, it gets the one of a
+// new server.
+func (server *RedisServer) aclLoadFromFile(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Error loading ACLs, opening file '%s': %v", path, err)
+	}
+
+	users := map[string]*aclUser{}
+	errs := []string{}
+	for i, line := range strings.Split(string(content), "\n") {
+		linenum := i + 1
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		argv, err := splitArgs(line)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s:%d: unbalanced quotes in acl line", path, linenum))
+			continue
+		}
+		if len(argv) == 0 {
+			continue
+		}
+		if argv[0] != "user" || len(argv) < 2 {
+			errs = append(errs, fmt.Sprintf("%s:%d should start with user keyword", path, linenum))
+			continue
+		}
+		name := argv[1]
+		if strings.ContainsAny(name, " \x00") {
+			errs = append(errs, fmt.Sprintf("%s:%d: username '%s' contains invalid characters", path, linenum, name))
+			continue
+		}
+		if users[name] != nil {
+			errs = append(errs, fmt.Sprintf("%s:%d: Duplicate user '%s' found", path, linenum, name))
+			continue
+		}
+
+		user, err := server.aclNewUserWithRules(name, argv[2:])
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s:%d: %v", path, linenum, err))
+			continue
+		}
+		users[name] = user
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, ". "))
+	}
+
+	if users[DEFAULT_USERNAME] == nil {
+		users[DEFAULT_USERNAME] = server.aclCreateDefaultUser()
+	}
+
+	// the users kept are updated in place, the clients authenticated as
+	// them keep them. The clients of the others are closed.
+	for name, old := range server.users {
+		if user := users[name]; user != nil {
+			*old = *user
+			users[name] = old
+			server.aclKillPubsubClientsIfNeeded(old)
+		} else {
+			server.disconnectAuthenticatedClients(old)
+		}
+	}
+	server.users = users
+	server.defaultUser = users[DEFAULT_USERNAME]
+	return nil
+}
+
+// aclNewUserWithRules is a new user with the rules, as given in an aclfile
+// or the config file
+func (server *RedisServer) aclNewUserWithRules(name string, rules []string) (*aclUser, error) {
+	ops, err := aclMergeSelectorArguments(rules)
+	if err != nil {
+		return nil, err
+	}
+	user := newAclUser(name)
+	for _, op := range ops {
+		if err := server.aclSetUser(user, op); err != nil {
+			return nil, err
+		}
+	}
+	return user, nil
+}
+
+// aclLoadConfiguredUsers creates the users of the config file. The default
+// user is replaced when it is one of them.
+func (server *RedisServer) aclLoadConfiguredUsers() error {
+	for _, argv := range server.Config.AclUsers {
+		name := argv[0]
+		if strings.ContainsAny(name, " \x00") {
+			return fmt.Errorf("Error in user declaration '%s': Usernames can't contain spaces or null characters", name)
+		}
+		user, err := server.aclNewUserWithRules(name, argv[1:])
+		if err != nil {
+			return fmt.Errorf("Error in user declaration '%s': %v", name, err)
+		}
+		if old := server.users[name]; old != nil {
+			*old = *user
+		} else {
+			server.users[name] = user
+		}
+	}
+	return nil
+}
+
+// aclSaveToFile writes the users to the aclfile, replacing it at once so a
+// crash can't leave it halfway
+func (server *RedisServer) aclSaveToFile(path string) error {
+	content := strings.Join(server.aclDescribeUsers(), "\n") + "\n"
+
+	tmpPath := filepath.Join(filepath.Dir(path), fmt.Sprintf("temp-%d-%s", os.Getpid(), filepath.Base(path)))
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(content)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return err
+}
+
+// The default of acllog-max-len
+const CONFIG_DEFAULT_ACLLOG_MAX_LEN = 128
+
+// Where the denied command was called, for ACL LOG
+const (
+	ACL_LOG_CTX_TOPLEVEL = iota
+	ACL_LOG_CTX_LUA
+	ACL_LOG_CTX_MULTI
+)
+
+// An entry is updated, rather than added, when the same denial happens
+// again within this many milliseconds
+const ACL_LOG_GROUPING_MAX_TIME_DELTA = 60000
+
+// aclLogEntry is a denial of ACL LOG, with the times it happened since
+type aclLogEntry struct {
+	count      int64
+	reason     int
+	context    int
+	object     string
+	username   string
+	ctime      time.Time // when it was created
+	lastUpdate time.Time
+	clientInfo string // the client that was denied last
+	entryID    int64
+}
+
+// addAclLogEntry logs that the client was denied, the object being the
+// command, key or channel denied, or the user of a failed AUTH
+func (server *RedisServer) addAclLogEntry(client *RedisClient, reason, context int, object, username string) {
+	now := time.Now()
+	entry := &aclLogEntry{
+		count:      1,
+		reason:     reason,
+		context:    context,
+		object:     object,
+		username:   username,
+		ctime:      now,
+		lastUpdate: now,
+		clientInfo: client.infoString(),
+	}
+
+	// the same denial happening again only updates its entry, that becomes
+	// the most recent one
+	for i, existing := range server.aclLog {
+		if existing.reason == entry.reason && existing.context == entry.context &&
+			existing.object == entry.object && existing.username == entry.username &&
+			now.Sub(existing.ctime) <= ACL_LOG_GROUPING_MAX_TIME_DELTA*time.Millisecond {
+			existing.count++
+			existing.lastUpdate = now
+			existing.clientInfo = entry.clientInfo
+			server.aclLog = append(server.aclLog[:i], server.aclLog[i+1:]...)
+			server.aclLog = append([]*aclLogEntry{existing}, server.aclLog...)
+			return
+		}
+	}
+
+	entry.entryID = server.aclLogEntryID
+	server.aclLogEntryID++
+	server.aclLog = append([]*aclLogEntry{entry}, server.aclLog...)
+	if len(server.aclLog) > server.Config.AclLogMaxLen {
+		server.aclLog = server.aclLog[:server.Config.AclLogMaxLen]
+	}
+}
+
+// addAclLogDenial logs the permission check that failed, the one of a
+// command of the client
+func (server *RedisServer) addAclLogDenial(client *RedisClient, result, context int, cmd, errArg string) {
+	object := errArg
+	if result == ACL_DENIED_CMD {
+		object = strings.ToLower(cmd)
+	}
+	server.addAclLogEntry(client, result, context, object, client.getUser().name)
+}
+
+// handleAclLogCommand is ACL LOG [count | RESET]
+func (server *RedisServer) handleAclLogCommand(client *RedisClient, args []interface{}) []byte {
+	count := int64(10)
+	if len(args) == 1 {
+		arg, _ := args[0].(string)
+		if strings.EqualFold(arg, "RESET") {
+			server.aclLog = nil
+			return []byte("+OK\r\n")
+		}
+		n, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil || n < 0 {
+			return []byte("-ERR value is out of range, must be positive\r\n")
+		}
+		count = n
+	}
+
+	entries := server.aclLog
+	if int64(len(entries)) > count {
+		entries = entries[:count]
+	}
+	now := time.Now()
+	reply := bytes.Buffer{}
+	reply.Write(addReplyArrayLen(len(entries)))
+	for _, entry := range entries {
+		reply.Write(client.addReplyMapLen(10))
+		for _, field := range []interface{}{
+			"count", entry.count,
+			"reason", aclLogReasonName(entry.reason),
+			"context", aclLogContextName(entry.context),
+			"object", entry.object,
+			"username", entry.username,
+			"age-seconds", float64(now.Sub(entry.ctime).Milliseconds()) / 1000,
+			"client-info", entry.clientInfo,
+			"entry-id", entry.entryID,
+			"timestamp-created", entry.ctime.UnixMilli(),
+			"timestamp-last-updated", entry.lastUpdate.UnixMilli(),
+		} {
+			writeReplyValue(&reply, field)
+		}
+	}
+	return reply.Bytes()
+}
+
+func aclLogReasonName(reason int) string {
+	switch reason {
+	case ACL_DENIED_CMD:
+		return "command"
+	case ACL_DENIED_KEY:
+		return "key"
+	case ACL_DENIED_CHANNEL:
+		return "channel"
+	case ACL_DENIED_AUTH:
+		return "auth"
+	}
+	return "unknown"
+}
+
+func aclLogContextName(context int) string {
+	switch context {
+	case ACL_LOG_CTX_LUA:
+		return "lua"
+	case ACL_LOG_CTX_MULTI:
+		return "multi"
+	}
+	return "toplevel"
+}
@@ -0,0 +1,727 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	AOF_FSYNC_NO       = 0
+	AOF_FSYNC_ALWAYS   = 1
+	AOF_FSYNC_EVERYSEC = 2
+)
+
+var aofFsyncNames = map[int]string{
+	AOF_FSYNC_NO:       "no",
+	AOF_FSYNC_ALWAYS:   "always",
+	AOF_FSYNC_EVERYSEC: "everysec",
+}
+
+func getAofFsyncByName(name string) int {
+	for fsync, fsyncName := range aofFsyncNames {
+		if strings.EqualFold(name, fsyncName) {
+			return fsync
+		}
+	}
+	return -1
+}
+
+// aofState is the append only file being written, the last incr file of the
+// manifest. Write commands are buffered in buf and written out before the
+// executor goes to sleep.
+type aofState struct {
+	file   *os.File
+	buf    bytes.Buffer
+	fsyncs chan *os.File
+
+	fsyncInProgress int32
+	lastFsync       time.Time
+	fsyncedSize     int64
+
+	CurrentSize  int64
+	LastWriteErr error
+	LastFsyncErr error
+
+	manifest *aofManifest
+
+	rewriteInProgress bool
+	rewriteScheduled  bool
+	RewriteBaseSize   int64
+	RewriteTimeStart  time.Time
+	RewriteTimeLast   time.Duration
+	LastBgrewriteErr  error
+}
+
+// catAppendOnlyCommand encodes the command the same way clients send it
+func catAppendOnlyCommand(buf *bytes.Buffer, cmd string, args []interface{}) {
+	buf.WriteString("*" + strconv.Itoa(len(args)+1) + "\r\n")
+	buf.WriteString("$" + strconv.Itoa(len(cmd)) + "\r\n" + cmd + "\r\n")
+	for _, arg := range args {
+		value, ok := arg.(string)
+		if !ok {
+			value = fmt.Sprint(arg)
+		}
+		buf.WriteString("$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n")
+	}
+}
+
+func (server *RedisServer) feedAppendOnlyFile(cmd string, args []interface{}) {
+	catAppendOnlyCommand(&server.aof.buf, cmd, args)
+}
+
+// Where a command is propagated
+const (
+	PROPAGATE_AOF = 1 << iota
+	PROPAGATE_REPL
+)
+
+// propagate sends a write command to the AOF and the replicas. args are only
+// read during the call, so pooled slices can be passed.
+func (server *RedisServer) propagate(cmd string, args []interface{}) {
+	server.propagateNow(cmd, args, PROPAGATE_AOF|PROPAGATE_REPL)
+}
+
+// propagateNow sends the command to the targets only, like the commands of
+// a script that called redis.set_repl
+func (server *RedisServer) propagateNow(cmd string, args []interface{}, target int) {
+	if server.loading {
+		return
+	}
+	if server.Config.AppendOnly && target&PROPAGATE_AOF != 0 {
+		server.feedAppendOnlyFile(cmd, args)
+	}
+	if server.Config.MasterHost == "" && target&PROPAGATE_REPL != 0 {
+		server.replicationFeedSlaves(cmd, args)
+	}
+}
+
+// propagateDeletion makes keys removed by expiration or eviction go away in
+// the AOF as well, as if they were deleted by a client
+func (server *RedisServer) propagateDeletion(key string, lazy bool) {
+	cmd := "DEL"
+	if lazy {
+		cmd = "UNLINK"
+	}
+	server.propagate(cmd, []interface{}{key})
+}
+
+// rewriteCommandVector replaces what gets propagated for the current command,
+// e.g. to turn relative expire times into absolute ones
+func (server *RedisServer) rewriteCommandVector(cmd string, args ...interface{}) {
+	server.propagateCmd = cmd
+	server.propagateArgs = args
+}
+
+// preventCommandPropagation keeps the current command from being propagated,
+// e.g. a script whose commands are propagated instead
+func (server *RedisServer) preventCommandPropagation() {
+	server.preventPropagation = true
+}
+
+// forceCommandPropagation propagates the current command even though the
+// dirty counter didn't grow, e.g. FLUSHALL whose save resets it
+func (server *RedisServer) forceCommandPropagation() {
+	server.forcePropagation = true
+}
+
+// openAppendOnlyFile opens the last incr file of the manifest for appending,
+// creating a new one when there is none
+func (server *RedisServer) openAppendOnlyFile() error {
+	am := server.aof.manifest
+	if am == nil {
+		am = &aofManifest{}
+	}
+
+	if len(am.incrList) == 0 {
+		am = am.dup()
+		name := server.getNewIncrAofName(am)
+		if err := server.persistAofManifest(am); err != nil {
+			return err
+		}
+		fmt.Printf("Creating AOF incr file %s on server start\n", name)
+	}
+	server.aof.manifest = am
+
+	path := server.aofFilePath(am.incrList[len(am.incrList)-1].fileName)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("can't open the append-only file %s: %w", path, err)
+	}
+
+	server.aof.file = file
+	server.aof.CurrentSize = server.aofTotalSize(am)
+	server.aof.fsyncedSize = server.aof.CurrentSize
+	server.aof.lastFsync = time.Now()
+	if am.base != nil {
+		if stat, err := os.Stat(server.aofFilePath(am.base.fileName)); err == nil {
+			server.aof.RewriteBaseSize = stat.Size()
+		}
+	}
+	if server.aof.fsyncs == nil {
+		server.aof.fsyncs = make(chan *os.File, 1)
+		go server.aofFsyncMain()
+	}
+	return nil
+}
+
+// openNewIncrAofForAppend switches writes to a new incr file, which is how a
+// rewrite separates the writes it doesn't contain from those it does
+func (server *RedisServer) openNewIncrAofForAppend() error {
+	am := server.aof.manifest.dup()
+	name := server.getNewIncrAofName(am)
+	file, err := os.OpenFile(server.aofFilePath(name), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("can't open the append-only file %s: %w", name, err)
+	}
+	if err := server.persistAofManifest(am); err != nil {
+		file.Close()
+		os.Remove(server.aofFilePath(name))
+		return err
+	}
+
+	// everything buffered so far belongs to the previous file
+	server.flushAppendOnlyFile()
+	server.aof.file.Close()
+	server.aof.file = file
+	server.aof.manifest = am
+	return nil
+}
+
+// aofFsyncMain runs the everysec fsyncs, so a slow disk doesn't stall the executor
+func (server *RedisServer) aofFsyncMain() {
+	for file := range server.aof.fsyncs {
+		server.faults.delayFsync()
+		err := file.Sync()
+		atomic.StoreInt32(&server.aof.fsyncInProgress, 0)
+		server.runOnExecutor(func() {
+			if err != nil {
+				fmt.Println("Error syncing the AOF file:", err)
+			}
+			server.aof.LastFsyncErr = err
+		})
+	}
+}
+
+func (server *RedisServer) aofBackgroundFsync() {
+	atomic.StoreInt32(&server.aof.fsyncInProgress, 1)
+	server.aof.fsyncs <- server.aof.file
+	server.aof.lastFsync = time.Now()
+	server.aof.fsyncedSize = server.aof.CurrentSize
+}
+
+// flushAppendOnlyFile writes the buffered commands and fsyncs according to
+// appendfsync. With "always" it runs before the replies are sent, so an
+// acknowledged write is on disk.
+func (server *RedisServer) flushAppendOnlyFile() {
+	aof := &server.aof
+	if aof.file == nil {
+		return
+	}
+
+	if aof.buf.Len() > 0 {
+		start := time.Now()
+		n, err := aof.file.Write(aof.buf.Bytes())
+		server.latencyAddSampleIfNeeded("aof-write", time.Since(start))
+		aof.CurrentSize += int64(n)
+		aof.buf.Next(n)
+		if err != nil {
+			if aof.LastWriteErr == nil {
+				fmt.Println("Error writing to the AOF file:", err)
+			}
+			if server.Config.AppendFsync == AOF_FSYNC_ALWAYS {
+				fmt.Println("Can't recover from AOF write error when the AOF fsync policy is 'always'. Exiting...")
+				os.Exit(1)
+			}
+			// the rest of the buffer is retried by the next flush
+			aof.LastWriteErr = err
+			return
+		}
+		if aof.LastWriteErr != nil {
+			fmt.Println("AOF write error looks solved, Redis can write again.")
+			aof.LastWriteErr = nil
+		}
+		aof.buf.Reset()
+	}
+
+	if aof.fsyncedSize == aof.CurrentSize {
+		return
+	}
+
+	switch server.Config.AppendFsync {
+	case AOF_FSYNC_ALWAYS:
+		start := time.Now()
+		server.faults.delayFsync()
+		if err := aof.file.Sync(); err != nil {
+			fmt.Println("Can't persist AOF for fsync error when the AOF fsync policy is 'always':", err)
+			os.Exit(1)
+		}
+		server.latencyAddSampleIfNeeded("aof-fsync-always", time.Since(start))
+		aof.lastFsync = time.Now()
+		aof.fsyncedSize = aof.CurrentSize
+	case AOF_FSYNC_EVERYSEC:
+		if time.Since(aof.lastFsync) >= time.Second && atomic.LoadInt32(&aof.fsyncInProgress) == 0 {
+			server.aofBackgroundFsync()
+		}
+	}
+}
+
+// writeCommandsDeniedByDiskError reports why write commands must be refused
+// because persistence is failing, or "" if they are accepted
+func (server *RedisServer) writeCommandsDeniedByDiskError() string {
+	if !server.Config.AppendOnly {
+		return ""
+	}
+
+	err := server.aof.LastWriteErr
+	if err == nil {
+		err = server.aof.LastFsyncErr
+	}
+	if err != nil {
+		return fmt.Sprintf("-MISCONF Errors writing to the AOF file: %s\r\n", err)
+	}
+	return ""
+}
+
+// countingReader counts the bytes read from the file, to know where the last
+// complete command of a truncated AOF ends
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// loadAppendOnlyFiles loads the base and the incr files listed in the
+// manifest. A missing manifest is an empty dataset, unless there is an AOF
+// written before the multi-part layout, which is upgraded.
+func (server *RedisServer) loadAppendOnlyFiles() error {
+	am, err := server.aofLoadManifestFromDisk()
+	if err != nil {
+		return err
+	}
+	if am == nil {
+		if am, err = server.aofUpgradePrepare(); err != nil {
+			return err
+		}
+	}
+	if am == nil {
+		return nil
+	}
+	server.aof.manifest = am
+
+	files := []*aofInfo{}
+	if am.base != nil {
+		files = append(files, am.base)
+	}
+	files = append(files, am.incrList...)
+
+	// replaying is not a change to the dataset
+	server.startLoading(server.aofTotalSize(am))
+	defer func() {
+		server.stopLoading()
+		server.Dirty = 0
+	}()
+
+	for i, info := range files {
+		last := i == len(files)-1
+		if err := server.loadSingleAppendOnlyFile(server.aofFilePath(info.fileName), last); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadSingleAppendOnlyFile replays the commands of one AOF file. When the
+// last file ends in the middle of a command, as after a crash during a
+// write, aof-load-truncated cuts it back to the last complete command.
+func (server *RedisServer) loadSingleAppendOnlyFile(filename string, last bool) error {
+	file, err := os.Open(filename)
+	if errors.Is(err, os.ErrNotExist) && last {
+		// the incr file is created lazily, it may not exist yet
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("can't open the append-only file %s: %w", filename, err)
+	}
+	defer file.Close()
+
+	counter := &countingReader{r: file}
+	reader := bufio.NewReader(counter)
+	valid := int64(0)
+	// where this file starts in the loading progress
+	base := server.loadingLoadedBytes
+
+	// the commands of a transaction are held until its EXEC, so one cut
+	// by a crash is dropped as a whole
+	var multi []multiCmd
+	inMulti := false
+	validBeforeMulti := int64(0)
+	defer func() {
+		for _, queued := range multi {
+			putArgs(queued.args)
+		}
+	}()
+
+	for {
+		prefix, err := reader.Peek(1)
+		if err == io.EOF {
+			if inMulti {
+				fmt.Println("Revert incomplete MULTI/EXEC transaction in AOF file")
+				return server.aofTruncated(filename, validBeforeMulti, last)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if prefix[0] == 'R' && valid == 0 {
+			if err := server.loadAofRdbPreamble(reader, filename); err != nil {
+				return err
+			}
+			valid = counter.n - int64(reader.Buffered())
+			continue
+		}
+		if prefix[0] != '*' {
+			return fmt.Errorf("bad file format reading the append only file %s", filename)
+		}
+
+		cmd, args, err := readCommand(reader, PROTO_UNLIMITED_BULK_LEN)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			if inMulti {
+				fmt.Println("Revert incomplete MULTI/EXEC transaction in AOF file")
+				valid = validBeforeMulti
+			}
+			return server.aofTruncated(filename, valid, last)
+		}
+		if err != nil {
+			return fmt.Errorf("bad file format reading the append only file %s: %w", filename, err)
+		}
+		previous := valid
+		valid = counter.n - int64(reader.Buffered())
+
+		switch {
+		case cmd == "MULTI" && !inMulti:
+			inMulti = true
+			validBeforeMulti = previous
+			putArgs(args)
+			continue
+		case cmd == "EXEC" && inMulti:
+			for _, queued := range multi {
+				queued.command.Function(server, queued.cmd, queued.args)
+				putArgs(queued.args)
+			}
+			multi = multi[:0]
+			inMulti = false
+			putArgs(args)
+			server.loadingAbsProgress(base + valid)
+			continue
+		}
+
+		if cmd == "SELECT" {
+			if len(args) != 1 || args[0] != "0" {
+				putArgs(args)
+				return fmt.Errorf("the append only file %s selects a database other than 0", filename)
+			}
+			putArgs(args)
+			continue
+		}
+
+		command, ok := redisCommandTable[cmd]
+		if !ok {
+			putArgs(args)
+			return fmt.Errorf("unknown command '%s' reading the append only file %s", cmd, filename)
+		}
+		if inMulti {
+			multi = append(multi, multiCmd{command: command, cmd: cmd, args: args})
+			continue
+		}
+		command.Function(server, cmd, args)
+		putArgs(args)
+		server.loadingAbsProgress(base + valid)
+	}
+}
+
+// loadAofRdbPreamble loads the RDB payload a base file starts with when it was
+// written with aof-use-rdb-preamble
+func (server *RedisServer) loadAofRdbPreamble(reader *bufio.Reader, filename string) error {
+	signature, err := reader.Peek(5)
+	if err != nil || string(signature) != "REDIS" {
+		return fmt.Errorf("bad file format reading the append only file %s", filename)
+	}
+
+	fmt.Println("Reading RDB base file on AOF loading...")
+	if err := server.rdbLoadRio(reader); err != nil {
+		return fmt.Errorf("error reading the RDB base file %s, AOF loading aborted: %w", filename, err)
+	}
+	fmt.Println("Reading the remaining AOF tail...")
+	return nil
+}
+
+func (server *RedisServer) aofTruncated(filename string, valid int64, last bool) error {
+	fmt.Printf("!!! Warning: short read while loading the AOF file %s!!!\n", filename)
+	if !last || !server.Config.AofLoadTruncated {
+		return fmt.Errorf("unexpected end of file reading the append only file %s. "+
+			"You can: 1) Make a backup of your AOF file, then use ./redis-check-aof --fix <filename.manifest>. "+
+			"2) Alternatively you can set the 'aof-load-truncated' configuration option to yes and restart the server", filename)
+	}
+
+	if err := os.Truncate(filename, valid); err != nil {
+		return fmt.Errorf("error truncating the AOF file %s: %w", filename, err)
+	}
+	fmt.Printf("AOF %s loaded anyway because aof-load-truncated is enabled\n", filename)
+	return nil
+}
+
+// Rewritten collections are split in commands of at most this many items
+const AOF_REWRITE_ITEMS_PER_CMD = 64
+
+func (server *RedisServer) rewriteTempFilename() string {
+	return filepath.Join(server.Config.Dir, fmt.Sprintf("%srewriteaof-bg-%d.aof", TEMP_FILE_NAME_PREFIX, os.Getpid()))
+}
+
+// rewriteObject emits the shortest commands that recreate the key
+func rewriteObject(buf *bytes.Buffer, key string, obj *RedisObject) error {
+	batch := func(cmd string, items []string, itemsPerArg int) {
+		per := AOF_REWRITE_ITEMS_PER_CMD * itemsPerArg
+		for start := 0; start < len(items); start += per {
+			end := start + per
+			if end > len(items) {
+				end = len(items)
+			}
+			args := make([]interface{}, 0, end-start+1)
+			args = append(args, key)
+			for _, item := range items[start:end] {
+				args = append(args, item)
+			}
+			catAppendOnlyCommand(buf, cmd, args)
+		}
+	}
+
+	switch value := obj.Value.(type) {
+	case string:
+		catAppendOnlyCommand(buf, "SET", []interface{}{key, value})
+	case []string:
+		batch("RPUSH", value, 1)
+	case map[string]struct{}:
+		members := make([]string, 0, len(value))
+		for member := range value {
+			members = append(members, member)
+		}
+		batch("SADD", members, 1)
+	case map[string]float64:
+		items := make([]string, 0, len(value)*2)
+		for member, score := range value {
+			items = append(items, strconv.FormatFloat(score, 'g', 17, 64), member)
+		}
+		batch("ZADD", items, 2)
+	case map[string]string:
+		items := make([]string, 0, len(value)*2)
+		for field, v := range value {
+			items = append(items, field, v)
+		}
+		batch("HSET", items, 2)
+	default:
+		return fmt.Errorf("can't rewrite key %s of type %s as commands", key, getObjectTypeName(obj))
+	}
+	return nil
+}
+
+// rewriteAppendOnlyFile writes the snapshot either as an RDB payload, which
+// loads much faster, or as the commands that rebuild it
+func rewriteAppendOnlyFile(filename string, snapshot rdbSnapshot, preamble bool) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("opening the temp file for AOF rewrite failed: %w", err)
+	}
+
+	w := bufio.NewWriter(file)
+	if preamble {
+		snapshot.aofBase = true
+		rdb := &rdbWriter{w: w, compression: snapshot.compression}
+		err = rdb.saveSnapshot(&snapshot)
+	} else {
+		buf := &bytes.Buffer{}
+		for _, code := range snapshot.functions {
+			catAppendOnlyCommand(buf, "FUNCTION", []interface{}{"LOAD", code})
+		}
+		_, err = w.Write(buf.Bytes())
+		if err == nil {
+			snapshot.storage.Range(func(key string, obj *RedisObject) bool {
+				buf.Reset()
+				if err = rewriteObject(buf, key, obj); err != nil {
+					return false
+				}
+				if when, ok := snapshot.expirations.Get(key); ok {
+					catAppendOnlyCommand(buf, "PEXPIREAT", []interface{}{key, strconv.FormatInt(when.UnixMilli(), 10)})
+				}
+				_, err = w.Write(buf.Bytes())
+				return err == nil
+			})
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(filename)
+	}
+	return err
+}
+
+// rewriteAppendOnlyFileBackground writes a compact base file from a snapshot
+// of the keyspace. Writes go to a new incr file from now on, so once the new
+// base is in place the older incr files are no longer needed.
+func (server *RedisServer) rewriteAppendOnlyFileBackground() error {
+	if server.aof.rewriteInProgress {
+		return errors.New("background append only file rewriting already in progress")
+	}
+
+	if server.aof.file != nil {
+		if err := server.openNewIncrAofForAppend(); err != nil {
+			return err
+		}
+	}
+
+	start := time.Now()
+	snapshot := server.newRdbSnapshot()
+	server.latencyAddSampleIfNeeded("fork", time.Since(start))
+	server.aof.rewriteInProgress = true
+	server.aof.RewriteTimeStart = time.Now()
+	tmpfile := server.rewriteTempFilename()
+	preamble := server.Config.AofUseRdbPreamble
+	fmt.Println("Background append only file rewriting started")
+
+	go func() {
+		err := rewriteAppendOnlyFile(tmpfile, snapshot, preamble)
+		server.runOnExecutor(func() {
+			snapshot.release()
+			server.backgroundRewriteDoneHandler(tmpfile, err)
+		})
+	}()
+	return nil
+}
+
+func (server *RedisServer) backgroundRewriteDoneHandler(tmpfile string, err error) {
+	aof := &server.aof
+	aof.rewriteInProgress = false
+	aof.RewriteTimeLast = time.Since(aof.RewriteTimeStart)
+
+	am := &aofManifest{}
+	if aof.manifest != nil {
+		am = aof.manifest.dup()
+	}
+	var newBase string
+	if err == nil {
+		newBase = server.getNewBaseFileNameAndMarkPreAsHistory(am)
+		markRewrittenIncrAofAsHistory(am)
+		err = os.MkdirAll(server.aofDirPath(), 0755)
+	}
+	if err == nil {
+		err = os.Rename(tmpfile, server.aofFilePath(newBase))
+	}
+	if err == nil {
+		if err = server.persistAofManifest(am); err != nil {
+			os.Remove(server.aofFilePath(newBase))
+		}
+	}
+	if err != nil {
+		fmt.Println("Background AOF rewrite terminated with error:", err)
+		os.Remove(tmpfile)
+		aof.LastBgrewriteErr = err
+		return
+	}
+
+	aof.manifest = am
+	server.aofDelHistoryFiles()
+	if stat, err := os.Stat(server.aofFilePath(newBase)); err == nil {
+		aof.RewriteBaseSize = stat.Size()
+	}
+	aof.CurrentSize = server.aofTotalSize(am)
+	aof.LastBgrewriteErr = nil
+	fmt.Println("Background AOF rewrite finished successfully")
+}
+
+// rewriteAppendOnlyFileIfGrown starts a rewrite once the AOF grew by
+// auto-aof-rewrite-percentage since the last rewrite
+func (server *RedisServer) rewriteAppendOnlyFileIfGrown() {
+	aof := &server.aof
+	perc := server.Config.AutoAofRewritePercentage
+	if !server.Config.AppendOnly || aof.rewriteInProgress || perc == 0 || aof.CurrentSize <= server.Config.AutoAofRewriteMinSize {
+		return
+	}
+
+	base := aof.RewriteBaseSize
+	if base == 0 {
+		base = 1
+	}
+	growth := aof.CurrentSize*100/base - 100
+	if growth >= int64(perc) {
+		fmt.Printf("Starting automatic rewriting of AOF on %d%% growth\n", growth)
+		server.rewriteAppendOnlyFileBackground()
+	}
+}
+
+// startAppendOnly turns the AOF on at runtime. The files have none of the
+// data so far, a rewrite writes it as the base.
+func (server *RedisServer) startAppendOnly() error {
+	if err := server.openAppendOnlyFile(); err != nil {
+		return err
+	}
+	if server.aof.rewriteInProgress {
+		// that one started before the writes went to the file
+		server.aof.rewriteScheduled = true
+		return nil
+	}
+	if err := server.rewriteAppendOnlyFileBackground(); err != nil {
+		server.aof.file.Close()
+		server.aof.file = nil
+		return fmt.Errorf("Redis needs to enable the AOF but can't trigger a background AOF rewrite operation: %w", err)
+	}
+	return nil
+}
+
+// stopAppendOnly turns the AOF off at runtime, with what was written so
+// far on disk
+func (server *RedisServer) stopAppendOnly() {
+	server.flushAppendOnlyFile()
+	if err := server.aof.file.Sync(); err != nil {
+		fmt.Println("Error syncing the AOF file:", err)
+	}
+	server.aof.file.Close()
+	server.aof.file = nil
+	server.aof.buf.Reset()
+	server.aof.rewriteScheduled = false
+}
+
+func (server *RedisServer) handleBgrewriteaofCommand(cmd string, args []interface{}) []byte {
+	if len(args) != 0 {
+		return addReplyErrorArity()
+	}
+
+	if server.aof.rewriteInProgress {
+		return []byte("-ERR Background append only file rewriting already in progress\r\n")
+	}
+	if err := server.rewriteAppendOnlyFileBackground(); err != nil {
+		return []byte(fmt.Sprintf("-ERR %s\r\n", err))
+	}
+	return []byte("+Background append only file rewriting started\r\n")
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	AOF_FILE_TYPE_BASE = 'b'
+	AOF_FILE_TYPE_HIST = 'h'
+	AOF_FILE_TYPE_INCR = 'i'
+
+	BASE_FILE_SUFFIX      = ".base"
+	INCR_FILE_SUFFIX      = ".incr"
+	AOF_FORMAT_SUFFIX     = ".aof"
+	RDB_FORMAT_SUFFIX     = ".rdb"
+	MANIFEST_NAME_SUFFIX  = ".manifest"
+	TEMP_FILE_NAME_PREFIX = "temp-"
+)
+
+type aofInfo struct {
+	fileName string
+	fileSeq  int64
+	fileType byte
+}
+
+// aofManifest lists the files that make up the AOF in appenddirname: one base
+// file written by a rewrite, followed by the incr files that received the
+// writes since then. History files are left overs of older rewrites that
+// are deleted once the manifest no longer references them.
+type aofManifest struct {
+	base        *aofInfo
+	incrList    []*aofInfo
+	historyList []*aofInfo
+	currBaseSeq int64
+	currIncrSeq int64
+}
+
+// dup deep copies the manifest, changes are made on a copy that only replaces
+// the current manifest once it has been persisted
+func (am *aofManifest) dup() *aofManifest {
+	dupList := func(list []*aofInfo) []*aofInfo {
+		dup := make([]*aofInfo, 0, len(list))
+		for _, info := range list {
+			infoCopy := *info
+			dup = append(dup, &infoCopy)
+		}
+		return dup
+	}
+
+	dup := *am
+	if am.base != nil {
+		base := *am.base
+		dup.base = &base
+	}
+	dup.incrList = dupList(am.incrList)
+	dup.historyList = dupList(am.historyList)
+	return &dup
+}
+
+func (am *aofManifest) String() string {
+	var b strings.Builder
+	write := func(info *aofInfo) {
+		fmt.Fprintf(&b, "file %s seq %d type %c\n", info.fileName, info.fileSeq, info.fileType)
+	}
+	if am.base != nil {
+		write(am.base)
+	}
+	for _, info := range am.historyList {
+		write(info)
+	}
+	for _, info := range am.incrList {
+		write(info)
+	}
+	return b.String()
+}
+
+func (server *RedisServer) aofDirPath() string {
+	return filepath.Join(server.Config.Dir, server.Config.AppendDirname)
+}
+
+func (server *RedisServer) aofFilePath(name string) string {
+	return filepath.Join(server.aofDirPath(), name)
+}
+
+func (server *RedisServer) aofManifestName() string {
+	return server.Config.AppendFilename + MANIFEST_NAME_SUFFIX
+}
+
+// aofLoadManifestFromDisk parses the manifest, returning nil if there is none
+func (server *RedisServer) aofLoadManifestFromDisk() (*aofManifest, error) {
+	path := server.aofFilePath(server.aofManifestName())
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't open the AOF manifest %s: %w", path, err)
+	}
+	defer file.Close()
+
+	am := &aofManifest{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields)%2 != 0 {
+			return nil, fmt.Errorf("invalid AOF manifest line: %s", line)
+		}
+		info := &aofInfo{}
+		for i := 0; i < len(fields); i += 2 {
+			switch fields[i] {
+			case "file":
+				info.fileName = fields[i+1]
+			case "seq":
+				info.fileSeq, err = strconv.ParseInt(fields[i+1], 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("invalid AOF manifest line: %s", line)
+				}
+			case "type":
+				info.fileType = fields[i+1][0]
+			}
+		}
+		if info.fileName == "" || filepath.Base(info.fileName) != info.fileName {
+			return nil, fmt.Errorf("invalid AOF file name in the manifest: %s", line)
+		}
+
+		switch info.fileType {
+		case AOF_FILE_TYPE_BASE:
+			if am.base != nil {
+				return nil, errors.New("found duplicate base file information in the AOF manifest")
+			}
+			am.base = info
+			am.currBaseSeq = info.fileSeq
+		case AOF_FILE_TYPE_HIST:
+			am.historyList = append(am.historyList, info)
+		case AOF_FILE_TYPE_INCR:
+			if info.fileSeq <= am.currIncrSeq {
+				return nil, errors.New("found a non-monotonic sequence number in the AOF manifest")
+			}
+			am.incrList = append(am.incrList, info)
+			am.currIncrSeq = info.fileSeq
+		default:
+			return nil, fmt.Errorf("unknown AOF file type in the manifest: %s", line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return am, nil
+}
+
+// persistAofManifest writes the manifest to a temp file and renames it into
+// place, so a crash never leaves a half written manifest
+func (server *RedisServer) persistAofManifest(am *aofManifest) error {
+	if err := os.MkdirAll(server.aofDirPath(), 0755); err != nil {
+		return fmt.Errorf("can't create the AOF directory %s: %w", server.aofDirPath(), err)
+	}
+
+	tmpPath := server.aofFilePath(TEMP_FILE_NAME_PREFIX + server.aofManifestName())
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("can't open the AOF manifest %s: %w", tmpPath, err)
+	}
+	_, err = file.WriteString(am.String())
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, server.aofFilePath(server.aofManifestName()))
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("can't persist the AOF manifest: %w", err)
+	}
+	return nil
+}
+
+// getNewBaseFileNameAndMarkPreAsHistory names the base file of a rewrite and
+// turns the current base into a history file. With aof-use-rdb-preamble the
+// base is an RDB file.
+func (server *RedisServer) getNewBaseFileNameAndMarkPreAsHistory(am *aofManifest) string {
+	if am.base != nil {
+		am.base.fileType = AOF_FILE_TYPE_HIST
+		am.historyList = append(am.historyList, am.base)
+	}
+
+	am.currBaseSeq++
+	format := AOF_FORMAT_SUFFIX
+	if server.Config.AofUseRdbPreamble {
+		format = RDB_FORMAT_SUFFIX
+	}
+	name := fmt.Sprintf("%s.%d%s%s", server.Config.AppendFilename, am.currBaseSeq, BASE_FILE_SUFFIX, format)
+	am.base = &aofInfo{fileName: name, fileSeq: am.currBaseSeq, fileType: AOF_FILE_TYPE_BASE}
+	return name
+}
+
+func (server *RedisServer) getNewIncrAofName(am *aofManifest) string {
+	am.currIncrSeq++
+	name := fmt.Sprintf("%s.%d%s%s", server.Config.AppendFilename, am.currIncrSeq, INCR_FILE_SUFFIX, AOF_FORMAT_SUFFIX)
+	am.incrList = append(am.incrList, &aofInfo{fileName: name, fileSeq: am.currIncrSeq, fileType: AOF_FILE_TYPE_INCR})
+	return name
+}
+
+// markRewrittenIncrAofAsHistory moves every incr file but the last one, which
+// receives the writes made since the rewrite started, to the history list
+func markRewrittenIncrAofAsHistory(am *aofManifest) {
+	if len(am.incrList) <= 1 {
+		return
+	}
+	last := len(am.incrList) - 1
+	for _, info := range am.incrList[:last] {
+		info.fileType = AOF_FILE_TYPE_HIST
+		am.historyList = append(am.historyList, info)
+	}
+	am.incrList = am.incrList[last:]
+}
+
+// aofDelHistoryFiles removes the files of older rewrites
+func (server *RedisServer) aofDelHistoryFiles() {
+	am := server.aof.manifest
+	if am == nil || len(am.historyList) == 0 {
+		return
+	}
+
+	for _, info := range am.historyList {
+		fmt.Printf("Removing the history file %s in the background\n", info.fileName)
+		os.Remove(server.aofFilePath(info.fileName))
+	}
+	am.historyList = nil
+	if err := server.persistAofManifest(am); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// aofUpgradePrepare moves a pre multi-part AOF into appenddirname as the base
+// file of a new manifest
+func (server *RedisServer) aofUpgradePrepare() (*aofManifest, error) {
+	legacy := filepath.Join(server.Config.Dir, server.Config.AppendFilename)
+	if _, err := os.Stat(legacy); err != nil {
+		return nil, nil
+	}
+
+	am := &aofManifest{
+		base:        &aofInfo{fileName: server.Config.AppendFilename, fileSeq: 1, fileType: AOF_FILE_TYPE_BASE},
+		currBaseSeq: 1,
+	}
+	if err := os.MkdirAll(server.aofDirPath(), 0755); err != nil {
+		return nil, fmt.Errorf("can't create the AOF directory %s: %w", server.aofDirPath(), err)
+	}
+	if err := server.persistAofManifest(am); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(legacy, server.aofFilePath(server.Config.AppendFilename)); err != nil {
+		return nil, fmt.Errorf("can't move the old AOF file %s into %s: %w", legacy, server.aofDirPath(), err)
+	}
+	fmt.Printf("Successfully migrated an old-style AOF into the AOF directory %s\n", server.aofDirPath())
+	return am, nil
+}
+
+// aofTotalSize is the size of the base and all incr files
+func (server *RedisServer) aofTotalSize(am *aofManifest) int64 {
+	total := int64(0)
+	files := append([]*aofInfo{}, am.incrList...)
+	if am.base != nil {
+		files = append(files, am.base)
+	}
+	for _, info := range files {
+		if stat, err := os.Stat(server.aofFilePath(info.fileName)); err == nil {
+			total += stat.Size()
+		}
+	}
+	return total
+}
@@ -0,0 +1,234 @@
+package main
+
+import "time"
+
+// What a blocked client waits for
+const (
+	BLOCKED_NONE     = iota
+	BLOCKED_WAIT     // replicas acknowledging its writes, for WAIT
+	BLOCKED_POSTPONE // the end of a pause, to run its command
+	BLOCKED_SHUTDOWN // the replicas catching up, for SHUTDOWN
+	BLOCKED_NUM
+)
+
+// Commands held while the clients are paused
+const (
+	CLIENT_PAUSE_OFF   = iota
+	CLIENT_PAUSE_WRITE // the ones that may change the dataset
+	CLIENT_PAUSE_ALL
+)
+
+// Why the clients are paused, each pause ends on its own and the strictest
+// one of those in effect holds
+const (
+	PAUSE_BY_CLIENT_COMMAND = iota
+	PAUSE_DURING_FAILOVER
+	PAUSE_DURING_SHUTDOWN
+	NUM_PAUSE_PURPOSES
+)
+
+type pauseEvent struct {
+	ptype int
+	end   time.Time // zero lasts until it is unpaused
+}
+
+// blockingState describes why a client is blocked. While it is blocked the
+// commands it sends are queued, they run in order once it is unblocked.
+type blockingState struct {
+	btype   int
+	timeout time.Time // zero blocks forever
+
+	// BLOCKED_WAIT
+	reploffset  int64
+	numreplicas int
+}
+
+// blockClient stops running the commands of the client, which gets no reply
+// until it is unblocked or the timeout elapses
+func (server *RedisServer) blockClient(client *RedisClient, btype int, timeout time.Time) {
+	client.Flags |= CLIENT_BLOCKED
+	client.bstate.btype = btype
+	client.bstate.timeout = timeout
+	server.blockedClients = append(server.blockedClients, client)
+	server.blockedClientsByType[btype]++
+
+	if btype == BLOCKED_WAIT {
+		server.clientsWaitingAcks = append(server.clientsWaitingAcks, client)
+	}
+}
+
+// unblockClient sends the reply the client waited for. The commands it sent
+// meanwhile run from processUnblockedClients.
+func (server *RedisServer) unblockClient(client *RedisClient, reply []byte) {
+	if client.Flags&CLIENT_BLOCKED == 0 {
+		return
+	}
+
+	if client.bstate.btype == BLOCKED_WAIT {
+		server.clientsWaitingAcks = removeClientFromList(server.clientsWaitingAcks, client)
+	}
+	server.blockedClients = removeClientFromList(server.blockedClients, client)
+	server.blockedClientsByType[client.bstate.btype]--
+	client.Flags &^= CLIENT_BLOCKED
+	client.bstate = blockingState{}
+
+	if reply != nil {
+		client.addReply(reply)
+	}
+	server.unblockedClients = append(server.unblockedClients, client)
+}
+
+// unblockClientOnRequest releases a client blocked by a command, as if its
+// timeout elapsed or with an error. Clients held by a pause or a shutdown
+// stay blocked.
+func (server *RedisServer) unblockClientOnRequest(client *RedisClient, withError bool) bool {
+	if client.Flags&CLIENT_BLOCKED == 0 || client.bstate.btype == BLOCKED_POSTPONE || client.bstate.btype == BLOCKED_SHUTDOWN {
+		return false
+	}
+	if withError {
+		server.unblockClient(client, []byte("-UNBLOCKED client unblocked via CLIENT UNBLOCK\r\n"))
+	} else {
+		server.unblockClient(client, server.replyToBlockedClientTimedOut(client))
+	}
+	return true
+}
+
+// replyToBlockedClientTimedOut is the reply of a client whose timeout elapsed
+func (server *RedisServer) replyToBlockedClientTimedOut(client *RedisClient) []byte {
+	switch client.bstate.btype {
+	case BLOCKED_WAIT:
+		return addReplyLongLong(int64(server.replicationCountAcksByOffset(client.bstate.reploffset)))
+	}
+	return nil
+}
+
+// handleBlockedClientsTimeout is called by serverCron to unblock the clients
+// whose timeout elapsed, along with the ones that disconnected meanwhile
+func (server *RedisServer) handleBlockedClientsTimeout() {
+	if len(server.blockedClients) == 0 {
+		return
+	}
+
+	now := time.Now()
+	blocked := append([]*RedisClient(nil), server.blockedClients...)
+	for _, client := range blocked {
+		timeout := client.bstate.timeout
+		if client.isClosed() || (!timeout.IsZero() && !now.Before(timeout)) {
+			server.unblockClient(client, server.replyToBlockedClientTimedOut(client))
+		}
+	}
+	server.processUnblockedClients()
+}
+
+// processUnblockedClients runs the commands the unblocked clients sent while
+// they were blocked, until a client blocks again
+func (server *RedisServer) processUnblockedClients() {
+	for len(server.unblockedClients) > 0 {
+		client := server.unblockedClients[0]
+		server.unblockedClients[0] = nil
+		server.unblockedClients = server.unblockedClients[1:]
+
+		deferred := client.deferred
+		client.deferred = nil
+		for i, commandRequest := range deferred {
+			if client.isClosed() {
+				putArgs(commandRequest.Args)
+				continue
+			}
+			if client.Flags&CLIENT_BLOCKED != 0 {
+				client.deferred = append(client.deferred, deferred[i:]...)
+				break
+			}
+			server.processCommand(commandRequest)
+		}
+	}
+}
+
+func removeClientFromList(list []*RedisClient, client *RedisClient) []*RedisClient {
+	for i, c := range list {
+		if c == client {
+			copy(list[i:], list[i+1:])
+			list[len(list)-1] = nil
+			return list[:len(list)-1]
+		}
+	}
+	return list
+}
+
+// pauseClients holds the commands of the clients, other than our master and
+// replicas, until end or until unpauseClients is called for the purpose. A
+// pause for the same purpose replaces the previous one, unless that one was
+// stricter or lasts longer.
+func (server *RedisServer) pauseClients(purpose int, end time.Time, ptype int) {
+	event := &server.clientPauseEvents[purpose]
+	if event.ptype != CLIENT_PAUSE_OFF {
+		if event.ptype > ptype {
+			ptype = event.ptype
+		}
+		if event.end.IsZero() || (!end.IsZero() && event.end.After(end)) {
+			end = event.end
+		}
+	}
+	*event = pauseEvent{ptype: ptype, end: end}
+	server.updatePausedActions()
+}
+
+// unpauseClients ends the pause of the purpose, the commands held run unless
+// another pause still holds them
+func (server *RedisServer) unpauseClients(purpose int) {
+	server.clientPauseEvents[purpose] = pauseEvent{}
+	server.updatePausedActions()
+}
+
+// updatePausedActions sets the pause in effect from the ones of all the
+// purposes, and runs the commands it no longer holds
+func (server *RedisServer) updatePausedActions() {
+	ptype := CLIENT_PAUSE_OFF
+	for _, event := range server.clientPauseEvents {
+		if event.ptype > ptype {
+			ptype = event.ptype
+		}
+	}
+	if ptype >= server.clientPauseType {
+		server.clientPauseType = ptype
+		return
+	}
+	server.clientPauseType = ptype
+
+	blocked := append([]*RedisClient(nil), server.blockedClients...)
+	for _, client := range blocked {
+		if client.bstate.btype != BLOCKED_POSTPONE || len(client.deferred) == 0 {
+			continue
+		}
+		if !server.isCommandPaused(client, client.deferred[0].Cmd) {
+			server.unblockClient(client, nil)
+		}
+	}
+}
+
+// checkClientPauseTimeout is called by serverCron to end the pauses whose
+// time elapsed
+func (server *RedisServer) checkClientPauseTimeout() {
+	now := time.Now()
+	for purpose, event := range server.clientPauseEvents {
+		if event.ptype != CLIENT_PAUSE_OFF && !event.end.IsZero() && !now.Before(event.end) {
+			server.unpauseClients(purpose)
+		}
+	}
+}
+
+// isCommandPaused tells if the current pause holds the command of the client
+func (server *RedisServer) isCommandPaused(client *RedisClient, cmd string) bool {
+	if server.clientPauseType == CLIENT_PAUSE_OFF || client.Flags&(CLIENT_MASTER|CLIENT_SLAVE) != 0 {
+		return false
+	}
+	if server.clientPauseType == CLIENT_PAUSE_ALL {
+		return true
+	}
+	// EXEC is held when one of the commands it runs would be
+	if cmd == "EXEC" {
+		return client.mstate.cmdFlags&CMD_WRITE != 0
+	}
+	command, ok := redisCommandTable[cmd]
+	return ok && command.CmdFlags&CMD_WRITE != 0
+}
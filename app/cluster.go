@@ -0,0 +1,1371 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The keys are sharded in 16384 hash slots, each served by one master of
+// the cluster. A node only runs the commands on the keys of its slots, the
+// clients are redirected to the owner of the others.
+const CLUSTER_SLOTS = 16384
+
+const (
+	CLUSTER_OK = iota
+	CLUSTER_FAIL
+)
+
+const (
+	CLUSTER_NODE_MASTER    = 1 << iota
+	CLUSTER_NODE_SLAVE     // a replica of slaveof
+	CLUSTER_NODE_PFAIL     // failing to our knowledge
+	CLUSTER_NODE_FAIL      // failing by agreement of the masters
+	CLUSTER_NODE_MYSELF    // this node
+	CLUSTER_NODE_HANDSHAKE // met but not yet answered
+	CLUSTER_NODE_NOADDR    // address unknown
+	CLUSTER_NODE_MEET      // to send a MEET rather than a PING
+)
+
+// why getNodeByQuery refused a command, see clusterRedirectClient
+const (
+	CLUSTER_REDIR_NONE = iota
+	CLUSTER_REDIR_UNSTABLE
+	CLUSTER_REDIR_ASK
+	CLUSTER_REDIR_MOVED
+	CLUSTER_REDIR_DOWN_STATE
+	CLUSTER_REDIR_DOWN_RO_STATE
+	CLUSTER_REDIR_DOWN_UNBOUND
+	CLUSTER_REDIR_CROSS_SLOT
+)
+
+// things to do before sleeping, once for all the changes of an event loop
+const (
+	CLUSTER_TODO_HANDLE_FAILOVER = 1 << iota
+	CLUSTER_TODO_UPDATE_STATE
+	CLUSTER_TODO_SAVE_CONFIG
+	CLUSTER_TODO_HANDLE_MANUALFAILOVER
+)
+
+const CLUSTER_NAMELEN = 40
+
+// how long a forgotten node can't be added back by the gossip
+const CLUSTER_BLACKLIST_TTL = 60 * time.Second
+
+// the cluster bus port is the port of the node plus this
+const CLUSTER_PORT_INCR = 10000
+
+// the default cluster-node-timeout, in milliseconds
+const CONFIG_DEFAULT_CLUSTER_NODE_TIMEOUT = 15000
+
+// the default cluster-replica-validity-factor
+const CONFIG_DEFAULT_CLUSTER_SLAVE_VALIDITY = 10
+
+type clusterNode struct {
+	name        string
+	flags       int
+	configEpoch uint64
+
+	// the slots the node serves, a bit each
+	slots    [CLUSTER_SLOTS / 8]byte
+	numslots int
+
+	slaveof *clusterNode
+	slaves  []*clusterNode
+
+	ip    string
+	port  int
+	cport int // port of the cluster bus
+
+	// unix time in milliseconds of the ping in flight, 0 when none, of the
+	// last pong, and of the last message of any kind
+	pingSent     int64
+	pongReceived int64
+	dataReceived int64
+	ctime        time.Time
+
+	// when the masters agreed it failed, and the masters that think so
+	failTime    int64
+	failReports []clusterNodeFailReport
+
+	// the replication offset the node last told us
+	replOffset int64
+
+	// when we last voted for a replica of this master
+	votedTime int64
+
+	// our connection to the node on the bus, and its connection to us
+	link        *clusterLink
+	inboundLink *clusterLink
+}
+
+// clusterNodeFailReport is a master telling in its gossip that a node is
+// failing, valid for a while
+type clusterNodeFailReport struct {
+	node *clusterNode
+	time int64
+}
+
+type clusterState struct {
+	myself        *clusterNode
+	currentEpoch  uint64
+	lastVoteEpoch uint64
+	state         int
+	nodes         map[string]*clusterNode
+
+	// the masters serving slots, those whose majority can fail a node
+	size int
+
+	// nodes forgotten with CLUSTER FORGET, until when they can come back
+	blacklist map[string]time.Time
+
+	todoBeforeSleep int
+
+	// see clusterUpdateState
+	firstCallTime     int64
+	amongMinorityTime int64
+
+	cronIteration int64
+	listeners     []net.Listener
+
+	// the election of a replica whose master failed, see
+	// clusterHandleSlaveFailover
+	failoverAuthTime  int64 // when the election starts, or started
+	failoverAuthCount int   // the votes we got
+	failoverAuthSent  bool  // we asked for the votes already
+	failoverAuthRank  int   // our rank among the replicas of the master
+	failoverAuthEpoch uint64
+
+	// the reason we last logged for not failing over, and when
+	cantFailoverReason int
+	lastLogTime        int64
+
+	// a manual failover: mfEnd is when it times out, 0 when none. The
+	// master pauses its writes for mfSlave, the replica records the
+	// offset the master paused at, and can start once it caught up.
+	mfEnd          int64
+	mfSlave        *clusterNode
+	mfMasterOffset int64
+	mfCanStart     bool
+
+	statsBusMessagesSent     [CLUSTERMSG_TYPE_COUNT]int64
+	statsBusMessagesReceived [CLUSTERMSG_TYPE_COUNT]int64
+
+	// the owner of each slot, nil when unassigned, and the slots moving in
+	// or out of this node
+	slots              [CLUSTER_SLOTS]*clusterNode
+	migratingSlotsTo   [CLUSTER_SLOTS]*clusterNode
+	importingSlotsFrom [CLUSTER_SLOTS]*clusterNode
+}
+
+func createClusterNode(name string, flags int) *clusterNode {
+	if name == "" {
+		name = getRandomHexChars(CLUSTER_NAMELEN)
+	}
+	return &clusterNode{name: name, flags: flags, ctime: time.Now()}
+}
+
+func (node *clusterNode) hasSlot(slot int) bool {
+	return node.slots[slot/8]&(1<<(slot%8)) != 0
+}
+
+func (node *clusterNode) isMaster() bool {
+	return node.flags&CLUSTER_NODE_MASTER != 0
+}
+
+func (node *clusterNode) isSlave() bool {
+	return node.flags&CLUSTER_NODE_SLAVE != 0
+}
+
+func (node *clusterNode) isMyself() bool {
+	return node.flags&CLUSTER_NODE_MYSELF != 0
+}
+
+func (node *clusterNode) inHandshake() bool {
+	return node.flags&CLUSTER_NODE_HANDSHAKE != 0
+}
+
+func (node *clusterNode) failed() bool {
+	return node.flags&CLUSTER_NODE_FAIL != 0
+}
+
+func (node *clusterNode) addSlave(slave *clusterNode) {
+	for _, s := range node.slaves {
+		if s == slave {
+			return
+		}
+	}
+	node.slaves = append(node.slaves, slave)
+}
+
+func (node *clusterNode) removeSlave(slave *clusterNode) {
+	for i, s := range node.slaves {
+		if s == slave {
+			node.slaves = append(node.slaves[:i], node.slaves[i+1:]...)
+			return
+		}
+	}
+}
+
+// clusterInit loads the node table from the cluster config file, or creates
+// this node, owning no slot, when there is none. server.cluster stays nil
+// unless cluster-enabled is set.
+func (server *RedisServer) clusterInit() {
+	if !server.Config.ClusterEnabled {
+		return
+	}
+	server.cluster = &clusterState{
+		state:          CLUSTER_FAIL,
+		nodes:          make(map[string]*clusterNode),
+		blacklist:      make(map[string]time.Time),
+		mfMasterOffset: -1,
+	}
+
+	loaded, err := server.clusterLoadConfig(server.clusterConfigPath())
+	if err != nil {
+		fmt.Printf("Unrecoverable error: corrupted cluster config file \"%s\": %v\n", server.clusterConfigPath(), err)
+		os.Exit(1)
+	}
+	if !loaded {
+		myself := createClusterNode("", CLUSTER_NODE_MYSELF|CLUSTER_NODE_MASTER)
+		server.cluster.myself = myself
+		server.clusterAddNode(myself)
+		fmt.Printf("No cluster configuration found, I'm %s\n", myself.name)
+	}
+
+	// the ports are the ones of this run, whatever the config file says
+	myself := server.cluster.myself
+	myself.port = server.clientPort(server.Config.TlsCluster)
+	myself.cport = myself.port + CLUSTER_PORT_INCR
+	server.clusterSaveConfigOrDie()
+
+	if err := server.clusterListen(); err != nil {
+		fmt.Printf("Could not bind cluster bus port %d: %v\n", myself.cport, err)
+		os.Exit(1)
+	}
+	server.clusterUpdateState()
+}
+
+func (server *RedisServer) clusterConfigPath() string {
+	return filepath.Join(server.Config.Dir, server.Config.ClusterConfigFile)
+}
+
+func (server *RedisServer) clusterAddNode(node *clusterNode) {
+	server.cluster.nodes[node.name] = node
+}
+
+// clusterDelNode removes the node from the table, with the slots it served
+// and the migrations from or to it
+func (server *RedisServer) clusterDelNode(node *clusterNode) {
+	cluster := server.cluster
+	for slot := 0; slot < CLUSTER_SLOTS; slot++ {
+		if cluster.importingSlotsFrom[slot] == node {
+			cluster.importingSlotsFrom[slot] = nil
+		}
+		if cluster.migratingSlotsTo[slot] == node {
+			cluster.migratingSlotsTo[slot] = nil
+		}
+		if cluster.slots[slot] == node {
+			server.clusterDelSlot(slot)
+		}
+	}
+
+	// the failures the node reported are no longer valid
+	for _, other := range cluster.nodes {
+		other.delFailureReport(node)
+	}
+
+	if node.slaveof != nil {
+		node.slaveof.removeSlave(node)
+	}
+	for _, slave := range node.slaves {
+		slave.slaveof = nil
+	}
+	server.freeClusterLink(node.link)
+	server.freeClusterLink(node.inboundLink)
+	delete(cluster.nodes, node.name)
+}
+
+// clusterRenameNode gives a node met in handshake the name it told us
+func (server *RedisServer) clusterRenameNode(node *clusterNode, name string) {
+	fmt.Printf("Renaming node %s into %s\n", node.name, name)
+	delete(server.cluster.nodes, node.name)
+	node.name = name
+	server.clusterAddNode(node)
+}
+
+func (server *RedisServer) clusterLookupNode(name string) *clusterNode {
+	return server.cluster.nodes[name]
+}
+
+// clusterBlacklistAddNode keeps the forgotten node from being added back
+// by the gossip of the other nodes for a while
+func (server *RedisServer) clusterBlacklistAddNode(node *clusterNode) {
+	server.clusterBlacklistCleanup()
+	server.cluster.blacklist[node.name] = time.Now().Add(CLUSTER_BLACKLIST_TTL)
+}
+
+func (server *RedisServer) clusterBlacklistExists(name string) bool {
+	server.clusterBlacklistCleanup()
+	_, ok := server.cluster.blacklist[name]
+	return ok
+}
+
+func (server *RedisServer) clusterBlacklistCleanup() {
+	now := time.Now()
+	for name, expire := range server.cluster.blacklist {
+		if expire.Before(now) {
+			delete(server.cluster.blacklist, name)
+		}
+	}
+}
+
+// clusterDoBeforeSleep schedules work for the end of the event loop, so
+// that many changes save the config once
+func (server *RedisServer) clusterDoBeforeSleep(flags int) {
+	server.cluster.todoBeforeSleep |= flags
+}
+
+func (server *RedisServer) clusterBeforeSleep() {
+	if server.cluster == nil {
+		return
+	}
+	cluster := server.cluster
+
+	// the failover goes first, it changes the state and the config
+	flags := cluster.todoBeforeSleep
+	cluster.todoBeforeSleep &^= CLUSTER_TODO_HANDLE_FAILOVER | CLUSTER_TODO_HANDLE_MANUALFAILOVER
+	if cluster.myself.isSlave() {
+		if flags&CLUSTER_TODO_HANDLE_MANUALFAILOVER != 0 {
+			server.clusterHandleManualFailover()
+		}
+		if flags&(CLUSTER_TODO_HANDLE_FAILOVER|CLUSTER_TODO_HANDLE_MANUALFAILOVER) != 0 {
+			server.clusterHandleSlaveFailover()
+		}
+	}
+
+	flags = cluster.todoBeforeSleep
+	cluster.todoBeforeSleep = 0
+	if flags&CLUSTER_TODO_UPDATE_STATE != 0 {
+		server.clusterUpdateState()
+	}
+	if flags&CLUSTER_TODO_SAVE_CONFIG != 0 {
+		server.clusterSaveConfigOrDie()
+	}
+}
+
+func (server *RedisServer) clusterAddSlot(node *clusterNode, slot int) bool {
+	if server.cluster.slots[slot] != nil {
+		return false
+	}
+	node.slots[slot/8] |= 1 << (slot % 8)
+	node.numslots++
+	server.cluster.slots[slot] = node
+	return true
+}
+
+func (server *RedisServer) clusterDelSlot(slot int) bool {
+	node := server.cluster.slots[slot]
+	if node == nil {
+		return false
+	}
+	// the shard channels of a slot our shard no longer serves are closed
+	if node == server.cluster.myself || node == server.cluster.myself.slaveof {
+		server.pubsubShardUnsubscribeAllChannelsInSlot(slot)
+	}
+	node.slots[slot/8] &^= 1 << (slot % 8)
+	node.numslots--
+	server.cluster.slots[slot] = nil
+	return true
+}
+
+// don't accept writes right after a restart, so the gossip can tell a
+// master it failed over before it serves stale slots
+const CLUSTER_WRITABLE_DELAY = 2000
+
+// clusterUpdateState tells if the cluster can serve queries: with
+// cluster-require-full-coverage every slot must be served by a node that
+// didn't fail, and in any case the majority of the masters must be
+// reachable
+func (server *RedisServer) clusterUpdateState() {
+	cluster := server.cluster
+	now := time.Now().UnixMilli()
+	if cluster.firstCallTime == 0 {
+		cluster.firstCallTime = now
+	}
+	if cluster.myself.isMaster() && cluster.state == CLUSTER_FAIL && now-cluster.firstCallTime < CLUSTER_WRITABLE_DELAY {
+		return
+	}
+
+	state := CLUSTER_OK
+	if server.Config.ClusterRequireFullCoverage {
+		for _, node := range cluster.slots {
+			if node == nil || node.flags&CLUSTER_NODE_FAIL != 0 {
+				state = CLUSTER_FAIL
+				break
+			}
+		}
+	}
+
+	// a partition with a minority of the masters can't serve, the others
+	// may fail it over
+	reachable := 0
+	cluster.size = 0
+	for _, node := range cluster.nodes {
+		if node.isMaster() && node.numslots > 0 {
+			cluster.size++
+			if node.flags&(CLUSTER_NODE_FAIL|CLUSTER_NODE_PFAIL) == 0 {
+				reachable++
+			}
+		}
+	}
+	if reachable < cluster.size/2+1 {
+		state = CLUSTER_FAIL
+		cluster.amongMinorityTime = now
+	}
+
+	if state != cluster.state {
+		// back in the majority, wait for the others to know about us
+		rejoinDelay := int64(server.Config.ClusterNodeTimeout)
+		if rejoinDelay > 5000 {
+			rejoinDelay = 5000
+		}
+		if rejoinDelay < 500 {
+			rejoinDelay = 500
+		}
+		if state == CLUSTER_OK && cluster.myself.isMaster() && now-cluster.amongMinorityTime < rejoinDelay {
+			return
+		}
+
+		if state == CLUSTER_OK {
+			fmt.Println("Cluster state changed: ok")
+		} else {
+			fmt.Println("Cluster state changed: fail")
+		}
+		cluster.state = state
+	}
+}
+
+// keyHashSlot maps a key to its hash slot. Only the part between the first
+// { and the next } is hashed when it isn't empty, so that keys like
+// {user1000}.following and {user1000}.followers share a slot.
+func keyHashSlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16([]byte(key)) & (CLUSTER_SLOTS - 1))
+}
+
+// getNodeByQuery tells which node serves the keys of the command, or of all
+// the commands EXEC runs, along with the slot. When this node can't run it
+// the reason is returned, for clusterRedirectClient.
+func (server *RedisServer) getNodeByQuery(client *RedisClient, command RedisCommand, cmd string, args []interface{}) (*clusterNode, int, int) {
+	var commands []multiCmd
+	if cmd == "EXEC" {
+		commands = client.mstate.commands
+	} else {
+		commands = []multiCmd{{command: command, cmd: cmd, args: args}}
+	}
+
+	var node *clusterNode
+	slot := 0
+	migrating, importing := false, false
+	missingKeys, numKeys := 0, 0
+	// the shard channels are routed like keys, but don't exist as keys
+	pubsubshardIncluded := false
+	for _, mc := range commands {
+		if mc.command.CmdFlags&CMD_PUBSUB != 0 && mc.command.GetKeysProc != nil {
+			pubsubshardIncluded = true
+		}
+		for _, key := range getKeysFromCommand(mc.command, mc.args) {
+			if numKeys == 0 {
+				slot = keyHashSlot(key)
+				node = server.cluster.slots[slot]
+				if node == nil {
+					return nil, slot, CLUSTER_REDIR_DOWN_UNBOUND
+				}
+				migrating = node == server.cluster.myself && server.cluster.migratingSlotsTo[slot] != nil
+				importing = !migrating && server.cluster.importingSlotsFrom[slot] != nil
+			} else if keyHashSlot(key) != slot {
+				return nil, slot, CLUSTER_REDIR_CROSS_SLOT
+			}
+			numKeys++
+
+			// a key moved to the target of a migration is looked for there,
+			// and may not be here yet while we import the slot
+			if (migrating || importing) && !pubsubshardIncluded {
+				if _, ok := server.Storage.Get(key); !ok || server.keyIsExpired(key) {
+					missingKeys++
+				}
+			}
+		}
+	}
+
+	// commands without keys run anywhere
+	if node == nil {
+		return server.cluster.myself, 0, CLUSTER_REDIR_NONE
+	}
+
+	if server.cluster.state != CLUSTER_OK {
+		if !server.Config.ClusterAllowReadsWhenDown {
+			return nil, slot, CLUSTER_REDIR_DOWN_STATE
+		}
+		for _, mc := range commands {
+			if mc.command.CmdFlags&CMD_WRITE != 0 {
+				return nil, slot, CLUSTER_REDIR_DOWN_RO_STATE
+			}
+		}
+	}
+
+	// the client was sent here by the node migrating the slot
+	if importing && (client.Flags&CLIENT_ASKING != 0 || command.CmdFlags&CMD_ASKING != 0) {
+		if numKeys > 1 && missingKeys > 0 {
+			return nil, slot, CLUSTER_REDIR_UNSTABLE
+		}
+		return server.cluster.myself, slot, CLUSTER_REDIR_NONE
+	}
+
+	if migrating && missingKeys > 0 {
+		// some of the keys are here and some moved already
+		if numKeys > 1 && missingKeys < numKeys {
+			return nil, slot, CLUSTER_REDIR_UNSTABLE
+		}
+		return server.cluster.migratingSlotsTo[slot], slot, CLUSTER_REDIR_ASK
+	}
+
+	// a client that sent READONLY reads the slots of our master from us,
+	// and any client uses the shard channels of our master here
+	if (client.Flags&CLIENT_READONLY != 0 || pubsubshardIncluded) && server.cluster.myself.isSlave() && server.cluster.myself.slaveof == node {
+		isWriteCommand := false
+		for _, mc := range commands {
+			if mc.command.CmdFlags&CMD_WRITE != 0 {
+				isWriteCommand = true
+			}
+		}
+		if !isWriteCommand {
+			return server.cluster.myself, slot, CLUSTER_REDIR_NONE
+		}
+	}
+
+	if node != server.cluster.myself {
+		return node, slot, CLUSTER_REDIR_MOVED
+	}
+	return node, slot, CLUSTER_REDIR_NONE
+}
+
+// clusterRedirectReply is the error sending the client to the node that
+// can run its command, or telling why none can
+func clusterRedirectReply(node *clusterNode, slot int, errorCode int) []byte {
+	switch errorCode {
+	case CLUSTER_REDIR_CROSS_SLOT:
+		return []byte("-CROSSSLOT Keys in request don't hash to the same slot\r\n")
+	case CLUSTER_REDIR_UNSTABLE:
+		return []byte("-TRYAGAIN Multiple keys request during rehashing of slot\r\n")
+	case CLUSTER_REDIR_DOWN_STATE:
+		return []byte("-CLUSTERDOWN The cluster is down\r\n")
+	case CLUSTER_REDIR_DOWN_RO_STATE:
+		return []byte("-CLUSTERDOWN The cluster is down and only accepts read commands\r\n")
+	case CLUSTER_REDIR_DOWN_UNBOUND:
+		return []byte("-CLUSTERDOWN Hash slot not served\r\n")
+	case CLUSTER_REDIR_MOVED, CLUSTER_REDIR_ASK:
+		kind := "MOVED"
+		if errorCode == CLUSTER_REDIR_ASK {
+			kind = "ASK"
+		}
+		return []byte(fmt.Sprintf("-%s %d %s:%d\r\n", kind, slot, node.ip, node.port))
+	default:
+		return []byte("-ERR Unexpected cluster redirection error\r\n")
+	}
+}
+
+// clusterRedirectClient refuses the command of a client that must go to
+// another node. Unlike the other refusals it doesn't abort EXEC with
+// -EXECABORT, the client has to resend the transaction elsewhere.
+func (server *RedisServer) clusterRedirectClient(client *RedisClient, cmd string, node *clusterNode, slot int, errorCode int) {
+	if cmd == "EXEC" {
+		server.discardTransaction(client)
+	} else if client.Flags&CLIENT_MULTI != 0 {
+		client.Flags |= CLIENT_DIRTY_EXEC
+	}
+	if command, ok := redisCommandTable[cmd]; ok {
+		server.commandStats(command).rejectedCalls++
+	}
+	reply := clusterRedirectReply(node, slot, errorCode)
+	server.afterErrorReply(reply)
+	client.addReply(reply)
+}
+
+// clusterGenNodeFlags are the flags of the node as CLUSTER NODES lists them
+func clusterGenNodeFlags(node *clusterNode) string {
+	names := []struct {
+		flag int
+		name string
+	}{
+		{CLUSTER_NODE_MYSELF, "myself"},
+		{CLUSTER_NODE_MASTER, "master"},
+		{CLUSTER_NODE_SLAVE, "slave"},
+		{CLUSTER_NODE_PFAIL, "fail?"},
+		{CLUSTER_NODE_FAIL, "fail"},
+		{CLUSTER_NODE_HANDSHAKE, "handshake"},
+		{CLUSTER_NODE_NOADDR, "noaddr"},
+	}
+	flags := []string{}
+	for _, n := range names {
+		if node.flags&n.flag != 0 {
+			flags = append(flags, n.name)
+		}
+	}
+	if len(flags) == 0 {
+		return "noflags"
+	}
+	return strings.Join(flags, ",")
+}
+
+// clusterGenNodeDescription is the line of the node in CLUSTER NODES and in
+// the cluster config file:
+// <id> <ip:port@cport> <flags> <master> <ping-sent> <pong-recv> <config-epoch> <link-state> <slot> ...
+func (server *RedisServer) clusterGenNodeDescription(node *clusterNode) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s:%d@%d %s ", node.name, node.ip, node.port, node.cport, clusterGenNodeFlags(node))
+	if node.slaveof != nil {
+		b.WriteString(node.slaveof.name)
+	} else {
+		b.WriteString("-")
+	}
+
+	linkState := "disconnected"
+	if node.isMyself() || server.clusterNodeConnected(node) {
+		linkState = "connected"
+	}
+	fmt.Fprintf(&b, " %d %d %d %s", node.pingSent, node.pongReceived, node.configEpoch, linkState)
+
+	// the slots as ranges, only masters serve slots
+	if node.isMaster() {
+		for _, r := range clusterNodeSlotRanges(node) {
+			if r[0] == r[1] {
+				fmt.Fprintf(&b, " %d", r[0])
+			} else {
+				fmt.Fprintf(&b, " %d-%d", r[0], r[1])
+			}
+		}
+	}
+
+	// only this node knows about its migrations
+	if node.isMyself() {
+		for slot := 0; slot < CLUSTER_SLOTS; slot++ {
+			if to := server.cluster.migratingSlotsTo[slot]; to != nil {
+				fmt.Fprintf(&b, " [%d->-%s]", slot, to.name)
+			} else if from := server.cluster.importingSlotsFrom[slot]; from != nil {
+				fmt.Fprintf(&b, " [%d-<-%s]", slot, from.name)
+			}
+		}
+	}
+	return b.String()
+}
+
+// clusterNodeConnected tells if we have a link with the node on the bus
+func (server *RedisServer) clusterNodeConnected(node *clusterNode) bool {
+	return node.link != nil
+}
+
+// clusterNodeSlotRanges are the slots of the node as [start, end] ranges
+func clusterNodeSlotRanges(node *clusterNode) [][2]int {
+	ranges := [][2]int{}
+	start := -1
+	for slot := 0; slot <= CLUSTER_SLOTS; slot++ {
+		has := slot < CLUSTER_SLOTS && node.hasSlot(slot)
+		if has && start == -1 {
+			start = slot
+		}
+		if !has && start != -1 {
+			ranges = append(ranges, [2]int{start, slot - 1})
+			start = -1
+		}
+	}
+	return ranges
+}
+
+// clusterSortedNodes is the node table ordered by name, so that the listings
+// don't change from a call to the next
+func (server *RedisServer) clusterSortedNodes() []*clusterNode {
+	nodes := make([]*clusterNode, 0, len(server.cluster.nodes))
+	for _, node := range server.cluster.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].name < nodes[j].name })
+	return nodes
+}
+
+func (server *RedisServer) clusterGenNodesDescription(filter int) string {
+	var b strings.Builder
+	for _, node := range server.clusterSortedNodes() {
+		if node.flags&filter != 0 {
+			continue
+		}
+		b.WriteString(server.clusterGenNodeDescription(node))
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// clusterStartHandshake adds a node to meet at the address, under a random
+// name until it tells its own. The address must be an IP.
+func (server *RedisServer) clusterStartHandshake(ip string, port, cport int) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil || port <= 0 || port > 65535 || cport <= 0 || cport > 65535 {
+		return false
+	}
+	ip = parsed.String()
+
+	// already meeting it
+	for _, node := range server.cluster.nodes {
+		if node.inHandshake() && node.ip == ip && node.port == port && node.cport == cport {
+			return true
+		}
+	}
+
+	node := createClusterNode("", CLUSTER_NODE_HANDSHAKE|CLUSTER_NODE_MEET)
+	node.ip, node.port, node.cport = ip, port, cport
+	server.clusterAddNode(node)
+	return true
+}
+
+// clusterReset forgets all the other nodes and the slots. A hard reset
+// also gives this node a new name and starts the epochs over.
+func (server *RedisServer) clusterReset(hard bool) {
+	cluster := server.cluster
+	myself := cluster.myself
+
+	if myself.isSlave() {
+		server.clusterSetNodeAsMaster(myself)
+		server.replicationUnsetMaster()
+		server.emptyData(false)
+	}
+
+	for slot := 0; slot < CLUSTER_SLOTS; slot++ {
+		cluster.migratingSlotsTo[slot] = nil
+		cluster.importingSlotsFrom[slot] = nil
+		server.clusterDelSlot(slot)
+	}
+
+	for _, node := range cluster.nodes {
+		if node != myself {
+			server.clusterDelNode(node)
+		}
+	}
+
+	if hard {
+		cluster.currentEpoch = 0
+		cluster.lastVoteEpoch = 0
+		myself.configEpoch = 0
+		fmt.Println("configEpoch set to 0 via CLUSTER RESET HARD")
+
+		delete(cluster.nodes, myself.name)
+		myself.name = getRandomHexChars(CLUSTER_NAMELEN)
+		server.clusterAddNode(myself)
+		fmt.Printf("Node hard reset, now I'm %s\n", myself.name)
+	}
+
+	server.resetManualFailover()
+	server.clusterSaveConfigOrDie()
+	server.clusterUpdateState()
+}
+
+// clusterSetNodeAsMaster turns a replica into a master of no slot
+func (server *RedisServer) clusterSetNodeAsMaster(node *clusterNode) {
+	if node.isMaster() {
+		return
+	}
+	if node.slaveof != nil {
+		node.slaveof.removeSlave(node)
+	}
+	node.flags &^= CLUSTER_NODE_SLAVE
+	node.flags |= CLUSTER_NODE_MASTER
+	node.slaveof = nil
+}
+
+// clusterSetMaster makes this node a replica of the master, giving up the
+// migrations of the slots it served
+func (server *RedisServer) clusterSetMaster(node *clusterNode) {
+	cluster := server.cluster
+	myself := cluster.myself
+	if myself.isMaster() {
+		myself.flags &^= CLUSTER_NODE_MASTER
+		myself.flags |= CLUSTER_NODE_SLAVE
+		for slot := 0; slot < CLUSTER_SLOTS; slot++ {
+			cluster.migratingSlotsTo[slot] = nil
+			cluster.importingSlotsFrom[slot] = nil
+		}
+	} else if myself.slaveof != nil {
+		myself.slaveof.removeSlave(myself)
+	}
+	myself.slaveof = node
+	node.addSlave(myself)
+	server.replicationSetMaster(node.ip, node.port)
+	server.resetManualFailover()
+}
+
+// verifyClusterConfigWithData takes the unassigned slots this node has keys
+// for, and imports the ones assigned to another node, so no key is lost
+func (server *RedisServer) verifyClusterConfigWithData() {
+	cluster := server.cluster
+	if cluster == nil || cluster.myself.isSlave() {
+		return
+	}
+
+	var slotsWithKeys [CLUSTER_SLOTS]bool
+	server.Storage.Range(func(key string, _ *RedisObject) bool {
+		slotsWithKeys[keyHashSlot(key)] = true
+		return true
+	})
+
+	update := false
+	for slot := 0; slot < CLUSTER_SLOTS; slot++ {
+		if !slotsWithKeys[slot] || cluster.slots[slot] == cluster.myself || cluster.importingSlotsFrom[slot] != nil {
+			continue
+		}
+		update = true
+		if cluster.slots[slot] == nil {
+			fmt.Printf("I have keys for unassigned slot %d. Taking responsibility for it.\n", slot)
+			server.clusterAddSlot(cluster.myself, slot)
+		} else {
+			fmt.Printf("I have keys for slot %d, but the slot is assigned to another node. Setting it to importing state.\n", slot)
+			cluster.importingSlotsFrom[slot] = cluster.slots[slot]
+		}
+	}
+	if update {
+		server.clusterSaveConfigOrDie()
+		server.clusterUpdateState()
+	}
+}
+
+// countKeysInSlot counts the keys of the slot
+func (server *RedisServer) countKeysInSlot(slot int) int {
+	return len(server.getKeysInSlot(slot, -1))
+}
+
+// getKeysInSlot returns up to count keys of the slot, all of them when
+// count is negative
+func (server *RedisServer) getKeysInSlot(slot int, count int) []string {
+	keys := []string{}
+	if count == 0 {
+		return keys
+	}
+	server.Storage.Range(func(key string, _ *RedisObject) bool {
+		if keyHashSlot(key) == slot {
+			keys = append(keys, key)
+		}
+		return count < 0 || len(keys) < count
+	})
+	return keys
+}
+
+// getSlotOrReply parses a slot number, or returns the error for it
+func getSlotOrReply(arg interface{}) (int, []byte) {
+	s, _ := arg.(string)
+	slot, err := strconv.Atoi(s)
+	if err != nil || slot < 0 || slot >= CLUSTER_SLOTS {
+		return -1, []byte("-ERR Invalid or out of range slot\r\n")
+	}
+	return slot, nil
+}
+
+// handleClusterCommand is the administration of the node table and the
+// slots of this node
+func (server *RedisServer) handleClusterCommand(cmd string, args []interface{}) []byte {
+	if server.cluster == nil {
+		return []byte("-ERR This instance has cluster support disabled\r\n")
+	}
+
+	subcommand, _ := args[0].(string)
+	subcommand = strings.ToUpper(subcommand)
+	cluster := server.cluster
+	myself := cluster.myself
+
+	switch {
+	case subcommand == "HELP" && len(args) == 1:
+		return addReplyHelp("CLUSTER", []string{
+			"ADDSLOTS <slot> [<slot> ...]",
+			"    Assign slots to current node.",
+			"COUNTKEYSINSLOT <slot>",
+			"    Return the number of keys in <slot>.",
+			"FAILOVER [FORCE|TAKEOVER]",
+			"    Promote current replica node to being a master.",
+			"FORGET <node-id>",
+			"    Remove a node from the cluster.",
+			"GETKEYSINSLOT <slot> <count>",
+			"    Return key names stored by current node in a slot.",
+			"INFO",
+			"    Return information about the cluster.",
+			"KEYSLOT <key>",
+			"    Return the hash slot for <key>.",
+			"MEET <ip> <port> [<bus-port>]",
+			"    Connect nodes into a working cluster.",
+			"MYID",
+			"    Return the node id.",
+			"NODES",
+			"    Return cluster configuration seen by node. Output format:",
+			"    <id> <ip:port@bus-port> <flags> <master> <pings> <pongs> <epoch> <link> <slot> ...",
+			"REPLICATE <node-id>",
+			"    Configure current node as replica to <node-id>.",
+			"REPLICAS <node-id>",
+			"    Return <node-id> replicas.",
+			"RESET [HARD|SOFT]",
+			"    Reset current node (default: soft).",
+			"SETSLOT <slot> (IMPORTING <node-id>|MIGRATING <node-id>|STABLE|NODE <node-id>)",
+			"    Set slot state.",
+			"SHARDS",
+			"    Return information about slot range mappings and the nodes associated with them.",
+			"SLOTS",
+			"    Return information about slots range mappings. Each range is made of:",
+			"    start, end, master and replicas IP addresses, ports and ids",
+		})
+	case subcommand == "INFO" && len(args) == 1:
+		return addReplyBulk([]interface{}{server.clusterGenInfoString()})
+	case subcommand == "KEYSLOT" && len(args) == 2:
+		key, _ := args[1].(string)
+		return addReplyLongLong(int64(keyHashSlot(key)))
+	case subcommand == "MYID" && len(args) == 1:
+		return addReplyBulk([]interface{}{myself.name})
+	case subcommand == "NODES" && len(args) == 1:
+		return addReplyBulk([]interface{}{server.clusterGenNodesDescription(0)})
+	case subcommand == "SLOTS" && len(args) == 1:
+		return server.clusterReplySlots()
+	case subcommand == "SHARDS" && len(args) == 1:
+		return server.clusterReplyShards()
+	case subcommand == "MEET" && (len(args) == 3 || len(args) == 4):
+		ip, _ := args[1].(string)
+		portArg, _ := args[2].(string)
+		port, err := strconv.Atoi(portArg)
+		if err != nil {
+			return []byte(fmt.Sprintf("-ERR Invalid base port specified: %s\r\n", portArg))
+		}
+		cport := port + CLUSTER_PORT_INCR
+		if len(args) == 4 {
+			cportArg, _ := args[3].(string)
+			if cport, err = strconv.Atoi(cportArg); err != nil {
+				return []byte(fmt.Sprintf("-ERR Invalid bus port specified: %s\r\n", cportArg))
+			}
+		}
+		if !server.clusterStartHandshake(ip, port, cport) {
+			return []byte(fmt.Sprintf("-ERR Invalid node address specified: %s:%s\r\n", ip, portArg))
+		}
+		return []byte("+OK\r\n")
+	case subcommand == "FORGET" && len(args) == 2:
+		name, _ := args[1].(string)
+		node := server.clusterLookupNode(name)
+		if node == nil {
+			return []byte(fmt.Sprintf("-ERR Unknown node %s\r\n", name))
+		}
+		if node == myself {
+			return []byte("-ERR I tried hard but I can't forget myself...\r\n")
+		}
+		if myself.isSlave() && myself.slaveof == node {
+			return []byte("-ERR Can't forget my master!\r\n")
+		}
+		server.clusterBlacklistAddNode(node)
+		server.clusterDelNode(node)
+		server.clusterDoBeforeSleep(CLUSTER_TODO_UPDATE_STATE | CLUSTER_TODO_SAVE_CONFIG)
+		return []byte("+OK\r\n")
+	case subcommand == "RESET" && len(args) <= 2:
+		hard := false
+		if len(args) == 2 {
+			mode, _ := args[1].(string)
+			switch strings.ToUpper(mode) {
+			case "HARD":
+				hard = true
+			case "SOFT":
+			default:
+				return []byte("-ERR syntax error\r\n")
+			}
+		}
+		if myself.isMaster() && server.Storage.Len() != 0 {
+			return []byte("-ERR CLUSTER RESET can't be called with master nodes containing keys\r\n")
+		}
+		server.clusterReset(hard)
+		return []byte("+OK\r\n")
+	case subcommand == "ADDSLOTS" && len(args) >= 2:
+		seen := make(map[int]bool, len(args)-1)
+		slots := make([]int, 0, len(args)-1)
+		for _, arg := range args[1:] {
+			slot, reply := getSlotOrReply(arg)
+			if reply != nil {
+				return reply
+			}
+			if cluster.slots[slot] != nil {
+				return []byte(fmt.Sprintf("-ERR Slot %d is already busy\r\n", slot))
+			}
+			if seen[slot] {
+				return []byte(fmt.Sprintf("-ERR Slot %d specified multiple times\r\n", slot))
+			}
+			seen[slot] = true
+			slots = append(slots, slot)
+		}
+		for _, slot := range slots {
+			// a slot we serve is no longer imported
+			cluster.importingSlotsFrom[slot] = nil
+			server.clusterAddSlot(myself, slot)
+		}
+		server.clusterDoBeforeSleep(CLUSTER_TODO_UPDATE_STATE | CLUSTER_TODO_SAVE_CONFIG)
+		return []byte("+OK\r\n")
+	case subcommand == "SETSLOT" && len(args) >= 3:
+		return server.clusterSetSlotCommand(args[1:])
+	case subcommand == "REPLICATE" && len(args) == 2:
+		name, _ := args[1].(string)
+		node := server.clusterLookupNode(name)
+		if node == nil {
+			return []byte(fmt.Sprintf("-ERR Unknown node %s\r\n", name))
+		}
+		if node == myself {
+			return []byte("-ERR Can't replicate myself\r\n")
+		}
+		if node.isSlave() {
+			return []byte("-ERR I can only replicate a master, not a replica.\r\n")
+		}
+		// a master would lose its keys, and its slots would be served by
+		// nobody
+		if myself.isMaster() && (myself.numslots != 0 || server.Storage.Len() != 0) {
+			return []byte("-ERR To set a master the node must be empty and without assigned slots.\r\n")
+		}
+		server.clusterSetMaster(node)
+		server.clusterDoBeforeSleep(CLUSTER_TODO_UPDATE_STATE | CLUSTER_TODO_SAVE_CONFIG)
+		return []byte("+OK\r\n")
+	case (subcommand == "REPLICAS" || subcommand == "SLAVES") && len(args) == 2:
+		name, _ := args[1].(string)
+		node := server.clusterLookupNode(name)
+		if node == nil {
+			return []byte(fmt.Sprintf("-ERR Unknown node %s\r\n", name))
+		}
+		if node.isSlave() {
+			return []byte("-ERR The specified node is not a master\r\n")
+		}
+		reply := addReplyArrayLen(len(node.slaves))
+		for _, slave := range node.slaves {
+			reply = append(reply, addReplyBulk([]interface{}{server.clusterGenNodeDescription(slave)})...)
+		}
+		return reply
+	case subcommand == "FAILOVER" && len(args) <= 2:
+		return server.clusterFailoverCommand(args[1:])
+	case subcommand == "COUNTKEYSINSLOT" && len(args) == 2:
+		s, _ := args[1].(string)
+		slot, err := strconv.Atoi(s)
+		if err != nil || slot < 0 || slot >= CLUSTER_SLOTS {
+			return []byte("-ERR Invalid slot\r\n")
+		}
+		return addReplyLongLong(int64(server.countKeysInSlot(slot)))
+	case subcommand == "GETKEYSINSLOT" && len(args) == 3:
+		slotArg, _ := args[1].(string)
+		countArg, _ := args[2].(string)
+		slot, err1 := strconv.Atoi(slotArg)
+		count, err2 := strconv.Atoi(countArg)
+		if err1 != nil || err2 != nil || slot < 0 || slot >= CLUSTER_SLOTS || count < 0 {
+			return []byte("-ERR Invalid slot or number of keys\r\n")
+		}
+		keys := server.getKeysInSlot(slot, count)
+		reply := addReplyArrayLen(len(keys))
+		for _, key := range keys {
+			reply = append(reply, addReplyBulk([]interface{}{key})...)
+		}
+		return reply
+	default:
+		return addReplySubcommandSyntaxError("CLUSTER", args[0].(string))
+	}
+}
+
+// clusterSetSlotCommand moves a slot between nodes: the source flags it
+// MIGRATING and the target IMPORTING while the keys are moved, then both
+// are told the new owner with NODE
+func (server *RedisServer) clusterSetSlotCommand(args []interface{}) []byte {
+	cluster := server.cluster
+	myself := cluster.myself
+	if myself.isSlave() {
+		return []byte("-ERR Please use SETSLOT only with masters.\r\n")
+	}
+	slot, reply := getSlotOrReply(args[0])
+	if reply != nil {
+		return reply
+	}
+	action, _ := args[1].(string)
+	action = strings.ToUpper(action)
+
+	var node *clusterNode
+	if len(args) == 3 && action != "STABLE" {
+		name, _ := args[2].(string)
+		node = server.clusterLookupNode(name)
+		if node == nil {
+			if action == "NODE" {
+				return []byte(fmt.Sprintf("-ERR Unknown node %s\r\n", name))
+			}
+			return []byte(fmt.Sprintf("-ERR I don't know about node %s\r\n", name))
+		}
+		if node.isSlave() {
+			return []byte("-ERR Target node is not a master\r\n")
+		}
+	}
+
+	switch {
+	case action == "MIGRATING" && node != nil:
+		if cluster.slots[slot] != myself {
+			return []byte(fmt.Sprintf("-ERR I'm not the owner of hash slot %d\r\n", slot))
+		}
+		cluster.migratingSlotsTo[slot] = node
+	case action == "IMPORTING" && node != nil:
+		if cluster.slots[slot] == myself {
+			return []byte(fmt.Sprintf("-ERR I'm already the owner of hash slot %d\r\n", slot))
+		}
+		cluster.importingSlotsFrom[slot] = node
+	case action == "STABLE" && len(args) == 2:
+		cluster.importingSlotsFrom[slot] = nil
+		cluster.migratingSlotsTo[slot] = nil
+	case action == "NODE" && node != nil:
+		// the keys of the slot must have been moved to the new owner
+		if cluster.slots[slot] == myself && node != myself && server.countKeysInSlot(slot) != 0 {
+			return []byte(fmt.Sprintf("-ERR Can't assign hashslot %d to a different node while I still hold keys for this hash slot.\r\n", slot))
+		}
+		if cluster.migratingSlotsTo[slot] != nil && server.countKeysInSlot(slot) == 0 {
+			cluster.migratingSlotsTo[slot] = nil
+		}
+		if cluster.slots[slot] != node {
+			server.clusterDelSlot(slot)
+			server.clusterAddSlot(node, slot)
+		}
+
+		// the migration ends here: we take the slot with a new epoch, so
+		// that the other nodes believe us over its previous owner
+		if node == myself && cluster.importingSlotsFrom[slot] != nil {
+			if server.clusterBumpConfigEpochWithoutConsensus() {
+				fmt.Printf("configEpoch updated after importing slot %d\n", slot)
+			}
+			cluster.importingSlotsFrom[slot] = nil
+			server.clusterBroadcastPong(CLUSTER_BROADCAST_ALL)
+		}
+	default:
+		return []byte("-ERR Invalid CLUSTER SETSLOT action or number of arguments. Try CLUSTER HELP\r\n")
+	}
+	server.clusterDoBeforeSleep(CLUSTER_TODO_SAVE_CONFIG | CLUSTER_TODO_UPDATE_STATE)
+	return []byte("+OK\r\n")
+}
+
+// clusterBumpConfigEpochWithoutConsensus takes a new config epoch unless
+// ours is already the greatest, telling if it did. The other nodes don't
+// vote for it, an epoch collision is resolved later if any.
+func (server *RedisServer) clusterBumpConfigEpochWithoutConsensus() bool {
+	cluster := server.cluster
+	maxEpoch := cluster.currentEpoch
+	for _, node := range cluster.nodes {
+		if node.configEpoch > maxEpoch {
+			maxEpoch = node.configEpoch
+		}
+	}
+	if cluster.myself.configEpoch != 0 && cluster.myself.configEpoch == maxEpoch {
+		return false
+	}
+	cluster.currentEpoch++
+	cluster.myself.configEpoch = cluster.currentEpoch
+	server.clusterSaveConfigOrDie()
+	fmt.Printf("New configEpoch set to %d\n", cluster.myself.configEpoch)
+	return true
+}
+
+// handleAskingCommand lets the next command run on a slot this node is
+// importing, as an -ASK redirection asks
+func (server *RedisServer) handleAskingCommand(cmd string, args []interface{}) []byte {
+	if server.cluster == nil {
+		return []byte("-ERR This instance has cluster support disabled\r\n")
+	}
+	server.currentClient.Flags |= CLIENT_ASKING
+	return []byte("+OK\r\n")
+}
+
+// handleReadonlyCommand lets the client read the slots of the master from
+// this replica, rather than being redirected to the master
+func (server *RedisServer) handleReadonlyCommand(cmd string, args []interface{}) []byte {
+	if server.cluster == nil {
+		return []byte("-ERR This instance has cluster support disabled\r\n")
+	}
+	server.currentClient.Flags |= CLIENT_READONLY
+	return []byte("+OK\r\n")
+}
+
+func (server *RedisServer) handleReadwriteCommand(cmd string, args []interface{}) []byte {
+	if server.cluster == nil {
+		return []byte("-ERR This instance has cluster support disabled\r\n")
+	}
+	server.currentClient.Flags &^= CLIENT_READONLY
+	return []byte("+OK\r\n")
+}
+
+func (server *RedisServer) clusterGenInfoString() string {
+	cluster := server.cluster
+	assigned, ok, pfail, fail := 0, 0, 0, 0
+	for _, node := range cluster.slots {
+		if node == nil {
+			continue
+		}
+		assigned++
+		switch {
+		case node.flags&CLUSTER_NODE_FAIL != 0:
+			fail++
+		case node.flags&CLUSTER_NODE_PFAIL != 0:
+			pfail++
+		default:
+			ok++
+		}
+	}
+
+	myEpoch := cluster.myself.configEpoch
+	if cluster.myself.isSlave() && cluster.myself.slaveof != nil {
+		myEpoch = cluster.myself.slaveof.configEpoch
+	}
+
+	state := "ok"
+	if cluster.state != CLUSTER_OK {
+		state = "fail"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "cluster_state:%s\r\n", state)
+	fmt.Fprintf(&b, "cluster_slots_assigned:%d\r\n", assigned)
+	fmt.Fprintf(&b, "cluster_slots_ok:%d\r\n", ok)
+	fmt.Fprintf(&b, "cluster_slots_pfail:%d\r\n", pfail)
+	fmt.Fprintf(&b, "cluster_slots_fail:%d\r\n", fail)
+	fmt.Fprintf(&b, "cluster_known_nodes:%d\r\n", len(cluster.nodes))
+	fmt.Fprintf(&b, "cluster_size:%d\r\n", cluster.size)
+	fmt.Fprintf(&b, "cluster_current_epoch:%d\r\n", cluster.currentEpoch)
+	fmt.Fprintf(&b, "cluster_my_epoch:%d\r\n", myEpoch)
+
+	// the messages of each type, then all of them
+	for _, dir := range []struct {
+		name  string
+		stats *[CLUSTERMSG_TYPE_COUNT]int64
+	}{{"sent", &cluster.statsBusMessagesSent}, {"received", &cluster.statsBusMessagesReceived}} {
+		total := int64(0)
+		for typ, count := range dir.stats {
+			if count > 0 {
+				fmt.Fprintf(&b, "cluster_stats_messages_%s_%s:%d\r\n", clusterMsgTypeNames[typ], dir.name, count)
+				total += count
+			}
+		}
+		fmt.Fprintf(&b, "cluster_stats_messages_%s:%d\r\n", dir.name, total)
+	}
+	fmt.Fprintf(&b, "total_cluster_links_buffer_limit_exceeded:%d\r\n", 0)
+	return b.String()
+}
+
+// clusterNodeReply is the node as CLUSTER SLOTS lists it: ip, port, id and
+// a map of more of its addresses, none here
+func clusterNodeReply(reply *bytes.Buffer, client *RedisClient, node *clusterNode) {
+	reply.Write(addReplyArrayLen(4))
+	writeReplyValue(reply, node.ip)
+	writeReplyValue(reply, node.port)
+	writeReplyValue(reply, node.name)
+	reply.Write(client.addReplyMapLen(0))
+}
+
+// clusterReplySlots is CLUSTER SLOTS, the ranges of slots with the master
+// serving them and its replicas
+func (server *RedisServer) clusterReplySlots() []byte {
+	client := server.currentClient
+	var reply bytes.Buffer
+	n := 0
+	for start := 0; start < CLUSTER_SLOTS; {
+		node := server.cluster.slots[start]
+		end := start
+		for end+1 < CLUSTER_SLOTS && server.cluster.slots[end+1] == node {
+			end++
+		}
+		if node != nil {
+			replicas := []*clusterNode{}
+			for _, slave := range node.slaves {
+				if !slave.failed() {
+					replicas = append(replicas, slave)
+				}
+			}
+			reply.Write(addReplyArrayLen(3 + len(replicas)))
+			writeReplyValue(&reply, start)
+			writeReplyValue(&reply, end)
+			clusterNodeReply(&reply, client, node)
+			for _, slave := range replicas {
+				clusterNodeReply(&reply, client, slave)
+			}
+			n++
+		}
+		start = end + 1
+	}
+	return append(addReplyArrayLen(n), reply.Bytes()...)
+}
+
+// clusterReplyShards is CLUSTER SHARDS, each master with its slots and the
+// details of it and its replicas
+func (server *RedisServer) clusterReplyShards() []byte {
+	client := server.currentClient
+	var reply bytes.Buffer
+	n := 0
+	for _, node := range server.clusterSortedNodes() {
+		if !node.isMaster() || node.inHandshake() {
+			continue
+		}
+		n++
+		reply.Write(client.addReplyMapLen(2))
+		writeReplyValue(&reply, "slots")
+		ranges := clusterNodeSlotRanges(node)
+		reply.Write(addReplyArrayLen(len(ranges) * 2))
+		for _, r := range ranges {
+			writeReplyValue(&reply, r[0])
+			writeReplyValue(&reply, r[1])
+		}
+
+		writeReplyValue(&reply, "nodes")
+		reply.Write(addReplyArrayLen(1 + len(node.slaves)))
+		server.clusterShardNodeReply(&reply, client, node)
+		for _, slave := range node.slaves {
+			server.clusterShardNodeReply(&reply, client, slave)
+		}
+	}
+	return append(addReplyArrayLen(n), reply.Bytes()...)
+}
+
+func (server *RedisServer) clusterShardNodeReply(reply *bytes.Buffer, client *RedisClient, node *clusterNode) {
+	offset := node.replOffset
+	if node.isMyself() {
+		offset = server.repl.masterReplOffset
+	}
+	role := "master"
+	if node.isSlave() {
+		role = "replica"
+	}
+	health := "online"
+	if node.failed() {
+		health = "failed"
+	} else if node.isSlave() && offset == 0 {
+		health = "loading"
+	}
+
+	reply.Write(client.addReplyMapLen(7))
+	writeReplyValue(reply, "id")
+	writeReplyValue(reply, node.name)
+	writeReplyValue(reply, "port")
+	writeReplyValue(reply, node.port)
+	writeReplyValue(reply, "ip")
+	writeReplyValue(reply, node.ip)
+	writeReplyValue(reply, "endpoint")
+	writeReplyValue(reply, node.ip)
+	writeReplyValue(reply, "role")
+	writeReplyValue(reply, role)
+	writeReplyValue(reply, "replication-offset")
+	writeReplyValue(reply, offset)
+	writeReplyValue(reply, "health")
+	writeReplyValue(reply, health)
+}
+
+func (server *RedisServer) genInfoCluster(b *strings.Builder) {
+	fmt.Fprintf(b, "cluster_enabled:%d\r\n", boolToInt(server.cluster != nil))
+}
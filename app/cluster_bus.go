@@ -0,0 +1,1153 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"time"
+)
+
+// The nodes of a cluster talk over the cluster bus, on the port of each node
+// plus 10000, with the binary messages of Redis Cluster. Every node pings
+// the others, gossiping about a few of the nodes it knows, which is how the
+// nodes learn about each other, about the slots they serve, and about the
+// ones that stopped answering.
+
+const (
+	CLUSTERMSG_TYPE_PING = iota
+	CLUSTERMSG_TYPE_PONG
+	CLUSTERMSG_TYPE_MEET
+	CLUSTERMSG_TYPE_FAIL
+	CLUSTERMSG_TYPE_PUBLISH
+	CLUSTERMSG_TYPE_FAILOVER_AUTH_REQUEST
+	CLUSTERMSG_TYPE_FAILOVER_AUTH_ACK
+	CLUSTERMSG_TYPE_UPDATE
+	CLUSTERMSG_TYPE_MFSTART
+	CLUSTERMSG_TYPE_MODULE
+	CLUSTERMSG_TYPE_PUBLISHSHARD
+	CLUSTERMSG_TYPE_COUNT
+)
+
+// as CLUSTER INFO names them in the message stats
+var clusterMsgTypeNames = [CLUSTERMSG_TYPE_COUNT]string{
+	"ping", "pong", "meet", "fail", "publish", "auth-req", "auth-ack",
+	"update", "mfstart", "module", "publishshard",
+}
+
+const CLUSTER_PROTO_VER = 1
+
+// sizes of the message header, of a gossip entry, and of the data of the
+// FAIL and UPDATE messages
+const (
+	CLUSTERMSG_HDR_SIZE    = 2256
+	CLUSTERMSG_GOSSIP_SIZE = 104
+	CLUSTERMSG_FAIL_SIZE   = CLUSTER_NAMELEN
+	CLUSTERMSG_UPDATE_SIZE = 8 + CLUSTER_NAMELEN + CLUSTER_SLOTS/8
+)
+
+const NET_IP_STR_LEN = 46
+
+// the first byte of the message flags
+const (
+	CLUSTERMSG_FLAG0_PAUSED = 1 << iota
+	CLUSTERMSG_FLAG0_FORCEACK
+	CLUSTERMSG_FLAG0_EXT_DATA
+)
+
+// who clusterBroadcastPong tells
+const (
+	CLUSTER_BROADCAST_ALL = iota
+	CLUSTER_BROADCAST_LOCAL_SLAVES
+)
+
+// how long, in node timeouts, a failure report counts, and after how long
+// a master nobody failed over gets its FAIL flag cleared
+const (
+	CLUSTER_FAIL_REPORT_VALIDITY_MULT = 2
+	CLUSTER_FAIL_UNDO_TIME_MULT       = 2
+)
+
+// clusterLink is a connection on the bus. We ping a node on the link we
+// opened to it, node is nil for the links the other nodes opened to us.
+type clusterLink struct {
+	conn    net.Conn
+	node    *clusterNode
+	inbound bool
+	ctime   int64
+	sendCh  chan []byte
+	closed  bool
+}
+
+// clusterMsgHeader is the decoded header of a message, the state of the
+// sender as it sees it
+type clusterMsgHeader struct {
+	totlen       uint32
+	ver          uint16
+	port         int
+	typ          int
+	count        int
+	currentEpoch uint64
+	configEpoch  uint64
+	offset       int64
+	sender       string
+	myslots      [CLUSTER_SLOTS / 8]byte
+	slaveof      string
+	myip         string
+	cport        int
+	flags        int
+	state        int
+	mflags       [3]byte
+}
+
+// clusterListen accepts the links of the other nodes on the bus port, on
+// the addresses of bind
+func (server *RedisServer) clusterListen() error {
+	listeners, err := listenToPort(server.cluster.myself.cport, server.Config.Bind)
+	if err != nil {
+		return err
+	}
+	for i, l := range listeners {
+		if server.Config.TlsCluster {
+			listeners[i] = server.tlsClusterListener(l)
+		}
+		go server.clusterAcceptLinks(listeners[i])
+	}
+	server.cluster.listeners = listeners
+	return nil
+}
+
+func (server *RedisServer) clusterAcceptLinks(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		server.runOnExecutor(func() {
+			link := createClusterLink(nil)
+			link.inbound = true
+			server.clusterLinkConnected(link, conn)
+		})
+	}
+}
+
+func createClusterLink(node *clusterNode) *clusterLink {
+	return &clusterLink{
+		node:   node,
+		ctime:  time.Now().UnixMilli(),
+		sendCh: make(chan []byte, 1024),
+	}
+}
+
+// clusterLinkConnected starts the goroutines reading the messages of the
+// link, handed to the executor, and writing the ones queued for it
+func (server *RedisServer) clusterLinkConnected(link *clusterLink, conn net.Conn) {
+	link.conn = conn
+
+	go func() {
+		for msg := range link.sendCh {
+			if _, err := conn.Write(msg); err != nil {
+				conn.Close()
+				return
+			}
+		}
+	}()
+
+	go func() {
+		reader := bufio.NewReader(conn)
+		for {
+			msg, err := clusterReadMessage(reader)
+			if err != nil {
+				break
+			}
+			server.runOnExecutor(func() {
+				if !link.closed {
+					server.clusterProcessPacket(link, msg)
+				}
+			})
+		}
+		server.runOnExecutor(func() {
+			server.freeClusterLink(link)
+		})
+	}()
+}
+
+// clusterReadMessage reads a message, sized by the length after the "RCmb"
+// signature
+func clusterReadMessage(reader *bufio.Reader) ([]byte, error) {
+	head := make([]byte, 8)
+	if _, err := io.ReadFull(reader, head); err != nil {
+		return nil, err
+	}
+	if string(head[:4]) != "RCmb" {
+		return nil, fmt.Errorf("bad cluster bus message signature")
+	}
+	totlen := binary.BigEndian.Uint32(head[4:])
+	if totlen < CLUSTERMSG_HDR_SIZE || totlen > 1<<30 {
+		return nil, fmt.Errorf("bad cluster bus message length %d", totlen)
+	}
+	msg := make([]byte, totlen)
+	copy(msg, head)
+	if _, err := io.ReadFull(reader, msg[8:]); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// freeClusterLink closes the link, the node gets a new one from the cron
+func (server *RedisServer) freeClusterLink(link *clusterLink) {
+	if link == nil || link.closed {
+		return
+	}
+	link.closed = true
+	close(link.sendCh)
+	if link.conn != nil {
+		link.conn.Close()
+	}
+	if link.node != nil && link.node.link == link {
+		link.node.link = nil
+	}
+	if server.cluster != nil {
+		for _, node := range server.cluster.nodes {
+			if node.inboundLink == link {
+				node.inboundLink = nil
+			}
+		}
+	}
+}
+
+func (server *RedisServer) clusterSendMessage(link *clusterLink, msg []byte) {
+	if link == nil || link.closed {
+		return
+	}
+	select {
+	case link.sendCh <- msg:
+	default:
+		// a node that doesn't read its messages gets a new link
+		server.freeClusterLink(link)
+		return
+	}
+	typ := int(binary.BigEndian.Uint16(msg[12:]))
+	if typ < CLUSTERMSG_TYPE_COUNT {
+		server.cluster.statsBusMessagesSent[typ]++
+	}
+}
+
+// clusterBroadcastMessage sends the message to all the nodes we are linked
+// with, those we know
+func (server *RedisServer) clusterBroadcastMessage(msg []byte) {
+	for _, node := range server.cluster.nodes {
+		if node.flags&(CLUSTER_NODE_MYSELF|CLUSTER_NODE_HANDSHAKE) != 0 {
+			continue
+		}
+		server.clusterSendMessage(node.link, msg)
+	}
+}
+
+func putClusterName(buf []byte, name string) {
+	copy(buf[:CLUSTER_NAMELEN], name)
+}
+
+// getClusterString reads a string padded with zeros
+func getClusterString(buf []byte) string {
+	if i := bytes.IndexByte(buf, 0); i >= 0 {
+		buf = buf[:i]
+	}
+	return string(buf)
+}
+
+// clusterBuildMessageHdr writes the header of a message of the type, the
+// state of this node. A replica tells the slots and epoch of its master.
+func (server *RedisServer) clusterBuildMessageHdr(typ int, datalen int) []byte {
+	cluster := server.cluster
+	myself := cluster.myself
+	master := myself
+	if myself.isSlave() && myself.slaveof != nil {
+		master = myself.slaveof
+	}
+
+	msg := make([]byte, CLUSTERMSG_HDR_SIZE+datalen)
+	copy(msg[0:], "RCmb")
+	binary.BigEndian.PutUint32(msg[4:], uint32(len(msg)))
+	binary.BigEndian.PutUint16(msg[8:], CLUSTER_PROTO_VER)
+	binary.BigEndian.PutUint16(msg[10:], uint16(server.clientPort(server.Config.TlsCluster)))
+	binary.BigEndian.PutUint16(msg[12:], uint16(typ))
+	binary.BigEndian.PutUint64(msg[16:], cluster.currentEpoch)
+	binary.BigEndian.PutUint64(msg[24:], master.configEpoch)
+	binary.BigEndian.PutUint64(msg[32:], uint64(server.repl.masterReplOffset))
+	putClusterName(msg[40:], myself.name)
+	copy(msg[80:], master.slots[:])
+	if myself.slaveof != nil {
+		putClusterName(msg[2128:], myself.slaveof.name)
+	}
+	binary.BigEndian.PutUint16(msg[2248:], uint16(myself.cport))
+	binary.BigEndian.PutUint16(msg[2250:], uint16(myself.flags))
+	msg[2252] = byte(cluster.state)
+	// the replica in a manual failover waits for our writes to stop
+	if myself.isMaster() && cluster.mfEnd != 0 {
+		msg[2253] |= CLUSTERMSG_FLAG0_PAUSED
+	}
+	return msg
+}
+
+func parseClusterMsgHeader(msg []byte) *clusterMsgHeader {
+	hdr := &clusterMsgHeader{
+		totlen:       binary.BigEndian.Uint32(msg[4:]),
+		ver:          binary.BigEndian.Uint16(msg[8:]),
+		port:         int(binary.BigEndian.Uint16(msg[10:])),
+		typ:          int(binary.BigEndian.Uint16(msg[12:])),
+		count:        int(binary.BigEndian.Uint16(msg[14:])),
+		currentEpoch: binary.BigEndian.Uint64(msg[16:]),
+		configEpoch:  binary.BigEndian.Uint64(msg[24:]),
+		offset:       int64(binary.BigEndian.Uint64(msg[32:])),
+		sender:       string(msg[40:80]),
+		slaveof:      getClusterString(msg[2128:2168]),
+		myip:         getClusterString(msg[2168:2214]),
+		cport:        int(binary.BigEndian.Uint16(msg[2248:])),
+		flags:        int(binary.BigEndian.Uint16(msg[2250:])),
+		state:        int(msg[2252]),
+	}
+	copy(hdr.myslots[:], msg[80:2128])
+	copy(hdr.mflags[:], msg[2253:2256])
+	return hdr
+}
+
+// clusterSetGossipEntry writes what we know about the node in a ping
+func clusterSetGossipEntry(buf []byte, node *clusterNode) {
+	putClusterName(buf, node.name)
+	binary.BigEndian.PutUint32(buf[40:], uint32(node.pingSent/1000))
+	binary.BigEndian.PutUint32(buf[44:], uint32(node.pongReceived/1000))
+	copy(buf[48:48+NET_IP_STR_LEN-1], node.ip)
+	binary.BigEndian.PutUint16(buf[94:], uint16(node.port))
+	binary.BigEndian.PutUint16(buf[96:], uint16(node.cport))
+	binary.BigEndian.PutUint16(buf[98:], uint16(node.flags))
+}
+
+// clusterSendPing sends a PING, a PONG or a MEET, with gossip about a few
+// random nodes, and about all the ones we think are failing so that the
+// masters reach a quorum fast
+func (server *RedisServer) clusterSendPing(link *clusterLink, typ int) {
+	cluster := server.cluster
+	nodes := make([]*clusterNode, 0, len(cluster.nodes))
+	pfail := []*clusterNode{}
+	for _, node := range cluster.nodes {
+		nodes = append(nodes, node)
+		if node.flags&CLUSTER_NODE_PFAIL != 0 && node.flags&(CLUSTER_NODE_HANDSHAKE|CLUSTER_NODE_NOADDR) == 0 {
+			pfail = append(pfail, node)
+		}
+	}
+
+	// a tenth of the nodes, at least 3, but never us or the receiver
+	freshnodes := len(nodes) - 2
+	wanted := len(nodes) / 10
+	if wanted < 3 {
+		wanted = 3
+	}
+	if wanted > freshnodes {
+		wanted = freshnodes
+	}
+
+	gossip := []*clusterNode{}
+	picked := map[*clusterNode]bool{}
+	for maxiterations := wanted * 3; freshnodes > 0 && len(gossip) < wanted && maxiterations > 0; maxiterations-- {
+		node := nodes[rand.Intn(len(nodes))]
+		if node == cluster.myself || node.flags&CLUSTER_NODE_PFAIL != 0 || picked[node] {
+			continue
+		}
+		// not worth telling about, or not known for sure yet
+		if node.flags&(CLUSTER_NODE_HANDSHAKE|CLUSTER_NODE_NOADDR) != 0 || (node.link == nil && node.numslots == 0) {
+			freshnodes--
+			continue
+		}
+		picked[node] = true
+		gossip = append(gossip, node)
+		freshnodes--
+	}
+	gossip = append(gossip, pfail...)
+
+	if link.node != nil && typ == CLUSTERMSG_TYPE_PING {
+		link.node.pingSent = time.Now().UnixMilli()
+	}
+
+	msg := server.clusterBuildMessageHdr(typ, len(gossip)*CLUSTERMSG_GOSSIP_SIZE)
+	binary.BigEndian.PutUint16(msg[14:], uint16(len(gossip)))
+	for i, node := range gossip {
+		clusterSetGossipEntry(msg[CLUSTERMSG_HDR_SIZE+i*CLUSTERMSG_GOSSIP_SIZE:], node)
+	}
+	server.clusterSendMessage(link, msg)
+}
+
+// clusterBroadcastPong tells our new config right away, rather than with
+// the next pings, to all the nodes or to the replicas of our master
+func (server *RedisServer) clusterBroadcastPong(target int) {
+	myself := server.cluster.myself
+	for _, node := range server.cluster.nodes {
+		if node.link == nil || node.flags&(CLUSTER_NODE_MYSELF|CLUSTER_NODE_HANDSHAKE) != 0 {
+			continue
+		}
+		if target == CLUSTER_BROADCAST_LOCAL_SLAVES {
+			localSlave := node.isSlave() && node.slaveof != nil && (node.slaveof == myself || node.slaveof == myself.slaveof)
+			if !localSlave {
+				continue
+			}
+		}
+		server.clusterSendPing(node.link, CLUSTERMSG_TYPE_PONG)
+	}
+}
+
+// clusterSendFail tells everybody the node failed, so the reachable nodes
+// flag it without waiting for their own quorum
+func (server *RedisServer) clusterSendFail(name string) {
+	msg := server.clusterBuildMessageHdr(CLUSTERMSG_TYPE_FAIL, CLUSTERMSG_FAIL_SIZE)
+	putClusterName(msg[CLUSTERMSG_HDR_SIZE:], name)
+	server.clusterBroadcastMessage(msg)
+}
+
+// clusterSendUpdate tells a node claiming slots of the node that they were
+// taken over with a newer config epoch
+func (server *RedisServer) clusterSendUpdate(link *clusterLink, node *clusterNode) {
+	if link == nil {
+		return
+	}
+	msg := server.clusterBuildMessageHdr(CLUSTERMSG_TYPE_UPDATE, CLUSTERMSG_UPDATE_SIZE)
+	data := msg[CLUSTERMSG_HDR_SIZE:]
+	binary.BigEndian.PutUint64(data, node.configEpoch)
+	putClusterName(data[8:], node.name)
+	copy(data[8+CLUSTER_NAMELEN:], node.slots[:])
+	server.clusterSendMessage(link, msg)
+}
+
+// clusterPropagatePublish sends a published message to all the nodes, or
+// for a shard channel to the other nodes of our shard, whose subscribers
+// get it too
+func (server *RedisServer) clusterPropagatePublish(channel, message string, t pubsubType) {
+	typ := CLUSTERMSG_TYPE_PUBLISH
+	if t.shard {
+		typ = CLUSTERMSG_TYPE_PUBLISHSHARD
+	}
+	msg := server.clusterBuildMessageHdr(typ, 8+len(channel)+len(message))
+	data := msg[CLUSTERMSG_HDR_SIZE:]
+	binary.BigEndian.PutUint32(data, uint32(len(channel)))
+	binary.BigEndian.PutUint32(data[4:], uint32(len(message)))
+	copy(data[8:], channel)
+	copy(data[8+len(channel):], message)
+
+	if !t.shard {
+		server.clusterBroadcastMessage(msg)
+		return
+	}
+	myself := server.cluster.myself
+	master := myself
+	if myself.isSlave() && myself.slaveof != nil {
+		master = myself.slaveof
+	}
+	for _, node := range append([]*clusterNode{master}, master.slaves...) {
+		if node != myself && !node.inHandshake() {
+			server.clusterSendMessage(node.link, msg)
+		}
+	}
+}
+
+// clusterMsgExpectedLen checks the length of the message for its type
+func clusterMsgExpectedLen(hdr *clusterMsgHeader, msg []byte) bool {
+	explen := CLUSTERMSG_HDR_SIZE
+	switch hdr.typ {
+	case CLUSTERMSG_TYPE_PING, CLUSTERMSG_TYPE_PONG, CLUSTERMSG_TYPE_MEET:
+		// the extensions of newer nodes follow the gossip, we skip them
+		return len(msg) >= explen+hdr.count*CLUSTERMSG_GOSSIP_SIZE
+	case CLUSTERMSG_TYPE_FAIL:
+		explen += CLUSTERMSG_FAIL_SIZE
+	case CLUSTERMSG_TYPE_PUBLISH, CLUSTERMSG_TYPE_PUBLISHSHARD:
+		if len(msg) < explen+8 {
+			return false
+		}
+		explen += 8 + int(binary.BigEndian.Uint32(msg[explen:])) + int(binary.BigEndian.Uint32(msg[explen+4:]))
+	case CLUSTERMSG_TYPE_UPDATE:
+		explen += CLUSTERMSG_UPDATE_SIZE
+	case CLUSTERMSG_TYPE_FAILOVER_AUTH_REQUEST, CLUSTERMSG_TYPE_FAILOVER_AUTH_ACK, CLUSTERMSG_TYPE_MFSTART:
+	default:
+		return true
+	}
+	return len(msg) == explen
+}
+
+// nodeIp2String is the address the node announced, or the one it
+// connected from
+func nodeIp2String(link *clusterLink, announced string) string {
+	if announced != "" {
+		return announced
+	}
+	host, _, err := net.SplitHostPort(link.conn.RemoteAddr().String())
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+// nodeUpdateAddressIfNeeded follows a node that moved to another address,
+// telling if it did
+func (server *RedisServer) nodeUpdateAddressIfNeeded(node *clusterNode, link *clusterLink, hdr *clusterMsgHeader) bool {
+	if link == node.link {
+		return false
+	}
+	ip := nodeIp2String(link, hdr.myip)
+	if node.port == hdr.port && node.cport == hdr.cport && node.ip == ip {
+		return false
+	}
+
+	node.ip, node.port, node.cport = ip, hdr.port, hdr.cport
+	server.freeClusterLink(node.link)
+	node.flags &^= CLUSTER_NODE_NOADDR
+	fmt.Printf("Address updated for node %s, now %s:%d\n", node.name, ip, node.port)
+
+	// we replicate our master at its new address
+	if server.cluster.myself.slaveof == node {
+		server.replicationSetMaster(node.ip, node.port)
+	}
+	return true
+}
+
+// clusterProcessPacket handles a message of the bus
+func (server *RedisServer) clusterProcessPacket(link *clusterLink, msg []byte) {
+	cluster := server.cluster
+	hdr := parseClusterMsgHeader(msg)
+
+	if hdr.ver != CLUSTER_PROTO_VER {
+		return
+	}
+	if !clusterMsgExpectedLen(hdr, msg) {
+		fmt.Printf("Received invalid %d packet of length %d\n", hdr.typ, len(msg))
+		return
+	}
+	if hdr.typ < CLUSTERMSG_TYPE_COUNT {
+		cluster.statsBusMessagesReceived[hdr.typ]++
+	}
+
+	now := time.Now().UnixMilli()
+	var sender *clusterNode
+	if link.node != nil && !link.node.inHandshake() {
+		sender = link.node
+	} else if node := server.clusterLookupNode(hdr.sender); node != nil && !node.inHandshake() {
+		sender = node
+	}
+	if sender != nil {
+		sender.dataReceived = now
+
+		// the epochs only go forward
+		if hdr.currentEpoch > cluster.currentEpoch {
+			cluster.currentEpoch = hdr.currentEpoch
+			server.clusterDoBeforeSleep(CLUSTER_TODO_SAVE_CONFIG)
+		}
+		if hdr.configEpoch > sender.configEpoch {
+			sender.configEpoch = hdr.configEpoch
+			server.clusterDoBeforeSleep(CLUSTER_TODO_SAVE_CONFIG)
+		}
+		sender.replOffset = hdr.offset
+
+		// our master paused its writes for our manual failover, its offset
+		// is the one we must reach
+		if cluster.mfEnd != 0 && cluster.myself.isSlave() && cluster.myself.slaveof == sender &&
+			hdr.mflags[0]&CLUSTERMSG_FLAG0_PAUSED != 0 && cluster.mfMasterOffset == -1 {
+			cluster.mfMasterOffset = sender.replOffset
+			server.clusterDoBeforeSleep(CLUSTER_TODO_HANDLE_MANUALFAILOVER)
+			fmt.Printf("Received replication offset for paused master manual failover: %d\n", cluster.mfMasterOffset)
+		}
+	}
+
+	switch hdr.typ {
+	case CLUSTERMSG_TYPE_PING, CLUSTERMSG_TYPE_PONG, CLUSTERMSG_TYPE_MEET:
+		server.clusterProcessPing(link, hdr, msg, sender)
+	case CLUSTERMSG_TYPE_FAIL:
+		about := string(msg[CLUSTERMSG_HDR_SIZE : CLUSTERMSG_HDR_SIZE+CLUSTER_NAMELEN])
+		if sender == nil {
+			fmt.Printf("Ignoring FAIL message from unknown node %s about %s\n", hdr.sender, about)
+			return
+		}
+		failing := server.clusterLookupNode(about)
+		if failing != nil && failing.flags&(CLUSTER_NODE_FAIL|CLUSTER_NODE_MYSELF) == 0 {
+			fmt.Printf("FAIL message received from %s about %s\n", hdr.sender, about)
+			failing.flags |= CLUSTER_NODE_FAIL
+			failing.flags &^= CLUSTER_NODE_PFAIL
+			failing.failTime = now
+			server.clusterDoBeforeSleep(CLUSTER_TODO_UPDATE_STATE | CLUSTER_TODO_SAVE_CONFIG)
+		}
+	case CLUSTERMSG_TYPE_UPDATE:
+		if sender == nil {
+			return
+		}
+		data := msg[CLUSTERMSG_HDR_SIZE:]
+		configEpoch := binary.BigEndian.Uint64(data)
+		node := server.clusterLookupNode(string(data[8 : 8+CLUSTER_NAMELEN]))
+		if node == nil || node.configEpoch >= configEpoch {
+			return
+		}
+		// a replica that took the slots over is a master now
+		if node.isSlave() {
+			server.clusterSetNodeAsMaster(node)
+		}
+		node.configEpoch = configEpoch
+		var slots [CLUSTER_SLOTS / 8]byte
+		copy(slots[:], data[8+CLUSTER_NAMELEN:])
+		server.clusterUpdateSlotsConfigWith(node, configEpoch, &slots)
+		server.clusterDoBeforeSleep(CLUSTER_TODO_SAVE_CONFIG)
+	case CLUSTERMSG_TYPE_PUBLISH, CLUSTERMSG_TYPE_PUBLISHSHARD:
+		if sender == nil {
+			return
+		}
+		data := msg[CLUSTERMSG_HDR_SIZE:]
+		channelLen := binary.BigEndian.Uint32(data)
+		channel := string(data[8 : 8+channelLen])
+		message := string(data[8+channelLen:])
+		t := pubsubTypeGlobal
+		if hdr.typ == CLUSTERMSG_TYPE_PUBLISHSHARD {
+			t = pubsubTypeShard
+		}
+		server.pubsubPublishMessage(channel, message, t)
+	case CLUSTERMSG_TYPE_FAILOVER_AUTH_REQUEST:
+		if sender == nil {
+			return
+		}
+		server.clusterSendFailoverAuthIfNeeded(sender, hdr)
+	case CLUSTERMSG_TYPE_FAILOVER_AUTH_ACK:
+		if sender == nil {
+			return
+		}
+		// only the masters serving slots vote, for the election in progress
+		if sender.isMaster() && sender.numslots > 0 && hdr.currentEpoch >= cluster.failoverAuthEpoch {
+			cluster.failoverAuthCount++
+			server.clusterDoBeforeSleep(CLUSTER_TODO_HANDLE_FAILOVER)
+		}
+	case CLUSTERMSG_TYPE_MFSTART:
+		// one of our replicas wants to take over, we pause the writes until
+		// it processed all of them
+		if sender == nil || sender.slaveof != cluster.myself {
+			return
+		}
+		server.resetManualFailover()
+		cluster.mfEnd = now + CLUSTER_MF_TIMEOUT
+		cluster.mfSlave = sender
+		server.pauseClients(PAUSE_DURING_FAILOVER, time.Time{}, CLIENT_PAUSE_WRITE)
+		fmt.Printf("Manual failover requested by replica %s.\n", sender.name)
+		// our offset comes with the PAUSED flag of the ping
+		server.clusterSendPing(link, CLUSTERMSG_TYPE_PING)
+	}
+}
+
+// clusterProcessPing handles PING, PONG and MEET: the handshake with new
+// nodes, the role and the slots of the sender, and its gossip
+func (server *RedisServer) clusterProcessPing(link *clusterLink, hdr *clusterMsgHeader, msg []byte, sender *clusterNode) {
+	cluster := server.cluster
+	myself := cluster.myself
+	now := time.Now().UnixMilli()
+
+	if hdr.typ == CLUSTERMSG_TYPE_PING || hdr.typ == CLUSTERMSG_TYPE_MEET {
+		// only the nodes of the cluster send us MEET, so the address they
+		// reach us at is ours
+		if hdr.typ == CLUSTERMSG_TYPE_MEET || myself.ip == "" {
+			if ip, _, err := net.SplitHostPort(link.conn.LocalAddr().String()); err == nil && ip != myself.ip {
+				myself.ip = ip
+				fmt.Printf("IP address for this node updated to %s\n", ip)
+				server.clusterDoBeforeSleep(CLUSTER_TODO_SAVE_CONFIG)
+			}
+		}
+
+		// a node met us, we meet it back to learn its name
+		if sender == nil && hdr.typ == CLUSTERMSG_TYPE_MEET {
+			node := createClusterNode("", CLUSTER_NODE_HANDSHAKE)
+			node.ip = nodeIp2String(link, hdr.myip)
+			node.port, node.cport = hdr.port, hdr.cport
+			server.clusterAddNode(node)
+			server.clusterDoBeforeSleep(CLUSTER_TODO_SAVE_CONFIG)
+			server.clusterProcessGossipSection(hdr, msg, link, nil)
+		}
+
+		if link.inbound && sender != nil && sender.inboundLink != link {
+			server.freeClusterLink(sender.inboundLink)
+			sender.inboundLink = link
+		}
+		server.clusterSendPing(link, CLUSTERMSG_TYPE_PONG)
+	}
+
+	if link.node != nil {
+		if link.node.inHandshake() {
+			// we met a node we already knew, at another address
+			if sender != nil {
+				server.nodeUpdateAddressIfNeeded(sender, link, hdr)
+				server.clusterDelNode(link.node)
+				return
+			}
+			server.clusterRenameNode(link.node, hdr.sender)
+			fmt.Printf("Handshake with node %s completed.\n", link.node.name)
+			link.node.flags &^= CLUSTER_NODE_HANDSHAKE
+			link.node.flags |= hdr.flags & (CLUSTER_NODE_MASTER | CLUSTER_NODE_SLAVE)
+			server.clusterDoBeforeSleep(CLUSTER_TODO_SAVE_CONFIG)
+			sender = link.node
+		} else if link.node.name != hdr.sender {
+			// another node answers at the address now
+			fmt.Printf("PONG contains mismatching sender ID. About node %s added %d ms ago, having flags %d\n",
+				link.node.name, now-link.node.ctime.UnixMilli(), link.node.flags)
+			link.node.flags |= CLUSTER_NODE_NOADDR
+			link.node.ip, link.node.port, link.node.cport = "", 0, 0
+			server.freeClusterLink(link)
+			server.clusterDoBeforeSleep(CLUSTER_TODO_SAVE_CONFIG)
+			return
+		}
+	}
+
+	if sender != nil && hdr.typ == CLUSTERMSG_TYPE_PING {
+		server.nodeUpdateAddressIfNeeded(sender, link, hdr)
+	}
+
+	// the node answered our ping, it is reachable
+	if link.node != nil && hdr.typ == CLUSTERMSG_TYPE_PONG {
+		node := link.node
+		node.pongReceived = now
+		node.pingSent = 0
+		if node.flags&CLUSTER_NODE_PFAIL != 0 {
+			node.flags &^= CLUSTER_NODE_PFAIL
+			server.clusterDoBeforeSleep(CLUSTER_TODO_UPDATE_STATE)
+		} else if node.failed() {
+			server.clearNodeFailureIfNeeded(node)
+		}
+	}
+
+	if sender == nil {
+		return
+	}
+
+	// the role of the sender, and the master of a replica
+	if hdr.slaveof == "" {
+		server.clusterSetNodeAsMaster(sender)
+	} else {
+		if sender.isMaster() {
+			server.clusterDelNodeSlots(sender)
+			sender.flags &^= CLUSTER_NODE_MASTER
+			sender.flags |= CLUSTER_NODE_SLAVE
+			server.clusterDoBeforeSleep(CLUSTER_TODO_SAVE_CONFIG | CLUSTER_TODO_UPDATE_STATE)
+		}
+		master := server.clusterLookupNode(hdr.slaveof)
+		if master != nil && sender.slaveof != master {
+			if sender.slaveof != nil {
+				sender.slaveof.removeSlave(sender)
+			}
+			master.addSlave(sender)
+			sender.slaveof = master
+			server.clusterDoBeforeSleep(CLUSTER_TODO_SAVE_CONFIG)
+		}
+	}
+
+	// the slots the sender claims, for it or for its master
+	senderMaster := sender
+	if !sender.isMaster() {
+		senderMaster = sender.slaveof
+	}
+	dirtySlots := senderMaster != nil && senderMaster.slots != hdr.myslots
+	if sender.isMaster() && dirtySlots {
+		server.clusterUpdateSlotsConfigWith(sender, hdr.configEpoch, &hdr.myslots)
+	}
+
+	// the sender claims slots we know were taken over since
+	if dirtySlots {
+		for slot := 0; slot < CLUSTER_SLOTS; slot++ {
+			if hdr.myslots[slot/8]&(1<<(slot%8)) == 0 {
+				continue
+			}
+			owner := cluster.slots[slot]
+			if owner == nil || owner == sender {
+				continue
+			}
+			if owner.configEpoch > hdr.configEpoch {
+				server.clusterSendUpdate(sender.link, owner)
+				break
+			}
+		}
+	}
+
+	if myself.isMaster() && sender.isMaster() && hdr.configEpoch == myself.configEpoch {
+		server.clusterHandleConfigEpochCollision(sender)
+	}
+
+	server.clusterProcessGossipSection(hdr, msg, link, sender)
+}
+
+// clusterProcessGossipSection learns about the nodes the sender gossips
+// about: the failures a master reports, and the nodes we didn't know
+func (server *RedisServer) clusterProcessGossipSection(hdr *clusterMsgHeader, msg []byte, link *clusterLink, sender *clusterNode) {
+	now := time.Now().UnixMilli()
+	for i := 0; i < hdr.count; i++ {
+		g := msg[CLUSTERMSG_HDR_SIZE+i*CLUSTERMSG_GOSSIP_SIZE:]
+		name := string(g[:CLUSTER_NAMELEN])
+		pongReceived := int64(binary.BigEndian.Uint32(g[44:])) * 1000
+		ip := getClusterString(g[48 : 48+NET_IP_STR_LEN])
+		port := int(binary.BigEndian.Uint16(g[94:]))
+		cport := int(binary.BigEndian.Uint16(g[96:]))
+		flags := int(binary.BigEndian.Uint16(g[98:]))
+
+		node := server.clusterLookupNode(name)
+		if node == nil {
+			// a node we don't know, with the name it has, we'll ping it
+			if sender != nil && flags&CLUSTER_NODE_NOADDR == 0 && !server.clusterBlacklistExists(name) {
+				node = createClusterNode(name, flags&^CLUSTER_NODE_MYSELF)
+				node.ip, node.port, node.cport = ip, port, cport
+				server.clusterAddNode(node)
+			}
+			continue
+		}
+
+		// the failure reports of the masters
+		if sender != nil && sender.isMaster() && node != server.cluster.myself {
+			if flags&(CLUSTER_NODE_FAIL|CLUSTER_NODE_PFAIL) != 0 {
+				if node.addFailureReport(sender) {
+					fmt.Printf("Node %s reported node %s as not reachable.\n", sender.name, node.name)
+				}
+				server.markNodeAsFailingIfNeeded(node)
+			} else if node.delFailureReport(sender) {
+				fmt.Printf("Node %s reported node %s is back online.\n", sender.name, node.name)
+			}
+		}
+
+		// the sender heard from the node more recently than we did
+		if flags&(CLUSTER_NODE_FAIL|CLUSTER_NODE_PFAIL) == 0 && node.pingSent == 0 && node.failureReportsCount(server) == 0 {
+			if pongReceived <= now+500 && pongReceived > node.pongReceived {
+				node.pongReceived = pongReceived
+			}
+		}
+
+		// a node we can't reach, that the sender reaches at another address
+		if node.flags&(CLUSTER_NODE_FAIL|CLUSTER_NODE_PFAIL) != 0 && flags&CLUSTER_NODE_NOADDR == 0 &&
+			flags&(CLUSTER_NODE_FAIL|CLUSTER_NODE_PFAIL) == 0 &&
+			(node.ip != ip || node.port != port || node.cport != cport) {
+			server.freeClusterLink(node.link)
+			node.ip, node.port, node.cport = ip, port, cport
+			node.flags &^= CLUSTER_NODE_NOADDR
+		}
+	}
+}
+
+// addFailureReport records that the master thinks the node is failing,
+// telling if it didn't already
+func (node *clusterNode) addFailureReport(sender *clusterNode) bool {
+	now := time.Now().UnixMilli()
+	for i := range node.failReports {
+		if node.failReports[i].node == sender {
+			node.failReports[i].time = now
+			return false
+		}
+	}
+	node.failReports = append(node.failReports, clusterNodeFailReport{node: sender, time: now})
+	return true
+}
+
+func (node *clusterNode) delFailureReport(sender *clusterNode) bool {
+	for i, report := range node.failReports {
+		if report.node == sender {
+			node.failReports = append(node.failReports[:i], node.failReports[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// failureReportsCount counts the reports still valid
+func (node *clusterNode) failureReportsCount(server *RedisServer) int {
+	maxtime := int64(server.Config.ClusterNodeTimeout) * CLUSTER_FAIL_REPORT_VALIDITY_MULT
+	now := time.Now().UnixMilli()
+	reports := node.failReports[:0]
+	for _, report := range node.failReports {
+		if now-report.time <= maxtime {
+			reports = append(reports, report)
+		}
+	}
+	node.failReports = reports
+	return len(reports)
+}
+
+// markNodeAsFailingIfNeeded fails a node we can't reach once the majority
+// of the masters agree, and tells everybody
+func (server *RedisServer) markNodeAsFailingIfNeeded(node *clusterNode) {
+	cluster := server.cluster
+	neededQuorum := cluster.size/2 + 1
+	if node.flags&CLUSTER_NODE_PFAIL == 0 || node.failed() {
+		return
+	}
+
+	failures := node.failureReportsCount(server)
+	if cluster.myself.isMaster() {
+		failures++
+	}
+	if failures < neededQuorum {
+		return
+	}
+
+	fmt.Printf("Marking node %s as failing (quorum reached).\n", node.name)
+	node.flags &^= CLUSTER_NODE_PFAIL
+	node.flags |= CLUSTER_NODE_FAIL
+	node.failTime = time.Now().UnixMilli()
+	server.clusterSendFail(node.name)
+	server.clusterDoBeforeSleep(CLUSTER_TODO_UPDATE_STATE | CLUSTER_TODO_SAVE_CONFIG)
+}
+
+// clearNodeFailureIfNeeded clears the FAIL flag of a node reachable again,
+// unless it is a master whose slots may be failed over still
+func (server *RedisServer) clearNodeFailureIfNeeded(node *clusterNode) {
+	now := time.Now().UnixMilli()
+	if node.isSlave() || node.numslots == 0 {
+		fmt.Printf("Clear FAIL state for node %s: %s is reachable again.\n", node.name, map[bool]string{true: "replica", false: "master without slots"}[node.isSlave()])
+		node.flags &^= CLUSTER_NODE_FAIL
+		server.clusterDoBeforeSleep(CLUSTER_TODO_UPDATE_STATE | CLUSTER_TODO_SAVE_CONFIG)
+		return
+	}
+	if now-node.failTime > int64(server.Config.ClusterNodeTimeout)*CLUSTER_FAIL_UNDO_TIME_MULT {
+		fmt.Printf("Clear FAIL state for node %s: is reachable again and nobody is serving its slots after some time.\n", node.name)
+		node.flags &^= CLUSTER_NODE_FAIL
+		server.clusterDoBeforeSleep(CLUSTER_TODO_UPDATE_STATE | CLUSTER_TODO_SAVE_CONFIG)
+	}
+}
+
+// clusterHandleConfigEpochCollision makes two masters with the same config
+// epoch end up with different ones, the node with the lesser name takes a
+// new epoch
+func (server *RedisServer) clusterHandleConfigEpochCollision(sender *clusterNode) {
+	cluster := server.cluster
+	if sender.name <= cluster.myself.name {
+		return
+	}
+	cluster.currentEpoch++
+	cluster.myself.configEpoch = cluster.currentEpoch
+	server.clusterSaveConfigOrDie()
+	fmt.Printf("WARNING: configEpoch collision with node %s. configEpoch set to %d\n", sender.name, cluster.currentEpoch)
+}
+
+// clusterDelNodeSlots unassigns the slots of the node, returning how many
+func (server *RedisServer) clusterDelNodeSlots(node *clusterNode) int {
+	deleted := 0
+	for slot := 0; slot < CLUSTER_SLOTS; slot++ {
+		if node.hasSlot(slot) {
+			server.clusterDelSlot(slot)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+// clusterUpdateSlotsConfigWith gives the slots to the sender when its
+// config epoch is newer than the one of their owner. When we, or our
+// master, lost all the slots to the sender, a replica that was failed over
+// most likely, we become its replica. Otherwise the keys we had in the
+// slots we lost are deleted, another node serves them now.
+func (server *RedisServer) clusterUpdateSlotsConfigWith(sender *clusterNode, senderConfigEpoch uint64, slots *[CLUSTER_SLOTS / 8]byte) {
+	cluster := server.cluster
+	myself := cluster.myself
+	if sender == myself {
+		fmt.Println("Discarding UPDATE message about myself.")
+		return
+	}
+
+	// the master whose slots we serve, or replicate
+	curmaster := myself
+	if myself.isSlave() {
+		curmaster = myself.slaveof
+	}
+
+	var newmaster *clusterNode
+	dirtySlots := []int{}
+	for slot := 0; slot < CLUSTER_SLOTS; slot++ {
+		if slots[slot/8]&(1<<(slot%8)) == 0 {
+			continue
+		}
+		owner := cluster.slots[slot]
+		if owner == sender || cluster.importingSlotsFrom[slot] != nil {
+			continue
+		}
+		if owner != nil && owner.configEpoch >= senderConfigEpoch {
+			continue
+		}
+		if owner == myself && server.countKeysInSlot(slot) > 0 {
+			dirtySlots = append(dirtySlots, slot)
+		}
+		if owner != nil && owner == curmaster {
+			newmaster = sender
+		}
+		server.clusterDelSlot(slot)
+		server.clusterAddSlot(sender, slot)
+		server.clusterDoBeforeSleep(CLUSTER_TODO_UPDATE_STATE | CLUSTER_TODO_SAVE_CONFIG)
+	}
+
+	if newmaster != nil && curmaster.numslots == 0 {
+		fmt.Printf("Configuration change detected. Reconfiguring myself as a replica of %s\n", sender.name)
+		server.clusterSetMaster(sender)
+		server.clusterDoBeforeSleep(CLUSTER_TODO_UPDATE_STATE | CLUSTER_TODO_SAVE_CONFIG)
+		return
+	}
+	for _, slot := range dirtySlots {
+		server.delKeysInSlot(slot)
+	}
+}
+
+// delKeysInSlot deletes the keys of a slot another node serves now
+func (server *RedisServer) delKeysInSlot(slot int) {
+	for _, key := range server.getKeysInSlot(slot, -1) {
+		server.dbGenericDelete(key, false)
+		server.propagateDeletion(key, false)
+	}
+}
+
+// clusterCron runs every 100 milliseconds: it connects to the nodes we
+// have no link with, pings them, flags the ones that don't answer, and
+// fails over our master when it failed
+func (server *RedisServer) clusterCron() {
+	cluster := server.cluster
+	if cluster == nil {
+		return
+	}
+	cluster.cronIteration++
+	now := time.Now().UnixMilli()
+	nodeTimeout := int64(server.Config.ClusterNodeTimeout)
+	handshakeTimeout := nodeTimeout
+	if handshakeTimeout < 1000 {
+		handshakeTimeout = 1000
+	}
+	updateState := false
+
+	for _, node := range cluster.nodes {
+		if node.flags&(CLUSTER_NODE_MYSELF|CLUSTER_NODE_NOADDR) != 0 {
+			continue
+		}
+		// a node that never answered our MEET
+		if node.inHandshake() && now-node.ctime.UnixMilli() > handshakeTimeout {
+			server.clusterDelNode(node)
+			continue
+		}
+		if node.link == nil {
+			server.clusterConnectNode(node, nodeTimeout)
+		}
+	}
+
+	// every second, ping the node we heard from the longest ago, of a few
+	if cluster.cronIteration%10 == 0 {
+		var minPongNode *clusterNode
+		nodes := make([]*clusterNode, 0, len(cluster.nodes))
+		for _, node := range cluster.nodes {
+			nodes = append(nodes, node)
+		}
+		for j := 0; j < 5; j++ {
+			node := nodes[rand.Intn(len(nodes))]
+			if node.link == nil || node.pingSent != 0 || node.flags&(CLUSTER_NODE_MYSELF|CLUSTER_NODE_HANDSHAKE) != 0 {
+				continue
+			}
+			if minPongNode == nil || minPongNode.pongReceived > node.pongReceived {
+				minPongNode = node
+			}
+		}
+		if minPongNode != nil {
+			server.clusterSendPing(minPongNode.link, CLUSTERMSG_TYPE_PING)
+		}
+	}
+
+	for _, node := range cluster.nodes {
+		if node.flags&(CLUSTER_NODE_MYSELF|CLUSTER_NODE_NOADDR|CLUSTER_NODE_HANDSHAKE) != 0 {
+			continue
+		}
+
+		// a link that stopped carrying anything may be the problem
+		pingDelay := now - node.pingSent
+		dataDelay := now - node.dataReceived
+		if node.link != nil && now-node.link.ctime > nodeTimeout && node.pingSent != 0 &&
+			pingDelay > nodeTimeout/2 && dataDelay > nodeTimeout/2 {
+			server.freeClusterLink(node.link)
+		}
+
+		// the replica in our manual failover waits for our offset
+		if cluster.mfEnd != 0 && cluster.myself.isMaster() && cluster.mfSlave == node && node.link != nil {
+			server.clusterSendPing(node.link, CLUSTERMSG_TYPE_PING)
+			continue
+		}
+
+		// no node goes without a ping for more than half the timeout
+		if node.link != nil && node.pingSent == 0 && now-node.pongReceived > nodeTimeout/2 {
+			server.clusterSendPing(node.link, CLUSTERMSG_TYPE_PING)
+			continue
+		}
+		if node.pingSent == 0 {
+			continue
+		}
+
+		nodeDelay := pingDelay
+		if dataDelay < nodeDelay {
+			nodeDelay = dataDelay
+		}
+		if nodeDelay > nodeTimeout && node.flags&(CLUSTER_NODE_PFAIL|CLUSTER_NODE_FAIL) == 0 {
+			fmt.Printf("*** NODE %s possibly failing\n", node.name)
+			node.flags |= CLUSTER_NODE_PFAIL
+			updateState = true
+			// alone, we are the majority
+			if cluster.size == 1 && cluster.myself.isMaster() {
+				server.markNodeAsFailingIfNeeded(node)
+			}
+		}
+	}
+
+	// a replica replicates its master once it knows where it is
+	myself := cluster.myself
+	if myself.isSlave() && server.Config.MasterHost == "" && myself.slaveof != nil && myself.slaveof.flags&CLUSTER_NODE_NOADDR == 0 && myself.slaveof.ip != "" {
+		server.replicationSetMaster(myself.slaveof.ip, myself.slaveof.port)
+	}
+
+	server.manualFailoverCheckTimeout()
+
+	if myself.isSlave() {
+		server.clusterHandleManualFailover()
+		server.clusterHandleSlaveFailover()
+	}
+
+	if updateState || cluster.state == CLUSTER_FAIL {
+		server.clusterUpdateState()
+	}
+}
+
+// clusterConnectNode opens a link to the node, to send it a MEET if it
+// doesn't know us yet, a PING otherwise
+func (server *RedisServer) clusterConnectNode(node *clusterNode, timeout int64) {
+	link := createClusterLink(node)
+	node.link = link
+	addr := net.JoinHostPort(node.ip, strconv.Itoa(node.cport))
+	tlsConfig := server.tlsDialConfig(server.Config.TlsCluster)
+
+	go func() {
+		conn, err := connDial(addr, time.Duration(timeout)*time.Millisecond, tlsConfig)
+		server.runOnExecutor(func() {
+			if link.closed {
+				if conn != nil {
+					conn.Close()
+				}
+				return
+			}
+			if err != nil {
+				// a node we can't connect to times out like one that
+				// doesn't answer
+				if node.pingSent == 0 {
+					node.pingSent = time.Now().UnixMilli()
+				}
+				server.freeClusterLink(link)
+				return
+			}
+			server.clusterLinkConnected(link, conn)
+
+			// the ping in flight stays the one the timeout counts from
+			oldPingSent := node.pingSent
+			if node.flags&CLUSTER_NODE_MEET != 0 {
+				server.clusterSendPing(link, CLUSTERMSG_TYPE_MEET)
+			} else {
+				server.clusterSendPing(link, CLUSTERMSG_TYPE_PING)
+			}
+			if oldPingSent != 0 {
+				node.pingSent = oldPingSent
+			}
+			node.flags &^= CLUSTER_NODE_MEET
+		})
+	}()
+}
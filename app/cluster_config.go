@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The cluster config file, nodes.conf by default, is the node table as
+// CLUSTER NODES lists it, followed by the epochs:
+//
+//	vars currentEpoch <epoch> lastVoteEpoch <epoch>
+//
+// It is rewritten on every change of the topology, so a node comes back
+// with its name, its slots and what it knew of the others.
+
+// clusterLoadConfig loads the node table, telling if there was one
+func (server *RedisServer) clusterLoadConfig(path string) (bool, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	cluster := server.cluster
+	empty := true
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		empty = false
+
+		if fields[0] == "vars" {
+			for i := 1; i+1 < len(fields); i += 2 {
+				value, err := strconv.ParseUint(fields[i+1], 10, 64)
+				if err != nil {
+					return false, fmt.Errorf("invalid %s value: %s", fields[i], fields[i+1])
+				}
+				switch fields[i] {
+				case "currentEpoch":
+					cluster.currentEpoch = value
+				case "lastVoteEpoch":
+					cluster.lastVoteEpoch = value
+				default:
+					fmt.Printf("Skipping unknown cluster config variable '%s'\n", fields[i])
+				}
+			}
+			continue
+		}
+
+		if len(fields) < 8 {
+			return false, fmt.Errorf("invalid line: %s", scanner.Text())
+		}
+		if err := server.clusterLoadNodeLine(fields); err != nil {
+			return false, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return false, err
+	}
+
+	// an empty file is like no file
+	if empty {
+		return false, nil
+	}
+	if cluster.myself == nil {
+		return false, errors.New("myself is missing")
+	}
+
+	fmt.Printf("Node configuration loaded, I'm %s\n", cluster.myself.name)
+
+	// the current epoch is at least the epoch of every node
+	for _, node := range cluster.nodes {
+		if node.configEpoch > cluster.currentEpoch {
+			cluster.currentEpoch = node.configEpoch
+		}
+	}
+	return true, nil
+}
+
+func (server *RedisServer) clusterLoadNodeLine(fields []string) error {
+	cluster := server.cluster
+
+	node := server.clusterLookupNode(fields[0])
+	if node == nil {
+		node = createClusterNode(fields[0], 0)
+		server.clusterAddNode(node)
+	}
+
+	// ip:port@cport, with an optional ,hostname
+	addr := strings.SplitN(fields[1], ",", 2)[0]
+	at := strings.LastIndexByte(addr, '@')
+	colon := strings.LastIndexByte(addr, ':')
+	if colon < 0 {
+		return fmt.Errorf("invalid address: %s", fields[1])
+	}
+	node.ip = addr[:colon]
+	portEnd := len(addr)
+	if at > colon {
+		portEnd = at
+		cport, err := strconv.Atoi(addr[at+1:])
+		if err != nil {
+			return fmt.Errorf("invalid address: %s", fields[1])
+		}
+		node.cport = cport
+	}
+	port, err := strconv.Atoi(addr[colon+1 : portEnd])
+	if err != nil {
+		return fmt.Errorf("invalid address: %s", fields[1])
+	}
+	node.port = port
+	if at <= colon {
+		node.cport = port + CLUSTER_PORT_INCR
+	}
+
+	for _, flag := range strings.Split(fields[2], ",") {
+		switch flag {
+		case "myself":
+			if cluster.myself != nil {
+				return errors.New("more than one myself")
+			}
+			cluster.myself = node
+			node.flags |= CLUSTER_NODE_MYSELF
+		case "master":
+			node.flags |= CLUSTER_NODE_MASTER
+		case "slave":
+			node.flags |= CLUSTER_NODE_SLAVE
+		case "fail?":
+			node.flags |= CLUSTER_NODE_PFAIL
+		case "fail":
+			node.flags |= CLUSTER_NODE_FAIL
+		case "handshake":
+			node.flags |= CLUSTER_NODE_HANDSHAKE
+		case "noaddr":
+			node.flags |= CLUSTER_NODE_NOADDR
+		case "noflags":
+		default:
+			return fmt.Errorf("unknown flag in cluster config file: %s", flag)
+		}
+	}
+
+	if fields[3] != "-" {
+		master := server.clusterLookupNode(fields[3])
+		if master == nil {
+			master = createClusterNode(fields[3], 0)
+			server.clusterAddNode(master)
+		}
+		node.slaveof = master
+		master.addSlave(node)
+	}
+
+	pingSent, err1 := strconv.ParseInt(fields[4], 10, 64)
+	pongReceived, err2 := strconv.ParseInt(fields[5], 10, 64)
+	configEpoch, err3 := strconv.ParseUint(fields[6], 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return fmt.Errorf("invalid line: %s", strings.Join(fields, " "))
+	}
+	// a ping in flight is not once we restarted
+	if pingSent != 0 {
+		node.pingSent = time.Now().UnixMilli()
+	}
+	node.pongReceived = pongReceived
+	node.configEpoch = configEpoch
+
+	for _, field := range fields[8:] {
+		if err := server.clusterLoadSlotField(node, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clusterLoadSlotField loads a slot, a range of slots, or a migration like
+// [slot->-target] and [slot-<-source]
+func (server *RedisServer) clusterLoadSlotField(node *clusterNode, field string) error {
+	cluster := server.cluster
+	if strings.HasPrefix(field, "[") {
+		field = strings.Trim(field, "[]")
+		var slotArg, name string
+		migrating := false
+		if i := strings.Index(field, "->-"); i >= 0 {
+			slotArg, name, migrating = field[:i], field[i+3:], true
+		} else if i := strings.Index(field, "-<-"); i >= 0 {
+			slotArg, name = field[:i], field[i+3:]
+		} else {
+			return fmt.Errorf("invalid slot migration: %s", field)
+		}
+		slot, err := strconv.Atoi(slotArg)
+		if err != nil || slot < 0 || slot >= CLUSTER_SLOTS {
+			return fmt.Errorf("invalid slot: %s", slotArg)
+		}
+		other := server.clusterLookupNode(name)
+		if other == nil {
+			other = createClusterNode(name, 0)
+			server.clusterAddNode(other)
+		}
+		if migrating {
+			cluster.migratingSlotsTo[slot] = other
+		} else {
+			cluster.importingSlotsFrom[slot] = other
+		}
+		return nil
+	}
+
+	startArg, endArg := field, field
+	if i := strings.IndexByte(field, '-'); i >= 0 {
+		startArg, endArg = field[:i], field[i+1:]
+	}
+	start, err1 := strconv.Atoi(startArg)
+	end, err2 := strconv.Atoi(endArg)
+	if err1 != nil || err2 != nil || start < 0 || end >= CLUSTER_SLOTS || start > end {
+		return fmt.Errorf("invalid slot range: %s", field)
+	}
+	for slot := start; slot <= end; slot++ {
+		server.clusterAddSlot(node, slot)
+	}
+	return nil
+}
+
+// clusterSaveConfig writes the node table to a temp file and renames it
+// over the config file. The nodes in handshake are not saved, they are
+// forgotten on restart.
+func (server *RedisServer) clusterSaveConfig() error {
+	cluster := server.cluster
+	content := server.clusterGenNodesDescription(CLUSTER_NODE_HANDSHAKE) +
+		fmt.Sprintf("vars currentEpoch %d lastVoteEpoch %d\n", cluster.currentEpoch, cluster.lastVoteEpoch)
+
+	path := server.clusterConfigPath()
+	tmpPath := filepath.Join(filepath.Dir(path), fmt.Sprintf("temp-%d-%s", os.Getpid(), filepath.Base(path)))
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(content)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return err
+}
+
+// clusterSaveConfigOrDie exits when the config can't be saved, a node that
+// forgot what it agreed to could break the cluster once restarted
+func (server *RedisServer) clusterSaveConfigOrDie() {
+	if err := server.clusterSaveConfig(); err != nil {
+		fmt.Printf("Fatal: can't update cluster config file: %v\n", err)
+		os.Exit(1)
+	}
+}
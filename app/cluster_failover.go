@@ -0,0 +1,378 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// When a master fails, its replicas hold an election: each one asks the
+// masters for their vote in a new epoch, the replicas with the most recent
+// data asking first. The replica voted for by the majority of the masters
+// takes the slots of its master with the epoch it was elected in, newer
+// than the one the old master claims them with, and tells everybody.
+//
+// CLUSTER FAILOVER has the master pause its writes until the replica
+// processed all of them, then the replica is elected, without waiting for
+// its master to fail and without losing a write.
+
+// how long a manual failover can take, in milliseconds
+const CLUSTER_MF_TIMEOUT = 5000
+
+// why the replica of a failed master doesn't fail it over, yet
+const (
+	CLUSTER_CANT_FAILOVER_NONE = iota
+	CLUSTER_CANT_FAILOVER_DATA_AGE
+	CLUSTER_CANT_FAILOVER_WAITING_DELAY
+	CLUSTER_CANT_FAILOVER_EXPIRED
+	CLUSTER_CANT_FAILOVER_WAITING_VOTES
+)
+
+// the same reason is logged again after this many milliseconds
+const CLUSTER_CANT_FAILOVER_RELOG_PERIOD = 10000
+
+// clusterGetSlaveRank counts the replicas of our master with more recent
+// data than ours, which should be elected before us
+func (server *RedisServer) clusterGetSlaveRank() int {
+	myself := server.cluster.myself
+	if myself.slaveof == nil {
+		return 0
+	}
+	rank := 0
+	for _, slave := range myself.slaveof.slaves {
+		if slave != myself && slave.replOffset > server.repl.masterReplOffset {
+			rank++
+		}
+	}
+	return rank
+}
+
+// clusterLogCantFailover tells why we don't fail over our master, when the
+// reason changed or once in a while, but not right after the master failed
+func (server *RedisServer) clusterLogCantFailover(reason int) {
+	cluster := server.cluster
+	now := time.Now().UnixMilli()
+	if reason == cluster.cantFailoverReason && now-cluster.lastLogTime < CLUSTER_CANT_FAILOVER_RELOG_PERIOD {
+		return
+	}
+	cluster.cantFailoverReason = reason
+
+	master := cluster.myself.slaveof
+	if master != nil && master.failed() && now-master.failTime < int64(server.Config.ClusterNodeTimeout)+5000 {
+		return
+	}
+
+	var msg string
+	switch reason {
+	case CLUSTER_CANT_FAILOVER_DATA_AGE:
+		msg = "Disconnected from master for longer than allowed. Please check the 'cluster-replica-validity-factor' configuration option."
+	case CLUSTER_CANT_FAILOVER_WAITING_DELAY:
+		msg = "Waiting the delay before I can start a new failover."
+	case CLUSTER_CANT_FAILOVER_EXPIRED:
+		msg = "Failover attempt expired."
+	case CLUSTER_CANT_FAILOVER_WAITING_VOTES:
+		msg = "Waiting for votes, but majority still not reached."
+	default:
+		msg = "Unknown reason code."
+	}
+	cluster.lastLogTime = now
+	fmt.Printf("Currently unable to failover: %s\n", msg)
+}
+
+// clusterHandleSlaveFailover runs the election of a replica whose master
+// failed, or whose manual failover can start. It is called by the cron and
+// before sleeping, once the votes came.
+func (server *RedisServer) clusterHandleSlaveFailover() {
+	cluster := server.cluster
+	myself := cluster.myself
+	master := myself.slaveof
+	now := time.Now().UnixMilli()
+	nodeTimeout := int64(server.Config.ClusterNodeTimeout)
+	neededQuorum := cluster.size/2 + 1
+	manualFailover := cluster.mfEnd != 0 && cluster.mfCanStart
+
+	// the votes are valid for two node timeouts, another election can
+	// start after twice that
+	authTimeout := nodeTimeout * 2
+	if authTimeout < 2000 {
+		authTimeout = 2000
+	}
+	authRetryTime := authTimeout * 2
+
+	if myself.isMaster() || master == nil || master.numslots == 0 {
+		return
+	}
+	if !manualFailover && (!master.failed() || server.Config.ClusterSlaveNoFailover) {
+		return
+	}
+
+	// how long we are without news of the master, not counting the node
+	// timeout it took to fail it
+	var dataAge int64
+	if server.repl.state == REPL_STATE_CONNECTED {
+		dataAge = now - server.repl.masterLastIo.UnixMilli()
+	} else {
+		dataAge = now - server.repl.downSince.UnixMilli()
+	}
+	if dataAge > nodeTimeout {
+		dataAge -= nodeTimeout
+	}
+
+	// a replica cut from its master for too long has data too old to take
+	// over, unless we are asked to
+	validityFactor := int64(server.Config.ClusterSlaveValidityFactor)
+	if validityFactor != 0 && !manualFailover &&
+		dataAge > int64(server.Config.ReplPingReplicaPeriod)*1000+nodeTimeout*validityFactor {
+		server.clusterLogCantFailover(CLUSTER_CANT_FAILOVER_DATA_AGE)
+		return
+	}
+
+	// the previous election is over, we schedule the next one: a random
+	// delay so that the replicas don't all ask at once, plus a second for
+	// each replica with more recent data
+	if now-cluster.failoverAuthTime > authRetryTime {
+		cluster.failoverAuthTime = now + 500 + rand.Int63n(500)
+		cluster.failoverAuthCount = 0
+		cluster.failoverAuthSent = false
+		cluster.failoverAuthRank = server.clusterGetSlaveRank()
+		cluster.failoverAuthTime += int64(cluster.failoverAuthRank) * 1000
+		// the master agreed to a manual failover, no need to wait
+		if cluster.mfEnd != 0 {
+			cluster.failoverAuthTime = now
+			cluster.failoverAuthRank = 0
+			server.clusterDoBeforeSleep(CLUSTER_TODO_HANDLE_FAILOVER)
+		}
+		fmt.Printf("Start of election delayed for %d milliseconds (rank #%d, offset %d).\n",
+			cluster.failoverAuthTime-now, cluster.failoverAuthRank, server.repl.masterReplOffset)
+		// the other replicas rank themselves with our offset
+		server.clusterBroadcastPong(CLUSTER_BROADCAST_LOCAL_SLAVES)
+		return
+	}
+
+	// the other replicas told their offsets meanwhile, we may have to wait
+	// for more of them
+	if !cluster.failoverAuthSent && cluster.mfEnd == 0 {
+		rank := server.clusterGetSlaveRank()
+		if rank > cluster.failoverAuthRank {
+			addedDelay := int64(rank-cluster.failoverAuthRank) * 1000
+			cluster.failoverAuthTime += addedDelay
+			cluster.failoverAuthRank = rank
+			fmt.Printf("Replica rank updated to #%d, added %d milliseconds of delay.\n", rank, addedDelay)
+		}
+	}
+
+	if now < cluster.failoverAuthTime {
+		server.clusterLogCantFailover(CLUSTER_CANT_FAILOVER_WAITING_DELAY)
+		return
+	}
+	if now-cluster.failoverAuthTime > authTimeout {
+		server.clusterLogCantFailover(CLUSTER_CANT_FAILOVER_EXPIRED)
+		return
+	}
+
+	if !cluster.failoverAuthSent {
+		cluster.currentEpoch++
+		cluster.failoverAuthEpoch = cluster.currentEpoch
+		fmt.Printf("Starting a failover election for epoch %d.\n", cluster.currentEpoch)
+		server.clusterRequestFailoverAuth()
+		cluster.failoverAuthSent = true
+		server.clusterDoBeforeSleep(CLUSTER_TODO_UPDATE_STATE | CLUSTER_TODO_SAVE_CONFIG)
+		return
+	}
+
+	if cluster.failoverAuthCount < neededQuorum {
+		server.clusterLogCantFailover(CLUSTER_CANT_FAILOVER_WAITING_VOTES)
+		return
+	}
+
+	fmt.Println("Failover election won: I'm the new master.")
+	if myself.configEpoch < cluster.failoverAuthEpoch {
+		myself.configEpoch = cluster.failoverAuthEpoch
+		fmt.Printf("configEpoch set to %d after successful failover\n", myself.configEpoch)
+	}
+	server.clusterFailoverReplaceYourMaster()
+}
+
+// clusterFailoverReplaceYourMaster turns us into a master with the slots of
+// our master, and tells everybody
+func (server *RedisServer) clusterFailoverReplaceYourMaster() {
+	myself := server.cluster.myself
+	oldmaster := myself.slaveof
+	if myself.isMaster() || oldmaster == nil {
+		return
+	}
+
+	server.clusterSetNodeAsMaster(myself)
+	server.replicationUnsetMaster()
+
+	for slot := 0; slot < CLUSTER_SLOTS; slot++ {
+		if oldmaster.hasSlot(slot) {
+			server.clusterDelSlot(slot)
+			server.clusterAddSlot(myself, slot)
+		}
+	}
+
+	server.clusterUpdateState()
+	server.clusterSaveConfigOrDie()
+	server.clusterBroadcastPong(CLUSTER_BROADCAST_ALL)
+	server.resetManualFailover()
+}
+
+// clusterRequestFailoverAuth asks all the masters for their vote. The
+// header has the slots and the config epoch of our master, which the
+// masters check no newer config took over.
+func (server *RedisServer) clusterRequestFailoverAuth() {
+	msg := server.clusterBuildMessageHdr(CLUSTERMSG_TYPE_FAILOVER_AUTH_REQUEST, 0)
+	// in a manual failover the master is up, the masters vote anyway
+	if server.cluster.mfEnd != 0 {
+		msg[2253] |= CLUSTERMSG_FLAG0_FORCEACK
+	}
+	server.clusterBroadcastMessage(msg)
+}
+
+// clusterSendFailoverAuthIfNeeded votes for the replica, once per epoch, if
+// its master failed and no newer config took over the slots it claims
+func (server *RedisServer) clusterSendFailoverAuthIfNeeded(node *clusterNode, hdr *clusterMsgHeader) {
+	cluster := server.cluster
+	myself := cluster.myself
+	master := node.slaveof
+	now := time.Now().UnixMilli()
+	nodeTimeout := int64(server.Config.ClusterNodeTimeout)
+	forceAck := hdr.mflags[0]&CLUSTERMSG_FLAG0_FORCEACK != 0
+
+	// only the masters serving slots vote
+	if myself.isSlave() || myself.numslots == 0 {
+		return
+	}
+
+	if hdr.currentEpoch < cluster.currentEpoch {
+		fmt.Printf("Failover auth denied to %s: reqEpoch (%d) < curEpoch(%d)\n", node.name, hdr.currentEpoch, cluster.currentEpoch)
+		return
+	}
+	if cluster.lastVoteEpoch == cluster.currentEpoch {
+		fmt.Printf("Failover auth denied to %s: already voted for epoch %d\n", node.name, cluster.currentEpoch)
+		return
+	}
+
+	switch {
+	case node.isMaster():
+		fmt.Printf("Failover auth denied to %s: it is a master node\n", node.name)
+		return
+	case master == nil:
+		fmt.Printf("Failover auth denied to %s: I don't know its master\n", node.name)
+		return
+	case !master.failed() && !forceAck:
+		fmt.Printf("Failover auth denied to %s: its master is up\n", node.name)
+		return
+	}
+
+	// one vote for the replicas of a master every two node timeouts, the
+	// replica elected has the time to tell everybody
+	if now-master.votedTime < nodeTimeout*2 {
+		fmt.Printf("Failover auth denied to %s: can't vote about this master before %d milliseconds\n",
+			node.name, nodeTimeout*2-(now-master.votedTime))
+		return
+	}
+
+	// the slots the replica claims must not have been taken over since
+	for slot := 0; slot < CLUSTER_SLOTS; slot++ {
+		if hdr.myslots[slot/8]&(1<<(slot%8)) == 0 {
+			continue
+		}
+		owner := cluster.slots[slot]
+		if owner == nil || owner.configEpoch <= hdr.configEpoch {
+			continue
+		}
+		fmt.Printf("Failover auth denied to %s: slot %d epoch (%d) > reqEpoch (%d)\n", node.name, slot, owner.configEpoch, hdr.configEpoch)
+		return
+	}
+
+	// the vote is saved before it is sent, a restart doesn't vote twice
+	cluster.lastVoteEpoch = cluster.currentEpoch
+	master.votedTime = now
+	server.clusterSaveConfigOrDie()
+	server.clusterSendMessage(node.link, server.clusterBuildMessageHdr(CLUSTERMSG_TYPE_FAILOVER_AUTH_ACK, 0))
+	fmt.Printf("Failover auth granted to %s for epoch %d\n", node.name, cluster.currentEpoch)
+}
+
+// clusterHandleManualFailover lets the election of a manual failover start
+// once we processed the stream of our master up to where it paused
+func (server *RedisServer) clusterHandleManualFailover() {
+	cluster := server.cluster
+	if cluster.mfEnd == 0 || cluster.mfCanStart || cluster.mfMasterOffset == -1 {
+		return
+	}
+	if cluster.mfMasterOffset == server.repl.masterReplOffset {
+		cluster.mfCanStart = true
+		fmt.Println("All master replication stream processed, manual failover can start.")
+		server.clusterDoBeforeSleep(CLUSTER_TODO_HANDLE_FAILOVER)
+	}
+}
+
+// resetManualFailover ends the manual failover, a master resumes its writes
+func (server *RedisServer) resetManualFailover() {
+	cluster := server.cluster
+	if cluster.mfSlave != nil {
+		server.unpauseClients(PAUSE_DURING_FAILOVER)
+	}
+	cluster.mfEnd = 0
+	cluster.mfCanStart = false
+	cluster.mfSlave = nil
+	cluster.mfMasterOffset = -1
+}
+
+func (server *RedisServer) manualFailoverCheckTimeout() {
+	if server.cluster.mfEnd != 0 && server.cluster.mfEnd < time.Now().UnixMilli() {
+		fmt.Println("Manual failover timed out.")
+		server.resetManualFailover()
+	}
+}
+
+// clusterFailoverCommand is CLUSTER FAILOVER [FORCE|TAKEOVER], sent to a
+// replica. FORCE doesn't wait for the master to pause, TAKEOVER doesn't
+// wait for the votes either.
+func (server *RedisServer) clusterFailoverCommand(args []interface{}) []byte {
+	cluster := server.cluster
+	myself := cluster.myself
+	force, takeover := false, false
+	if len(args) == 1 {
+		option, _ := args[0].(string)
+		switch strings.ToUpper(option) {
+		case "FORCE":
+			force = true
+		case "TAKEOVER":
+			force, takeover = true, true
+		default:
+			return []byte("-ERR syntax error\r\n")
+		}
+	}
+
+	if myself.isMaster() {
+		return []byte("-ERR You should send CLUSTER FAILOVER to a replica\r\n")
+	}
+	if myself.slaveof == nil {
+		return []byte("-ERR I'm a replica but my master is unknown to me\r\n")
+	}
+	if !force && (myself.slaveof.failed() || myself.slaveof.link == nil) {
+		return []byte("-ERR Master is down or failed, please use CLUSTER FAILOVER FORCE\r\n")
+	}
+
+	server.resetManualFailover()
+	cluster.mfEnd = time.Now().UnixMilli() + CLUSTER_MF_TIMEOUT
+
+	switch {
+	case takeover:
+		// no election, we take a new epoch and the slots right away
+		fmt.Println("Taking over the master (user request).")
+		server.clusterBumpConfigEpochWithoutConsensus()
+		server.clusterFailoverReplaceYourMaster()
+	case force:
+		fmt.Println("Forced failover user request accepted.")
+		cluster.mfCanStart = true
+	default:
+		fmt.Println("Manual failover user request accepted.")
+		server.clusterSendMessage(myself.slaveof.link, server.clusterBuildMessageHdr(CLUSTERMSG_TYPE_MFSTART, 0))
+	}
+	return []byte("+OK\r\n")
+}
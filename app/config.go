@@ -0,0 +1,1341 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type ClientBufferLimit struct {
+	HardBytes   int64
+	SoftBytes   int64
+	SoftSeconds int64
+}
+
+// SaveParam is a save point: snapshot after Seconds if at least Changes were made
+type SaveParam struct {
+	Seconds int64
+	Changes int64
+}
+
+type ServerConfig struct {
+	// the absolute path of the config file, if the server was started with
+	// one
+	ConfigFile string
+
+	Port int
+	// accepted for the config files written for Redis but has no effect:
+	// every client reads and writes on goroutines of its own, and the
+	// commands and their replies run on the executor whatever its value
+	IoThreads int
+	Hz        int
+
+	ActiveExpireEffort int
+
+	Maxmemory                 int64
+	MaxmemoryPolicy           int
+	MaxmemorySamples          int
+	MaxmemoryEvictionTenacity int
+	LfuLogFactor              int
+	LfuDecayTime              int
+
+	LazyfreeLazyEviction  bool
+	LazyfreeLazyExpire    bool
+	LazyfreeLazyServerDel bool
+	LazyfreeLazyUserDel   bool
+	LazyfreeLazyUserFlush bool
+	ClientOutputLimit     [CLIENT_TYPE_COUNT]ClientBufferLimit
+	ProtoMaxBulkLen       int64
+
+	Dir            string
+	DbFilename     string
+	RdbCompression bool
+	RdbChecksum    bool
+	SaveParams     []SaveParam
+
+	// microseconds the saving and the loading of each key take on top, to
+	// test what happens while they run as if on a slow disk
+	RdbKeySaveDelay int
+	KeyLoadDelay    int
+
+	// seconds a shutdown waits for the replicas to catch up, 0 doesn't, and
+	// the SHUTDOWN_* options of the ones of SIGTERM and SIGINT
+	ShutdownTimeout   int
+	ShutdownOnSigterm int
+	ShutdownOnSigint  int
+
+	AppendOnly       bool
+	AppendFilename   string
+	AppendDirname    string
+	AppendFsync      int
+	AofLoadTruncated bool
+
+	AofUseRdbPreamble bool
+
+	AutoAofRewritePercentage int
+	AutoAofRewriteMinSize    int64
+
+	// set when the server is a replica
+	MasterHost            string
+	MasterPort            int
+	ReplTimeout           int
+	ReplPingReplicaPeriod int
+	ReplBacklogSize       int64
+	ReplBacklogTtl        int
+	ReplicaServeStaleData bool
+	ReplicaReadOnly       bool
+
+	ReplDisklessSync            bool
+	ReplDisklessSyncDelay       int
+	ReplDisklessSyncMaxReplicas int
+
+	// writes are refused unless enough replicas acked within the lag
+	MinReplicasToWrite int
+	MinReplicasMaxLag  int
+
+	// what a replica tells its master about itself, for the ones that pick
+	// a replica to promote
+	ReplicaAnnounceIp   string
+	ReplicaAnnouncePort int
+	ReplicaPriority     int
+	ReplicaAnnounced    bool
+
+	// the password of the clients, and the one we give our master
+	Requirepass string
+	MasterUser  string
+	MasterAuth  string
+
+	// the addresses the clients connect to, all of them when empty, see
+	// listenToPort
+	Bind []string
+
+	// the path of the Unix socket the clients may connect to as well, and
+	// its permissions
+	UnixSocket     string
+	UnixSocketPerm os.FileMode
+
+	// only the loopback clients are served while the default user has no
+	// password
+	ProtectedMode bool
+
+	// who may run DEBUG, one of PROTECTED_ACTION_ALLOWED_*
+	EnableDebugCmd int
+
+	// the port of the TLS clients, with the certificate the server presents
+	// and the CA their certificates are verified with
+	TlsPort       int
+	TlsCertFile   string
+	TlsKeyFile    string
+	TlsCaCertFile string
+	TlsProtocols  string
+	TlsCiphers    string
+	// "yes", "optional" or "no", whether the clients present a certificate
+	TlsAuthClients string
+	// the links of the replication, and of the cluster bus, over TLS
+	TlsReplication bool
+	TlsCluster     bool
+
+	// the users defined with "user" in the config file, applied like the
+	// lines of an aclfile
+	AclUsers [][]string
+
+	// the file the users are defined in, see ACL LOAD and ACL SAVE
+	AclFile string
+	// entries ACL LOG keeps
+	AclLogMaxLen int
+
+	// classes of keyspace events published, see notify.go
+	NotifyKeyspaceEvents int
+
+	// milliseconds a script runs before the other clients get -BUSY
+	BusyReplyThreshold int
+
+	// microseconds a command runs for to be logged, -1 logs none, and how
+	// many entries the slowlog keeps
+	SlowlogLogSlowerThan int
+	SlowlogMaxLen        int
+
+	// milliseconds an event takes to be recorded by LATENCY, 0 records none
+	LatencyMonitorThreshold int
+
+	// the latencies of each command are counted, for LATENCY HISTOGRAM,
+	// with these percentiles in INFO latencystats
+	LatencyTracking                bool
+	LatencyTrackingInfoPercentiles []float64
+
+	// cluster mode, only at startup
+	ClusterEnabled             bool
+	ClusterConfigFile          string
+	ClusterRequireFullCoverage bool
+	ClusterAllowReadsWhenDown  bool
+	// milliseconds a node is unreachable before it is flagged failing
+	ClusterNodeTimeout int
+	// how many node timeouts old the data of a replica can be for it to
+	// fail over its master, 0 for any age
+	ClusterSlaveValidityFactor int
+	ClusterSlaveNoFailover     bool
+
+	// commands renamed, or disabled when renamed to "", only at startup
+	// when the command table is built
+	RenameCommands [][2]string
+
+	// sentinel mode, only at startup. The "--sentinel monitor ..." lines
+	// are kept as given and applied once the sentinel state exists.
+	SentinelMode       bool
+	SentinelDirectives [][]string
+}
+
+// The longest bulk string a client may send
+const CONFIG_DEFAULT_PROTO_MAX_BULK_LEN = 512 << 20
+
+// The addresses the clients connect to when bind is not set
+var CONFIG_DEFAULT_BIND = []string{"*", "-::*"}
+
+func defaultServerConfig() *ServerConfig {
+	return &ServerConfig{
+		Port:      6379,
+		IoThreads: 1,
+		Hz:        CONFIG_DEFAULT_HZ,
+
+		ActiveExpireEffort: CONFIG_DEFAULT_ACTIVE_EXPIRE_EFFORT,
+
+		SlowlogLogSlowerThan: CONFIG_DEFAULT_SLOWLOG_LOG_SLOWER_THAN,
+		SlowlogMaxLen:        CONFIG_DEFAULT_SLOWLOG_MAX_LEN,
+
+		LatencyTracking:                true,
+		LatencyTrackingInfoPercentiles: []float64{50, 99, 99.9},
+
+		MaxmemoryPolicy:           MAXMEMORY_NO_EVICTION,
+		MaxmemorySamples:          CONFIG_DEFAULT_MAXMEMORY_SAMPLES,
+		MaxmemoryEvictionTenacity: CONFIG_DEFAULT_EVICTION_TENACITY,
+		LfuLogFactor:              CONFIG_DEFAULT_LFU_LOG_FACTOR,
+		LfuDecayTime:              CONFIG_DEFAULT_LFU_DECAY_TIME,
+		ClientOutputLimit: [CLIENT_TYPE_COUNT]ClientBufferLimit{
+			CLIENT_TYPE_NORMAL:  {0, 0, 0},
+			CLIENT_TYPE_REPLICA: {256 << 20, 64 << 20, 60},
+			CLIENT_TYPE_PUBSUB:  {32 << 20, 8 << 20, 60},
+		},
+		ProtoMaxBulkLen: CONFIG_DEFAULT_PROTO_MAX_BULK_LEN,
+
+		Dir:            ".",
+		DbFilename:     "dump.rdb",
+		RdbCompression: true,
+		RdbChecksum:    true,
+		SaveParams:     []SaveParam{{3600, 1}, {300, 100}, {60, 10000}},
+
+		ShutdownTimeout: CONFIG_DEFAULT_SHUTDOWN_TIMEOUT,
+
+		AppendFilename:   "appendonly.aof",
+		AppendDirname:    "appendonlydir",
+		AppendFsync:      AOF_FSYNC_EVERYSEC,
+		AofLoadTruncated: true,
+
+		AofUseRdbPreamble: true,
+
+		AutoAofRewritePercentage: 100,
+		AutoAofRewriteMinSize:    64 << 20,
+
+		ReplTimeout:           CONFIG_DEFAULT_REPL_TIMEOUT,
+		ReplPingReplicaPeriod: CONFIG_DEFAULT_REPL_PING_PERIOD,
+		ReplBacklogSize:       CONFIG_DEFAULT_REPL_BACKLOG_SIZE,
+		ReplBacklogTtl:        CONFIG_DEFAULT_REPL_BACKLOG_TTL,
+		ReplicaServeStaleData: true,
+		ReplicaReadOnly:       true,
+
+		ReplDisklessSync:      true,
+		ReplDisklessSyncDelay: CONFIG_DEFAULT_REPL_DISKLESS_SYNC_DELAY,
+
+		MinReplicasMaxLag: CONFIG_DEFAULT_MIN_REPLICAS_MAX_LAG,
+
+		ReplicaPriority:  CONFIG_DEFAULT_REPLICA_PRIORITY,
+		ReplicaAnnounced: true,
+
+		ProtectedMode:  true,
+		TlsAuthClients: "yes",
+		AclLogMaxLen:   CONFIG_DEFAULT_ACLLOG_MAX_LEN,
+
+		BusyReplyThreshold: CONFIG_DEFAULT_BUSY_REPLY_THRESHOLD,
+
+		ClusterConfigFile:          "nodes.conf",
+		ClusterRequireFullCoverage: true,
+		ClusterNodeTimeout:         CONFIG_DEFAULT_CLUSTER_NODE_TIMEOUT,
+		ClusterSlaveValidityFactor: CONFIG_DEFAULT_CLUSTER_SLAVE_VALIDITY,
+	}
+}
+
+// loadServerConfig parses the arguments of redis-server: the path of a
+// config file, if any, and "--name value" options that override it
+func loadServerConfig(args []string) (*ServerConfig, error) {
+	config := defaultServerConfig()
+
+	directives := []configDirective{}
+	if len(args) > 0 && !strings.HasPrefix(args[0], "--") {
+		path, err := filepath.Abs(args[0])
+		if err != nil {
+			return nil, err
+		}
+		config.ConfigFile = path
+		if directives, err = loadConfigFile(args[0], 0); err != nil {
+			return nil, err
+		}
+		args = args[1:]
+	}
+
+	for i := 0; i < len(args); i++ {
+		if !strings.HasPrefix(args[i], "--") {
+			return nil, fmt.Errorf("invalid argument: %s", args[i])
+		}
+		argv := []string{strings.TrimPrefix(args[i], "--")}
+		for i+1 < len(args) && !strings.HasPrefix(args[i+1], "--") {
+			argv = append(argv, args[i+1])
+			i++
+		}
+		directives = append(directives, configDirective{argv: argv})
+	}
+
+	portSet := false
+	for _, directive := range directives {
+		name, values := strings.ToLower(directive.argv[0]), directive.argv[1:]
+
+		// --sentinel alone turns sentinel mode on, followed by a directive
+		// it is one of the lines of a sentinel config
+		if name == "sentinel" {
+			if len(values) == 0 {
+				config.SentinelMode = true
+			} else {
+				config.SentinelDirectives = append(config.SentinelDirectives, values)
+			}
+			continue
+		}
+		if name == "rename-command" {
+			if len(values) != 2 {
+				return nil, directive.error(fmt.Errorf("wrong number of arguments"))
+			}
+			config.RenameCommands = append(config.RenameCommands, [2]string{values[0], values[1]})
+			continue
+		}
+		// the users of the config file, applied once the ACLs exist
+		if name == "user" {
+			config.AclUsers = append(config.AclUsers, values)
+			continue
+		}
+		if name == "port" {
+			portSet = true
+		}
+
+		if err := config.set(name, values); err != nil {
+			return nil, directive.error(err)
+		}
+	}
+
+	if config.SentinelMode {
+		if config.ClusterEnabled {
+			return nil, fmt.Errorf("sentinel mode is not compatible with cluster mode")
+		}
+		if !portSet {
+			config.Port = REDIS_SENTINEL_PORT
+		}
+	}
+	if len(config.AclUsers) > 0 && config.AclFile != "" {
+		return nil, fmt.Errorf("Configuring Redis with users defined in redis.conf and at " +
+			"the same setting an ACL file path is invalid. This setup is very likely to lead " +
+			"to configuration errors and security holes, please define either an ACL file or " +
+			"declare users directly in your redis.conf, but not both.")
+	}
+
+	return config, nil
+}
+
+// configDirective is a line of the config file, or an option of the
+// command line
+type configDirective struct {
+	argv []string
+
+	// where it is in the config file, for the errors
+	line int
+	text string
+}
+
+func (directive configDirective) error(err error) error {
+	if directive.line == 0 {
+		return err
+	}
+	return fmt.Errorf("\n*** FATAL CONFIG FILE ERROR ***\n"+
+		"Reading the configuration file, at line %d\n>>> '%s'\n%v", directive.line, directive.text, err)
+}
+
+// the depth of the includes, a file including itself is an error rather
+// than a loop
+const CONFIG_MAX_INCLUDE_DEPTH = 16
+
+// loadConfigFile reads the directives of a redis.conf style file, a line
+// "name value ..." each, the values quoted like the arguments of
+// redis-cli. The files of an include, a glob pattern, are read in its
+// place. Blank lines and the ones starting with # are skipped.
+func loadConfigFile(path string, depth int) ([]configDirective, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Fatal error, can't open config file '%s': %v", path, err)
+	}
+
+	directives := []configDirective{}
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		directive := configDirective{line: i + 1, text: line}
+		argv, err := splitArgs(line)
+		if err != nil {
+			return nil, directive.error(err)
+		}
+		if len(argv) < 2 {
+			return nil, directive.error(fmt.Errorf("wrong number of arguments"))
+		}
+		if !strings.EqualFold(argv[0], "include") {
+			directive.argv = argv
+			directives = append(directives, directive)
+			continue
+		}
+		if depth+1 > CONFIG_MAX_INCLUDE_DEPTH {
+			return nil, directive.error(fmt.Errorf("too many nested includes"))
+		}
+		included, err := loadIncludedConfigFiles(argv[1], depth+1)
+		if err != nil {
+			return nil, err
+		}
+		directives = append(directives, included...)
+	}
+	return directives, nil
+}
+
+func loadIncludedConfigFiles(pattern string, depth int) ([]configDirective, error) {
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	// a file that doesn't exist is an error, unlike a pattern matching
+	// none
+	if len(paths) == 0 && !strings.ContainsAny(pattern, "*?[") {
+		paths = []string{pattern}
+	}
+	directives := []configDirective{}
+	for _, path := range paths {
+		included, err := loadConfigFile(path, depth)
+		if err != nil {
+			return nil, err
+		}
+		directives = append(directives, included...)
+	}
+	return directives, nil
+}
+
+// Flags of the config parameters
+const (
+	IMMUTABLE_CONFIG = 1 << iota // only set at startup, not with CONFIG SET
+	MULTI_ARG_CONFIG             // takes several arguments, like save
+)
+
+// standardConfig is a config parameter of the registry: how its arguments
+// are parsed into the config, how its value is formatted, and what makes a
+// change of CONFIG SET take effect, if anything is needed
+type standardConfig struct {
+	name  string
+	alias string // the old name, like the slave-* ones of the replica-*
+	flags int
+
+	set   func(config *ServerConfig, values []string) error
+	get   func(config *ServerConfig) string
+	apply func(server *RedisServer) error
+
+	// the lines of CONFIG REWRITE, when not the "name value" one
+	rewrite func(config *ServerConfig) []string
+}
+
+func (c *standardConfig) withApply(apply func(server *RedisServer) error) *standardConfig {
+	c.apply = apply
+	return c
+}
+
+func (c *standardConfig) withRewrite(rewrite func(config *ServerConfig) []string) *standardConfig {
+	c.rewrite = rewrite
+	return c
+}
+
+func createSpecialConfig(name, alias string, flags int, set func(*ServerConfig, []string) error, get func(*ServerConfig) string) *standardConfig {
+	return &standardConfig{name: name, alias: alias, flags: flags, set: set, get: get}
+}
+
+func createBoolConfig(name, alias string, flags int, field func(*ServerConfig) *bool) *standardConfig {
+	return createSpecialConfig(name, alias, flags,
+		func(config *ServerConfig, values []string) error {
+			return parseYesNo(values[0], field(config))
+		},
+		func(config *ServerConfig) string {
+			return yesNo(*field(config))
+		})
+}
+
+func createIntConfig(name, alias string, flags int, min, max int, field func(*ServerConfig) *int) *standardConfig {
+	return createSpecialConfig(name, alias, flags,
+		func(config *ServerConfig, values []string) error {
+			n, err := strconv.Atoi(values[0])
+			if err != nil {
+				return fmt.Errorf("argument couldn't be parsed into an integer")
+			}
+			if n < min || n > max {
+				return fmt.Errorf("argument must be between %d and %d inclusive", min, max)
+			}
+			*field(config) = n
+			return nil
+		},
+		func(config *ServerConfig) string {
+			return strconv.Itoa(*field(config))
+		})
+}
+
+func createMemoryConfig(name, alias string, flags int, field func(*ServerConfig) *int64) *standardConfig {
+	return createSpecialConfig(name, alias, flags,
+		func(config *ServerConfig, values []string) error {
+			n, err := memtoll(values[0])
+			if err != nil {
+				return fmt.Errorf("argument must be a memory value")
+			}
+			*field(config) = n
+			return nil
+		},
+		func(config *ServerConfig) string {
+			return strconv.FormatInt(*field(config), 10)
+		})
+}
+
+// createShutdownOnSignalConfig is the options of the shutdown of a signal,
+// "default" or some of save, nosave, now and force
+func createShutdownOnSignalConfig(name string, field func(*ServerConfig) *int) *standardConfig {
+	return createSpecialConfig(name, "", MULTI_ARG_CONFIG,
+		func(config *ServerConfig, values []string) error {
+			flags := SHUTDOWN_NOFLAGS
+			for _, value := range strings.Fields(strings.Join(values, " ")) {
+				flag, ok := shutdownOnSignalFlags[strings.ToLower(value)]
+				if !ok {
+					return fmt.Errorf("argument(s) must be one of the following: default, save, nosave, now, force")
+				}
+				flags |= flag
+			}
+			if flags&SHUTDOWN_SAVE != 0 && flags&SHUTDOWN_NOSAVE != 0 {
+				return fmt.Errorf("argument(s) must be one of the following: default, save, nosave, now, force")
+			}
+			*field(config) = flags
+			return nil
+		},
+		func(config *ServerConfig) string {
+			names := []string{}
+			for _, name := range []string{"save", "nosave", "now", "force"} {
+				if *field(config)&shutdownOnSignalFlags[name] != 0 {
+					names = append(names, name)
+				}
+			}
+			if len(names) == 0 {
+				return "default"
+			}
+			return strings.Join(names, " ")
+		})
+}
+
+var shutdownOnSignalFlags = map[string]int{
+	"default": SHUTDOWN_NOFLAGS,
+	"save":    SHUTDOWN_SAVE,
+	"nosave":  SHUTDOWN_NOSAVE,
+	"now":     SHUTDOWN_NOW,
+	"force":   SHUTDOWN_FORCE,
+}
+
+func createStringConfig(name, alias string, flags int, field func(*ServerConfig) *string) *standardConfig {
+	return createSpecialConfig(name, alias, flags,
+		func(config *ServerConfig, values []string) error {
+			*field(config) = values[0]
+			return nil
+		},
+		func(config *ServerConfig) string {
+			return *field(config)
+		})
+}
+
+// setFileName sets a file name of the data dir, that can't be a path
+func setFileName(field *string, value, name, kind string) error {
+	if filepath.Base(value) != value {
+		return fmt.Errorf("%s can't be a path, just a %s", name, kind)
+	}
+	*field = value
+	return nil
+}
+
+const maxInt = int(^uint(0) >> 1)
+
+// configs are the config parameters, by name and by alias
+var configs = map[string]*standardConfig{}
+
+// configTable is the registry of the config parameters
+var configTable = []*standardConfig{
+	createIntConfig("port", "", IMMUTABLE_CONFIG, 0, 65535, func(c *ServerConfig) *int { return &c.Port }),
+	createIntConfig("io-threads", "", IMMUTABLE_CONFIG, 1, 128, func(c *ServerConfig) *int { return &c.IoThreads }),
+	createSpecialConfig("hz", "", 0,
+		func(c *ServerConfig, values []string) error {
+			n, err := strconv.Atoi(values[0])
+			if err != nil {
+				return fmt.Errorf("argument couldn't be parsed into an integer")
+			}
+			c.Hz = minOf(maxOf(n, CONFIG_MIN_HZ), CONFIG_MAX_HZ)
+			return nil
+		},
+		func(c *ServerConfig) string { return strconv.Itoa(c.Hz) }),
+	createIntConfig("active-expire-effort", "", 0, 1, CONFIG_MAX_ACTIVE_EXPIRE_EFFORT, func(c *ServerConfig) *int { return &c.ActiveExpireEffort }),
+
+	createMemoryConfig("maxmemory", "", 0, func(c *ServerConfig) *int64 { return &c.Maxmemory }).withApply(applyMaxmemory),
+	createSpecialConfig("maxmemory-policy", "", 0,
+		func(c *ServerConfig, values []string) error {
+			policy := getMaxmemoryPolicyByName(values[0])
+			if policy == -1 {
+				return fmt.Errorf("invalid maxmemory-policy: %s", values[0])
+			}
+			c.MaxmemoryPolicy = policy
+			return nil
+		},
+		func(c *ServerConfig) string { return getMaxmemoryPolicyName(c.MaxmemoryPolicy) }),
+	createIntConfig("maxmemory-samples", "", 0, 1, 64, func(c *ServerConfig) *int { return &c.MaxmemorySamples }),
+	createIntConfig("maxmemory-eviction-tenacity", "", 0, 0, 100, func(c *ServerConfig) *int { return &c.MaxmemoryEvictionTenacity }),
+	createIntConfig("lfu-log-factor", "", 0, 0, maxInt, func(c *ServerConfig) *int { return &c.LfuLogFactor }),
+	createIntConfig("lfu-decay-time", "", 0, 0, maxInt, func(c *ServerConfig) *int { return &c.LfuDecayTime }),
+	createBoolConfig("lazyfree-lazy-eviction", "", 0, func(c *ServerConfig) *bool { return &c.LazyfreeLazyEviction }),
+	createBoolConfig("lazyfree-lazy-expire", "", 0, func(c *ServerConfig) *bool { return &c.LazyfreeLazyExpire }),
+	createBoolConfig("lazyfree-lazy-server-del", "", 0, func(c *ServerConfig) *bool { return &c.LazyfreeLazyServerDel }),
+	createBoolConfig("lazyfree-lazy-user-del", "", 0, func(c *ServerConfig) *bool { return &c.LazyfreeLazyUserDel }),
+	createBoolConfig("lazyfree-lazy-user-flush", "", 0, func(c *ServerConfig) *bool { return &c.LazyfreeLazyUserFlush }),
+	createMemoryConfig("proto-max-bulk-len", "", 0, func(c *ServerConfig) *int64 { return &c.ProtoMaxBulkLen }).withApply(applyProtoMaxBulkLen),
+	createSpecialConfig("client-output-buffer-limit", "", MULTI_ARG_CONFIG, setClientOutputBufferLimit,
+		func(c *ServerConfig) string {
+			parts := []string{}
+			for class, name := range []string{"normal", "slave", "pubsub"} {
+				limit := c.ClientOutputLimit[class]
+				parts = append(parts, fmt.Sprintf("%s %d %d %d", name, limit.HardBytes, limit.SoftBytes, limit.SoftSeconds))
+			}
+			return strings.Join(parts, " ")
+		}).withRewrite(func(c *ServerConfig) []string {
+		lines := []string{}
+		for class, name := range []string{"normal", "replica", "pubsub"} {
+			limit := c.ClientOutputLimit[class]
+			lines = append(lines, fmt.Sprintf("client-output-buffer-limit %s %d %d %d", name, limit.HardBytes, limit.SoftBytes, limit.SoftSeconds))
+		}
+		return lines
+	}),
+	createSpecialConfig("notify-keyspace-events", "", 0,
+		func(c *ServerConfig, values []string) error {
+			flags := keyspaceEventsStringToFlags(values[0])
+			if flags == -1 {
+				return fmt.Errorf("invalid event class character. Use 'Ag$shzxeKEtmdn'")
+			}
+			c.NotifyKeyspaceEvents = flags
+			return nil
+		},
+		func(c *ServerConfig) string { return keyspaceEventsFlagsToString(c.NotifyKeyspaceEvents) }),
+
+	createSpecialConfig("dir", "", 0,
+		func(c *ServerConfig, values []string) error {
+			info, err := os.Stat(values[0])
+			if err != nil || !info.IsDir() {
+				return fmt.Errorf("can't chdir to '%s'", values[0])
+			}
+			c.Dir = values[0]
+			return nil
+		},
+		func(c *ServerConfig) string {
+			dir, err := filepath.Abs(c.Dir)
+			if err != nil {
+				return c.Dir
+			}
+			return dir
+		}),
+	createSpecialConfig("dbfilename", "", 0,
+		func(c *ServerConfig, values []string) error {
+			return setFileName(&c.DbFilename, values[0], "dbfilename", "filename")
+		},
+		func(c *ServerConfig) string { return c.DbFilename }),
+	createBoolConfig("rdbcompression", "", 0, func(c *ServerConfig) *bool { return &c.RdbCompression }),
+	createBoolConfig("rdbchecksum", "", 0, func(c *ServerConfig) *bool { return &c.RdbChecksum }),
+	createIntConfig("rdb-key-save-delay", "", 0, 0, maxInt, func(c *ServerConfig) *int { return &c.RdbKeySaveDelay }),
+	createIntConfig("key-load-delay", "", 0, 0, maxInt, func(c *ServerConfig) *int { return &c.KeyLoadDelay }),
+	createIntConfig("shutdown-timeout", "", 0, 0, maxInt, func(c *ServerConfig) *int { return &c.ShutdownTimeout }),
+	createShutdownOnSignalConfig("shutdown-on-sigterm", func(c *ServerConfig) *int { return &c.ShutdownOnSigterm }),
+	createShutdownOnSignalConfig("shutdown-on-sigint", func(c *ServerConfig) *int { return &c.ShutdownOnSigint }),
+	createSpecialConfig("save", "", MULTI_ARG_CONFIG,
+		func(c *ServerConfig, values []string) error {
+			params, err := parseSaveParams(values)
+			if err != nil {
+				return err
+			}
+			c.SaveParams = params
+			return nil
+		},
+		func(c *ServerConfig) string {
+			parts := []string{}
+			for _, param := range c.SaveParams {
+				parts = append(parts, fmt.Sprintf("%d %d", param.Seconds, param.Changes))
+			}
+			return strings.Join(parts, " ")
+		}),
+
+	createBoolConfig("appendonly", "", 0, func(c *ServerConfig) *bool { return &c.AppendOnly }).withApply(applyAppendOnly),
+	createSpecialConfig("appendfilename", "", IMMUTABLE_CONFIG,
+		func(c *ServerConfig, values []string) error {
+			return setFileName(&c.AppendFilename, values[0], "appendfilename", "filename")
+		},
+		func(c *ServerConfig) string { return c.AppendFilename }),
+	createSpecialConfig("appenddirname", "", IMMUTABLE_CONFIG,
+		func(c *ServerConfig, values []string) error {
+			return setFileName(&c.AppendDirname, values[0], "appenddirname", "dirname")
+		},
+		func(c *ServerConfig) string { return c.AppendDirname }),
+	createBoolConfig("aof-load-truncated", "", 0, func(c *ServerConfig) *bool { return &c.AofLoadTruncated }),
+	createBoolConfig("aof-use-rdb-preamble", "", 0, func(c *ServerConfig) *bool { return &c.AofUseRdbPreamble }),
+	createSpecialConfig("appendfsync", "", 0,
+		func(c *ServerConfig, values []string) error {
+			fsync := getAofFsyncByName(values[0])
+			if fsync == -1 {
+				return fmt.Errorf("invalid appendfsync: %s", values[0])
+			}
+			c.AppendFsync = fsync
+			return nil
+		},
+		func(c *ServerConfig) string { return aofFsyncNames[c.AppendFsync] }).withApply(applyAppendFsync),
+	createIntConfig("auto-aof-rewrite-percentage", "", 0, 0, maxInt, func(c *ServerConfig) *int { return &c.AutoAofRewritePercentage }),
+	createMemoryConfig("auto-aof-rewrite-min-size", "", 0, func(c *ServerConfig) *int64 { return &c.AutoAofRewriteMinSize }),
+
+	createSpecialConfig("replicaof", "slaveof", IMMUTABLE_CONFIG|MULTI_ARG_CONFIG,
+		func(c *ServerConfig, values []string) error {
+			fields := strings.Fields(strings.Join(values, " "))
+			if len(fields) != 2 {
+				return fmt.Errorf("wrong number of arguments")
+			}
+			if strings.EqualFold(fields[0], "no") && strings.EqualFold(fields[1], "one") {
+				c.MasterHost, c.MasterPort = "", 0
+				return nil
+			}
+			port, err := strconv.Atoi(fields[1])
+			if err != nil || port < 0 || port > 65535 {
+				return fmt.Errorf("invalid master port: %s", fields[1])
+			}
+			c.MasterHost, c.MasterPort = fields[0], port
+			return nil
+		},
+		func(c *ServerConfig) string {
+			if c.MasterHost == "" {
+				return ""
+			}
+			return fmt.Sprintf("%s %d", c.MasterHost, c.MasterPort)
+		}).withRewrite(func(c *ServerConfig) []string {
+		// a master has no line
+		if c.MasterHost == "" {
+			return nil
+		}
+		return []string{fmt.Sprintf("replicaof %s %d", c.MasterHost, c.MasterPort)}
+	}),
+	createIntConfig("repl-timeout", "", 0, 1, maxInt, func(c *ServerConfig) *int { return &c.ReplTimeout }),
+	createIntConfig("repl-ping-replica-period", "repl-ping-slave-period", 0, 1, maxInt, func(c *ServerConfig) *int { return &c.ReplPingReplicaPeriod }),
+	createSpecialConfig("repl-backlog-size", "", 0,
+		func(c *ServerConfig, values []string) error {
+			n, err := memtoll(values[0])
+			if err != nil {
+				return fmt.Errorf("argument must be a memory value")
+			}
+			c.ReplBacklogSize = maxOf(n, CONFIG_REPL_BACKLOG_MIN_SIZE)
+			return nil
+		},
+		func(c *ServerConfig) string { return strconv.FormatInt(c.ReplBacklogSize, 10) }).withApply(applyReplBacklogSize),
+	createIntConfig("repl-backlog-ttl", "", 0, 0, maxInt, func(c *ServerConfig) *int { return &c.ReplBacklogTtl }),
+	createBoolConfig("replica-serve-stale-data", "slave-serve-stale-data", 0, func(c *ServerConfig) *bool { return &c.ReplicaServeStaleData }),
+	createBoolConfig("replica-read-only", "slave-read-only", 0, func(c *ServerConfig) *bool { return &c.ReplicaReadOnly }),
+	createBoolConfig("repl-diskless-sync", "", 0, func(c *ServerConfig) *bool { return &c.ReplDisklessSync }),
+	createIntConfig("repl-diskless-sync-delay", "", 0, 0, maxInt, func(c *ServerConfig) *int { return &c.ReplDisklessSyncDelay }),
+	createIntConfig("repl-diskless-sync-max-replicas", "", 0, 0, maxInt, func(c *ServerConfig) *int { return &c.ReplDisklessSyncMaxReplicas }),
+	createIntConfig("min-replicas-to-write", "min-slaves-to-write", 0, 0, maxInt, func(c *ServerConfig) *int { return &c.MinReplicasToWrite }).withApply(applyMinReplicas),
+	createIntConfig("min-replicas-max-lag", "min-slaves-max-lag", 0, 0, maxInt, func(c *ServerConfig) *int { return &c.MinReplicasMaxLag }).withApply(applyMinReplicas),
+	createStringConfig("replica-announce-ip", "slave-announce-ip", 0, func(c *ServerConfig) *string { return &c.ReplicaAnnounceIp }),
+	createIntConfig("replica-announce-port", "slave-announce-port", 0, 0, 65535, func(c *ServerConfig) *int { return &c.ReplicaAnnouncePort }),
+	createIntConfig("replica-priority", "slave-priority", 0, 0, maxInt, func(c *ServerConfig) *int { return &c.ReplicaPriority }),
+	createBoolConfig("replica-announced", "", 0, func(c *ServerConfig) *bool { return &c.ReplicaAnnounced }),
+
+	createStringConfig("requirepass", "", 0, func(c *ServerConfig) *string { return &c.Requirepass }).withApply(applyRequirepass),
+	createStringConfig("masteruser", "", 0, func(c *ServerConfig) *string { return &c.MasterUser }),
+	createStringConfig("masterauth", "", 0, func(c *ServerConfig) *string { return &c.MasterAuth }),
+
+	createSpecialConfig("bind", "", IMMUTABLE_CONFIG|MULTI_ARG_CONFIG,
+		func(c *ServerConfig, values []string) error {
+			c.Bind = values
+			return nil
+		},
+		func(c *ServerConfig) string {
+			if len(c.Bind) == 0 {
+				return strings.Join(CONFIG_DEFAULT_BIND, " ")
+			}
+			return strings.Join(c.Bind, " ")
+		}),
+	createStringConfig("unixsocket", "", IMMUTABLE_CONFIG, func(c *ServerConfig) *string { return &c.UnixSocket }),
+	createSpecialConfig("unixsocketperm", "", IMMUTABLE_CONFIG,
+		func(c *ServerConfig, values []string) error {
+			n, err := strconv.ParseUint(values[0], 8, 32)
+			if err != nil || n > 0777 {
+				return fmt.Errorf("invalid unixsocketperm value: %s", values[0])
+			}
+			c.UnixSocketPerm = os.FileMode(n)
+			return nil
+		},
+		func(c *ServerConfig) string { return fmt.Sprintf("%o", c.UnixSocketPerm) }),
+	createBoolConfig("protected-mode", "", 0, func(c *ServerConfig) *bool { return &c.ProtectedMode }),
+	createSpecialConfig("enable-debug-command", "", IMMUTABLE_CONFIG,
+		func(c *ServerConfig, values []string) error {
+			allowed := getProtectedActionByName(values[0])
+			if allowed == -1 {
+				return fmt.Errorf("invalid enable-debug-command: %s", values[0])
+			}
+			c.EnableDebugCmd = allowed
+			return nil
+		},
+		func(c *ServerConfig) string { return protectedActionNames[c.EnableDebugCmd] }),
+
+	createIntConfig("tls-port", "", IMMUTABLE_CONFIG, 0, 65535, func(c *ServerConfig) *int { return &c.TlsPort }),
+	createStringConfig("tls-cert-file", "", IMMUTABLE_CONFIG, func(c *ServerConfig) *string { return &c.TlsCertFile }),
+	createStringConfig("tls-key-file", "", IMMUTABLE_CONFIG, func(c *ServerConfig) *string { return &c.TlsKeyFile }),
+	createStringConfig("tls-ca-cert-file", "", IMMUTABLE_CONFIG, func(c *ServerConfig) *string { return &c.TlsCaCertFile }),
+	createStringConfig("tls-protocols", "", IMMUTABLE_CONFIG, func(c *ServerConfig) *string { return &c.TlsProtocols }),
+	createStringConfig("tls-ciphers", "", IMMUTABLE_CONFIG, func(c *ServerConfig) *string { return &c.TlsCiphers }),
+	createSpecialConfig("tls-auth-clients", "", IMMUTABLE_CONFIG,
+		func(c *ServerConfig, values []string) error {
+			value := strings.ToLower(values[0])
+			if _, ok := tlsAuthClients[value]; !ok {
+				return fmt.Errorf("invalid tls-auth-clients value: %s", values[0])
+			}
+			c.TlsAuthClients = value
+			return nil
+		},
+		func(c *ServerConfig) string { return c.TlsAuthClients }),
+	createBoolConfig("tls-replication", "", IMMUTABLE_CONFIG, func(c *ServerConfig) *bool { return &c.TlsReplication }),
+	createBoolConfig("tls-cluster", "", IMMUTABLE_CONFIG, func(c *ServerConfig) *bool { return &c.TlsCluster }),
+
+	createStringConfig("aclfile", "", IMMUTABLE_CONFIG, func(c *ServerConfig) *string { return &c.AclFile }),
+	createIntConfig("acllog-max-len", "", 0, 0, maxInt, func(c *ServerConfig) *int { return &c.AclLogMaxLen }).withApply(applyAclLogMaxLen),
+	createIntConfig("busy-reply-threshold", "lua-time-limit", 0, 0, maxInt, func(c *ServerConfig) *int { return &c.BusyReplyThreshold }),
+	createIntConfig("slowlog-log-slower-than", "", 0, -1, maxInt, func(c *ServerConfig) *int { return &c.SlowlogLogSlowerThan }),
+	createIntConfig("slowlog-max-len", "", 0, 0, maxInt, func(c *ServerConfig) *int { return &c.SlowlogMaxLen }),
+	createIntConfig("latency-monitor-threshold", "", 0, 0, maxInt, func(c *ServerConfig) *int { return &c.LatencyMonitorThreshold }),
+	createBoolConfig("latency-tracking", "", 0, func(c *ServerConfig) *bool { return &c.LatencyTracking }),
+	createSpecialConfig("latency-tracking-info-percentiles", "", MULTI_ARG_CONFIG,
+		func(c *ServerConfig, values []string) error {
+			percentiles := []float64{}
+			for _, field := range strings.Fields(strings.Join(values, " ")) {
+				percentile, err := strconv.ParseFloat(field, 64)
+				if err != nil || percentile < 0 || percentile > 100 {
+					return fmt.Errorf("latency-tracking-info-percentiles expects a list of percentiles between 0.0 and 100.0")
+				}
+				percentiles = append(percentiles, percentile)
+			}
+			c.LatencyTrackingInfoPercentiles = percentiles
+			return nil
+		},
+		func(c *ServerConfig) string {
+			parts := []string{}
+			for _, percentile := range c.LatencyTrackingInfoPercentiles {
+				parts = append(parts, strconv.FormatFloat(percentile, 'f', -1, 64))
+			}
+			return strings.Join(parts, " ")
+		}),
+
+	createBoolConfig("cluster-enabled", "", IMMUTABLE_CONFIG, func(c *ServerConfig) *bool { return &c.ClusterEnabled }),
+	createStringConfig("cluster-config-file", "", IMMUTABLE_CONFIG, func(c *ServerConfig) *string { return &c.ClusterConfigFile }),
+	createBoolConfig("cluster-require-full-coverage", "", 0, func(c *ServerConfig) *bool { return &c.ClusterRequireFullCoverage }).withApply(applyClusterState),
+	createBoolConfig("cluster-allow-reads-when-down", "", 0, func(c *ServerConfig) *bool { return &c.ClusterAllowReadsWhenDown }),
+	createIntConfig("cluster-node-timeout", "", 0, 1, maxInt, func(c *ServerConfig) *int { return &c.ClusterNodeTimeout }),
+	createIntConfig("cluster-replica-validity-factor", "cluster-slave-validity-factor", 0, 0, maxInt, func(c *ServerConfig) *int { return &c.ClusterSlaveValidityFactor }),
+	createBoolConfig("cluster-replica-no-failover", "cluster-slave-no-failover", 0, func(c *ServerConfig) *bool { return &c.ClusterSlaveNoFailover }),
+}
+
+func init() {
+	for _, c := range configTable {
+		configs[c.name] = c
+		if c.alias != "" {
+			configs[c.alias] = c
+		}
+	}
+}
+
+func setClientOutputBufferLimit(config *ServerConfig, values []string) error {
+	if len(values)%4 != 0 {
+		return fmt.Errorf("wrong number of arguments")
+	}
+	limits := config.ClientOutputLimit
+	for j := 0; j < len(values); j += 4 {
+		class := getClientTypeByName(values[j])
+		if class == -1 {
+			return fmt.Errorf("invalid client class: %s", values[j])
+		}
+		hard, err1 := memtoll(values[j+1])
+		soft, err2 := memtoll(values[j+2])
+		seconds, err3 := strconv.ParseInt(values[j+3], 10, 64)
+		if err1 != nil || err2 != nil || err3 != nil || seconds < 0 {
+			return fmt.Errorf("invalid client-output-buffer-limit for class %s", values[j])
+		}
+		limits[class] = ClientBufferLimit{hard, soft, seconds}
+	}
+	config.ClientOutputLimit = limits
+	return nil
+}
+
+// set parses the arguments of a config parameter, the ones of a line of
+// the config file or of CONFIG SET
+func (config *ServerConfig) set(name string, values []string) error {
+	c := configs[name]
+	if c == nil {
+		return fmt.Errorf("unknown config: %s", name)
+	}
+	if len(values) == 0 || (len(values) > 1 && c.flags&MULTI_ARG_CONFIG == 0) {
+		return fmt.Errorf("wrong number of arguments for config %s", name)
+	}
+	return c.set(config, values)
+}
+
+// get returns the current value of a configuration parameter in the same
+// format it is set with
+func (config *ServerConfig) get(name string) (string, bool) {
+	c := configs[name]
+	if c == nil {
+		return "", false
+	}
+	return c.get(config), true
+}
+
+// The functions that make a change of CONFIG SET take effect
+
+func applyMaxmemory(server *RedisServer) error {
+	if used := server.getUsedMemory(); server.Config.Maxmemory != 0 && used > server.Config.Maxmemory {
+		fmt.Printf("WARNING: the new maxmemory value set via CONFIG SET (%d) is smaller than the current memory usage (%d). "+
+			"This will result in key eviction and/or the inability to accept new write commands depending on the maxmemory-policy.\n",
+			server.Config.Maxmemory, used)
+	}
+	server.performEvictions()
+	return nil
+}
+
+func applyAppendOnly(server *RedisServer) error {
+	if server.Config.AppendOnly && server.aof.file == nil {
+		return server.startAppendOnly()
+	}
+	if !server.Config.AppendOnly && server.aof.file != nil {
+		server.stopAppendOnly()
+	}
+	return nil
+}
+
+func applyAppendFsync(server *RedisServer) error {
+	// what was written under the previous policy is on disk from now on
+	server.flushAppendOnlyFile()
+	if server.aof.file != nil && server.aof.fsyncedSize != server.aof.CurrentSize {
+		if err := server.aof.file.Sync(); err != nil {
+			return err
+		}
+		server.aof.lastFsync = time.Now()
+		server.aof.fsyncedSize = server.aof.CurrentSize
+	}
+	return nil
+}
+
+func applyProtoMaxBulkLen(server *RedisServer) error {
+	atomic.StoreInt64(&server.protoMaxBulkLen, server.Config.ProtoMaxBulkLen)
+	return nil
+}
+
+func applyReplBacklogSize(server *RedisServer) error {
+	server.resizeReplicationBacklog()
+	return nil
+}
+
+func applyMinReplicas(server *RedisServer) error {
+	server.refreshGoodSlavesCount()
+	return nil
+}
+
+func applyRequirepass(server *RedisServer) error {
+	server.aclUpdateDefaultUserPassword(server.Config.Requirepass)
+	return nil
+}
+
+func applyAclLogMaxLen(server *RedisServer) error {
+	if len(server.aclLog) > server.Config.AclLogMaxLen {
+		server.aclLog = server.aclLog[:server.Config.AclLogMaxLen]
+	}
+	return nil
+}
+
+func applyClusterState(server *RedisServer) error {
+	if server.cluster != nil {
+		server.clusterUpdateState()
+	}
+	return nil
+}
+
+// parseSaveParams parses "<seconds> <changes>" pairs, given either as
+// separate arguments or as a single string. An empty string disables saving.
+func parseSaveParams(values []string) ([]SaveParam, error) {
+	fields := strings.Fields(strings.Join(values, " "))
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("invalid save parameters: %s", strings.Join(values, " "))
+	}
+
+	params := []SaveParam{}
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err1 := strconv.ParseInt(fields[i], 10, 64)
+		changes, err2 := strconv.ParseInt(fields[i+1], 10, 64)
+		if err1 != nil || err2 != nil || seconds < 1 || changes < 0 {
+			return nil, fmt.Errorf("invalid save parameters: %s", strings.Join(values, " "))
+		}
+		params = append(params, SaveParam{seconds, changes})
+	}
+	return params, nil
+}
+
+func yesNo(value bool) string {
+	if value {
+		return "yes"
+	}
+	return "no"
+}
+
+func (server *RedisServer) handleConfigCommand(cmd string, args []interface{}) []byte {
+	subcommand, ok := args[0].(string)
+	if !ok {
+		return []byte("-ERR Invalid subcommand type\r\n")
+	}
+	subcommand = strings.ToUpper(subcommand)
+
+	switch {
+	case subcommand == "HELP" && len(args) == 1:
+		return addReplyHelp("CONFIG", []string{
+			"GET <pattern>",
+			"    Return parameters matching the glob-like <pattern> and their values.",
+			"SET <directive> <value>",
+			"    Set the configuration <directive> to <value>.",
+			"RESETSTAT",
+			"    Reset statistics reported by the INFO command.",
+			"REWRITE",
+			"    Rewrite the configuration file.",
+		})
+	case subcommand == "GET" && len(args) >= 2:
+		return server.configGetCommand(args[1:])
+	case subcommand == "SET" && len(args) >= 3:
+		return server.configSetCommand(args[1:])
+	case subcommand == "RESETSTAT" && len(args) == 1:
+		server.resetServerStats()
+		return []byte("+OK\r\n")
+	case subcommand == "REWRITE" && len(args) == 1:
+		return server.configRewriteCommand()
+	case subcommand == "GET" || subcommand == "SET" || subcommand == "RESETSTAT" || subcommand == "REWRITE":
+		return []byte(fmt.Sprintf("-ERR wrong number of arguments for 'config|%s' command\r\n", strings.ToLower(subcommand)))
+	}
+	return addReplySubcommandSyntaxError("CONFIG", subcommand)
+}
+
+// configGetCommand replies with the parameters matching the patterns, the
+// aliases included
+func (server *RedisServer) configGetCommand(patterns []interface{}) []byte {
+	names := []string{}
+	seen := map[string]bool{}
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for _, arg := range patterns {
+		pattern, _ := arg.(string)
+		pattern = strings.ToLower(pattern)
+		if !strings.ContainsAny(pattern, "*?[") {
+			if configs[pattern] != nil {
+				add(pattern)
+			}
+			continue
+		}
+		for _, c := range configTable {
+			for _, name := range []string{c.name, c.alias} {
+				if name != "" && stringMatch(pattern, name, true) {
+					add(name)
+				}
+			}
+		}
+	}
+
+	reply := bytes.Buffer{}
+	reply.Write(server.currentClient.addReplyMapLen(len(names)))
+	for _, name := range names {
+		writeReplyValue(&reply, name)
+		writeReplyValue(&reply, configs[name].get(server.Config))
+	}
+	return reply.Bytes()
+}
+
+// configSetCommand sets the parameters and makes the changes take effect,
+// all of them or none when one fails
+func (server *RedisServer) configSetCommand(args []interface{}) []byte {
+	if len(args)%2 != 0 {
+		return []byte("-ERR wrong number of arguments for 'config|set' command\r\n")
+	}
+
+	type configChange struct {
+		config *standardConfig
+		name   string
+		value  string
+	}
+	changes := []configChange{}
+	for i := 0; i < len(args); i += 2 {
+		name, _ := args[i].(string)
+		value, _ := args[i+1].(string)
+		c := configs[strings.ToLower(name)]
+		if c == nil {
+			return []byte(fmt.Sprintf("-ERR Unknown option or number of arguments for CONFIG SET - '%s'\r\n", name))
+		}
+		if c.flags&IMMUTABLE_CONFIG != 0 {
+			return []byte(fmt.Sprintf("-ERR CONFIG SET failed (possibly related to argument '%s') - can't set immutable config\r\n", name))
+		}
+		for _, change := range changes {
+			if change.config == c {
+				return []byte(fmt.Sprintf("-ERR CONFIG SET failed (possibly related to argument '%s') - duplicate parameter\r\n", name))
+			}
+		}
+		changes = append(changes, configChange{c, name, value})
+	}
+
+	backup := *server.Config
+	for _, change := range changes {
+		values := []string{change.value}
+		if change.config.flags&MULTI_ARG_CONFIG != 0 {
+			if fields := strings.Fields(change.value); len(fields) > 0 {
+				values = fields
+			}
+		}
+		if err := change.config.set(server.Config, values); err != nil {
+			*server.Config = backup
+			return []byte(fmt.Sprintf("-ERR CONFIG SET failed (possibly related to argument '%s') - %v\r\n", change.name, err))
+		}
+	}
+
+	// the changes take effect once all are set, the ones applied so far
+	// are undone with the old values when one fails
+	for i, change := range changes {
+		if change.config.apply == nil {
+			continue
+		}
+		if err := change.config.apply(server); err != nil {
+			*server.Config = backup
+			for _, applied := range changes[:i] {
+				if applied.config.apply != nil {
+					applied.config.apply(server)
+				}
+			}
+			return []byte(fmt.Sprintf("-ERR CONFIG SET failed (possibly related to argument '%s') - %v\r\n", change.name, err))
+		}
+	}
+	return []byte("+OK\r\n")
+}
+
+// The line before the ones CONFIG REWRITE adds at the end of the file
+const CONFIG_REWRITE_SIGNATURE = "# Generated by CONFIG REWRITE"
+
+// configRewriteState is the config file being rewritten: its lines, and
+// where the ones of each option are
+type configRewriteState struct {
+	lines   []string
+	removed map[int]bool
+	options map[string][]int
+	tail    []string
+}
+
+// readConfigRewriteState reads the config file for a rewrite. The lines
+// CONFIG REWRITE added are read like the others, the signature is dropped.
+func readConfigRewriteState(path string) (*configRewriteState, error) {
+	state := &configRewriteState{removed: map[int]bool{}, options: map[string][]int{}}
+	content, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	content = bytes.TrimRight(content, "\n")
+	if len(content) == 0 {
+		return state, nil
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.TrimSpace(line) == CONFIG_REWRITE_SIGNATURE {
+			continue
+		}
+		state.lines = append(state.lines, line)
+		argv, err := splitArgs(strings.TrimSpace(line))
+		if err != nil || len(argv) == 0 || strings.HasPrefix(argv[0], "#") {
+			continue
+		}
+		name := strings.ToLower(argv[0])
+		if c := configs[name]; c != nil {
+			name = c.name
+		}
+		state.options[name] = append(state.options[name], len(state.lines)-1)
+	}
+	return state, nil
+}
+
+// rewriteOption puts the lines of an option where it is in the file, the
+// lines it has no more are removed. The new ones go at the end, unless
+// the option only has its default value.
+func (state *configRewriteState) rewriteOption(name string, lines []string, force bool) {
+	positions := state.options[name]
+	for _, line := range lines {
+		if len(positions) > 0 {
+			state.lines[positions[0]] = line
+			positions = positions[1:]
+		} else if force || len(state.options[name]) > 0 {
+			state.tail = append(state.tail, line)
+		}
+	}
+	for _, position := range positions {
+		state.removed[position] = true
+	}
+}
+
+func (state *configRewriteState) content() string {
+	b := strings.Builder{}
+	for i, line := range state.lines {
+		if !state.removed[i] {
+			b.WriteString(line + "\n")
+		}
+	}
+	if len(state.tail) > 0 {
+		b.WriteString(CONFIG_REWRITE_SIGNATURE + "\n")
+		for _, line := range state.tail {
+			b.WriteString(line + "\n")
+		}
+	}
+	return b.String()
+}
+
+// formatConfigLine is the "name value" line of a config parameter, the
+// value quoted when it would be read back differently otherwise
+func formatConfigLine(c *standardConfig, value string) string {
+	if c.flags&MULTI_ARG_CONFIG != 0 && value != "" {
+		return c.name + " " + value
+	}
+	if argv, err := splitArgs(value); err != nil || len(argv) != 1 || argv[0] != value {
+		value = catRepr(value)
+	}
+	return c.name + " " + value
+}
+
+// rewriteConfig writes the config file with the current configuration.
+// The comments and the lines of anything else are kept, an option is
+// rewritten where it is, and the ones that were not in the file are added
+// at the end unless they have their default value.
+func (server *RedisServer) rewriteConfig(path string) error {
+	state, err := readConfigRewriteState(path)
+	if err != nil {
+		return err
+	}
+
+	defaults := defaultServerConfig()
+	for _, c := range configTable {
+		value := c.get(server.Config)
+		lines := []string{formatConfigLine(c, value)}
+		if c.rewrite != nil {
+			lines = c.rewrite(server.Config)
+		}
+		state.rewriteOption(c.name, lines, value != c.get(defaults))
+	}
+	if server.sentinel != nil {
+		state.rewriteOption("sentinel", server.sentinelConfigLines(), true)
+	}
+	// the users are saved with ACL SAVE when there is an aclfile
+	if server.Config.AclFile == "" {
+		state.rewriteOption("user", server.aclDescribeUsers(), true)
+	}
+
+	tmpPath := filepath.Join(filepath.Dir(path), fmt.Sprintf("temp-%d-%s", os.Getpid(), filepath.Base(path)))
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(path); err == nil {
+		file.Chmod(info.Mode())
+	}
+	_, err = file.WriteString(state.content())
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return err
+}
+
+func (server *RedisServer) configRewriteCommand() []byte {
+	if server.Config.ConfigFile == "" {
+		return []byte("-ERR The server is running without a config file\r\n")
+	}
+	if err := server.rewriteConfig(server.Config.ConfigFile); err != nil {
+		fmt.Println("CONFIG REWRITE failed:", err)
+		return []byte(fmt.Sprintf("-ERR Rewriting config file: %v\r\n", err))
+	}
+	fmt.Println("CONFIG REWRITE executed with success.")
+	return []byte("+OK\r\n")
+}
+
+func parseYesNo(value string, target *bool) error {
+	switch strings.ToLower(value) {
+	case "yes":
+		*target = true
+	case "no":
+		*target = false
+	default:
+		return fmt.Errorf("argument must be 'yes' or 'no': %s", value)
+	}
+	return nil
+}
+
+// memtoll converts a memory size like "64mb" or "1gb" into bytes
+func memtoll(value string) (int64, error) {
+	value = strings.ToLower(value)
+	units := []struct {
+		suffix string
+		mul    int64
+	}{
+		{"kb", 1024}, {"mb", 1024 * 1024}, {"gb", 1024 * 1024 * 1024},
+		{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+		{"b", 1},
+	}
+
+	mul := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(value, unit.suffix) {
+			mul = unit.mul
+			value = strings.TrimSuffix(value, unit.suffix)
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid memory value: %s", value)
+	}
+	return n * mul, nil
+}
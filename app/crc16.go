@@ -0,0 +1,29 @@
+package main
+
+// CRC16 XMODEM, polynomial 0x1021 with no initial or final inversion, the
+// one cluster uses to map keys to hash slots
+var crc16Table = makeCrc16Table(0x1021)
+
+func makeCrc16Table(poly uint16) [256]uint16 {
+	var table [256]uint16
+	for i := range table {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ poly
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}
+
+func crc16(p []byte) uint16 {
+	var crc uint16
+	for _, c := range p {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^c]
+	}
+	return crc
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"hash/crc64"
+)
+
+// Redis uses the reflected Jones polynomial for RDB checksums, without the
+// initial and final inversion that hash/crc64 applies.
+const crc64JonesReflected = 0x95AC9329AC4BC9B5
+
+var crc64Table = crc64.MakeTable(crc64JonesReflected)
+
+func crc64Update(crc uint64, p []byte) uint64 {
+	return ^crc64.Update(^crc, crc64Table, p)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Wait this long before retrying a save point after a failed BGSAVE
+const CONFIG_BGSAVE_RETRY_DELAY = 5 * time.Second
+
+const (
+	CONFIG_DEFAULT_HZ = 10
+	CONFIG_MIN_HZ     = 1
+	CONFIG_MAX_HZ     = 500
+)
+
+// Below this many keys a map is never rebuilt, the savings are not worth it
+const HASHTABLE_MIN_RESIZE = 1024
+
+// serverCron is called hz times per second on the executor goroutine and
+// drives all the periodic background work of the server.
+func (server *RedisServer) serverCron() {
+	server.UnixTime = time.Now()
+	server.LRUClock = getLRUClock()
+
+	if used := server.getUsedMemory(); used > server.StatPeakMemory {
+		server.StatPeakMemory = used
+	}
+
+	// keep evicting if a previous call ran out of time
+	if server.Config.Maxmemory > 0 {
+		server.performEvictions()
+	}
+
+	if server.runWithPeriod(100) {
+		server.clientsCron()
+		server.trackInstantaneousMetric(STATS_METRIC_COMMAND, server.stat.NumCommands)
+		server.trackInstantaneousMetric(STATS_METRIC_NET_INPUT, atomic.LoadInt64(&server.statNetInputBytes))
+		server.trackInstantaneousMetric(STATS_METRIC_NET_OUTPUT, atomic.LoadInt64(&server.statNetOutputBytes))
+	}
+
+	if server.runWithPeriod(1000) {
+		server.replicationCron()
+		server.migrateCloseTimedoutSockets()
+	}
+
+	if server.cluster != nil && server.runWithPeriod(100) {
+		server.clusterCron()
+	}
+
+	if server.sentinel != nil {
+		server.sentinelTimer()
+	}
+
+	server.checkShutdownAsap()
+	server.checkShutdownInProgress()
+	server.checkClientPauseTimeout()
+	// keys that expired or were evicted in the background
+	server.trackingBroadcastInvalidationMessages()
+	server.handleBlockedClientsTimeout()
+	server.updateFailoverStatus()
+
+	server.databasesCron()
+
+	if !server.rdbBgsaveInProgress {
+		server.checkSaveParams()
+	}
+
+	// a rewrite requested while another one was running
+	if server.aof.rewriteScheduled && !server.aof.rewriteInProgress {
+		if server.rewriteAppendOnlyFileBackground() == nil {
+			server.aof.rewriteScheduled = false
+		}
+	}
+	server.rewriteAppendOnlyFileIfGrown()
+
+	// retries failed writes and does the everysec fsync when idle
+	server.flushAppendOnlyFile()
+
+	// start a BGSAVE that was requested with SCHEDULE once the previous one is done
+	if server.rdbBgsaveScheduled && !server.rdbBgsaveInProgress {
+		if server.rdbSaveBackground() == nil {
+			server.rdbBgsaveScheduled = false
+		}
+	}
+
+	server.CronLoops++
+}
+
+// checkSaveParams starts a BGSAVE when any save point is reached. After a
+// failed BGSAVE the save points are not retried for a few seconds, so a full
+// disk does not turn into a busy loop of failing saves.
+func (server *RedisServer) checkSaveParams() {
+	now := server.UnixTime
+	for _, param := range server.Config.SaveParams {
+		if server.Dirty < param.Changes || now.Sub(server.LastSave) <= time.Duration(param.Seconds)*time.Second {
+			continue
+		}
+		if server.RdbLastBgsaveErr != nil && now.Sub(server.LastBgsaveTry) <= CONFIG_BGSAVE_RETRY_DELAY {
+			continue
+		}
+
+		fmt.Printf("%d changes in %d seconds. Saving...\n", param.Changes, param.Seconds)
+		server.rdbSaveBackground()
+		return
+	}
+}
+
+// runWithPeriod reports whether a job that wants to run every ms milliseconds
+// is due in the current cron iteration.
+func (server *RedisServer) runWithPeriod(ms int) bool {
+	period := 1000 / server.Config.Hz
+	return ms <= period || server.CronLoops%int64(ms/period) == 0
+}
+
+// clientsCron catches clients that stay over their soft output buffer limit
+// without receiving any new reply that would trigger the check.
+func (server *RedisServer) clientsCron() {
+	server.clientsMu.Lock()
+	clients := make([]*RedisClient, 0, len(server.clients))
+	for _, client := range server.clients {
+		clients = append(clients, client)
+	}
+	server.clientsMu.Unlock()
+
+	for _, client := range clients {
+		client.mu.Lock()
+		exceeded := client.outputBytes > 0 && client.checkOutputBufferLimits()
+		client.mu.Unlock()
+
+		if exceeded {
+			client.closeOverOutputLimit()
+		}
+	}
+
+	server.pubsubRemoveClosedClients()
+	server.unwatchClosedClients()
+	server.trackingRemoveClosedClients()
+}
+
+func (server *RedisServer) databasesCron() {
+	server.activeExpireCycle(ACTIVE_EXPIRE_CYCLE_SLOW)
+	server.tryResizeHashTables()
+}
+
+// beforeSleep runs whenever the executor drained its queue of requests
+func (server *RedisServer) beforeSleep() {
+	server.activeExpireCycle(ACTIVE_EXPIRE_CYCLE_FAST)
+
+	// clients in WAIT get unblocked by the ACKs we just processed, or wait
+	// for the ones we ask the replicas for
+	if len(server.clientsWaitingAcks) > 0 {
+		server.processClientsWaitingReplicas()
+	}
+	if server.getAckFromSlaves {
+		server.replicationFeedSlaves("REPLCONF", []interface{}{"GETACK", "*"})
+		server.getAckFromSlaves = false
+	}
+	server.updateFailoverStatus()
+	server.processUnblockedClients()
+	server.clusterBeforeSleep()
+
+	server.flushAppendOnlyFile()
+}
+
+// Go maps grow incrementally but never give memory back, so once most keys
+// are gone the keyspace dicts are rebuilt at their current size.
+func (server *RedisServer) tryResizeHashTables() {
+	size := server.Storage.Len()
+	if size > server.storagePeak {
+		server.storagePeak = size
+	}
+
+	if server.storagePeak < HASHTABLE_MIN_RESIZE || size*10 > server.storagePeak {
+		return
+	}
+
+	server.Storage.Rebuild()
+	server.Expirations.Rebuild()
+	server.storagePeak = size
+}
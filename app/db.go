@@ -0,0 +1,277 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	LOOKUP_NONE    = 0
+	LOOKUP_NOTOUCH = 1 << 0 // don't update the LRU/LFU data of the value
+	LOOKUP_NOSTATS = 1 << 1 // don't count a keyspace hit or miss
+	LOOKUP_WRITE   = 1 << 2 // the key is looked up to be written, no stats
+)
+
+// lookupKeyRead finds the key of a command reading it, which counts as a
+// keyspace hit or miss
+func (server *RedisServer) lookupKeyRead(key string) *RedisObject {
+	return server.lookupKeyWithFlags(key, LOOKUP_NONE)
+}
+
+// lookupKeyWrite finds the key of a command about to write it
+func (server *RedisServer) lookupKeyWrite(key string) *RedisObject {
+	return server.lookupKeyWithFlags(key, LOOKUP_WRITE)
+}
+
+func (server *RedisServer) lookupKeyWithFlags(key string, flags int) *RedisObject {
+	obj, ok := server.Storage.Get(key)
+	if ok && server.expireIfNeeded(key) {
+		obj, ok = nil, false
+	}
+	if flags&(LOOKUP_NOSTATS|LOOKUP_WRITE) == 0 {
+		if ok {
+			server.stat.KeyspaceHits++
+		} else {
+			server.stat.KeyspaceMisses++
+		}
+	}
+	if !ok {
+		return nil
+	}
+	if flags&LOOKUP_NOTOUCH == 0 && !server.noTouchClient() {
+		server.updateObjectAccess(obj)
+	}
+	return obj
+}
+
+// noTouchClient tells if the command runs for a client in CLIENT NO-TOUCH
+// mode, which may be the caller of the script running it
+func (server *RedisServer) noTouchClient() bool {
+	client := server.currentClient
+	if server.script != nil && client == server.script.client {
+		client = server.script.caller
+	}
+	return client != nil && client.Flags&CLIENT_NO_TOUCH != 0
+}
+
+// setKey stores the value and drops any previous TTL of the key
+func (server *RedisServer) setKey(key string, obj *RedisObject) {
+	server.dbReplaceValue(key, obj)
+	server.Expirations.Delete(key)
+}
+
+// dbReplaceValue stores the value and keeps the TTL of the key. Commands that
+// modify a collection store a modified copy this way, values shared with
+// snapshots are never changed in place.
+func (server *RedisServer) dbReplaceValue(key string, obj *RedisObject) {
+	if old, ok := server.Storage.Get(key); ok {
+		server.usedMemory -= keyMemoryUsage(key, old)
+		if server.Config.LazyfreeLazyServerDel && old != obj {
+			server.freeObjectAsync(old)
+		}
+	} else {
+		server.notifyKeyspaceEvent(NOTIFY_NEW, "new", key)
+	}
+	server.initObjectLRU(obj)
+	server.usedMemory += keyMemoryUsage(key, obj)
+	server.Storage.Set(key, obj)
+	server.signalModifiedKey(key)
+}
+
+func (server *RedisServer) setExpire(key string, when time.Time) {
+	server.Expirations.Set(key, when)
+	server.signalModifiedKey(key)
+}
+
+// signalModifiedKey is called on every change of a key, whatever wrote it
+func (server *RedisServer) signalModifiedKey(key string) {
+	server.touchWatchedKey(key)
+	server.trackingInvalidateKey(key)
+}
+
+func (server *RedisServer) dbGenericDelete(key string, async bool) bool {
+	obj, ok := server.Storage.Get(key)
+	if !ok {
+		return false
+	}
+
+	server.usedMemory -= keyMemoryUsage(key, obj)
+	server.Storage.Delete(key)
+	server.Expirations.Delete(key)
+	if async {
+		server.freeObjectAsync(obj)
+	}
+	server.signalModifiedKey(key)
+	return true
+}
+
+func (server *RedisServer) dbSyncDelete(key string) bool {
+	return server.dbGenericDelete(key, false)
+}
+
+func (server *RedisServer) dbAsyncDelete(key string) bool {
+	return server.dbGenericDelete(key, true)
+}
+
+func (server *RedisServer) emptyData(async bool) int {
+	// the watched keys that exist are modified by the flush
+	for key := range server.watchedKeys {
+		if _, ok := server.Storage.Get(key); ok {
+			server.touchWatchedKey(key)
+		}
+	}
+
+	server.trackingInvalidateKeysOnFlush()
+
+	removed := server.Storage.Len()
+	if async {
+		server.emptyDbAsync()
+	} else {
+		server.Storage = newDict[*RedisObject]()
+		server.Expirations = newDict[time.Time]()
+	}
+	server.storagePeak = 0
+	server.usedMemory = 0
+	server.evictionPool = nil
+	return removed
+}
+
+func (server *RedisServer) keyIsExpired(key string) bool {
+	when, exists := server.Expirations.Get(key)
+	return exists && time.Now().After(when)
+}
+
+func (server *RedisServer) handleKeysCommand(cmd string, args []interface{}) []byte {
+	if len(args) != 1 {
+		return addReplyErrorArity()
+	}
+
+	pattern, ok := args[0].(string)
+	if !ok {
+		return []byte("-ERR Invalid pattern type\r\n")
+	}
+	allkeys := pattern == "*"
+
+	keys := []string{}
+	server.Storage.Range(func(key string, _ *RedisObject) bool {
+		if (allkeys || stringMatch(pattern, key, false)) && !server.keyIsExpired(key) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+
+	return addReplyArray(keys)
+}
+
+func (server *RedisServer) delGenericCommand(args []interface{}, lazy bool) []byte {
+	if len(args) < 1 {
+		return addReplyErrorArity()
+	}
+
+	deleted := int64(0)
+	for _, arg := range args {
+		key, ok := arg.(string)
+		if !ok {
+			return []byte("-ERR Invalid key type\r\n")
+		}
+
+		server.expireIfNeeded(key)
+		if server.dbGenericDelete(key, lazy) {
+			server.notifyKeyspaceEvent(NOTIFY_GENERIC, "del", key)
+			deleted++
+		}
+	}
+	server.Dirty += deleted
+
+	return addReplyLongLong(deleted)
+}
+
+func (server *RedisServer) handleDelCommand(cmd string, args []interface{}) []byte {
+	return server.delGenericCommand(args, server.Config.LazyfreeLazyUserDel)
+}
+
+func (server *RedisServer) handleUnlinkCommand(cmd string, args []interface{}) []byte {
+	return server.delGenericCommand(args, true)
+}
+
+// getFlushCommandFlags parses the optional ASYNC|SYNC argument of FLUSHALL/FLUSHDB
+func (server *RedisServer) getFlushCommandFlags(args []interface{}) (bool, bool) {
+	if len(args) > 1 {
+		return false, false
+	}
+	if len(args) == 0 {
+		return server.Config.LazyfreeLazyUserFlush, true
+	}
+
+	option, _ := args[0].(string)
+	switch strings.ToUpper(option) {
+	case "ASYNC":
+		return true, true
+	case "SYNC":
+		return false, true
+	default:
+		return false, false
+	}
+}
+
+func (server *RedisServer) handleFlushdbCommand(cmd string, args []interface{}) []byte {
+	async, ok := server.getFlushCommandFlags(args)
+	if !ok {
+		return []byte("-ERR syntax error\r\n")
+	}
+
+	server.Dirty += int64(server.emptyData(async))
+	return []byte("+OK\r\n")
+}
+
+// With a single database FLUSHALL only differs from FLUSHDB in saving the
+// now empty dataset when save points are configured
+func (server *RedisServer) handleFlushallCommand(cmd string, args []interface{}) []byte {
+	async, ok := server.getFlushCommandFlags(args)
+	if !ok {
+		return []byte("-ERR syntax error\r\n")
+	}
+
+	server.Dirty += int64(server.emptyData(async))
+
+	if len(server.Config.SaveParams) > 0 && !server.rdbBgsaveInProgress {
+		server.rdbSave()
+	}
+	// the save reset the dirty counter, the flush is propagated anyway
+	server.Dirty++
+	server.forceCommandPropagation()
+	return []byte("+OK\r\n")
+}
+
+// getKeysFromCommand returns the keys among the arguments of the command
+func getKeysFromCommand(command RedisCommand, args []interface{}) []string {
+	if command.GetKeysProc != nil {
+		return command.GetKeysProc(args)
+	}
+	first, last, step := command.FirstKey, command.LastKey, command.KeyStep
+	if command.NumKeysIndex != 0 {
+		if command.NumKeysIndex > len(args) {
+			return nil
+		}
+		s, _ := args[command.NumKeysIndex-1].(string)
+		numkeys, err := strconv.Atoi(s)
+		if err != nil || numkeys <= 0 {
+			return nil
+		}
+		first, last, step = command.NumKeysIndex+1, command.NumKeysIndex+numkeys, 1
+	}
+	if first == 0 {
+		return nil
+	}
+	if last < 0 || last > len(args) {
+		last = len(args)
+	}
+
+	keys := []string{}
+	for pos := first; pos <= last; pos += step {
+		key, _ := args[pos-1].(string)
+		keys = append(keys, key)
+	}
+	return keys
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// faultInjection are the failures DEBUG injects, to test how the clients and
+// the replicas cope with them
+type faultInjection struct {
+	dropReplicationStream bool
+	fsyncDelay            int64             // microseconds, read by the fsync goroutine too
+	failCommands          map[string][]byte // the error replies, by lowercase command name
+}
+
+func (faults *faultInjection) delayFsync() {
+	if delay := atomic.LoadInt64(&faults.fsyncDelay); delay > 0 {
+		time.Sleep(time.Duration(delay) * time.Microsecond)
+	}
+}
+
+func (server *RedisServer) handleDebugCommand(cmd string, args []interface{}) []byte {
+	if len(args) < 1 {
+		return addReplyErrorArity()
+	}
+
+	subcommand, ok := args[0].(string)
+	if !ok {
+		return []byte("-ERR Invalid subcommand type\r\n")
+	}
+
+	switch strings.ToUpper(subcommand) {
+	case "RELOAD":
+		return server.debugReload(args[1:])
+	case "LOADAOF":
+		if len(args) != 1 {
+			return addReplyErrorArity()
+		}
+		return server.debugLoadAof()
+	case "SLEEP":
+		if len(args) != 2 {
+			return addReplyErrorArity()
+		}
+		return server.debugSleep(args[1])
+	case "OBJECT":
+		if len(args) != 2 {
+			return addReplyErrorArity()
+		}
+		key, _ := args[1].(string)
+		return server.debugObject(key)
+	case "SET-ACTIVE-EXPIRE":
+		if len(args) != 2 {
+			return addReplyErrorArity()
+		}
+		enabled, _ := args[1].(string)
+		server.expire.disabled = enabled == "0"
+		return []byte("+OK\r\n")
+	case "JMAP":
+		if len(args) != 1 {
+			return addReplyErrorArity()
+		}
+		return server.currentClient.addReplyVerbatim(debugJmap(), "txt")
+	case "STRINGMATCH-LEN":
+		if len(args) != 1 {
+			return addReplyErrorArity()
+		}
+		matches := stringMatchFuzzTest()
+		fmt.Printf("stringmatchlen fuzz test: %d matches\n", matches)
+		return []byte("+Apparently Redis did not crash: test passed\r\n")
+	case "QUICKLIST-PACKED-THRESHOLD":
+		if len(args) != 2 {
+			return addReplyErrorArity()
+		}
+		arg, _ := args[1].(string)
+		threshold, err := memtoll(arg)
+		if err != nil || threshold < 0 || threshold > QUICKLIST_DEFAULT_PACKED_THRESHOLD*4 {
+			return []byte("-ERR argument must be a memory value bigger than 1 and smaller than 4gb\r\n")
+		}
+		if threshold == 0 {
+			threshold = QUICKLIST_DEFAULT_PACKED_THRESHOLD
+		}
+		quicklistPackedThreshold = threshold
+		return []byte("+OK\r\n")
+	case "CHANGE-REPL-ID":
+		if len(args) != 1 {
+			return addReplyErrorArity()
+		}
+		server.changeReplicationId()
+		server.clearReplicationId2()
+		fmt.Println("Replication IDs changed by DEBUG CHANGE-REPL-ID")
+		return []byte("+OK\r\n")
+	case "DROP-REPLICATION-STREAM":
+		if len(args) != 2 {
+			return addReplyErrorArity()
+		}
+		drop, _ := args[1].(string)
+		server.faults.dropReplicationStream = drop == "1"
+		return []byte("+OK\r\n")
+	case "FSYNC-DELAY":
+		if len(args) != 2 {
+			return addReplyErrorArity()
+		}
+		arg, _ := args[1].(string)
+		delay, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil || delay < 0 {
+			return []byte("-ERR value is out of range, must be positive\r\n")
+		}
+		atomic.StoreInt64(&server.faults.fsyncDelay, delay)
+		return []byte("+OK\r\n")
+	case "FAIL-COMMAND":
+		if len(args) != 2 && len(args) != 3 {
+			return addReplyErrorArity()
+		}
+		return server.debugFailCommand(args[1:])
+	case "FAULTS-RESET":
+		if len(args) != 1 {
+			return addReplyErrorArity()
+		}
+		server.faults.dropReplicationStream = false
+		atomic.StoreInt64(&server.faults.fsyncDelay, 0)
+		server.faults.failCommands = nil
+		return []byte("+OK\r\n")
+	case "HELP":
+		return addReplyHelp("DEBUG", []string{
+			"CHANGE-REPL-ID",
+			"    Change the replication IDs of the instance.",
+			"    Dangerous: should be used only for testing the replication subsystem.",
+			"DROP-REPLICATION-STREAM <0|1>",
+			"    Setting it to 1 stops sending the replication stream to the replicas, which",
+			"    are left behind until they reconnect and catch up from the backlog.",
+			"FAIL-COMMAND <command> [<error>]",
+			"    Make <command> fail with <error> (default: ERR injected failure) instead of",
+			"    running it.",
+			"FAULTS-RESET",
+			"    Stop injecting all the failures of DROP-REPLICATION-STREAM, FAIL-COMMAND and",
+			"    FSYNC-DELAY.",
+			"FSYNC-DELAY <microseconds>",
+			"    Delay each fsync of the AOF, like a slow disk would. 0 disables the delay.",
+			"JMAP",
+			"    Show a summary of the heap of the server, like jmap -heap does for Java.",
+			"LOADAOF",
+			"    Flush the AOF buffers on disk and reload the AOF in memory.",
+			"OBJECT <key>",
+			"    Show low level info about the <key> and associated value.",
+			"QUICKLIST-PACKED-THRESHOLD <size>",
+			"    Sets the threshold for elements to be inserted as plain vs packed nodes",
+			"    Default value is 1GB, allows values up to 4GB. Setting to 0 restores to default.",
+			"RELOAD [option ...]",
+			"    Save the RDB on disk and reload it back to memory. Available options:",
+			"    * MERGE: Merge the content of the RDB file into the current dataset.",
+			"    * NOFLUSH: Do not empty the current dataset before loading the RDB file.",
+			"    * NOSAVE: the database will be loaded from an existing RDB file.",
+			"    Examples:",
+			"    * DEBUG RELOAD: verify that the server is able to persist, flush and reload",
+			"      the database.",
+			"    * DEBUG RELOAD NOSAVE: replace the current database with the contents of an",
+			"      existing RDB file.",
+			"    * DEBUG RELOAD NOSAVE NOFLUSH MERGE: add the contents of an existing RDB",
+			"      file to the database.",
+			"SET-ACTIVE-EXPIRE <0|1>",
+			"    Setting it to 0 disables expiring keys in background when they are not",
+			"    accessed (otherwise the Redis behavior). Setting it to 1 reenables back the",
+			"    default.",
+			"SLEEP <seconds>",
+			"    Stop the server for <seconds>. Decimals allowed.",
+			"STRINGMATCH-LEN",
+			"    Run a fuzz tester against the stringmatchlen() function.",
+		})
+	default:
+		return addReplySubcommandSyntaxError("DEBUG", subcommand)
+	}
+}
+
+// debugReload saves, flushes and reloads the dataset, which is how the test
+// suites check that everything survives a persistence round trip
+func (server *RedisServer) debugReload(options []interface{}) []byte {
+	// DEBUG is served while blocked by a load, which can't start another one
+	if server.loading {
+		return []byte("-LOADING Redis is loading the dataset in memory\r\n")
+	}
+
+	flush, save := true, true
+	for _, arg := range options {
+		option, _ := arg.(string)
+		switch strings.ToUpper(option) {
+		case "MERGE", "NOFLUSH":
+			// keys of the file replace the ones already in memory
+			flush = false
+		case "NOSAVE":
+			save = false
+		default:
+			return []byte("-ERR DEBUG RELOAD only supports the MERGE, NOFLUSH and NOSAVE options.\r\n")
+		}
+	}
+
+	if save {
+		if err := server.rdbSave(); err != nil {
+			return []byte(fmt.Sprintf("-ERR %s\r\n", err))
+		}
+	}
+	if flush {
+		server.emptyData(false)
+	}
+
+	if err := server.rdbLoad(server.rdbFilename()); err != nil {
+		fmt.Println("Error loading RDB file:", err)
+		return []byte("-ERR Error trying to load the RDB dump, check server logs.\r\n")
+	}
+	// the load is not propagated to the AOF or the replicas
+	server.Dirty = 0
+	fmt.Println("DB reloaded by DEBUG RELOAD")
+	return []byte("+OK\r\n")
+}
+
+func (server *RedisServer) debugLoadAof() []byte {
+	if server.loading {
+		return []byte("-LOADING Redis is loading the dataset in memory\r\n")
+	}
+
+	if server.Config.AppendOnly {
+		server.flushAppendOnlyFile()
+	}
+	server.emptyData(false)
+	server.functionsInit()
+
+	if err := server.loadAppendOnlyFiles(); err != nil {
+		fmt.Println("Error loading the append only file:", err)
+		return []byte("-ERR Error loading the AOF, check server logs.\r\n")
+	}
+	// the load is not propagated to the AOF or the replicas
+	server.Dirty = 0
+	fmt.Println("Append Only File loaded by DEBUG LOADAOF")
+	return []byte("+OK\r\n")
+}
+
+// debugSleep blocks the server, for the tests of what happens meanwhile
+func (server *RedisServer) debugSleep(arg interface{}) []byte {
+	seconds, _ := arg.(string)
+	duration, err := strconv.ParseFloat(seconds, 64)
+	if err != nil || duration < 0 {
+		return []byte("-ERR value is not a valid float\r\n")
+	}
+	time.Sleep(time.Duration(duration * float64(time.Second)))
+	return []byte("+OK\r\n")
+}
+
+// debugObject describes how the value of the key is stored, with the size
+// of its serialization and its quicklist for a list
+func (server *RedisServer) debugObject(key string) []byte {
+	obj := server.lookupKeyWithFlags(key, LOOKUP_NOTOUCH)
+	if obj == nil {
+		return []byte("-ERR no such key\r\n")
+	}
+
+	var payload bytes.Buffer
+	rdb := &rdbWriter{w: bufio.NewWriter(&payload), compression: server.Config.RdbCompression}
+	if err := rdb.saveObject(obj); err != nil {
+		return []byte(fmt.Sprintf("-ERR %s\r\n", err))
+	}
+	rdb.w.Flush()
+
+	extra := ""
+	if elements, ok := obj.Value.([]string); ok && getObjectEncodingName(obj) == "quicklist" {
+		nodes := quicklistNodes(elements)
+		extra = fmt.Sprintf(" ql_nodes:%d ql_avg_node:%.2f ql_listpack_max:%d ql_compressed:0 ql_uncompressed_size:%d",
+			len(nodes), float64(len(elements))/float64(len(nodes)), OBJ_LIST_MAX_LISTPACK_ENTRIES, payload.Len())
+	}
+	return []byte(fmt.Sprintf("+Value at:%p refcount:1 encoding:%s serializedlength:%d lru:%d lru_seconds_idle:%d%s\r\n",
+		obj, getObjectEncodingName(obj), payload.Len(), obj.LRU, server.estimateObjectIdleTime(obj)/1000, extra))
+}
+
+// debugJmap summarizes the heap of the Go runtime
+func debugJmap() string {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Heap Configuration:\n")
+	fmt.Fprintf(&b, "   GOMAXPROCS       = %d\n", runtime.GOMAXPROCS(0))
+	fmt.Fprintf(&b, "   NextGC           = %d\n", stats.NextGC)
+	fmt.Fprintf(&b, "\nHeap Usage:\n")
+	fmt.Fprintf(&b, "   HeapSys          = %d\n", stats.HeapSys)
+	fmt.Fprintf(&b, "   HeapAlloc        = %d\n", stats.HeapAlloc)
+	fmt.Fprintf(&b, "   HeapIdle         = %d\n", stats.HeapIdle)
+	fmt.Fprintf(&b, "   HeapReleased     = %d\n", stats.HeapReleased)
+	fmt.Fprintf(&b, "   HeapObjects      = %d\n", stats.HeapObjects)
+	fmt.Fprintf(&b, "   StackInuse       = %d\n", stats.StackInuse)
+	fmt.Fprintf(&b, "\nGarbage Collection:\n")
+	fmt.Fprintf(&b, "   NumGC            = %d\n", stats.NumGC)
+	fmt.Fprintf(&b, "   PauseTotalNs     = %d\n", stats.PauseTotalNs)
+	fmt.Fprintf(&b, "   GCCPUFraction    = %.6f\n", stats.GCCPUFraction)
+	fmt.Fprintf(&b, "   Goroutines       = %d\n", runtime.NumGoroutine())
+	return b.String()
+}
+
+// debugFailCommand makes the command reply with the error rather than run
+func (server *RedisServer) debugFailCommand(args []interface{}) []byte {
+	name, _ := args[0].(string)
+	name = strings.ToLower(name)
+	command, ok := redisCommandTable[strings.ToUpper(name)]
+	if !ok {
+		return []byte(fmt.Sprintf("-ERR Unknown command '%s'\r\n", name))
+	}
+	// DEBUG FAULTS-RESET must keep working
+	if strings.EqualFold(command.Name, "DEBUG") {
+		return []byte(fmt.Sprintf("-ERR Can't inject failures in '%s'\r\n", name))
+	}
+
+	errorString := "ERR injected failure"
+	if len(args) == 2 {
+		errorString, _ = args[1].(string)
+		errorString = strings.TrimPrefix(errorString, "-")
+		if errorString == "" || strings.ContainsAny(errorString, "\r\n") {
+			return []byte("-ERR the error must be a single line\r\n")
+		}
+	}
+
+	if server.faults.failCommands == nil {
+		server.faults.failCommands = make(map[string][]byte)
+	}
+	server.faults.failCommands[strings.ToLower(command.Name)] = []byte("-" + errorString + "\r\n")
+	return []byte("+OK\r\n")
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"math/rand"
+)
+
+// Number of maps a dict is split in. Copy-on-write works at shard
+// granularity, so this bounds the cost of the first write to a shard
+// while a snapshot is alive.
+const DICT_SHARDS = 256
+
+// dict is a map split in shards that can be frozen for point-in-time
+// snapshots. Go can't fork to get copy-on-write pages like Redis does, so a
+// snapshot keeps references to the shard maps and the dict copies a shard
+// before its first write while any snapshot is alive. Snapshots only ever
+// see maps that are no longer written to.
+//
+// Values are shared with snapshots as well, which is why they are never
+// modified in place: commands replace the whole value instead. The access
+// time of the objects is the one exception, see RedisObject.LRU.
+type dict[V any] struct {
+	shards    [DICT_SHARDS]map[string]V
+	shared    [DICT_SHARDS]bool // referenced by a live snapshot
+	size      int
+	snapshots int
+}
+
+// dictSnapshot is a read-only view of a dict at the time it was taken. It is
+// safe to use from any goroutine.
+type dictSnapshot[V any] struct {
+	dict   *dict[V]
+	shards [DICT_SHARDS]map[string]V
+	size   int
+}
+
+func newDict[V any]() *dict[V] {
+	d := &dict[V]{}
+	for i := range d.shards {
+		d.shards[i] = make(map[string]V)
+	}
+	return d
+}
+
+// dictShardIndex hashes the key with FNV-1a
+func dictShardIndex(key string) int {
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return int(hash % DICT_SHARDS)
+}
+
+// writable returns the shard map for writing, copying it first if a
+// snapshot still references it
+func (d *dict[V]) writable(i int) map[string]V {
+	if d.shared[i] {
+		shard := make(map[string]V, len(d.shards[i]))
+		for key, value := range d.shards[i] {
+			shard[key] = value
+		}
+		d.shards[i] = shard
+		d.shared[i] = false
+	}
+	return d.shards[i]
+}
+
+func (d *dict[V]) Get(key string) (V, bool) {
+	value, ok := d.shards[dictShardIndex(key)][key]
+	return value, ok
+}
+
+func (d *dict[V]) Set(key string, value V) {
+	i := dictShardIndex(key)
+	if _, ok := d.shards[i][key]; !ok {
+		d.size++
+	}
+	d.writable(i)[key] = value
+}
+
+func (d *dict[V]) Delete(key string) bool {
+	i := dictShardIndex(key)
+	if _, ok := d.shards[i][key]; !ok {
+		return false
+	}
+	delete(d.writable(i), key)
+	d.size--
+	return true
+}
+
+func (d *dict[V]) Len() int {
+	return d.size
+}
+
+// Range calls fn for every entry until it returns false. The dict must not
+// be modified by fn.
+func (d *dict[V]) Range(fn func(key string, value V) bool) {
+	for _, shard := range d.shards {
+		for key, value := range shard {
+			if !fn(key, value) {
+				return
+			}
+		}
+	}
+}
+
+// Sample calls fn for up to count entries starting at a random position,
+// until it returns false. fn may delete the entry it is given.
+func (d *dict[V]) Sample(count int, fn func(key string, value V) bool) {
+	if d.size == 0 || count <= 0 {
+		return
+	}
+
+	start := rand.Intn(DICT_SHARDS)
+	for j := 0; j < DICT_SHARDS; j++ {
+		// map iteration starts at a random element of the shard
+		for key, value := range d.shards[(start+j)%DICT_SHARDS] {
+			if !fn(key, value) {
+				return
+			}
+			count--
+			if count == 0 {
+				return
+			}
+		}
+	}
+}
+
+// RandomKey returns a random key, with a bias towards keys in smaller shards
+func (d *dict[V]) RandomKey() (string, bool) {
+	if d.size == 0 {
+		return "", false
+	}
+
+	start := rand.Intn(DICT_SHARDS)
+	for j := 0; j < DICT_SHARDS; j++ {
+		shard := d.shards[(start+j)%DICT_SHARDS]
+		if len(shard) == 0 {
+			continue
+		}
+		n := rand.Intn(len(shard))
+		for key := range shard {
+			if n == 0 {
+				return key, true
+			}
+			n--
+		}
+	}
+	return "", false
+}
+
+// Rebuild copies every shard into a map of its current size. Go maps never
+// shrink, so this is how memory is given back after most keys are gone.
+func (d *dict[V]) Rebuild() {
+	for i := range d.shards {
+		d.shared[i] = true
+		d.writable(i)
+	}
+}
+
+// Snapshot freezes the current content of the dict. It costs O(DICT_SHARDS)
+// and the snapshot must be released once it's no longer used.
+func (d *dict[V]) Snapshot() *dictSnapshot[V] {
+	for i := range d.shared {
+		d.shared[i] = true
+	}
+	d.snapshots++
+	return &dictSnapshot[V]{dict: d, shards: d.shards, size: d.size}
+}
+
+// Release tells the dict the snapshot is gone, so that shards don't need to
+// be copied anymore once no snapshot is left. Must be called from the
+// goroutine that owns the dict.
+func (s *dictSnapshot[V]) Release() {
+	d := s.dict
+	if d == nil {
+		return
+	}
+	s.dict = nil
+
+	d.snapshots--
+	if d.snapshots == 0 {
+		for i := range d.shared {
+			d.shared[i] = false
+		}
+	}
+}
+
+func (s *dictSnapshot[V]) Get(key string) (V, bool) {
+	value, ok := s.shards[dictShardIndex(key)][key]
+	return value, ok
+}
+
+func (s *dictSnapshot[V]) Len() int {
+	return s.size
+}
+
+func (s *dictSnapshot[V]) Range(fn func(key string, value V) bool) {
+	for _, shard := range s.shards {
+		for key, value := range shard {
+			if !fn(key, value) {
+				return
+			}
+		}
+	}
+}
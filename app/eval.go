@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// evalState is the Lua interpreter the scripts run in, with the scripts it
+// compiled by the SHA1 of their body, for EVALSHA
+type evalState struct {
+	L       *luaState
+	client  *RedisClient
+	scripts map[string]*evalScript
+}
+
+type evalScript struct {
+	body string
+	fn   *luaClosure
+}
+
+// sha1hex is the lowercase hex SHA1 digest of s, how scripts are named
+func sha1hex(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// luaCreateFunction compiles the body and adds it to the scripts, replying
+// with the compile error if it doesn't compile
+func (server *RedisServer) luaCreateFunction(sha, body string) (*evalScript, []byte) {
+	if script, ok := server.lua.scripts[sha]; ok {
+		return script, nil
+	}
+
+	fn, err := server.lua.L.load(body, "user_script")
+	if err != nil {
+		return nil, []byte(fmt.Sprintf("-ERR Error compiling script (new function): %s\r\n", luaSanitizeReplyLine(err.Error())))
+	}
+	script := &evalScript{body: body, fn: fn}
+	server.lua.scripts[sha] = script
+	return script, nil
+}
+
+// handleEvalCommand runs a script: EVAL script numkeys [key ...] [arg ...]
+func (server *RedisServer) handleEvalCommand(cmd string, args []interface{}) []byte {
+	return server.evalGenericCommand(args, false, false)
+}
+
+// handleEvalshaCommand runs a script by the SHA1 of its body, once EVAL or
+// SCRIPT LOAD loaded it
+func (server *RedisServer) handleEvalshaCommand(cmd string, args []interface{}) []byte {
+	return server.evalGenericCommand(args, true, false)
+}
+
+// handleEvalRoCommand is EVAL for a script that doesn't write, which can
+// run on read-only replicas
+func (server *RedisServer) handleEvalRoCommand(cmd string, args []interface{}) []byte {
+	return server.evalGenericCommand(args, false, true)
+}
+
+func (server *RedisServer) handleEvalshaRoCommand(cmd string, args []interface{}) []byte {
+	return server.evalGenericCommand(args, true, true)
+}
+
+func (server *RedisServer) evalGenericCommand(args []interface{}, evalsha, readonly bool) []byte {
+	if len(args) < 2 {
+		return addReplyErrorArity()
+	}
+
+	body, _ := args[0].(string)
+	numkeysArg, _ := args[1].(string)
+	numkeys, err := strconv.ParseInt(numkeysArg, 10, 64)
+	if err != nil {
+		return []byte("-ERR value is not an integer or out of range\r\n")
+	}
+	if numkeys > int64(len(args)-2) {
+		return []byte("-ERR Number of keys can't be greater than number of args\r\n")
+	} else if numkeys < 0 {
+		return []byte("-ERR Number of keys can't be negative\r\n")
+	}
+
+	var sha string
+	var script *evalScript
+	if evalsha {
+		sha = strings.ToLower(body)
+		script = server.lua.scripts[sha]
+		if script == nil {
+			return []byte("-NOSCRIPT No matching script. Please use EVAL.\r\n")
+		}
+	} else {
+		sha = sha1hex(body)
+		var reply []byte
+		if script, reply = server.luaCreateFunction(sha, body); reply != nil {
+			return reply
+		}
+	}
+
+	keys := args[2 : 2+numkeys]
+	argv := args[2+numkeys:]
+	L := server.lua.L
+	L.globals.set("KEYS", luaStringArray(keys))
+	L.globals.set("ARGV", luaStringArray(argv))
+
+	// each run draws the same random numbers, as in Redis
+	L.rand.seed(0)
+	flags := SCRIPT_EVAL_MODE
+	if readonly {
+		flags |= SCRIPT_READ_ONLY
+	}
+	reply := server.luaCallFunction(L, script.fn, sha, nil, server.lua.client, flags)
+
+	// the commands the script ran were propagated instead
+	server.preventCommandPropagation()
+	return reply
+}
+
+// luaCallFunction runs a script, or a function, as the client, and converts
+// what it returned, or the error it raised, to the reply of the caller
+func (server *RedisServer) luaCallFunction(L *luaState, fn luaValue, funcname string, args []luaValue, client *RedisClient, flags int) []byte {
+	client.resp = 2
+
+	caller := server.currentClient
+	server.scriptPrepareForRun(funcname, caller, client, flags)
+	rets, lerr := L.xpcall(fn, args, luaErrorHandler)
+	server.scriptResetRun()
+	server.currentClient = caller
+
+	var reply bytes.Buffer
+	if lerr != nil {
+		t, ok := lerr.value.(*luaTable)
+		if !ok {
+			return []byte(fmt.Sprintf("-ERR Error running script %s, %.100s\r\n", funcname, luaSanitizeReplyLine(lerr.Error())))
+		}
+		msg, _ := luaToString(t.getStr("err"))
+		source, _ := luaToString(t.getStr("source"))
+		line, _ := luaToString(t.getStr("line"))
+		if source != "" && line != "" {
+			msg += fmt.Sprintf(" script: %s, on %s:%s.", funcname, source, line)
+		}
+		reply.WriteString("-" + luaSanitizeReplyLine(msg) + "\r\n")
+		return reply.Bytes()
+	}
+
+	// no caller when the script is replayed from the AOF
+	resp := 2
+	if caller != nil {
+		resp = caller.resp
+	}
+	luaReplyToRedisReply(&reply, luaFirst(rets), resp, 0)
+	return reply.Bytes()
+}
+
+// luaErrorHandler turns the errors that reach the top of a script into
+// error tables, {err="ERR message"}, telling where they were raised
+func luaErrorHandler(L *luaState, err luaValue) luaValue {
+	t, ok := err.(*luaTable)
+	if !ok {
+		t = newLuaTable(0, 3)
+		t.set("err", "ERR "+luaAnyToString(err))
+	}
+	if len(L.frames) > 0 {
+		frame := L.frames[len(L.frames)-1]
+		t.set("source", "@"+frame.closure.proto.chunk)
+		t.set("line", float64(frame.line))
+	}
+	return t
+}
+
+// luaStringArray is the Lua array of the arguments, like KEYS
+func luaStringArray(items []interface{}) *luaTable {
+	t := newLuaTable(len(items), 0)
+	for _, item := range items {
+		s, _ := item.(string)
+		t.append(s)
+	}
+	return t
+}
+
+// handleScriptCommand manages the scripts cache, and the script running
+func (server *RedisServer) handleScriptCommand(cmd string, args []interface{}) []byte {
+	subcommand, _ := args[0].(string)
+	subcommand = strings.ToUpper(subcommand)
+
+	// SCRIPT is allowed while a script is busy, for SCRIPT KILL only
+	if server.scriptIsTimedout() && subcommand != "KILL" {
+		return server.scriptBusyError()
+	}
+
+	switch {
+	case subcommand == "HELP" && len(args) == 1:
+		return addReplyHelp("SCRIPT", []string{
+			"EXISTS <sha1> [<sha1> ...]",
+			"    Return information about the existence of the scripts in the script cache.",
+			"FLUSH [ASYNC|SYNC]",
+			"    Flush the Lua scripts cache. Very dangerous on replicas.",
+			"    When called without the optional mode argument, the behavior is determined by the",
+			"    lazyfree-lazy-user-flush configuration directive. Valid modes are:",
+			"    * ASYNC: Asynchronously flush the scripts cache.",
+			"    * SYNC: Synchronously flush the scripts cache.",
+			"KILL",
+			"    Kill the currently executing Lua script.",
+			"LOAD <script>",
+			"    Load a script into the scripts cache without executing it.",
+		})
+	case subcommand == "FLUSH" && len(args) <= 2:
+		if len(args) == 2 {
+			mode, _ := args[1].(string)
+			if mode = strings.ToUpper(mode); mode != "SYNC" && mode != "ASYNC" {
+				return []byte("-ERR SCRIPT FLUSH only support SYNC|ASYNC option\r\n")
+			}
+		}
+		// a new interpreter drops whatever the scripts left behind, along
+		// with the scripts
+		server.scriptingInit()
+		return []byte("+OK\r\n")
+	case subcommand == "EXISTS" && len(args) >= 2:
+		reply := addReplyArrayLen(len(args) - 1)
+		for _, arg := range args[1:] {
+			sha, _ := arg.(string)
+			if _, ok := server.lua.scripts[strings.ToLower(sha)]; ok {
+				reply = append(reply, addReplyLongLong(1)...)
+			} else {
+				reply = append(reply, addReplyLongLong(0)...)
+			}
+		}
+		return reply
+	case subcommand == "LOAD" && len(args) == 2:
+		body, _ := args[1].(string)
+		sha := sha1hex(body)
+		if _, reply := server.luaCreateFunction(sha, body); reply != nil {
+			return reply
+		}
+		return addReplyBulk([]interface{}{sha})
+	case subcommand == "KILL" && len(args) == 1:
+		return server.scriptKill(true)
+	default:
+		return addReplySubcommandSyntaxError("SCRIPT", args[0].(string))
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"time"
+)
+
+const (
+	MAXMEMORY_FLAG_LRU     = 1 << 0
+	MAXMEMORY_FLAG_LFU     = 1 << 1
+	MAXMEMORY_FLAG_ALLKEYS = 1 << 2
+
+	MAXMEMORY_VOLATILE_LRU    = (0 << 8) | MAXMEMORY_FLAG_LRU
+	MAXMEMORY_VOLATILE_LFU    = (1 << 8) | MAXMEMORY_FLAG_LFU
+	MAXMEMORY_VOLATILE_TTL    = 2 << 8
+	MAXMEMORY_VOLATILE_RANDOM = 3 << 8
+	MAXMEMORY_ALLKEYS_LRU     = (4 << 8) | MAXMEMORY_FLAG_LRU | MAXMEMORY_FLAG_ALLKEYS
+	MAXMEMORY_ALLKEYS_LFU     = (5 << 8) | MAXMEMORY_FLAG_LFU | MAXMEMORY_FLAG_ALLKEYS
+	MAXMEMORY_ALLKEYS_RANDOM  = (6 << 8) | MAXMEMORY_FLAG_ALLKEYS
+	MAXMEMORY_NO_EVICTION     = 7 << 8
+)
+
+var maxmemoryPolicyNames = map[string]int{
+	"volatile-lru":    MAXMEMORY_VOLATILE_LRU,
+	"volatile-lfu":    MAXMEMORY_VOLATILE_LFU,
+	"volatile-random": MAXMEMORY_VOLATILE_RANDOM,
+	"volatile-ttl":    MAXMEMORY_VOLATILE_TTL,
+	"allkeys-lru":     MAXMEMORY_ALLKEYS_LRU,
+	"allkeys-lfu":     MAXMEMORY_ALLKEYS_LFU,
+	"allkeys-random":  MAXMEMORY_ALLKEYS_RANDOM,
+	"noeviction":      MAXMEMORY_NO_EVICTION,
+}
+
+func getMaxmemoryPolicyByName(name string) int {
+	if policy, ok := maxmemoryPolicyNames[strings.ToLower(name)]; ok {
+		return policy
+	}
+	return -1
+}
+
+func getMaxmemoryPolicyName(policy int) string {
+	for name, p := range maxmemoryPolicyNames {
+		if p == policy {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+const (
+	EVICT_OK = iota
+	EVICT_RUNNING
+	EVICT_FAIL
+)
+
+const (
+	EVPOOL_SIZE                        = 16
+	CONFIG_DEFAULT_MAXMEMORY_SAMPLES   = 5
+	CONFIG_DEFAULT_EVICTION_TENACITY   = 10
+	EVICTION_TIME_CHECK_INTERVAL       = 16
+	EVICTION_TENACITY_BASE_MICROSECOND = 50
+)
+
+// Rough per-key bookkeeping cost on top of the key and value bytes: the map
+// entry, the object header and the string headers.
+const KEY_ENTRY_OVERHEAD = 64
+
+type evictionPoolEntry struct {
+	idle uint64
+	key  string
+}
+
+// keyMemoryUsage estimates the bytes a key and its value use in the keyspace
+func keyMemoryUsage(key string, obj *RedisObject) int64 {
+	return int64(len(key)) + KEY_ENTRY_OVERHEAD + objectComputeSize(obj, 0)
+}
+
+// getUsedMemory returns the memory counted against maxmemory. It is an
+// estimate maintained on every keyspace change, since the Go heap size only
+// goes down after the garbage collector runs.
+func (server *RedisServer) getUsedMemory() int64 {
+	return server.usedMemory
+}
+
+// evictionTimeLimit follows maxmemory-eviction-tenacity: 10 gives the
+// default 500us budget, every step above grows it by 15%, 100 is unlimited.
+func (server *RedisServer) evictionTimeLimit() time.Duration {
+	tenacity := server.Config.MaxmemoryEvictionTenacity
+	if tenacity <= 10 {
+		return time.Duration(EVICTION_TENACITY_BASE_MICROSECOND*tenacity) * time.Microsecond
+	}
+	if tenacity < 100 {
+		us := 500.0 * math.Pow(1.15, float64(tenacity-10))
+		return time.Duration(us) * time.Microsecond
+	}
+	return time.Duration(math.MaxInt64)
+}
+
+// evictionPoolPopulate samples keys and merges them into the pool, which is
+// kept sorted by ascending idle score so the best candidate is at the end
+func (server *RedisServer) evictionPoolPopulate(policy int) {
+	samples := server.Config.MaxmemorySamples
+
+	consider := func(key string) {
+		obj, ok := server.Storage.Get(key)
+		if !ok {
+			return
+		}
+
+		var idle uint64
+		switch {
+		case policy&MAXMEMORY_FLAG_LRU != 0:
+			idle = server.estimateObjectIdleTime(obj)
+		case policy&MAXMEMORY_FLAG_LFU != 0:
+			idle = 255 - uint64(server.LFUDecrAndReturn(obj))
+		case policy == MAXMEMORY_VOLATILE_TTL:
+			when, _ := server.Expirations.Get(key)
+			idle = math.MaxUint64 - uint64(when.UnixMilli())
+		}
+
+		pool := server.evictionPool
+		for _, entry := range pool {
+			if entry.key == key {
+				return
+			}
+		}
+		if len(pool) == EVPOOL_SIZE && idle <= pool[0].idle {
+			return
+		}
+
+		i := 0
+		for i < len(pool) && pool[i].idle < idle {
+			i++
+		}
+
+		entry := evictionPoolEntry{idle: idle, key: key}
+		if len(pool) < EVPOOL_SIZE {
+			pool = append(pool, evictionPoolEntry{})
+			copy(pool[i+1:], pool[i:])
+			pool[i] = entry
+		} else {
+			// pool is full: drop the worst element on the left
+			copy(pool[:i-1], pool[1:i])
+			pool[i-1] = entry
+		}
+		server.evictionPool = pool
+	}
+
+	if policy&MAXMEMORY_FLAG_ALLKEYS != 0 {
+		server.Storage.Sample(samples, func(key string, _ *RedisObject) bool {
+			consider(key)
+			return true
+		})
+	} else {
+		server.Expirations.Sample(samples, func(key string, _ time.Time) bool {
+			consider(key)
+			return true
+		})
+	}
+}
+
+func (server *RedisServer) evictionPoolPopBest() (string, bool) {
+	for len(server.evictionPool) > 0 {
+		last := len(server.evictionPool) - 1
+		key := server.evictionPool[last].key
+		server.evictionPool = server.evictionPool[:last]
+
+		if _, ok := server.Storage.Get(key); ok {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+func (server *RedisServer) randomEvictionKey(policy int) (string, bool) {
+	if policy == MAXMEMORY_ALLKEYS_RANDOM {
+		return server.Storage.RandomKey()
+	}
+	return server.Expirations.RandomKey()
+}
+
+// performEvictions deletes keys according to maxmemory-policy until the used
+// memory is back under maxmemory. EVICT_RUNNING means the time budget ran out
+// and serverCron will carry on.
+func (server *RedisServer) performEvictions() int {
+	maxmemory := server.Config.Maxmemory
+	if maxmemory == 0 || server.getUsedMemory() <= maxmemory {
+		return EVICT_OK
+	}
+
+	// evictions would be propagated, they wait for the end of a pause
+	if server.clientPauseType != CLIENT_PAUSE_OFF {
+		return EVICT_OK
+	}
+
+	policy := server.Config.MaxmemoryPolicy
+	if policy == MAXMEMORY_NO_EVICTION {
+		return EVICT_FAIL
+	}
+
+	start := time.Now()
+	timeLimit := server.evictionTimeLimit()
+	keysFreed := 0
+	defer func() { server.latencyAddSampleIfNeeded("eviction-cycle", time.Since(start)) }()
+
+	for server.getUsedMemory() > maxmemory {
+		var bestKey string
+		var found bool
+
+		if policy&(MAXMEMORY_FLAG_LRU|MAXMEMORY_FLAG_LFU) != 0 || policy == MAXMEMORY_VOLATILE_TTL {
+			for !found {
+				if policy&MAXMEMORY_FLAG_ALLKEYS != 0 && server.Storage.Len() == 0 ||
+					policy&MAXMEMORY_FLAG_ALLKEYS == 0 && server.Expirations.Len() == 0 {
+					break
+				}
+				server.evictionPoolPopulate(policy)
+				bestKey, found = server.evictionPoolPopBest()
+			}
+		} else {
+			bestKey, found = server.randomEvictionKey(policy)
+		}
+
+		if !found {
+			return EVICT_FAIL
+		}
+
+		server.dbGenericDelete(bestKey, server.Config.LazyfreeLazyEviction)
+		server.notifyKeyspaceEvent(NOTIFY_EVICTED, "evicted", bestKey)
+		server.propagateDeletion(bestKey, server.Config.LazyfreeLazyEviction)
+		server.stat.EvictedKeys++
+		keysFreed++
+
+		if keysFreed%EVICTION_TIME_CHECK_INTERVAL == 0 && time.Since(start) > timeLimit {
+			return EVICT_RUNNING
+		}
+	}
+
+	return EVICT_OK
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ACTIVE_EXPIRE_CYCLE_SLOW = iota
+	ACTIVE_EXPIRE_CYCLE_FAST
+)
+
+const (
+	ACTIVE_EXPIRE_CYCLE_KEYS_PER_LOOP    = 20   // keys sampled per loop
+	ACTIVE_EXPIRE_CYCLE_FAST_DURATION    = 1000 // microseconds
+	ACTIVE_EXPIRE_CYCLE_SLOW_TIME_PERC   = 25   // max CPU percentage of the slow cycle
+	ACTIVE_EXPIRE_CYCLE_ACCEPTABLE_STALE = 10   // percent of stale keys we tolerate
+	CONFIG_DEFAULT_ACTIVE_EXPIRE_EFFORT  = 1
+	CONFIG_MAX_ACTIVE_EXPIRE_EFFORT      = 10
+	ACTIVE_EXPIRE_CYCLE_SLOW_ITERATIONS  = 16 // loops between time limit checks
+)
+
+type activeExpireState struct {
+	timelimitExit bool
+	lastFastCycle time.Time
+	statStalePerc float64
+
+	// DEBUG SET-ACTIVE-EXPIRE 0 leaves the keys to expire when accessed
+	disabled bool
+
+	// estimated from the TTLs of the keys sampled, for INFO keyspace
+	avgTTL time.Duration
+}
+
+// expireIfNeeded deletes the key if its TTL elapsed and reports whether it
+// is expired. A replica only reports it, the key stays until the DEL of its
+// master, and the commands of the master still see it.
+func (server *RedisServer) expireIfNeeded(key string) bool {
+	// nothing expires while loading, the replayed commands may still use the key
+	if server.loading {
+		return false
+	}
+
+	when, exists := server.Expirations.Get(key)
+	if !exists || !time.Now().After(when) {
+		return false
+	}
+
+	if server.Config.MasterHost != "" {
+		client := server.currentClient
+		return client == nil || client.Flags&CLIENT_MASTER == 0
+	}
+
+	server.deleteExpiredKey(key)
+	return true
+}
+
+func (server *RedisServer) deleteExpiredKey(key string) {
+	server.dbGenericDelete(key, server.Config.LazyfreeLazyExpire)
+	server.notifyKeyspaceEvent(NOTIFY_EXPIRED, "expired", key)
+	server.propagateDeletion(key, server.Config.LazyfreeLazyExpire)
+	server.stat.ExpiredKeys++
+}
+
+// activeExpireCycle samples keys with a TTL and reclaims the expired ones, in
+// the same spirit as Redis: keep sampling while a large share of the sample
+// is stale, but never run longer than the time budget of the cycle type.
+// The active-expire-effort setting trades CPU for memory.
+func (server *RedisServer) activeExpireCycle(cycleType int) {
+	effort := server.Config.ActiveExpireEffort - 1
+	keysPerLoop := ACTIVE_EXPIRE_CYCLE_KEYS_PER_LOOP + ACTIVE_EXPIRE_CYCLE_KEYS_PER_LOOP/4*effort
+	fastDuration := time.Duration(ACTIVE_EXPIRE_CYCLE_FAST_DURATION+ACTIVE_EXPIRE_CYCLE_FAST_DURATION/4*effort) * time.Microsecond
+	slowTimePerc := ACTIVE_EXPIRE_CYCLE_SLOW_TIME_PERC + 2*effort
+	acceptableStale := float64(ACTIVE_EXPIRE_CYCLE_ACCEPTABLE_STALE - effort)
+
+	// the deletions would be propagated, while a pause keeps the dataset as
+	// is. Replicas wait for the deletions of their master instead.
+	if server.clientPauseType != CLIENT_PAUSE_OFF || server.Config.MasterHost != "" || server.expire.disabled {
+		return
+	}
+
+	start := time.Now()
+
+	if cycleType == ACTIVE_EXPIRE_CYCLE_FAST {
+		// Only run a fast cycle if the last one hit its time limit or too
+		// many stale keys are left, and never twice within two durations.
+		if !server.expire.timelimitExit && server.expire.statStalePerc < acceptableStale {
+			return
+		}
+		if start.Sub(server.expire.lastFastCycle) < fastDuration*2 {
+			return
+		}
+		server.expire.lastFastCycle = start
+	}
+
+	timelimit := time.Second * time.Duration(slowTimePerc) / time.Duration(server.Config.Hz) / 100
+	if timelimit <= 0 {
+		timelimit = time.Microsecond
+	}
+	if cycleType == ACTIVE_EXPIRE_CYCLE_FAST {
+		timelimit = fastDuration
+	}
+
+	server.expire.timelimitExit = false
+	totalSampled, totalExpired := 0, 0
+	iteration := 0
+	ttlSum, ttlSamples := time.Duration(0), 0
+
+	for {
+		if server.Expirations.Len() == 0 {
+			break
+		}
+
+		iteration++
+		now := time.Now()
+		sampled, expired := 0, 0
+
+		server.Expirations.Sample(keysPerLoop, func(key string, when time.Time) bool {
+			sampled++
+			if now.After(when) {
+				server.deleteExpiredKey(key)
+				expired++
+			} else {
+				ttlSum += when.Sub(now)
+				ttlSamples++
+			}
+			return true
+		})
+
+		totalSampled += sampled
+		totalExpired += expired
+
+		if iteration%ACTIVE_EXPIRE_CYCLE_SLOW_ITERATIONS == 0 && time.Since(start) > timelimit {
+			server.expire.timelimitExit = true
+			server.stat.ExpiredTimeCapReachedCount++
+			break
+		}
+
+		// stop once the share of stale keys in the sample is acceptable
+		if sampled == 0 || float64(expired)*100/float64(sampled) <= acceptableStale {
+			break
+		}
+	}
+
+	// like the stale keys, the average moves slowly towards the samples
+	if ttlSamples > 0 {
+		avg := ttlSum / time.Duration(ttlSamples)
+		if server.expire.avgTTL == 0 {
+			server.expire.avgTTL = avg
+		} else {
+			server.expire.avgTTL = server.expire.avgTTL/50*49 + avg/50
+		}
+	}
+	if totalSampled > 0 {
+		current := float64(totalExpired) / float64(totalSampled)
+		server.expire.statStalePerc = current*0.05 + server.expire.statStalePerc*0.95
+	}
+	server.latencyAddSampleIfNeeded("expire-cycle", time.Since(start))
+}
+
+// expireGenericCommand implements EXPIRE, PEXPIRE, EXPIREAT and PEXPIREAT.
+// The time is relative to basetime unless it is zero, in seconds or in
+// milliseconds. All of them are propagated as PEXPIREAT, so the key expires
+// at the same time wherever the command is applied.
+func (server *RedisServer) expireGenericCommand(cmd string, args []interface{}, basetime time.Time, unit time.Duration) []byte {
+	if len(args) != 2 {
+		return addReplyErrorArity()
+	}
+
+	key, ok := args[0].(string)
+	if !ok {
+		return []byte("-ERR Invalid key type\r\n")
+	}
+	arg, _ := args[1].(string)
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return []byte("-ERR value is not an integer or out of range\r\n")
+	}
+
+	ms := n * int64(unit/time.Millisecond)
+	if n != 0 && ms/n != int64(unit/time.Millisecond) {
+		return []byte(fmt.Sprintf("-ERR invalid expire time in '%s' command\r\n", strings.ToLower(cmd)))
+	}
+	if !basetime.IsZero() {
+		ms += basetime.UnixMilli()
+	}
+
+	if server.lookupKeyWithFlags(key, LOOKUP_NOTOUCH|LOOKUP_WRITE) == nil {
+		return addReplyLongLong(0)
+	}
+
+	// an expire in the past deletes the key, except while loading where
+	// the following commands may still need it, and on replicas that wait
+	// for the deletion of their master
+	when := time.UnixMilli(ms)
+	if !server.loading && server.Config.MasterHost == "" && !when.After(time.Now()) {
+		lazy := server.Config.LazyfreeLazyExpire
+		server.dbGenericDelete(key, lazy)
+		server.notifyKeyspaceEvent(NOTIFY_GENERIC, "del", key)
+		if lazy {
+			server.rewriteCommandVector("UNLINK", key)
+		} else {
+			server.rewriteCommandVector("DEL", key)
+		}
+		server.Dirty++
+		return addReplyLongLong(1)
+	}
+
+	server.setExpire(key, when)
+	server.notifyKeyspaceEvent(NOTIFY_GENERIC, "expire", key)
+	server.rewriteCommandVector("PEXPIREAT", key, strconv.FormatInt(ms, 10))
+	server.Dirty++
+	return addReplyLongLong(1)
+}
+
+func (server *RedisServer) handleExpireCommand(cmd string, args []interface{}) []byte {
+	return server.expireGenericCommand(cmd, args, time.Now(), time.Second)
+}
+
+func (server *RedisServer) handlePexpireCommand(cmd string, args []interface{}) []byte {
+	return server.expireGenericCommand(cmd, args, time.Now(), time.Millisecond)
+}
+
+func (server *RedisServer) handleExpireatCommand(cmd string, args []interface{}) []byte {
+	return server.expireGenericCommand(cmd, args, time.Time{}, time.Second)
+}
+
+func (server *RedisServer) handlePexpireatCommand(cmd string, args []interface{}) []byte {
+	return server.expireGenericCommand(cmd, args, time.Time{}, time.Millisecond)
+}
@@ -0,0 +1,688 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FUNCTION LOAD gives up on the code of a library running longer than this,
+// it should only register functions
+const functionLoadTimeout = 500 * time.Millisecond
+
+// functionsState holds the libraries loaded with FUNCTION LOAD, and the Lua
+// interpreter their functions run in. The functions are named across all the
+// libraries, case insensitively.
+type functionsState struct {
+	L      *luaState
+	client *RedisClient
+
+	libraries map[string]*functionLibInfo
+	functions map[string]*functionInfo
+
+	// the globals the code of a library runs with, its redis lib can only
+	// register functions
+	loadGlobals *luaTable
+
+	// the library whose code is running, the functions it registers go in it
+	loading   *functionLibInfo
+	loadStart time.Time
+
+	// the arguments of the FCALL running, for FUNCTION STATS
+	runningArgs []interface{}
+}
+
+type functionLibInfo struct {
+	name      string
+	code      string
+	functions map[string]*functionInfo
+}
+
+type functionInfo struct {
+	name        string
+	library     *functionLibInfo
+	fn          luaValue
+	description string
+	flags       int
+}
+
+// functionsInit creates the interpreter of the functions, with no library
+func (server *RedisServer) functionsInit() {
+	L := server.luaCreateState()
+	server.functions.L = L
+	server.functions.client = server.createScriptClient()
+	server.functions.libraries = make(map[string]*functionLibInfo)
+	server.functions.functions = make(map[string]*functionInfo)
+
+	// the code of a library sees the globals of its functions, but a redis
+	// lib that registers them rather than running commands
+	load := newLuaTable(0, 64)
+	for key, value, _ := L.globals.next(nil); key != nil; key, value, _ = L.globals.next(key) {
+		load.set(key, value)
+	}
+	load.set("_G", load)
+	lib := newLuaTable(0, 8)
+	L.register(lib, "register_function", server.luaRegisterFunction)
+	luaRegisterLogFunction(L, lib)
+	luaRegisterVersion(lib)
+	load.set("redis", lib)
+
+	luaSetGlobalsProtection(L, load)
+	luaSetGlobalsProtection(L, L.globals)
+	server.functions.loadGlobals = load
+
+	L.hook = server.luaFunctionsHook
+}
+
+// luaFunctionsHook stops the code of a library that runs for too long, the
+// functions are stopped like the scripts
+func (server *RedisServer) luaFunctionsHook(L *luaState) {
+	if server.functions.loading == nil {
+		server.luaMaskCountHook(L)
+		return
+	}
+	if time.Since(server.functions.loadStart) > functionLoadTimeout {
+		L.steps = luaHookEvery
+		L.raise(luaErrorTable("FUNCTION LOAD timeout"))
+	}
+}
+
+// luaRegisterFunction is redis.register_function, for the code of a library:
+//
+//	redis.register_function(name, callback)
+//	redis.register_function{function_name=name, callback=callback,
+//	    flags={...}, description=description}
+func (server *RedisServer) luaRegisterFunction(L *luaState, args []luaValue) []luaValue {
+	var name string
+	var callback luaValue
+	var description string
+	flags := 0
+
+	switch len(args) {
+	case 1:
+		t, ok := args[0].(*luaTable)
+		if !ok {
+			L.raise(luaErrorTable("calling redis.register_function with a single argument is only applicable to Lua table (representing named arguments)."))
+		}
+		hasName := false
+		for key, value, _ := t.next(nil); key != nil; key, value, _ = t.next(key) {
+			field, ok := key.(string)
+			if !ok {
+				L.raise(luaErrorTable("named argument key given to redis.register_function is not a string"))
+			}
+			switch field {
+			case "function_name":
+				if name, ok = value.(string); !ok {
+					L.raise(luaErrorTable("function_name argument given to redis.register_function must be a string"))
+				}
+				hasName = true
+			case "description":
+				if description, ok = value.(string); !ok {
+					L.raise(luaErrorTable("description argument given to redis.register_function must be a string"))
+				}
+			case "callback":
+				if luaTypeName(value) != "function" {
+					L.raise(luaErrorTable("callback argument given to redis.register_function must be a function"))
+				}
+				callback = value
+			case "flags":
+				t, ok := value.(*luaTable)
+				if !ok {
+					L.raise(luaErrorTable("flags argument to redis.register_function must be a table representing function flags"))
+				}
+				flags = luaRegisterFunctionReadFlags(L, t)
+			default:
+				L.raise(luaErrorTable("unknown argument given to redis.register_function"))
+			}
+		}
+		if !hasName {
+			L.raise(luaErrorTable("redis.register_function must get a function name argument"))
+		}
+		if callback == nil {
+			L.raise(luaErrorTable("redis.register_function must get a callback argument"))
+		}
+	case 2:
+		var ok bool
+		if name, ok = args[0].(string); !ok {
+			L.raise(luaErrorTable("first argument to redis.register_function must be a string"))
+		}
+		if luaTypeName(args[1]) != "function" {
+			L.raise(luaErrorTable("second argument to redis.register_function must be a function"))
+		}
+		callback = args[1]
+	default:
+		L.raise(luaErrorTable("wrong number of arguments to redis.register_function"))
+	}
+
+	if !functionsVerifyName(name) {
+		L.raise(luaErrorTable("Function names can only contain letters, numbers, or underscores(_) and must be at least one character long"))
+	}
+	lib := server.functions.loading
+	if _, ok := lib.functions[strings.ToLower(name)]; ok {
+		L.raise(luaErrorTable("Function already exists in the library"))
+	}
+	lib.functions[strings.ToLower(name)] = &functionInfo{
+		name:        name,
+		library:     lib,
+		fn:          callback,
+		description: description,
+		flags:       flags,
+	}
+	return nil
+}
+
+// luaRegisterFunctionReadFlags reads the flags of a function, an array of
+// their names
+func luaRegisterFunctionReadFlags(L *luaState, t *luaTable) int {
+	flags := 0
+	for i := 1; t.getInt(i) != nil; i++ {
+		name, _ := t.getInt(i).(string)
+		flag := 0
+		for _, def := range scriptFlagsDef {
+			if def.name == name {
+				flag = def.flag
+			}
+		}
+		if flag == 0 {
+			L.raise(luaErrorTable("unknown flag given"))
+		}
+		flags |= flag
+	}
+	return flags
+}
+
+// functionsVerifyName tells whether the name of a library or a function is
+// made of letters, numbers and underscores
+func functionsVerifyName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// functionExtractLibMetaData parses the shebang starting the code of a
+// library, like #!lua name=mylib, returning its engine and name
+func functionExtractLibMetaData(code string) (engine, name string, err error) {
+	if !strings.HasPrefix(code, "#!") {
+		return "", "", errors.New("Missing library metadata")
+	}
+	end := strings.IndexByte(code, '\n')
+	if end < 0 {
+		end = len(code)
+	}
+	parts := strings.Fields(code[2:end])
+	if len(parts) == 0 {
+		return "", "", errors.New("Invalid library metadata")
+	}
+	engine = parts[0]
+	for _, part := range parts[1:] {
+		if !strings.HasPrefix(part, "name=") {
+			return "", "", fmt.Errorf("Invalid metadata value given: %s", part)
+		}
+		if name != "" {
+			return "", "", errors.New("Invalid metadata value, name argument was given multiple times")
+		}
+		name = part[len("name="):]
+	}
+	if name == "" {
+		return "", "", errors.New("Library name was not given")
+	}
+	return engine, name, nil
+}
+
+// functionsCreateWithLibraryCtx loads the library of the code, replacing the
+// one of the same name when replace is set. Nothing changes on errors.
+func (server *RedisServer) functionsCreateWithLibraryCtx(code string, replace bool) (string, error) {
+	engine, name, err := functionExtractLibMetaData(code)
+	if err != nil {
+		return "", err
+	}
+	if !strings.EqualFold(engine, "lua") {
+		return "", fmt.Errorf("Engine '%s' not found", engine)
+	}
+	if !functionsVerifyName(name) {
+		return "", errors.New("Library names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	}
+	old := server.functions.libraries[name]
+	if old != nil && !replace {
+		return "", fmt.Errorf("Library '%s' already exists", name)
+	}
+
+	lib := &functionLibInfo{
+		name:      name,
+		code:      code,
+		functions: make(map[string]*functionInfo),
+	}
+	if err := server.luaEngineCreate(lib); err != nil {
+		return "", err
+	}
+	if len(lib.functions) == 0 {
+		return "", errors.New("No functions registered")
+	}
+	for key, fi := range lib.functions {
+		if other, ok := server.functions.functions[key]; ok && other.library != old {
+			return "", fmt.Errorf("Function %s already exists", fi.name)
+		}
+	}
+
+	if old != nil {
+		server.functionsLibDelete(old)
+	}
+	server.functions.libraries[name] = lib
+	for key, fi := range lib.functions {
+		server.functions.functions[key] = fi
+	}
+	return name, nil
+}
+
+// luaEngineCreate runs the code of the library, which registers its
+// functions. The shebang is left out but still counts as the first line.
+func (server *RedisServer) luaEngineCreate(lib *functionLibInfo) error {
+	L := server.functions.L
+	body := ""
+	if end := strings.IndexByte(lib.code, '\n'); end >= 0 {
+		body = lib.code[end:]
+	}
+	fn, err := L.load(body, "user_function")
+	if err != nil {
+		return fmt.Errorf("Error compiling function: %s", err)
+	}
+
+	globals := L.globals
+	L.globals = server.functions.loadGlobals
+	server.functions.loading = lib
+	server.functions.loadStart = time.Now()
+	_, lerr := L.pcall(fn, nil)
+	server.functions.loading = nil
+	L.globals = globals
+
+	if lerr != nil {
+		msg := lerr.Error()
+		if t, ok := lerr.value.(*luaTable); ok {
+			msg, _ = luaToString(t.getStr("err"))
+		}
+		return fmt.Errorf("Error registering functions: %s", msg)
+	}
+	return nil
+}
+
+func (server *RedisServer) functionsLibDelete(lib *functionLibInfo) {
+	for key := range lib.functions {
+		delete(server.functions.functions, key)
+	}
+	delete(server.functions.libraries, lib.name)
+}
+
+// functionsLibraryNames are the names of the libraries, sorted so that they
+// are listed and saved in the same order
+func (server *RedisServer) functionsLibraryNames() []string {
+	names := make([]string, 0, len(server.functions.libraries))
+	for name := range server.functions.libraries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// functionsLibraryCodes is the code of each library, what the RDB keeps of
+// the functions
+func (server *RedisServer) functionsLibraryCodes() []string {
+	codes := make([]string, 0, len(server.functions.libraries))
+	for _, name := range server.functionsLibraryNames() {
+		codes = append(codes, server.functions.libraries[name].code)
+	}
+	return codes
+}
+
+// handleFcallCommand runs a function: FCALL function numkeys [key ...] [arg ...]
+func (server *RedisServer) handleFcallCommand(cmd string, args []interface{}) []byte {
+	return server.fcallCommandGeneric(args, false)
+}
+
+// handleFcallRoCommand is FCALL for the functions flagged no-writes, which
+// can run on read-only replicas
+func (server *RedisServer) handleFcallRoCommand(cmd string, args []interface{}) []byte {
+	return server.fcallCommandGeneric(args, true)
+}
+
+func (server *RedisServer) fcallCommandGeneric(args []interface{}, readonly bool) []byte {
+	name, _ := args[0].(string)
+	fi := server.functions.functions[strings.ToLower(name)]
+	if fi == nil {
+		return []byte("-ERR Function not found\r\n")
+	}
+
+	numkeysArg, _ := args[1].(string)
+	numkeys, err := strconv.ParseInt(numkeysArg, 10, 64)
+	if err != nil {
+		return []byte("-ERR Bad number of keys provided\r\n")
+	}
+	if numkeys > int64(len(args)-2) {
+		return []byte("-ERR Number of keys can't be greater than number of args\r\n")
+	} else if numkeys < 0 {
+		return []byte("-ERR Number of keys can't be negative\r\n")
+	}
+
+	flags := 0
+	if fi.flags&SCRIPT_FLAG_NO_WRITES != 0 {
+		flags |= SCRIPT_READ_ONLY
+	} else if readonly {
+		return []byte("-ERR Can not execute a script with write flag using *_ro command.\r\n")
+	}
+
+	keys := luaStringArray(args[2 : 2+numkeys])
+	argv := luaStringArray(args[2+numkeys:])
+	server.functions.runningArgs = args
+	reply := server.luaCallFunction(server.functions.L, fi.fn, fi.name, []luaValue{keys, argv}, server.functions.client, flags)
+	server.functions.runningArgs = nil
+
+	// the commands the function ran were propagated instead
+	server.preventCommandPropagation()
+	return reply
+}
+
+// handleFunctionCommand manages the libraries of functions
+func (server *RedisServer) handleFunctionCommand(cmd string, args []interface{}) []byte {
+	subcommand, _ := args[0].(string)
+	subcommand = strings.ToUpper(subcommand)
+
+	// FUNCTION is allowed while a script is busy, to look at it or kill it
+	if server.scriptIsTimedout() && subcommand != "KILL" && subcommand != "STATS" {
+		return server.scriptBusyError()
+	}
+
+	switch {
+	case subcommand == "HELP" && len(args) == 1:
+		return addReplyHelp("FUNCTION", []string{
+			"LOAD [REPLACE] <FUNCTION CODE>",
+			"    Create a new library with the given library name and code.",
+			"DELETE <LIBRARY NAME>",
+			"    Delete the given library.",
+			"LIST [LIBRARYNAME PATTERN] [WITHCODE]",
+			"    Return general information on all the libraries:",
+			"    * Library name",
+			"    * The engine used to run the Library",
+			"    * Library description",
+			"    * Functions list",
+			"    * Library code (if WITHCODE is given)",
+			"    It also possible to get only function that matches a pattern using LIBRARYNAME argument.",
+			"STATS",
+			"    Return information about the current function running:",
+			"    * Function name",
+			"    * Command used to run the function",
+			"    * Duration in MS that the function is running",
+			"    If no function is running, return nil",
+			"    In addition, returns a list of available engines.",
+			"KILL",
+			"    Kill the current running function.",
+			"FLUSH [ASYNC|SYNC]",
+			"    Delete all the libraries.",
+			"    When called without the optional mode argument, the behavior is determined by the",
+			"    lazyfree-lazy-user-flush configuration directive. Valid modes are:",
+			"    * ASYNC: Asynchronously flush the libraries.",
+			"    * SYNC: Synchronously flush the libraries.",
+			"DUMP",
+			"    Return a serialized payload representing the current libraries, can be restored using FUNCTION RESTORE command",
+			"RESTORE <PAYLOAD> [FLUSH|APPEND|REPLACE]",
+			"    Restore the libraries represented by the given payload, it is possible to give a restore policy to",
+			"    control how to handle existing libraries (default APPEND):",
+			"    * FLUSH: delete all existing libraries.",
+			"    * APPEND: appends the restored libraries to the existing libraries. On collision, abort.",
+			"    * REPLACE: appends the restored libraries to the existing libraries, On collision, replace the old",
+			"      libraries with the new libraries (notice that even on this option there is a chance of failure",
+			"      in case of functions name collision with another library).",
+		})
+	case subcommand == "LOAD" && (len(args) == 2 || len(args) == 3):
+		replace := false
+		if len(args) == 3 {
+			option, _ := args[1].(string)
+			if !strings.EqualFold(option, "REPLACE") {
+				return []byte(fmt.Sprintf("-ERR Unknown option given: %s\r\n", option))
+			}
+			replace = true
+		}
+		code, _ := args[len(args)-1].(string)
+		name, err := server.functionsCreateWithLibraryCtx(code, replace)
+		if err != nil {
+			return []byte("-ERR " + luaSanitizeReplyLine(err.Error()) + "\r\n")
+		}
+		server.Dirty++
+		return addReplyBulk([]interface{}{name})
+	case subcommand == "DELETE" && len(args) == 2:
+		name, _ := args[1].(string)
+		lib := server.functions.libraries[name]
+		if lib == nil {
+			return []byte("-ERR Library not found\r\n")
+		}
+		server.functionsLibDelete(lib)
+		server.Dirty++
+		return []byte("+OK\r\n")
+	case subcommand == "LIST":
+		return server.functionListCommand(args[1:])
+	case subcommand == "STATS" && len(args) == 1:
+		return server.functionStatsCommand()
+	case subcommand == "KILL" && len(args) == 1:
+		return server.scriptKill(false)
+	case subcommand == "FLUSH" && len(args) <= 2:
+		if len(args) == 2 {
+			mode, _ := args[1].(string)
+			if mode = strings.ToUpper(mode); mode != "SYNC" && mode != "ASYNC" {
+				return []byte("-ERR FUNCTION FLUSH only supports SYNC|ASYNC option\r\n")
+			}
+		}
+		server.functionsInit()
+		server.Dirty++
+		return []byte("+OK\r\n")
+	case subcommand == "DUMP" && len(args) == 1:
+		return addReplyBulk([]interface{}{string(server.functionsDump())})
+	case subcommand == "RESTORE" && (len(args) == 2 || len(args) == 3):
+		return server.functionRestoreCommand(args[1:])
+	default:
+		return addReplySubcommandSyntaxError("FUNCTION", args[0].(string))
+	}
+}
+
+// functionListCommand is FUNCTION LIST [LIBRARYNAME pattern] [WITHCODE]
+func (server *RedisServer) functionListCommand(args []interface{}) []byte {
+	client := server.currentClient
+	withCode := false
+	pattern := ""
+	for i := 0; i < len(args); i++ {
+		arg, _ := args[i].(string)
+		switch {
+		case !withCode && strings.EqualFold(arg, "WITHCODE"):
+			withCode = true
+		case pattern == "" && strings.EqualFold(arg, "LIBRARYNAME"):
+			if i == len(args)-1 {
+				return []byte("-ERR library name argument was not given\r\n")
+			}
+			i++
+			pattern, _ = args[i].(string)
+		default:
+			return []byte(fmt.Sprintf("-ERR Unknown argument %s\r\n", arg))
+		}
+	}
+
+	var reply bytes.Buffer
+	n := 0
+	for _, name := range server.functionsLibraryNames() {
+		if pattern != "" && !stringMatch(pattern, name, true) {
+			continue
+		}
+		lib := server.functions.libraries[name]
+		n++
+
+		fields := 3
+		if withCode {
+			fields++
+		}
+		reply.Write(client.addReplyMapLen(fields))
+		writeReplyValue(&reply, "library_name")
+		writeReplyValue(&reply, lib.name)
+		writeReplyValue(&reply, "engine")
+		writeReplyValue(&reply, "LUA")
+
+		writeReplyValue(&reply, "functions")
+		keys := make([]string, 0, len(lib.functions))
+		for key := range lib.functions {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		reply.Write(addReplyArrayLen(len(keys)))
+		for _, key := range keys {
+			fi := lib.functions[key]
+			reply.Write(client.addReplyMapLen(3))
+			writeReplyValue(&reply, "name")
+			writeReplyValue(&reply, fi.name)
+			writeReplyValue(&reply, "description")
+			if fi.description != "" {
+				writeReplyValue(&reply, fi.description)
+			} else {
+				reply.Write(client.addReplyNull())
+			}
+			writeReplyValue(&reply, "flags")
+			flags := []string{}
+			for _, def := range scriptFlagsDef {
+				if fi.flags&def.flag != 0 {
+					flags = append(flags, def.name)
+				}
+			}
+			reply.Write(client.addReplySetLen(len(flags)))
+			for _, flag := range flags {
+				writeReplyValue(&reply, flag)
+			}
+		}
+
+		if withCode {
+			writeReplyValue(&reply, "library_code")
+			writeReplyValue(&reply, lib.code)
+		}
+	}
+	return append(addReplyArrayLen(n), reply.Bytes()...)
+}
+
+// functionStatsCommand tells about the function running, and the engines
+func (server *RedisServer) functionStatsCommand() []byte {
+	client := server.currentClient
+	var reply bytes.Buffer
+	reply.Write(client.addReplyMapLen(2))
+
+	writeReplyValue(&reply, "running_script")
+	if run := server.script; run == nil || server.scriptIsEval() {
+		reply.Write(client.addReplyNull())
+	} else {
+		reply.Write(client.addReplyMapLen(3))
+		writeReplyValue(&reply, "name")
+		writeReplyValue(&reply, run.funcname)
+		writeReplyValue(&reply, "command")
+		writeReplyValue(&reply, append([]interface{}{"fcall"}, server.functions.runningArgs...))
+		writeReplyValue(&reply, "duration_ms")
+		writeReplyValue(&reply, time.Since(run.start).Milliseconds())
+	}
+
+	writeReplyValue(&reply, "engines")
+	reply.Write(client.addReplyMapLen(1))
+	writeReplyValue(&reply, "LUA")
+	reply.Write(client.addReplyMapLen(2))
+	writeReplyValue(&reply, "libraries_count")
+	writeReplyValue(&reply, len(server.functions.libraries))
+	writeReplyValue(&reply, "functions_count")
+	writeReplyValue(&reply, len(server.functions.functions))
+	return reply.Bytes()
+}
+
+// functionsDump serializes the libraries like they are saved in the RDB,
+// followed by the RDB version and a CRC64, like the payload of DUMP
+func (server *RedisServer) functionsDump() []byte {
+	var payload bytes.Buffer
+	rdb := &rdbWriter{w: bufio.NewWriter(&payload), compression: server.Config.RdbCompression}
+	for _, code := range server.functionsLibraryCodes() {
+		rdb.writeByte(RDB_OPCODE_FUNCTION2)
+		rdb.saveString(code)
+	}
+	rdb.w.Flush()
+
+	buf := make([]byte, 2)
+	binary.LittleEndian.PutUint16(buf, RDB_VERSION)
+	payload.Write(buf)
+	buf = make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, crc64Update(0, payload.Bytes()))
+	payload.Write(buf)
+	return payload.Bytes()
+}
+
+// functionRestoreCommand is FUNCTION RESTORE payload [FLUSH|APPEND|REPLACE].
+// The libraries of the payload are all loaded, or none.
+func (server *RedisServer) functionRestoreCommand(args []interface{}) []byte {
+	policy := "APPEND"
+	if len(args) == 2 {
+		policy, _ = args[1].(string)
+		policy = strings.ToUpper(policy)
+		if policy != "FLUSH" && policy != "APPEND" && policy != "REPLACE" {
+			return []byte("-ERR Wrong restore policy given, value should be either FLUSH, APPEND or REPLACE.\r\n")
+		}
+	}
+
+	data, _ := args[0].(string)
+	if len(data) < 10 {
+		return []byte("-ERR payload version or checksum are wrong\r\n")
+	}
+	footer := []byte(data[len(data)-10:])
+	version := binary.LittleEndian.Uint16(footer[:2])
+	if version > RDB_VERSION || binary.LittleEndian.Uint64(footer[2:]) != crc64Update(0, []byte(data[:len(data)-8])) {
+		return []byte("-ERR payload version or checksum are wrong\r\n")
+	}
+
+	rdb := &rdbReader{r: bufio.NewReader(strings.NewReader(data[:len(data)-10]))}
+	var codes []string
+	for {
+		opcode, err := rdb.readByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return []byte("-ERR payload version or checksum are wrong\r\n")
+		}
+		if opcode != RDB_OPCODE_FUNCTION2 {
+			return []byte("-ERR given type is not a function\r\n")
+		}
+		code, err := rdb.loadString()
+		if err != nil {
+			return []byte("-ERR payload version or checksum are wrong\r\n")
+		}
+		codes = append(codes, code)
+	}
+
+	// the libraries are loaded over a copy, put back on errors
+	libraries, functions := server.functions.libraries, server.functions.functions
+	server.functions.libraries = make(map[string]*functionLibInfo, len(libraries))
+	server.functions.functions = make(map[string]*functionInfo, len(functions))
+	if policy != "FLUSH" {
+		for name, lib := range libraries {
+			server.functions.libraries[name] = lib
+		}
+		for name, fi := range functions {
+			server.functions.functions[name] = fi
+		}
+	}
+	for _, code := range codes {
+		if _, err := server.functionsCreateWithLibraryCtx(code, policy == "REPLACE"); err != nil {
+			server.functions.libraries, server.functions.functions = libraries, functions
+			return []byte("-ERR " + luaSanitizeReplyLine(err.Error()) + "\r\n")
+		}
+	}
+	server.Dirty++
+	return []byte("+OK\r\n")
+}
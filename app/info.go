@@ -0,0 +1,464 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Flags of the INFO sections
+const (
+	INFO_SECTION_DEFAULT  = 1 << iota // in the reply without arguments
+	INFO_SECTION_SERVER               // shown by a server
+	INFO_SECTION_SENTINEL             // shown by a sentinel
+)
+
+// infoSection renders one "# Name" block of the INFO reply
+type infoSection struct {
+	name     string
+	flags    int
+	generate func(server *RedisServer, b *strings.Builder)
+}
+
+var infoSections = []infoSection{
+	{"server", INFO_SECTION_DEFAULT | INFO_SECTION_SERVER | INFO_SECTION_SENTINEL, (*RedisServer).genInfoServer},
+	{"clients", INFO_SECTION_DEFAULT | INFO_SECTION_SERVER | INFO_SECTION_SENTINEL, (*RedisServer).genInfoClients},
+	{"memory", INFO_SECTION_DEFAULT | INFO_SECTION_SERVER, (*RedisServer).genInfoMemory},
+	{"persistence", INFO_SECTION_DEFAULT | INFO_SECTION_SERVER, (*RedisServer).genInfoPersistence},
+	{"stats", INFO_SECTION_DEFAULT | INFO_SECTION_SERVER | INFO_SECTION_SENTINEL, (*RedisServer).genInfoStats},
+	{"replication", INFO_SECTION_DEFAULT | INFO_SECTION_SERVER, (*RedisServer).genInfoReplication},
+	{"cpu", INFO_SECTION_DEFAULT | INFO_SECTION_SERVER | INFO_SECTION_SENTINEL, (*RedisServer).genInfoCpu},
+	{"commandstats", INFO_SECTION_SERVER | INFO_SECTION_SENTINEL, (*RedisServer).genInfoCommandStats},
+	{"errorstats", INFO_SECTION_DEFAULT | INFO_SECTION_SERVER | INFO_SECTION_SENTINEL, (*RedisServer).genInfoErrorStats},
+	{"latencystats", INFO_SECTION_SERVER | INFO_SECTION_SENTINEL, (*RedisServer).genInfoLatencyStats},
+	{"cluster", INFO_SECTION_DEFAULT | INFO_SECTION_SERVER, (*RedisServer).genInfoCluster},
+	{"sentinel", INFO_SECTION_DEFAULT | INFO_SECTION_SENTINEL, (*RedisServer).genInfoSentinel},
+	{"keyspace", INFO_SECTION_DEFAULT | INFO_SECTION_SERVER, (*RedisServer).genInfoKeyspace},
+}
+
+// genRedisInfoString builds the INFO reply for the requested sections.
+// Without arguments, or with "default", the default sections are included,
+// "all" and "everything" include all of them.
+func (server *RedisServer) genRedisInfoString(requested []string) string {
+	wanted := map[string]bool{}
+	defaults, all := len(requested) == 0, false
+	for _, name := range requested {
+		name = strings.ToLower(name)
+		switch name {
+		case "default":
+			defaults = true
+		case "all", "everything":
+			all = true
+		}
+		wanted[name] = true
+	}
+
+	mode := INFO_SECTION_SERVER
+	if server.sentinel != nil {
+		mode = INFO_SECTION_SENTINEL
+	}
+
+	var b strings.Builder
+	for _, section := range infoSections {
+		if section.flags&mode == 0 {
+			continue
+		}
+		if !all && !wanted[section.name] && !(defaults && section.flags&INFO_SECTION_DEFAULT != 0) {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		fmt.Fprintf(&b, "# %s\r\n", strings.ToUpper(section.name[:1])+section.name[1:])
+		section.generate(server, &b)
+	}
+	return b.String()
+}
+
+func (server *RedisServer) genInfoServer(b *strings.Builder) {
+	mode := "standalone"
+	if server.cluster != nil {
+		mode = "cluster"
+	} else if server.sentinel != nil {
+		mode = "sentinel"
+	}
+	executable, _ := os.Executable()
+	uptime := int64(server.UnixTime.Sub(server.startTime).Seconds())
+
+	fmt.Fprintf(b, "redis_version:%s\r\n", REDIS_VERSION)
+	fmt.Fprintf(b, "redis_git_sha1:%s\r\n", "00000000")
+	fmt.Fprintf(b, "redis_git_dirty:%d\r\n", 0)
+	fmt.Fprintf(b, "redis_mode:%s\r\n", mode)
+	fmt.Fprintf(b, "os:%s %s\r\n", runtime.GOOS, runtime.GOARCH)
+	fmt.Fprintf(b, "arch_bits:%d\r\n", strconv.IntSize)
+	fmt.Fprintf(b, "go_version:%s\r\n", runtime.Version())
+	fmt.Fprintf(b, "process_id:%d\r\n", os.Getpid())
+	fmt.Fprintf(b, "run_id:%s\r\n", server.runid)
+	fmt.Fprintf(b, "tcp_port:%d\r\n", server.Config.Port)
+	fmt.Fprintf(b, "server_time_usec:%d\r\n", server.UnixTime.UnixMicro())
+	fmt.Fprintf(b, "uptime_in_seconds:%d\r\n", uptime)
+	fmt.Fprintf(b, "uptime_in_days:%d\r\n", uptime/(3600*24))
+	fmt.Fprintf(b, "hz:%d\r\n", server.Config.Hz)
+	fmt.Fprintf(b, "configured_hz:%d\r\n", server.Config.Hz)
+	fmt.Fprintf(b, "lru_clock:%d\r\n", server.LRUClock)
+	fmt.Fprintf(b, "executable:%s\r\n", executable)
+	fmt.Fprintf(b, "config_file:%s\r\n", server.Config.ConfigFile)
+	// io-threads changes nothing, see ServerConfig.IoThreads
+	fmt.Fprintf(b, "io_threads_active:0\r\n")
+}
+
+func (server *RedisServer) genInfoClients(b *strings.Builder) {
+	connected, maxOutput := 0, int64(0)
+	server.clientsMu.Lock()
+	for _, client := range server.clients {
+		client.mu.Lock()
+		if client.getClientType() != CLIENT_TYPE_REPLICA {
+			connected++
+		}
+		if client.outputBytes > maxOutput {
+			maxOutput = client.outputBytes
+		}
+		client.mu.Unlock()
+	}
+	server.clientsMu.Unlock()
+
+	fmt.Fprintf(b, "connected_clients:%d\r\n", connected)
+	fmt.Fprintf(b, "client_recent_max_output_buffer:%d\r\n", maxOutput)
+	fmt.Fprintf(b, "blocked_clients:%d\r\n", len(server.blockedClients)-server.blockedClientsByType[BLOCKED_POSTPONE])
+	fmt.Fprintf(b, "pubsub_clients:%d\r\n", len(server.pubsub.clients))
+	fmt.Fprintf(b, "watching_clients:%d\r\n", len(server.watchingClients))
+	fmt.Fprintf(b, "total_watched_keys:%d\r\n", len(server.watchedKeys))
+	// no command blocks on keys yet
+	fmt.Fprintf(b, "total_blocking_keys:0\r\n")
+	fmt.Fprintf(b, "tracking_clients:%d\r\n", len(server.trackingClients))
+}
+
+func (server *RedisServer) genInfoMemory(b *strings.Builder) {
+	mh := server.getMemoryOverheadData()
+	peakPerc := float64(0)
+	if mh.peakAllocated > 0 {
+		peakPerc = float64(mh.totalAllocated) * 100 / float64(mh.peakAllocated)
+	}
+	datasetPerc := float64(0)
+	if mh.totalAllocated > 0 {
+		datasetPerc = float64(mh.datasetBytes) * 100 / float64(mh.totalAllocated)
+	}
+	fragmentation := float64(0)
+	if mh.totalAllocated > 0 {
+		fragmentation = float64(mh.allocatorSys) / float64(mh.totalAllocated)
+	}
+
+	fmt.Fprintf(b, "used_memory:%d\r\n", mh.totalAllocated)
+	fmt.Fprintf(b, "used_memory_human:%s\r\n", bytesToHuman(mh.totalAllocated))
+	fmt.Fprintf(b, "used_memory_rss:%d\r\n", mh.allocatorSys)
+	fmt.Fprintf(b, "used_memory_rss_human:%s\r\n", bytesToHuman(mh.allocatorSys))
+	fmt.Fprintf(b, "used_memory_peak:%d\r\n", mh.peakAllocated)
+	fmt.Fprintf(b, "used_memory_peak_human:%s\r\n", bytesToHuman(mh.peakAllocated))
+	fmt.Fprintf(b, "used_memory_peak_perc:%.2f%%\r\n", peakPerc)
+	fmt.Fprintf(b, "used_memory_overhead:%d\r\n", mh.overheadTotal)
+	fmt.Fprintf(b, "used_memory_dataset:%d\r\n", mh.datasetBytes)
+	fmt.Fprintf(b, "used_memory_dataset_perc:%.2f%%\r\n", datasetPerc)
+	fmt.Fprintf(b, "allocator_allocated:%d\r\n", mh.allocatorHeap)
+	fmt.Fprintf(b, "maxmemory:%d\r\n", server.Config.Maxmemory)
+	fmt.Fprintf(b, "maxmemory_human:%s\r\n", bytesToHuman(server.Config.Maxmemory))
+	fmt.Fprintf(b, "maxmemory_policy:%s\r\n", getMaxmemoryPolicyName(server.Config.MaxmemoryPolicy))
+	fmt.Fprintf(b, "mem_fragmentation_ratio:%.2f\r\n", fragmentation)
+	fmt.Fprintf(b, "mem_allocator:%s\r\n", runtime.Version())
+	fmt.Fprintf(b, "lazyfree_pending_objects:%d\r\n", atomic.LoadInt64(&server.lazyfree.PendingItems))
+	fmt.Fprintf(b, "lazyfreed_objects:%d\r\n", atomic.LoadInt64(&server.lazyfree.FreedItems))
+}
+
+func (server *RedisServer) genInfoPersistence(b *strings.Builder) {
+	bgsaveStatus := "ok"
+	if server.RdbLastBgsaveErr != nil {
+		bgsaveStatus = "err"
+	}
+
+	currentBgsaveTime := int64(-1)
+	if server.rdbBgsaveInProgress {
+		currentBgsaveTime = int64(server.UnixTime.Sub(server.RdbSaveTimeStart).Seconds())
+	}
+
+	lastBgsaveTime := int64(-1)
+	if !server.RdbSaveTimeStart.IsZero() {
+		lastBgsaveTime = int64(server.RdbSaveTimeLast.Seconds())
+	}
+
+	fmt.Fprintf(b, "loading:%d\r\n", boolToInt(server.loading))
+	if server.loading {
+		server.genInfoLoadingProgress(b)
+	}
+	fmt.Fprintf(b, "rdb_changes_since_last_save:%d\r\n", server.Dirty)
+	fmt.Fprintf(b, "rdb_bgsave_in_progress:%d\r\n", boolToInt(server.rdbBgsaveInProgress))
+	fmt.Fprintf(b, "rdb_last_save_time:%d\r\n", server.LastSave.Unix())
+	fmt.Fprintf(b, "rdb_last_bgsave_status:%s\r\n", bgsaveStatus)
+	fmt.Fprintf(b, "rdb_last_bgsave_time_sec:%d\r\n", lastBgsaveTime)
+	fmt.Fprintf(b, "rdb_current_bgsave_time_sec:%d\r\n", currentBgsaveTime)
+
+	aofWriteStatus := "ok"
+	if server.aof.LastWriteErr != nil || server.aof.LastFsyncErr != nil {
+		aofWriteStatus = "err"
+	}
+	rewriteStatus := "ok"
+	if server.aof.LastBgrewriteErr != nil {
+		rewriteStatus = "err"
+	}
+
+	currentRewriteTime := int64(-1)
+	if server.aof.rewriteInProgress {
+		currentRewriteTime = int64(server.UnixTime.Sub(server.aof.RewriteTimeStart).Seconds())
+	}
+
+	lastRewriteTime := int64(-1)
+	if !server.aof.RewriteTimeStart.IsZero() {
+		lastRewriteTime = int64(server.aof.RewriteTimeLast.Seconds())
+	}
+
+	fmt.Fprintf(b, "aof_enabled:%d\r\n", boolToInt(server.Config.AppendOnly))
+	fmt.Fprintf(b, "aof_rewrite_in_progress:%d\r\n", boolToInt(server.aof.rewriteInProgress))
+	fmt.Fprintf(b, "aof_last_rewrite_time_sec:%d\r\n", lastRewriteTime)
+	fmt.Fprintf(b, "aof_current_rewrite_time_sec:%d\r\n", currentRewriteTime)
+	fmt.Fprintf(b, "aof_last_bgrewrite_status:%s\r\n", rewriteStatus)
+	fmt.Fprintf(b, "aof_last_write_status:%s\r\n", aofWriteStatus)
+	if server.Config.AppendOnly {
+		fmt.Fprintf(b, "aof_current_size:%d\r\n", server.aof.CurrentSize)
+		fmt.Fprintf(b, "aof_base_size:%d\r\n", server.aof.RewriteBaseSize)
+		fmt.Fprintf(b, "aof_buffer_length:%d\r\n", server.aof.buf.Len())
+	}
+}
+
+// genInfoLoadingProgress estimates the time left from the rate the files
+// have been read at so far
+func (server *RedisServer) genInfoLoadingProgress(b *strings.Builder) {
+	elapsed := int64(time.Since(server.loadingStartTime).Seconds())
+	perc := float64(0)
+	if server.loadingTotalBytes > 0 {
+		perc = float64(server.loadingLoadedBytes) * 100 / float64(server.loadingTotalBytes)
+	}
+	eta := int64(1)
+	if elapsed > 0 && server.loadingLoadedBytes > 0 {
+		rate := server.loadingLoadedBytes / elapsed
+		if rate > 0 {
+			eta = (server.loadingTotalBytes - server.loadingLoadedBytes) / rate
+		}
+	}
+
+	fmt.Fprintf(b, "loading_start_time:%d\r\n", server.loadingStartTime.Unix())
+	fmt.Fprintf(b, "loading_total_bytes:%d\r\n", server.loadingTotalBytes)
+	fmt.Fprintf(b, "loading_rdb_used_mem:%d\r\n", server.loadingRdbUsedMem)
+	fmt.Fprintf(b, "loading_loaded_bytes:%d\r\n", server.loadingLoadedBytes)
+	fmt.Fprintf(b, "loading_loaded_perc:%.2f\r\n", perc)
+	fmt.Fprintf(b, "loading_eta_seconds:%d\r\n", eta)
+}
+
+func (server *RedisServer) genInfoStats(b *strings.Builder) {
+	server.clientsMu.Lock()
+	numConnections := server.stat.NumConnections
+	server.clientsMu.Unlock()
+
+	fmt.Fprintf(b, "total_connections_received:%d\r\n", numConnections)
+	fmt.Fprintf(b, "total_commands_processed:%d\r\n", server.stat.NumCommands)
+	fmt.Fprintf(b, "instantaneous_ops_per_sec:%d\r\n", server.getInstantaneousMetric(STATS_METRIC_COMMAND))
+	fmt.Fprintf(b, "total_net_input_bytes:%d\r\n", atomic.LoadInt64(&server.statNetInputBytes))
+	fmt.Fprintf(b, "total_net_output_bytes:%d\r\n", atomic.LoadInt64(&server.statNetOutputBytes))
+	fmt.Fprintf(b, "instantaneous_input_kbps:%.2f\r\n", float64(server.getInstantaneousMetric(STATS_METRIC_NET_INPUT))/1024)
+	fmt.Fprintf(b, "instantaneous_output_kbps:%.2f\r\n", float64(server.getInstantaneousMetric(STATS_METRIC_NET_OUTPUT))/1024)
+	fmt.Fprintf(b, "expired_keys:%d\r\n", server.stat.ExpiredKeys)
+	fmt.Fprintf(b, "expired_stale_perc:%.2f\r\n", server.expire.statStalePerc*100)
+	fmt.Fprintf(b, "expired_time_cap_reached_count:%d\r\n", server.stat.ExpiredTimeCapReachedCount)
+	fmt.Fprintf(b, "evicted_keys:%d\r\n", server.stat.EvictedKeys)
+	fmt.Fprintf(b, "keyspace_hits:%d\r\n", server.stat.KeyspaceHits)
+	fmt.Fprintf(b, "keyspace_misses:%d\r\n", server.stat.KeyspaceMisses)
+	fmt.Fprintf(b, "pubsub_channels:%d\r\n", len(server.pubsub.channels))
+	fmt.Fprintf(b, "pubsub_patterns:%d\r\n", len(server.pubsub.patterns))
+	fmt.Fprintf(b, "pubsubshard_channels:%d\r\n", len(server.pubsub.shardChannels))
+	fmt.Fprintf(b, "migrate_cached_sockets:%d\r\n", len(server.migrateCachedSockets))
+	fmt.Fprintf(b, "total_error_replies:%d\r\n", server.stat.TotalErrorReplies)
+	trackingItems := 0
+	for _, ids := range server.trackingTable {
+		trackingItems += len(ids)
+	}
+	fmt.Fprintf(b, "tracking_total_keys:%d\r\n", len(server.trackingTable))
+	fmt.Fprintf(b, "tracking_total_items:%d\r\n", trackingItems)
+	fmt.Fprintf(b, "tracking_total_prefixes:%d\r\n", len(server.trackingPrefixes))
+}
+
+func (server *RedisServer) genInfoCommandStats(b *strings.Builder) {
+	names := make([]string, 0, len(server.stat.commands))
+	for name := range server.stat.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		stats := server.stat.commands[name]
+		perCall := float64(0)
+		if stats.calls > 0 {
+			perCall = float64(stats.microseconds) / float64(stats.calls)
+		}
+		fmt.Fprintf(b, "cmdstat_%s:calls=%d,usec=%d,usec_per_call=%.2f,rejected_calls=%d,failed_calls=%d\r\n",
+			name, stats.calls, stats.microseconds, perCall, stats.rejectedCalls, stats.failedCalls)
+	}
+}
+
+func (server *RedisServer) genInfoErrorStats(b *strings.Builder) {
+	codes := make([]string, 0, len(server.stat.errors))
+	for code := range server.stat.errors {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		fmt.Fprintf(b, "errorstat_%s:count=%d\r\n", code, server.stat.errors[code])
+	}
+}
+
+func (server *RedisServer) genInfoCpu(b *strings.Builder) {
+	var self, children syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &self)
+	syscall.Getrusage(syscall.RUSAGE_CHILDREN, &children)
+
+	seconds := func(tv syscall.Timeval) float64 {
+		return float64(tv.Sec) + float64(tv.Usec)/1e6
+	}
+	fmt.Fprintf(b, "used_cpu_sys:%.6f\r\n", seconds(self.Stime))
+	fmt.Fprintf(b, "used_cpu_user:%.6f\r\n", seconds(self.Utime))
+	fmt.Fprintf(b, "used_cpu_sys_children:%.6f\r\n", seconds(children.Stime))
+	fmt.Fprintf(b, "used_cpu_user_children:%.6f\r\n", seconds(children.Utime))
+}
+
+// genInfoKeyspace tells about the keys of the database, when there are any
+func (server *RedisServer) genInfoKeyspace(b *strings.Builder) {
+	keys := server.Storage.Len()
+	if keys == 0 {
+		return
+	}
+	fmt.Fprintf(b, "db0:keys=%d,expires=%d,avg_ttl=%d\r\n", keys, server.Expirations.Len(), server.expire.avgTTL.Milliseconds())
+}
+
+// bytesToHuman formats a size the way INFO does, like 1.50M
+func bytesToHuman(n int64) string {
+	units := []string{"K", "M", "G", "T", "P"}
+	if n < 1024 {
+		return fmt.Sprintf("%dB", n)
+	}
+	size := float64(n)
+	for _, unit := range units {
+		size /= 1024
+		if size < 1024 || unit == "P" {
+			return fmt.Sprintf("%.2f%s", size, unit)
+		}
+	}
+	return fmt.Sprintf("%dB", n)
+}
+
+func boolToInt(value bool) int {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+func (server *RedisServer) handleInfoCommand(cmd string, args []interface{}) []byte {
+	sections := make([]string, 0, len(args))
+	for _, arg := range args {
+		section, ok := arg.(string)
+		if !ok {
+			return []byte("-ERR Invalid section type\r\n")
+		}
+		sections = append(sections, section)
+	}
+
+	return addReplyBulk([]interface{}{server.genRedisInfoString(sections)})
+}
+
+func (server *RedisServer) genInfoReplication(b *strings.Builder) {
+	repl := &server.repl
+	if server.Config.MasterHost == "" {
+		fmt.Fprintf(b, "role:master\r\n")
+	} else {
+		linkUp := repl.state == REPL_STATE_CONNECTED
+		fmt.Fprintf(b, "role:slave\r\n")
+		fmt.Fprintf(b, "master_host:%s\r\n", server.Config.MasterHost)
+		fmt.Fprintf(b, "master_port:%d\r\n", server.Config.MasterPort)
+		if linkUp {
+			fmt.Fprintf(b, "master_link_status:up\r\n")
+		} else {
+			fmt.Fprintf(b, "master_link_status:down\r\n")
+		}
+
+		lastIo := int64(-1)
+		readReploff, reploff := repl.masterReplOffset, repl.masterReplOffset
+		if repl.master != nil {
+			lastIo = int64(server.UnixTime.Sub(repl.masterLastIo).Seconds())
+			readReploff = atomic.LoadInt64(&repl.master.readReploff)
+		}
+		fmt.Fprintf(b, "master_last_io_seconds_ago:%d\r\n", lastIo)
+		fmt.Fprintf(b, "master_sync_in_progress:%d\r\n", boolToInt(repl.state == REPL_STATE_TRANSFER))
+		fmt.Fprintf(b, "slave_read_repl_offset:%d\r\n", readReploff)
+		fmt.Fprintf(b, "slave_repl_offset:%d\r\n", reploff)
+
+		if repl.state == REPL_STATE_TRANSFER && repl.link != nil {
+			size := atomic.LoadInt64(&repl.link.transferSize)
+			read := atomic.LoadInt64(&repl.link.transferRead)
+			perc := float64(0)
+			if size > 0 {
+				perc = float64(read) * 100 / float64(size)
+			}
+			fmt.Fprintf(b, "master_sync_total_bytes:%d\r\n", size)
+			fmt.Fprintf(b, "master_sync_read_bytes:%d\r\n", read)
+			fmt.Fprintf(b, "master_sync_left_bytes:%d\r\n", size-read)
+			fmt.Fprintf(b, "master_sync_perc:%.2f\r\n", perc)
+			fmt.Fprintf(b, "master_sync_last_io_seconds_ago:%d\r\n",
+				server.UnixTime.Unix()-atomic.LoadInt64(&repl.link.transferLastIo))
+		}
+
+		if !linkUp {
+			downSince := int64(-1)
+			if !repl.downSince.IsZero() {
+				downSince = int64(server.UnixTime.Sub(repl.downSince).Seconds())
+			}
+			fmt.Fprintf(b, "master_link_down_since_seconds:%d\r\n", downSince)
+		}
+		fmt.Fprintf(b, "slave_priority:%d\r\n", server.Config.ReplicaPriority)
+		fmt.Fprintf(b, "slave_read_only:%d\r\n", boolToInt(server.Config.ReplicaReadOnly))
+		fmt.Fprintf(b, "replica_announced:%d\r\n", boolToInt(server.Config.ReplicaAnnounced))
+	}
+
+	fmt.Fprintf(b, "connected_slaves:%d\r\n", len(repl.slaves))
+	if server.Config.MinReplicasToWrite > 0 && server.Config.MinReplicasMaxLag > 0 {
+		fmt.Fprintf(b, "min_slaves_good_slaves:%d\r\n", repl.goodSlavesCount)
+	}
+	for i, slave := range repl.slaves {
+		ip := slave.replicationGetSlaveIp()
+		if ip == "" {
+			continue
+		}
+		lag := int64(0)
+		if !slave.replAckTime.IsZero() {
+			lag = int64(server.UnixTime.Sub(slave.replAckTime).Seconds())
+		}
+		fmt.Fprintf(b, "slave%d:ip=%s,port=%d,state=%s,offset=%d,lag=%d\r\n",
+			i, ip, slave.replListeningPort, replstateToString(slave.replState), slave.replAckOff, lag)
+	}
+
+	fmt.Fprintf(b, "master_failover_state:%s\r\n", getFailoverStateString(repl.failoverState))
+	fmt.Fprintf(b, "master_replid:%s\r\n", repl.replid)
+	fmt.Fprintf(b, "master_replid2:%s\r\n", repl.replid2)
+	fmt.Fprintf(b, "master_repl_offset:%d\r\n", repl.masterReplOffset)
+	fmt.Fprintf(b, "second_repl_offset:%d\r\n", repl.secondReplidOffset)
+
+	backlogSize, firstByte, histlen := server.Config.ReplBacklogSize, int64(0), int64(0)
+	if repl.backlog != nil {
+		backlogSize = int64(len(repl.backlog.buf))
+		firstByte, histlen = repl.backlog.offset, repl.backlog.histlen
+	}
+	fmt.Fprintf(b, "repl_backlog_active:%d\r\n", boolToInt(repl.backlog != nil))
+	fmt.Fprintf(b, "repl_backlog_size:%d\r\n", backlogSize)
+	fmt.Fprintf(b, "repl_backlog_first_byte_offset:%d\r\n", firstByte)
+	fmt.Fprintf(b, "repl_backlog_histlen:%d\r\n", histlen)
+}
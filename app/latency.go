@@ -0,0 +1,444 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The samples an event keeps, at most one per second
+const LATENCY_TS_LEN = 160
+
+type latencySample struct {
+	time    int64 // unix time
+	latency int64 // milliseconds
+}
+
+// latencyTimeSeries are the latest samples of an event, a ring, with the
+// worst one ever
+type latencyTimeSeries struct {
+	idx     int
+	max     int64
+	samples [LATENCY_TS_LEN]latencySample
+}
+
+// latencyAddSampleIfNeeded records the event if it took at least
+// latency-monitor-threshold milliseconds, 0 disables the monitor
+func (server *RedisServer) latencyAddSampleIfNeeded(event string, duration time.Duration) {
+	threshold := server.Config.LatencyMonitorThreshold
+	if threshold > 0 && duration.Milliseconds() >= int64(threshold) {
+		server.latencyAddSample(event, duration.Milliseconds())
+	}
+}
+
+// latencyAddSample records the latency of the event, a second keeps the
+// worst of its samples
+func (server *RedisServer) latencyAddSample(event string, latency int64) {
+	ts := server.latencyEvents[event]
+	if ts == nil {
+		ts = &latencyTimeSeries{}
+		server.latencyEvents[event] = ts
+	}
+	if latency > ts.max {
+		ts.max = latency
+	}
+
+	now := time.Now().Unix()
+	prev := &ts.samples[(ts.idx+LATENCY_TS_LEN-1)%LATENCY_TS_LEN]
+	if prev.time == now {
+		if latency > prev.latency {
+			prev.latency = latency
+		}
+		return
+	}
+	ts.samples[ts.idx] = latencySample{time: now, latency: latency}
+	ts.idx = (ts.idx + 1) % LATENCY_TS_LEN
+}
+
+// history are the samples of the event, oldest first
+func (ts *latencyTimeSeries) history() []latencySample {
+	samples := []latencySample{}
+	for j := 0; j < LATENCY_TS_LEN; j++ {
+		sample := ts.samples[(ts.idx+j)%LATENCY_TS_LEN]
+		if sample.time != 0 {
+			samples = append(samples, sample)
+		}
+	}
+	return samples
+}
+
+// latencyStats summarizes the samples of an event for LATENCY DOCTOR
+type latencyStats struct {
+	samples int
+	avg     int64
+	mad     int64   // mean absolute deviation
+	period  float64 // seconds between the samples, on average
+	max     int64
+}
+
+func (ts *latencyTimeSeries) analyze() latencyStats {
+	history := ts.history()
+	stats := latencyStats{samples: len(history), max: ts.max}
+	if len(history) == 0 {
+		return stats
+	}
+
+	sum := int64(0)
+	for _, sample := range history {
+		sum += sample.latency
+	}
+	stats.avg = sum / int64(len(history))
+
+	deviation := int64(0)
+	for _, sample := range history {
+		deviation += int64(math.Abs(float64(sample.latency - stats.avg)))
+	}
+	stats.mad = deviation / int64(len(history))
+
+	if len(history) > 1 {
+		stats.period = float64(history[len(history)-1].time-history[0].time) / float64(len(history)-1)
+	}
+	return stats
+}
+
+func (server *RedisServer) latencyEventNames() []string {
+	names := make([]string, 0, len(server.latencyEvents))
+	for name := range server.latencyEvents {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// createLatencyReport is LATENCY DOCTOR, what the events recorded tell and
+// what may help
+func (server *RedisServer) createLatencyReport() string {
+	if len(server.latencyEvents) == 0 {
+		if server.Config.LatencyMonitorThreshold == 0 {
+			return "I'm sorry, Dave, I can't do that. Latency monitoring is disabled in this Redis instance. " +
+				"You may use \"CONFIG SET latency-monitor-threshold <milliseconds>.\" in order to enable it. " +
+				"If we weren't in a deep space mission I'd suggest to take a look at https://redis.io/topics/latency-monitor.\n"
+		}
+		return "Dave, no latency spike was observed during the lifetime of this Redis instance, not in the slightest bit. " +
+			"I honestly think you ought to sleep tonight.\n"
+	}
+
+	b := strings.Builder{}
+	b.WriteString("Dave, I have observed latency spikes in this Redis instance. You don't mind talking about it, do you Dave?\n\n")
+
+	advices := map[string]bool{}
+	for i, name := range server.latencyEventNames() {
+		stats := server.latencyEvents[name].analyze()
+		fmt.Fprintf(&b, "%d. %s: %d latency spikes (average %dms, mean deviation %dms, period %.2f sec). Worst all time event %dms.\n",
+			i+1, name, stats.samples, stats.avg, stats.mad, stats.period, stats.max)
+
+		switch {
+		case name == "command" || name == "fast-command":
+			if server.Config.SlowlogLogSlowerThan < 0 || server.Config.SlowlogLogSlowerThan/1000 > server.Config.LatencyMonitorThreshold {
+				advices["slowlog"] = true
+			} else {
+				advices["slowcommands"] = true
+			}
+			if name == "fast-command" {
+				advices["cpu"] = true
+			}
+		case name == "expire-cycle" || name == "eviction-cycle":
+			advices["largeobjects"] = true
+		case name == "fork":
+			advices["snapshot"] = true
+		case strings.HasPrefix(name, "aof-"):
+			advices["disk"] = true
+			if server.Config.AppendFsync == AOF_FSYNC_ALWAYS {
+				advices["fsyncalways"] = true
+			}
+		}
+	}
+
+	if len(advices) == 0 {
+		b.WriteString("\nWhile there are latency events logged, I'm not able to suggest any easy fix. " +
+			"Please use the Redis community to get some help, providing this report in your help request.\n")
+		return b.String()
+	}
+
+	b.WriteString("\nI have a few advices for you:\n\n")
+	if advices["slowlog"] {
+		fmt.Fprintf(&b, "- Check your Slow Log configuration, since the slowlog-log-slower-than threshold is disabled or "+
+			"set to a value greater than the latency monitor threshold of %d milliseconds. Use "+
+			"'CONFIG SET slowlog-log-slower-than %d' to log the commands that are slow enough to be reported here.\n",
+			server.Config.LatencyMonitorThreshold, server.Config.LatencyMonitorThreshold*1000)
+	}
+	if advices["slowcommands"] {
+		b.WriteString("- Check your Slow Log to understand what are the commands you are running which are too slow to execute. " +
+			"Please check https://redis.io/commands/slowlog for more information.\n")
+	}
+	if advices["cpu"] {
+		b.WriteString("- The system is slow to execute Redis code paths not containing system calls. This usually means the " +
+			"system does not provide Redis CPU time to run for long periods. You should try to: 1) Lower the system load. " +
+			"2) Use a computer / VM just for Redis if you are running other software in the same system. " +
+			"3) Check if you have a \"noisy neighbour\" problem.\n")
+	}
+	if advices["largeobjects"] {
+		b.WriteString("- Deleting, expiring or evicting (because of maxmemory policy) large objects is a blocking operation. " +
+			"If you have very large objects that are often deleted, expired, or evicted, try to fragment those objects " +
+			"into multiple smaller objects.\n")
+	}
+	if advices["snapshot"] {
+		b.WriteString("- Taking the snapshot of the dataset for BGSAVE and BGREWRITEAOF blocks the server for longer " +
+			"the larger the dataset is. Consider saving less often, or a smaller dataset per instance.\n")
+	}
+	if advices["disk"] {
+		b.WriteString("- The AOF is written and synced to a slow disk. Consider a faster disk, or check that no other " +
+			"process of the system is using it intensively.\n")
+	}
+	if advices["fsyncalways"] {
+		b.WriteString("- Your fsync policy is set to 'always'. It is very hard to get good performances with such a setup, " +
+			"if possible try to relax the fsync policy to 'everysec'.\n")
+	}
+	return b.String()
+}
+
+// The range of the latencies of the commands histograms count, in
+// nanoseconds, larger ones count as the largest
+const (
+	LATENCY_HISTOGRAM_MIN_VALUE = 1
+	LATENCY_HISTOGRAM_MAX_VALUE = 1000000000
+)
+
+// A histogram bucket covers the values of the same power of two, split in
+// LATENCY_HISTOGRAM_SUB_BUCKETS counts, so a value is known within 1%
+const (
+	LATENCY_HISTOGRAM_SUB_BUCKET_BITS = 7
+	LATENCY_HISTOGRAM_SUB_BUCKETS     = 1 << LATENCY_HISTOGRAM_SUB_BUCKET_BITS
+)
+
+// latencyHistogram counts the latencies of a command, in the manner of an
+// HDR histogram with two significant digits
+type latencyHistogram struct {
+	counts []int64
+	total  int64
+}
+
+func newLatencyHistogram() *latencyHistogram {
+	return &latencyHistogram{counts: make([]int64, latencyHistogramIndex(LATENCY_HISTOGRAM_MAX_VALUE)+1)}
+}
+
+// latencyHistogramIndex is the count of the value: the values below twice
+// the sub buckets are counted one by one, the larger ones by their highest
+// bits
+func latencyHistogramIndex(value int64) int {
+	shift := bits.Len64(uint64(value)) - (LATENCY_HISTOGRAM_SUB_BUCKET_BITS + 1)
+	if shift <= 0 {
+		return int(value)
+	}
+	sub := int(value >> shift)
+	return 2*LATENCY_HISTOGRAM_SUB_BUCKETS + (shift-1)*LATENCY_HISTOGRAM_SUB_BUCKETS + sub - LATENCY_HISTOGRAM_SUB_BUCKETS
+}
+
+// latencyHistogramHighestValue is the largest value counted at the index
+func latencyHistogramHighestValue(index int) int64 {
+	if index < 2*LATENCY_HISTOGRAM_SUB_BUCKETS {
+		return int64(index)
+	}
+	index -= 2 * LATENCY_HISTOGRAM_SUB_BUCKETS
+	shift := index/LATENCY_HISTOGRAM_SUB_BUCKETS + 1
+	sub := int64(index%LATENCY_HISTOGRAM_SUB_BUCKETS + LATENCY_HISTOGRAM_SUB_BUCKETS)
+	return (sub+1)<<shift - 1
+}
+
+func (h *latencyHistogram) record(duration time.Duration) {
+	value := duration.Nanoseconds()
+	if value < LATENCY_HISTOGRAM_MIN_VALUE {
+		value = LATENCY_HISTOGRAM_MIN_VALUE
+	} else if value > LATENCY_HISTOGRAM_MAX_VALUE {
+		value = LATENCY_HISTOGRAM_MAX_VALUE
+	}
+	h.counts[latencyHistogramIndex(value)]++
+	h.total++
+}
+
+// percentile is the latency, in nanoseconds, below which the percentage of
+// the calls were
+func (h *latencyHistogram) percentile(percentile float64) int64 {
+	if h.total == 0 {
+		return 0
+	}
+	target := int64(math.Ceil(percentile / 100 * float64(h.total)))
+	if target < 1 {
+		target = 1
+	}
+	cumulative := int64(0)
+	for index, count := range h.counts {
+		cumulative += count
+		if cumulative >= target {
+			return latencyHistogramHighestValue(index)
+		}
+	}
+	return LATENCY_HISTOGRAM_MAX_VALUE
+}
+
+// cumulativeBuckets are how many calls took at most 1024ns, then twice that
+// and so on, until all the calls are counted. Only the buckets that count
+// more calls than the previous one are given, keyed by microseconds.
+func (h *latencyHistogram) cumulativeBuckets() [][2]int64 {
+	buckets := [][2]int64{}
+	cumulative, previous := int64(0), int64(0)
+	index := 0
+	for limit := int64(1024); previous < h.total; limit *= 2 {
+		for ; index < len(h.counts) && latencyHistogramHighestValue(index) < limit; index++ {
+			cumulative += h.counts[index]
+		}
+		if cumulative != previous {
+			buckets = append(buckets, [2]int64{limit / 1000, cumulative})
+		}
+		previous = cumulative
+		if index == len(h.counts) {
+			break
+		}
+	}
+	return buckets
+}
+
+// updateLatencyHistogram records the latency of a call of the command, with
+// latency-tracking enabled
+func (server *RedisServer) updateLatencyHistogram(stats *commandStats, duration time.Duration) {
+	if !server.Config.LatencyTracking {
+		return
+	}
+	if stats.latencyHistogram == nil {
+		stats.latencyHistogram = newLatencyHistogram()
+	}
+	stats.latencyHistogram.record(duration)
+}
+
+// genInfoLatencyStats gives the latency-tracking-info-percentiles of each
+// command that was called
+func (server *RedisServer) genInfoLatencyStats(b *strings.Builder) {
+	names := make([]string, 0, len(server.stat.commands))
+	for name, stats := range server.stat.commands {
+		if stats.latencyHistogram != nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		histogram := server.stat.commands[name].latencyHistogram
+		percentiles := []string{}
+		for _, percentile := range server.Config.LatencyTrackingInfoPercentiles {
+			percentiles = append(percentiles, fmt.Sprintf("p%s=%.3f",
+				strconv.FormatFloat(percentile, 'f', -1, 64), float64(histogram.percentile(percentile))/1000))
+		}
+		fmt.Fprintf(b, "latency_percentiles_usec_%s:%s\r\n", name, strings.Join(percentiles, ","))
+	}
+}
+
+// latencyHistogramReply is LATENCY HISTOGRAM for the commands given, or all
+// of them, the ones never called left out
+func (server *RedisServer) latencyHistogramReply(client *RedisClient, names []string) []byte {
+	if len(names) == 0 {
+		for name := range server.stat.commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	entries := [][]byte{}
+	seen := map[string]bool{}
+	for _, name := range names {
+		name = strings.ToLower(name)
+		stats := server.stat.commands[name]
+		if stats == nil || stats.latencyHistogram == nil || seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		buckets := stats.latencyHistogram.cumulativeBuckets()
+		entry := addReplyValue(name)
+		entry = append(entry, client.addReplyMapLen(2)...)
+		entry = append(entry, addReplyValue("calls")...)
+		entry = append(entry, addReplyLongLong(stats.latencyHistogram.total)...)
+		entry = append(entry, addReplyValue("histogram_usec")...)
+		entry = append(entry, client.addReplyMapLen(len(buckets))...)
+		for _, bucket := range buckets {
+			entry = append(entry, addReplyLongLong(bucket[0])...)
+			entry = append(entry, addReplyLongLong(bucket[1])...)
+		}
+		entries = append(entries, entry)
+	}
+
+	reply := client.addReplyMapLen(len(entries))
+	for _, entry := range entries {
+		reply = append(reply, entry...)
+	}
+	return reply
+}
+
+func (server *RedisServer) handleLatencyCommand(cmd string, args []interface{}) []byte {
+	subcommand, _ := args[0].(string)
+	subcommand = strings.ToUpper(subcommand)
+
+	switch {
+	case subcommand == "HELP" && len(args) == 1:
+		return addReplyHelp("LATENCY", []string{
+			"DOCTOR",
+			"    Return a human readable latency analysis report.",
+			"HISTORY <event>",
+			"    Return time-latency samples for the <event> class.",
+			"LATEST",
+			"    Return the latest latency samples for all events.",
+			"HISTOGRAM [<command> ...]",
+			"    Return a cumulative distribution of latencies in the format of a histogram for the specified command names.",
+			"    If no commands are specified then all histograms are replied.",
+			"RESET [<event> ...]",
+			"    Reset latency data of one or more <event> classes.",
+			"    (default: reset all data for all event classes)",
+		})
+	case subcommand == "HISTORY" && len(args) == 2:
+		event, _ := args[1].(string)
+		ts := server.latencyEvents[event]
+		if ts == nil {
+			return addReplyArrayLen(0)
+		}
+		samples := []interface{}{}
+		for _, sample := range ts.history() {
+			samples = append(samples, []interface{}{sample.time, sample.latency})
+		}
+		return addReplyValue(samples)
+	case subcommand == "LATEST" && len(args) == 1:
+		events := []interface{}{}
+		for _, name := range server.latencyEventNames() {
+			ts := server.latencyEvents[name]
+			last := ts.samples[(ts.idx+LATENCY_TS_LEN-1)%LATENCY_TS_LEN]
+			events = append(events, []interface{}{name, last.time, last.latency, ts.max})
+		}
+		return addReplyValue(events)
+	case subcommand == "HISTOGRAM":
+		names := []string{}
+		for _, arg := range args[1:] {
+			name, _ := arg.(string)
+			names = append(names, name)
+		}
+		return server.latencyHistogramReply(server.currentClient, names)
+	case subcommand == "DOCTOR" && len(args) == 1:
+		return server.currentClient.addReplyVerbatim(server.createLatencyReport(), "txt")
+	case subcommand == "RESET":
+		resets := 0
+		if len(args) == 1 {
+			resets = len(server.latencyEvents)
+			server.latencyEvents = make(map[string]*latencyTimeSeries)
+		} else {
+			for _, arg := range args[1:] {
+				event, _ := arg.(string)
+				if _, ok := server.latencyEvents[event]; ok {
+					delete(server.latencyEvents, event)
+					resets++
+				}
+			}
+		}
+		return addReplyLongLong(int64(resets))
+	}
+	return addReplySubcommandSyntaxError("LATENCY", subcommand)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Objects whose free effort is above this are released on the lazyfree goroutine
+const LAZYFREE_THRESHOLD = 64
+
+type lazyfreeJob struct {
+	objects     []*RedisObject
+	storage     *dict[*RedisObject]
+	expirations *dict[time.Time]
+}
+
+// LazyFree plays the role of the Redis bio lazyfree thread: large values are
+// handed over to it so that dropping them doesn't stall the executor.
+type LazyFree struct {
+	jobs         chan lazyfreeJob
+	PendingItems int64
+	FreedItems   int64
+}
+
+func newLazyFree() *LazyFree {
+	lazyfree := &LazyFree{jobs: make(chan lazyfreeJob, 1024)}
+	go lazyfree.main()
+	return lazyfree
+}
+
+func (lazyfree *LazyFree) main() {
+	for job := range lazyfree.jobs {
+		// Values and keyspace shards may still be referenced by a snapshot,
+		// so they are never modified here: dropping our references is what
+		// lets the garbage collector reclaim them.
+		freed := int64(len(job.objects))
+		if job.storage != nil {
+			freed += int64(job.storage.Len())
+		}
+
+		atomic.AddInt64(&lazyfree.PendingItems, -freed)
+		atomic.AddInt64(&lazyfree.FreedItems, freed)
+	}
+}
+
+func (lazyfree *LazyFree) pending() int64 {
+	return atomic.LoadInt64(&lazyfree.PendingItems)
+}
+
+func (lazyfree *LazyFree) freed() int64 {
+	return atomic.LoadInt64(&lazyfree.FreedItems)
+}
+
+// lazyfreeGetFreeEffort returns roughly the number of allocations that have
+// to be released to free the object
+func lazyfreeGetFreeEffort(obj *RedisObject) int {
+	if obj.Type == OBJ_STREAM {
+		stream := obj.Value.(*Stream)
+		effort := len(stream.Entries)
+		for _, group := range stream.Groups {
+			effort += len(group.PEL) + len(group.Consumers)
+		}
+		return effort
+	}
+	return objectLength(obj)
+}
+
+// freeObjectAsync releases the object in the background when it is big enough
+// for that to pay off, otherwise the reference is simply dropped
+func (server *RedisServer) freeObjectAsync(obj *RedisObject) {
+	if lazyfreeGetFreeEffort(obj) <= LAZYFREE_THRESHOLD {
+		return
+	}
+
+	atomic.AddInt64(&server.lazyfree.PendingItems, 1)
+	server.lazyfree.jobs <- lazyfreeJob{objects: []*RedisObject{obj}}
+}
+
+// emptyDbAsync swaps in fresh keyspace dicts and frees the old ones in the background
+func (server *RedisServer) emptyDbAsync() {
+	storage, expirations := server.Storage, server.Expirations
+	server.Storage = newDict[*RedisObject]()
+	server.Expirations = newDict[time.Time]()
+
+	atomic.AddInt64(&server.lazyfree.PendingItems, int64(storage.Len()))
+	server.lazyfree.jobs <- lazyfreeJob{storage: storage, expirations: expirations}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+// Decoders for the compact encodings found in RDB files (listpack, ziplist,
+// intset and the legacy zipmap), plus a listpack encoder used for streams.
+
+var errCorruptEncoding = errors.New("corrupt compact encoding")
+
+const (
+	LP_HDR_SIZE = 6
+	LP_EOF      = 0xFF
+)
+
+// lpDecode returns every element of a listpack as a string
+func lpDecode(lp []byte) ([]string, error) {
+	if len(lp) < LP_HDR_SIZE+1 {
+		return nil, errCorruptEncoding
+	}
+
+	elements := []string{}
+	p := LP_HDR_SIZE
+	for {
+		if p >= len(lp) {
+			return nil, errCorruptEncoding
+		}
+		if lp[p] == LP_EOF {
+			return elements, nil
+		}
+
+		value, entryLen, err := lpDecodeEntry(lp[p:])
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, value)
+
+		p += entryLen
+		p += lpEncodeBacklenSize(entryLen)
+	}
+}
+
+// lpDecodeEntry decodes a single entry and returns its value and the size of
+// encoding+data, not counting the trailing backlen
+func lpDecodeEntry(p []byte) (string, int, error) {
+	need := func(n int) error {
+		if len(p) < n {
+			return errCorruptEncoding
+		}
+		return nil
+	}
+
+	b := p[0]
+	switch {
+	case b&0x80 == 0: // 7 bit uint
+		return strconv.Itoa(int(b & 0x7F)), 1, nil
+	case b&0xC0 == 0x80: // 6 bit str len
+		n := int(b & 0x3F)
+		if err := need(1 + n); err != nil {
+			return "", 0, err
+		}
+		return string(p[1 : 1+n]), 1 + n, nil
+	case b&0xE0 == 0xC0: // 13 bit int
+		if err := need(2); err != nil {
+			return "", 0, err
+		}
+		v := int64(b&0x1F)<<8 | int64(p[1])
+		if v >= 1<<12 {
+			v -= 1 << 13
+		}
+		return strconv.FormatInt(v, 10), 2, nil
+	case b&0xF0 == 0xE0: // 12 bit str len
+		if err := need(2); err != nil {
+			return "", 0, err
+		}
+		n := int(b&0x0F)<<8 | int(p[1])
+		if err := need(2 + n); err != nil {
+			return "", 0, err
+		}
+		return string(p[2 : 2+n]), 2 + n, nil
+	}
+
+	switch b {
+	case 0xF0: // 32 bit str len
+		if err := need(5); err != nil {
+			return "", 0, err
+		}
+		n := int(binary.LittleEndian.Uint32(p[1:5]))
+		if err := need(5 + n); err != nil {
+			return "", 0, err
+		}
+		return string(p[5 : 5+n]), 5 + n, nil
+	case 0xF1:
+		if err := need(3); err != nil {
+			return "", 0, err
+		}
+		return strconv.FormatInt(int64(int16(binary.LittleEndian.Uint16(p[1:3]))), 10), 3, nil
+	case 0xF2:
+		if err := need(4); err != nil {
+			return "", 0, err
+		}
+		v := int32(uint32(p[1])<<8|uint32(p[2])<<16|uint32(p[3])<<24) >> 8
+		return strconv.FormatInt(int64(v), 10), 4, nil
+	case 0xF3:
+		if err := need(5); err != nil {
+			return "", 0, err
+		}
+		return strconv.FormatInt(int64(int32(binary.LittleEndian.Uint32(p[1:5]))), 10), 5, nil
+	case 0xF4:
+		if err := need(9); err != nil {
+			return "", 0, err
+		}
+		return strconv.FormatInt(int64(binary.LittleEndian.Uint64(p[1:9])), 10), 9, nil
+	default:
+		return "", 0, errCorruptEncoding
+	}
+}
+
+func lpEncodeBacklenSize(l int) int {
+	switch {
+	case l <= 127:
+		return 1
+	case l < 16383:
+		return 2
+	case l < 2097151:
+		return 3
+	case l < 268435455:
+		return 4
+	default:
+		return 5
+	}
+}
+
+// lpEncodeBacklen writes the entry length so the listpack can be walked
+// backwards: 7 bits per byte, most significant first, and every byte but the
+// first one flagged with the high bit
+func lpEncodeBacklen(l int) []byte {
+	size := lpEncodeBacklenSize(l)
+	buf := make([]byte, size)
+	for i := size - 1; i >= 0; i-- {
+		buf[i] = byte(l & 127)
+		if i != 0 {
+			buf[i] |= 128
+		}
+		l >>= 7
+	}
+	return buf
+}
+
+func lpEncodeElement(value string) []byte {
+	var entry []byte
+
+	if v, err := strconv.ParseInt(value, 10, 64); err == nil && strconv.FormatInt(v, 10) == value {
+		switch {
+		case v >= 0 && v <= 127:
+			entry = []byte{byte(v)}
+		case v >= -4096 && v <= 4095:
+			u := uint16(v) & 0x1FFF
+			entry = []byte{0xC0 | byte(u>>8), byte(u)}
+		case v >= -32768 && v <= 32767:
+			entry = []byte{0xF1, 0, 0}
+			binary.LittleEndian.PutUint16(entry[1:], uint16(v))
+		case v >= -8388608 && v <= 8388607:
+			u := uint32(v)
+			entry = []byte{0xF2, byte(u), byte(u >> 8), byte(u >> 16)}
+		case v >= -2147483648 && v <= 2147483647:
+			entry = []byte{0xF3, 0, 0, 0, 0}
+			binary.LittleEndian.PutUint32(entry[1:], uint32(v))
+		default:
+			entry = make([]byte, 9)
+			entry[0] = 0xF4
+			binary.LittleEndian.PutUint64(entry[1:], uint64(v))
+		}
+	} else {
+		n := len(value)
+		switch {
+		case n < 64:
+			entry = append([]byte{0x80 | byte(n)}, value...)
+		case n < 4096:
+			entry = append([]byte{0xE0 | byte(n>>8), byte(n)}, value...)
+		default:
+			entry = make([]byte, 5, 5+n)
+			entry[0] = 0xF0
+			binary.LittleEndian.PutUint32(entry[1:], uint32(n))
+			entry = append(entry, value...)
+		}
+	}
+
+	return append(entry, lpEncodeBacklen(len(entry))...)
+}
+
+// lpEncode builds a listpack holding the given elements
+func lpEncode(elements []string) []byte {
+	lp := make([]byte, LP_HDR_SIZE)
+	for _, element := range elements {
+		lp = append(lp, lpEncodeElement(element)...)
+	}
+	lp = append(lp, LP_EOF)
+
+	binary.LittleEndian.PutUint32(lp[0:4], uint32(len(lp)))
+	count := len(elements)
+	if count > 65535 {
+		count = 65535 // means "unknown", readers have to walk the listpack
+	}
+	binary.LittleEndian.PutUint16(lp[4:6], uint16(count))
+	return lp
+}
+
+const ZIPLIST_HEADER_SIZE = 10
+
+// ziplistDecode returns every element of a ziplist as a string
+func ziplistDecode(zl []byte) ([]string, error) {
+	if len(zl) < ZIPLIST_HEADER_SIZE+1 {
+		return nil, errCorruptEncoding
+	}
+
+	elements := []string{}
+	p := ZIPLIST_HEADER_SIZE
+	for {
+		if p >= len(zl) {
+			return nil, errCorruptEncoding
+		}
+		if zl[p] == 0xFF {
+			return elements, nil
+		}
+
+		// previous entry length
+		if zl[p] < 254 {
+			p++
+		} else {
+			p += 5
+		}
+		if p >= len(zl) {
+			return nil, errCorruptEncoding
+		}
+
+		b := zl[p]
+		var value string
+		switch b >> 6 {
+		case 0:
+			n := int(b & 0x3F)
+			if p+1+n > len(zl) {
+				return nil, errCorruptEncoding
+			}
+			value = string(zl[p+1 : p+1+n])
+			p += 1 + n
+		case 1:
+			if p+2 > len(zl) {
+				return nil, errCorruptEncoding
+			}
+			n := int(b&0x3F)<<8 | int(zl[p+1])
+			if p+2+n > len(zl) {
+				return nil, errCorruptEncoding
+			}
+			value = string(zl[p+2 : p+2+n])
+			p += 2 + n
+		case 2:
+			if p+5 > len(zl) {
+				return nil, errCorruptEncoding
+			}
+			n := int(binary.BigEndian.Uint32(zl[p+1 : p+5]))
+			if p+5+n > len(zl) {
+				return nil, errCorruptEncoding
+			}
+			value = string(zl[p+5 : p+5+n])
+			p += 5 + n
+		default:
+			var v int64
+			size := 0
+			switch b {
+			case 0xC0:
+				size = 2
+			case 0xD0:
+				size = 4
+			case 0xE0:
+				size = 8
+			case 0xF0:
+				size = 3
+			case 0xFE:
+				size = 1
+			default:
+				if b >= 0xF1 && b <= 0xFD {
+					v = int64(b&0x0F) - 1
+				} else {
+					return nil, errCorruptEncoding
+				}
+			}
+			if p+1+size > len(zl) {
+				return nil, errCorruptEncoding
+			}
+			data := zl[p+1 : p+1+size]
+			switch size {
+			case 1:
+				v = int64(int8(data[0]))
+			case 2:
+				v = int64(int16(binary.LittleEndian.Uint16(data)))
+			case 3:
+				v = int64(int32(uint32(data[0])<<8|uint32(data[1])<<16|uint32(data[2])<<24) >> 8)
+			case 4:
+				v = int64(int32(binary.LittleEndian.Uint32(data)))
+			case 8:
+				v = int64(binary.LittleEndian.Uint64(data))
+			}
+			value = strconv.FormatInt(v, 10)
+			p += 1 + size
+		}
+
+		elements = append(elements, value)
+	}
+}
+
+// intsetDecode returns the members of an intset as strings
+func intsetDecode(is []byte) ([]string, error) {
+	if len(is) < 8 {
+		return nil, errCorruptEncoding
+	}
+	encoding := int(binary.LittleEndian.Uint32(is[0:4]))
+	length := int(binary.LittleEndian.Uint32(is[4:8]))
+	if encoding != 2 && encoding != 4 && encoding != 8 || len(is) < 8+encoding*length {
+		return nil, errCorruptEncoding
+	}
+
+	members := make([]string, 0, length)
+	for i := 0; i < length; i++ {
+		data := is[8+i*encoding : 8+(i+1)*encoding]
+		var v int64
+		switch encoding {
+		case 2:
+			v = int64(int16(binary.LittleEndian.Uint16(data)))
+		case 4:
+			v = int64(int32(binary.LittleEndian.Uint32(data)))
+		case 8:
+			v = int64(binary.LittleEndian.Uint64(data))
+		}
+		members = append(members, strconv.FormatInt(v, 10))
+	}
+	return members, nil
+}
+
+// zipmapDecode returns the alternating fields and values of a zipmap, the
+// hash encoding used before Redis 2.6
+func zipmapDecode(zm []byte) ([]string, error) {
+	if len(zm) < 2 {
+		return nil, errCorruptEncoding
+	}
+
+	elements := []string{}
+	p := 1
+	readLen := func() (int, error) {
+		if p >= len(zm) {
+			return 0, errCorruptEncoding
+		}
+		if zm[p] < 254 {
+			p++
+			return int(zm[p-1]), nil
+		}
+		if p+5 > len(zm) {
+			return 0, errCorruptEncoding
+		}
+		n := int(binary.LittleEndian.Uint32(zm[p+1 : p+5]))
+		p += 5
+		return n, nil
+	}
+
+	for {
+		if p >= len(zm) {
+			return nil, errCorruptEncoding
+		}
+		if zm[p] == 255 {
+			return elements, nil
+		}
+
+		klen, err := readLen()
+		if err != nil || p+klen > len(zm) {
+			return nil, errCorruptEncoding
+		}
+		field := string(zm[p : p+klen])
+		p += klen
+
+		vlen, err := readLen()
+		if err != nil || p+1+vlen > len(zm) {
+			return nil, errCorruptEncoding
+		}
+		free := int(zm[p])
+		p++
+		value := string(zm[p : p+vlen])
+		p += vlen + free
+
+		elements = append(elements, field, value)
+	}
+}
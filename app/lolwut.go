@@ -0,0 +1,324 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// lwCanvas is a grid of pixels the LOLWUT versions draw on, each pixel
+// holding a color
+type lwCanvas struct {
+	width  int
+	height int
+	pixels []byte
+}
+
+func lwCreateCanvas(width, height int, bgcolor byte) *lwCanvas {
+	canvas := &lwCanvas{width: width, height: height, pixels: make([]byte, width*height)}
+	for i := range canvas.pixels {
+		canvas.pixels[i] = bgcolor
+	}
+	return canvas
+}
+
+// lwDrawPixel colors the pixel, the ones out of the canvas are ignored
+func (canvas *lwCanvas) lwDrawPixel(x, y int, color byte) {
+	if x < 0 || x >= canvas.width || y < 0 || y >= canvas.height {
+		return
+	}
+	canvas.pixels[x+y*canvas.width] = color
+}
+
+// lwGetPixel is the color of the pixel, 0 out of the canvas
+func (canvas *lwCanvas) lwGetPixel(x, y int) byte {
+	if x < 0 || x >= canvas.width || y < 0 || y >= canvas.height {
+		return 0
+	}
+	return canvas.pixels[x+y*canvas.width]
+}
+
+// lwDrawLine draws a line with the Bresenham algorithm
+func (canvas *lwCanvas) lwDrawLine(x1, y1, x2, y2 int, color byte) {
+	dx, dy := x2-x1, y2-y1
+	if dx < 0 {
+		dx = -dx
+	}
+	if dy < 0 {
+		dy = -dy
+	}
+	sx, sy := 1, 1
+	if x1 >= x2 {
+		sx = -1
+	}
+	if y1 >= y2 {
+		sy = -1
+	}
+	err := dx - dy
+
+	for {
+		canvas.lwDrawPixel(x1, y1, color)
+		if x1 == x2 && y1 == y2 {
+			break
+		}
+		e2 := err * 2
+		if e2 > -dy {
+			err -= dy
+			x1 += sx
+		}
+		if e2 < dx {
+			err += dx
+			y1 += sy
+		}
+	}
+}
+
+// lwDrawSquare draws a square centered at x, y with the side and rotation
+// given. The corners are the points of a circle rotated by 90 degrees each.
+func (canvas *lwCanvas) lwDrawSquare(x, y int, size, angle float64, color byte) {
+	// a square inscribed in a circle of radius 1 has a side of sqrt(2)
+	size = math.Round(size / 1.4142135623)
+
+	var px, py [4]int
+	k := math.Pi/4 + angle
+	for j := 0; j < 4; j++ {
+		px[j] = int(math.Round(math.Sin(k)*size + float64(x)))
+		py[j] = int(math.Round(math.Cos(k)*size + float64(y)))
+		k += math.Pi / 2
+	}
+	for j := 0; j < 4; j++ {
+		canvas.lwDrawLine(px[j], py[j], px[(j+1)%4], py[(j+1)%4], color)
+	}
+}
+
+// lwDrawSchotter draws the squares of "Schotter" by Georg Nees, more and
+// more disordered from the top rows to the bottom ones
+func lwDrawSchotter(consoleCols, squaresPerRow, squaresPerCol int) *lwCanvas {
+	canvasWidth := consoleCols * 2
+	padding := 0
+	if canvasWidth > 4 {
+		padding = 2
+	}
+	squareSide := float64(canvasWidth-padding*2) / float64(squaresPerRow)
+	canvasHeight := int(squareSide*float64(squaresPerCol)) + padding*2
+	canvas := lwCreateCanvas(canvasWidth, canvasHeight, 0)
+
+	for y := 0; y < squaresPerCol; y++ {
+		for x := 0; x < squaresPerRow; x++ {
+			sx := int(float64(x)*squareSide + squareSide/2 + float64(padding))
+			sy := int(float64(y)*squareSide + squareSide/2 + float64(padding))
+			angle := 0.0
+			if y > 1 {
+				random := func() float64 {
+					r := rand.Float64() / float64(squaresPerCol) * float64(y)
+					if rand.Intn(2) == 1 {
+						r = -r
+					}
+					return r
+				}
+				angle = random()
+				sx += int(random() * squareSide / 3)
+				sy += int(random() * squareSide / 3)
+			}
+			canvas.lwDrawSquare(sx, sy, squareSide, angle, 1)
+		}
+	}
+	return canvas
+}
+
+// renderBraille renders the canvas with a braille character for each group
+// of 2x4 pixels, whose dots are the bits:
+//
+//	0 3
+//	1 4
+//	2 5
+//	6 7
+func (canvas *lwCanvas) renderBraille() string {
+	var b strings.Builder
+	for y := 0; y < canvas.height; y += 4 {
+		for x := 0; x < canvas.width; x += 2 {
+			dots := 0
+			for bit, pixel := range [8][2]int{{0, 0}, {0, 1}, {0, 2}, {1, 0}, {1, 1}, {1, 2}, {0, 3}, {1, 3}} {
+				if canvas.lwGetPixel(x+pixel[0], y+pixel[1]) != 0 {
+					dots |= 1 << bit
+				}
+			}
+			b.WriteRune(rune(0x2800 + dots))
+		}
+		if y != canvas.height-1 {
+			b.WriteByte('\n')
+		}
+	}
+	return b.String()
+}
+
+// renderGrays renders the canvas with the four grays of the color terminals,
+// which are close to the ones of the Game Boy
+func (canvas *lwCanvas) renderGrays() string {
+	var b strings.Builder
+	for y := 0; y < canvas.height; y++ {
+		for x := 0; x < canvas.width; x++ {
+			// both the foreground and the background, for the terminals
+			// to agree on how it looks
+			escape := "0;30;40m"
+			switch canvas.lwGetPixel(x, y) {
+			case 1:
+				escape = "0;90;100m"
+			case 2:
+				escape = "0;37;47m"
+			case 3:
+				escape = "0;97;107m"
+			}
+			fmt.Fprintf(&b, "\033[%s \033[0m", escape)
+		}
+		if y != canvas.height-1 {
+			b.WriteByte('\n')
+		}
+	}
+	return b.String()
+}
+
+// lwSkyscraper is a building of the skyline of LOLWUT 6
+type lwSkyscraper struct {
+	xoff    int
+	width   int
+	height  int
+	windows bool
+	color   byte
+}
+
+// generateSkyscraper draws the skyscraper, its windows randomly lit with
+// one of the two grays
+func (canvas *lwCanvas) generateSkyscraper(si lwSkyscraper) {
+	starty := canvas.height - 1
+	endy := starty - si.height + 1
+	for y := starty; y >= endy; y-- {
+		for x := si.xoff; x < si.xoff+si.width; x++ {
+			// the roof is four pixels less wide
+			if y == endy && (x <= si.xoff+1 || x >= si.xoff+si.width-2) {
+				continue
+			}
+			color := si.color
+			if si.windows && x > si.xoff+1 && x < si.xoff+si.width-2 && y > endy+1 && y < starty-1 {
+				relx := x - (si.xoff + 1)
+				rely := y - (endy + 1)
+				// the windows are two pixels wide and one tall, the
+				// characters of the terminal being taller than wide
+				if relx/2%2 == 1 && rely%2 == 1 {
+					for color == si.color {
+						color = byte(1 + rand.Intn(2))
+					}
+					if relx%2 == 1 {
+						color = canvas.lwGetPixel(x-1, y)
+					}
+				}
+			}
+			canvas.lwDrawPixel(x, y, color)
+		}
+	}
+}
+
+// generateSkyline draws a city like the parallax backgrounds of the 8 bit
+// games: two rows of buildings behind, the lighter ones farther, and one of
+// buildings with windows in front
+func (canvas *lwCanvas) generateSkyline() {
+	for color := byte(2); color >= 1; color-- {
+		for offset := -10; offset < canvas.width; {
+			offset += rand.Intn(8)
+			si := lwSkyscraper{xoff: offset, width: 10 + rand.Intn(9), color: color}
+			if color == 2 {
+				si.height = canvas.height/2 + rand.Intn(canvas.height)/2
+			} else {
+				si.height = canvas.height/2 + rand.Intn(canvas.height)/3
+			}
+			canvas.generateSkyscraper(si)
+			if color == 2 {
+				offset += si.width / 2
+			} else {
+				offset += si.width + 1
+			}
+		}
+	}
+
+	for offset := -10; offset < canvas.width; {
+		offset += rand.Intn(8)
+		si := lwSkyscraper{xoff: offset, width: 5 + rand.Intn(14), windows: true}
+		if si.width%4 != 0 {
+			si.width += si.width % 3
+		}
+		si.height = canvas.height/3 + rand.Intn(canvas.height)/2
+		canvas.generateSkyscraper(si)
+		offset += si.width + 5
+	}
+}
+
+// lolwutParseArgs parses the numeric arguments of a LOLWUT version over the
+// defaults, each clamped to its range
+func lolwutParseArgs(args []interface{}, values []int, limits [][2]int) []byte {
+	for i := 0; i < len(args) && i < len(values); i++ {
+		arg, _ := args[i].(string)
+		n, err := strconv.Atoi(arg)
+		if err != nil {
+			return []byte("-ERR value is not an integer or out of range\r\n")
+		}
+		values[i] = minOf(maxOf(n, limits[i][0]), limits[i][1])
+	}
+	return nil
+}
+
+// lolwut5 is LOLWUT [columns] [squares per row] [squares per column]
+func (server *RedisServer) lolwut5(args []interface{}) []byte {
+	values := []int{66, 8, 12}
+	if errReply := lolwutParseArgs(args, values, [][2]int{{1, 1000}, {1, 200}, {1, 200}}); errReply != nil {
+		return errReply
+	}
+
+	rendered := lwDrawSchotter(values[0], values[1], values[2]).renderBraille()
+	rendered += "\nGeorg Nees - schotter, plotter on paper, 1968. Redis ver. " + REDIS_VERSION + "\n"
+	return server.currentClient.addReplyVerbatim(rendered, "txt")
+}
+
+// lolwut6 is LOLWUT [columns] [rows]
+func (server *RedisServer) lolwut6(args []interface{}) []byte {
+	values := []int{80, 20}
+	if errReply := lolwutParseArgs(args, values, [][2]int{{1, 1000}, {1, 1000}}); errReply != nil {
+		return errReply
+	}
+
+	canvas := lwCreateCanvas(values[0], values[1], 3)
+	canvas.generateSkyline()
+	rendered := canvas.renderGrays()
+	rendered += "\nDedicated to the 8 bit game developers of past and present.\n" +
+		"Original 8 bit image from Plaguemon by hikikomori. Redis ver. " + REDIS_VERSION + "\n"
+	return server.currentClient.addReplyVerbatim(rendered, "txt")
+}
+
+// handleLolwutCommand is LOLWUT [VERSION <version>] [<args> ...], the art of
+// the version given or of the one of the server. The versions without art
+// just tell the version of the server.
+func (server *RedisServer) handleLolwutCommand(cmd string, args []interface{}) []byte {
+	version := REDIS_VERSION
+	if len(args) >= 2 {
+		if option, _ := args[0].(string); strings.EqualFold(option, "VERSION") {
+			arg, _ := args[1].(string)
+			n, err := strconv.ParseInt(arg, 10, 64)
+			if err != nil {
+				return []byte("-ERR value is not an integer or out of range\r\n")
+			}
+			version = fmt.Sprintf("%d.0.0", uint32(n))
+			args = args[2:]
+		}
+	}
+
+	switch {
+	case strings.HasPrefix(version, "5.") && !strings.HasPrefix(version, "5.9"),
+		strings.HasPrefix(version, "4.9"):
+		return server.lolwut5(args)
+	case strings.HasPrefix(version, "6.") && !strings.HasPrefix(version, "6.9"),
+		strings.HasPrefix(version, "5.9"):
+		return server.lolwut6(args)
+	}
+	return server.currentClient.addReplyVerbatim("Redis ver. "+REDIS_VERSION+"\n", "txt")
+}
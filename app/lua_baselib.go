@@ -0,0 +1,295 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Helpers to check the arguments of the Go functions, n counts from 1
+
+func (L *luaState) argError(n int, msg string) {
+	L.runtimeError("bad argument #%d to '%s' (%s)", n, L.goFunc, msg)
+}
+
+func (L *luaState) typeError(args []luaValue, n int, expected string) {
+	got := "no value"
+	if n <= len(args) {
+		got = luaTypeName(args[n-1])
+	}
+	L.argError(n, expected+" expected, got "+got)
+}
+
+func luaArg(args []luaValue, n int) luaValue {
+	if n <= len(args) {
+		return args[n-1]
+	}
+	return nil
+}
+
+func (L *luaState) checkAny(args []luaValue, n int) luaValue {
+	if n > len(args) {
+		L.argError(n, "value expected")
+	}
+	return args[n-1]
+}
+
+func (L *luaState) checkTable(args []luaValue, n int) *luaTable {
+	t, ok := luaArg(args, n).(*luaTable)
+	if !ok {
+		L.typeError(args, n, "table")
+	}
+	return t
+}
+
+func (L *luaState) checkNumber(args []luaValue, n int) float64 {
+	v, ok := luaToNumber(luaArg(args, n))
+	if !ok {
+		L.typeError(args, n, "number")
+	}
+	return v
+}
+
+func (L *luaState) checkInt(args []luaValue, n int) int {
+	return int(L.checkNumber(args, n))
+}
+
+func (L *luaState) optNumber(args []luaValue, n int, def float64) float64 {
+	if luaArg(args, n) == nil {
+		return def
+	}
+	return L.checkNumber(args, n)
+}
+
+func (L *luaState) optInt(args []luaValue, n int, def int) int {
+	return int(L.optNumber(args, n, float64(def)))
+}
+
+func (L *luaState) checkString(args []luaValue, n int) string {
+	s, ok := luaToString(luaArg(args, n))
+	if !ok {
+		L.typeError(args, n, "string")
+	}
+	return s
+}
+
+func (L *luaState) optString(args []luaValue, n int, def string) string {
+	if luaArg(args, n) == nil {
+		return def
+	}
+	return L.checkString(args, n)
+}
+
+// tostring converts any value, with the __tostring metamethod of tables
+func (L *luaState) tostring(v luaValue) string {
+	if t, ok := v.(*luaTable); ok {
+		if h := t.metaField("__tostring"); h != nil {
+			s, ok := luaFirst(L.call(h, []luaValue{t})).(string)
+			if !ok {
+				L.runtimeError("'__tostring' must return a string")
+			}
+			return s
+		}
+	}
+	return luaAnyToString(v)
+}
+
+func (L *luaState) openBaseLib() {
+	g := L.globals
+	g.set("_G", g)
+	g.set("_VERSION", "Lua 5.1")
+
+	L.register(g, "assert", func(L *luaState, args []luaValue) []luaValue {
+		L.checkAny(args, 1)
+		if !luaToBoolean(args[0]) {
+			L.raise(L.optString(args, 2, "assertion failed!"))
+		}
+		return args
+	})
+	L.register(g, "error", func(L *luaState, args []luaValue) []luaValue {
+		level := L.optInt(args, 2, 1)
+		msg := luaArg(args, 1)
+		if s, ok := msg.(string); ok && level > 0 {
+			msg = L.where(level) + s
+		}
+		L.raise(msg)
+		return nil
+	})
+	L.register(g, "getmetatable", func(L *luaState, args []luaValue) []luaValue {
+		var meta *luaTable
+		switch v := L.checkAny(args, 1).(type) {
+		case *luaTable:
+			meta = v.meta
+		case string:
+			meta = L.stringMeta
+		}
+		if meta == nil {
+			return []luaValue{nil}
+		}
+		if protected := meta.getStr("__metatable"); protected != nil {
+			return []luaValue{protected}
+		}
+		return []luaValue{meta}
+	})
+	L.register(g, "setmetatable", func(L *luaState, args []luaValue) []luaValue {
+		t := L.checkTable(args, 1)
+		meta, ok := luaArg(args, 2).(*luaTable)
+		if !ok && luaArg(args, 2) != nil {
+			L.typeError(args, 2, "nil or table")
+		}
+		if t.metaField("__metatable") != nil {
+			L.runtimeError("cannot change a protected metatable")
+		}
+		if t.readonly {
+			L.runtimeError("Attempt to modify a readonly table")
+		}
+		t.meta = meta
+		return []luaValue{t}
+	})
+	L.register(g, "rawequal", func(L *luaState, args []luaValue) []luaValue {
+		L.checkAny(args, 1)
+		L.checkAny(args, 2)
+		return []luaValue{luaRawEqual(args[0], args[1])}
+	})
+	L.register(g, "rawget", func(L *luaState, args []luaValue) []luaValue {
+		t := L.checkTable(args, 1)
+		return []luaValue{t.get(L.checkAny(args, 2))}
+	})
+	L.register(g, "rawset", func(L *luaState, args []luaValue) []luaValue {
+		t := L.checkTable(args, 1)
+		L.checkAny(args, 2)
+		L.checkAny(args, 3)
+		if t.readonly {
+			L.runtimeError("Attempt to modify a readonly table")
+		}
+		L.checkTableKey(args[1])
+		t.set(args[1], args[2])
+		return []luaValue{t}
+	})
+	next := &luaGoFunction{name: "next", fn: func(L *luaState, args []luaValue) []luaValue {
+		t := L.checkTable(args, 1)
+		key, value, ok := t.next(luaArg(args, 2))
+		if !ok {
+			L.runtimeError("invalid key to 'next'")
+		}
+		if key == nil {
+			return []luaValue{nil}
+		}
+		return []luaValue{key, value}
+	}}
+	g.set("next", next)
+	L.register(g, "pairs", func(L *luaState, args []luaValue) []luaValue {
+		return []luaValue{next, L.checkTable(args, 1), nil}
+	})
+	ipairsIter := &luaGoFunction{name: "ipairs_iter", fn: func(L *luaState, args []luaValue) []luaValue {
+		i := L.checkInt(args, 2) + 1
+		v := L.index(args[0], float64(i), nil)
+		if v == nil {
+			return []luaValue{nil}
+		}
+		return []luaValue{float64(i), v}
+	}}
+	L.register(g, "ipairs", func(L *luaState, args []luaValue) []luaValue {
+		return []luaValue{ipairsIter, L.checkTable(args, 1), float64(0)}
+	})
+	L.register(g, "pcall", func(L *luaState, args []luaValue) []luaValue {
+		fn := L.checkAny(args, 1)
+		rets, err := L.pcall(fn, args[1:])
+		if err != nil {
+			return []luaValue{false, err.value}
+		}
+		return append([]luaValue{true}, rets...)
+	})
+	L.register(g, "xpcall", func(L *luaState, args []luaValue) []luaValue {
+		L.checkAny(args, 2)
+		rets, err := L.xpcall(args[0], nil, func(L *luaState, err luaValue) luaValue {
+			return luaFirst(L.call(args[1], []luaValue{err}))
+		})
+		if err != nil {
+			return []luaValue{false, err.value}
+		}
+		return append([]luaValue{true}, rets...)
+	})
+	L.register(g, "select", func(L *luaState, args []luaValue) []luaValue {
+		if s, ok := luaArg(args, 1).(string); ok && s == "#" {
+			return []luaValue{float64(len(args) - 1)}
+		}
+		n := L.checkInt(args, 1)
+		if n < 0 {
+			n = len(args) + n
+		} else if n == 0 {
+			L.argError(1, "index out of range")
+		}
+		if n < 0 {
+			L.argError(1, "index out of range")
+		}
+		if n >= len(args) {
+			return nil
+		}
+		return args[n:]
+	})
+	L.register(g, "tonumber", func(L *luaState, args []luaValue) []luaValue {
+		base := L.optInt(args, 2, 10)
+		if base == 10 {
+			n, ok := luaToNumber(L.checkAny(args, 1))
+			if !ok {
+				return []luaValue{nil}
+			}
+			return []luaValue{n}
+		}
+		if base < 2 || base > 36 {
+			L.argError(2, "base out of range")
+		}
+		s := strings.ToLower(strings.TrimSpace(L.checkString(args, 1)))
+		n, err := strconv.ParseInt(s, base, 64)
+		if err != nil {
+			return []luaValue{nil}
+		}
+		return []luaValue{float64(n)}
+	})
+	L.register(g, "tostring", func(L *luaState, args []luaValue) []luaValue {
+		return []luaValue{L.tostring(L.checkAny(args, 1))}
+	})
+	L.register(g, "type", func(L *luaState, args []luaValue) []luaValue {
+		return []luaValue{luaTypeName(L.checkAny(args, 1))}
+	})
+	L.register(g, "unpack", func(L *luaState, args []luaValue) []luaValue {
+		t := L.checkTable(args, 1)
+		i := L.optInt(args, 2, 1)
+		j := L.optInt(args, 3, t.length())
+		if i > j {
+			return nil
+		}
+		if j-i >= 8000 {
+			L.runtimeError("too many results to unpack")
+		}
+		values := make([]luaValue, 0, j-i+1)
+		for k := i; k <= j; k++ {
+			values = append(values, t.getInt(k))
+		}
+		return values
+	})
+	L.register(g, "loadstring", func(L *luaState, args []luaValue) []luaValue {
+		src := L.checkString(args, 1)
+		chunk := L.optString(args, 2, src)
+		f, err := L.load(src, luaChunkID(chunk))
+		if err != nil {
+			return []luaValue{nil, err.Error()}
+		}
+		return []luaValue{f}
+	})
+}
+
+// luaChunkID is how a chunk loaded from a string shows in the messages
+func luaChunkID(source string) string {
+	if strings.HasPrefix(source, "=") || strings.HasPrefix(source, "@") {
+		return source[1:]
+	}
+	line := source
+	if i := strings.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i] + "..."
+	}
+	if len(line) > 45 {
+		line = line[:45] + "..."
+	}
+	return `[string "` + line + `"]`
+}
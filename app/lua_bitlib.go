@@ -0,0 +1,92 @@
+package main
+
+import (
+	"math"
+	"math/bits"
+)
+
+// The bit library of Redis, LuaBitOp 1.0.2: bitwise operations on numbers
+// taken as 32-bit integers, returning signed ones
+
+// luaToBit converts a number to 32 bits the way LuaBitOp does, rounding to
+// the nearest integer and wrapping around
+func luaToBit(n float64) uint32 {
+	if math.IsNaN(n) || math.IsInf(n, 0) {
+		return 0
+	}
+	return uint32(int64(math.Mod(math.RoundToEven(n), 1<<32)))
+}
+
+func luaBitResult(b uint32) []luaValue {
+	return []luaValue{float64(int32(b))}
+}
+
+func (L *luaState) openBitLib() {
+	lib := newLuaTable(0, 16)
+	L.globals.set("bit", lib)
+
+	checkBit := func(L *luaState, args []luaValue, n int) uint32 {
+		return luaToBit(L.checkNumber(args, n))
+	}
+
+	L.register(lib, "tobit", func(L *luaState, args []luaValue) []luaValue {
+		return luaBitResult(checkBit(L, args, 1))
+	})
+	L.register(lib, "bnot", func(L *luaState, args []luaValue) []luaValue {
+		return luaBitResult(^checkBit(L, args, 1))
+	})
+	variadic := map[string]func(a, b uint32) uint32{
+		"band": func(a, b uint32) uint32 { return a & b },
+		"bor":  func(a, b uint32) uint32 { return a | b },
+		"bxor": func(a, b uint32) uint32 { return a ^ b },
+	}
+	for name, op := range variadic {
+		op := op
+		L.register(lib, name, func(L *luaState, args []luaValue) []luaValue {
+			b := checkBit(L, args, 1)
+			for i := 2; i <= len(args); i++ {
+				b = op(b, checkBit(L, args, i))
+			}
+			return luaBitResult(b)
+		})
+	}
+	shifts := map[string]func(b uint32, n uint) uint32{
+		"lshift":  func(b uint32, n uint) uint32 { return b << n },
+		"rshift":  func(b uint32, n uint) uint32 { return b >> n },
+		"arshift": func(b uint32, n uint) uint32 { return uint32(int32(b) >> n) },
+		"rol":     func(b uint32, n uint) uint32 { return bits.RotateLeft32(b, int(n)) },
+		"ror":     func(b uint32, n uint) uint32 { return bits.RotateLeft32(b, -int(n)) },
+	}
+	for name, op := range shifts {
+		op := op
+		L.register(lib, name, func(L *luaState, args []luaValue) []luaValue {
+			b := checkBit(L, args, 1)
+			n := checkBit(L, args, 2) & 31
+			return luaBitResult(op(b, uint(n)))
+		})
+	}
+	L.register(lib, "bswap", func(L *luaState, args []luaValue) []luaValue {
+		return luaBitResult(bits.ReverseBytes32(checkBit(L, args, 1)))
+	})
+	L.register(lib, "tohex", func(L *luaState, args []luaValue) []luaValue {
+		b := checkBit(L, args, 1)
+		n := 8
+		if luaArg(args, 2) != nil {
+			n = int(int32(checkBit(L, args, 2)))
+		}
+		digits := "0123456789abcdef"
+		if n < 0 {
+			n = -n
+			digits = "0123456789ABCDEF"
+		}
+		if n > 8 {
+			n = 8
+		}
+		buf := make([]byte, n)
+		for i := n - 1; i >= 0; i-- {
+			buf[i] = digits[b&15]
+			b >>= 4
+		}
+		return []luaValue{string(buf)}
+	})
+}
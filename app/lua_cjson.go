@@ -0,0 +1,575 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// The cjson library of Redis, lua-cjson 2.1.0: cjson.encode, cjson.decode
+// and the functions changing how they behave
+
+// luaLightUserdata is a bare value the scripts can only compare, like
+// cjson.null
+type luaLightUserdata struct {
+	name string
+}
+
+type cjsonConfig struct {
+	encodeSparseConvert bool
+	encodeSparseRatio   int
+	encodeSparseSafe    int
+	encodeMaxDepth      int
+	decodeMaxDepth      int
+	encodePrecision     int
+	encodeKeepBuffer    bool
+	encodeInvalidNums   int // 0 error, 1 as is, 2 as null
+	decodeInvalidNums   bool
+}
+
+func (L *luaState) openCjsonLib() {
+	L.globals.set("cjson", newCjsonLib(L))
+}
+
+func newCjsonLib(L *luaState) *luaTable {
+	cfg := &cjsonConfig{
+		encodeSparseRatio: 2,
+		encodeSparseSafe:  10,
+		encodeMaxDepth:    1000,
+		decodeMaxDepth:    1000,
+		encodePrecision:   14,
+		encodeKeepBuffer:  true,
+		decodeInvalidNums: true,
+	}
+	null := &luaLightUserdata{name: "null"}
+
+	lib := newLuaTable(0, 16)
+	L.register(lib, "encode", func(L *luaState, args []luaValue) []luaValue {
+		if len(args) != 1 {
+			L.argError(1, "expected 1 argument")
+		}
+		var b strings.Builder
+		cjsonEncode(L, cfg, null, &b, args[0], 0)
+		return []luaValue{b.String()}
+	})
+	L.register(lib, "decode", func(L *luaState, args []luaValue) []luaValue {
+		if len(args) != 1 {
+			L.argError(1, "expected 1 argument")
+		}
+		s := L.checkString(args, 1)
+		d := &cjsonDecoder{L: L, cfg: cfg, null: null, s: s}
+		v := d.value(0)
+		if tok := d.token(); tok.kind != cjsonTokenEnd {
+			d.error("the end", tok)
+		}
+		return []luaValue{v}
+	})
+	L.register(lib, "encode_sparse_array", func(L *luaState, args []luaValue) []luaValue {
+		if luaArg(args, 1) != nil {
+			cfg.encodeSparseConvert = cjsonCheckBool(L, args, 1)
+		}
+		if luaArg(args, 2) != nil {
+			cfg.encodeSparseRatio = cjsonCheckInt(L, args, 2, 0, math.MaxInt32)
+		}
+		if luaArg(args, 3) != nil {
+			cfg.encodeSparseSafe = cjsonCheckInt(L, args, 3, 0, math.MaxInt32)
+		}
+		return []luaValue{cfg.encodeSparseConvert, float64(cfg.encodeSparseRatio), float64(cfg.encodeSparseSafe)}
+	})
+	L.register(lib, "encode_max_depth", func(L *luaState, args []luaValue) []luaValue {
+		if luaArg(args, 1) != nil {
+			cfg.encodeMaxDepth = cjsonCheckInt(L, args, 1, 1, math.MaxInt32)
+		}
+		return []luaValue{float64(cfg.encodeMaxDepth)}
+	})
+	L.register(lib, "decode_max_depth", func(L *luaState, args []luaValue) []luaValue {
+		if luaArg(args, 1) != nil {
+			cfg.decodeMaxDepth = cjsonCheckInt(L, args, 1, 1, math.MaxInt32)
+		}
+		return []luaValue{float64(cfg.decodeMaxDepth)}
+	})
+	L.register(lib, "encode_number_precision", func(L *luaState, args []luaValue) []luaValue {
+		if luaArg(args, 1) != nil {
+			cfg.encodePrecision = cjsonCheckInt(L, args, 1, 1, 14)
+		}
+		return []luaValue{float64(cfg.encodePrecision)}
+	})
+	L.register(lib, "encode_keep_buffer", func(L *luaState, args []luaValue) []luaValue {
+		if luaArg(args, 1) != nil {
+			cfg.encodeKeepBuffer = cjsonCheckBool(L, args, 1)
+		}
+		return []luaValue{cfg.encodeKeepBuffer}
+	})
+	L.register(lib, "encode_invalid_numbers", func(L *luaState, args []luaValue) []luaValue {
+		if s, ok := luaArg(args, 1).(string); ok && s == "null" {
+			cfg.encodeInvalidNums = 2
+		} else if luaArg(args, 1) != nil {
+			cfg.encodeInvalidNums = boolToInt(cjsonCheckBool(L, args, 1))
+		}
+		if cfg.encodeInvalidNums == 2 {
+			return []luaValue{"null"}
+		}
+		return []luaValue{cfg.encodeInvalidNums == 1}
+	})
+	L.register(lib, "decode_invalid_numbers", func(L *luaState, args []luaValue) []luaValue {
+		if luaArg(args, 1) != nil {
+			cfg.decodeInvalidNums = cjsonCheckBool(L, args, 1)
+		}
+		return []luaValue{cfg.decodeInvalidNums}
+	})
+	L.register(lib, "new", func(L *luaState, args []luaValue) []luaValue {
+		return []luaValue{newCjsonLib(L)}
+	})
+	lib.set("null", null)
+	lib.set("_NAME", "cjson")
+	lib.set("_VERSION", "2.1.0")
+	return lib
+}
+
+// cjsonCheckBool reads an on/off setting, a boolean or "on" and "off"
+func cjsonCheckBool(L *luaState, args []luaValue, n int) bool {
+	switch v := args[n-1].(type) {
+	case bool:
+		return v
+	case string:
+		if v == "on" {
+			return true
+		} else if v == "off" {
+			return false
+		}
+	}
+	L.argError(n, "invalid option")
+	return false
+}
+
+func cjsonCheckInt(L *luaState, args []luaValue, n, lo, hi int) int {
+	v := L.checkInt(args, n)
+	if v < lo || v > hi {
+		L.argError(n, "expected integer between "+strconv.Itoa(lo)+" and "+strconv.Itoa(hi))
+	}
+	return v
+}
+
+func cjsonEncode(L *luaState, cfg *cjsonConfig, null luaValue, b *strings.Builder, v luaValue, depth int) {
+	switch v := v.(type) {
+	case nil:
+		b.WriteString("null")
+	case bool:
+		if v {
+			b.WriteString("true")
+		} else {
+			b.WriteString("false")
+		}
+	case float64:
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			switch cfg.encodeInvalidNums {
+			case 0:
+				L.runtimeError("Cannot serialise number: must not be NaN or Inf")
+			case 2:
+				b.WriteString("null")
+				return
+			}
+		}
+		b.WriteString(cjsonFormatNumber(v, cfg.encodePrecision))
+	case string:
+		cjsonEncodeString(b, v)
+	case *luaTable:
+		depth++
+		if depth > cfg.encodeMaxDepth {
+			L.runtimeError("Cannot serialise, excessive nesting (%d)", depth)
+		}
+		if n := cjsonArrayLength(L, cfg, v); n > 0 {
+			b.WriteByte('[')
+			for i := 1; i <= n; i++ {
+				if i > 1 {
+					b.WriteByte(',')
+				}
+				cjsonEncode(L, cfg, null, b, v.getInt(i), depth)
+			}
+			b.WriteByte(']')
+			return
+		}
+		b.WriteByte('{')
+		first := true
+		for key, value, _ := v.next(nil); key != nil; key, value, _ = v.next(key) {
+			if !first {
+				b.WriteByte(',')
+			}
+			first = false
+			switch k := key.(type) {
+			case string:
+				cjsonEncodeString(b, k)
+			case float64:
+				b.WriteByte('"')
+				b.WriteString(cjsonFormatNumber(k, cfg.encodePrecision))
+				b.WriteByte('"')
+			default:
+				L.runtimeError("Cannot serialise %s: table key must be a number or string", luaTypeName(key))
+			}
+			b.WriteByte(':')
+			cjsonEncode(L, cfg, null, b, value, depth)
+		}
+		b.WriteByte('}')
+	default:
+		if v == null {
+			b.WriteString("null")
+			return
+		}
+		L.runtimeError("Cannot serialise %s: type not supported", luaTypeName(v))
+	}
+}
+
+// cjsonArrayLength is the length of the table when it is encoded as an
+// array, 0 for an object. An array with too many holes is an error, or an
+// object when encode_sparse_array converts them.
+func cjsonArrayLength(L *luaState, cfg *cjsonConfig, t *luaTable) int {
+	last, items := 0, 0
+	for key, _, _ := t.next(nil); key != nil; key, _, _ = t.next(key) {
+		k, ok := key.(float64)
+		if !ok || k < 1 || k != math.Floor(k) {
+			return 0
+		}
+		if int(k) > last {
+			last = int(k)
+		}
+		items++
+	}
+	if cfg.encodeSparseRatio > 0 && last > items*cfg.encodeSparseRatio && last > cfg.encodeSparseSafe {
+		if !cfg.encodeSparseConvert {
+			L.runtimeError("Cannot serialise table: excessively sparse array")
+		}
+		return 0
+	}
+	return last
+}
+
+// cjsonFormatNumber is %.14g, with the precision of encode_number_precision
+func cjsonFormatNumber(n float64, precision int) string {
+	switch {
+	case math.IsInf(n, 1):
+		return "inf"
+	case math.IsInf(n, -1):
+		return "-inf"
+	case math.IsNaN(n):
+		return "nan"
+	}
+	return strconv.FormatFloat(n, 'g', precision, 64)
+}
+
+func cjsonEncodeString(b *strings.Builder, s string) {
+	const hex = "0123456789abcdef"
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '/':
+			b.WriteString(`\/`)
+		case '\b':
+			b.WriteString(`\b`)
+		case '\f':
+			b.WriteString(`\f`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		default:
+			if c < 0x20 || c == 0x7f {
+				b.WriteString(`\u00`)
+				b.WriteByte(hex[c>>4])
+				b.WriteByte(hex[c&15])
+			} else {
+				b.WriteByte(c)
+			}
+		}
+	}
+	b.WriteByte('"')
+}
+
+// Tokens of the decoder
+const (
+	cjsonTokenObjBegin = iota
+	cjsonTokenObjEnd
+	cjsonTokenArrBegin
+	cjsonTokenArrEnd
+	cjsonTokenString
+	cjsonTokenNumber
+	cjsonTokenBoolean
+	cjsonTokenNull
+	cjsonTokenColon
+	cjsonTokenComma
+	cjsonTokenEnd
+	cjsonTokenError
+)
+
+var cjsonTokenNames = []string{
+	"T_OBJ_BEGIN", "T_OBJ_END", "T_ARR_BEGIN", "T_ARR_END", "T_STRING",
+	"T_NUMBER", "T_BOOLEAN", "T_NULL", "T_COLON", "T_COMMA", "T_END", "T_ERROR",
+}
+
+type cjsonToken struct {
+	kind  int
+	index int
+	value luaValue
+	err   string
+}
+
+type cjsonDecoder struct {
+	L    *luaState
+	cfg  *cjsonConfig
+	null luaValue
+	s    string
+	pos  int
+}
+
+// error raises "Expected <what> but found <token> at character <n>"
+func (d *cjsonDecoder) error(expected string, tok cjsonToken) {
+	found := cjsonTokenNames[tok.kind]
+	if tok.kind == cjsonTokenError {
+		found = tok.err
+	}
+	d.L.runtimeError("Expected %s but found %s at character %d", expected, found, tok.index+1)
+}
+
+func (d *cjsonDecoder) token() cjsonToken {
+	for d.pos < len(d.s) && strings.IndexByte(" \t\n\r", d.s[d.pos]) >= 0 {
+		d.pos++
+	}
+	tok := cjsonToken{index: d.pos}
+	if d.pos >= len(d.s) {
+		tok.kind = cjsonTokenEnd
+		return tok
+	}
+
+	c := d.s[d.pos]
+	switch c {
+	case '{':
+		tok.kind = cjsonTokenObjBegin
+	case '}':
+		tok.kind = cjsonTokenObjEnd
+	case '[':
+		tok.kind = cjsonTokenArrBegin
+	case ']':
+		tok.kind = cjsonTokenArrEnd
+	case ':':
+		tok.kind = cjsonTokenColon
+	case ',':
+		tok.kind = cjsonTokenComma
+	case '"':
+		return d.stringToken()
+	default:
+		switch {
+		case c == '-' || (c >= '0' && c <= '9'):
+			return d.numberToken()
+		case strings.HasPrefix(d.s[d.pos:], "true"):
+			tok.kind, tok.value = cjsonTokenBoolean, true
+			d.pos += 4
+		case strings.HasPrefix(d.s[d.pos:], "false"):
+			tok.kind, tok.value = cjsonTokenBoolean, false
+			d.pos += 5
+		case strings.HasPrefix(d.s[d.pos:], "null"):
+			tok.kind, tok.value = cjsonTokenNull, d.null
+			d.pos += 4
+		case d.cfg.decodeInvalidNums && (c == 'i' || c == 'I' || c == 'n' || c == 'N'):
+			return d.numberToken()
+		default:
+			tok.kind, tok.err = cjsonTokenError, "invalid token"
+		}
+		return tok
+	}
+	d.pos++
+	return tok
+}
+
+func (d *cjsonDecoder) numberToken() cjsonToken {
+	tok := cjsonToken{index: d.pos, kind: cjsonTokenNumber}
+	end := d.pos
+	for end < len(d.s) && strings.IndexByte("+-0123456789.eExXaAbBcCdDfFiInNtTyY", d.s[end]) >= 0 {
+		end++
+	}
+	text := d.s[d.pos:end]
+	var n float64
+	var err error
+	lower := strings.ToLower(strings.TrimLeft(text, "+-"))
+	switch {
+	case !d.cfg.decodeInvalidNums && (strings.HasPrefix(lower, "0x") || strings.HasPrefix(lower, "inf") || strings.HasPrefix(lower, "nan")):
+		err = strconv.ErrSyntax
+	case strings.HasPrefix(lower, "0x"):
+		var u uint64
+		u, err = strconv.ParseUint(lower[2:], 16, 64)
+		n = float64(u)
+		if strings.HasPrefix(text, "-") {
+			n = -n
+		}
+	default:
+		n, err = strconv.ParseFloat(text, 64)
+		if numErr, ok := err.(*strconv.NumError); ok && numErr.Err == strconv.ErrRange {
+			err = nil
+		}
+	}
+	if err != nil {
+		tok.kind, tok.err = cjsonTokenError, "invalid number"
+		return tok
+	}
+	tok.value = n
+	d.pos = end
+	return tok
+}
+
+func (d *cjsonDecoder) stringToken() cjsonToken {
+	tok := cjsonToken{index: d.pos, kind: cjsonTokenString}
+	var b strings.Builder
+	i := d.pos + 1
+	for {
+		if i >= len(d.s) {
+			tok.kind, tok.err = cjsonTokenError, "unexpected end of string"
+			return tok
+		}
+		c := d.s[i]
+		if c == '"' {
+			break
+		}
+		if c != '\\' {
+			b.WriteByte(c)
+			i++
+			continue
+		}
+		if i+1 >= len(d.s) {
+			tok.kind, tok.err = cjsonTokenError, "unexpected end of string"
+			return tok
+		}
+		switch d.s[i+1] {
+		case '"', '\\', '/':
+			b.WriteByte(d.s[i+1])
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'u':
+			r, n := cjsonDecodeUnicodeEscape(d.s[i:])
+			if n == 0 {
+				tok.kind, tok.err = cjsonTokenError, "invalid unicode escape code"
+				return tok
+			}
+			var buf [utf8.UTFMax]byte
+			b.Write(buf[:utf8.EncodeRune(buf[:], r)])
+			i += n
+			continue
+		default:
+			tok.kind, tok.err = cjsonTokenError, "invalid escape code"
+			return tok
+		}
+		i += 2
+	}
+	tok.value = b.String()
+	d.pos = i + 1
+	return tok
+}
+
+// cjsonDecodeUnicodeEscape decodes \uXXXX, or a surrogate pair of them,
+// returning how many bytes it took, 0 when it is invalid
+func cjsonDecodeUnicodeEscape(s string) (rune, int) {
+	hex4 := func(s string) (rune, bool) {
+		if len(s) < 6 || s[0] != '\\' || s[1] != 'u' {
+			return 0, false
+		}
+		n, err := strconv.ParseUint(s[2:6], 16, 32)
+		return rune(n), err == nil
+	}
+	r, ok := hex4(s)
+	if !ok {
+		return 0, 0
+	}
+	if r >= 0xdc00 && r <= 0xdfff {
+		return 0, 0
+	}
+	if r >= 0xd800 && r <= 0xdbff {
+		low, ok := hex4(s[6:])
+		if !ok || low < 0xdc00 || low > 0xdfff {
+			return 0, 0
+		}
+		return (r-0xd800)<<10 | (low - 0xdc00) + 0x10000, 12
+	}
+	return r, 6
+}
+
+func (d *cjsonDecoder) value(depth int) luaValue {
+	tok := d.token()
+	switch tok.kind {
+	case cjsonTokenString, cjsonTokenNumber, cjsonTokenBoolean, cjsonTokenNull:
+		return tok.value
+	case cjsonTokenObjBegin:
+		return d.object(tok, depth+1)
+	case cjsonTokenArrBegin:
+		return d.array(tok, depth+1)
+	}
+	d.error("value", tok)
+	return nil
+}
+
+func (d *cjsonDecoder) checkDepth(tok cjsonToken, depth int) {
+	if depth > d.cfg.decodeMaxDepth {
+		d.L.runtimeError("Found too many nested data structures (%d) at character %d", depth, tok.index+1)
+	}
+}
+
+func (d *cjsonDecoder) object(start cjsonToken, depth int) luaValue {
+	d.checkDepth(start, depth)
+	t := newLuaTable(0, 0)
+	save := d.pos
+	if tok := d.token(); tok.kind == cjsonTokenObjEnd {
+		return t
+	}
+	d.pos = save
+	for {
+		tok := d.token()
+		if tok.kind != cjsonTokenString {
+			d.error("object key string", tok)
+		}
+		key := tok.value
+		if tok = d.token(); tok.kind != cjsonTokenColon {
+			d.error("colon", tok)
+		}
+		t.set(key, d.value(depth))
+
+		tok = d.token()
+		if tok.kind == cjsonTokenObjEnd {
+			return t
+		}
+		if tok.kind != cjsonTokenComma {
+			d.error("comma or object end", tok)
+		}
+	}
+}
+
+func (d *cjsonDecoder) array(start cjsonToken, depth int) luaValue {
+	d.checkDepth(start, depth)
+	t := newLuaTable(0, 0)
+	save := d.pos
+	if tok := d.token(); tok.kind == cjsonTokenArrEnd {
+		return t
+	}
+	d.pos = save
+	for i := 1; ; i++ {
+		t.set(float64(i), d.value(depth))
+		tok := d.token()
+		if tok.kind == cjsonTokenArrEnd {
+			return t
+		}
+		if tok.kind != cjsonTokenComma {
+			d.error("comma or array end", tok)
+		}
+	}
+}
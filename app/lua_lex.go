@@ -0,0 +1,373 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Lua tokens, the single character ones are their own byte
+const (
+	tkEOF = 256 + iota
+	tkName
+	tkString
+	tkNumber
+	tkAnd
+	tkBreak
+	tkDo
+	tkElse
+	tkElseif
+	tkEnd
+	tkFalse
+	tkFor
+	tkFunction
+	tkIf
+	tkIn
+	tkLocal
+	tkNil
+	tkNot
+	tkOr
+	tkRepeat
+	tkReturn
+	tkThen
+	tkTrue
+	tkUntil
+	tkWhile
+	tkConcat // ..
+	tkDots   // ...
+	tkEq     // ==
+	tkGe     // >=
+	tkLe     // <=
+	tkNe     // ~=
+)
+
+var luaKeywords = map[string]int{
+	"and": tkAnd, "break": tkBreak, "do": tkDo, "else": tkElse, "elseif": tkElseif,
+	"end": tkEnd, "false": tkFalse, "for": tkFor, "function": tkFunction, "if": tkIf,
+	"in": tkIn, "local": tkLocal, "nil": tkNil, "not": tkNot, "or": tkOr,
+	"repeat": tkRepeat, "return": tkReturn, "then": tkThen, "true": tkTrue,
+	"until": tkUntil, "while": tkWhile,
+}
+
+type luaToken struct {
+	kind int
+	str  string  // names and strings
+	num  float64 // numbers
+	line int
+}
+
+// luaLexer splits a chunk into tokens, one of lookahead
+type luaLexer struct {
+	src   string
+	pos   int
+	line  int
+	chunk string // name used in the error messages, like user_script
+
+	tok   luaToken
+	ahead luaToken
+}
+
+func newLuaLexer(src, chunk string) *luaLexer {
+	lx := &luaLexer{src: src, line: 1, chunk: chunk}
+	lx.ahead.kind = -1
+	// a first line starting with # is skipped, like in the standalone interpreter
+	if strings.HasPrefix(src, "#") {
+		for lx.pos < len(src) && src[lx.pos] != '\n' {
+			lx.pos++
+		}
+	}
+	return lx
+}
+
+// luaSyntaxError is raised by the lexer and the parser, and returned by
+// luaCompile
+type luaSyntaxError struct {
+	msg string
+}
+
+func (err *luaSyntaxError) Error() string {
+	return err.msg
+}
+
+func (lx *luaLexer) errorf(format string, args ...interface{}) {
+	panic(&luaSyntaxError{fmt.Sprintf("%s:%d: %s", lx.chunk, lx.line, fmt.Sprintf(format, args...))})
+}
+
+// errorNear reports an error at the current token, as Lua does
+func (lx *luaLexer) errorNear(msg string) {
+	lx.errorf("%s near '%s'", msg, lx.tokenText(lx.tok))
+}
+
+func (lx *luaLexer) tokenText(tok luaToken) string {
+	switch tok.kind {
+	case tkEOF:
+		return "<eof>"
+	case tkName, tkString:
+		return tok.str
+	case tkNumber:
+		return luaNumberToString(tok.num)
+	}
+	return luaTokenName(tok.kind)
+}
+
+func luaTokenName(kind int) string {
+	for name, k := range luaKeywords {
+		if k == kind {
+			return name
+		}
+	}
+	switch kind {
+	case tkEOF:
+		return "<eof>"
+	case tkName:
+		return "<name>"
+	case tkString:
+		return "<string>"
+	case tkNumber:
+		return "<number>"
+	case tkConcat:
+		return ".."
+	case tkDots:
+		return "..."
+	case tkEq:
+		return "=="
+	case tkGe:
+		return ">="
+	case tkLe:
+		return "<="
+	case tkNe:
+		return "~="
+	}
+	return string(rune(kind))
+}
+
+// next moves to the following token
+func (lx *luaLexer) next() {
+	if lx.ahead.kind != -1 {
+		lx.tok = lx.ahead
+		lx.ahead.kind = -1
+		return
+	}
+	lx.tok = lx.scan()
+}
+
+// peek returns the token after the current one
+func (lx *luaLexer) peek() luaToken {
+	if lx.ahead.kind == -1 {
+		lx.ahead = lx.scan()
+	}
+	return lx.ahead
+}
+
+func (lx *luaLexer) scan() luaToken {
+	for lx.pos < len(lx.src) {
+		c := lx.src[lx.pos]
+		switch {
+		case c == '\n':
+			lx.line++
+			lx.pos++
+		case c == ' ' || c == '\t' || c == '\r' || c == '\v' || c == '\f':
+			lx.pos++
+		case c == '-' && lx.pos+1 < len(lx.src) && lx.src[lx.pos+1] == '-':
+			lx.pos += 2
+			if lx.pos < len(lx.src) && lx.src[lx.pos] == '[' {
+				if level := lx.longBracketLevel(); level >= 0 {
+					lx.readLongString(level)
+					continue
+				}
+			}
+			for lx.pos < len(lx.src) && lx.src[lx.pos] != '\n' {
+				lx.pos++
+			}
+		default:
+			return lx.scanToken()
+		}
+	}
+	return luaToken{kind: tkEOF, line: lx.line}
+}
+
+func (lx *luaLexer) scanToken() luaToken {
+	line := lx.line
+	c := lx.src[lx.pos]
+	switch {
+	case isLuaNameStart(c):
+		start := lx.pos
+		for lx.pos < len(lx.src) && isLuaNameChar(lx.src[lx.pos]) {
+			lx.pos++
+		}
+		name := lx.src[start:lx.pos]
+		if kind, ok := luaKeywords[name]; ok {
+			return luaToken{kind: kind, line: line}
+		}
+		return luaToken{kind: tkName, str: name, line: line}
+	case isDigit(c) || (c == '.' && lx.pos+1 < len(lx.src) && isDigit(lx.src[lx.pos+1])):
+		return lx.readNumber()
+	case c == '"' || c == '\'':
+		return luaToken{kind: tkString, str: lx.readString(c), line: line}
+	case c == '[':
+		if level := lx.longBracketLevel(); level >= 0 {
+			return luaToken{kind: tkString, str: lx.readLongString(level), line: line}
+		}
+		lx.pos++
+		return luaToken{kind: '[', line: line}
+	}
+
+	lx.pos++
+	next := byte(0)
+	if lx.pos < len(lx.src) {
+		next = lx.src[lx.pos]
+	}
+	switch c {
+	case '=', '<', '>', '~':
+		if next == '=' {
+			lx.pos++
+			return luaToken{kind: map[byte]int{'=': tkEq, '<': tkLe, '>': tkGe, '~': tkNe}[c], line: line}
+		}
+		if c == '~' {
+			lx.errorf("unexpected symbol near '~'")
+		}
+	case '.':
+		if next == '.' {
+			lx.pos++
+			if lx.pos < len(lx.src) && lx.src[lx.pos] == '.' {
+				lx.pos++
+				return luaToken{kind: tkDots, line: line}
+			}
+			return luaToken{kind: tkConcat, line: line}
+		}
+	case '+', '-', '*', '/', '%', '^', '#', '(', ')', '{', '}', ']', ';', ':', ',':
+	default:
+		lx.errorf("unexpected symbol near '%c'", c)
+	}
+	return luaToken{kind: int(c), line: line}
+}
+
+func isLuaNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isLuaNameChar(c byte) bool {
+	return isLuaNameStart(c) || isDigit(c)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func (lx *luaLexer) readNumber() luaToken {
+	start := lx.pos
+	for lx.pos < len(lx.src) {
+		c := lx.src[lx.pos]
+		if isLuaNameChar(c) || c == '.' {
+			lx.pos++
+		} else if (c == '+' || c == '-') && (lx.src[lx.pos-1] == 'e' || lx.src[lx.pos-1] == 'E') &&
+			!strings.HasPrefix(strings.ToLower(lx.src[start:]), "0x") {
+			lx.pos++
+		} else {
+			break
+		}
+	}
+	text := lx.src[start:lx.pos]
+	n, ok := luaStringToNumber(text)
+	if !ok {
+		lx.errorf("malformed number near '%s'", text)
+	}
+	return luaToken{kind: tkNumber, num: n, line: lx.line}
+}
+
+func (lx *luaLexer) readString(quote byte) string {
+	lx.pos++
+	var b strings.Builder
+	for {
+		if lx.pos >= len(lx.src) {
+			lx.errorf("unfinished string near '<eof>'")
+		}
+		c := lx.src[lx.pos]
+		switch c {
+		case quote:
+			lx.pos++
+			return b.String()
+		case '\n':
+			lx.errorf("unfinished string near '%c%s'", quote, b.String())
+		case '\\':
+			lx.pos++
+			if lx.pos >= len(lx.src) {
+				continue
+			}
+			e := lx.src[lx.pos]
+			switch e {
+			case 'a':
+				b.WriteByte('\a')
+			case 'b':
+				b.WriteByte('\b')
+			case 'f':
+				b.WriteByte('\f')
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case 'v':
+				b.WriteByte('\v')
+			case '\n':
+				lx.line++
+				b.WriteByte('\n')
+			default:
+				if !isDigit(e) {
+					b.WriteByte(e)
+					break
+				}
+				n := 0
+				for i := 0; i < 3 && lx.pos < len(lx.src) && isDigit(lx.src[lx.pos]); i++ {
+					n = n*10 + int(lx.src[lx.pos]-'0')
+					lx.pos++
+				}
+				if n > 255 {
+					lx.errorf("escape sequence too large")
+				}
+				b.WriteByte(byte(n))
+				continue
+			}
+			lx.pos++
+		default:
+			b.WriteByte(c)
+			lx.pos++
+		}
+	}
+}
+
+// longBracketLevel returns the level of the [==[ opening at the current
+// position, or -1 when there is none
+func (lx *luaLexer) longBracketLevel() int {
+	i := lx.pos + 1
+	level := 0
+	for i < len(lx.src) && lx.src[i] == '=' {
+		level++
+		i++
+	}
+	if i < len(lx.src) && lx.src[i] == '[' {
+		return level
+	}
+	return -1
+}
+
+func (lx *luaLexer) readLongString(level int) string {
+	lx.pos += level + 2
+	// a newline right after the opening bracket is skipped
+	if strings.HasPrefix(lx.src[lx.pos:], "\r\n") {
+		lx.pos += 2
+		lx.line++
+	} else if lx.pos < len(lx.src) && lx.src[lx.pos] == '\n' {
+		lx.pos++
+		lx.line++
+	}
+	closing := "]" + strings.Repeat("=", level) + "]"
+	end := strings.Index(lx.src[lx.pos:], closing)
+	if end < 0 {
+		lx.errorf("unfinished long string near '<eof>'")
+	}
+	s := lx.src[lx.pos : lx.pos+end]
+	lx.line += strings.Count(s, "\n")
+	lx.pos += end + len(closing)
+	return s
+}
@@ -0,0 +1,111 @@
+package main
+
+import "math"
+
+// The PRNG behind math.random is the lrand48 of Redis, so that a script
+// draws the same numbers wherever it runs once the seed is reset
+
+const luaRand48Max = math.MaxInt32
+
+type luaRand48 struct {
+	x uint64
+}
+
+func (r *luaRand48) seed(seed int32) {
+	r.x = (uint64(uint32(seed))<<16 | 0x330e) & (1<<48 - 1)
+}
+
+func (r *luaRand48) next() int32 {
+	r.x = (r.x*0x5deece66d + 0xb) & (1<<48 - 1)
+	return int32(r.x >> 17)
+}
+
+func (L *luaState) openMathLib() {
+	lib := newLuaTable(0, 32)
+	L.globals.set("math", lib)
+	lib.set("pi", math.Pi)
+	lib.set("huge", math.Inf(1))
+
+	unary := map[string]func(float64) float64{
+		"abs": math.Abs, "ceil": math.Ceil, "floor": math.Floor, "sqrt": math.Sqrt,
+		"exp": math.Exp, "log10": math.Log10, "sin": math.Sin, "cos": math.Cos,
+		"tan": math.Tan, "asin": math.Asin, "acos": math.Acos, "atan": math.Atan,
+		"sinh": math.Sinh, "cosh": math.Cosh, "tanh": math.Tanh,
+		"deg": func(x float64) float64 { return x * 180 / math.Pi },
+		"rad": func(x float64) float64 { return x * math.Pi / 180 },
+	}
+	for name, fn := range unary {
+		fn := fn
+		L.register(lib, name, func(L *luaState, args []luaValue) []luaValue {
+			return []luaValue{fn(L.checkNumber(args, 1))}
+		})
+	}
+	L.register(lib, "log", func(L *luaState, args []luaValue) []luaValue {
+		return []luaValue{math.Log(L.checkNumber(args, 1))}
+	})
+	L.register(lib, "pow", func(L *luaState, args []luaValue) []luaValue {
+		return []luaValue{math.Pow(L.checkNumber(args, 1), L.checkNumber(args, 2))}
+	})
+	L.register(lib, "atan2", func(L *luaState, args []luaValue) []luaValue {
+		return []luaValue{math.Atan2(L.checkNumber(args, 1), L.checkNumber(args, 2))}
+	})
+	L.register(lib, "fmod", func(L *luaState, args []luaValue) []luaValue {
+		return []luaValue{math.Mod(L.checkNumber(args, 1), L.checkNumber(args, 2))}
+	})
+	L.register(lib, "modf", func(L *luaState, args []luaValue) []luaValue {
+		i, f := math.Modf(L.checkNumber(args, 1))
+		return []luaValue{i, f}
+	})
+	L.register(lib, "frexp", func(L *luaState, args []luaValue) []luaValue {
+		f, e := math.Frexp(L.checkNumber(args, 1))
+		return []luaValue{f, float64(e)}
+	})
+	L.register(lib, "ldexp", func(L *luaState, args []luaValue) []luaValue {
+		return []luaValue{math.Ldexp(L.checkNumber(args, 1), L.checkInt(args, 2))}
+	})
+	L.register(lib, "min", func(L *luaState, args []luaValue) []luaValue {
+		min := L.checkNumber(args, 1)
+		for i := 2; i <= len(args); i++ {
+			if n := L.checkNumber(args, i); n < min {
+				min = n
+			}
+		}
+		return []luaValue{min}
+	})
+	L.register(lib, "max", func(L *luaState, args []luaValue) []luaValue {
+		max := L.checkNumber(args, 1)
+		for i := 2; i <= len(args); i++ {
+			if n := L.checkNumber(args, i); n > max {
+				max = n
+			}
+		}
+		return []luaValue{max}
+	})
+
+	L.rand.seed(0)
+	L.register(lib, "random", func(L *luaState, args []luaValue) []luaValue {
+		r := float64(L.rand.next()%luaRand48Max) / luaRand48Max
+		switch len(args) {
+		case 0:
+			return []luaValue{r}
+		case 1:
+			u := L.checkInt(args, 1)
+			if u < 1 {
+				L.argError(1, "interval is empty")
+			}
+			return []luaValue{math.Floor(r*float64(u)) + 1}
+		case 2:
+			l, u := L.checkInt(args, 1), L.checkInt(args, 2)
+			if l > u {
+				L.argError(2, "interval is empty")
+			}
+			return []luaValue{math.Floor(r*float64(u-l+1)) + float64(l)}
+		}
+		L.runtimeError("wrong number of arguments")
+		return nil
+	})
+	L.register(lib, "randomseed", func(L *luaState, args []luaValue) []luaValue {
+		L.rand.seed(int32(L.checkInt(args, 1)))
+		return nil
+	})
+}
@@ -0,0 +1,747 @@
+package main
+
+import "fmt"
+
+// The parser turns a chunk into a tree the interpreter walks. Names are
+// resolved while parsing: a local is a slot of the frame of its function, an
+// upvalue an index in the cells captured by the closure, and anything else
+// a field of the globals table.
+
+type luaExpr interface{}
+
+type luaStmt interface{}
+
+type luaBlock struct {
+	stmts []luaStmt
+}
+
+// luaProto is a function as written in the source, a closure is one of its
+// instances
+type luaProto struct {
+	name     string
+	chunk    string
+	line     int
+	params   []int // slots of the parameters
+	isVararg bool
+	numSlots int
+	upvals   []luaUpvalDesc
+	body     *luaBlock
+}
+
+// luaUpvalDesc tells where a new closure takes the cell of an upvalue from:
+// a local of the enclosing function, or one of its own upvalues
+type luaUpvalDesc struct {
+	fromLocal bool
+	index     int
+}
+
+type (
+	luaConstExpr struct {
+		value luaValue
+	}
+	luaVarargExpr struct{}
+	luaLocalExpr  struct {
+		slot int
+		name string
+	}
+	luaUpvalExpr struct {
+		index int
+		name  string
+	}
+	luaGlobalExpr struct {
+		name string
+	}
+	luaIndexExpr struct {
+		obj  luaExpr
+		key  luaExpr
+		line int
+	}
+	luaCallExpr struct {
+		fn   luaExpr
+		args []luaExpr
+		line int
+	}
+	luaMethodCallExpr struct {
+		obj  luaExpr
+		name string
+		args []luaExpr
+		line int
+	}
+	luaFunctionExpr struct {
+		proto *luaProto
+	}
+	luaBinopExpr struct {
+		op          int
+		left, right luaExpr
+		line        int
+	}
+	luaUnopExpr struct {
+		op   int
+		expr luaExpr
+		line int
+	}
+	luaTableExpr struct {
+		fields []luaTableField
+		line   int
+	}
+	// luaParenExpr keeps only the first value of a call or ...
+	luaParenExpr struct {
+		expr luaExpr
+	}
+)
+
+// luaTableField is a field of a table constructor, positional when key is nil
+type luaTableField struct {
+	key   luaExpr
+	value luaExpr
+}
+
+type (
+	luaLocalStmt struct {
+		slots []int
+		exprs []luaExpr
+		line  int
+	}
+	luaLocalFunctionStmt struct {
+		slot int
+		fn   *luaFunctionExpr
+		line int
+	}
+	luaAssignStmt struct {
+		targets []luaExpr
+		exprs   []luaExpr
+		line    int
+	}
+	luaCallStmt struct {
+		call luaExpr
+		line int
+	}
+	luaDoStmt struct {
+		block *luaBlock
+	}
+	luaWhileStmt struct {
+		cond  luaExpr
+		block *luaBlock
+		line  int
+	}
+	luaRepeatStmt struct {
+		block *luaBlock
+		cond  luaExpr
+		line  int
+	}
+	luaIfStmt struct {
+		conds     []luaExpr
+		blocks    []*luaBlock
+		elseBlock *luaBlock
+		line      int
+	}
+	luaNumericForStmt struct {
+		slot               int
+		start, limit, step luaExpr
+		block              *luaBlock
+		line               int
+	}
+	luaGenericForStmt struct {
+		slots []int
+		exprs []luaExpr
+		block *luaBlock
+		line  int
+	}
+	luaReturnStmt struct {
+		exprs []luaExpr
+		line  int
+	}
+	luaBreakStmt struct{}
+)
+
+// binary operator priorities, left and right, as in lparser.c
+var luaBinaryPriority = map[int][2]int{
+	'+': {6, 6}, '-': {6, 6},
+	'*': {7, 7}, '/': {7, 7}, '%': {7, 7},
+	'^':      {10, 9},
+	tkConcat: {5, 4},
+	tkEq:     {3, 3}, tkNe: {3, 3}, '<': {3, 3}, tkLe: {3, 3}, '>': {3, 3}, tkGe: {3, 3},
+	tkAnd: {2, 2},
+	tkOr:  {1, 1},
+}
+
+const luaUnaryPriority = 8
+
+// nesting of the syntax above which the parser gives up
+const luaMaxSyntaxLevels = 200
+
+type luaLocalVar struct {
+	name string
+	slot int
+}
+
+type luaFuncState struct {
+	parent   *luaFuncState
+	proto    *luaProto
+	actives  []luaLocalVar
+	upvalIdx map[string]int
+}
+
+type luaParser struct {
+	lx     *luaLexer
+	fs     *luaFuncState
+	levels int
+}
+
+// luaCompile parses a chunk into the prototype of a vararg function, the
+// way loadstring does
+func luaCompile(src, chunk string) (proto *luaProto, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			serr, ok := r.(*luaSyntaxError)
+			if !ok {
+				panic(r)
+			}
+			err = serr
+		}
+	}()
+
+	p := &luaParser{lx: newLuaLexer(src, chunk)}
+	p.lx.next()
+	proto = &luaProto{name: "main chunk", chunk: chunk, isVararg: true}
+	p.openFunction(proto)
+	proto.body = p.block()
+	if p.lx.tok.kind != tkEOF {
+		p.lx.errorNear("'<eof>' expected")
+	}
+	p.closeFunction()
+	return proto, nil
+}
+
+func (p *luaParser) openFunction(proto *luaProto) {
+	p.fs = &luaFuncState{parent: p.fs, proto: proto, upvalIdx: make(map[string]int)}
+}
+
+func (p *luaParser) closeFunction() {
+	p.fs = p.fs.parent
+}
+
+func (p *luaParser) enterLevel() {
+	p.levels++
+	if p.levels > luaMaxSyntaxLevels {
+		p.lx.errorf("chunk has too many syntax levels")
+	}
+}
+
+func (p *luaParser) leaveLevel() {
+	p.levels--
+}
+
+// declareLocal adds a local to the current function, visible once activated
+func (p *luaParser) declareLocal(name string) luaLocalVar {
+	v := luaLocalVar{name: name, slot: p.fs.proto.numSlots}
+	p.fs.proto.numSlots++
+	return v
+}
+
+func (p *luaParser) activate(vars ...luaLocalVar) {
+	p.fs.actives = append(p.fs.actives, vars...)
+}
+
+// singleVar resolves a name to a local, an upvalue or a global
+func (p *luaParser) singleVar(name string) luaExpr {
+	kind, index := p.fs.findVar(name)
+	switch kind {
+	case 'l':
+		return &luaLocalExpr{slot: index, name: name}
+	case 'u':
+		return &luaUpvalExpr{index: index, name: name}
+	}
+	return &luaGlobalExpr{name: name}
+}
+
+func (fs *luaFuncState) findVar(name string) (byte, int) {
+	for i := len(fs.actives) - 1; i >= 0; i-- {
+		if fs.actives[i].name == name {
+			return 'l', fs.actives[i].slot
+		}
+	}
+	if index, ok := fs.upvalIdx[name]; ok {
+		return 'u', index
+	}
+	if fs.parent == nil {
+		return 'g', 0
+	}
+	kind, index := fs.parent.findVar(name)
+	if kind == 'g' {
+		return 'g', 0
+	}
+	fs.proto.upvals = append(fs.proto.upvals, luaUpvalDesc{fromLocal: kind == 'l', index: index})
+	fs.upvalIdx[name] = len(fs.proto.upvals) - 1
+	return 'u', len(fs.proto.upvals) - 1
+}
+
+func (p *luaParser) check(kind int) {
+	if p.lx.tok.kind != kind {
+		p.lx.errorNear(fmt.Sprintf("'%s' expected", luaTokenName(kind)))
+	}
+}
+
+func (p *luaParser) checkNext(kind int) {
+	p.check(kind)
+	p.lx.next()
+}
+
+// checkMatch expects the token closing what was opened at line
+func (p *luaParser) checkMatch(what, who, line int) {
+	if p.lx.tok.kind == what {
+		p.lx.next()
+		return
+	}
+	if line == p.lx.line {
+		p.check(what)
+	}
+	p.lx.errorNear(fmt.Sprintf("'%s' expected (to close '%s' at line %d)",
+		luaTokenName(what), luaTokenName(who), line))
+}
+
+func (p *luaParser) checkName() string {
+	p.check(tkName)
+	name := p.lx.tok.str
+	p.lx.next()
+	return name
+}
+
+func (p *luaParser) testNext(kind int) bool {
+	if p.lx.tok.kind == kind {
+		p.lx.next()
+		return true
+	}
+	return false
+}
+
+func blockFollow(kind int) bool {
+	switch kind {
+	case tkElse, tkElseif, tkEnd, tkUntil, tkEOF:
+		return true
+	}
+	return false
+}
+
+// block parses statements up to the end of a block, the locals it declares
+// go out of scope with it
+func (p *luaParser) block() *luaBlock {
+	p.enterLevel()
+	actives := len(p.fs.actives)
+	block := p.blockBody()
+	p.fs.actives = p.fs.actives[:actives]
+	p.leaveLevel()
+	return block
+}
+
+func (p *luaParser) blockBody() *luaBlock {
+	block := &luaBlock{}
+	for !blockFollow(p.lx.tok.kind) {
+		if p.lx.tok.kind == tkReturn {
+			block.stmts = append(block.stmts, p.returnStat())
+			break
+		}
+		if p.lx.tok.kind == tkBreak {
+			p.lx.next()
+			block.stmts = append(block.stmts, &luaBreakStmt{})
+			p.testNext(';')
+			break
+		}
+		block.stmts = append(block.stmts, p.statement())
+		p.testNext(';')
+	}
+	return block
+}
+
+func (p *luaParser) returnStat() luaStmt {
+	line := p.lx.tok.line
+	p.lx.next()
+	stmt := &luaReturnStmt{line: line}
+	if !blockFollow(p.lx.tok.kind) && p.lx.tok.kind != ';' {
+		stmt.exprs = p.exprList()
+	}
+	p.testNext(';')
+	if !blockFollow(p.lx.tok.kind) {
+		p.lx.errorNear("'<eof>' expected")
+	}
+	return stmt
+}
+
+func (p *luaParser) statement() luaStmt {
+	line := p.lx.tok.line
+	switch p.lx.tok.kind {
+	case tkIf:
+		return p.ifStat(line)
+	case tkWhile:
+		p.lx.next()
+		cond := p.expr()
+		p.checkNext(tkDo)
+		block := p.block()
+		p.checkMatch(tkEnd, tkWhile, line)
+		return &luaWhileStmt{cond: cond, block: block, line: line}
+	case tkDo:
+		p.lx.next()
+		block := p.block()
+		p.checkMatch(tkEnd, tkDo, line)
+		return &luaDoStmt{block: block}
+	case tkFor:
+		return p.forStat(line)
+	case tkRepeat:
+		// the condition sees the locals of the body
+		p.lx.next()
+		p.enterLevel()
+		actives := len(p.fs.actives)
+		block := p.blockBody()
+		p.checkMatch(tkUntil, tkRepeat, line)
+		cond := p.expr()
+		p.fs.actives = p.fs.actives[:actives]
+		p.leaveLevel()
+		return &luaRepeatStmt{block: block, cond: cond, line: line}
+	case tkFunction:
+		return p.funcStat(line)
+	case tkLocal:
+		p.lx.next()
+		if p.testNext(tkFunction) {
+			v := p.declareLocal(p.checkName())
+			p.activate(v)
+			fn := p.body(false, line, v.name)
+			return &luaLocalFunctionStmt{slot: v.slot, fn: fn, line: line}
+		}
+		return p.localStat(line)
+	}
+	return p.exprStat(line)
+}
+
+func (p *luaParser) ifStat(line int) luaStmt {
+	stmt := &luaIfStmt{line: line}
+	p.lx.next()
+	stmt.conds = append(stmt.conds, p.expr())
+	p.checkNext(tkThen)
+	stmt.blocks = append(stmt.blocks, p.block())
+	for p.lx.tok.kind == tkElseif {
+		p.lx.next()
+		stmt.conds = append(stmt.conds, p.expr())
+		p.checkNext(tkThen)
+		stmt.blocks = append(stmt.blocks, p.block())
+	}
+	if p.testNext(tkElse) {
+		stmt.elseBlock = p.block()
+	}
+	p.checkMatch(tkEnd, tkIf, line)
+	return stmt
+}
+
+func (p *luaParser) forStat(line int) luaStmt {
+	p.lx.next()
+	name := p.checkName()
+	switch p.lx.tok.kind {
+	case '=':
+		p.lx.next()
+		stmt := &luaNumericForStmt{line: line}
+		stmt.start = p.expr()
+		p.checkNext(',')
+		stmt.limit = p.expr()
+		if p.testNext(',') {
+			stmt.step = p.expr()
+		}
+		p.checkNext(tkDo)
+		actives := len(p.fs.actives)
+		v := p.declareLocal(name)
+		p.activate(v)
+		stmt.slot = v.slot
+		stmt.block = p.block()
+		p.fs.actives = p.fs.actives[:actives]
+		p.checkMatch(tkEnd, tkFor, line)
+		return stmt
+	case ',', tkIn:
+		names := []string{name}
+		for p.testNext(',') {
+			names = append(names, p.checkName())
+		}
+		p.checkNext(tkIn)
+		stmt := &luaGenericForStmt{line: line}
+		stmt.exprs = p.exprList()
+		p.checkNext(tkDo)
+		actives := len(p.fs.actives)
+		for _, name := range names {
+			v := p.declareLocal(name)
+			p.activate(v)
+			stmt.slots = append(stmt.slots, v.slot)
+		}
+		stmt.block = p.block()
+		p.fs.actives = p.fs.actives[:actives]
+		p.checkMatch(tkEnd, tkFor, line)
+		return stmt
+	}
+	p.lx.errorNear("'=' or 'in' expected")
+	return nil
+}
+
+func (p *luaParser) funcStat(line int) luaStmt {
+	p.lx.next()
+	name := p.checkName()
+	fullName := name
+	var target luaExpr = p.singleVar(name)
+	method := false
+	for p.lx.tok.kind == '.' || p.lx.tok.kind == ':' {
+		method = p.lx.tok.kind == ':'
+		p.lx.next()
+		key := p.checkName()
+		fullName += "." + key
+		target = &luaIndexExpr{obj: target, key: &luaConstExpr{key}, line: line}
+		if method {
+			break
+		}
+	}
+	fn := p.body(method, line, fullName)
+	return &luaAssignStmt{targets: []luaExpr{target}, exprs: []luaExpr{fn}, line: line}
+}
+
+func (p *luaParser) localStat(line int) luaStmt {
+	var vars []luaLocalVar
+	for {
+		vars = append(vars, p.declareLocal(p.checkName()))
+		if !p.testNext(',') {
+			break
+		}
+	}
+	stmt := &luaLocalStmt{line: line}
+	if p.testNext('=') {
+		stmt.exprs = p.exprList()
+	}
+	// the values are evaluated before the new locals are visible
+	p.activate(vars...)
+	for _, v := range vars {
+		stmt.slots = append(stmt.slots, v.slot)
+	}
+	return stmt
+}
+
+func (p *luaParser) exprStat(line int) luaStmt {
+	e := p.suffixedExpr()
+	if p.lx.tok.kind == '=' || p.lx.tok.kind == ',' {
+		targets := []luaExpr{e}
+		for p.testNext(',') {
+			targets = append(targets, p.suffixedExpr())
+		}
+		p.checkNext('=')
+		for _, target := range targets {
+			switch target.(type) {
+			case *luaLocalExpr, *luaUpvalExpr, *luaGlobalExpr, *luaIndexExpr:
+			default:
+				p.lx.errorNear("syntax error")
+			}
+		}
+		return &luaAssignStmt{targets: targets, exprs: p.exprList(), line: line}
+	}
+	switch e.(type) {
+	case *luaCallExpr, *luaMethodCallExpr:
+		return &luaCallStmt{call: e, line: line}
+	}
+	p.lx.errorNear("syntax error")
+	return nil
+}
+
+// body parses the parameters and the body of a function
+func (p *luaParser) body(method bool, line int, name string) *luaFunctionExpr {
+	proto := &luaProto{name: name, chunk: p.lx.chunk, line: line}
+	p.openFunction(proto)
+	if method {
+		v := p.declareLocal("self")
+		p.activate(v)
+		proto.params = append(proto.params, v.slot)
+	}
+	p.checkNext('(')
+	if p.lx.tok.kind != ')' {
+		for {
+			if p.testNext(tkDots) {
+				proto.isVararg = true
+				break
+			}
+			if p.lx.tok.kind != tkName {
+				p.lx.errorNear("<name> or '...' expected")
+			}
+			v := p.declareLocal(p.checkName())
+			p.activate(v)
+			proto.params = append(proto.params, v.slot)
+			if !p.testNext(',') {
+				break
+			}
+		}
+	}
+	p.checkNext(')')
+	proto.body = p.block()
+	p.checkMatch(tkEnd, tkFunction, line)
+	p.closeFunction()
+	return &luaFunctionExpr{proto: proto}
+}
+
+func (p *luaParser) exprList() []luaExpr {
+	exprs := []luaExpr{p.expr()}
+	for p.testNext(',') {
+		exprs = append(exprs, p.expr())
+	}
+	return exprs
+}
+
+func (p *luaParser) expr() luaExpr {
+	return p.subExpr(0)
+}
+
+// subExpr parses an expression whose binary operators bind tighter than limit
+func (p *luaParser) subExpr(limit int) luaExpr {
+	p.enterLevel()
+	defer p.leaveLevel()
+
+	var e luaExpr
+	switch op := p.lx.tok.kind; op {
+	case tkNot, '-', '#':
+		line := p.lx.tok.line
+		p.lx.next()
+		operand := p.subExpr(luaUnaryPriority)
+		// fold negative numbers, so -1 is a constant like in Lua
+		if c, ok := operand.(*luaConstExpr); ok && op == '-' {
+			if n, ok := c.value.(float64); ok {
+				e = &luaConstExpr{-n}
+				break
+			}
+		}
+		e = &luaUnopExpr{op: op, expr: operand, line: line}
+	default:
+		e = p.simpleExpr()
+	}
+
+	for {
+		op := p.lx.tok.kind
+		prio, ok := luaBinaryPriority[op]
+		if !ok || prio[0] <= limit {
+			return e
+		}
+		line := p.lx.tok.line
+		p.lx.next()
+		right := p.subExpr(prio[1])
+		e = &luaBinopExpr{op: op, left: e, right: right, line: line}
+	}
+}
+
+func (p *luaParser) simpleExpr() luaExpr {
+	tok := p.lx.tok
+	switch tok.kind {
+	case tkNumber:
+		p.lx.next()
+		return &luaConstExpr{tok.num}
+	case tkString:
+		p.lx.next()
+		return &luaConstExpr{tok.str}
+	case tkNil:
+		p.lx.next()
+		return &luaConstExpr{nil}
+	case tkTrue:
+		p.lx.next()
+		return &luaConstExpr{true}
+	case tkFalse:
+		p.lx.next()
+		return &luaConstExpr{false}
+	case tkDots:
+		if !p.fs.proto.isVararg {
+			p.lx.errorNear("cannot use '...' outside a vararg function")
+		}
+		p.lx.next()
+		return &luaVarargExpr{}
+	case '{':
+		return p.tableConstructor()
+	case tkFunction:
+		p.lx.next()
+		return p.body(false, tok.line, "anonymous")
+	}
+	return p.suffixedExpr()
+}
+
+func (p *luaParser) primaryExpr() luaExpr {
+	switch p.lx.tok.kind {
+	case tkName:
+		return p.singleVar(p.checkName())
+	case '(':
+		line := p.lx.tok.line
+		p.lx.next()
+		e := p.expr()
+		p.checkMatch(')', '(', line)
+		return &luaParenExpr{e}
+	}
+	p.lx.errorNear("unexpected symbol")
+	return nil
+}
+
+func (p *luaParser) suffixedExpr() luaExpr {
+	e := p.primaryExpr()
+	for {
+		line := p.lx.tok.line
+		switch p.lx.tok.kind {
+		case '.':
+			p.lx.next()
+			e = &luaIndexExpr{obj: e, key: &luaConstExpr{p.checkName()}, line: line}
+		case '[':
+			p.lx.next()
+			key := p.expr()
+			p.checkNext(']')
+			e = &luaIndexExpr{obj: e, key: key, line: line}
+		case ':':
+			p.lx.next()
+			name := p.checkName()
+			e = &luaMethodCallExpr{obj: e, name: name, args: p.callArgs(), line: line}
+		case '(', tkString, '{':
+			e = &luaCallExpr{fn: e, args: p.callArgs(), line: line}
+		default:
+			return e
+		}
+	}
+}
+
+func (p *luaParser) callArgs() []luaExpr {
+	switch p.lx.tok.kind {
+	case tkString:
+		s := p.lx.tok.str
+		p.lx.next()
+		return []luaExpr{&luaConstExpr{s}}
+	case '{':
+		return []luaExpr{p.tableConstructor()}
+	case '(':
+		line := p.lx.tok.line
+		p.lx.next()
+		var args []luaExpr
+		if p.lx.tok.kind != ')' {
+			args = p.exprList()
+		}
+		p.checkMatch(')', '(', line)
+		return args
+	}
+	p.lx.errorNear("function arguments expected")
+	return nil
+}
+
+func (p *luaParser) tableConstructor() luaExpr {
+	line := p.lx.tok.line
+	p.checkNext('{')
+	t := &luaTableExpr{line: line}
+	for p.lx.tok.kind != '}' {
+		switch {
+		case p.lx.tok.kind == tkName && p.lx.peek().kind == '=':
+			key := p.checkName()
+			p.lx.next()
+			t.fields = append(t.fields, luaTableField{key: &luaConstExpr{key}, value: p.expr()})
+		case p.lx.tok.kind == '[':
+			p.lx.next()
+			key := p.expr()
+			p.checkNext(']')
+			p.checkNext('=')
+			t.fields = append(t.fields, luaTableField{key: key, value: p.expr()})
+		default:
+			t.fields = append(t.fields, luaTableField{value: p.expr()})
+		}
+		if !p.testNext(',') && !p.testNext(';') {
+			break
+		}
+	}
+	p.checkMatch('}', '{', line)
+	return t
+}
@@ -0,0 +1,699 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+func (L *luaState) openStringLib() {
+	lib := newLuaTable(0, 16)
+	L.globals.set("string", lib)
+	L.stringMeta = newLuaTable(0, 1)
+	L.stringMeta.set("__index", lib)
+
+	L.register(lib, "len", func(L *luaState, args []luaValue) []luaValue {
+		return []luaValue{float64(len(L.checkString(args, 1)))}
+	})
+	L.register(lib, "sub", func(L *luaState, args []luaValue) []luaValue {
+		s := L.checkString(args, 1)
+		i, j := luaStringRange(len(s), L.checkInt(args, 2), L.optInt(args, 3, -1))
+		if i > j {
+			return []luaValue{""}
+		}
+		return []luaValue{s[i-1 : j]}
+	})
+	L.register(lib, "upper", func(L *luaState, args []luaValue) []luaValue {
+		return []luaValue{strings.ToUpper(L.checkString(args, 1))}
+	})
+	L.register(lib, "lower", func(L *luaState, args []luaValue) []luaValue {
+		return []luaValue{strings.ToLower(L.checkString(args, 1))}
+	})
+	L.register(lib, "rep", func(L *luaState, args []luaValue) []luaValue {
+		s := L.checkString(args, 1)
+		n := L.checkInt(args, 2)
+		if n <= 0 {
+			return []luaValue{""}
+		}
+		if len(s)*n > luaMaxStringSize {
+			L.runtimeError("resulting string too large")
+		}
+		return []luaValue{strings.Repeat(s, n)}
+	})
+	L.register(lib, "reverse", func(L *luaState, args []luaValue) []luaValue {
+		s := []byte(L.checkString(args, 1))
+		for i, j := 0, len(s)-1; i < j; i, j = i+1, j-1 {
+			s[i], s[j] = s[j], s[i]
+		}
+		return []luaValue{string(s)}
+	})
+	L.register(lib, "byte", func(L *luaState, args []luaValue) []luaValue {
+		s := L.checkString(args, 1)
+		start := L.optInt(args, 2, 1)
+		i, j := luaStringRange(len(s), start, L.optInt(args, 3, start))
+		var values []luaValue
+		for k := i; k <= j; k++ {
+			values = append(values, float64(s[k-1]))
+		}
+		return values
+	})
+	L.register(lib, "char", func(L *luaState, args []luaValue) []luaValue {
+		b := make([]byte, len(args))
+		for i := range args {
+			c := L.checkInt(args, i+1)
+			if c < 0 || c > 255 {
+				L.argError(i+1, "invalid value")
+			}
+			b[i] = byte(c)
+		}
+		return []luaValue{string(b)}
+	})
+	L.register(lib, "format", luaStringFormat)
+	L.register(lib, "find", func(L *luaState, args []luaValue) []luaValue {
+		return luaStringFind(L, args, true)
+	})
+	L.register(lib, "match", func(L *luaState, args []luaValue) []luaValue {
+		return luaStringFind(L, args, false)
+	})
+	L.register(lib, "gmatch", luaStringGmatch)
+	L.register(lib, "gsub", luaStringGsub)
+}
+
+// strings longer than this can't be built by the library functions
+const luaMaxStringSize = 512 * 1024 * 1024
+
+// luaStringRange turns the i and j of string.sub into a 1-based range of s,
+// empty when i > j
+func luaStringRange(n, i, j int) (int, int) {
+	if i < 0 {
+		i = n + i + 1
+	}
+	if j < 0 {
+		j = n + j + 1
+	}
+	if i < 1 {
+		i = 1
+	}
+	if j > n {
+		j = n
+	}
+	return i, j
+}
+
+func luaStringFormat(L *luaState, args []luaValue) []luaValue {
+	format := L.checkString(args, 1)
+	var b bytes.Buffer
+	arg := 1
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		if c != '%' {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		if i < len(format) && format[i] == '%' {
+			b.WriteByte('%')
+			continue
+		}
+
+		// flags, width and precision, at most two digits each
+		start := i
+		for i < len(format) && strings.IndexByte("-+ #0", format[i]) >= 0 {
+			i++
+		}
+		if i-start > 5 {
+			L.runtimeError("invalid format (repeated flags)")
+		}
+		for n := 0; i < len(format) && isDigit(format[i]); n++ {
+			if n == 2 {
+				L.runtimeError("invalid format (width or precision too long)")
+			}
+			i++
+		}
+		if i < len(format) && format[i] == '.' {
+			i++
+			for n := 0; i < len(format) && isDigit(format[i]); n++ {
+				if n == 2 {
+					L.runtimeError("invalid format (width or precision too long)")
+				}
+				i++
+			}
+		}
+		if i >= len(format) {
+			L.runtimeError("invalid option '%%' to 'format'")
+		}
+		spec := format[start:i]
+		conv := format[i]
+
+		arg++
+		switch conv {
+		case 'c':
+			b.WriteByte(byte(L.checkInt(args, arg)))
+		case 'd', 'i':
+			b.WriteString(fmt.Sprintf("%"+spec+"d", int64(L.checkNumber(args, arg))))
+		case 'u':
+			b.WriteString(fmt.Sprintf("%"+spec+"d", uint64(int64(L.checkNumber(args, arg)))))
+		case 'o', 'x', 'X':
+			b.WriteString(fmt.Sprintf("%"+spec+string(conv), uint64(int64(L.checkNumber(args, arg)))))
+		case 'e', 'E', 'f', 'g', 'G':
+			// C prints %g with 6 digits by default, Go with as many as needed
+			if (conv == 'g' || conv == 'G') && !strings.Contains(spec, ".") {
+				spec += ".6"
+			}
+			b.WriteString(fmt.Sprintf("%"+spec+string(conv), L.checkNumber(args, arg)))
+		case 'q':
+			luaQuoteString(&b, L.checkString(args, arg))
+		case 's':
+			s := L.tostring(L.checkAny(args, arg))
+			b.WriteString(fmt.Sprintf("%"+spec+"s", s))
+		default:
+			L.runtimeError("invalid option '%%%c' to 'format'", conv)
+		}
+	}
+	return []luaValue{b.String()}
+}
+
+// luaQuoteString writes s so that Lua reads it back, for %q
+func luaQuoteString(b *bytes.Buffer, s string) {
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"', '\\', '\n':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\r':
+			b.WriteString("\\r")
+		case 0:
+			b.WriteString("\\000")
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+}
+
+// luaPatternSpecials are the characters that make find use the matcher
+const luaPatternSpecials = "^$*+?.([%-"
+
+func luaStringFind(L *luaState, args []luaValue, find bool) []luaValue {
+	s := L.checkString(args, 1)
+	p := L.checkString(args, 2)
+	init := L.optInt(args, 3, 1)
+	if init < 0 {
+		init = len(s) + init + 1
+	}
+	init--
+	if init < 0 {
+		init = 0
+	} else if init > len(s) {
+		init = len(s)
+	}
+
+	if find && (luaToBoolean(luaArg(args, 4)) || !strings.ContainsAny(p, luaPatternSpecials)) {
+		i := strings.Index(s[init:], p)
+		if i < 0 {
+			return []luaValue{nil}
+		}
+		return []luaValue{float64(init + i + 1), float64(init + i + len(p))}
+	}
+
+	anchor := strings.HasPrefix(p, "^")
+	if anchor {
+		p = p[1:]
+	}
+	for pos := init; ; pos++ {
+		ms := &luaMatchState{L: L, src: s, pat: p}
+		if end := ms.match(pos, 0); end >= 0 {
+			if find {
+				return append([]luaValue{float64(pos + 1), float64(end)}, ms.captures(-1, -1, false)...)
+			}
+			return ms.captures(pos, end, true)
+		}
+		if anchor || pos >= len(s) {
+			return []luaValue{nil}
+		}
+	}
+}
+
+func luaStringGmatch(L *luaState, args []luaValue) []luaValue {
+	s := L.checkString(args, 1)
+	p := L.checkString(args, 2)
+	pos := 0
+	iter := &luaGoFunction{name: "gmatch_iter", fn: func(L *luaState, _ []luaValue) []luaValue {
+		for ; pos <= len(s); pos++ {
+			ms := &luaMatchState{L: L, src: s, pat: p}
+			if end := ms.match(pos, 0); end >= 0 {
+				start := pos
+				pos = end
+				if end == start {
+					pos++
+				}
+				return ms.captures(start, end, true)
+			}
+		}
+		return []luaValue{nil}
+	}}
+	return []luaValue{iter}
+}
+
+func luaStringGsub(L *luaState, args []luaValue) []luaValue {
+	s := L.checkString(args, 1)
+	p := L.checkString(args, 2)
+	repl := luaArg(args, 3)
+	switch repl.(type) {
+	case float64, string, *luaTable, *luaClosure, *luaGoFunction:
+	default:
+		L.typeError(args, 3, "string/function/table")
+	}
+	maxN := L.optInt(args, 4, len(s)+1)
+
+	anchor := strings.HasPrefix(p, "^")
+	if anchor {
+		p = p[1:]
+	}
+	var b bytes.Buffer
+	n := 0
+	pos := 0
+	for n < maxN {
+		ms := &luaMatchState{L: L, src: s, pat: p}
+		end := ms.match(pos, 0)
+		if end >= 0 {
+			n++
+			ms.addValue(&b, pos, end, repl)
+		}
+		if end >= 0 && end > pos {
+			pos = end
+		} else if pos < len(s) {
+			b.WriteByte(s[pos])
+			pos++
+		} else {
+			break
+		}
+		if anchor {
+			break
+		}
+	}
+	b.WriteString(s[pos:])
+	return []luaValue{b.String(), float64(n)}
+}
+
+// A port of the pattern matcher of lstrlib.c
+
+const (
+	luaMaxCaptures  = 32
+	luaCapUnfinshed = -1
+	luaCapPosition  = -2
+)
+
+type luaMatchState struct {
+	L       *luaState
+	src     string
+	pat     string
+	level   int
+	capture [luaMaxCaptures]struct {
+		init int
+		len  int
+	}
+	depth int
+}
+
+func (ms *luaMatchState) error(format string, args ...interface{}) {
+	ms.L.runtimeError(format, args...)
+}
+
+func (ms *luaMatchState) classEnd(p int) int {
+	c := ms.pat[p]
+	p++
+	if c == '%' {
+		if p >= len(ms.pat) {
+			ms.error("malformed pattern (ends with '%%')")
+		}
+		return p + 1
+	}
+	if c == '[' {
+		if p < len(ms.pat) && ms.pat[p] == '^' {
+			p++
+		}
+		for {
+			if p >= len(ms.pat) {
+				ms.error("malformed pattern (missing ']')")
+			}
+			c := ms.pat[p]
+			p++
+			if c == '%' {
+				p++
+			}
+			if p < len(ms.pat) && ms.pat[p] == ']' {
+				return p + 1
+			}
+			if p >= len(ms.pat) {
+				ms.error("malformed pattern (missing ']')")
+			}
+		}
+	}
+	return p
+}
+
+func luaMatchClass(c byte, class byte) bool {
+	var res bool
+	lower := class | 0x20
+	switch lower {
+	case 'a':
+		res = (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+	case 'c':
+		res = c < 32 || c == 127
+	case 'd':
+		res = c >= '0' && c <= '9'
+	case 'l':
+		res = c >= 'a' && c <= 'z'
+	case 'p':
+		res = (c >= 33 && c <= 47) || (c >= 58 && c <= 64) || (c >= 91 && c <= 96) || (c >= 123 && c <= 126)
+	case 's':
+		res = c == ' ' || (c >= '\t' && c <= '\r')
+	case 'u':
+		res = c >= 'A' && c <= 'Z'
+	case 'w':
+		res = (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+	case 'x':
+		res = (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+	case 'z':
+		res = c == 0
+	default:
+		return class == c
+	}
+	if class >= 'A' && class <= 'Z' {
+		return !res
+	}
+	return res
+}
+
+// matchBracketClass matches c against the class [...] between p and ec,
+// ec being the closing ]
+func (ms *luaMatchState) matchBracketClass(c byte, p, ec int) bool {
+	sig := true
+	if ms.pat[p+1] == '^' {
+		sig = false
+		p++
+	}
+	for p++; p < ec; p++ {
+		if ms.pat[p] == '%' {
+			p++
+			if luaMatchClass(c, ms.pat[p]) {
+				return sig
+			}
+		} else if p+2 < ec && ms.pat[p+1] == '-' {
+			if ms.pat[p] <= c && c <= ms.pat[p+2] {
+				return sig
+			}
+			p += 2
+		} else if ms.pat[p] == c {
+			return sig
+		}
+	}
+	return !sig
+}
+
+func (ms *luaMatchState) singleMatch(s, p, ep int) bool {
+	if s >= len(ms.src) {
+		return false
+	}
+	c := ms.src[s]
+	switch ms.pat[p] {
+	case '.':
+		return true
+	case '%':
+		return luaMatchClass(c, ms.pat[p+1])
+	case '[':
+		return ms.matchBracketClass(c, p, ep-1)
+	}
+	return ms.pat[p] == c
+}
+
+// match returns the end of the match of the pattern from p at s, or -1
+func (ms *luaMatchState) match(s, p int) int {
+	ms.depth++
+	if ms.depth > luaMaxSyntaxLevels*10 {
+		ms.error("pattern too complex")
+	}
+	defer func() { ms.depth-- }()
+
+	for {
+		if p >= len(ms.pat) {
+			return s
+		}
+		switch ms.pat[p] {
+		case '(':
+			if p+1 < len(ms.pat) && ms.pat[p+1] == ')' {
+				return ms.startCapture(s, p+2, luaCapPosition)
+			}
+			return ms.startCapture(s, p+1, luaCapUnfinshed)
+		case ')':
+			return ms.endCapture(s, p+1)
+		case '%':
+			if p+1 < len(ms.pat) {
+				switch next := ms.pat[p+1]; {
+				case next == 'b':
+					s = ms.matchBalance(s, p+2)
+					if s == -1 {
+						return -1
+					}
+					p += 4
+					continue
+				case next == 'f':
+					p += 2
+					if p >= len(ms.pat) || ms.pat[p] != '[' {
+						ms.error("missing '[' after '%%f' in pattern")
+					}
+					ep := ms.classEnd(p)
+					var prev, cur byte
+					if s > 0 {
+						prev = ms.src[s-1]
+					}
+					if s < len(ms.src) {
+						cur = ms.src[s]
+					}
+					if ms.matchBracketClass(prev, p, ep-1) || !ms.matchBracketClass(cur, p, ep-1) {
+						return -1
+					}
+					p = ep
+					continue
+				case isDigit(next):
+					s = ms.matchCapture(s, next)
+					if s == -1 {
+						return -1
+					}
+					p += 2
+					continue
+				}
+			}
+		case '$':
+			if p+1 == len(ms.pat) {
+				if s == len(ms.src) {
+					return s
+				}
+				return -1
+			}
+		}
+
+		ep := ms.classEnd(p)
+		m := ms.singleMatch(s, p, ep)
+		if ep < len(ms.pat) {
+			switch ms.pat[ep] {
+			case '?':
+				if m {
+					if res := ms.match(s+1, ep+1); res != -1 {
+						return res
+					}
+				}
+				p = ep + 1
+				continue
+			case '*':
+				return ms.maxExpand(s, p, ep)
+			case '+':
+				if !m {
+					return -1
+				}
+				return ms.maxExpand(s+1, p, ep)
+			case '-':
+				return ms.minExpand(s, p, ep)
+			}
+		}
+		if !m {
+			return -1
+		}
+		s++
+		p = ep
+	}
+}
+
+func (ms *luaMatchState) matchBalance(s, p int) int {
+	if p+1 >= len(ms.pat) {
+		ms.error("unbalanced pattern")
+	}
+	if s >= len(ms.src) || ms.src[s] != ms.pat[p] {
+		return -1
+	}
+	b, e := ms.pat[p], ms.pat[p+1]
+	cont := 1
+	for i := s + 1; i < len(ms.src); i++ {
+		switch ms.src[i] {
+		case e:
+			cont--
+			if cont == 0 {
+				return i + 1
+			}
+		case b:
+			cont++
+		}
+	}
+	return -1
+}
+
+func (ms *luaMatchState) maxExpand(s, p, ep int) int {
+	i := 0
+	for ms.singleMatch(s+i, p, ep) {
+		i++
+	}
+	for ; i >= 0; i-- {
+		if res := ms.match(s+i, ep+1); res != -1 {
+			return res
+		}
+	}
+	return -1
+}
+
+func (ms *luaMatchState) minExpand(s, p, ep int) int {
+	for {
+		if res := ms.match(s, ep+1); res != -1 {
+			return res
+		}
+		if !ms.singleMatch(s, p, ep) {
+			return -1
+		}
+		s++
+	}
+}
+
+func (ms *luaMatchState) startCapture(s, p, what int) int {
+	if ms.level >= luaMaxCaptures {
+		ms.error("too many captures")
+	}
+	ms.capture[ms.level].init = s
+	ms.capture[ms.level].len = what
+	ms.level++
+	res := ms.match(s, p)
+	if res == -1 {
+		ms.level--
+	}
+	return res
+}
+
+func (ms *luaMatchState) endCapture(s, p int) int {
+	l := -1
+	for i := ms.level - 1; i >= 0; i-- {
+		if ms.capture[i].len == luaCapUnfinshed {
+			l = i
+			break
+		}
+	}
+	if l < 0 {
+		ms.error("invalid pattern capture")
+	}
+	ms.capture[l].len = s - ms.capture[l].init
+	res := ms.match(s, p)
+	if res == -1 {
+		ms.capture[l].len = luaCapUnfinshed
+	}
+	return res
+}
+
+func (ms *luaMatchState) matchCapture(s int, c byte) int {
+	l := int(c - '1')
+	if l < 0 || l >= ms.level || ms.capture[l].len == luaCapUnfinshed {
+		ms.error("invalid capture index")
+	}
+	capture := ms.src[ms.capture[l].init : ms.capture[l].init+ms.capture[l].len]
+	if strings.HasPrefix(ms.src[s:], capture) {
+		return s + len(capture)
+	}
+	return -1
+}
+
+// getCapture returns capture i, the whole match from s to e when the
+// pattern has none
+func (ms *luaMatchState) getCapture(i, s, e int) luaValue {
+	if i >= ms.level {
+		if i == 0 {
+			return ms.src[s:e]
+		}
+		ms.error("invalid capture index")
+	}
+	c := ms.capture[i]
+	if c.len == luaCapUnfinshed {
+		ms.error("unfinished capture")
+	}
+	if c.len == luaCapPosition {
+		return float64(c.init + 1)
+	}
+	return ms.src[c.init : c.init+c.len]
+}
+
+// captures returns the captured values, or the whole match if wholeIfNone
+// and the pattern has no capture
+func (ms *luaMatchState) captures(s, e int, wholeIfNone bool) []luaValue {
+	n := ms.level
+	if n == 0 && wholeIfNone {
+		n = 1
+	}
+	values := make([]luaValue, n)
+	for i := 0; i < n; i++ {
+		values[i] = ms.getCapture(i, s, e)
+	}
+	return values
+}
+
+// addValue writes the replacement of the match from s to e, for gsub
+func (ms *luaMatchState) addValue(b *bytes.Buffer, s, e int, repl luaValue) {
+	var value luaValue
+	switch r := repl.(type) {
+	case float64, string:
+		rs, _ := luaToString(r)
+		for i := 0; i < len(rs); i++ {
+			if rs[i] != '%' || i+1 == len(rs) {
+				b.WriteByte(rs[i])
+				continue
+			}
+			i++
+			switch {
+			case !isDigit(rs[i]):
+				b.WriteByte(rs[i])
+			case rs[i] == '0':
+				b.WriteString(ms.src[s:e])
+			default:
+				v := ms.getCapture(int(rs[i]-'1'), s, e)
+				str, _ := luaToString(v)
+				b.WriteString(str)
+			}
+		}
+		return
+	case *luaTable:
+		value = ms.L.index(r, ms.getCapture(0, s, e), nil)
+	default:
+		value = luaFirst(ms.L.call(r, ms.captures(s, e, true)))
+	}
+
+	switch v := value.(type) {
+	case nil, bool:
+		if v == nil || v == false {
+			b.WriteString(ms.src[s:e])
+			return
+		}
+	case string:
+		b.WriteString(v)
+		return
+	case float64:
+		b.WriteString(luaNumberToString(v))
+		return
+	}
+	ms.error("invalid replacement value (a %s)", luaTypeName(value))
+}
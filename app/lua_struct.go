@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"strings"
+)
+
+// The struct library of Redis, by Roberto Ierusalimschy: struct.pack,
+// struct.unpack and struct.size convert numbers and strings from and to
+// binary strings, following a format like "<i4s"
+
+// the biggest integer size of the i and I options, in bytes
+const luaStructMaxIntSize = 32
+
+// the biggest alignment of the ! option
+const luaStructMaxAlign = 8
+
+type luaStructHeader struct {
+	bigEndian bool
+	align     int
+}
+
+// getnum reads the size following an option, def when there is none
+func (L *luaState) structGetNum(format string, pos *int, def int) int {
+	if *pos >= len(format) || format[*pos] < '0' || format[*pos] > '9' {
+		return def
+	}
+	n := 0
+	for *pos < len(format) && format[*pos] >= '0' && format[*pos] <= '9' {
+		if n > (math.MaxInt32-int(format[*pos]-'0'))/10 {
+			L.runtimeError("integral size overflow")
+		}
+		n = n*10 + int(format[*pos]-'0')
+		*pos++
+	}
+	return n
+}
+
+// structOptSize is the size of the option, 0 for the control options
+func (L *luaState) structOptSize(opt byte, format string, pos *int) int {
+	switch opt {
+	case 'B', 'b':
+		return 1
+	case 'H', 'h':
+		return 2
+	case 'L', 'l', 'T':
+		return 8
+	case 'f':
+		return 4
+	case 'd':
+		return 8
+	case 'x':
+		return 1
+	case 'c':
+		return L.structGetNum(format, pos, 1)
+	case 'i', 'I':
+		size := L.structGetNum(format, pos, 4)
+		if size > luaStructMaxIntSize {
+			L.runtimeError("integral size %d is larger than limit of %d", size, luaStructMaxIntSize)
+		}
+		return size
+	}
+	return 0
+}
+
+// structToAlign is the padding before an option, for the alignment set
+func structToAlign(length int, h *luaStructHeader, opt byte, size int) int {
+	if size == 0 || opt == 'c' {
+		return 0
+	}
+	if size > h.align {
+		size = h.align
+	}
+	return (size - (length & (size - 1))) & (size - 1)
+}
+
+// structControlOptions applies the options that change the endianness and
+// the alignment
+func (L *luaState) structControlOptions(opt byte, format string, pos *int, h *luaStructHeader) {
+	switch opt {
+	case ' ':
+	case '>':
+		h.bigEndian = true
+	case '<':
+		h.bigEndian = false
+	case '!':
+		a := L.structGetNum(format, pos, luaStructMaxAlign)
+		if a&(a-1) != 0 {
+			L.runtimeError("alignment %d is not a power of 2", a)
+		}
+		h.align = a
+	default:
+		L.argError(1, "invalid format option '"+string(opt)+"'")
+	}
+}
+
+func structPutInteger(b *strings.Builder, value uint64, bigEndian bool, size int) {
+	buf := make([]byte, size)
+	for i := 0; i < size && i < 8; i++ {
+		buf[i] = byte(value)
+		value >>= 8
+	}
+	if bigEndian {
+		for i, j := 0, size-1; i < j; i, j = i+1, j-1 {
+			buf[i], buf[j] = buf[j], buf[i]
+		}
+	}
+	b.Write(buf)
+}
+
+func structGetInteger(data string, bigEndian, signed bool, size int) float64 {
+	var value uint64
+	for i := 0; i < size; i++ {
+		var c byte
+		if bigEndian {
+			c = data[i]
+		} else {
+			c = data[size-1-i]
+		}
+		value = value<<8 | uint64(c)
+	}
+	if signed {
+		if size < 8 {
+			mask := ^uint64(0) << (size*8 - 1)
+			if value&mask != 0 {
+				value |= mask
+			}
+		}
+		return float64(int64(value))
+	}
+	return float64(value)
+}
+
+func (L *luaState) openStructLib() {
+	lib := newLuaTable(0, 4)
+	L.globals.set("struct", lib)
+
+	L.register(lib, "pack", func(L *luaState, args []luaValue) []luaValue {
+		format := L.checkString(args, 1)
+		h := luaStructHeader{align: 1}
+		arg := 2
+		total := 0
+		var b strings.Builder
+
+		for pos := 0; pos < len(format); {
+			opt := format[pos]
+			pos++
+			size := L.structOptSize(opt, format, &pos)
+			toalign := structToAlign(total, &h, opt, size)
+			total += toalign
+			b.WriteString(strings.Repeat("\x00", toalign))
+
+			switch opt {
+			case 'b', 'B', 'h', 'H', 'l', 'L', 'T', 'i', 'I':
+				n := L.checkNumber(args, arg)
+				arg++
+				var value uint64
+				if n < 0 {
+					value = uint64(int64(n))
+				} else {
+					value = uint64(n)
+				}
+				structPutInteger(&b, value, h.bigEndian, size)
+			case 'x':
+				b.WriteByte(0)
+			case 'f':
+				buf := make([]byte, 4)
+				if h.bigEndian {
+					binary.BigEndian.PutUint32(buf, math.Float32bits(float32(L.checkNumber(args, arg))))
+				} else {
+					binary.LittleEndian.PutUint32(buf, math.Float32bits(float32(L.checkNumber(args, arg))))
+				}
+				arg++
+				b.Write(buf)
+			case 'd':
+				buf := make([]byte, 8)
+				if h.bigEndian {
+					binary.BigEndian.PutUint64(buf, math.Float64bits(L.checkNumber(args, arg)))
+				} else {
+					binary.LittleEndian.PutUint64(buf, math.Float64bits(L.checkNumber(args, arg)))
+				}
+				arg++
+				b.Write(buf)
+			case 'c', 's':
+				s := L.checkString(args, arg)
+				arg++
+				if size == 0 {
+					size = len(s)
+				}
+				if len(s) < size {
+					L.argError(arg, "string too short")
+				}
+				b.WriteString(s[:size])
+				if opt == 's' {
+					b.WriteByte(0)
+					size++
+				}
+			default:
+				L.structControlOptions(opt, format, &pos, &h)
+			}
+			total += size
+		}
+		return []luaValue{b.String()}
+	})
+
+	L.register(lib, "unpack", func(L *luaState, args []luaValue) []luaValue {
+		format := L.checkString(args, 1)
+		data := L.checkString(args, 2)
+		start := L.optInt(args, 3, 1)
+		if start < 1 {
+			L.argError(3, "offset must be 1 or greater")
+		}
+		offset := start - 1
+		if offset > len(data) {
+			L.argError(3, "offset must be 1 or greater")
+		}
+		h := luaStructHeader{align: 1}
+		var rets []luaValue
+
+		for pos := 0; pos < len(format); {
+			opt := format[pos]
+			pos++
+			size := L.structOptSize(opt, format, &pos)
+			offset += structToAlign(offset, &h, opt, size)
+			if size > len(data) || offset > len(data)-size {
+				L.argError(2, "data string too short")
+			}
+
+			switch opt {
+			case 'b', 'B', 'h', 'H', 'l', 'L', 'T', 'i', 'I':
+				signed := opt >= 'a' && opt <= 'z'
+				rets = append(rets, structGetInteger(data[offset:], h.bigEndian, signed, size))
+			case 'x':
+			case 'f':
+				var u uint32
+				if h.bigEndian {
+					u = binary.BigEndian.Uint32([]byte(data[offset : offset+4]))
+				} else {
+					u = binary.LittleEndian.Uint32([]byte(data[offset : offset+4]))
+				}
+				rets = append(rets, float64(math.Float32frombits(u)))
+			case 'd':
+				var u uint64
+				if h.bigEndian {
+					u = binary.BigEndian.Uint64([]byte(data[offset : offset+8]))
+				} else {
+					u = binary.LittleEndian.Uint64([]byte(data[offset : offset+8]))
+				}
+				rets = append(rets, math.Float64frombits(u))
+			case 'c':
+				if size == 0 {
+					var n float64
+					ok := false
+					if len(rets) > 0 {
+						n, ok = rets[len(rets)-1].(float64)
+					}
+					if !ok {
+						L.runtimeError("format 'c0' needs a previous size")
+					}
+					size = int(n)
+					rets = rets[:len(rets)-1]
+					if size < 0 || size > len(data) || offset > len(data)-size {
+						L.argError(2, "data string too short")
+					}
+				}
+				rets = append(rets, data[offset:offset+size])
+			case 's':
+				end := strings.IndexByte(data[offset:], 0)
+				if end < 0 {
+					L.runtimeError("unfinished string in data")
+				}
+				size = end + 1
+				rets = append(rets, data[offset:offset+end])
+			default:
+				L.structControlOptions(opt, format, &pos, &h)
+			}
+			offset += size
+		}
+		return append(rets, float64(offset+1))
+	})
+
+	L.register(lib, "size", func(L *luaState, args []luaValue) []luaValue {
+		format := L.checkString(args, 1)
+		h := luaStructHeader{align: 1}
+		total := 0
+		for pos := 0; pos < len(format); {
+			opt := format[pos]
+			pos++
+			size := L.structOptSize(opt, format, &pos)
+			total += structToAlign(total, &h, opt, size)
+			if opt == 's' {
+				L.argError(1, "options 'c0' - 's' have undefined sizes")
+			} else if opt == 'c' && size == 0 {
+				L.argError(1, "options 'c0' - 's' have undefined sizes")
+			}
+			if !(opt >= 'a' && opt <= 'z') && !(opt >= 'A' && opt <= 'Z') && !(opt >= '0' && opt <= '9') {
+				L.structControlOptions(opt, format, &pos, &h)
+			}
+			total += size
+		}
+		return []luaValue{float64(total)}
+	})
+}
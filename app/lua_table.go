@@ -0,0 +1,209 @@
+package main
+
+import "math"
+
+// luaTable keeps the keys 1..n in an array, the others in a hash that
+// remembers the insertion order so next can walk it from any key
+type luaTable struct {
+	arr     []luaValue
+	hashIdx map[luaValue]int
+	entries []luaTableEntry
+	dead    int // entries set to nil, reclaimed when new keys are added
+	meta    *luaTable
+
+	// a readonly table can't be changed by the scripts, like the globals
+	readonly bool
+}
+
+type luaTableEntry struct {
+	key   luaValue
+	value luaValue
+}
+
+func newLuaTable(narr, nhash int) *luaTable {
+	t := &luaTable{}
+	if narr > 0 {
+		t.arr = make([]luaValue, 0, narr)
+	}
+	if nhash > 0 {
+		t.hashIdx = make(map[luaValue]int, nhash)
+		t.entries = make([]luaTableEntry, 0, nhash)
+	}
+	return t
+}
+
+// arrayIndex returns the position of key in the array part, if it is one of
+// its integer keys
+func (t *luaTable) arrayIndex(key luaValue) (int, bool) {
+	n, ok := key.(float64)
+	if !ok || n < 1 || n > float64(len(t.arr)) || n != math.Floor(n) {
+		return 0, false
+	}
+	return int(n) - 1, true
+}
+
+func (t *luaTable) get(key luaValue) luaValue {
+	if i, ok := t.arrayIndex(key); ok {
+		return t.arr[i]
+	}
+	if t.hashIdx == nil {
+		return nil
+	}
+	if i, ok := t.hashIdx[key]; ok {
+		return t.entries[i].value
+	}
+	return nil
+}
+
+func (t *luaTable) getStr(key string) luaValue {
+	return t.get(key)
+}
+
+func (t *luaTable) getInt(i int) luaValue {
+	if i >= 1 && i <= len(t.arr) {
+		return t.arr[i-1]
+	}
+	return t.get(float64(i))
+}
+
+// set stores the value, a nil removing the key. The caller checks the key
+// is neither nil nor NaN.
+func (t *luaTable) set(key, value luaValue) {
+	if i, ok := t.arrayIndex(key); ok {
+		t.arr[i] = value
+		if value == nil && i == len(t.arr)-1 {
+			for len(t.arr) > 0 && t.arr[len(t.arr)-1] == nil {
+				t.arr = t.arr[:len(t.arr)-1]
+			}
+		}
+		return
+	}
+
+	// the key right after the array grows it, along with the keys that
+	// follow it in the hash
+	if n, ok := key.(float64); ok && n == float64(len(t.arr)+1) {
+		if value == nil {
+			t.hashDelete(key)
+			return
+		}
+		t.hashDelete(key)
+		t.arr = append(t.arr, value)
+		for len(t.entries)-t.dead > 0 {
+			next := float64(len(t.arr) + 1)
+			i, ok := t.hashIdx[next]
+			if !ok || t.entries[i].value == nil {
+				break
+			}
+			t.arr = append(t.arr, t.entries[i].value)
+			t.hashDelete(next)
+		}
+		return
+	}
+
+	if t.hashIdx != nil {
+		if i, ok := t.hashIdx[key]; ok {
+			if value == nil && t.entries[i].value != nil {
+				t.dead++
+			} else if value != nil && t.entries[i].value == nil {
+				t.dead--
+			}
+			t.entries[i].value = value
+			return
+		}
+	}
+	if value == nil {
+		return
+	}
+	if t.hashIdx == nil {
+		t.hashIdx = make(map[luaValue]int)
+	}
+	if t.dead > 16 && t.dead > len(t.entries)/2 {
+		t.compact()
+	}
+	t.hashIdx[key] = len(t.entries)
+	t.entries = append(t.entries, luaTableEntry{key, value})
+}
+
+func (t *luaTable) hashDelete(key luaValue) {
+	if t.hashIdx == nil {
+		return
+	}
+	if i, ok := t.hashIdx[key]; ok && t.entries[i].value != nil {
+		t.entries[i].value = nil
+		t.dead++
+	}
+}
+
+// compact drops the entries set to nil. New keys are not allowed while a
+// table is traversed, so no next runs across it.
+func (t *luaTable) compact() {
+	live := t.entries[:0]
+	for _, e := range t.entries {
+		if e.value != nil {
+			live = append(live, e)
+		} else {
+			delete(t.hashIdx, e.key)
+		}
+	}
+	for i := len(live); i < len(t.entries); i++ {
+		t.entries[i] = luaTableEntry{}
+	}
+	t.entries = live
+	for i, e := range t.entries {
+		t.hashIdx[e.key] = i
+	}
+	t.dead = 0
+}
+
+// length is a border of the table, like the # operator
+func (t *luaTable) length() int {
+	if len(t.arr) > 0 || t.hashIdx == nil {
+		return len(t.arr)
+	}
+	n := 0
+	for t.get(float64(n+1)) != nil {
+		n++
+	}
+	return n
+}
+
+// append adds the value at the end of the array
+func (t *luaTable) append(value luaValue) {
+	t.set(float64(t.length()+1), value)
+}
+
+// next returns the key and value following key in the traversal, a nil key
+// starting it. ok is false for a key not in the table.
+func (t *luaTable) next(key luaValue) (luaValue, luaValue, bool) {
+	i := 0
+	if key != nil {
+		if ai, ok := t.arrayIndex(key); ok {
+			i = ai + 1
+		} else {
+			hi, ok := t.hashIdx[key]
+			if !ok {
+				return nil, nil, false
+			}
+			i = len(t.arr) + hi + 1
+		}
+	}
+	for ; i < len(t.arr); i++ {
+		if t.arr[i] != nil {
+			return float64(i + 1), t.arr[i], true
+		}
+	}
+	for j := i - len(t.arr); j < len(t.entries); j++ {
+		if t.entries[j].value != nil {
+			return t.entries[j].key, t.entries[j].value, true
+		}
+	}
+	return nil, nil, true
+}
+
+// metaField returns a field of the metatable, like __index
+func (t *luaTable) metaField(name string) luaValue {
+	if t.meta == nil {
+		return nil
+	}
+	return t.meta.getStr(name)
+}
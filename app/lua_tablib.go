@@ -0,0 +1,104 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+func (L *luaState) openTableLib() {
+	lib := newLuaTable(0, 8)
+	L.globals.set("table", lib)
+
+	L.register(lib, "getn", func(L *luaState, args []luaValue) []luaValue {
+		return []luaValue{float64(L.checkTable(args, 1).length())}
+	})
+	L.register(lib, "maxn", func(L *luaState, args []luaValue) []luaValue {
+		t := L.checkTable(args, 1)
+		max := 0.0
+		for key, _, _ := t.next(nil); key != nil; key, _, _ = t.next(key) {
+			if n, ok := key.(float64); ok && n > max {
+				max = n
+			}
+		}
+		return []luaValue{max}
+	})
+	L.register(lib, "insert", func(L *luaState, args []luaValue) []luaValue {
+		t := L.checkTable(args, 1)
+		n := t.length()
+		switch len(args) {
+		case 2:
+			t.set(float64(n+1), args[1])
+		case 3:
+			pos := L.checkInt(args, 2)
+			if pos > n+1 {
+				n = pos - 1
+			}
+			for i := n + 1; i > pos; i-- {
+				t.set(float64(i), t.getInt(i-1))
+			}
+			t.set(float64(pos), args[2])
+		default:
+			L.runtimeError("wrong number of arguments to 'insert'")
+		}
+		return nil
+	})
+	L.register(lib, "remove", func(L *luaState, args []luaValue) []luaValue {
+		t := L.checkTable(args, 1)
+		n := t.length()
+		pos := L.optInt(args, 2, n)
+		if n == 0 {
+			return nil
+		}
+		if pos < 1 || pos > n {
+			return nil
+		}
+		value := t.getInt(pos)
+		for i := pos; i < n; i++ {
+			t.set(float64(i), t.getInt(i+1))
+		}
+		t.set(float64(n), nil)
+		return []luaValue{value}
+	})
+	L.register(lib, "concat", func(L *luaState, args []luaValue) []luaValue {
+		t := L.checkTable(args, 1)
+		sep := L.optString(args, 2, "")
+		i := L.optInt(args, 3, 1)
+		j := L.optInt(args, 4, t.length())
+		var b strings.Builder
+		for k := i; k <= j; k++ {
+			s, ok := luaToString(t.getInt(k))
+			if !ok {
+				L.runtimeError("invalid value (at index %d) in table for 'concat'", k)
+			}
+			b.WriteString(s)
+			if k != j {
+				b.WriteString(sep)
+			}
+		}
+		return []luaValue{b.String()}
+	})
+	L.register(lib, "sort", func(L *luaState, args []luaValue) []luaValue {
+		t := L.checkTable(args, 1)
+		n := t.length()
+		values := make([]luaValue, n)
+		for i := range values {
+			values[i] = t.getInt(i + 1)
+		}
+		less := func(a, b luaValue) bool { return L.lessThan(a, b) }
+		if cmp := luaArg(args, 2); cmp != nil {
+			switch cmp.(type) {
+			case *luaClosure, *luaGoFunction:
+			default:
+				L.typeError(args, 2, "function")
+			}
+			less = func(a, b luaValue) bool {
+				return luaToBoolean(luaFirst(L.call(cmp, []luaValue{a, b})))
+			}
+		}
+		sort.SliceStable(values, func(i, j int) bool { return less(values[i], values[j]) })
+		for i, v := range values {
+			t.set(float64(i+1), v)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,930 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// luaValue is a Lua value: nil, bool, float64, string, *luaTable,
+// *luaClosure or *luaGoFunction
+type luaValue interface{}
+
+// luaClosure is a Lua function with the cells of its upvalues
+type luaClosure struct {
+	proto  *luaProto
+	upvals []*luaValue
+}
+
+// luaGoFunction is a function of the libraries, written in Go
+type luaGoFunction struct {
+	name string
+	fn   func(L *luaState, args []luaValue) []luaValue
+}
+
+// luaError is a Lua error on its way to the closest pcall, carrying the
+// error value
+type luaError struct {
+	value luaValue
+}
+
+func (err *luaError) Error() string {
+	if s, ok := luaToString(err.value); ok {
+		return s
+	}
+	return fmt.Sprintf("(error object is a %s value)", luaTypeName(err.value))
+}
+
+// luaFrame is the activation of a Lua function
+type luaFrame struct {
+	closure *luaClosure
+	cells   []*luaValue
+	varargs []luaValue
+	line    int
+}
+
+// Lua calls deeper than this fail with a stack overflow, as in Lua 5.1
+const luaMaxCalls = 20000
+
+// luaHookEvery is how many loop iterations and calls run between two calls
+// of the hook
+const luaHookEvery = 1000
+
+// luaState is an interpreter with its globals
+type luaState struct {
+	globals    *luaTable
+	stringMeta *luaTable
+
+	// PRNG of math.random
+	rand luaRand48
+
+	frames []*luaFrame
+	depth  int
+
+	// called every luaHookEvery steps, it may raise an error to stop the
+	// script
+	hook  func(L *luaState)
+	steps int
+
+	// the Go function running, for its error messages
+	goFunc string
+}
+
+func newLuaState() *luaState {
+	L := &luaState{
+		globals: newLuaTable(0, 64),
+	}
+	L.openBaseLib()
+	L.openStringLib()
+	L.openTableLib()
+	L.openMathLib()
+	return L
+}
+
+// register adds a Go function to a table
+func (L *luaState) register(t *luaTable, name string, fn func(L *luaState, args []luaValue) []luaValue) {
+	t.set(name, &luaGoFunction{name: name, fn: fn})
+}
+
+// load compiles a chunk into a function of the globals
+func (L *luaState) load(src, chunk string) (*luaClosure, error) {
+	proto, err := luaCompile(src, chunk)
+	if err != nil {
+		return nil, err
+	}
+	return &luaClosure{proto: proto}, nil
+}
+
+// raise throws a Lua error with the value as is
+func (L *luaState) raise(value luaValue) {
+	panic(&luaError{value: value})
+}
+
+// runtimeError throws an error message prefixed by the position of the Lua
+// code running
+func (L *luaState) runtimeError(format string, args ...interface{}) {
+	L.raise(L.where(1) + fmt.Sprintf(format, args...))
+}
+
+// where is the chunk:line: prefix of the Lua function level frames up the
+// stack, empty when there is none
+func (L *luaState) where(level int) string {
+	if level < 1 || level > len(L.frames) {
+		return ""
+	}
+	frame := L.frames[len(L.frames)-level]
+	return fmt.Sprintf("%s:%d: ", frame.closure.proto.chunk, frame.line)
+}
+
+// pcall calls fn and returns the error it raised, if any
+func (L *luaState) pcall(fn luaValue, args []luaValue) ([]luaValue, *luaError) {
+	return L.xpcall(fn, args, nil)
+}
+
+// xpcall is pcall with a handler that rewrites the error value while the
+// stack is still the one of the error, to add where it happened
+func (L *luaState) xpcall(fn luaValue, args []luaValue, handler func(L *luaState, err luaValue) luaValue) (rets []luaValue, lerr *luaError) {
+	frames, depth, goFunc := len(L.frames), L.depth, L.goFunc
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(*luaError)
+			if !ok {
+				panic(r)
+			}
+			if handler != nil {
+				e = &luaError{value: handler(L, e.value)}
+			}
+			for i := frames; i < len(L.frames); i++ {
+				L.frames[i] = nil
+			}
+			L.frames = L.frames[:frames]
+			L.depth = depth
+			L.goFunc = goFunc
+			rets, lerr = nil, e
+		}
+	}()
+	return L.call(fn, args), nil
+}
+
+func (L *luaState) step() {
+	L.steps++
+	if L.steps >= luaHookEvery {
+		L.steps = 0
+		if L.hook != nil {
+			L.hook(L)
+		}
+	}
+}
+
+// call calls a function value with the arguments and returns its results
+func (L *luaState) call(fn luaValue, args []luaValue) []luaValue {
+	L.step()
+	switch f := fn.(type) {
+	case *luaClosure:
+		return L.callClosure(f, args)
+	case *luaGoFunction:
+		L.depth++
+		if L.depth > luaMaxCalls {
+			L.runtimeError("stack overflow")
+		}
+		goFunc := L.goFunc
+		L.goFunc = f.name
+		rets := f.fn(L, args)
+		L.goFunc = goFunc
+		L.depth--
+		return rets
+	case *luaTable:
+		if h := f.metaField("__call"); h != nil {
+			return L.call(h, append([]luaValue{f}, args...))
+		}
+	}
+	L.runtimeError("attempt to call a %s value", luaTypeName(fn))
+	return nil
+}
+
+func (L *luaState) callClosure(f *luaClosure, args []luaValue) []luaValue {
+	L.depth++
+	if L.depth > luaMaxCalls {
+		L.runtimeError("stack overflow")
+	}
+
+	proto := f.proto
+	frame := &luaFrame{closure: f, cells: make([]*luaValue, proto.numSlots), line: proto.line}
+	for i, slot := range proto.params {
+		cell := new(luaValue)
+		if i < len(args) {
+			*cell = args[i]
+		}
+		frame.cells[slot] = cell
+	}
+	if proto.isVararg && len(args) > len(proto.params) {
+		frame.varargs = args[len(proto.params):]
+	}
+
+	L.frames = append(L.frames, frame)
+	_, rets := L.execBlock(frame, proto.body)
+	L.frames[len(L.frames)-1] = nil
+	L.frames = L.frames[:len(L.frames)-1]
+	L.depth--
+	return rets
+}
+
+// how a block ended
+const (
+	luaFlowNormal = iota
+	luaFlowBreak
+	luaFlowReturn
+)
+
+func (L *luaState) execBlock(frame *luaFrame, block *luaBlock) (int, []luaValue) {
+	for _, stmt := range block.stmts {
+		if flow, rets := L.execStmt(frame, stmt); flow != luaFlowNormal {
+			return flow, rets
+		}
+	}
+	return luaFlowNormal, nil
+}
+
+func (L *luaState) execStmt(frame *luaFrame, stmt luaStmt) (int, []luaValue) {
+	switch s := stmt.(type) {
+	case *luaLocalStmt:
+		frame.line = s.line
+		values := L.evalList(frame, s.exprs, len(s.slots))
+		for i, slot := range s.slots {
+			cell := new(luaValue)
+			*cell = values[i]
+			frame.cells[slot] = cell
+		}
+	case *luaAssignStmt:
+		frame.line = s.line
+		L.execAssign(frame, s)
+	case *luaCallStmt:
+		frame.line = s.line
+		L.evalMulti(frame, s.call)
+	case *luaLocalFunctionStmt:
+		frame.line = s.line
+		cell := new(luaValue)
+		frame.cells[s.slot] = cell
+		*cell = L.newClosure(frame, s.fn.proto)
+	case *luaIfStmt:
+		frame.line = s.line
+		for i, cond := range s.conds {
+			if luaToBoolean(L.eval(frame, cond)) {
+				return L.execBlock(frame, s.blocks[i])
+			}
+		}
+		if s.elseBlock != nil {
+			return L.execBlock(frame, s.elseBlock)
+		}
+	case *luaWhileStmt:
+		for {
+			frame.line = s.line
+			if !luaToBoolean(L.eval(frame, s.cond)) {
+				break
+			}
+			flow, rets := L.execBlock(frame, s.block)
+			if flow == luaFlowBreak {
+				break
+			}
+			if flow == luaFlowReturn {
+				return flow, rets
+			}
+			L.step()
+		}
+	case *luaRepeatStmt:
+		for {
+			flow, rets := L.execBlock(frame, s.block)
+			if flow == luaFlowBreak {
+				break
+			}
+			if flow == luaFlowReturn {
+				return flow, rets
+			}
+			frame.line = s.line
+			if luaToBoolean(L.eval(frame, s.cond)) {
+				break
+			}
+			L.step()
+		}
+	case *luaNumericForStmt:
+		return L.execNumericFor(frame, s)
+	case *luaGenericForStmt:
+		return L.execGenericFor(frame, s)
+	case *luaDoStmt:
+		return L.execBlock(frame, s.block)
+	case *luaReturnStmt:
+		frame.line = s.line
+		// a call in tail position passes all its results
+		if len(s.exprs) == 1 {
+			return luaFlowReturn, L.evalMulti(frame, s.exprs[0])
+		}
+		return luaFlowReturn, L.evalList(frame, s.exprs, -1)
+	case *luaBreakStmt:
+		return luaFlowBreak, nil
+	}
+	return luaFlowNormal, nil
+}
+
+func (L *luaState) execAssign(frame *luaFrame, s *luaAssignStmt) {
+	if len(s.targets) == 1 && len(s.exprs) == 1 {
+		L.assign(frame, s.targets[0], s.exprs[0])
+		return
+	}
+
+	// the tables and keys of the targets are evaluated before the values
+	type target struct {
+		obj, key luaValue
+	}
+	targets := make([]target, len(s.targets))
+	for i, t := range s.targets {
+		if index, ok := t.(*luaIndexExpr); ok {
+			targets[i] = target{L.eval(frame, index.obj), L.eval(frame, index.key)}
+		}
+	}
+	values := L.evalList(frame, s.exprs, len(s.targets))
+	for i, t := range s.targets {
+		switch e := t.(type) {
+		case *luaLocalExpr:
+			*frame.cells[e.slot] = values[i]
+		case *luaUpvalExpr:
+			*frame.closure.upvals[e.index] = values[i]
+		case *luaGlobalExpr:
+			L.setIndex(L.globals, e.name, values[i], nil)
+		case *luaIndexExpr:
+			L.setIndex(targets[i].obj, targets[i].key, values[i], e.obj)
+		}
+	}
+}
+
+// assign is the common a = b, without the lists
+func (L *luaState) assign(frame *luaFrame, target, expr luaExpr) {
+	switch e := target.(type) {
+	case *luaLocalExpr:
+		*frame.cells[e.slot] = L.eval(frame, expr)
+	case *luaUpvalExpr:
+		*frame.closure.upvals[e.index] = L.eval(frame, expr)
+	case *luaGlobalExpr:
+		L.setIndex(L.globals, e.name, L.eval(frame, expr), nil)
+	case *luaIndexExpr:
+		obj := L.eval(frame, e.obj)
+		key := L.eval(frame, e.key)
+		value := L.eval(frame, expr)
+		L.setIndex(obj, key, value, e.obj)
+	}
+}
+
+func (L *luaState) execNumericFor(frame *luaFrame, s *luaNumericForStmt) (int, []luaValue) {
+	frame.line = s.line
+	start, ok1 := luaToNumber(L.eval(frame, s.start))
+	limit, ok2 := luaToNumber(L.eval(frame, s.limit))
+	step := 1.0
+	ok3 := true
+	if s.step != nil {
+		step, ok3 = luaToNumber(L.eval(frame, s.step))
+	}
+	switch {
+	case !ok1:
+		L.runtimeError("'for' initial value must be a number")
+	case !ok2:
+		L.runtimeError("'for' limit must be a number")
+	case !ok3:
+		L.runtimeError("'for' step must be a number")
+	}
+
+	for i := start; (step > 0 && i <= limit) || (step <= 0 && i >= limit); i += step {
+		cell := new(luaValue)
+		*cell = i
+		frame.cells[s.slot] = cell
+		flow, rets := L.execBlock(frame, s.block)
+		if flow == luaFlowBreak {
+			break
+		}
+		if flow == luaFlowReturn {
+			return flow, rets
+		}
+		L.step()
+	}
+	return luaFlowNormal, nil
+}
+
+func (L *luaState) execGenericFor(frame *luaFrame, s *luaGenericForStmt) (int, []luaValue) {
+	frame.line = s.line
+	init := L.evalList(frame, s.exprs, 3)
+	fn, state, control := init[0], init[1], init[2]
+	for {
+		values := L.call(fn, []luaValue{state, control})
+		if len(values) == 0 || values[0] == nil {
+			break
+		}
+		control = values[0]
+		for i, slot := range s.slots {
+			cell := new(luaValue)
+			if i < len(values) {
+				*cell = values[i]
+			}
+			frame.cells[slot] = cell
+		}
+		flow, rets := L.execBlock(frame, s.block)
+		if flow == luaFlowBreak {
+			break
+		}
+		if flow == luaFlowReturn {
+			return flow, rets
+		}
+		frame.line = s.line
+	}
+	return luaFlowNormal, nil
+}
+
+func (L *luaState) newClosure(frame *luaFrame, proto *luaProto) *luaClosure {
+	f := &luaClosure{proto: proto, upvals: make([]*luaValue, len(proto.upvals))}
+	for i, desc := range proto.upvals {
+		if desc.fromLocal {
+			f.upvals[i] = frame.cells[desc.index]
+		} else {
+			f.upvals[i] = frame.closure.upvals[desc.index]
+		}
+	}
+	return f
+}
+
+// evalList evaluates expressions into exactly n values, with the last one
+// expanding to all its results. n -1 keeps them all.
+func (L *luaState) evalList(frame *luaFrame, exprs []luaExpr, n int) []luaValue {
+	var values []luaValue
+	if n >= 0 {
+		values = make([]luaValue, 0, n)
+	}
+	for i, e := range exprs {
+		if i == len(exprs)-1 {
+			values = append(values, L.evalMulti(frame, e)...)
+		} else {
+			values = append(values, L.eval(frame, e))
+		}
+	}
+	if n < 0 {
+		return values
+	}
+	for len(values) < n {
+		values = append(values, nil)
+	}
+	return values[:n]
+}
+
+// evalMulti evaluates an expression to all its values, more than one for
+// calls and ...
+func (L *luaState) evalMulti(frame *luaFrame, e luaExpr) []luaValue {
+	switch e := e.(type) {
+	case *luaCallExpr:
+		fn := L.eval(frame, e.fn)
+		args := L.evalList(frame, e.args, -1)
+		frame.line = e.line
+		if _, ok := fn.(*luaClosure); !ok {
+			if _, ok := fn.(*luaGoFunction); !ok {
+				if t, ok := fn.(*luaTable); !ok || t.metaField("__call") == nil {
+					L.runtimeError("attempt to call a %s value%s", luaTypeName(fn), luaDescribe(e.fn))
+				}
+			}
+		}
+		return L.call(fn, args)
+	case *luaMethodCallExpr:
+		obj := L.eval(frame, e.obj)
+		frame.line = e.line
+		fn := L.index(obj, e.name, e.obj)
+		args := append([]luaValue{obj}, L.evalList(frame, e.args, -1)...)
+		frame.line = e.line
+		if fn == nil {
+			L.runtimeError("attempt to call a nil value (method '%s')", e.name)
+		}
+		return L.call(fn, args)
+	case *luaVarargExpr:
+		return append([]luaValue(nil), frame.varargs...)
+	}
+	return []luaValue{L.eval(frame, e)}
+}
+
+func (L *luaState) eval(frame *luaFrame, e luaExpr) luaValue {
+	switch e := e.(type) {
+	case *luaConstExpr:
+		return e.value
+	case *luaLocalExpr:
+		return *frame.cells[e.slot]
+	case *luaUpvalExpr:
+		return *frame.closure.upvals[e.index]
+	case *luaGlobalExpr:
+		return L.index(L.globals, e.name, nil)
+	case *luaIndexExpr:
+		obj := L.eval(frame, e.obj)
+		key := L.eval(frame, e.key)
+		frame.line = e.line
+		return L.index(obj, key, e.obj)
+	case *luaCallExpr, *luaMethodCallExpr, *luaVarargExpr:
+		values := L.evalMulti(frame, e)
+		if len(values) == 0 {
+			return nil
+		}
+		return values[0]
+	case *luaParenExpr:
+		return L.eval(frame, e.expr)
+	case *luaFunctionExpr:
+		return L.newClosure(frame, e.proto)
+	case *luaBinopExpr:
+		return L.evalBinop(frame, e)
+	case *luaUnopExpr:
+		v := L.eval(frame, e.expr)
+		frame.line = e.line
+		switch e.op {
+		case tkNot:
+			return !luaToBoolean(v)
+		case '-':
+			n, ok := luaToNumber(v)
+			if !ok {
+				L.runtimeError("attempt to perform arithmetic on a %s value%s", luaTypeName(v), luaDescribe(e.expr))
+			}
+			return -n
+		case '#':
+			switch v := v.(type) {
+			case string:
+				return float64(len(v))
+			case *luaTable:
+				return float64(v.length())
+			}
+			L.runtimeError("attempt to get length of a %s value%s", luaTypeName(v), luaDescribe(e.expr))
+		}
+	case *luaTableExpr:
+		return L.evalTable(frame, e)
+	}
+	return nil
+}
+
+func (L *luaState) evalTable(frame *luaFrame, e *luaTableExpr) luaValue {
+	t := newLuaTable(len(e.fields), 0)
+	n := 0
+	for i, field := range e.fields {
+		if field.key != nil {
+			key := L.eval(frame, field.key)
+			frame.line = e.line
+			L.checkTableKey(key)
+			t.set(key, L.eval(frame, field.value))
+			continue
+		}
+		if i == len(e.fields)-1 {
+			for _, v := range L.evalMulti(frame, field.value) {
+				n++
+				t.set(float64(n), v)
+			}
+			continue
+		}
+		n++
+		t.set(float64(n), L.eval(frame, field.value))
+	}
+	return t
+}
+
+func (L *luaState) evalBinop(frame *luaFrame, e *luaBinopExpr) luaValue {
+	left := L.eval(frame, e.left)
+	switch e.op {
+	case tkAnd:
+		if !luaToBoolean(left) {
+			return left
+		}
+		return L.eval(frame, e.right)
+	case tkOr:
+		if luaToBoolean(left) {
+			return left
+		}
+		return L.eval(frame, e.right)
+	}
+
+	right := L.eval(frame, e.right)
+	frame.line = e.line
+	switch e.op {
+	case tkEq:
+		return luaRawEqual(left, right)
+	case tkNe:
+		return !luaRawEqual(left, right)
+	case '<':
+		return L.lessThan(left, right)
+	case '>':
+		return L.lessThan(right, left)
+	case tkLe:
+		return L.lessEqual(left, right)
+	case tkGe:
+		return L.lessEqual(right, left)
+	case tkConcat:
+		return L.concat(left, right, e)
+	}
+	return L.arith(e.op, left, right, e)
+}
+
+func (L *luaState) arith(op int, left, right luaValue, e *luaBinopExpr) luaValue {
+	a, ok1 := luaToNumber(left)
+	b, ok2 := luaToNumber(right)
+	if !ok1 || !ok2 {
+		if h := L.binaryMetamethod(left, right, luaArithEvents[op]); h != nil {
+			return luaFirst(L.call(h, []luaValue{left, right}))
+		}
+		bad, expr := left, e.left
+		if ok1 {
+			bad, expr = right, e.right
+		}
+		L.runtimeError("attempt to perform arithmetic on a %s value%s", luaTypeName(bad), luaDescribe(expr))
+	}
+	switch op {
+	case '+':
+		return a + b
+	case '-':
+		return a - b
+	case '*':
+		return a * b
+	case '/':
+		return a / b
+	case '%':
+		return a - math.Floor(a/b)*b
+	case '^':
+		return math.Pow(a, b)
+	}
+	return nil
+}
+
+var luaArithEvents = map[int]string{
+	'+': "__add", '-': "__sub", '*': "__mul", '/': "__div", '%': "__mod", '^': "__pow",
+}
+
+func (L *luaState) binaryMetamethod(left, right luaValue, event string) luaValue {
+	if t, ok := left.(*luaTable); ok {
+		if h := t.metaField(event); h != nil {
+			return h
+		}
+	}
+	if t, ok := right.(*luaTable); ok {
+		return t.metaField(event)
+	}
+	return nil
+}
+
+func (L *luaState) concat(left, right luaValue, e *luaBinopExpr) luaValue {
+	a, ok1 := luaToString(left)
+	b, ok2 := luaToString(right)
+	if !ok1 || !ok2 {
+		if h := L.binaryMetamethod(left, right, "__concat"); h != nil {
+			return luaFirst(L.call(h, []luaValue{left, right}))
+		}
+		bad, expr := left, e.left
+		if ok1 {
+			bad, expr = right, e.right
+		}
+		L.runtimeError("attempt to concatenate a %s value%s", luaTypeName(bad), luaDescribe(expr))
+	}
+	return a + b
+}
+
+func (L *luaState) lessThan(left, right luaValue) bool {
+	switch a := left.(type) {
+	case float64:
+		if b, ok := right.(float64); ok {
+			return a < b
+		}
+	case string:
+		if b, ok := right.(string); ok {
+			return a < b
+		}
+	}
+	if h := L.binaryMetamethod(left, right, "__lt"); h != nil {
+		return luaToBoolean(luaFirst(L.call(h, []luaValue{left, right})))
+	}
+	L.compareError(left, right)
+	return false
+}
+
+func (L *luaState) lessEqual(left, right luaValue) bool {
+	switch a := left.(type) {
+	case float64:
+		if b, ok := right.(float64); ok {
+			return a <= b
+		}
+	case string:
+		if b, ok := right.(string); ok {
+			return a <= b
+		}
+	}
+	if h := L.binaryMetamethod(left, right, "__le"); h != nil {
+		return luaToBoolean(luaFirst(L.call(h, []luaValue{left, right})))
+	}
+	L.compareError(left, right)
+	return false
+}
+
+func (L *luaState) compareError(left, right luaValue) {
+	t1, t2 := luaTypeName(left), luaTypeName(right)
+	if t1 == t2 {
+		L.runtimeError("attempt to compare two %s values", t1)
+	}
+	L.runtimeError("attempt to compare %s with %s", t1, t2)
+}
+
+// index reads obj[key], going through __index when the key is missing. from
+// is the expression obj comes from, named in the error messages.
+func (L *luaState) index(obj, key luaValue, from luaExpr) luaValue {
+	for loop := 0; loop < 100; loop++ {
+		var h luaValue
+		switch o := obj.(type) {
+		case *luaTable:
+			v := o.get(key)
+			if v != nil {
+				return v
+			}
+			if h = o.metaField("__index"); h == nil {
+				return nil
+			}
+		case string:
+			if L.stringMeta == nil {
+				return nil
+			}
+			h = L.stringMeta.getStr("__index")
+		default:
+			L.runtimeError("attempt to index a %s value%s", luaTypeName(obj), luaDescribe(from))
+		}
+		switch h.(type) {
+		case *luaClosure, *luaGoFunction:
+			return luaFirst(L.call(h, []luaValue{obj, key}))
+		}
+		obj, from = h, nil
+	}
+	L.runtimeError("loop in gettable")
+	return nil
+}
+
+// setIndex writes obj[key], going through __newindex for a new key
+func (L *luaState) setIndex(obj, key, value luaValue, from luaExpr) {
+	for loop := 0; loop < 100; loop++ {
+		t, ok := obj.(*luaTable)
+		if !ok {
+			L.runtimeError("attempt to index a %s value%s", luaTypeName(obj), luaDescribe(from))
+		}
+		if t.readonly {
+			L.runtimeError("Attempt to modify a readonly table")
+		}
+		h := t.metaField("__newindex")
+		if h == nil || t.get(key) != nil {
+			L.checkTableKey(key)
+			t.set(key, value)
+			return
+		}
+		switch h.(type) {
+		case *luaClosure, *luaGoFunction:
+			L.call(h, []luaValue{t, key, value})
+			return
+		}
+		obj, from = h, nil
+	}
+	L.runtimeError("loop in settable")
+}
+
+func (L *luaState) checkTableKey(key luaValue) {
+	if key == nil {
+		L.runtimeError("table index is nil")
+	}
+	if n, ok := key.(float64); ok && math.IsNaN(n) {
+		L.runtimeError("table index is NaN")
+	}
+}
+
+// luaDescribe names the variable an expression reads, for error messages
+func luaDescribe(e luaExpr) string {
+	switch e := e.(type) {
+	case *luaGlobalExpr:
+		return fmt.Sprintf(" (global '%s')", e.name)
+	case *luaLocalExpr:
+		return fmt.Sprintf(" (local '%s')", e.name)
+	case *luaUpvalExpr:
+		return fmt.Sprintf(" (upvalue '%s')", e.name)
+	case *luaIndexExpr:
+		if c, ok := e.key.(*luaConstExpr); ok {
+			if s, ok := c.value.(string); ok {
+				return fmt.Sprintf(" (field '%s')", s)
+			}
+		}
+	}
+	return ""
+}
+
+func luaFirst(values []luaValue) luaValue {
+	if len(values) == 0 {
+		return nil
+	}
+	return values[0]
+}
+
+func luaTypeName(v luaValue) string {
+	switch v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case *luaTable:
+		return "table"
+	case *luaClosure, *luaGoFunction:
+		return "function"
+	}
+	return "userdata"
+}
+
+func luaToBoolean(v luaValue) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	}
+	return true
+}
+
+func luaRawEqual(a, b luaValue) bool {
+	return a == b
+}
+
+// luaToNumber converts numbers and numeric strings, as arithmetic does
+func luaToNumber(v luaValue) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case string:
+		return luaStringToNumber(v)
+	}
+	return 0, false
+}
+
+// luaStringToNumber parses a number the way the Lua lexer and tonumber do:
+// decimal, with an exponent, or hexadecimal, with spaces around
+func luaStringToNumber(s string) (float64, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, false
+	}
+	neg := false
+	body := s
+	if body[0] == '-' || body[0] == '+' {
+		neg = body[0] == '-'
+		body = body[1:]
+	}
+	if len(body) > 2 && body[0] == '0' && (body[1] == 'x' || body[1] == 'X') {
+		n, err := strconv.ParseUint(body[2:], 16, 64)
+		if err != nil {
+			return 0, false
+		}
+		if neg {
+			return -float64(n), true
+		}
+		return float64(n), true
+	}
+	for _, c := range body {
+		if !(c >= '0' && c <= '9') && c != '.' && c != 'e' && c != 'E' && c != '+' && c != '-' {
+			return 0, false
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		if ne, ok := err.(*strconv.NumError); ok && ne.Err == strconv.ErrRange {
+			return n, true
+		}
+		return 0, false
+	}
+	return n, true
+}
+
+// luaNumberToString formats a number like Lua 5.1, with %.14g
+func luaNumberToString(n float64) string {
+	switch {
+	case math.IsInf(n, 1):
+		return "inf"
+	case math.IsInf(n, -1):
+		return "-inf"
+	case math.IsNaN(n):
+		return "nan"
+	case n == math.Trunc(n) && math.Abs(n) < 1e15:
+		return strconv.FormatFloat(n, 'f', 0, 64)
+	}
+	return strconv.FormatFloat(n, 'g', 14, 64)
+}
+
+// luaToString converts strings and numbers, the values tostring doesn't
+// need a metamethod or an address for
+func luaToString(v luaValue) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case float64:
+		return luaNumberToString(v), true
+	}
+	return "", false
+}
+
+// luaAnyToString is tostring without the __tostring metamethod
+func luaAnyToString(v luaValue) string {
+	switch v := v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		if v {
+			return "true"
+		}
+		return "false"
+	case float64:
+		return luaNumberToString(v)
+	case string:
+		return v
+	case *luaTable:
+		return fmt.Sprintf("table: %p", v)
+	case *luaClosure:
+		return fmt.Sprintf("function: %p", v)
+	case *luaGoFunction:
+		return fmt.Sprintf("function: builtin: %p", v)
+	}
+	return fmt.Sprintf("userdata: %p", v)
+}
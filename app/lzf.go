@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+)
+
+// LZF as used by Redis for compressed RDB strings (a port of liblzf)
+
+const (
+	lzfHashLog    = 14
+	lzfMaxLiteral = 1 << 5
+	lzfMaxOffset  = 1 << 13
+	lzfMaxRef     = (1 << 8) + (1 << 3)
+)
+
+var errLzfCorrupt = errors.New("invalid LZF compressed data")
+
+func lzfHash(in []byte, i int) uint32 {
+	v := uint32(in[i])<<16 | uint32(in[i+1])<<8 | uint32(in[i+2])
+	return (v * 2654435761) >> (32 - lzfHashLog)
+}
+
+// lzfCompress returns the compressed data, or nil when the input does not
+// shrink and should be stored as is
+func lzfCompress(in []byte) []byte {
+	n := len(in)
+	if n < 4 {
+		return nil
+	}
+
+	var htab [1 << lzfHashLog]int
+	out := make([]byte, 0, n)
+
+	// every literal run is preceded by a control byte holding its length - 1
+	out = append(out, 0)
+	litPos, lit := 0, 0
+
+	emitLiteral := func(b byte) {
+		out = append(out, b)
+		lit++
+		if lit == lzfMaxLiteral {
+			out[litPos] = byte(lit - 1)
+			out = append(out, 0)
+			litPos, lit = len(out)-1, 0
+		}
+	}
+
+	ip := 0
+	for ip < n-2 {
+		h := lzfHash(in, ip)
+		ref := htab[h] - 1
+		htab[h] = ip + 1
+
+		off := ip - ref
+		if ref >= 0 && off > 0 && off <= lzfMaxOffset &&
+			in[ref] == in[ip] && in[ref+1] == in[ip+1] && in[ref+2] == in[ip+2] {
+			length := 3
+			maxLength := n - ip
+			if maxLength > lzfMaxRef {
+				maxLength = lzfMaxRef
+			}
+			for length < maxLength && in[ref+length] == in[ip+length] {
+				length++
+			}
+
+			// close the pending literal run
+			if lit == 0 {
+				out = out[:len(out)-1]
+			} else {
+				out[litPos] = byte(lit - 1)
+			}
+
+			l, o := length-2, off-1
+			if l < 7 {
+				out = append(out, byte(l<<5|o>>8))
+			} else {
+				out = append(out, byte(7<<5|o>>8), byte(l-7))
+			}
+			out = append(out, byte(o))
+
+			out = append(out, 0)
+			litPos, lit = len(out)-1, 0
+
+			ip += length
+			continue
+		}
+
+		emitLiteral(in[ip])
+		ip++
+	}
+
+	for ip < n {
+		emitLiteral(in[ip])
+		ip++
+	}
+
+	if lit == 0 {
+		out = out[:len(out)-1]
+	} else {
+		out[litPos] = byte(lit - 1)
+	}
+
+	if len(out) >= n {
+		return nil
+	}
+	return out
+}
+
+func lzfDecompress(in []byte, outLen int) ([]byte, error) {
+	out := make([]byte, 0, outLen)
+
+	for ip := 0; ip < len(in); {
+		ctrl := int(in[ip])
+		ip++
+
+		if ctrl < lzfMaxLiteral {
+			ctrl++
+			if ip+ctrl > len(in) || len(out)+ctrl > outLen {
+				return nil, errLzfCorrupt
+			}
+			out = append(out, in[ip:ip+ctrl]...)
+			ip += ctrl
+			continue
+		}
+
+		length := ctrl >> 5
+		if length == 7 {
+			if ip >= len(in) {
+				return nil, errLzfCorrupt
+			}
+			length += int(in[ip])
+			ip++
+		}
+		if ip >= len(in) {
+			return nil, errLzfCorrupt
+		}
+		ref := len(out) - ((ctrl&0x1f)<<8 | int(in[ip])) - 1
+		ip++
+		length += 2
+
+		if ref < 0 || len(out)+length > outLen {
+			return nil, errLzfCorrupt
+		}
+		// byte by byte, the reference may overlap what we are writing
+		for i := 0; i < length; i++ {
+			out = append(out, out[ref+i])
+		}
+	}
+
+	if len(out) != outLen {
+		return nil, errLzfCorrupt
+	}
+	return out, nil
+}
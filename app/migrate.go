@@ -0,0 +1,494 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DUMP serializes a value like the RDB does, followed by the RDB version and
+// a CRC64 of the whole, and RESTORE creates a key from it. MIGRATE moves
+// keys to another instance with the two, the way keys are moved between the
+// nodes of a cluster.
+
+// how long an unused MIGRATE connection is kept, and how many are
+const (
+	MIGRATE_SOCKET_CACHE_ITEMS = 64
+	MIGRATE_SOCKET_CACHE_TTL   = 10 * time.Second
+)
+
+// migrateCachedSocket is a connection MIGRATE keeps to a target, with the
+// database the target has selected on it
+type migrateCachedSocket struct {
+	conn        net.Conn
+	reader      *bufio.Reader
+	lastDbid    int
+	lastUseTime time.Time
+}
+
+// createDumpPayload serializes the value of a key for RESTORE
+func (server *RedisServer) createDumpPayload(obj *RedisObject) ([]byte, error) {
+	var payload bytes.Buffer
+	rdb := &rdbWriter{w: bufio.NewWriter(&payload), compression: server.Config.RdbCompression}
+	if err := rdb.saveObjectType(obj); err != nil {
+		return nil, err
+	}
+	if err := rdb.saveObject(obj); err != nil {
+		return nil, err
+	}
+	rdb.w.Flush()
+
+	buf := make([]byte, 2)
+	binary.LittleEndian.PutUint16(buf, RDB_VERSION)
+	payload.Write(buf)
+	buf = make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, crc64Update(0, payload.Bytes()))
+	payload.Write(buf)
+	return payload.Bytes(), nil
+}
+
+// verifyDumpPayload checks the version and the checksum of the footer
+func verifyDumpPayload(data string) bool {
+	if len(data) < 10 {
+		return false
+	}
+	footer := []byte(data[len(data)-10:])
+	if binary.LittleEndian.Uint16(footer[:2]) > RDB_VERSION {
+		return false
+	}
+	return binary.LittleEndian.Uint64(footer[2:]) == crc64Update(0, []byte(data[:len(data)-8]))
+}
+
+// loadDumpPayload creates the value a payload serializes
+func loadDumpPayload(data string) (*RedisObject, error) {
+	rdb := &rdbReader{r: bufio.NewReader(strings.NewReader(data[:len(data)-10]))}
+	rdbtype, err := rdb.readByte()
+	if err != nil {
+		return nil, err
+	}
+	obj, err := rdb.loadObject(rdbtype)
+	if err != nil {
+		return nil, err
+	}
+	// the value must be all of the payload
+	if _, err := rdb.readByte(); err == nil {
+		return nil, errRdbBadFormat
+	}
+	return obj, nil
+}
+
+func (server *RedisServer) handleDumpCommand(cmd string, args []interface{}) []byte {
+	key, _ := args[0].(string)
+	obj := server.lookupKeyRead(key)
+	if obj == nil {
+		return []byte("$-1\r\n")
+	}
+	payload, err := server.createDumpPayload(obj)
+	if err != nil {
+		return []byte(fmt.Sprintf("-ERR %v\r\n", err))
+	}
+	return addReplyBulk([]interface{}{string(payload)})
+}
+
+// handleRestoreCommand is RESTORE key ttl serialized-value [REPLACE]
+// [ABSTTL] [IDLETIME seconds] [FREQ frequency]. RESTORE-ASKING is the same
+// command, that MIGRATE sends to a node importing the slot.
+func (server *RedisServer) handleRestoreCommand(cmd string, args []interface{}) []byte {
+	key, _ := args[0].(string)
+	replace, absttl := false, false
+	lruIdle, lfuFreq := int64(-1), -1
+	for i := 3; i < len(args); i++ {
+		option, _ := args[i].(string)
+		switch strings.ToUpper(option) {
+		case "REPLACE":
+			replace = true
+		case "ABSTTL":
+			absttl = true
+		case "IDLETIME":
+			if i+1 >= len(args) || lfuFreq != -1 {
+				return []byte("-ERR syntax error\r\n")
+			}
+			s, _ := args[i+1].(string)
+			idle, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return []byte("-ERR value is not an integer or out of range\r\n")
+			}
+			if idle < 0 {
+				return []byte("-ERR Invalid IDLETIME value, must be >= 0\r\n")
+			}
+			lruIdle = idle
+			i++
+		case "FREQ":
+			if i+1 >= len(args) || lruIdle != -1 {
+				return []byte("-ERR syntax error\r\n")
+			}
+			s, _ := args[i+1].(string)
+			freq, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return []byte("-ERR value is not an integer or out of range\r\n")
+			}
+			if freq < 0 || freq > 255 {
+				return []byte("-ERR Invalid FREQ value, must be >= 0 and <= 255\r\n")
+			}
+			lfuFreq = int(freq)
+			i++
+		default:
+			return []byte("-ERR syntax error\r\n")
+		}
+	}
+
+	ttlArg, _ := args[1].(string)
+	ttl, err := strconv.ParseInt(ttlArg, 10, 64)
+	if err != nil {
+		return []byte("-ERR value is not an integer or out of range\r\n")
+	}
+	if ttl < 0 {
+		return []byte("-ERR Invalid TTL value, must be >= 0\r\n")
+	}
+
+	if !replace && server.lookupKeyWithFlags(key, LOOKUP_NOTOUCH|LOOKUP_WRITE) != nil {
+		return []byte("-BUSYKEY Target key name already exists.\r\n")
+	}
+
+	data, _ := args[2].(string)
+	if !verifyDumpPayload(data) {
+		return []byte("-ERR DUMP payload version or checksum are wrong\r\n")
+	}
+	obj, err := loadDumpPayload(data)
+	if err != nil {
+		return []byte("-ERR Bad data format\r\n")
+	}
+
+	deleted := false
+	if replace {
+		deleted = server.dbGenericDelete(key, server.Config.LazyfreeLazyServerDel)
+	}
+
+	if ttl != 0 && !absttl {
+		ttl += time.Now().UnixMilli()
+	}
+
+	// a key that would expire right away is only deleted
+	if ttl != 0 && !server.loading && server.Config.MasterHost == "" && ttl <= time.Now().UnixMilli() {
+		if deleted {
+			server.notifyKeyspaceEvent(NOTIFY_GENERIC, "del", key)
+			server.rewriteCommandVector("DEL", key)
+			server.Dirty++
+		}
+		return []byte("+OK\r\n")
+	}
+
+	server.setKey(key, obj)
+	if ttl != 0 {
+		server.setExpire(key, time.UnixMilli(ttl))
+
+		// the replicas and the AOF expire the key at the same time
+		if !absttl {
+			rewritten := make([]interface{}, 0, len(args)+1)
+			rewritten = append(rewritten, key, strconv.FormatInt(ttl, 10))
+			rewritten = append(rewritten, args[2:]...)
+			rewritten = append(rewritten, "ABSTTL")
+			server.rewriteCommandVector(cmd, rewritten...)
+		}
+	}
+	server.objectSetLRUOrLFU(obj, lruIdle, lfuFreq)
+	server.notifyKeyspaceEvent(NOTIFY_GENERIC, "restore", key)
+	server.Dirty++
+	return []byte("+OK\r\n")
+}
+
+// migrateGetKeys finds the keys of MIGRATE: the key argument, or the ones
+// after KEYS when it is empty
+func migrateGetKeys(args []interface{}) []string {
+	if len(args) < 5 {
+		return nil
+	}
+	for i := 5; i < len(args); i++ {
+		option, _ := args[i].(string)
+		switch strings.ToUpper(option) {
+		case "AUTH":
+			i++
+		case "AUTH2":
+			i += 2
+		case "KEYS":
+			if key, _ := args[2].(string); key == "" {
+				keys := make([]string, 0, len(args)-i-1)
+				for _, arg := range args[i+1:] {
+					key, _ := arg.(string)
+					keys = append(keys, key)
+				}
+				return keys
+			}
+		}
+	}
+	key, _ := args[2].(string)
+	return []string{key}
+}
+
+// migrateGetSocket returns the cached connection to the target, or a new
+// one. A new connection starts on database 0.
+func (server *RedisServer) migrateGetSocket(host, port string, timeout time.Duration) (*migrateCachedSocket, error) {
+	name := net.JoinHostPort(host, port)
+	if cs, ok := server.migrateCachedSockets[name]; ok {
+		cs.lastUseTime = time.Now()
+		return cs, nil
+	}
+
+	// too many connections, one of them goes
+	if len(server.migrateCachedSockets) == MIGRATE_SOCKET_CACHE_ITEMS {
+		for other := range server.migrateCachedSockets {
+			server.migrateCloseSocket(other)
+			break
+		}
+	}
+
+	conn, err := connDial(name, timeout, server.tlsDialConfig(server.Config.TlsCluster))
+	if err != nil {
+		return nil, err
+	}
+	cs := &migrateCachedSocket{conn: conn, reader: bufio.NewReader(conn), lastUseTime: time.Now()}
+	server.migrateCachedSockets[name] = cs
+	return cs, nil
+}
+
+func (server *RedisServer) migrateCloseSocket(name string) {
+	if cs, ok := server.migrateCachedSockets[name]; ok {
+		cs.conn.Close()
+		delete(server.migrateCachedSockets, name)
+	}
+}
+
+// migrateCloseTimedoutSockets closes the connections MIGRATE didn't use
+// for a while, called by the cron
+func (server *RedisServer) migrateCloseTimedoutSockets() {
+	for name, cs := range server.migrateCachedSockets {
+		if time.Since(cs.lastUseTime) > MIGRATE_SOCKET_CACHE_TTL {
+			server.migrateCloseSocket(name)
+		}
+	}
+}
+
+// handleMigrateCommand is MIGRATE host port key|"" destination-db timeout
+// [COPY] [REPLACE] [AUTH password | AUTH2 username password] [KEYS key ...].
+// The keys are restored on the target, then deleted here unless COPY is
+// given. The server waits for the target like Redis does, up to timeout
+// milliseconds for each read and write.
+func (server *RedisServer) handleMigrateCommand(cmd string, args []interface{}) []byte {
+	copyKeys, replace := false, false
+	var username, password string
+	firstKey, numKeys := 2, 1
+	for i := 5; i < len(args); i++ {
+		option, _ := args[i].(string)
+		switch strings.ToUpper(option) {
+		case "COPY":
+			copyKeys = true
+		case "REPLACE":
+			replace = true
+		case "AUTH":
+			if i+1 >= len(args) {
+				return []byte("-ERR syntax error\r\n")
+			}
+			password, _ = args[i+1].(string)
+			i++
+		case "AUTH2":
+			if i+2 >= len(args) {
+				return []byte("-ERR syntax error\r\n")
+			}
+			username, _ = args[i+1].(string)
+			password, _ = args[i+2].(string)
+			i += 2
+		case "KEYS":
+			if key, _ := args[2].(string); key != "" {
+				return []byte("-ERR When using MIGRATE KEYS option, the key argument must be set to the empty string\r\n")
+			}
+			firstKey, numKeys = i+1, len(args)-i-1
+			i = len(args)
+		default:
+			return []byte("-ERR syntax error\r\n")
+		}
+	}
+
+	host, _ := args[0].(string)
+	port, _ := args[1].(string)
+	dbArg, _ := args[3].(string)
+	timeoutArg, _ := args[4].(string)
+	dbid, err1 := strconv.Atoi(dbArg)
+	timeoutMs, err2 := strconv.ParseInt(timeoutArg, 10, 64)
+	if err1 != nil || err2 != nil {
+		return []byte("-ERR value is not an integer or out of range\r\n")
+	}
+	if timeoutMs <= 0 {
+		timeoutMs = 1000
+	}
+	timeout := time.Duration(timeoutMs) * time.Millisecond
+
+	// only the keys that exist are moved
+	type migrateKey struct {
+		key string
+		obj *RedisObject
+		ttl int64
+	}
+	keys := []migrateKey{}
+	now := time.Now().UnixMilli()
+	for _, arg := range args[firstKey : firstKey+numKeys] {
+		key, _ := arg.(string)
+		obj := server.lookupKeyWithFlags(key, LOOKUP_NOTOUCH)
+		if obj == nil {
+			continue
+		}
+		ttl := int64(0)
+		if when, ok := server.Expirations.Get(key); ok {
+			ttl = when.UnixMilli() - now
+			if ttl < 0 {
+				continue
+			}
+			if ttl < 1 {
+				ttl = 1
+			}
+		}
+		keys = append(keys, migrateKey{key: key, obj: obj, ttl: ttl})
+	}
+	if len(keys) == 0 {
+		return []byte("+NOKEY\r\n")
+	}
+
+	restoreCmd := "RESTORE"
+	if server.cluster != nil {
+		restoreCmd = "RESTORE-ASKING"
+	}
+
+	// a cached connection the target closed is retried once on a new one
+	name := net.JoinHostPort(host, port)
+	for mayRetry := true; ; mayRetry = false {
+		cs, err := server.migrateGetSocket(host, port, timeout)
+		if err != nil {
+			return []byte("-IOERR error or timeout connecting to the client\r\n")
+		}
+
+		var buf bytes.Buffer
+		if password != "" {
+			if username != "" {
+				catAppendOnlyCommand(&buf, "AUTH", []interface{}{username, password})
+			} else {
+				catAppendOnlyCommand(&buf, "AUTH", []interface{}{password})
+			}
+		}
+		selectDb := cs.lastDbid != dbid
+		if selectDb {
+			catAppendOnlyCommand(&buf, "SELECT", []interface{}{strconv.Itoa(dbid)})
+		}
+		for _, mk := range keys {
+			payload, err := server.createDumpPayload(mk.obj)
+			if err != nil {
+				return []byte(fmt.Sprintf("-ERR %v\r\n", err))
+			}
+			restoreArgs := []interface{}{mk.key, strconv.FormatInt(mk.ttl, 10), string(payload)}
+			if replace {
+				restoreArgs = append(restoreArgs, "REPLACE")
+			}
+			catAppendOnlyCommand(&buf, restoreCmd, restoreArgs)
+		}
+
+		cs.conn.SetWriteDeadline(time.Now().Add(timeout))
+		if _, err := cs.conn.Write(buf.Bytes()); err != nil {
+			server.migrateCloseSocket(name)
+			if mayRetry && !isTimeoutError(err) {
+				continue
+			}
+			return []byte("-IOERR error or timeout writing to target instance\r\n")
+		}
+
+		readReply := func() (string, error) {
+			cs.conn.SetReadDeadline(time.Now().Add(timeout))
+			line, err := cs.reader.ReadString('\n')
+			return strings.TrimRight(line, "\r\n"), err
+		}
+
+		// every reply is read, the connection is reused
+		var authReply, selectReply string
+		if password != "" {
+			if authReply, err = readReply(); err != nil {
+				server.migrateCloseSocket(name)
+				if mayRetry && !isTimeoutError(err) {
+					continue
+				}
+				return []byte("-IOERR error or timeout reading to target instance\r\n")
+			}
+		}
+		if selectDb {
+			if selectReply, err = readReply(); err != nil {
+				server.migrateCloseSocket(name)
+				if mayRetry && !isTimeoutError(err) {
+					continue
+				}
+				return []byte("-IOERR error or timeout reading to target instance\r\n")
+			}
+			cs.lastDbid = dbid
+		}
+
+		// the keys the target restored go away here, even when a later one
+		// fails
+		var errorReply []byte
+		deleted := []interface{}{}
+		retry := false
+		for i, mk := range keys {
+			reply, err := readReply()
+			if err != nil {
+				server.migrateCloseSocket(name)
+				// nothing was restored, the target may have closed the
+				// connection we cached
+				retry = errorReply == nil && i == 0 && mayRetry && !isTimeoutError(err)
+				if errorReply == nil {
+					errorReply = []byte("-IOERR error or timeout reading to target instance\r\n")
+				}
+				break
+			}
+			if strings.HasPrefix(authReply, "-") || strings.HasPrefix(selectReply, "-") || strings.HasPrefix(reply, "-") {
+				if errorReply == nil {
+					switch {
+					case strings.HasPrefix(authReply, "-"):
+						reply = authReply
+					case strings.HasPrefix(selectReply, "-"):
+						reply = selectReply
+					}
+					errorReply = []byte(fmt.Sprintf("-ERR Target instance replied with error: %s\r\n", reply[1:]))
+				}
+				continue
+			}
+			if !copyKeys {
+				server.dbGenericDelete(mk.key, server.Config.LazyfreeLazyServerDel)
+				server.notifyKeyspaceEvent(NOTIFY_GENERIC, "del", mk.key)
+				deleted = append(deleted, mk.key)
+			}
+		}
+		if retry {
+			continue
+		}
+		// the database the target selected is unknown after an error
+		if errorReply != nil {
+			server.migrateCloseSocket(name)
+		}
+
+		// the deletions are propagated, not the MIGRATE
+		if len(deleted) > 0 {
+			server.rewriteCommandVector("DEL", deleted...)
+			server.Dirty += int64(len(deleted))
+		} else {
+			server.preventCommandPropagation()
+		}
+		if errorReply != nil {
+			return errorReply
+		}
+		return []byte("+OK\r\n")
+	}
+}
+
+func isTimeoutError(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
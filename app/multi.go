@@ -0,0 +1,246 @@
+package main
+
+// multiCmd is a command queued by a client in MULTI
+type multiCmd struct {
+	command RedisCommand
+	cmd     string
+	args    []interface{}
+}
+
+// multiState holds the commands queued until EXEC
+type multiState struct {
+	commands []multiCmd
+	cmdFlags int // the flags of all the queued commands, like CMD_WRITE
+}
+
+// isMultiControlCommand tells the commands that run right away while the
+// client is in MULTI instead of being queued
+func isMultiControlCommand(cmd string) bool {
+	switch cmd {
+	case "EXEC", "DISCARD", "MULTI", "WATCH", "QUIT", "RESET":
+		return true
+	}
+	return false
+}
+
+// queueMultiCommand adds the command to the transaction of the client. The
+// arguments are copied, the request ones go back to the pool after the call.
+func (client *RedisClient) queueMultiCommand(command RedisCommand, cmd string, args []interface{}) {
+	queued := make([]interface{}, len(args))
+	copy(queued, args)
+	client.mstate.commands = append(client.mstate.commands, multiCmd{command: command, cmd: cmd, args: queued})
+	client.mstate.cmdFlags |= command.CmdFlags
+}
+
+// discardTransaction ends the transaction of the client, along with the
+// watch of its keys
+func (server *RedisServer) discardTransaction(client *RedisClient) {
+	client.mstate = multiState{}
+	client.Flags &^= CLIENT_MULTI | CLIENT_DIRTY_CAS | CLIENT_DIRTY_EXEC
+	server.unwatchAllKeys(client)
+}
+
+// watchKey makes EXEC fail if the key is modified before it runs. A key
+// already expired only counts as modified once it is written again.
+func (server *RedisServer) watchKey(client *RedisClient, key string) {
+	if _, ok := client.watchedKeys[key]; ok {
+		return
+	}
+	if client.watchedKeys == nil {
+		client.watchedKeys = make(map[string]bool)
+	}
+	client.watchedKeys[key] = server.keyIsExpired(key)
+
+	clients, ok := server.watchedKeys[key]
+	if !ok {
+		clients = make(map[*RedisClient]struct{})
+		server.watchedKeys[key] = clients
+	}
+	clients[client] = struct{}{}
+	server.watchingClients[client] = struct{}{}
+}
+
+func (server *RedisServer) unwatchAllKeys(client *RedisClient) {
+	for key := range client.watchedKeys {
+		clients := server.watchedKeys[key]
+		delete(clients, client)
+		if len(clients) == 0 {
+			delete(server.watchedKeys, key)
+		}
+	}
+	client.watchedKeys = nil
+	delete(server.watchingClients, client)
+}
+
+// isWatchedKeyExpired tells if one of the keys the client watches expired
+// since, which EXEC treats as a modification
+func (server *RedisServer) isWatchedKeyExpired(client *RedisClient) bool {
+	for key, expired := range client.watchedKeys {
+		if !expired && server.keyIsExpired(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// touchWatchedKey marks the clients watching the key, their EXEC will fail.
+// Deleting a key that was already expired when watched changes nothing.
+func (server *RedisServer) touchWatchedKey(key string) {
+	clients := server.watchedKeys[key]
+	if len(clients) == 0 {
+		return
+	}
+
+	_, exists := server.Storage.Get(key)
+	for client := range clients {
+		if client.watchedKeys[key] && !exists {
+			client.watchedKeys[key] = false
+			continue
+		}
+		client.Flags |= CLIENT_DIRTY_CAS
+	}
+}
+
+// unwatchClosedClients drops the watched keys of the clients that
+// disconnected, called by clientsCron
+func (server *RedisServer) unwatchClosedClients() {
+	for client := range server.watchingClients {
+		if client.isClosed() {
+			server.unwatchAllKeys(client)
+		}
+	}
+}
+
+// rejectCommand replies with the error that kept the command from running.
+// A transaction that misses a command must not run at all: a rejected EXEC
+// discards it, any other command makes EXEC fail.
+func (server *RedisServer) rejectCommand(client *RedisClient, cmd string, reply []byte) {
+	if client.Flags&CLIENT_MULTI != 0 {
+		if cmd == "EXEC" {
+			server.discardTransaction(client)
+			reply = []byte("-EXECABORT Transaction discarded because of: " + string(reply[1:]))
+		} else {
+			client.Flags |= CLIENT_DIRTY_EXEC
+		}
+	}
+	if command, ok := redisCommandTable[cmd]; ok {
+		server.commandStats(command).rejectedCalls++
+	}
+	server.afterErrorReply(reply)
+	client.addReply(reply)
+}
+
+func (server *RedisServer) handleMultiCommand(cmd string, args []interface{}) []byte {
+	if len(args) != 0 {
+		return addReplyErrorArity()
+	}
+
+	client := server.currentClient
+	if client.Flags&CLIENT_MULTI != 0 {
+		return []byte("-ERR MULTI calls can not be nested\r\n")
+	}
+	client.Flags |= CLIENT_MULTI
+	return []byte("+OK\r\n")
+}
+
+func (server *RedisServer) handleDiscardCommand(cmd string, args []interface{}) []byte {
+	if len(args) != 0 {
+		return addReplyErrorArity()
+	}
+
+	client := server.currentClient
+	if client.Flags&CLIENT_MULTI == 0 {
+		return []byte("-ERR DISCARD without MULTI\r\n")
+	}
+	server.discardTransaction(client)
+	return []byte("+OK\r\n")
+}
+
+func (server *RedisServer) handleWatchCommand(cmd string, args []interface{}) []byte {
+	if len(args) < 1 {
+		return addReplyErrorArity()
+	}
+
+	client := server.currentClient
+	if client.Flags&CLIENT_MULTI != 0 {
+		return []byte("-ERR WATCH inside MULTI is not allowed\r\n")
+	}
+	for _, arg := range args {
+		key, ok := arg.(string)
+		if !ok {
+			return []byte("-ERR Invalid key type\r\n")
+		}
+		server.watchKey(client, key)
+	}
+	return []byte("+OK\r\n")
+}
+
+func (server *RedisServer) handleUnwatchCommand(cmd string, args []interface{}) []byte {
+	if len(args) != 0 {
+		return addReplyErrorArity()
+	}
+
+	client := server.currentClient
+	server.unwatchAllKeys(client)
+	client.Flags &^= CLIENT_DIRTY_CAS
+	return []byte("+OK\r\n")
+}
+
+// handleExecCommand runs the queued commands one after the other. Nothing
+// else runs on the executor meanwhile, so no other client sees the dataset
+// halfway. When they change the dataset, their effects are propagated
+// between a MULTI and an EXEC so replicas and the AOF apply them at once.
+func (server *RedisServer) handleExecCommand(cmd string, args []interface{}) []byte {
+	if len(args) != 0 {
+		return addReplyErrorArity()
+	}
+
+	client := server.currentClient
+	if client.Flags&CLIENT_MULTI == 0 {
+		return []byte("-ERR EXEC without MULTI\r\n")
+	}
+
+	// a command failed to queue, or a watched key was modified: nothing runs
+	if client.Flags&CLIENT_DIRTY_EXEC != 0 {
+		server.discardTransaction(client)
+		return []byte("-EXECABORT Transaction discarded because of previous errors.\r\n")
+	}
+	if client.Flags&CLIENT_DIRTY_CAS != 0 || server.isWatchedKeyExpired(client) {
+		server.discardTransaction(client)
+		return client.addReplyNullArray()
+	}
+
+	commands := client.mstate.commands
+	server.discardTransaction(client)
+
+	server.inExec = true
+	server.execMultiPropagated = false
+	client.Flags |= CLIENT_DENY_BLOCKING
+
+	replies := make([][]byte, 0, len(commands))
+	for _, queued := range commands {
+		// the ACLs may have changed since the command was queued
+		if result, errArg := server.aclCheckAllPerm(client, queued.command, queued.cmd, queued.args); result != ACL_OK {
+			server.addAclLogDenial(client, result, ACL_LOG_CTX_MULTI, queued.cmd, errArg)
+			msg := aclErrorMessage(result, client.getUser(), queued.cmd, errArg, false)
+			replies = append(replies, []byte("-NOPERM ACLs rules changed between the moment the transaction was "+
+				"accumulated and the EXEC call. This command is no longer allowed for the following reason: "+msg+"\r\n"))
+			continue
+		}
+		replies = append(replies, server.call(client, queued.command, queued.cmd, queued.args))
+	}
+
+	client.Flags &^= CLIENT_DENY_BLOCKING
+	server.inExec = false
+
+	// EXEC itself closes the MULTI propagated before the first write
+	if server.execMultiPropagated {
+		server.Dirty++
+	}
+
+	reply := addReplyArrayLen(len(replies))
+	for _, r := range replies {
+		reply = append(reply, r...)
+	}
+	return reply
+}
@@ -0,0 +1,1000 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	CLIENT_SLAVE = 1 << iota
+	CLIENT_PUBSUB
+	CLIENT_MASTER
+	CLIENT_PRE_PSYNC             // replica that only knows SYNC
+	CLIENT_BLOCKED               // waiting for something, like WAIT
+	CLIENT_MASTER_FORCE_REPLY    // the master reads this reply, like REPLCONF ACK
+	CLIENT_MULTI                 // in a MULTI, its commands are queued
+	CLIENT_DENY_BLOCKING         // its commands can't block, like the ones of EXEC
+	CLIENT_DIRTY_CAS             // a watched key was modified, EXEC will fail
+	CLIENT_DIRTY_EXEC            // a command failed to queue, EXEC will abort
+	CLIENT_SCRIPT                // the client the scripts run commands as
+	CLIENT_ASKING                // sent ASKING, may run a command on an importing slot
+	CLIENT_READONLY              // sent READONLY, reads from a cluster replica
+	CLIENT_CLOSE_AFTER_COMMAND   // closed once the reply of its command is written
+	CLIENT_REPLY_OFF             // gets no replies, CLIENT REPLY OFF
+	CLIENT_REPLY_SKIP_NEXT       // the next command gets no reply, CLIENT REPLY SKIP
+	CLIENT_REPLY_SKIP            // the current command gets no reply
+	CLIENT_NO_EVICT              // never evicted to free memory, CLIENT NO-EVICT
+	CLIENT_NO_TOUCH              // its reads leave the LRU/LFU data alone, CLIENT NO-TOUCH
+	CLIENT_TRACKING              // told when the keys it read change, CLIENT TRACKING
+	CLIENT_TRACKING_BROKEN_REDIR // the client its invalidations go to disconnected
+	CLIENT_TRACKING_OPTIN        // only the reads after CLIENT CACHING YES are tracked
+	CLIENT_TRACKING_OPTOUT       // the reads after CLIENT CACHING NO are not tracked
+	CLIENT_TRACKING_CACHING      // sent CLIENT CACHING for its next command
+	CLIENT_TRACKING_NOLOOP       // not told about the keys it modified itself
+	CLIENT_TRACKING_BCAST        // told about all the keys of its prefixes, read or not
+)
+
+const (
+	CLIENT_TYPE_NORMAL = iota
+	CLIENT_TYPE_REPLICA
+	CLIENT_TYPE_PUBSUB
+	CLIENT_TYPE_COUNT
+)
+
+// The master is told apart by CLIENT LIST and CLIENT KILL only, it has no
+// output buffer limits
+const CLIENT_TYPE_MASTER = CLIENT_TYPE_COUNT
+
+// longest hostname, as in NI_MAXHOST
+const NET_HOST_STR_LEN = 256
+
+type RedisClient struct {
+	ID     uint64
+	Conn   net.Conn
+	Flags  int
+	server *RedisServer
+
+	// protocol version, switched with HELLO
+	resp int
+
+	// set with CLIENT SETNAME and CLIENT SETINFO
+	name    string
+	libName string
+	libVer  string
+
+	// when it connected, and when it last sent a command, with its name
+	ctime           time.Time
+	lastInteraction time.Time
+	lastCmd         string
+
+	// the client the invalidations of CLIENT TRACKING go to, 0 for itself
+	trackingRedirect uint64
+	// the prefixes of the keys it is told about in BCAST mode
+	trackingPrefixes map[string]struct{}
+
+	// set by AUTH, or HELLO with AUTH, with the right password, with the
+	// user it authenticated as. nil is the default user.
+	authenticated bool
+	user          *aclUser
+
+	// reply bytes produced by the executor, waiting for the writer of the
+	// client to write them. wake tells the writer there is something to do.
+	mu      sync.Mutex
+	pending *bytes.Buffer
+	wake    chan struct{}
+	closed  bool
+	// closed once the pending replies are written
+	closeAfterWrite bool
+
+	// bytes not yet written to the socket, including the ones being written
+	outputBytes        int64
+	softLimitReachedAt time.Time
+
+	// set on the replicas connected to us
+	replState          int
+	replListeningPort  int
+	replAddr           string // announced with REPLCONF ip-address
+	replCapa           int
+	psyncInitialOffset int64
+	replHeld           *bytes.Buffer // stream held back until the RDB is sent
+	replAckOff         int64         // offset the replica acknowledged with REPLCONF ACK
+	replAckTime        time.Time
+	replSyncStart      time.Time // when it asked for a full sync
+	replStreamOnAck    bool      // the stream starts with its first ACK, after a diskless sync
+
+	// replication offset after the last command, what WAIT waits for
+	woff int64
+
+	// for the master client, the offset of the stream read so far
+	readReploff int64
+
+	// set while blocked, the commands sent meanwhile are deferred
+	bstate   blockingState
+	deferred []CommandRequest
+
+	// commands queued since MULTI, and the keys watched for EXEC with
+	// whether they were already expired then
+	mstate      multiState
+	watchedKeys map[string]bool
+
+	// channels and patterns the client is subscribed to
+	pubsubChannels      map[string]struct{}
+	pubsubPatterns      map[string]struct{}
+	pubsubShardChannels map[string]struct{}
+}
+
+var nextClientID uint64
+
+func newClient(server *RedisServer, conn net.Conn) *RedisClient {
+	client := &RedisClient{
+		ID:      atomic.AddUint64(&nextClientID, 1),
+		Conn:    conn,
+		server:  server,
+		resp:    2,
+		pending: getReplyBuffer(),
+		wake:    make(chan struct{}, 1),
+		ctime:   time.Now(),
+	}
+	client.lastInteraction = client.ctime
+	go client.writeLoop()
+
+	server.clientsMu.Lock()
+	server.clients[client.ID] = client
+	server.stat.NumConnections++
+	server.clientsMu.Unlock()
+
+	return client
+}
+
+// addReply appends a reply to the client's pending buffer and wakes its
+// writer. The socket is written by the writer of the client only, so a
+// client that doesn't read its replies holds no one else's. Called on the
+// executor, like the checks of the flags and limits it does.
+func (client *RedisClient) addReply(reply []byte) {
+	// the master doesn't read replies to the stream it sends
+	if client.Flags&CLIENT_MASTER != 0 && client.Flags&CLIENT_MASTER_FORCE_REPLY == 0 {
+		return
+	}
+	if client.Flags&(CLIENT_REPLY_OFF|CLIENT_REPLY_SKIP) != 0 {
+		return
+	}
+
+	client.mu.Lock()
+	if client.closed {
+		client.mu.Unlock()
+		return
+	}
+	client.pending.Write(reply)
+	client.outputBytes += int64(len(reply))
+	if client.checkOutputBufferLimits() {
+		client.mu.Unlock()
+		client.closeOverOutputLimit()
+		return
+	}
+	client.wakeWriter()
+	client.mu.Unlock()
+}
+
+// wakeWriter has the writer flush the pending replies, the wakeups sent
+// while it writes are merged in one. Must be called with client.mu held.
+func (client *RedisClient) wakeWriter() {
+	select {
+	case client.wake <- struct{}{}:
+	default:
+	}
+}
+
+// writeLoop is the writer of the client, it runs until the client is closed
+func (client *RedisClient) writeLoop() {
+	for range client.wake {
+		client.writePending()
+	}
+}
+
+// writePending flushes everything buffered so far, on the writer of the
+// client
+func (client *RedisClient) writePending() {
+	client.mu.Lock()
+	if client.closed {
+		client.mu.Unlock()
+		return
+	}
+	// swap in a fresh buffer so the executor can keep appending while we write
+	buf := client.pending
+	client.pending = getReplyBuffer()
+	client.mu.Unlock()
+
+	written := int64(buf.Len())
+	var err error
+	if written > 0 {
+		var n int
+		n, err = client.Conn.Write(buf.Bytes())
+		atomic.AddInt64(&client.server.statNetOutputBytes, int64(n))
+	}
+	putReplyBuffer(buf)
+
+	client.mu.Lock()
+	client.outputBytes -= written
+	closeNow := client.closeAfterWrite && client.pending.Len() == 0
+	client.mu.Unlock()
+
+	if err != nil {
+		fmt.Println("Error writing to connection: ", err)
+		client.close()
+	} else if closeNow {
+		client.close()
+	}
+}
+
+// closeAfterReply closes the client once the replies added so far are
+// written, by its writer
+func (client *RedisClient) closeAfterReply() {
+	client.mu.Lock()
+	if client.closed {
+		client.mu.Unlock()
+		return
+	}
+	client.closeAfterWrite = true
+	client.wakeWriter()
+	client.mu.Unlock()
+}
+
+// getUser is the ACL user the client is authenticated as
+func (client *RedisClient) getUser() *aclUser {
+	if client.user == nil {
+		return client.server.defaultUser
+	}
+	return client.user
+}
+
+// waitPendingWrites blocks until the replies added so far were written to
+// the socket, for writes that bypass the writer of the client. Returns false if the
+// client was closed.
+func (client *RedisClient) waitPendingWrites() bool {
+	return client.waitPendingWritesUntil(time.Time{})
+}
+
+// waitPendingWritesUntil is waitPendingWrites giving up at the deadline,
+// zero waits forever
+func (client *RedisClient) waitPendingWritesUntil(deadline time.Time) bool {
+	for {
+		client.mu.Lock()
+		drained, closed := client.outputBytes == 0, client.closed
+		client.mu.Unlock()
+
+		if closed {
+			return false
+		}
+		if drained {
+			return true
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (client *RedisClient) isClosed() bool {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.closed
+}
+
+func (client *RedisClient) closeOverOutputLimit() {
+	fmt.Printf("Client id=%d addr=%s closed for overcoming of output buffer limits.\n",
+		client.ID, client.Conn.RemoteAddr())
+	client.close()
+}
+
+func (client *RedisClient) getClientType() int {
+	if client.Flags&CLIENT_SLAVE != 0 {
+		return CLIENT_TYPE_REPLICA
+	}
+	if client.Flags&CLIENT_PUBSUB != 0 {
+		return CLIENT_TYPE_PUBSUB
+	}
+	return CLIENT_TYPE_NORMAL
+}
+
+func getClientTypeByName(name string) int {
+	switch strings.ToLower(name) {
+	case "normal":
+		return CLIENT_TYPE_NORMAL
+	case "replica", "slave":
+		return CLIENT_TYPE_REPLICA
+	case "pubsub":
+		return CLIENT_TYPE_PUBSUB
+	default:
+		return -1
+	}
+}
+
+// checkOutputBufferLimits reports whether the client went over the hard limit
+// of its class, or stayed over the soft limit for longer than allowed.
+// Must be called with client.mu held.
+func (client *RedisClient) checkOutputBufferLimits() bool {
+	limit := client.server.Config.ClientOutputLimit[client.getClientType()]
+	used := client.outputBytes
+
+	if limit.HardBytes > 0 && used >= limit.HardBytes {
+		return true
+	}
+
+	if limit.SoftBytes > 0 && used >= limit.SoftBytes {
+		if client.softLimitReachedAt.IsZero() {
+			client.softLimitReachedAt = time.Now()
+			return false
+		}
+		return time.Since(client.softLimitReachedAt) > time.Duration(limit.SoftSeconds)*time.Second
+	}
+
+	client.softLimitReachedAt = time.Time{}
+	return false
+}
+
+func (client *RedisClient) close() {
+	client.mu.Lock()
+	if client.closed {
+		client.mu.Unlock()
+		return
+	}
+	client.closed = true
+	client.pending.Reset()
+	client.Conn.Close()
+	// ends the writer, which may be blocked on the socket closed above
+	close(client.wake)
+	client.mu.Unlock()
+
+	// clientsMu is always taken before client.mu, never while holding it
+	client.server.clientsMu.Lock()
+	delete(client.server.clients, client.ID)
+	client.server.clientsMu.Unlock()
+}
+
+// clearClientConnectionState returns the client to the state of a new
+// connection, only the library it declared with CLIENT SETINFO stays
+func (server *RedisServer) clearClientConnectionState(client *RedisClient) {
+	if client.Flags&CLIENT_TRACKING != 0 {
+		server.disableTracking(client)
+	}
+	client.resp = 2
+	client.user = nil
+	client.authenticated = false
+	server.discardTransaction(client)
+	server.pubsubUnsubscribeAllChannels(client, false, pubsubTypeGlobal)
+	server.pubsubUnsubscribeAllChannels(client, false, pubsubTypeShard)
+	server.pubsubUnsubscribeAllPatterns(client, false)
+	client.name = ""
+	client.Flags &^= CLIENT_ASKING | CLIENT_READONLY | CLIENT_REPLY_OFF | CLIENT_REPLY_SKIP_NEXT |
+		CLIENT_NO_TOUCH | CLIENT_NO_EVICT
+}
+
+// handleResetCommand is RESET, which connection pools send before handing
+// a connection out again
+func (server *RedisServer) handleResetCommand(cmd string, args []interface{}) []byte {
+	client := server.currentClient
+	if client.Flags&(CLIENT_SLAVE|CLIENT_MASTER) != 0 {
+		return []byte("-ERR can only reset normal client connections\r\n")
+	}
+	server.clearClientConnectionState(client)
+	return []byte("+RESET\r\n")
+}
+
+// handleHelloCommand switches the protocol of the connection, once it is
+// authenticated or with AUTH, and describes the server. RESP3 clients get
+// the description as a map.
+func (server *RedisServer) handleHelloCommand(cmd string, args []interface{}) []byte {
+	client := server.currentClient
+	resp := client.resp
+	if len(args) >= 1 {
+		protover, _ := args[0].(string)
+		n, err := strconv.Atoi(protover)
+		if err != nil {
+			return []byte("-ERR Protocol version is not an integer or out of range\r\n")
+		}
+		if n < 2 || n > 3 {
+			return []byte("-NOPROTO unsupported protocol version\r\n")
+		}
+		resp = n
+	}
+	name, setName := "", false
+	for j := 1; j < len(args); j++ {
+		option, _ := args[j].(string)
+		if strings.EqualFold(option, "SETNAME") && len(args)-1-j >= 1 {
+			name, _ = args[j+1].(string)
+			if !validateClientAttr(name) {
+				return []byte("-ERR Client names cannot contain spaces, newlines or special characters.\r\n")
+			}
+			setName = true
+			j++
+			continue
+		}
+		if strings.EqualFold(option, "AUTH") && len(args)-1-j >= 2 {
+			username, _ := args[j+1].(string)
+			password, _ := args[j+2].(string)
+			if errReply := server.authenticateClient(client, username, password); errReply != nil {
+				return errReply
+			}
+			j += 2
+			continue
+		}
+		return []byte(fmt.Sprintf("-ERR Syntax error in HELLO option '%s'\r\n", option))
+	}
+	if server.authRequired(client) {
+		return []byte("-NOAUTH HELLO must be called with the client already authenticated, otherwise the " +
+			"HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select " +
+			"the RESP protocol version at the same time\r\n")
+	}
+	client.resp = resp
+	if setName {
+		client.name = name
+	}
+
+	role := "master"
+	if server.Config.MasterHost != "" {
+		role = "replica"
+	}
+	mode := "standalone"
+	if server.sentinel != nil {
+		mode = "sentinel"
+	} else if server.cluster != nil {
+		mode = "cluster"
+	}
+	fields := []interface{}{
+		"server", "redis",
+		"version", REDIS_VERSION,
+		"proto", resp,
+		"id", int64(client.ID),
+		"mode", mode,
+		"role", role,
+		"modules", []interface{}{},
+	}
+	if resp == 2 {
+		return addReplyValue(fields)
+	}
+
+	reply := bytes.Buffer{}
+	reply.WriteString(fmt.Sprintf("%%%d\r\n", len(fields)/2))
+	for _, field := range fields {
+		writeReplyValue(&reply, field)
+	}
+	return reply.Bytes()
+}
+
+// handleConnection reads and parses commands on the connection's own goroutine
+// and forwards them to the executor; replies are written back by the writer
+// of the client. The replies themselves are still serialized by the commands,
+// on the executor.
+func handleConnection(server *RedisServer, conn net.Conn) {
+	client := newClient(server, conn)
+	defer client.close()
+
+	reader := getReader(netInputReader{conn, &server.statNetInputBytes})
+	defer putReader(reader)
+
+	for {
+		cmd, args, err := readCommand(reader, atomic.LoadInt64(&server.protoMaxBulkLen))
+		var protoErr protocolError
+		if errors.As(err, &protoErr) {
+			// told why after the replies of the commands before, by the
+			// executor. The rest of the input is discarded until the
+			// writer closes the connection.
+			server.requests <- CommandRequest{Client: client, ProtoErr: protoErr.Error()}
+			io.Copy(io.Discard, reader)
+			return
+		}
+		if err != nil {
+			fmt.Println("Error reading from connection: ", err)
+			return
+		}
+
+		if cmd == "" {
+			continue
+		}
+
+		server.requests <- CommandRequest{Client: client, Cmd: cmd, Args: args}
+	}
+}
+
+// netInputReader adds the bytes read from a client to the ones of INFO
+// stats
+type netInputReader struct {
+	r     io.Reader
+	count *int64
+}
+
+func (cr netInputReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	atomic.AddInt64(cr.count, int64(n))
+	return n, err
+}
+
+// infoString describes the client in the format of CLIENT LIST
+func (client *RedisClient) infoString() string {
+	now := client.server.UnixTime
+	addr, laddr := "", ""
+	if client.Conn != nil {
+		addr, laddr = client.Conn.RemoteAddr().String(), client.Conn.LocalAddr().String()
+	}
+
+	flags := ""
+	for _, flag := range []struct {
+		flag int
+		name string
+	}{
+		{CLIENT_SLAVE, "S"}, {CLIENT_MASTER, "M"}, {CLIENT_PUBSUB, "P"}, {CLIENT_MULTI, "x"},
+		{CLIENT_BLOCKED, "b"}, {CLIENT_DIRTY_CAS, "d"}, {CLIENT_CLOSE_AFTER_COMMAND, "c"},
+		{CLIENT_READONLY, "r"}, {CLIENT_NO_EVICT, "e"}, {CLIENT_NO_TOUCH, "T"}, {CLIENT_TRACKING, "t"},
+		{CLIENT_TRACKING_BROKEN_REDIR, "R"}, {CLIENT_TRACKING_BCAST, "B"},
+	} {
+		if client.Flags&flag.flag != 0 {
+			flags += flag.name
+		}
+	}
+	if flags == "" {
+		flags = "N"
+	}
+
+	multi := -1
+	if client.Flags&CLIENT_MULTI != 0 {
+		multi = len(client.mstate.commands)
+	}
+	cmd := client.lastCmd
+	if cmd == "" {
+		cmd = "NULL"
+	}
+	client.mu.Lock()
+	omem := client.outputBytes
+	client.mu.Unlock()
+
+	return fmt.Sprintf("id=%d addr=%s laddr=%s name=%s age=%d idle=%d flags=%s db=0 sub=%d psub=%d ssub=%d multi=%d "+
+		"watch=%d omem=%d cmd=%s user=%s resp=%d lib-name=%s lib-ver=%s",
+		client.ID, addr, laddr, client.name, int64(now.Sub(client.ctime).Seconds()),
+		int64(now.Sub(client.lastInteraction).Seconds()), flags, len(client.pubsubChannels),
+		len(client.pubsubPatterns), len(client.pubsubShardChannels), multi, len(client.watchedKeys), omem,
+		cmd, client.getUser().name, client.resp, client.libName, client.libVer)
+}
+
+// clientTypeFilter parses the TYPE of CLIENT LIST and CLIENT KILL
+func clientTypeFilter(name string) (int, bool) {
+	if strings.EqualFold(name, "master") {
+		return CLIENT_TYPE_MASTER, true
+	}
+	class := getClientTypeByName(name)
+	return class, class != -1
+}
+
+func (client *RedisClient) matchesClientType(class int) bool {
+	if client.Flags&CLIENT_MASTER != 0 {
+		return class == CLIENT_TYPE_MASTER
+	}
+	return client.getClientType() == class
+}
+
+// validateClientAttr checks a name of CLIENT SETNAME or CLIENT SETINFO,
+// printable characters only and no spaces, which would break the format
+// of CLIENT LIST
+func validateClientAttr(value string) bool {
+	for i := 0; i < len(value); i++ {
+		if value[i] < '!' || value[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// clientsByID are the connected clients in the order they connected
+func (server *RedisServer) clientsByID() []*RedisClient {
+	server.clientsMu.Lock()
+	clients := make([]*RedisClient, 0, len(server.clients))
+	for _, client := range server.clients {
+		clients = append(clients, client)
+	}
+	server.clientsMu.Unlock()
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ID < clients[j].ID })
+	return clients
+}
+
+func (server *RedisServer) handleClientCommand(cmd string, args []interface{}) []byte {
+	client := server.currentClient
+	subcommand, _ := args[0].(string)
+	subcommand = strings.ToUpper(subcommand)
+
+	switch {
+	case subcommand == "HELP" && len(args) == 1:
+		return addReplyHelp("CLIENT", []string{
+			"GETNAME",
+			"    Return the name of the current connection.",
+			"ID",
+			"    Return the ID of the current connection.",
+			"INFO",
+			"    Return information about the current client connection.",
+			"KILL <ip:port>",
+			"    Kill connection made from <ip:port>.",
+			"KILL <option> <value> [<option> <value> [...]]",
+			"    Kill connections. Options are:",
+			"    * ADDR (<ip:port>|<unixsocket>:0)",
+			"      Kill connections made from the specified address",
+			"    * LADDR (<ip:port>|<unixsocket>:0)",
+			"      Kill connections made to specified local address",
+			"    * TYPE (NORMAL|MASTER|REPLICA|PUBSUB)",
+			"      Kill connections by type.",
+			"    * USER <username>",
+			"      Kill connections authenticated by <username>.",
+			"    * SKIPME (YES|NO)",
+			"      Skip killing current connection (default: yes).",
+			"    * ID <client-id>",
+			"      Kill connections by client id.",
+			"LIST [options ...]",
+			"    Return information about client connections. Options:",
+			"    * TYPE (NORMAL|MASTER|REPLICA|PUBSUB)",
+			"      Return clients of specified type.",
+			"    * ID <client-id> [<client-id> ...]",
+			"      Return clients of specified IDs only.",
+			"PAUSE <timeout> [WRITE|ALL]",
+			"    Suspend all, or just write, clients for <timeout> milliseconds.",
+			"UNPAUSE",
+			"    Stop the current client pause, resuming traffic.",
+			"NO-EVICT (ON|OFF)",
+			"    Protect current client connection from eviction.",
+			"NO-TOUCH (ON|OFF)",
+			"    Will not touch LRU/LFU stats when this mode is on.",
+			"TRACKING (ON|OFF) [REDIRECT <id>] [BCAST] [PREFIX <prefix> [...]]",
+			"         [OPTIN] [OPTOUT] [NOLOOP]",
+			"    Control server assisted client side caching.",
+			"TRACKINGINFO",
+			"    Report tracking status for the current connection.",
+			"CACHING (YES|NO)",
+			"    Enable/disable tracking of the keys for next command in OPTIN/OPTOUT modes.",
+			"GETREDIR",
+			"    Return the client ID we are redirecting to when tracking is enabled.",
+			"UNBLOCK <clientid> [TIMEOUT|ERROR]",
+			"    Unblock the specified blocked client.",
+			"REPLY (ON|OFF|SKIP)",
+			"    Control the replies sent to the current connection.",
+			"SETNAME <name>",
+			"    Assign the name <name> to the current connection.",
+			"SETINFO <option> <value>",
+			"    Set client meta attr. Options are:",
+			"    * LIB-NAME: the client lib name.",
+			"    * LIB-VER: the client lib version.",
+		})
+	case subcommand == "ID" && len(args) == 1:
+		return addReplyLongLong(int64(client.ID))
+	case subcommand == "INFO" && len(args) == 1:
+		return addReplyBulk([]interface{}{client.infoString() + "\n"})
+	case subcommand == "LIST":
+		return server.clientListCommand(args[1:])
+	case subcommand == "KILL" && len(args) >= 2:
+		return server.clientKillCommand(args[1:])
+	case subcommand == "PAUSE" && (len(args) == 2 || len(args) == 3):
+		timeoutArg, _ := args[1].(string)
+		timeout, err := strconv.ParseInt(timeoutArg, 10, 64)
+		if err != nil {
+			return []byte("-ERR timeout is not an integer or out of range\r\n")
+		}
+		if timeout < 0 {
+			return []byte("-ERR timeout is negative\r\n")
+		}
+		ptype := CLIENT_PAUSE_ALL
+		if len(args) == 3 {
+			mode, _ := args[2].(string)
+			switch strings.ToUpper(mode) {
+			case "WRITE":
+				ptype = CLIENT_PAUSE_WRITE
+			case "ALL":
+			default:
+				return []byte("-ERR CLIENT PAUSE mode must be WRITE or ALL\r\n")
+			}
+		}
+		end := time.Now().Add(time.Duration(timeout) * time.Millisecond)
+		server.pauseClients(PAUSE_BY_CLIENT_COMMAND, end, ptype)
+		return []byte("+OK\r\n")
+	case subcommand == "UNPAUSE" && len(args) == 1:
+		server.unpauseClients(PAUSE_BY_CLIENT_COMMAND)
+		return []byte("+OK\r\n")
+	case subcommand == "REPLY" && len(args) == 2:
+		mode, _ := args[1].(string)
+		switch strings.ToUpper(mode) {
+		case "ON":
+			client.Flags &^= CLIENT_REPLY_OFF | CLIENT_REPLY_SKIP_NEXT
+			return []byte("+OK\r\n")
+		case "OFF":
+			client.Flags |= CLIENT_REPLY_OFF
+		case "SKIP":
+			if client.Flags&CLIENT_REPLY_OFF == 0 {
+				client.Flags |= CLIENT_REPLY_SKIP_NEXT
+			}
+		default:
+			return []byte("-ERR syntax error\r\n")
+		}
+		// EXEC still needs a reply per command
+		if server.inExec {
+			return []byte("+OK\r\n")
+		}
+		return nil
+	case (subcommand == "NO-EVICT" || subcommand == "NO-TOUCH") && len(args) == 2:
+		flag := CLIENT_NO_EVICT
+		if subcommand == "NO-TOUCH" {
+			flag = CLIENT_NO_TOUCH
+		}
+		mode, _ := args[1].(string)
+		switch strings.ToUpper(mode) {
+		case "ON":
+			client.Flags |= flag
+		case "OFF":
+			client.Flags &^= flag
+		default:
+			return []byte("-ERR syntax error\r\n")
+		}
+		return []byte("+OK\r\n")
+	case subcommand == "UNBLOCK" && (len(args) == 2 || len(args) == 3):
+		idArg, _ := args[1].(string)
+		id, err := strconv.ParseUint(idArg, 10, 64)
+		if err != nil {
+			return []byte("-ERR value is not an integer or out of range\r\n")
+		}
+		withError := false
+		if len(args) == 3 {
+			mode, _ := args[2].(string)
+			switch strings.ToUpper(mode) {
+			case "TIMEOUT":
+			case "ERROR":
+				withError = true
+			default:
+				return []byte("-ERR CLIENT UNBLOCK reason should be TIMEOUT or ERROR\r\n")
+			}
+		}
+		server.clientsMu.Lock()
+		target := server.clients[id]
+		server.clientsMu.Unlock()
+		if target == nil || !server.unblockClientOnRequest(target, withError) {
+			return addReplyLongLong(0)
+		}
+		return addReplyLongLong(1)
+	case subcommand == "TRACKING" && len(args) >= 2:
+		return server.clientTrackingCommand(client, args[1:])
+	case subcommand == "CACHING" && len(args) == 2:
+		value, _ := args[1].(string)
+		return server.clientCachingCommand(client, value)
+	case subcommand == "TRACKINGINFO" && len(args) == 1:
+		return server.clientTrackingInfoCommand(client)
+	case subcommand == "GETREDIR" && len(args) == 1:
+		if client.Flags&CLIENT_TRACKING == 0 {
+			return addReplyLongLong(-1)
+		}
+		return addReplyLongLong(int64(client.trackingRedirect))
+	case subcommand == "GETNAME" && len(args) == 1:
+		if client.name == "" {
+			return addReplyValue(nil)
+		}
+		return addReplyBulk([]interface{}{client.name})
+	case subcommand == "SETNAME" && len(args) == 2:
+		name, _ := args[1].(string)
+		if !validateClientAttr(name) {
+			return []byte("-ERR Client names cannot contain spaces, newlines or special characters.\r\n")
+		}
+		client.name = name
+		return []byte("+OK\r\n")
+	case subcommand == "SETINFO" && len(args) == 3:
+		attr, _ := args[1].(string)
+		value, _ := args[2].(string)
+		var field *string
+		switch strings.ToLower(attr) {
+		case "lib-name":
+			field = &client.libName
+		case "lib-ver":
+			field = &client.libVer
+		default:
+			return []byte(fmt.Sprintf("-ERR Unrecognized option '%s'\r\n", attr))
+		}
+		if !validateClientAttr(value) {
+			return []byte(fmt.Sprintf("-ERR %s cannot contain spaces, newlines or special characters.\r\n", strings.ToLower(attr)))
+		}
+		*field = value
+		return []byte("+OK\r\n")
+	}
+	return addReplySubcommandSyntaxError("CLIENT", subcommand)
+}
+
+// clientKillCommand closes the client with the address given, or the ones
+// matching all the filters given, and replies with how many. The current
+// client is skipped unless SKIPME is no, and if killed it gets its reply
+// first.
+func (server *RedisServer) clientKillCommand(args []interface{}) []byte {
+	filters := []func(client *RedisClient) bool{}
+	skipme, oldStyle := true, len(args) == 1
+
+	if oldStyle {
+		addr, _ := args[0].(string)
+		filters = append(filters, func(client *RedisClient) bool {
+			return client.Conn != nil && client.Conn.RemoteAddr().String() == addr
+		})
+		skipme = false
+	} else {
+		if len(args)%2 != 0 {
+			return []byte("-ERR syntax error\r\n")
+		}
+		for j := 0; j < len(args); j += 2 {
+			option, _ := args[j].(string)
+			value, _ := args[j+1].(string)
+			switch strings.ToUpper(option) {
+			case "ID":
+				id, err := strconv.ParseInt(value, 10, 64)
+				if err != nil || id <= 0 {
+					return []byte("-ERR client-id should be greater than 0\r\n")
+				}
+				filters = append(filters, func(client *RedisClient) bool { return client.ID == uint64(id) })
+			case "TYPE":
+				class, ok := clientTypeFilter(value)
+				if !ok {
+					return []byte(fmt.Sprintf("-ERR Unknown client type '%s'\r\n", value))
+				}
+				filters = append(filters, func(client *RedisClient) bool { return client.matchesClientType(class) })
+			case "ADDR":
+				filters = append(filters, func(client *RedisClient) bool {
+					return client.Conn != nil && client.Conn.RemoteAddr().String() == value
+				})
+			case "LADDR":
+				filters = append(filters, func(client *RedisClient) bool {
+					return client.Conn != nil && client.Conn.LocalAddr().String() == value
+				})
+			case "USER":
+				user := server.users[value]
+				if user == nil {
+					return []byte(fmt.Sprintf("-ERR No such user '%s'\r\n", value))
+				}
+				filters = append(filters, func(client *RedisClient) bool { return client.getUser() == user })
+			case "SKIPME":
+				switch strings.ToLower(value) {
+				case "yes":
+					skipme = true
+				case "no":
+					skipme = false
+				default:
+					return []byte("-ERR syntax error\r\n")
+				}
+			default:
+				return []byte("-ERR syntax error\r\n")
+			}
+		}
+	}
+
+	killed := int64(0)
+	for _, client := range server.clientsByID() {
+		matches := true
+		for _, filter := range filters {
+			if !filter(client) {
+				matches = false
+				break
+			}
+		}
+		if !matches || (skipme && client == server.currentClient) {
+			continue
+		}
+		if client == server.currentClient {
+			client.Flags |= CLIENT_CLOSE_AFTER_COMMAND
+		} else {
+			client.close()
+		}
+		killed++
+	}
+
+	if oldStyle {
+		if killed == 0 {
+			return []byte("-ERR No such client\r\n")
+		}
+		return []byte("+OK\r\n")
+	}
+	return addReplyLongLong(killed)
+}
+
+// clientListCommand lists the clients, of a TYPE or with the IDs given
+func (server *RedisServer) clientListCommand(args []interface{}) []byte {
+	filter := func(client *RedisClient) bool { return true }
+	if len(args) > 0 {
+		option, _ := args[0].(string)
+		switch {
+		case strings.EqualFold(option, "TYPE") && len(args) == 2:
+			name, _ := args[1].(string)
+			class, ok := clientTypeFilter(name)
+			if !ok {
+				return []byte(fmt.Sprintf("-ERR Unknown client type '%s'\r\n", name))
+			}
+			filter = func(client *RedisClient) bool { return client.matchesClientType(class) }
+		case strings.EqualFold(option, "ID") && len(args) >= 2:
+			ids := map[uint64]bool{}
+			for _, arg := range args[1:] {
+				s, _ := arg.(string)
+				id, err := strconv.ParseUint(s, 10, 64)
+				if err != nil || id == 0 {
+					return []byte("-ERR Invalid client ID\r\n")
+				}
+				ids[id] = true
+			}
+			filter = func(client *RedisClient) bool { return ids[client.ID] }
+		default:
+			return []byte("-ERR syntax error\r\n")
+		}
+	}
+
+	b := strings.Builder{}
+	for _, client := range server.clientsByID() {
+		if filter(client) {
+			b.WriteString(client.infoString() + "\n")
+		}
+	}
+	return addReplyBulk([]interface{}{b.String()})
+}
+
+const PROTECTED_MODE_ERROR = "-DENIED Redis is running in protected mode because protected mode is enabled and no password is set for the default user. " +
+	"In this mode connections are only accepted from the loopback interface. " +
+	"If you want to connect from external computers to Redis you may adopt one of the following solutions: " +
+	"1) Just disable protected mode sending the command 'CONFIG SET protected-mode no' from the loopback interface by connecting to Redis from the same host the server is running, " +
+	"however MAKE SURE Redis is not publicly accessible from internet if you do so. Use CONFIG REWRITE to make this change permanent. " +
+	"2) Alternatively you can just disable the protected mode by editing the Redis configuration file, and setting the protected mode option to 'no', and then restarting the server. " +
+	"3) If you started the server manually just for testing, restart it with the '--protected-mode no' option. " +
+	"4) Set up an authentication password for the default user. " +
+	"NOTE: You only need to do one of the above things in order for the server to start accepting connections from the outside.\r\n"
+
+// protectedModeDenies tells a client that can't be served in protected
+// mode: one from another host while no bind address was chosen and the
+// default user has no password. A sentinel is never in protected mode.
+func (server *RedisServer) protectedModeDenies(client *RedisClient) bool {
+	if !server.Config.ProtectedMode || len(server.Config.Bind) > 0 || server.sentinel != nil {
+		return false
+	}
+	if server.defaultUser.flags&USER_FLAG_NOPASS == 0 {
+		return false
+	}
+	return !client.isLocal()
+}
+
+// Who may run the protected commands
+const (
+	PROTECTED_ACTION_ALLOWED_NO = iota
+	PROTECTED_ACTION_ALLOWED_YES
+	PROTECTED_ACTION_ALLOWED_LOCAL
+)
+
+var protectedActionNames = map[int]string{
+	PROTECTED_ACTION_ALLOWED_NO:    "no",
+	PROTECTED_ACTION_ALLOWED_YES:   "yes",
+	PROTECTED_ACTION_ALLOWED_LOCAL: "local",
+}
+
+func getProtectedActionByName(name string) int {
+	for allowed, allowedName := range protectedActionNames {
+		if strings.EqualFold(name, allowedName) {
+			return allowed
+		}
+	}
+	return -1
+}
+
+// allowProtectedAction tells whether the client may run a protected command
+// with the config at allowed
+func allowProtectedAction(allowed int, client *RedisClient) bool {
+	return allowed == PROTECTED_ACTION_ALLOWED_YES ||
+		(allowed == PROTECTED_ACTION_ALLOWED_LOCAL && client.isLocal())
+}
+
+// isLocal tells a client connected from this host, from the loopback
+// interface or not over TCP at all
+func (client *RedisClient) isLocal() bool {
+	if client.Conn == nil {
+		return true
+	}
+	addr, ok := client.Conn.RemoteAddr().(*net.TCPAddr)
+	return !ok || addr.IP.IsLoopback()
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Classes of keyspace events, set with notify-keyspace-events
+const (
+	NOTIFY_KEYSPACE = 1 << iota // K, __keyspace@<db>__:<key> <event>
+	NOTIFY_KEYEVENT             // E, __keyevent@<db>__:<event> <key>
+	NOTIFY_GENERIC              // g, commands like DEL and EXPIRE
+	NOTIFY_STRING               // $
+	NOTIFY_LIST                 // l
+	NOTIFY_SET                  // s
+	NOTIFY_HASH                 // h
+	NOTIFY_ZSET                 // z
+	NOTIFY_EXPIRED              // x
+	NOTIFY_EVICTED              // e
+	NOTIFY_STREAM               // t
+	NOTIFY_KEY_MISS             // m, not part of A
+	NOTIFY_MODULE               // d
+	NOTIFY_NEW                  // n, not part of A
+
+	NOTIFY_ALL = NOTIFY_GENERIC | NOTIFY_STRING | NOTIFY_LIST | NOTIFY_SET | NOTIFY_HASH |
+		NOTIFY_ZSET | NOTIFY_EXPIRED | NOTIFY_EVICTED | NOTIFY_STREAM | NOTIFY_MODULE
+)
+
+// keyspaceEventsStringToFlags parses the classes of notify-keyspace-events,
+// returning -1 on an unknown class
+func keyspaceEventsStringToFlags(classes string) int {
+	flags := 0
+	for _, c := range classes {
+		switch c {
+		case 'A':
+			flags |= NOTIFY_ALL
+		case 'g':
+			flags |= NOTIFY_GENERIC
+		case '$':
+			flags |= NOTIFY_STRING
+		case 'l':
+			flags |= NOTIFY_LIST
+		case 's':
+			flags |= NOTIFY_SET
+		case 'h':
+			flags |= NOTIFY_HASH
+		case 'z':
+			flags |= NOTIFY_ZSET
+		case 'x':
+			flags |= NOTIFY_EXPIRED
+		case 'e':
+			flags |= NOTIFY_EVICTED
+		case 'K':
+			flags |= NOTIFY_KEYSPACE
+		case 'E':
+			flags |= NOTIFY_KEYEVENT
+		case 't':
+			flags |= NOTIFY_STREAM
+		case 'm':
+			flags |= NOTIFY_KEY_MISS
+		case 'd':
+			flags |= NOTIFY_MODULE
+		case 'n':
+			flags |= NOTIFY_NEW
+		default:
+			return -1
+		}
+	}
+	return flags
+}
+
+// keyspaceEventsFlagsToString is the inverse of keyspaceEventsStringToFlags,
+// with A standing for all the classes it includes
+func keyspaceEventsFlagsToString(flags int) string {
+	var b strings.Builder
+	if flags&NOTIFY_ALL == NOTIFY_ALL {
+		b.WriteByte('A')
+	} else {
+		for _, class := range []struct {
+			flag int
+			c    byte
+		}{
+			{NOTIFY_GENERIC, 'g'},
+			{NOTIFY_STRING, '$'},
+			{NOTIFY_LIST, 'l'},
+			{NOTIFY_SET, 's'},
+			{NOTIFY_HASH, 'h'},
+			{NOTIFY_ZSET, 'z'},
+			{NOTIFY_EXPIRED, 'x'},
+			{NOTIFY_EVICTED, 'e'},
+			{NOTIFY_STREAM, 't'},
+			{NOTIFY_MODULE, 'd'},
+		} {
+			if flags&class.flag != 0 {
+				b.WriteByte(class.c)
+			}
+		}
+	}
+	if flags&NOTIFY_NEW != 0 {
+		b.WriteByte('n')
+	}
+	if flags&NOTIFY_KEYSPACE != 0 {
+		b.WriteByte('K')
+	}
+	if flags&NOTIFY_KEYEVENT != 0 {
+		b.WriteByte('E')
+	}
+	if flags&NOTIFY_KEY_MISS != 0 {
+		b.WriteByte('m')
+	}
+	return b.String()
+}
+
+// notifyKeyspaceEvent publishes the event on the key to the keyspace and
+// keyevent channels enabled by notify-keyspace-events, when its class is
+func (server *RedisServer) notifyKeyspaceEvent(class int, event, key string) {
+	flags := server.Config.NotifyKeyspaceEvents
+	if flags&class == 0 {
+		return
+	}
+
+	if flags&NOTIFY_KEYSPACE != 0 {
+		server.pubsubPublishMessage(fmt.Sprintf("__keyspace@0__:%s", key), event, pubsubTypeGlobal)
+	}
+	if flags&NOTIFY_KEYEVENT != 0 {
+		server.pubsubPublishMessage(fmt.Sprintf("__keyevent@0__:%s", event), key, pubsubTypeGlobal)
+	}
+}
@@ -0,0 +1,633 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	OBJ_STRING = 0
+	OBJ_LIST   = 1
+	OBJ_SET    = 2
+	OBJ_ZSET   = 3
+	OBJ_HASH   = 4
+	OBJ_STREAM = 6
+)
+
+// Collections above these sizes are reported with their big encodings
+const (
+	OBJ_LIST_MAX_LISTPACK_ENTRIES = 128
+	OBJ_SET_MAX_INTSET_ENTRIES    = 512
+	OBJ_SET_MAX_LISTPACK_ENTRIES  = 128
+	OBJ_ZSET_MAX_LISTPACK_ENTRIES = 128
+	OBJ_HASH_MAX_LISTPACK_ENTRIES = 128
+)
+
+// The elements of a list this large are each saved in a plain node of the
+// quicklist rather than packed, DEBUG QUICKLIST-PACKED-THRESHOLD changes it
+const QUICKLIST_DEFAULT_PACKED_THRESHOLD = 1 << 30
+
+var quicklistPackedThreshold int64 = QUICKLIST_DEFAULT_PACKED_THRESHOLD
+
+// quicklistNode is a node of the quicklist a list is saved as, a listpack of
+// elements or a single plain one
+type quicklistNode struct {
+	elements []string
+	plain    bool
+}
+
+// quicklistNodes splits the list in the nodes of its quicklist
+func quicklistNodes(elements []string) []quicklistNode {
+	nodes := []quicklistNode{}
+	packed := []string{}
+	flush := func() {
+		if len(packed) > 0 {
+			nodes = append(nodes, quicklistNode{elements: packed})
+			packed = []string{}
+		}
+	}
+	for _, element := range elements {
+		if int64(len(element)) >= quicklistPackedThreshold {
+			flush()
+			nodes = append(nodes, quicklistNode{elements: []string{element}, plain: true})
+			continue
+		}
+		packed = append(packed, element)
+		if len(packed) == OBJ_LIST_MAX_LISTPACK_ENTRIES {
+			flush()
+		}
+	}
+	flush()
+	return nodes
+}
+
+// RedisObject is the value stored for every key in the keyspace
+type RedisObject struct {
+	Type  int
+	Value interface{}
+	// LRU clock or LFU data, depending on maxmemory-policy. Reads update it
+	// in place, atomically since a BGSAVE may be saving the object.
+	LRU uint32
+}
+
+func createStringObject(value string) *RedisObject {
+	return &RedisObject{Type: OBJ_STRING, Value: value}
+}
+
+func createListObject(elements []string) *RedisObject {
+	return &RedisObject{Type: OBJ_LIST, Value: elements}
+}
+
+func createSetObject(members map[string]struct{}) *RedisObject {
+	return &RedisObject{Type: OBJ_SET, Value: members}
+}
+
+func createZsetObject(scores map[string]float64) *RedisObject {
+	return &RedisObject{Type: OBJ_ZSET, Value: scores}
+}
+
+func createHashObject(fields map[string]string) *RedisObject {
+	return &RedisObject{Type: OBJ_HASH, Value: fields}
+}
+
+func isIntegerString(value string) bool {
+	_, err := strconv.ParseInt(value, 10, 64)
+	return err == nil && len(value) <= 20
+}
+
+// getObjectEncodingName reports the encoding Redis would use for the value
+func getObjectEncodingName(obj *RedisObject) string {
+	switch value := obj.Value.(type) {
+	case string:
+		if isIntegerString(value) {
+			return "int"
+		}
+		if len(value) <= OBJ_ENCODING_EMBSTR_SIZE_LIMIT {
+			return "embstr"
+		}
+		return "raw"
+	case []string:
+		if len(value) <= OBJ_LIST_MAX_LISTPACK_ENTRIES {
+			return "listpack"
+		}
+		return "quicklist"
+	case map[string]struct{}:
+		intset := len(value) <= OBJ_SET_MAX_INTSET_ENTRIES
+		for member := range value {
+			if !intset {
+				break
+			}
+			intset = isIntegerString(member)
+		}
+		if intset {
+			return "intset"
+		}
+		if len(value) <= OBJ_SET_MAX_LISTPACK_ENTRIES {
+			return "listpack"
+		}
+		return "hashtable"
+	case map[string]float64:
+		if len(value) <= OBJ_ZSET_MAX_LISTPACK_ENTRIES {
+			return "listpack"
+		}
+		return "skiplist"
+	case map[string]string:
+		if len(value) <= OBJ_HASH_MAX_LISTPACK_ENTRIES {
+			return "listpack"
+		}
+		return "hashtable"
+	case *Stream:
+		return "stream"
+	default:
+		return "unknown"
+	}
+}
+
+func getObjectTypeName(obj *RedisObject) string {
+	switch obj.Type {
+	case OBJ_STRING:
+		return "string"
+	case OBJ_LIST:
+		return "list"
+	case OBJ_SET:
+		return "set"
+	case OBJ_ZSET:
+		return "zset"
+	case OBJ_HASH:
+		return "hash"
+	case OBJ_STREAM:
+		return "stream"
+	default:
+		return "unknown"
+	}
+}
+
+// objectLength returns the number of elements of a collection, 1 for strings
+func objectLength(obj *RedisObject) int {
+	switch value := obj.Value.(type) {
+	case []string:
+		return len(value)
+	case map[string]struct{}:
+		return len(value)
+	case map[string]float64:
+		return len(value)
+	case map[string]string:
+		return len(value)
+	case *Stream:
+		return len(value.Entries)
+	default:
+		return 1
+	}
+}
+
+const (
+	LRU_BITS             = 24
+	LRU_CLOCK_MAX        = (1 << LRU_BITS) - 1
+	LRU_CLOCK_RESOLUTION = 1000 // milliseconds
+
+	LFU_INIT_VAL = 5
+
+	CONFIG_DEFAULT_LFU_LOG_FACTOR = 10
+	CONFIG_DEFAULT_LFU_DECAY_TIME = 1 // minutes
+
+	OBJ_ENCODING_EMBSTR_SIZE_LIMIT = 44
+)
+
+// Number of elements MEMORY USAGE samples in collections by default
+const OBJ_COMPUTE_SIZE_DEF_SAMPLES = 5
+
+// objectComputeSize estimates the bytes used by the value of an object.
+// Collections are estimated from the first samples elements, 0 means all.
+func objectComputeSize(obj *RedisObject, samples int) int64 {
+	const elementOverhead = 16
+
+	// average the sampled elements and extrapolate to the whole collection
+	estimate := func(total, sampled int, sampledBytes int64) int64 {
+		if sampled == 0 {
+			return 16
+		}
+		return 16 + sampledBytes*int64(total)/int64(sampled)
+	}
+
+	switch value := obj.Value.(type) {
+	case string:
+		return int64(len(value)) + 16
+	case []string:
+		sampled, bytes := 0, int64(0)
+		for _, element := range value {
+			if samples > 0 && sampled >= samples {
+				break
+			}
+			bytes += int64(len(element)) + elementOverhead
+			sampled++
+		}
+		return estimate(len(value), sampled, bytes)
+	case map[string]struct{}:
+		sampled, bytes := 0, int64(0)
+		for member := range value {
+			if samples > 0 && sampled >= samples {
+				break
+			}
+			bytes += int64(len(member)) + elementOverhead
+			sampled++
+		}
+		return estimate(len(value), sampled, bytes)
+	case map[string]float64:
+		sampled, bytes := 0, int64(0)
+		for member := range value {
+			if samples > 0 && sampled >= samples {
+				break
+			}
+			bytes += int64(len(member)) + 8 + elementOverhead
+			sampled++
+		}
+		return estimate(len(value), sampled, bytes)
+	case map[string]string:
+		sampled, bytes := 0, int64(0)
+		for field, v := range value {
+			if samples > 0 && sampled >= samples {
+				break
+			}
+			bytes += int64(len(field)+len(v)) + 2*elementOverhead
+			sampled++
+		}
+		return estimate(len(value), sampled, bytes)
+	case *Stream:
+		sampled, bytes := 0, int64(0)
+		for _, entry := range value.Entries {
+			if samples > 0 && sampled >= samples {
+				break
+			}
+			bytes += 16 + elementOverhead
+			for _, field := range entry.Fields {
+				bytes += int64(len(field)) + elementOverhead
+			}
+			sampled++
+		}
+		return estimate(len(value.Entries), sampled, bytes)
+	default:
+		return 16
+	}
+}
+
+// getLRUClock returns the current time in LRU_CLOCK_RESOLUTION units,
+// wrapped to LRU_BITS like the Redis LRU clock
+func getLRUClock() uint32 {
+	return uint32(time.Now().UnixMilli()/LRU_CLOCK_RESOLUTION) & LRU_CLOCK_MAX
+}
+
+// estimateObjectIdleTime returns the idle time of the object in milliseconds
+func (server *RedisServer) estimateObjectIdleTime(obj *RedisObject) uint64 {
+	lruclock := server.LRUClock
+	if lruclock >= obj.LRU {
+		return uint64(lruclock-obj.LRU) * LRU_CLOCK_RESOLUTION
+	}
+	return uint64(lruclock+(LRU_CLOCK_MAX-obj.LRU)) * LRU_CLOCK_RESOLUTION
+}
+
+// With an LFU policy the LRU field holds the last decrement time in minutes
+// (16 bits) and a logarithmic access counter (8 bits).
+func LFUGetTimeInMinutes() uint32 {
+	return uint32(time.Now().Unix()/60) & 65535
+}
+
+func LFUTimeElapsed(ldt uint32) uint32 {
+	now := LFUGetTimeInMinutes()
+	if now >= ldt {
+		return now - ldt
+	}
+	return 65535 - ldt + now
+}
+
+// LFULogIncr increments the counter with a probability that falls as it grows
+func LFULogIncr(counter uint8, logFactor int) uint8 {
+	if counter == 255 {
+		return 255
+	}
+	r := rand.Float64()
+	baseval := float64(counter) - LFU_INIT_VAL
+	if baseval < 0 {
+		baseval = 0
+	}
+	p := 1.0 / (baseval*float64(logFactor) + 1)
+	if r < p {
+		counter++
+	}
+	return counter
+}
+
+// LFUDecrAndReturn returns the counter decayed by the minutes elapsed since
+// the object was last accessed, without updating the object
+func (server *RedisServer) LFUDecrAndReturn(obj *RedisObject) uint8 {
+	ldt := obj.LRU >> 8
+	counter := uint8(obj.LRU & 255)
+	periods := uint32(0)
+	if server.Config.LfuDecayTime > 0 {
+		periods = LFUTimeElapsed(ldt) / uint32(server.Config.LfuDecayTime)
+	}
+	if periods >= uint32(counter) {
+		return 0
+	}
+	return counter - uint8(periods)
+}
+
+func (server *RedisServer) initObjectLRU(obj *RedisObject) {
+	if server.Config.MaxmemoryPolicy&MAXMEMORY_FLAG_LFU != 0 {
+		atomic.StoreUint32(&obj.LRU, LFUGetTimeInMinutes()<<8|LFU_INIT_VAL)
+	} else {
+		atomic.StoreUint32(&obj.LRU, server.LRUClock)
+	}
+}
+
+// updateObjectAccess refreshes the LRU clock or LFU counter of a value on reads
+func (server *RedisServer) updateObjectAccess(obj *RedisObject) {
+	if server.Config.MaxmemoryPolicy&MAXMEMORY_FLAG_LFU != 0 {
+		counter := server.LFUDecrAndReturn(obj)
+		counter = LFULogIncr(counter, server.Config.LfuLogFactor)
+		atomic.StoreUint32(&obj.LRU, LFUGetTimeInMinutes()<<8|uint32(counter))
+	} else {
+		atomic.StoreUint32(&obj.LRU, server.LRUClock)
+	}
+}
+
+func (server *RedisServer) handleObjectCommand(cmd string, args []interface{}) []byte {
+	if len(args) < 1 {
+		return addReplyErrorArity()
+	}
+
+	subcommand, ok := args[0].(string)
+	if !ok {
+		return []byte("-ERR Invalid subcommand type\r\n")
+	}
+
+	if strings.ToUpper(subcommand) == "HELP" && len(args) == 1 {
+		return addReplyHelp("OBJECT", []string{
+			"ENCODING <key>",
+			"    Return the kind of internal representation used in order to store the value",
+			"    associated with a <key>.",
+			"FREQ <key>",
+			"    Return the access frequency index of the <key>. The returned integer is",
+			"    proportional to the logarithm of the recent access frequency of the key.",
+			"IDLETIME <key>",
+			"    Return the idle time of the <key>, that is the approximated number of",
+			"    seconds elapsed since the last access to the key.",
+			"REFCOUNT <key>",
+			"    Return the number of references of the value associated with the specified",
+			"    <key>.",
+		})
+	}
+
+	if len(args) != 2 {
+		return addReplySubcommandSyntaxError("OBJECT", subcommand)
+	}
+
+	key, ok := args[1].(string)
+	if !ok {
+		return []byte("-ERR Invalid key type\r\n")
+	}
+
+	// inspecting a key must not count as an access
+	obj := server.lookupKeyWithFlags(key, LOOKUP_NOTOUCH)
+	if obj == nil {
+		return []byte("$-1\r\n")
+	}
+
+	lfu := server.Config.MaxmemoryPolicy&MAXMEMORY_FLAG_LFU != 0
+
+	switch strings.ToUpper(subcommand) {
+	case "ENCODING":
+		return addReplyBulk([]interface{}{getObjectEncodingName(obj)})
+	case "REFCOUNT":
+		return addReplyLongLong(1)
+	case "IDLETIME":
+		if lfu {
+			return []byte("-ERR An LFU maxmemory policy is selected, idle time not tracked. " +
+				"Please note that when switching between policies at runtime LRU and LFU data " +
+				"will take some time to adjust.\r\n")
+		}
+		return addReplyLongLong(int64(server.estimateObjectIdleTime(obj) / 1000))
+	case "FREQ":
+		if !lfu {
+			return []byte("-ERR An LFU maxmemory policy is not selected, access frequency not tracked. " +
+				"Please note that when switching between policies at runtime LRU and LFU data " +
+				"will take some time to adjust.\r\n")
+		}
+		return addReplyLongLong(int64(server.LFUDecrAndReturn(obj)))
+	default:
+		return addReplySubcommandSyntaxError("OBJECT", subcommand)
+	}
+}
+
+func addReplySubcommandSyntaxError(command, subcommand string) []byte {
+	return []byte(fmt.Sprintf("-ERR unknown subcommand '%s'. Try %s HELP.\r\n", subcommand, command))
+}
+
+type redisMemOverhead struct {
+	peakAllocated     int64
+	totalAllocated    int64
+	startupAllocated  int64
+	clientsSlaves     int64
+	clientsNormal     int64
+	overheadHashtable int64
+	overheadExpires   int64
+	overheadTotal     int64
+	datasetBytes      int64
+	keys              int64
+	allocatorHeap     int64
+	allocatorSys      int64
+}
+
+// getMemoryOverheadData breaks down where the memory of the server goes
+func (server *RedisServer) getMemoryOverheadData() redisMemOverhead {
+	var mh redisMemOverhead
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	mh.totalAllocated = server.getUsedMemory()
+	mh.peakAllocated = server.StatPeakMemory
+	if mh.totalAllocated > mh.peakAllocated {
+		mh.peakAllocated = mh.totalAllocated
+	}
+	mh.allocatorHeap = int64(ms.HeapAlloc)
+	mh.allocatorSys = int64(ms.Sys)
+
+	server.clientsMu.Lock()
+	for _, client := range server.clients {
+		client.mu.Lock()
+		if client.getClientType() == CLIENT_TYPE_REPLICA {
+			mh.clientsSlaves += client.outputBytes
+		} else {
+			mh.clientsNormal += client.outputBytes
+		}
+		client.mu.Unlock()
+	}
+	server.clientsMu.Unlock()
+
+	mh.keys = int64(server.Storage.Len())
+	mh.overheadHashtable = mh.keys * KEY_ENTRY_OVERHEAD
+	mh.overheadExpires = int64(server.Expirations.Len()) * KEY_ENTRY_OVERHEAD / 2
+	mh.overheadTotal = mh.clientsSlaves + mh.clientsNormal + mh.overheadHashtable + mh.overheadExpires
+	mh.datasetBytes = mh.totalAllocated - mh.overheadHashtable
+	if mh.datasetBytes < 0 {
+		mh.datasetBytes = 0
+	}
+
+	return mh
+}
+
+// getMemoryDoctorReport produces the human readable report of MEMORY DOCTOR
+func (server *RedisServer) getMemoryDoctorReport() string {
+	mh := server.getMemoryOverheadData()
+
+	if mh.totalAllocated < 1024*1024*5 {
+		return "Hi Sam, this instance is empty or is using very little memory, " +
+			"my issues detector can't be used in these conditions. " +
+			"Please, leave for your mission on Earth and fill it with some data. " +
+			"The new Sam and I will be back to our programming as soon as I " +
+			"finished rebooting."
+	}
+
+	var issues []string
+	if float64(mh.peakAllocated) > float64(mh.totalAllocated)*1.5 {
+		issues = append(issues, " * Peak memory: In the past this instance used more than 150% "+
+			"the memory that is currently using. The allocator is normally not able to release "+
+			"memory after a peak, so you can expect to see a big fragmentation ratio, however "+
+			"this is actually harmless and is only due to the memory peak, and if the Redis "+
+			"instance Resident Set Size (RSS) is currently bigger than expected, the memory "+
+			"will be used as soon as you fill the Redis instance with more data. If the memory "+
+			"peak was only occasional and you want to try to reclaim memory, please try the "+
+			"MEMORY PURGE command, otherwise the only other option is to shutdown and restart "+
+			"the instance.")
+	}
+	if mh.allocatorHeap > 0 && float64(mh.allocatorSys)/float64(mh.allocatorHeap) > 1.4 {
+		issues = append(issues, fmt.Sprintf(" * High process RSS overhead: This instance has "+
+			"non-allocator RSS memory overhead is greater than 1.4 (this means that the Resident "+
+			"Set Size of the Redis process is much larger than the sum of the allocations Redis "+
+			"performed). This problem is usually due either to a large peak memory (check if "+
+			"there is a peak memory entry above in the report) or may result from a Go runtime "+
+			"that did not return freed memory to the system yet. Sys/HeapAlloc ratio is %.2f.",
+			float64(mh.allocatorSys)/float64(mh.allocatorHeap)))
+	}
+	if mh.clientsNormal > 1024*1024*200 {
+		issues = append(issues, " * Big client buffers: The clients output buffers in this "+
+			"instance are greater than 200MB. Check the CLIENT output buffers to find the "+
+			"clients using more memory.")
+	}
+	if mh.clientsSlaves > 1024*1024*10 {
+		issues = append(issues, " * Big replica buffers: The replica output buffers in this "+
+			"instance are greater than 10MB for each replica (on average). This likely means "+
+			"that there is some replica instance that is struggling receiving data, either "+
+			"because it is too slow or because of networking issues.")
+	}
+
+	if len(issues) == 0 {
+		return "Hi Sam, I can't find any memory issue in your instance. " +
+			"I can only account for what occurs on this base."
+	}
+
+	return "Sam, I detected a few issues in this Redis instance memory implants:\n\n" +
+		strings.Join(issues, "\n\n") +
+		"\n\nI'm here to keep you safe, Sam. I want to help you.\n"
+}
+
+func (server *RedisServer) handleMemoryCommand(cmd string, args []interface{}) []byte {
+	if len(args) < 1 {
+		return addReplyErrorArity()
+	}
+
+	subcommand, ok := args[0].(string)
+	if !ok {
+		return []byte("-ERR Invalid subcommand type\r\n")
+	}
+
+	switch strings.ToUpper(subcommand) {
+	case "HELP":
+		return addReplyHelp("MEMORY", []string{
+			"DOCTOR",
+			"    Return memory problems reports.",
+			"MALLOC-STATS",
+			"    Return internal statistics report from the memory allocator.",
+			"PURGE",
+			"    Attempt to purge dirty pages for reclamation by the allocator.",
+			"STATS",
+			"    Return information about the memory usage of the server.",
+			"USAGE <key> [SAMPLES <count>]",
+			"    Return memory in bytes used by <key> and its value. Nested values are",
+			"    sampled up to <count> times (default: 5, 0 means sample all).",
+		})
+	case "USAGE":
+		if len(args) != 2 && len(args) != 4 {
+			return addReplyErrorArity()
+		}
+		key, _ := args[1].(string)
+		samples := OBJ_COMPUTE_SIZE_DEF_SAMPLES
+		if len(args) == 4 {
+			option, _ := args[2].(string)
+			if strings.ToUpper(option) != "SAMPLES" {
+				return []byte("-ERR syntax error\r\n")
+			}
+			count, _ := args[3].(string)
+			n, err := strconv.Atoi(count)
+			if err != nil || n < 0 {
+				return []byte("-ERR value is out of range, must be positive\r\n")
+			}
+			samples = n
+		}
+
+		obj := server.lookupKeyWithFlags(key, LOOKUP_NOTOUCH|LOOKUP_NOSTATS)
+		if obj == nil {
+			return []byte("$-1\r\n")
+		}
+		usage := int64(len(key)) + KEY_ENTRY_OVERHEAD + objectComputeSize(obj, samples)
+		return addReplyLongLong(usage)
+	case "STATS":
+		mh := server.getMemoryOverheadData()
+		bytesPerKey := int64(0)
+		datasetPerc := 0.0
+		peakPerc := 0.0
+		if mh.keys > 0 {
+			bytesPerKey = (mh.totalAllocated - mh.startupAllocated) / mh.keys
+		}
+		if mh.totalAllocated > 0 {
+			datasetPerc = float64(mh.datasetBytes) * 100 / float64(mh.totalAllocated)
+		}
+		if mh.peakAllocated > 0 {
+			peakPerc = float64(mh.totalAllocated) * 100 / float64(mh.peakAllocated)
+		}
+		return addReplyValue([]interface{}{
+			"peak.allocated", mh.peakAllocated,
+			"total.allocated", mh.totalAllocated,
+			"startup.allocated", mh.startupAllocated,
+			"clients.slaves", mh.clientsSlaves,
+			"clients.normal", mh.clientsNormal,
+			"db.0", []interface{}{
+				"overhead.hashtable.main", mh.overheadHashtable,
+				"overhead.hashtable.expires", mh.overheadExpires,
+			},
+			"overhead.total", mh.overheadTotal,
+			"keys.count", mh.keys,
+			"keys.bytes-per-key", bytesPerKey,
+			"dataset.bytes", mh.datasetBytes,
+			"dataset.percentage", datasetPerc,
+			"peak.percentage", peakPerc,
+			"allocator.allocated", mh.allocatorHeap,
+			"allocator.resident", mh.allocatorSys,
+			"lazyfree.pending_objects", server.lazyfree.pending(),
+		})
+	case "DOCTOR":
+		return addReplyBulk([]interface{}{server.getMemoryDoctorReport()})
+	case "MALLOC-STATS":
+		return addReplyBulk([]interface{}{"Stats not supported for the current allocator"})
+	case "PURGE":
+		debug.FreeOSMemory()
+		return []byte("+OK\r\n")
+	default:
+		return addReplySubcommandSyntaxError("MEMORY", subcommand)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sync"
+)
+
+// Buffers larger than this are left to the GC instead of being pooled, so a
+// single huge reply doesn't pin memory forever.
+const maxPooledBufferSize = 64 * 1024
+
+const readerBufferSize = 16 * 1024
+
+var readerPool = sync.Pool{
+	New: func() interface{} {
+		return bufio.NewReaderSize(nil, readerBufferSize)
+	},
+}
+
+var argsPool = sync.Pool{
+	New: func() interface{} {
+		args := make([]interface{}, 0, 8)
+		return &args
+	},
+}
+
+var replyBufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+func getReader(r io.Reader) *bufio.Reader {
+	reader := readerPool.Get().(*bufio.Reader)
+	reader.Reset(r)
+	return reader
+}
+
+func putReader(reader *bufio.Reader) {
+	reader.Reset(nil)
+	readerPool.Put(reader)
+}
+
+// getArgs returns an empty argument slice with room for at least n elements.
+// Handlers must not keep a reference to the slice after they return.
+func getArgs(n int) []interface{} {
+	args := *argsPool.Get().(*[]interface{})
+	if cap(args) < n {
+		return make([]interface{}, 0, n)
+	}
+	return args[:0]
+}
+
+func putArgs(args []interface{}) {
+	if args == nil || cap(args) > 1024 {
+		return
+	}
+	for i := range args {
+		args[i] = nil
+	}
+	args = args[:0]
+	argsPool.Put(&args)
+}
+
+func getReplyBuffer() *bytes.Buffer {
+	return replyBufferPool.Get().(*bytes.Buffer)
+}
+
+func putReplyBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBufferSize {
+		return
+	}
+	buf.Reset()
+	replyBufferPool.Put(buf)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// a pipeline of SETs, as a client sends them
+var benchCommands = strings.Repeat("*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\n", 64)
+
+func BenchmarkReadCommandPooled(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		reader := getReader(strings.NewReader(benchCommands))
+		for {
+			_, args, err := readCommand(reader, CONFIG_DEFAULT_PROTO_MAX_BULK_LEN)
+			if err != nil {
+				break
+			}
+			putArgs(args)
+		}
+		putReader(reader)
+	}
+}
+
+func BenchmarkReadCommandUnpooled(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		reader := bufio.NewReaderSize(strings.NewReader(benchCommands), readerBufferSize)
+		for {
+			if _, _, err := readCommand(reader, CONFIG_DEFAULT_PROTO_MAX_BULK_LEN); err != nil {
+				break
+			}
+		}
+	}
+}
+
+func BenchmarkArgsPooled(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		args := getArgs(2)
+		args = append(args, "key", "value")
+		putArgs(args)
+	}
+}
+
+func BenchmarkArgsUnpooled(b *testing.B) {
+	b.ReportAllocs()
+	var args []interface{}
+	for i := 0; i < b.N; i++ {
+		args = make([]interface{}, 0, 2)
+		args = append(args, "key", "value")
+	}
+	_ = args
+}
+
+func BenchmarkReplyBufferPooled(b *testing.B) {
+	b.ReportAllocs()
+	reply := []byte("$5\r\nvalue\r\n")
+	for i := 0; i < b.N; i++ {
+		buf := getReplyBuffer()
+		buf.Write(reply)
+		putReplyBuffer(buf)
+	}
+}
+
+func BenchmarkReplyBufferUnpooled(b *testing.B) {
+	b.ReportAllocs()
+	reply := []byte("$5\r\nvalue\r\n")
+	var buf *bytes.Buffer
+	for i := 0; i < b.N; i++ {
+		buf = new(bytes.Buffer)
+		buf.Write(reply)
+	}
+	_ = buf
+}
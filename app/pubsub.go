@@ -0,0 +1,542 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+)
+
+// pubsubState maps each channel, and each pattern, to the clients
+// subscribed to it
+type pubsubState struct {
+	channels map[string]map[*RedisClient]struct{}
+	patterns map[string]map[*RedisClient]struct{}
+
+	// shard channels are kept apart, in a cluster they live with the slot of
+	// their name
+	shardChannels map[string]map[*RedisClient]struct{}
+
+	// the patterns by shape, so a message is not matched against each of
+	// them: the ones without wildcards are looked up, as are the ones that
+	// only end with *, by their prefix. The others are matched one by one.
+	literalPatterns map[string]struct{}
+	prefixPatterns  map[string]string
+	globPatterns    map[string]struct{}
+
+	// clients with at least one subscription, so the ones that disconnected
+	// can be removed from the channels
+	clients map[*RedisClient]struct{}
+}
+
+// pubsubType tells the global channels from the shard channels, which have
+// their own subscriptions, counts and replies
+type pubsubType struct {
+	shard          bool
+	subscribeMsg   string
+	unsubscribeMsg string
+	messageBulk    string
+}
+
+var (
+	pubsubTypeGlobal = pubsubType{false, "subscribe", "unsubscribe", "message"}
+	pubsubTypeShard  = pubsubType{true, "ssubscribe", "sunsubscribe", "smessage"}
+)
+
+// pubsubServerChannels maps the channels of the type to their subscribers
+func (server *RedisServer) pubsubServerChannels(t pubsubType) map[string]map[*RedisClient]struct{} {
+	if t.shard {
+		return server.pubsub.shardChannels
+	}
+	return server.pubsub.channels
+}
+
+// pubsubClientChannels points to the channels of the type the client is
+// subscribed to, so they can be allocated on the first subscription
+func (client *RedisClient) pubsubClientChannels(t pubsubType) *map[string]struct{} {
+	if t.shard {
+		return &client.pubsubShardChannels
+	}
+	return &client.pubsubChannels
+}
+
+// pubsubSubscriptionCount is the count sent along with the confirmations of
+// the type
+func (client *RedisClient) pubsubSubscriptionCount(t pubsubType) int {
+	if t.shard {
+		return client.clientShardSubscriptionsCount()
+	}
+	return client.clientSubscriptionsCount()
+}
+
+// clientSubscriptionsCount is the count sent along with the subscribe and
+// unsubscribe confirmations
+func (client *RedisClient) clientSubscriptionsCount() int {
+	return len(client.pubsubChannels) + len(client.pubsubPatterns)
+}
+
+func (client *RedisClient) clientShardSubscriptionsCount() int {
+	return len(client.pubsubShardChannels)
+}
+
+// pubsubSubscribeChannel subscribes the client to the channel and returns
+// the confirmation, sent even if it was already subscribed
+func (server *RedisServer) pubsubSubscribeChannel(client *RedisClient, channel string, t pubsubType) []byte {
+	clientChannels := client.pubsubClientChannels(t)
+	if _, ok := (*clientChannels)[channel]; !ok {
+		if *clientChannels == nil {
+			*clientChannels = make(map[string]struct{})
+		}
+		(*clientChannels)[channel] = struct{}{}
+
+		serverChannels := server.pubsubServerChannels(t)
+		subscribers, ok := serverChannels[channel]
+		if !ok {
+			subscribers = make(map[*RedisClient]struct{})
+			serverChannels[channel] = subscribers
+		}
+		subscribers[client] = struct{}{}
+	}
+	server.pubsubUpdateClientFlags(client)
+	return client.addReplyPubsub([]interface{}{t.subscribeMsg, channel, client.pubsubSubscriptionCount(t)})
+}
+
+// pubsubUnsubscribeChannel removes the subscription of the client, returning
+// the confirmation when notify is set
+func (server *RedisServer) pubsubUnsubscribeChannel(client *RedisClient, channel string, notify bool, t pubsubType) []byte {
+	clientChannels := client.pubsubClientChannels(t)
+	if _, ok := (*clientChannels)[channel]; ok {
+		delete(*clientChannels, channel)
+
+		serverChannels := server.pubsubServerChannels(t)
+		subscribers := serverChannels[channel]
+		delete(subscribers, client)
+		if len(subscribers) == 0 {
+			delete(serverChannels, channel)
+		}
+	}
+	server.pubsubUpdateClientFlags(client)
+	if !notify {
+		return nil
+	}
+	return client.addReplyPubsub([]interface{}{t.unsubscribeMsg, channel, client.pubsubSubscriptionCount(t)})
+}
+
+// pubsubUnsubscribeAllChannels is UNSUBSCRIBE without arguments. When the
+// client had no subscription it still gets a confirmation, for no channel.
+func (server *RedisServer) pubsubUnsubscribeAllChannels(client *RedisClient, notify bool, t pubsubType) []byte {
+	reply := bytes.Buffer{}
+	for channel := range *client.pubsubClientChannels(t) {
+		reply.Write(server.pubsubUnsubscribeChannel(client, channel, notify, t))
+	}
+	if notify && reply.Len() == 0 {
+		return client.addReplyPubsub([]interface{}{t.unsubscribeMsg, nil, client.pubsubSubscriptionCount(t)})
+	}
+	return reply.Bytes()
+}
+
+// pubsubSubscribePattern subscribes the client to the channels matching the
+// pattern and returns the confirmation
+func (server *RedisServer) pubsubSubscribePattern(client *RedisClient, pattern string) []byte {
+	if _, ok := client.pubsubPatterns[pattern]; !ok {
+		if client.pubsubPatterns == nil {
+			client.pubsubPatterns = make(map[string]struct{})
+		}
+		client.pubsubPatterns[pattern] = struct{}{}
+
+		subscribers, ok := server.pubsub.patterns[pattern]
+		if !ok {
+			subscribers = make(map[*RedisClient]struct{})
+			server.pubsub.patterns[pattern] = subscribers
+			server.pubsubIndexPattern(pattern, true)
+		}
+		subscribers[client] = struct{}{}
+	}
+	server.pubsubUpdateClientFlags(client)
+	return client.addReplyPubsub([]interface{}{"psubscribe", pattern, client.clientSubscriptionsCount()})
+}
+
+// pubsubUnsubscribePattern removes the pattern subscription of the client,
+// returning the confirmation when notify is set
+func (server *RedisServer) pubsubUnsubscribePattern(client *RedisClient, pattern string, notify bool) []byte {
+	if _, ok := client.pubsubPatterns[pattern]; ok {
+		delete(client.pubsubPatterns, pattern)
+
+		subscribers := server.pubsub.patterns[pattern]
+		delete(subscribers, client)
+		if len(subscribers) == 0 {
+			delete(server.pubsub.patterns, pattern)
+			server.pubsubIndexPattern(pattern, false)
+		}
+	}
+	server.pubsubUpdateClientFlags(client)
+	if !notify {
+		return nil
+	}
+	return client.addReplyPubsub([]interface{}{"punsubscribe", pattern, client.clientSubscriptionsCount()})
+}
+
+// pubsubUnsubscribeAllPatterns is PUNSUBSCRIBE without arguments
+func (server *RedisServer) pubsubUnsubscribeAllPatterns(client *RedisClient, notify bool) []byte {
+	reply := bytes.Buffer{}
+	for pattern := range client.pubsubPatterns {
+		reply.Write(server.pubsubUnsubscribePattern(client, pattern, notify))
+	}
+	if notify && reply.Len() == 0 {
+		return client.addReplyPubsub([]interface{}{"punsubscribe", nil, client.clientSubscriptionsCount()})
+	}
+	return reply.Bytes()
+}
+
+// pubsubIndexPattern adds the pattern to the index of its shape, or removes
+// it from there
+func (server *RedisServer) pubsubIndexPattern(pattern string, add bool) {
+	wildcard := strings.IndexAny(pattern, "*?[\\")
+	switch {
+	case wildcard == -1:
+		if add {
+			server.pubsub.literalPatterns[pattern] = struct{}{}
+		} else {
+			delete(server.pubsub.literalPatterns, pattern)
+		}
+	case wildcard == len(pattern)-1 && pattern[wildcard] == '*':
+		prefix := pattern[:wildcard]
+		if add {
+			server.pubsub.prefixPatterns[prefix] = pattern
+		} else {
+			delete(server.pubsub.prefixPatterns, prefix)
+		}
+	default:
+		if add {
+			server.pubsub.globPatterns[pattern] = struct{}{}
+		} else {
+			delete(server.pubsub.globPatterns, pattern)
+		}
+	}
+}
+
+// pubsubMatchingPatterns returns the subscribed patterns matching the channel
+func (server *RedisServer) pubsubMatchingPatterns(channel string) []string {
+	var matching []string
+	if _, ok := server.pubsub.literalPatterns[channel]; ok {
+		matching = append(matching, channel)
+	}
+	if len(server.pubsub.prefixPatterns) > 0 {
+		for i := 0; i <= len(channel); i++ {
+			if pattern, ok := server.pubsub.prefixPatterns[channel[:i]]; ok {
+				matching = append(matching, pattern)
+			}
+		}
+	}
+	for pattern := range server.pubsub.globPatterns {
+		if stringMatch(pattern, channel, false) {
+			matching = append(matching, pattern)
+		}
+	}
+	return matching
+}
+
+// pubsubUpdateClientFlags puts the client in the pubsub class, for the
+// output buffer limits, as long as it has subscriptions
+func (server *RedisServer) pubsubUpdateClientFlags(client *RedisClient) {
+	if client.clientSubscriptionsCount()+client.clientShardSubscriptionsCount() > 0 {
+		client.Flags |= CLIENT_PUBSUB
+		server.pubsub.clients[client] = struct{}{}
+	} else {
+		client.Flags &^= CLIENT_PUBSUB
+		delete(server.pubsub.clients, client)
+	}
+}
+
+// pubsubPublishMessage sends the message to the subscribers of the channel
+// and returns how many received it. The writer of each subscriber writes
+// it, so a slow subscriber never holds the publisher, until its output
+// buffer limit closes it. Patterns only match global channels.
+func (server *RedisServer) pubsubPublishMessage(channel, message string, t pubsubType) int {
+	receivers := 0
+	if subscribers := server.pubsubServerChannels(t)[channel]; len(subscribers) > 0 {
+		reply := addReplyValue([]interface{}{t.messageBulk, channel, message})
+		push := addReplyPush(reply)
+		for client := range subscribers {
+			if client.isClosed() {
+				continue
+			}
+			client.addReplyPubsubMessage(reply, push)
+			receivers++
+		}
+	}
+
+	if t.shard || len(server.pubsub.patterns) == 0 {
+		return receivers
+	}
+	for _, pattern := range server.pubsubMatchingPatterns(channel) {
+		reply := addReplyValue([]interface{}{"pmessage", pattern, channel, message})
+		push := addReplyPush(reply)
+		for client := range server.pubsub.patterns[pattern] {
+			if client.isClosed() {
+				continue
+			}
+			client.addReplyPubsubMessage(reply, push)
+			receivers++
+		}
+	}
+	return receivers
+}
+
+// addReplyPubsub encodes a pubsub frame, as a push for RESP3 clients since
+// it may come in between the replies to their commands
+func (client *RedisClient) addReplyPubsub(items []interface{}) []byte {
+	reply := addReplyValue(items)
+	if client.resp > 2 {
+		return addReplyPush(reply)
+	}
+	return reply
+}
+
+// addReplyPubsubMessage sends a message encoded once for each protocol,
+// for all the subscribers
+func (client *RedisClient) addReplyPubsubMessage(reply, push []byte) {
+	if client.resp > 2 {
+		client.addReply(push)
+	} else {
+		client.addReply(reply)
+	}
+}
+
+// pubsubRemoveClosedClients drops the subscriptions of the clients that
+// disconnected, called by clientsCron
+func (server *RedisServer) pubsubRemoveClosedClients() {
+	for client := range server.pubsub.clients {
+		if client.isClosed() {
+			server.pubsubUnsubscribeAllChannels(client, false, pubsubTypeGlobal)
+			server.pubsubUnsubscribeAllPatterns(client, false)
+			server.pubsubUnsubscribeAllChannels(client, false, pubsubTypeShard)
+		}
+	}
+}
+
+// isPubsubContextCommand tells the commands a RESP2 client can send while
+// it is subscribed
+func isPubsubContextCommand(cmd string) bool {
+	switch cmd {
+	case "SUBSCRIBE", "UNSUBSCRIBE", "PSUBSCRIBE", "PUNSUBSCRIBE", "SSUBSCRIBE", "SUNSUBSCRIBE",
+		"PING", "QUIT", "RESET":
+		return true
+	}
+	return false
+}
+
+func (server *RedisServer) handleSubscribeCommand(cmd string, args []interface{}) []byte {
+	return server.subscribeGenericCommand(args, pubsubTypeGlobal)
+}
+
+func (server *RedisServer) handleUnsubscribeCommand(cmd string, args []interface{}) []byte {
+	return server.unsubscribeGenericCommand(args, pubsubTypeGlobal)
+}
+
+func (server *RedisServer) handleSsubscribeCommand(cmd string, args []interface{}) []byte {
+	return server.subscribeGenericCommand(args, pubsubTypeShard)
+}
+
+func (server *RedisServer) handleSunsubscribeCommand(cmd string, args []interface{}) []byte {
+	return server.unsubscribeGenericCommand(args, pubsubTypeShard)
+}
+
+func (server *RedisServer) subscribeGenericCommand(args []interface{}, t pubsubType) []byte {
+	if len(args) < 1 {
+		return addReplyErrorArity()
+	}
+
+	client := server.currentClient
+	reply := bytes.Buffer{}
+	for _, arg := range args {
+		channel, ok := arg.(string)
+		if !ok {
+			return []byte("-ERR Invalid channel type\r\n")
+		}
+		reply.Write(server.pubsubSubscribeChannel(client, channel, t))
+	}
+	return reply.Bytes()
+}
+
+func (server *RedisServer) unsubscribeGenericCommand(args []interface{}, t pubsubType) []byte {
+	client := server.currentClient
+	if len(args) == 0 {
+		return server.pubsubUnsubscribeAllChannels(client, true, t)
+	}
+
+	reply := bytes.Buffer{}
+	for _, arg := range args {
+		channel, ok := arg.(string)
+		if !ok {
+			return []byte("-ERR Invalid channel type\r\n")
+		}
+		reply.Write(server.pubsubUnsubscribeChannel(client, channel, true, t))
+	}
+	return reply.Bytes()
+}
+
+func (server *RedisServer) handlePsubscribeCommand(cmd string, args []interface{}) []byte {
+	if len(args) < 1 {
+		return addReplyErrorArity()
+	}
+
+	client := server.currentClient
+	reply := bytes.Buffer{}
+	for _, arg := range args {
+		pattern, ok := arg.(string)
+		if !ok {
+			return []byte("-ERR Invalid pattern type\r\n")
+		}
+		reply.Write(server.pubsubSubscribePattern(client, pattern))
+	}
+	return reply.Bytes()
+}
+
+func (server *RedisServer) handlePunsubscribeCommand(cmd string, args []interface{}) []byte {
+	client := server.currentClient
+	if len(args) == 0 {
+		return server.pubsubUnsubscribeAllPatterns(client, true)
+	}
+
+	reply := bytes.Buffer{}
+	for _, arg := range args {
+		pattern, ok := arg.(string)
+		if !ok {
+			return []byte("-ERR Invalid pattern type\r\n")
+		}
+		reply.Write(server.pubsubUnsubscribePattern(client, pattern, true))
+	}
+	return reply.Bytes()
+}
+
+func (server *RedisServer) handlePublishCommand(cmd string, args []interface{}) []byte {
+	return server.publishGenericCommand(cmd, args, pubsubTypeGlobal)
+}
+
+func (server *RedisServer) handleSpublishCommand(cmd string, args []interface{}) []byte {
+	return server.publishGenericCommand(cmd, args, pubsubTypeShard)
+}
+
+func (server *RedisServer) publishGenericCommand(cmd string, args []interface{}, t pubsubType) []byte {
+	if len(args) != 2 {
+		return addReplyErrorArity()
+	}
+	if server.sentinel != nil {
+		return server.sentinelPublishCommand(args)
+	}
+
+	channel, ok := args[0].(string)
+	if !ok {
+		return []byte("-ERR Invalid channel type\r\n")
+	}
+	message, ok := args[1].(string)
+	if !ok {
+		return []byte("-ERR Invalid message type\r\n")
+	}
+
+	receivers := server.pubsubPublishMessage(channel, message, t)
+
+	// the subscribers of the other nodes of the cluster, or of our shard,
+	// get the message over the bus. Otherwise our replicas get it, while
+	// the AOF has no use for it.
+	if server.cluster != nil {
+		server.clusterPropagatePublish(channel, message, t)
+	} else if server.Config.MasterHost == "" {
+		server.replicationFeedSlaves(cmd, args)
+	}
+	return addReplyLongLong(int64(receivers))
+}
+
+// pubsubShardChannelGetKeys is the shard channel of SPUBLISH, a cluster
+// routes it to the shard serving its slot like a key
+func pubsubShardChannelGetKeys(args []interface{}) []string {
+	channel, _ := args[0].(string)
+	return []string{channel}
+}
+
+// pubsubShardChannelsGetKeys is the shard channels of SSUBSCRIBE and
+// SUNSUBSCRIBE
+func pubsubShardChannelsGetKeys(args []interface{}) []string {
+	channels := make([]string, 0, len(args))
+	for _, arg := range args {
+		channel, _ := arg.(string)
+		channels = append(channels, channel)
+	}
+	return channels
+}
+
+// pubsubShardUnsubscribeAllChannelsInSlot unsubscribes the clients from the
+// shard channels of a slot that moved to another shard, telling them
+func (server *RedisServer) pubsubShardUnsubscribeAllChannelsInSlot(slot int) {
+	for channel, subscribers := range server.pubsub.shardChannels {
+		if keyHashSlot(channel) != slot {
+			continue
+		}
+		for client := range subscribers {
+			client.addReply(server.pubsubUnsubscribeChannel(client, channel, true, pubsubTypeShard))
+		}
+	}
+}
+
+func (server *RedisServer) handlePubsubCommand(cmd string, args []interface{}) []byte {
+	if len(args) < 1 {
+		return addReplyErrorArity()
+	}
+
+	subcommand, ok := args[0].(string)
+	if !ok {
+		return []byte("-ERR Invalid subcommand type\r\n")
+	}
+
+	subcommand = strings.ToUpper(subcommand)
+	t := pubsubTypeGlobal
+	if strings.HasPrefix(subcommand, "SHARD") {
+		t = pubsubTypeShard
+	}
+
+	switch subcommand {
+	case "HELP":
+		return addReplyHelp("PUBSUB", []string{
+			"CHANNELS [<pattern>]",
+			"    Return the currently active channels matching a <pattern> (default: '*').",
+			"NUMPAT",
+			"    Return number of subscriptions to patterns.",
+			"NUMSUB [<channel> ...]",
+			"    Return the number of subscribers for the specified channels, excluding",
+			"    pattern subscriptions(default: no channels).",
+			"SHARDCHANNELS [<pattern>]",
+			"    Return the currently active shard level channels matching a <pattern> (default: '*').",
+			"SHARDNUMSUB [<shardchannel> ...]",
+			"    Return the number of subscribers for the specified shard level channel(s)",
+		})
+	case "CHANNELS", "SHARDCHANNELS":
+		if len(args) > 2 {
+			return addReplyErrorArity()
+		}
+		pattern := ""
+		if len(args) == 2 {
+			pattern, _ = args[1].(string)
+		}
+		channels := []string{}
+		for channel := range server.pubsubServerChannels(t) {
+			if pattern == "" || stringMatch(pattern, channel, false) {
+				channels = append(channels, channel)
+			}
+		}
+		return addReplyArray(channels)
+	case "NUMSUB", "SHARDNUMSUB":
+		serverChannels := server.pubsubServerChannels(t)
+		reply := make([]interface{}, 0, 2*(len(args)-1))
+		for _, arg := range args[1:] {
+			channel, _ := arg.(string)
+			reply = append(reply, channel, len(serverChannels[channel]))
+		}
+		return addReplyValue(reply)
+	case "NUMPAT":
+		if len(args) != 1 {
+			return addReplyErrorArity()
+		}
+		return addReplyLongLong(int64(len(server.pubsub.patterns)))
+	default:
+		return addReplySubcommandSyntaxError("PUBSUB", subcommand)
+	}
+}
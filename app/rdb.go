@@ -0,0 +1,842 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	RDB_OPCODE_FUNCTION2       = 245
+	RDB_OPCODE_FUNCTION_PRE_GA = 246
+	RDB_OPCODE_MODULE_AUX      = 247
+	RDB_OPCODE_IDLE            = 248
+	RDB_OPCODE_FREQ            = 249
+	RDB_OPCODE_AUX             = 250
+	RDB_OPCODE_RESIZEDB        = 251
+	RDB_OPCODE_EXPIRETIME_MS   = 252
+	RDB_OPCODE_EXPIRETIME      = 253
+	RDB_OPCODE_SELECTDB        = 254
+	RDB_OPCODE_EOF             = 255
+)
+
+const (
+	RDB_6BITLEN  = 0
+	RDB_14BITLEN = 1
+	RDB_32BITLEN = 0x80
+	RDB_64BITLEN = 0x81
+	RDB_ENCVAL   = 3
+
+	RDB_ENC_INT8  = 0
+	RDB_ENC_INT16 = 1
+	RDB_ENC_INT32 = 2
+	RDB_ENC_LZF   = 3
+)
+
+var errRdbBadFormat = errors.New("bad RDB file format")
+
+// rdbReader keeps a running CRC64 of everything consumed so far, which is
+// compared with the checksum trailer at EOF
+type rdbReader struct {
+	r   *bufio.Reader
+	crc uint64
+
+	// position in the file, reported as loading progress
+	offset int64
+}
+
+func (rdb *rdbReader) readByte() (byte, error) {
+	b, err := rdb.r.ReadByte()
+	if err == nil {
+		rdb.crc = crc64Update(rdb.crc, []byte{b})
+		rdb.offset++
+	}
+	return b, err
+}
+
+func (rdb *rdbReader) readFull(n int) ([]byte, error) {
+	buf := make([]byte, n)
+	_, err := io.ReadFull(rdb.r, buf)
+	if err == nil {
+		rdb.crc = crc64Update(rdb.crc, buf)
+		rdb.offset += int64(n)
+	}
+	return buf, err
+}
+
+// loadLen reads a length prefix. When the value is a special encoding the
+// returned flag is set and the length is the encoding type.
+func (rdb *rdbReader) loadLen() (uint64, bool, error) {
+	first, err := rdb.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+
+	switch (first & 0xC0) >> 6 {
+	case RDB_ENCVAL:
+		return uint64(first & 0x3F), true, nil
+	case RDB_6BITLEN:
+		return uint64(first & 0x3F), false, nil
+	case RDB_14BITLEN:
+		next, err := rdb.readByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(first&0x3F)<<8 | uint64(next), false, nil
+	}
+
+	switch first {
+	case RDB_32BITLEN:
+		buf, err := rdb.readFull(4)
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(buf)), false, nil
+	case RDB_64BITLEN:
+		buf, err := rdb.readFull(8)
+		if err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(buf), false, nil
+	default:
+		return 0, false, fmt.Errorf("unknown length encoding %d", first)
+	}
+}
+
+func (rdb *rdbReader) loadString() (string, error) {
+	length, encoded, err := rdb.loadLen()
+	if err != nil {
+		return "", err
+	}
+
+	if encoded {
+		switch length {
+		case RDB_ENC_INT8:
+			b, err := rdb.readByte()
+			if err != nil {
+				return "", err
+			}
+			return strconv.FormatInt(int64(int8(b)), 10), nil
+		case RDB_ENC_INT16:
+			buf, err := rdb.readFull(2)
+			if err != nil {
+				return "", err
+			}
+			return strconv.FormatInt(int64(int16(binary.LittleEndian.Uint16(buf))), 10), nil
+		case RDB_ENC_INT32:
+			buf, err := rdb.readFull(4)
+			if err != nil {
+				return "", err
+			}
+			return strconv.FormatInt(int64(int32(binary.LittleEndian.Uint32(buf))), 10), nil
+		case RDB_ENC_LZF:
+			return rdb.loadLzfString()
+		default:
+			return "", fmt.Errorf("unknown string encoding %d", length)
+		}
+	}
+
+	buf, err := rdb.readFull(int(length))
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+func (rdb *rdbReader) loadLzfString() (string, error) {
+	clen, _, err := rdb.loadLen()
+	if err != nil {
+		return "", err
+	}
+	length, _, err := rdb.loadLen()
+	if err != nil {
+		return "", err
+	}
+
+	compressed, err := rdb.readFull(int(clen))
+	if err != nil {
+		return "", err
+	}
+	value, err := lzfDecompress(compressed, int(length))
+	if err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
+func (server *RedisServer) rdbFilename() string {
+	return filepath.Join(server.Config.Dir, server.Config.DbFilename)
+}
+
+// rdbLoad reads an RDB file into the keyspace. A missing file is not an error,
+// the server just starts empty.
+func (server *RedisServer) rdbLoad(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	size := int64(0)
+	if stat, err := file.Stat(); err == nil {
+		size = stat.Size()
+	}
+	server.startLoading(size)
+	defer server.stopLoading()
+
+	return server.rdbLoadRio(bufio.NewReader(file))
+}
+
+// Bytes loaded between two rounds of serving the clients that wait for the
+// load to finish
+const LOADING_PROCESS_EVENTS_INTERVAL_BYTES = 2 * 1024 * 1024
+
+// startLoading marks the dataset as being loaded. Until stopLoading, clients
+// are answered with -LOADING except for the commands flagged with LOADING.
+func (server *RedisServer) startLoading(size int64) {
+	server.loading = true
+	server.loadingStartTime = time.Now()
+	server.loadingTotalBytes = size
+	server.loadingLoadedBytes = 0
+	server.loadingProcessedBytes = 0
+	server.loadingRdbUsedMem = 0
+}
+
+// loadingAbsProgress records how far into the files the load is, and serves
+// the clients every LOADING_PROCESS_EVENTS_INTERVAL_BYTES
+func (server *RedisServer) loadingAbsProgress(pos int64) {
+	server.loadingLoadedBytes = pos
+	if pos-server.loadingProcessedBytes >= LOADING_PROCESS_EVENTS_INTERVAL_BYTES {
+		server.loadingProcessedBytes = pos
+		server.processEventsWhileBlocked()
+	}
+}
+
+func (server *RedisServer) stopLoading() {
+	server.loading = false
+}
+
+// rdbLoadRio loads an RDB payload from the reader and stops right after its
+// checksum, which is where the commands of an AOF with an RDB preamble start
+func (server *RedisServer) rdbLoadRio(reader *bufio.Reader) error {
+	rdb := &rdbReader{r: reader, offset: server.loadingLoadedBytes}
+
+	header, err := rdb.readFull(9)
+	if err != nil {
+		return err
+	}
+	if string(header[:5]) != "REDIS" {
+		return errRdbBadFormat
+	}
+	version, err := strconv.Atoi(string(header[5:]))
+	if err != nil || version < 1 {
+		return fmt.Errorf("can't handle RDB format version %s", header[5:])
+	}
+
+	now := time.Now()
+	var expireAt time.Time
+	lruIdle, lfuFreq := int64(-1), -1
+
+	for {
+		rdbtype, err := rdb.readByte()
+		if err != nil {
+			return err
+		}
+
+		switch rdbtype {
+		case RDB_OPCODE_EXPIRETIME:
+			buf, err := rdb.readFull(4)
+			if err != nil {
+				return err
+			}
+			expireAt = time.Unix(int64(binary.LittleEndian.Uint32(buf)), 0)
+			continue
+		case RDB_OPCODE_EXPIRETIME_MS:
+			buf, err := rdb.readFull(8)
+			if err != nil {
+				return err
+			}
+			expireAt = time.UnixMilli(int64(binary.LittleEndian.Uint64(buf)))
+			continue
+		case RDB_OPCODE_IDLE:
+			idle, _, err := rdb.loadLen()
+			if err != nil {
+				return err
+			}
+			lruIdle = int64(idle)
+			continue
+		case RDB_OPCODE_FREQ:
+			freq, err := rdb.readByte()
+			if err != nil {
+				return err
+			}
+			lfuFreq = int(freq)
+			continue
+		case RDB_OPCODE_SELECTDB:
+			dbid, _, err := rdb.loadLen()
+			if err != nil {
+				return err
+			}
+			if dbid != 0 {
+				return fmt.Errorf("database %d is out of range, only db 0 is supported", dbid)
+			}
+			continue
+		case RDB_OPCODE_RESIZEDB:
+			// the sizes are only a hint, the keyspace shards grow as needed
+			if _, _, err := rdb.loadLen(); err != nil {
+				return err
+			}
+			if _, _, err := rdb.loadLen(); err != nil {
+				return err
+			}
+			continue
+		case RDB_OPCODE_AUX:
+			key, err := rdb.loadString()
+			if err != nil {
+				return err
+			}
+			value, err := rdb.loadString()
+			if err != nil {
+				return err
+			}
+			server.rdbLoadAuxField(key, value)
+			continue
+		case RDB_OPCODE_FUNCTION2:
+			code, err := rdb.loadString()
+			if err != nil {
+				return err
+			}
+			// the libraries of the file replace the ones of the same name
+			if _, err := server.functionsCreateWithLibraryCtx(code, true); err != nil {
+				return fmt.Errorf("failed loading library: %w", err)
+			}
+			continue
+		case RDB_OPCODE_FUNCTION_PRE_GA:
+			return errors.New("Pre-release function format not supported")
+		case RDB_OPCODE_MODULE_AUX:
+			return errors.New("the RDB file contains module AUX data, but modules are not supported")
+		case RDB_OPCODE_EOF:
+			return rdb.verifyChecksum(version, server.Config.RdbChecksum)
+		}
+
+		key, err := rdb.loadString()
+		if err != nil {
+			return err
+		}
+		obj, err := rdb.loadObject(rdbtype)
+		if err != nil {
+			return err
+		}
+		if server.Config.KeyLoadDelay > 0 {
+			time.Sleep(time.Duration(server.Config.KeyLoadDelay) * time.Microsecond)
+		}
+
+		// keys that expired while the server was down are not loaded
+		if !expireAt.IsZero() && expireAt.Before(now) {
+			expireAt = time.Time{}
+			lruIdle, lfuFreq = -1, -1
+			continue
+		}
+
+		server.setKey(key, obj)
+		if !expireAt.IsZero() {
+			server.setExpire(key, expireAt)
+		}
+		server.objectSetLRUOrLFU(obj, lruIdle, lfuFreq)
+
+		expireAt = time.Time{}
+		lruIdle, lfuFreq = -1, -1
+
+		server.loadingAbsProgress(rdb.offset)
+	}
+}
+
+// verifyChecksum compares the CRC64 trailer, available since RDB version 5,
+// with the checksum of what was read. A zero trailer means it was disabled.
+func (rdb *rdbReader) verifyChecksum(version int, enabled bool) error {
+	if version < 5 {
+		return nil
+	}
+
+	expected := rdb.crc
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(rdb.r, buf); err != nil {
+		return err
+	}
+	stored := binary.LittleEndian.Uint64(buf)
+
+	if enabled && stored != 0 && stored != expected {
+		return errors.New("wrong RDB checksum")
+	}
+	return nil
+}
+
+func (server *RedisServer) rdbLoadAuxField(key, value string) {
+	switch key {
+	case "redis-ver":
+		fmt.Printf("Loading RDB produced by version %s\n", value)
+	case "ctime":
+		if ctime, err := strconv.ParseInt(value, 10, 64); err == nil {
+			age := time.Now().Unix() - ctime
+			if age < 0 {
+				age = 0
+			}
+			fmt.Printf("RDB age %d seconds\n", age)
+		}
+	case "used-mem":
+		if usedMem, err := strconv.ParseInt(value, 10, 64); err == nil {
+			fmt.Printf("RDB memory usage when created %.2f Mb\n", float64(usedMem)/(1024*1024))
+			server.loadingRdbUsedMem = usedMem
+		}
+	}
+}
+
+// objectSetLRUOrLFU applies the IDLE/FREQ information stored in the RDB
+func (server *RedisServer) objectSetLRUOrLFU(obj *RedisObject, lruIdle int64, lfuFreq int) {
+	lfu := server.Config.MaxmemoryPolicy&MAXMEMORY_FLAG_LFU != 0
+	if lfu && lfuFreq >= 0 {
+		obj.LRU = LFUGetTimeInMinutes()<<8 | uint32(lfuFreq)
+	} else if !lfu && lruIdle >= 0 {
+		clock := int64(server.LRUClock) - lruIdle*1000/LRU_CLOCK_RESOLUTION
+		if clock < 0 {
+			clock += LRU_CLOCK_MAX
+		}
+		obj.LRU = uint32(clock)
+	}
+}
+
+const RDB_VERSION = 11
+
+// Where the RDB of a BGSAVE in progress goes
+const (
+	RDB_CHILD_TYPE_NONE   = iota
+	RDB_CHILD_TYPE_DISK   // the dump file
+	RDB_CHILD_TYPE_SOCKET // the sockets of replicas, for a diskless sync
+)
+
+type rdbWriter struct {
+	w           *bufio.Writer
+	crc         uint64
+	compression bool
+}
+
+func (rdb *rdbWriter) write(p []byte) error {
+	rdb.crc = crc64Update(rdb.crc, p)
+	_, err := rdb.w.Write(p)
+	return err
+}
+
+func (rdb *rdbWriter) writeByte(b byte) error {
+	return rdb.write([]byte{b})
+}
+
+func (rdb *rdbWriter) saveLen(length uint64) error {
+	var buf []byte
+	switch {
+	case length < 1<<6:
+		buf = []byte{byte(length) | RDB_6BITLEN<<6}
+	case length < 1<<14:
+		buf = []byte{byte(length>>8) | RDB_14BITLEN<<6, byte(length)}
+	case length <= 0xFFFFFFFF:
+		buf = make([]byte, 5)
+		buf[0] = RDB_32BITLEN
+		binary.BigEndian.PutUint32(buf[1:], uint32(length))
+	default:
+		buf = make([]byte, 9)
+		buf[0] = RDB_64BITLEN
+		binary.BigEndian.PutUint64(buf[1:], length)
+	}
+	return rdb.write(buf)
+}
+
+// trySaveIntegerString writes numeric strings in the compact integer encodings
+func (rdb *rdbWriter) trySaveIntegerString(value string) (bool, error) {
+	if len(value) == 0 || len(value) > 11 {
+		return false, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 32)
+	if err != nil || strconv.FormatInt(n, 10) != value {
+		return false, nil
+	}
+
+	var buf []byte
+	switch {
+	case n >= -(1<<7) && n <= 1<<7-1:
+		buf = []byte{RDB_ENCVAL<<6 | RDB_ENC_INT8, byte(int8(n))}
+	case n >= -(1<<15) && n <= 1<<15-1:
+		buf = []byte{RDB_ENCVAL<<6 | RDB_ENC_INT16, 0, 0}
+		binary.LittleEndian.PutUint16(buf[1:], uint16(int16(n)))
+	default:
+		buf = []byte{RDB_ENCVAL<<6 | RDB_ENC_INT32, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint32(buf[1:], uint32(int32(n)))
+	}
+	return true, rdb.write(buf)
+}
+
+// trySaveLzfString stores the string LZF compressed when that saves space
+func (rdb *rdbWriter) trySaveLzfString(value string) (bool, error) {
+	compressed := lzfCompress([]byte(value))
+	if compressed == nil {
+		return false, nil
+	}
+
+	if err := rdb.writeByte(RDB_ENCVAL<<6 | RDB_ENC_LZF); err != nil {
+		return true, err
+	}
+	if err := rdb.saveLen(uint64(len(compressed))); err != nil {
+		return true, err
+	}
+	if err := rdb.saveLen(uint64(len(value))); err != nil {
+		return true, err
+	}
+	return true, rdb.write(compressed)
+}
+
+func (rdb *rdbWriter) saveString(value string) error {
+	if ok, err := rdb.trySaveIntegerString(value); ok || err != nil {
+		return err
+	}
+
+	// strings shorter than this don't compress enough to be worth it
+	if rdb.compression && len(value) > 20 {
+		if ok, err := rdb.trySaveLzfString(value); ok || err != nil {
+			return err
+		}
+	}
+
+	if err := rdb.saveLen(uint64(len(value))); err != nil {
+		return err
+	}
+	return rdb.write([]byte(value))
+}
+
+func (rdb *rdbWriter) saveAuxField(key, value string) error {
+	if err := rdb.writeByte(RDB_OPCODE_AUX); err != nil {
+		return err
+	}
+	if err := rdb.saveString(key); err != nil {
+		return err
+	}
+	return rdb.saveString(value)
+}
+
+func (rdb *rdbWriter) saveKeyValuePair(snapshot *rdbSnapshot, key string, obj *RedisObject) error {
+	if expireAt, ok := snapshot.expirations.Get(key); ok {
+		buf := make([]byte, 9)
+		buf[0] = RDB_OPCODE_EXPIRETIME_MS
+		binary.LittleEndian.PutUint64(buf[1:], uint64(expireAt.UnixMilli()))
+		if err := rdb.write(buf); err != nil {
+			return err
+		}
+	}
+
+	// eviction metadata, so a restarted server keeps its LRU/LFU ordering
+	lru := atomic.LoadUint32(&obj.LRU)
+	if snapshot.policy&MAXMEMORY_FLAG_LRU != 0 {
+		idle := uint64(0)
+		if snapshot.lruClock >= lru {
+			idle = uint64(snapshot.lruClock-lru) * LRU_CLOCK_RESOLUTION / 1000
+		}
+		if err := rdb.writeByte(RDB_OPCODE_IDLE); err != nil {
+			return err
+		}
+		if err := rdb.saveLen(idle); err != nil {
+			return err
+		}
+	} else if snapshot.policy&MAXMEMORY_FLAG_LFU != 0 {
+		if err := rdb.write([]byte{RDB_OPCODE_FREQ, byte(lru & 255)}); err != nil {
+			return err
+		}
+	}
+
+	// the value type byte comes before the key
+	if err := rdb.saveObjectType(obj); err != nil {
+		return err
+	}
+	if err := rdb.saveString(key); err != nil {
+		return err
+	}
+	return rdb.saveObject(obj)
+}
+
+// rdbSnapshot is the point-in-time view of the keyspace that gets serialized,
+// together with the server state the dump records
+type rdbSnapshot struct {
+	storage     *dictSnapshot[*RedisObject]
+	expirations *dictSnapshot[time.Time]
+
+	compression  bool
+	checksum     bool
+	aofBase      bool // RDB preamble of an AOF
+	policy       int
+	lruClock     uint32
+	usedMemory   int64
+	keySaveDelay time.Duration
+
+	// the code of the libraries of functions
+	functions []string
+}
+
+// newRdbSnapshot freezes the keyspace, writes can continue right away. The
+// snapshot must be released on the executor once it has been written.
+func (server *RedisServer) newRdbSnapshot() rdbSnapshot {
+	return rdbSnapshot{
+		storage:      server.Storage.Snapshot(),
+		expirations:  server.Expirations.Snapshot(),
+		compression:  server.Config.RdbCompression,
+		checksum:     server.Config.RdbChecksum,
+		policy:       server.Config.MaxmemoryPolicy,
+		lruClock:     server.LRUClock,
+		usedMemory:   server.getUsedMemory(),
+		keySaveDelay: time.Duration(server.Config.RdbKeySaveDelay) * time.Microsecond,
+		functions:    server.functionsLibraryCodes(),
+	}
+}
+
+func (snapshot *rdbSnapshot) release() {
+	snapshot.storage.Release()
+	snapshot.expirations.Release()
+}
+
+// rdbTempFilename is where the dump is written before it is renamed
+func rdbTempFilename(filename string) string {
+	return filepath.Join(filepath.Dir(filename), fmt.Sprintf("temp-%d.rdb", os.Getpid()))
+}
+
+// rdbSaveSnapshot writes the snapshot to a temp file and renames it into place
+// so that a crash in the middle of a save never leaves a truncated dump.
+func rdbSaveSnapshot(filename string, snapshot rdbSnapshot) error {
+	tmpfile := rdbTempFilename(filename)
+	file, err := os.Create(tmpfile)
+	if err != nil {
+		return fmt.Errorf("failed opening the temp RDB file %s for saving: %w", tmpfile, err)
+	}
+
+	rdb := &rdbWriter{w: bufio.NewWriter(file), compression: snapshot.compression}
+	err = rdb.saveSnapshot(&snapshot)
+	if err == nil {
+		err = rdb.w.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpfile)
+		return fmt.Errorf("write error saving DB on disk: %w", err)
+	}
+
+	if err := os.Rename(tmpfile, filename); err != nil {
+		os.Remove(tmpfile)
+		return fmt.Errorf("error moving temp DB file on the final destination: %w", err)
+	}
+	return nil
+}
+
+func (rdb *rdbWriter) saveSnapshot(snapshot *rdbSnapshot) error {
+	if err := rdb.write([]byte(fmt.Sprintf("REDIS%04d", RDB_VERSION))); err != nil {
+		return err
+	}
+
+	aux := [][2]string{
+		{"redis-ver", REDIS_VERSION},
+		{"redis-bits", "64"},
+		{"ctime", strconv.FormatInt(time.Now().Unix(), 10)},
+		{"used-mem", strconv.FormatInt(snapshot.usedMemory, 10)},
+		{"aof-base", strconv.Itoa(boolToInt(snapshot.aofBase))},
+	}
+	for _, field := range aux {
+		if err := rdb.saveAuxField(field[0], field[1]); err != nil {
+			return err
+		}
+	}
+
+	for _, code := range snapshot.functions {
+		if err := rdb.writeByte(RDB_OPCODE_FUNCTION2); err != nil {
+			return err
+		}
+		if err := rdb.saveString(code); err != nil {
+			return err
+		}
+	}
+
+	if snapshot.storage.Len() > 0 {
+		if err := rdb.writeByte(RDB_OPCODE_SELECTDB); err != nil {
+			return err
+		}
+		if err := rdb.saveLen(0); err != nil {
+			return err
+		}
+		if err := rdb.writeByte(RDB_OPCODE_RESIZEDB); err != nil {
+			return err
+		}
+		if err := rdb.saveLen(uint64(snapshot.storage.Len())); err != nil {
+			return err
+		}
+		if err := rdb.saveLen(uint64(snapshot.expirations.Len())); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	snapshot.storage.Range(func(key string, obj *RedisObject) bool {
+		err = rdb.saveKeyValuePair(snapshot, key, obj)
+		if snapshot.keySaveDelay > 0 {
+			time.Sleep(snapshot.keySaveDelay)
+		}
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := rdb.writeByte(RDB_OPCODE_EOF); err != nil {
+		return err
+	}
+
+	// a zero checksum tells loaders that checksumming is disabled
+	checksum := make([]byte, 8)
+	if snapshot.checksum {
+		binary.LittleEndian.PutUint64(checksum, rdb.crc)
+	}
+	_, err = rdb.w.Write(checksum)
+	return err
+}
+
+func (server *RedisServer) rdbSave() error {
+	if server.rdbBgsaveInProgress {
+		return errors.New("background save already in progress")
+	}
+
+	snapshot := server.newRdbSnapshot()
+	err := rdbSaveSnapshot(server.rdbFilename(), snapshot)
+	snapshot.release()
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+
+	fmt.Println("DB saved on disk")
+	server.Dirty = 0
+	server.LastSave = time.Now()
+	server.RdbLastBgsaveErr = nil
+	return nil
+}
+
+// rdbSaveBackground freezes the keyspace and writes the snapshot on a
+// background goroutine, while the executor keeps serving writes.
+func (server *RedisServer) rdbSaveBackground() error {
+	if server.rdbBgsaveInProgress {
+		return errors.New("background save already in progress")
+	}
+
+	// taking the snapshot is what blocks the executor, the fork of Redis
+	start := time.Now()
+	snapshot := server.newRdbSnapshot()
+	server.latencyAddSampleIfNeeded("fork", time.Since(start))
+
+	server.rdbBgsaveInProgress = true
+	server.rdbChildType = RDB_CHILD_TYPE_DISK
+	server.dirtyBeforeBgsave = server.Dirty
+	server.LastBgsaveTry = time.Now()
+	server.RdbSaveTimeStart = time.Now()
+	filename := server.rdbFilename()
+	fmt.Println("Background saving started")
+
+	go func() {
+		err := rdbSaveSnapshot(filename, snapshot)
+		server.runOnExecutor(func() {
+			snapshot.release()
+			server.backgroundSaveDoneHandler(err)
+		})
+	}()
+
+	return nil
+}
+
+func (server *RedisServer) backgroundSaveDoneHandler(err error) {
+	childType := server.rdbChildType
+	server.rdbBgsaveInProgress = false
+	server.rdbChildType = RDB_CHILD_TYPE_NONE
+	server.RdbSaveTimeLast = time.Since(server.RdbSaveTimeStart)
+
+	switch {
+	case childType == RDB_CHILD_TYPE_SOCKET && err != nil:
+		fmt.Println("Background transfer error:", err)
+	case childType == RDB_CHILD_TYPE_SOCKET:
+		// nothing was saved, the dump file is as old as it was
+		fmt.Println("Background RDB transfer terminated with success")
+	case err != nil:
+		server.RdbLastBgsaveErr = err
+		fmt.Println("Background saving error:", err)
+	default:
+		server.RdbLastBgsaveErr = nil
+		fmt.Println("Background saving terminated with success")
+		// changes made while the child was saving still need to be saved
+		server.Dirty -= server.dirtyBeforeBgsave
+		server.LastSave = server.RdbSaveTimeStart
+	}
+
+	server.updateSlavesWaitingBgsave(err, childType)
+}
+
+func (server *RedisServer) handleSaveCommand(cmd string, args []interface{}) []byte {
+	if len(args) != 0 {
+		return addReplyErrorArity()
+	}
+
+	if server.rdbBgsaveInProgress {
+		return []byte("-ERR Background save already in progress\r\n")
+	}
+
+	if err := server.rdbSave(); err != nil {
+		return []byte("-ERR\r\n")
+	}
+	return []byte("+OK\r\n")
+}
+
+// handleLastsaveCommand replies with the unix time of the last successful save
+func (server *RedisServer) handleLastsaveCommand(cmd string, args []interface{}) []byte {
+	return addReplyLongLong(server.LastSave.Unix())
+}
+
+func (server *RedisServer) handleBgsaveCommand(cmd string, args []interface{}) []byte {
+	if len(args) > 1 {
+		return addReplyErrorArity()
+	}
+
+	schedule := false
+	if len(args) == 1 {
+		option, _ := args[0].(string)
+		if strings.ToUpper(option) != "SCHEDULE" {
+			return []byte("-ERR syntax error\r\n")
+		}
+		schedule = true
+	}
+
+	if server.rdbBgsaveInProgress {
+		if schedule {
+			server.rdbBgsaveScheduled = true
+			return []byte("+Background saving scheduled\r\n")
+		}
+		return []byte("-ERR Background save already in progress\r\n")
+	}
+
+	if err := server.rdbSaveBackground(); err != nil {
+		return []byte(fmt.Sprintf("-ERR %s\r\n", err))
+	}
+	return []byte("+Background saving started\r\n")
+}
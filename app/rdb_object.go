@@ -0,0 +1,825 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+const (
+	RDB_TYPE_STRING             = 0
+	RDB_TYPE_LIST               = 1
+	RDB_TYPE_SET                = 2
+	RDB_TYPE_ZSET               = 3
+	RDB_TYPE_HASH               = 4
+	RDB_TYPE_ZSET_2             = 5
+	RDB_TYPE_MODULE_PRE_GA      = 6
+	RDB_TYPE_MODULE_2           = 7
+	RDB_TYPE_HASH_ZIPMAP        = 9
+	RDB_TYPE_LIST_ZIPLIST       = 10
+	RDB_TYPE_SET_INTSET         = 11
+	RDB_TYPE_ZSET_ZIPLIST       = 12
+	RDB_TYPE_HASH_ZIPLIST       = 13
+	RDB_TYPE_LIST_QUICKLIST     = 14
+	RDB_TYPE_STREAM_LISTPACKS   = 15
+	RDB_TYPE_HASH_LISTPACK      = 16
+	RDB_TYPE_ZSET_LISTPACK      = 17
+	RDB_TYPE_LIST_QUICKLIST_2   = 18
+	RDB_TYPE_STREAM_LISTPACKS_2 = 19
+	RDB_TYPE_SET_LISTPACK       = 20
+	RDB_TYPE_STREAM_LISTPACKS_3 = 21
+)
+
+const (
+	QUICKLIST_NODE_CONTAINER_PLAIN  = 1
+	QUICKLIST_NODE_CONTAINER_PACKED = 2
+)
+
+const (
+	STREAM_ITEM_FLAG_DELETED    = 1 << 0
+	STREAM_ITEM_FLAG_SAMEFIELDS = 1 << 1
+
+	// entries per listpack node when saving streams
+	STREAM_NODE_MAX_ENTRIES = 100
+)
+
+func (rdb *rdbReader) loadMillisecondTime() (int64, error) {
+	buf, err := rdb.readFull(8)
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(buf)), nil
+}
+
+// loadDoubleValue reads the string encoded score of RDB_TYPE_ZSET
+func (rdb *rdbReader) loadDoubleValue() (float64, error) {
+	length, err := rdb.readByte()
+	if err != nil {
+		return 0, err
+	}
+	switch length {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	buf, err := rdb.readFull(int(length))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(string(buf), 64)
+}
+
+func (rdb *rdbReader) loadBinaryDoubleValue() (float64, error) {
+	buf, err := rdb.readFull(8)
+	if err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(buf)), nil
+}
+
+func (rdb *rdbReader) loadStreamID() (StreamID, error) {
+	ms, _, err := rdb.loadLen()
+	if err != nil {
+		return StreamID{}, err
+	}
+	seq, _, err := rdb.loadLen()
+	if err != nil {
+		return StreamID{}, err
+	}
+	return StreamID{ms, seq}, nil
+}
+
+// decodeRawStreamID decodes the 128 bit big endian IDs used for node keys and PELs
+func decodeRawStreamID(raw []byte) (StreamID, error) {
+	if len(raw) != 16 {
+		return StreamID{}, errCorruptEncoding
+	}
+	return StreamID{binary.BigEndian.Uint64(raw[:8]), binary.BigEndian.Uint64(raw[8:])}, nil
+}
+
+func encodeRawStreamID(id StreamID) []byte {
+	raw := make([]byte, 16)
+	binary.BigEndian.PutUint64(raw[:8], id.Ms)
+	binary.BigEndian.PutUint64(raw[8:], id.Seq)
+	return raw
+}
+
+// loadStringList reads length-prefixed strings, count times
+func (rdb *rdbReader) loadStringList(count uint64) ([]string, error) {
+	elements := make([]string, 0, count)
+	for i := uint64(0); i < count; i++ {
+		element, err := rdb.loadString()
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, element)
+	}
+	return elements, nil
+}
+
+// loadEncodedBlob reads a string holding a compact encoding and decodes it
+func (rdb *rdbReader) loadEncodedBlob(decode func([]byte) ([]string, error)) ([]string, error) {
+	blob, err := rdb.loadString()
+	if err != nil {
+		return nil, err
+	}
+	return decode([]byte(blob))
+}
+
+func pairsToHash(elements []string) (map[string]string, error) {
+	if len(elements)%2 != 0 {
+		return nil, errCorruptEncoding
+	}
+	hash := make(map[string]string, len(elements)/2)
+	for i := 0; i < len(elements); i += 2 {
+		hash[elements[i]] = elements[i+1]
+	}
+	return hash, nil
+}
+
+func pairsToZset(elements []string) (map[string]float64, error) {
+	if len(elements)%2 != 0 {
+		return nil, errCorruptEncoding
+	}
+	zset := make(map[string]float64, len(elements)/2)
+	for i := 0; i < len(elements); i += 2 {
+		score, err := strconv.ParseFloat(elements[i+1], 64)
+		if err != nil {
+			return nil, errCorruptEncoding
+		}
+		zset[elements[i]] = score
+	}
+	return zset, nil
+}
+
+func membersToSet(members []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(members))
+	for _, member := range members {
+		set[member] = struct{}{}
+	}
+	return set
+}
+
+func (rdb *rdbReader) loadObject(rdbtype byte) (*RedisObject, error) {
+	switch rdbtype {
+	case RDB_TYPE_STRING:
+		value, err := rdb.loadString()
+		if err != nil {
+			return nil, err
+		}
+		return createStringObject(value), nil
+
+	case RDB_TYPE_LIST, RDB_TYPE_SET:
+		count, _, err := rdb.loadLen()
+		if err != nil {
+			return nil, err
+		}
+		elements, err := rdb.loadStringList(count)
+		if err != nil {
+			return nil, err
+		}
+		if rdbtype == RDB_TYPE_LIST {
+			return createListObject(elements), nil
+		}
+		return createSetObject(membersToSet(elements)), nil
+
+	case RDB_TYPE_ZSET, RDB_TYPE_ZSET_2:
+		count, _, err := rdb.loadLen()
+		if err != nil {
+			return nil, err
+		}
+		zset := make(map[string]float64, count)
+		for i := uint64(0); i < count; i++ {
+			member, err := rdb.loadString()
+			if err != nil {
+				return nil, err
+			}
+			var score float64
+			if rdbtype == RDB_TYPE_ZSET_2 {
+				score, err = rdb.loadBinaryDoubleValue()
+			} else {
+				score, err = rdb.loadDoubleValue()
+			}
+			if err != nil {
+				return nil, err
+			}
+			zset[member] = score
+		}
+		return createZsetObject(zset), nil
+
+	case RDB_TYPE_HASH:
+		count, _, err := rdb.loadLen()
+		if err != nil {
+			return nil, err
+		}
+		elements, err := rdb.loadStringList(count * 2)
+		if err != nil {
+			return nil, err
+		}
+		hash, err := pairsToHash(elements)
+		if err != nil {
+			return nil, err
+		}
+		return createHashObject(hash), nil
+
+	case RDB_TYPE_LIST_ZIPLIST:
+		elements, err := rdb.loadEncodedBlob(ziplistDecode)
+		if err != nil {
+			return nil, err
+		}
+		return createListObject(elements), nil
+
+	case RDB_TYPE_LIST_QUICKLIST, RDB_TYPE_LIST_QUICKLIST_2:
+		nodes, _, err := rdb.loadLen()
+		if err != nil {
+			return nil, err
+		}
+		elements := []string{}
+		for i := uint64(0); i < nodes; i++ {
+			container := uint64(QUICKLIST_NODE_CONTAINER_PACKED)
+			if rdbtype == RDB_TYPE_LIST_QUICKLIST_2 {
+				if container, _, err = rdb.loadLen(); err != nil {
+					return nil, err
+				}
+			}
+			blob, err := rdb.loadString()
+			if err != nil {
+				return nil, err
+			}
+			if container == QUICKLIST_NODE_CONTAINER_PLAIN {
+				elements = append(elements, blob)
+				continue
+			}
+
+			decode := lpDecode
+			if rdbtype == RDB_TYPE_LIST_QUICKLIST {
+				decode = ziplistDecode
+			}
+			nodeElements, err := decode([]byte(blob))
+			if err != nil {
+				return nil, err
+			}
+			elements = append(elements, nodeElements...)
+		}
+		return createListObject(elements), nil
+
+	case RDB_TYPE_SET_INTSET, RDB_TYPE_SET_LISTPACK:
+		decode := intsetDecode
+		if rdbtype == RDB_TYPE_SET_LISTPACK {
+			decode = lpDecode
+		}
+		members, err := rdb.loadEncodedBlob(decode)
+		if err != nil {
+			return nil, err
+		}
+		return createSetObject(membersToSet(members)), nil
+
+	case RDB_TYPE_ZSET_ZIPLIST, RDB_TYPE_ZSET_LISTPACK:
+		decode := ziplistDecode
+		if rdbtype == RDB_TYPE_ZSET_LISTPACK {
+			decode = lpDecode
+		}
+		elements, err := rdb.loadEncodedBlob(decode)
+		if err != nil {
+			return nil, err
+		}
+		zset, err := pairsToZset(elements)
+		if err != nil {
+			return nil, err
+		}
+		return createZsetObject(zset), nil
+
+	case RDB_TYPE_HASH_ZIPMAP, RDB_TYPE_HASH_ZIPLIST, RDB_TYPE_HASH_LISTPACK:
+		decode := zipmapDecode
+		if rdbtype == RDB_TYPE_HASH_ZIPLIST {
+			decode = ziplistDecode
+		} else if rdbtype == RDB_TYPE_HASH_LISTPACK {
+			decode = lpDecode
+		}
+		elements, err := rdb.loadEncodedBlob(decode)
+		if err != nil {
+			return nil, err
+		}
+		hash, err := pairsToHash(elements)
+		if err != nil {
+			return nil, err
+		}
+		return createHashObject(hash), nil
+
+	case RDB_TYPE_STREAM_LISTPACKS, RDB_TYPE_STREAM_LISTPACKS_2, RDB_TYPE_STREAM_LISTPACKS_3:
+		stream, err := rdb.loadStream(rdbtype)
+		if err != nil {
+			return nil, err
+		}
+		return createStreamObject(stream), nil
+
+	case RDB_TYPE_MODULE_PRE_GA, RDB_TYPE_MODULE_2:
+		return nil, errors.New("the RDB file contains module data, but modules are not supported")
+
+	default:
+		return nil, fmt.Errorf("unknown RDB value type %d", rdbtype)
+	}
+}
+
+// lpStreamInt reads an integer element of a stream listpack node
+func lpStreamInt(elements []string, i *int) (int64, error) {
+	if *i >= len(elements) {
+		return 0, errCorruptEncoding
+	}
+	v, err := strconv.ParseInt(elements[*i], 10, 64)
+	*i++
+	if err != nil {
+		return 0, errCorruptEncoding
+	}
+	return v, nil
+}
+
+// decodeStreamNode expands a listpack node: a master entry with the fields
+// shared by the node, followed by entries stored as deltas from the master ID
+func decodeStreamNode(master StreamID, elements []string) ([]StreamEntry, error) {
+	i := 0
+	if _, err := lpStreamInt(elements, &i); err != nil { // valid entries
+		return nil, err
+	}
+	if _, err := lpStreamInt(elements, &i); err != nil { // deleted entries
+		return nil, err
+	}
+	masterFieldsCount, err := lpStreamInt(elements, &i)
+	if err != nil {
+		return nil, err
+	}
+	if i+int(masterFieldsCount) > len(elements) {
+		return nil, errCorruptEncoding
+	}
+	masterFields := elements[i : i+int(masterFieldsCount)]
+	i += int(masterFieldsCount)
+	i++ // master entry terminator
+
+	entries := []StreamEntry{}
+	for i < len(elements) {
+		flags, err := lpStreamInt(elements, &i)
+		if err != nil {
+			return nil, err
+		}
+		msDiff, err := lpStreamInt(elements, &i)
+		if err != nil {
+			return nil, err
+		}
+		seqDiff, err := lpStreamInt(elements, &i)
+		if err != nil {
+			return nil, err
+		}
+
+		var fields []string
+		if flags&STREAM_ITEM_FLAG_SAMEFIELDS != 0 {
+			if i+len(masterFields) > len(elements) {
+				return nil, errCorruptEncoding
+			}
+			for j, field := range masterFields {
+				fields = append(fields, field, elements[i+j])
+			}
+			i += len(masterFields)
+		} else {
+			count, err := lpStreamInt(elements, &i)
+			if err != nil {
+				return nil, err
+			}
+			if i+int(count)*2 > len(elements) {
+				return nil, errCorruptEncoding
+			}
+			fields = append(fields, elements[i:i+int(count)*2]...)
+			i += int(count) * 2
+		}
+		i++ // lp-count of the entry
+
+		if flags&STREAM_ITEM_FLAG_DELETED == 0 {
+			id := StreamID{master.Ms + uint64(msDiff), master.Seq + uint64(seqDiff)}
+			entries = append(entries, StreamEntry{ID: id, Fields: fields})
+		}
+	}
+	return entries, nil
+}
+
+func (rdb *rdbReader) loadStream(rdbtype byte) (*Stream, error) {
+	stream := &Stream{}
+
+	nodes, _, err := rdb.loadLen()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < nodes; i++ {
+		nodeKey, err := rdb.loadString()
+		if err != nil {
+			return nil, err
+		}
+		master, err := decodeRawStreamID([]byte(nodeKey))
+		if err != nil {
+			return nil, err
+		}
+		elements, err := rdb.loadEncodedBlob(lpDecode)
+		if err != nil {
+			return nil, err
+		}
+		entries, err := decodeStreamNode(master, elements)
+		if err != nil {
+			return nil, err
+		}
+		stream.Entries = append(stream.Entries, entries...)
+	}
+
+	if _, _, err := rdb.loadLen(); err != nil { // number of entries
+		return nil, err
+	}
+	if stream.LastID, err = rdb.loadStreamID(); err != nil {
+		return nil, err
+	}
+
+	if rdbtype >= RDB_TYPE_STREAM_LISTPACKS_2 {
+		if stream.FirstID, err = rdb.loadStreamID(); err != nil {
+			return nil, err
+		}
+		if stream.MaxDeletedID, err = rdb.loadStreamID(); err != nil {
+			return nil, err
+		}
+		if stream.EntriesAdded, _, err = rdb.loadLen(); err != nil {
+			return nil, err
+		}
+	} else {
+		stream.EntriesAdded = uint64(len(stream.Entries))
+		if len(stream.Entries) > 0 {
+			stream.FirstID = stream.Entries[0].ID
+		}
+	}
+
+	groups, _, err := rdb.loadLen()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < groups; i++ {
+		group, err := rdb.loadStreamConsumerGroup(rdbtype)
+		if err != nil {
+			return nil, err
+		}
+		stream.Groups = append(stream.Groups, group)
+	}
+
+	return stream, nil
+}
+
+func (rdb *rdbReader) loadStreamConsumerGroup(rdbtype byte) (*StreamConsumerGroup, error) {
+	group := &StreamConsumerGroup{EntriesRead: -1}
+
+	var err error
+	if group.Name, err = rdb.loadString(); err != nil {
+		return nil, err
+	}
+	if group.LastID, err = rdb.loadStreamID(); err != nil {
+		return nil, err
+	}
+	if rdbtype >= RDB_TYPE_STREAM_LISTPACKS_2 {
+		entriesRead, _, err := rdb.loadLen()
+		if err != nil {
+			return nil, err
+		}
+		group.EntriesRead = int64(entriesRead)
+	}
+
+	pelSize, _, err := rdb.loadLen()
+	if err != nil {
+		return nil, err
+	}
+	pending := make(map[StreamID]int, pelSize)
+	for j := uint64(0); j < pelSize; j++ {
+		raw, err := rdb.readFull(16)
+		if err != nil {
+			return nil, err
+		}
+		id, _ := decodeRawStreamID(raw)
+		deliveryTime, err := rdb.loadMillisecondTime()
+		if err != nil {
+			return nil, err
+		}
+		deliveryCount, _, err := rdb.loadLen()
+		if err != nil {
+			return nil, err
+		}
+		pending[id] = len(group.PEL)
+		group.PEL = append(group.PEL, StreamPendingEntry{ID: id, DeliveryTime: deliveryTime, DeliveryCount: deliveryCount})
+	}
+
+	consumers, _, err := rdb.loadLen()
+	if err != nil {
+		return nil, err
+	}
+	for j := uint64(0); j < consumers; j++ {
+		consumer := &StreamConsumer{}
+		if consumer.Name, err = rdb.loadString(); err != nil {
+			return nil, err
+		}
+		if consumer.SeenTime, err = rdb.loadMillisecondTime(); err != nil {
+			return nil, err
+		}
+		consumer.ActiveTime = -1
+		if rdbtype >= RDB_TYPE_STREAM_LISTPACKS_3 {
+			if consumer.ActiveTime, err = rdb.loadMillisecondTime(); err != nil {
+				return nil, err
+			}
+		}
+
+		// the consumer PEL only references entries of the group PEL
+		consumerPelSize, _, err := rdb.loadLen()
+		if err != nil {
+			return nil, err
+		}
+		for k := uint64(0); k < consumerPelSize; k++ {
+			raw, err := rdb.readFull(16)
+			if err != nil {
+				return nil, err
+			}
+			id, _ := decodeRawStreamID(raw)
+			idx, ok := pending[id]
+			if !ok {
+				return nil, errors.New("consumer PEL entry not found in the group PEL")
+			}
+			group.PEL[idx].Consumer = consumer.Name
+		}
+		group.Consumers = append(group.Consumers, consumer)
+	}
+
+	return group, nil
+}
+
+func (rdb *rdbWriter) saveObjectType(obj *RedisObject) error {
+	switch obj.Type {
+	case OBJ_STRING:
+		return rdb.writeByte(RDB_TYPE_STRING)
+	case OBJ_LIST:
+		return rdb.writeByte(RDB_TYPE_LIST_QUICKLIST_2)
+	case OBJ_SET:
+		return rdb.writeByte(RDB_TYPE_SET)
+	case OBJ_ZSET:
+		return rdb.writeByte(RDB_TYPE_ZSET_2)
+	case OBJ_HASH:
+		return rdb.writeByte(RDB_TYPE_HASH)
+	case OBJ_STREAM:
+		return rdb.writeByte(RDB_TYPE_STREAM_LISTPACKS_3)
+	default:
+		return fmt.Errorf("unknown object type %d", obj.Type)
+	}
+}
+
+func (rdb *rdbWriter) saveMillisecondTime(ms int64) error {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(ms))
+	return rdb.write(buf)
+}
+
+func (rdb *rdbWriter) saveBinaryDoubleValue(value float64) error {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, math.Float64bits(value))
+	return rdb.write(buf)
+}
+
+func (rdb *rdbWriter) saveStreamID(id StreamID) error {
+	if err := rdb.saveLen(id.Ms); err != nil {
+		return err
+	}
+	return rdb.saveLen(id.Seq)
+}
+
+func (rdb *rdbWriter) saveObject(obj *RedisObject) error {
+	switch value := obj.Value.(type) {
+	case string:
+		return rdb.saveString(value)
+
+	case []string:
+		// quicklist of listpack nodes, and plain ones for the large elements
+		nodes := quicklistNodes(value)
+		if err := rdb.saveLen(uint64(len(nodes))); err != nil {
+			return err
+		}
+		for _, node := range nodes {
+			if node.plain {
+				if err := rdb.saveLen(QUICKLIST_NODE_CONTAINER_PLAIN); err != nil {
+					return err
+				}
+				if err := rdb.saveString(node.elements[0]); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := rdb.saveLen(QUICKLIST_NODE_CONTAINER_PACKED); err != nil {
+				return err
+			}
+			if err := rdb.saveString(string(lpEncode(node.elements))); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case map[string]struct{}:
+		if err := rdb.saveLen(uint64(len(value))); err != nil {
+			return err
+		}
+		for member := range value {
+			if err := rdb.saveString(member); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case map[string]float64:
+		if err := rdb.saveLen(uint64(len(value))); err != nil {
+			return err
+		}
+		for member, score := range value {
+			if err := rdb.saveString(member); err != nil {
+				return err
+			}
+			if err := rdb.saveBinaryDoubleValue(score); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case map[string]string:
+		if err := rdb.saveLen(uint64(len(value))); err != nil {
+			return err
+		}
+		for field, v := range value {
+			if err := rdb.saveString(field); err != nil {
+				return err
+			}
+			if err := rdb.saveString(v); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case *Stream:
+		return rdb.saveStream(value)
+
+	default:
+		return fmt.Errorf("unknown object type %d", obj.Type)
+	}
+}
+
+// encodeStreamNode packs entries into a listpack node, using the fields of
+// the first entry as master fields
+func encodeStreamNode(entries []StreamEntry) []byte {
+	master := entries[0].ID
+	masterFields := []string{}
+	for i := 0; i < len(entries[0].Fields); i += 2 {
+		masterFields = append(masterFields, entries[0].Fields[i])
+	}
+
+	elements := []string{
+		strconv.Itoa(len(entries)),
+		"0",
+		strconv.Itoa(len(masterFields)),
+	}
+	elements = append(elements, masterFields...)
+	elements = append(elements, "0")
+
+	for _, entry := range entries {
+		sameFields := len(entry.Fields) == len(masterFields)*2
+		for i := 0; sameFields && i < len(masterFields); i++ {
+			sameFields = entry.Fields[i*2] == masterFields[i]
+		}
+
+		flags := 0
+		if sameFields {
+			flags |= STREAM_ITEM_FLAG_SAMEFIELDS
+		}
+		elements = append(elements,
+			strconv.Itoa(flags),
+			strconv.FormatUint(entry.ID.Ms-master.Ms, 10),
+			strconv.FormatInt(int64(entry.ID.Seq-master.Seq), 10),
+		)
+
+		var count int
+		if sameFields {
+			for i := 1; i < len(entry.Fields); i += 2 {
+				elements = append(elements, entry.Fields[i])
+			}
+			count = len(masterFields)
+		} else {
+			elements = append(elements, strconv.Itoa(len(entry.Fields)/2))
+			elements = append(elements, entry.Fields...)
+			count = len(entry.Fields) + 1
+		}
+		// number of elements of the entry, so it can be walked backwards
+		elements = append(elements, strconv.Itoa(count+3))
+	}
+
+	return lpEncode(elements)
+}
+
+func (rdb *rdbWriter) saveStream(stream *Stream) error {
+	nodes := (len(stream.Entries) + STREAM_NODE_MAX_ENTRIES - 1) / STREAM_NODE_MAX_ENTRIES
+	if err := rdb.saveLen(uint64(nodes)); err != nil {
+		return err
+	}
+	for start := 0; start < len(stream.Entries); start += STREAM_NODE_MAX_ENTRIES {
+		end := start + STREAM_NODE_MAX_ENTRIES
+		if end > len(stream.Entries) {
+			end = len(stream.Entries)
+		}
+		node := stream.Entries[start:end]
+		if err := rdb.saveString(string(encodeRawStreamID(node[0].ID))); err != nil {
+			return err
+		}
+		if err := rdb.saveString(string(encodeStreamNode(node))); err != nil {
+			return err
+		}
+	}
+
+	if err := rdb.saveLen(uint64(len(stream.Entries))); err != nil {
+		return err
+	}
+	for _, id := range []StreamID{stream.LastID, stream.FirstID, stream.MaxDeletedID} {
+		if err := rdb.saveStreamID(id); err != nil {
+			return err
+		}
+	}
+	if err := rdb.saveLen(stream.EntriesAdded); err != nil {
+		return err
+	}
+
+	if err := rdb.saveLen(uint64(len(stream.Groups))); err != nil {
+		return err
+	}
+	for _, group := range stream.Groups {
+		if err := rdb.saveStreamConsumerGroup(group); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rdb *rdbWriter) saveStreamConsumerGroup(group *StreamConsumerGroup) error {
+	if err := rdb.saveString(group.Name); err != nil {
+		return err
+	}
+	if err := rdb.saveStreamID(group.LastID); err != nil {
+		return err
+	}
+	if err := rdb.saveLen(uint64(group.EntriesRead)); err != nil {
+		return err
+	}
+
+	pel := append([]StreamPendingEntry(nil), group.PEL...)
+	sort.Slice(pel, func(i, j int) bool { return pel[i].ID.Less(pel[j].ID) })
+
+	if err := rdb.saveLen(uint64(len(pel))); err != nil {
+		return err
+	}
+	for _, nack := range pel {
+		if err := rdb.write(encodeRawStreamID(nack.ID)); err != nil {
+			return err
+		}
+		if err := rdb.saveMillisecondTime(nack.DeliveryTime); err != nil {
+			return err
+		}
+		if err := rdb.saveLen(nack.DeliveryCount); err != nil {
+			return err
+		}
+	}
+
+	if err := rdb.saveLen(uint64(len(group.Consumers))); err != nil {
+		return err
+	}
+	for _, consumer := range group.Consumers {
+		if err := rdb.saveString(consumer.Name); err != nil {
+			return err
+		}
+		if err := rdb.saveMillisecondTime(consumer.SeenTime); err != nil {
+			return err
+		}
+		if err := rdb.saveMillisecondTime(consumer.ActiveTime); err != nil {
+			return err
+		}
+
+		owned := []StreamID{}
+		for _, nack := range pel {
+			if nack.Consumer == consumer.Name {
+				owned = append(owned, nack.ID)
+			}
+		}
+		if err := rdb.saveLen(uint64(len(owned))); err != nil {
+			return err
+		}
+		for _, id := range owned {
+			if err := rdb.write(encodeRawStreamID(id)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
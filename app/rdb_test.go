@@ -0,0 +1,870 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCrc64(t *testing.T) {
+	if crc := crc64Update(0, []byte("123456789")); crc != 0xe9c6d914c4b8d9ca {
+		t.Errorf("crc64 of 123456789 is %#x, want 0xe9c6d914c4b8d9ca", crc)
+	}
+
+	// the RDB reader updates the checksum a byte at a time
+	crc := uint64(0)
+	for _, b := range []byte("123456789") {
+		crc = crc64Update(crc, []byte{b})
+	}
+	if crc != 0xe9c6d914c4b8d9ca {
+		t.Errorf("incremental crc64 of 123456789 is %#x, want 0xe9c6d914c4b8d9ca", crc)
+	}
+}
+
+func TestLzf(t *testing.T) {
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	tests := []struct {
+		name         string
+		in           string
+		incompressed bool
+	}{
+		{name: "repeated byte", in: strings.Repeat("a", 1000)},
+		{name: "repeated pattern", in: strings.Repeat("abcdefgh", 500)},
+		{name: "text", in: strings.Repeat("the quick brown fox jumps over the lazy dog, ", 20)},
+		{name: "long match", in: "0123456789" + strings.Repeat("x", 70000) + "0123456789"},
+		{name: "random", in: string(random), incompressed: true},
+		{name: "short", in: "abc", incompressed: true},
+		{name: "empty", in: "", incompressed: true},
+	}
+	for _, tt := range tests {
+		compressed := lzfCompress([]byte(tt.in))
+		if tt.incompressed {
+			if compressed != nil {
+				t.Errorf("%s: compressed to %d bytes from %d, want it stored as is", tt.name, len(compressed), len(tt.in))
+			}
+			continue
+		}
+		if compressed == nil || len(compressed) >= len(tt.in) {
+			t.Errorf("%s: not compressed", tt.name)
+			continue
+		}
+		out, err := lzfDecompress(compressed, len(tt.in))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if string(out) != tt.in {
+			t.Errorf("%s: the round trip changed the data", tt.name)
+		}
+
+		// a wrong length or a truncated input is corrupt
+		if _, err := lzfDecompress(compressed, len(tt.in)-1); err != errLzfCorrupt {
+			t.Errorf("%s: decompressed to a shorter length: %v", tt.name, err)
+		}
+		if _, err := lzfDecompress(compressed[:len(compressed)-1], len(tt.in)); err != errLzfCorrupt {
+			t.Errorf("%s: decompressed a truncated input: %v", tt.name, err)
+		}
+	}
+
+	decompress := []struct {
+		in     []byte
+		outLen int
+		want   string
+		err    error
+	}{
+		// a literal then a back reference of 9 overlapping what it writes
+		{in: []byte{0x00, 'a', 0xE0, 0x00, 0x00}, outLen: 10, want: "aaaaaaaaaa"},
+		{in: []byte{0x02, 'a', 'b', 'c', 0x20, 0x02}, outLen: 6, want: "abcabc"},
+		{in: []byte{0x20, 0x05}, outLen: 3, err: errLzfCorrupt},
+		{in: []byte{0x05, 'a'}, outLen: 6, err: errLzfCorrupt},
+		{in: []byte{0x00, 'a'}, outLen: 2, err: errLzfCorrupt},
+	}
+	for _, tt := range decompress {
+		out, err := lzfDecompress(tt.in, tt.outLen)
+		if err != tt.err || string(out) != tt.want {
+			t.Errorf("lzfDecompress(%v, %d) = %q, %v, want %q, %v", tt.in, tt.outLen, out, err, tt.want, tt.err)
+		}
+	}
+}
+
+// rdbTestObject writes a payload with the writer and loads it back as an
+// object of the type
+func rdbTestObject(rdbtype byte, build func(rdb *rdbWriter)) (*RedisObject, error) {
+	var buf bytes.Buffer
+	w := &rdbWriter{w: bufio.NewWriter(&buf)}
+	build(w)
+	w.w.Flush()
+	r := &rdbReader{r: bufio.NewReader(&buf)}
+	return r.loadObject(rdbtype)
+}
+
+func TestRdbStrings(t *testing.T) {
+	tests := []struct {
+		value       string
+		compression bool
+		encoding    byte // the first byte of the encoded string
+	}{
+		{value: "", encoding: 0},
+		{value: "hello", encoding: 5},
+		{value: "0", encoding: RDB_ENCVAL<<6 | RDB_ENC_INT8},
+		{value: "-128", encoding: RDB_ENCVAL<<6 | RDB_ENC_INT8},
+		{value: "128", encoding: RDB_ENCVAL<<6 | RDB_ENC_INT16},
+		{value: "-32768", encoding: RDB_ENCVAL<<6 | RDB_ENC_INT16},
+		{value: "32768", encoding: RDB_ENCVAL<<6 | RDB_ENC_INT32},
+		{value: "-2147483648", encoding: RDB_ENCVAL<<6 | RDB_ENC_INT32},
+		{value: "2147483648", encoding: 10},
+		{value: "007", encoding: 3},
+		{value: "+1", encoding: 2},
+		{value: strings.Repeat("x", 100), encoding: RDB_14BITLEN<<6 | 0},
+		{value: strings.Repeat("x", 100), compression: true, encoding: RDB_ENCVAL<<6 | RDB_ENC_LZF},
+		{value: strings.Repeat("x", 20), compression: true, encoding: 20},
+		{value: strings.Repeat("x", 70000), compression: true, encoding: RDB_ENCVAL<<6 | RDB_ENC_LZF},
+		{value: strings.Repeat("x", 70000), encoding: RDB_32BITLEN},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		w := &rdbWriter{w: bufio.NewWriter(&buf), compression: tt.compression}
+		if err := w.saveString(tt.value); err != nil {
+			t.Fatal(err)
+		}
+		w.w.Flush()
+		if buf.Bytes()[0] != tt.encoding {
+			t.Errorf("%.10q (compression %v): encoded as %#x, want %#x", tt.value, tt.compression, buf.Bytes()[0], tt.encoding)
+		}
+
+		r := &rdbReader{r: bufio.NewReader(&buf)}
+		value, err := r.loadString()
+		if err != nil || value != tt.value {
+			t.Errorf("%.10q (compression %v): loaded %.10q, %v", tt.value, tt.compression, value, err)
+		}
+		if r.crc != w.crc {
+			t.Errorf("%.10q: the reader checksum %#x differs from the writer one %#x", tt.value, r.crc, w.crc)
+		}
+	}
+}
+
+// ziplistEncode builds a ziplist of the entries, each an encoding byte
+// followed by its data
+func ziplistEncode(entries ...[]byte) []byte {
+	zl := make([]byte, ZIPLIST_HEADER_SIZE)
+	prevlen, tail := 0, ZIPLIST_HEADER_SIZE
+	for _, entry := range entries {
+		tail = len(zl)
+		if prevlen < 254 {
+			zl = append(zl, byte(prevlen))
+			prevlen = 1
+		} else {
+			zl = append(zl, 254, 0, 0, 0, 0)
+			binary.LittleEndian.PutUint32(zl[len(zl)-4:], uint32(prevlen))
+			prevlen = 5
+		}
+		zl = append(zl, entry...)
+		prevlen += len(entry)
+	}
+	zl = append(zl, 0xFF)
+	binary.LittleEndian.PutUint32(zl[0:4], uint32(len(zl)))
+	binary.LittleEndian.PutUint32(zl[4:8], uint32(tail))
+	binary.LittleEndian.PutUint16(zl[8:10], uint16(len(entries)))
+	return zl
+}
+
+// zlString is a ziplist entry of a string, zlInt one of an integer
+func zlString(s string) []byte {
+	if len(s) < 1<<6 {
+		return append([]byte{byte(len(s))}, s...)
+	}
+	return append([]byte{0x40 | byte(len(s)>>8), byte(len(s))}, s...)
+}
+
+func zlInt(encoding byte, data ...byte) []byte {
+	return append([]byte{encoding}, data...)
+}
+
+func le16(v int16) []byte {
+	return binary.LittleEndian.AppendUint16(nil, uint16(v))
+}
+
+func le32(v int32) []byte {
+	return binary.LittleEndian.AppendUint32(nil, uint32(v))
+}
+
+func le64(v int64) []byte {
+	return binary.LittleEndian.AppendUint64(nil, uint64(v))
+}
+
+func intsetEncode(encoding int, values ...int64) []byte {
+	is := append(le32(int32(encoding)), le32(int32(len(values)))...)
+	for _, v := range values {
+		switch encoding {
+		case 2:
+			is = append(is, le16(int16(v))...)
+		case 4:
+			is = append(is, le32(int32(v))...)
+		case 8:
+			is = append(is, le64(v)...)
+		}
+	}
+	return is
+}
+
+// zipmapEncode builds a zipmap of the fields and values, each value followed
+// by free bytes
+func zipmapEncode(free int, pairs ...string) []byte {
+	zm := []byte{byte(len(pairs) / 2)}
+	appendLen := func(n int) {
+		if n < 254 {
+			zm = append(zm, byte(n))
+		} else {
+			zm = append(append(zm, 254), le32(int32(n))...)
+		}
+	}
+	for i := 0; i < len(pairs); i += 2 {
+		appendLen(len(pairs[i]))
+		zm = append(zm, pairs[i]...)
+		appendLen(len(pairs[i+1]))
+		zm = append(zm, byte(free))
+		zm = append(zm, pairs[i+1]...)
+		zm = append(zm, make([]byte, free)...)
+	}
+	return append(zm, 0xFF)
+}
+
+func TestRdbLoadEncodings(t *testing.T) {
+	long := strings.Repeat("y", 300)
+	blob := func(b []byte) func(rdb *rdbWriter) {
+		return func(rdb *rdbWriter) { rdb.saveString(string(b)) }
+	}
+
+	tests := []struct {
+		name    string
+		rdbtype byte
+		build   func(rdb *rdbWriter)
+		want    interface{}
+		err     string
+	}{
+		{
+			name:    "list",
+			rdbtype: RDB_TYPE_LIST,
+			build: func(rdb *rdbWriter) {
+				rdb.saveLen(3)
+				rdb.saveString("a")
+				rdb.saveString("12")
+				rdb.saveString("c")
+			},
+			want: []string{"a", "12", "c"},
+		},
+		{
+			name:    "list ziplist",
+			rdbtype: RDB_TYPE_LIST_ZIPLIST,
+			build: blob(ziplistEncode(
+				zlString("a"),
+				zlString(long),
+				zlString("after a 5 bytes prevlen"),
+				zlInt(0xF1),
+				zlInt(0xFD),
+				zlInt(0xFE, 0x80),
+				zlInt(0xC0, le16(12345)...),
+				zlInt(0xF0, 0x12, 0x34, 0x56),
+				zlInt(0xF0, 0xFF, 0xFF, 0xFF),
+				zlInt(0xD0, le32(-2000000000)...),
+				zlInt(0xE0, le64(1<<40)...),
+			)),
+			want: []string{"a", long, "after a 5 bytes prevlen", "0", "12", "-128", "12345", "5649426", "-1", "-2000000000", "1099511627776"},
+		},
+		{
+			name:    "list ziplist truncated",
+			rdbtype: RDB_TYPE_LIST_ZIPLIST,
+			build:   blob(ziplistEncode(zlString("abc"))[:ZIPLIST_HEADER_SIZE+3]),
+			err:     errCorruptEncoding.Error(),
+		},
+		{
+			name:    "list quicklist of ziplists",
+			rdbtype: RDB_TYPE_LIST_QUICKLIST,
+			build: func(rdb *rdbWriter) {
+				rdb.saveLen(2)
+				rdb.saveString(string(ziplistEncode(zlString("a"), zlInt(0xF3))))
+				rdb.saveString(string(ziplistEncode(zlString("b"))))
+			},
+			want: []string{"a", "2", "b"},
+		},
+		{
+			name:    "list quicklist of listpacks",
+			rdbtype: RDB_TYPE_LIST_QUICKLIST_2,
+			build: func(rdb *rdbWriter) {
+				rdb.saveLen(3)
+				rdb.saveLen(QUICKLIST_NODE_CONTAINER_PACKED)
+				rdb.saveString(string(lpEncode([]string{"a", "-7", long})))
+				rdb.saveLen(QUICKLIST_NODE_CONTAINER_PLAIN)
+				rdb.saveString("plain")
+				rdb.saveLen(QUICKLIST_NODE_CONTAINER_PACKED)
+				rdb.saveString(string(lpEncode([]string{"z"})))
+			},
+			want: []string{"a", "-7", long, "plain", "z"},
+		},
+		{
+			name:    "set",
+			rdbtype: RDB_TYPE_SET,
+			build: func(rdb *rdbWriter) {
+				rdb.saveLen(2)
+				rdb.saveString("a")
+				rdb.saveString("100")
+			},
+			want: map[string]struct{}{"a": {}, "100": {}},
+		},
+		{
+			name:    "set intset 16 bits",
+			rdbtype: RDB_TYPE_SET_INTSET,
+			build:   blob(intsetEncode(2, -32768, 0, 32767)),
+			want:    map[string]struct{}{"-32768": {}, "0": {}, "32767": {}},
+		},
+		{
+			name:    "set intset 32 bits",
+			rdbtype: RDB_TYPE_SET_INTSET,
+			build:   blob(intsetEncode(4, -2147483648, 1, 2147483647)),
+			want:    map[string]struct{}{"-2147483648": {}, "1": {}, "2147483647": {}},
+		},
+		{
+			name:    "set intset 64 bits",
+			rdbtype: RDB_TYPE_SET_INTSET,
+			build:   blob(intsetEncode(8, math.MinInt64, math.MaxInt64)),
+			want:    map[string]struct{}{"-9223372036854775808": {}, "9223372036854775807": {}},
+		},
+		{
+			name:    "set intset bad encoding",
+			rdbtype: RDB_TYPE_SET_INTSET,
+			build:   blob(intsetEncode(3, 1)),
+			err:     errCorruptEncoding.Error(),
+		},
+		{
+			name:    "set listpack",
+			rdbtype: RDB_TYPE_SET_LISTPACK,
+			build:   blob(lpEncode([]string{"a", "1", long})),
+			want:    map[string]struct{}{"a": {}, "1": {}, long: {}},
+		},
+		{
+			name:    "zset",
+			rdbtype: RDB_TYPE_ZSET,
+			build: func(rdb *rdbWriter) {
+				rdb.saveLen(3)
+				rdb.saveString("a")
+				rdb.write(append([]byte{3}, "1.5"...))
+				rdb.saveString("inf")
+				rdb.writeByte(254)
+				rdb.saveString("-inf")
+				rdb.writeByte(255)
+			},
+			want: map[string]float64{"a": 1.5, "inf": math.Inf(1), "-inf": math.Inf(-1)},
+		},
+		{
+			name:    "zset 2",
+			rdbtype: RDB_TYPE_ZSET_2,
+			build: func(rdb *rdbWriter) {
+				rdb.saveLen(2)
+				rdb.saveString("a")
+				rdb.saveBinaryDoubleValue(-0.25)
+				rdb.saveString("b")
+				rdb.saveBinaryDoubleValue(1e300)
+			},
+			want: map[string]float64{"a": -0.25, "b": 1e300},
+		},
+		{
+			name:    "zset ziplist",
+			rdbtype: RDB_TYPE_ZSET_ZIPLIST,
+			build:   blob(ziplistEncode(zlString("a"), zlInt(0xF2), zlString("b"), zlString("2.5"))),
+			want:    map[string]float64{"a": 1, "b": 2.5},
+		},
+		{
+			name:    "zset listpack",
+			rdbtype: RDB_TYPE_ZSET_LISTPACK,
+			build:   blob(lpEncode([]string{"a", "-3", "b", "inf"})),
+			want:    map[string]float64{"a": -3, "b": math.Inf(1)},
+		},
+		{
+			name:    "zset listpack bad score",
+			rdbtype: RDB_TYPE_ZSET_LISTPACK,
+			build:   blob(lpEncode([]string{"a", "x"})),
+			err:     errCorruptEncoding.Error(),
+		},
+		{
+			name:    "hash",
+			rdbtype: RDB_TYPE_HASH,
+			build: func(rdb *rdbWriter) {
+				rdb.saveLen(2)
+				rdb.saveString("f")
+				rdb.saveString("v")
+				rdb.saveString("n")
+				rdb.saveString("1")
+			},
+			want: map[string]string{"f": "v", "n": "1"},
+		},
+		{
+			name:    "hash zipmap",
+			rdbtype: RDB_TYPE_HASH_ZIPMAP,
+			build:   blob(zipmapEncode(2, "f", "v", "long", long)),
+			want:    map[string]string{"f": "v", "long": long},
+		},
+		{
+			name:    "hash ziplist",
+			rdbtype: RDB_TYPE_HASH_ZIPLIST,
+			build:   blob(ziplistEncode(zlString("f"), zlString("v"), zlString("n"), zlInt(0xC0, le16(-300)...))),
+			want:    map[string]string{"f": "v", "n": "-300"},
+		},
+		{
+			name:    "hash ziplist odd",
+			rdbtype: RDB_TYPE_HASH_ZIPLIST,
+			build:   blob(ziplistEncode(zlString("f"))),
+			err:     errCorruptEncoding.Error(),
+		},
+		{
+			name:    "hash listpack",
+			rdbtype: RDB_TYPE_HASH_LISTPACK,
+			build:   blob(lpEncode([]string{"f", "v", "n", "123456789012"})),
+			want:    map[string]string{"f": "v", "n": "123456789012"},
+		},
+		{
+			name:    "module",
+			rdbtype: RDB_TYPE_MODULE_2,
+			build:   func(rdb *rdbWriter) {},
+			err:     "modules are not supported",
+		},
+		{
+			name:    "unknown type",
+			rdbtype: 99,
+			build:   func(rdb *rdbWriter) {},
+			err:     "unknown RDB value type 99",
+		},
+	}
+	for _, tt := range tests {
+		obj, err := rdbTestObject(tt.rdbtype, tt.build)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(obj.Value, tt.want) {
+			t.Errorf("%s: loaded %v, want %v", tt.name, obj.Value, tt.want)
+		}
+	}
+}
+
+// rdbTestFile is an RDB file of the version with the opcodes the build
+// writes, up to the EOF opcode and the checksum
+func rdbTestFile(version int, build func(rdb *rdbWriter)) []byte {
+	var buf bytes.Buffer
+	w := &rdbWriter{w: bufio.NewWriter(&buf)}
+	w.write([]byte("REDIS" + strings.Repeat("0", 4-len(strconv.Itoa(version))) + strconv.Itoa(version)))
+	build(w)
+	w.writeByte(RDB_OPCODE_EOF)
+	if version >= 5 {
+		w.write(le64(int64(w.crc)))
+	}
+	w.w.Flush()
+	return buf.Bytes()
+}
+
+func TestRdbLoadOpcodes(t *testing.T) {
+	future := time.Now().Add(time.Hour).Truncate(time.Second)
+	past := time.Now().Add(-time.Hour)
+
+	tests := []struct {
+		name    string
+		version int
+		build   func(rdb *rdbWriter)
+		check   func(server *RedisServer) string
+		err     string
+	}{
+		{
+			name:    "aux fields and keys",
+			version: 9,
+			build: func(rdb *rdbWriter) {
+				rdb.saveAuxField("redis-ver", "7.0.0")
+				rdb.saveAuxField("ctime", strconv.FormatInt(time.Now().Unix(), 10))
+				rdb.saveAuxField("used-mem", "1048576")
+				rdb.saveAuxField("unknown-field", "ignored")
+				rdb.writeByte(RDB_OPCODE_SELECTDB)
+				rdb.saveLen(0)
+				rdb.writeByte(RDB_OPCODE_RESIZEDB)
+				rdb.saveLen(3)
+				rdb.saveLen(2)
+				rdb.writeByte(RDB_TYPE_STRING)
+				rdb.saveString("a")
+				rdb.saveString("1")
+				rdb.write(append([]byte{RDB_OPCODE_EXPIRETIME}, le32(int32(future.Unix()))...))
+				rdb.writeByte(RDB_TYPE_STRING)
+				rdb.saveString("seconds")
+				rdb.saveString("2")
+				rdb.write(append([]byte{RDB_OPCODE_EXPIRETIME_MS}, le64(past.UnixMilli())...))
+				rdb.writeByte(RDB_TYPE_STRING)
+				rdb.saveString("expired")
+				rdb.saveString("3")
+			},
+			check: func(server *RedisServer) string {
+				if server.loadingRdbUsedMem != 1048576 {
+					return "used-mem not loaded"
+				}
+				if server.Storage.Len() != 2 {
+					return "the keys that expired were loaded"
+				}
+				if _, ok := server.Expirations.Get("a"); ok {
+					return "a got an expire"
+				}
+				if when, ok := server.Expirations.Get("seconds"); !ok || !when.Equal(future) {
+					return "the expire in seconds was not loaded"
+				}
+				return ""
+			},
+		},
+		{
+			name:    "no checksum before version 5",
+			version: 4,
+			build: func(rdb *rdbWriter) {
+				rdb.writeByte(RDB_TYPE_STRING)
+				rdb.saveString("a")
+				rdb.saveString("1")
+			},
+			check: func(server *RedisServer) string {
+				if _, ok := server.Storage.Get("a"); !ok {
+					return "the key was not loaded"
+				}
+				return ""
+			},
+		},
+		{
+			name:    "function",
+			version: 10,
+			build: func(rdb *rdbWriter) {
+				rdb.writeByte(RDB_OPCODE_FUNCTION2)
+				rdb.saveString("#!lua name=lib\nredis.register_function('f', function() return 1 end)")
+			},
+			check: func(server *RedisServer) string {
+				if len(server.functionsLibraryCodes()) != 1 {
+					return "the library was not loaded"
+				}
+				return ""
+			},
+		},
+		{
+			name:    "bad function",
+			version: 10,
+			build: func(rdb *rdbWriter) {
+				rdb.writeByte(RDB_OPCODE_FUNCTION2)
+				rdb.saveString("#!lua name=lib\nerror('oops')")
+			},
+			err: "failed loading library",
+		},
+		{
+			name:    "pre-GA function",
+			version: 10,
+			build: func(rdb *rdbWriter) {
+				rdb.writeByte(RDB_OPCODE_FUNCTION_PRE_GA)
+			},
+			err: "Pre-release function format not supported",
+		},
+		{
+			name:    "other db",
+			version: 9,
+			build: func(rdb *rdbWriter) {
+				rdb.writeByte(RDB_OPCODE_SELECTDB)
+				rdb.saveLen(1)
+			},
+			err: "database 1 is out of range",
+		},
+		{
+			name:    "module aux",
+			version: 9,
+			build: func(rdb *rdbWriter) {
+				rdb.writeByte(RDB_OPCODE_MODULE_AUX)
+			},
+			err: "module AUX data",
+		},
+	}
+	for _, tt := range tests {
+		server := newTestServer(t)
+		err := server.rdbLoadRio(bufio.NewReader(bytes.NewReader(rdbTestFile(tt.version, tt.build))))
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if problem := tt.check(server); problem != "" {
+			t.Errorf("%s: %s", tt.name, problem)
+		}
+	}
+
+	header := []struct {
+		header string
+		err    string
+	}{
+		{header: "RADIS0011", err: errRdbBadFormat.Error()},
+		{header: "REDIS00x1", err: "can't handle RDB format version 00x1"},
+		{header: "REDIS", err: "EOF"},
+	}
+	for _, tt := range header {
+		server := newTestServer(t)
+		err := server.rdbLoadRio(bufio.NewReader(strings.NewReader(tt.header)))
+		if err == nil || err.Error() != tt.err && !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%q: got error %v, want %q", tt.header, err, tt.err)
+		}
+	}
+}
+
+// populateTestServer stores a key of every type and encoding the RDB saves
+func populateTestServer(t *testing.T, server *RedisServer) {
+	t.Helper()
+	random := make([]byte, 200)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	strs := map[string]string{
+		"str":          "hello",
+		"empty":        "",
+		"int8":         "-100",
+		"int16":        "30000",
+		"int32":        "-2000000000",
+		"not-int":      "007",
+		"big-int":      "12345678901",
+		"compressible": strings.Repeat("abc", 100),
+		"random":       string(random),
+	}
+	for key, value := range strs {
+		server.setKey(key, createStringObject(value))
+	}
+
+	// listpack nodes of OBJ_LIST_MAX_LISTPACK_ENTRIES and plain nodes, with
+	// the threshold lowered like DEBUG QUICKLIST-PACKED-THRESHOLD does
+	threshold := quicklistPackedThreshold
+	quicklistPackedThreshold = 1000
+	t.Cleanup(func() { quicklistPackedThreshold = threshold })
+	elements := []string{}
+	for i := 0; i < OBJ_LIST_MAX_LISTPACK_ENTRIES*2+10; i++ {
+		elements = append(elements, strconv.Itoa(i-50), "e"+strconv.Itoa(i))
+	}
+	elements = append(elements, strings.Repeat("p", int(quicklistPackedThreshold)), "last")
+	server.setKey("list", createListObject(elements))
+	server.setKey("small-list", createListObject([]string{"a", "1"}))
+
+	server.setKey("set", createSetObject(map[string]struct{}{"a": {}, "1": {}, "-5": {}, strings.Repeat("s", 100): {}}))
+	server.setKey("zset", createZsetObject(map[string]float64{
+		"a": 1, "b": -2.5, "c": 1e-300, "inf": math.Inf(1), "-inf": math.Inf(-1),
+	}))
+	server.setKey("hash", createHashObject(map[string]string{"f": "v", "n": "42", "long": strings.Repeat("h", 100)}))
+
+	// a stream of several nodes, with entries with and without the master
+	// fields, and a consumer group
+	stream := &Stream{MaxDeletedID: StreamID{1, 5}, EntriesAdded: 260}
+	for i := 0; i < STREAM_NODE_MAX_ENTRIES*2+50; i++ {
+		fields := []string{"f", strconv.Itoa(i), "g", "v"}
+		if i%7 == 3 {
+			fields = []string{"other", "x"}
+		}
+		stream.Entries = append(stream.Entries, StreamEntry{ID: StreamID{uint64(2 + i/3), uint64(i % 3)}, Fields: fields})
+	}
+	stream.FirstID = stream.Entries[0].ID
+	stream.LastID = stream.Entries[len(stream.Entries)-1].ID
+	stream.Groups = []*StreamConsumerGroup{{
+		Name:        "group",
+		LastID:      stream.Entries[2].ID,
+		EntriesRead: 3,
+		PEL: []StreamPendingEntry{
+			{ID: stream.Entries[0].ID, DeliveryTime: 1700000000000, DeliveryCount: 2, Consumer: "alice"},
+			{ID: stream.Entries[1].ID, DeliveryTime: 1700000000500, DeliveryCount: 1, Consumer: "bob"},
+			{ID: stream.Entries[2].ID, DeliveryTime: 1700000001000, DeliveryCount: 1, Consumer: "alice"},
+		},
+		Consumers: []*StreamConsumer{
+			{Name: "alice", SeenTime: 1700000001000, ActiveTime: 1700000001000},
+			{Name: "bob", SeenTime: 1700000000500, ActiveTime: -1},
+		},
+	}}
+	server.setKey("stream", createStreamObject(stream))
+	server.setKey("empty-stream", createStreamObject(&Stream{LastID: StreamID{5, 0}, EntriesAdded: 1}))
+
+	server.setExpire("str", time.Now().Add(time.Hour))
+	server.setExpire("hash", time.Now().Add(time.Minute))
+
+	client := newTestClient(server)
+	code := "#!lua name=mylib\nredis.register_function('echo', function(keys, args) return args[1] end)"
+	if reply := client.testRun("FUNCTION", "LOAD", code); reply != "$5\r\nmylib\r\n" {
+		t.Fatalf("FUNCTION LOAD: %q", reply)
+	}
+}
+
+func TestRdbSaveLoad(t *testing.T) {
+	tests := []struct {
+		compression bool
+		checksum    bool
+	}{
+		{compression: true, checksum: true},
+		{compression: false, checksum: true},
+		{compression: true, checksum: false},
+	}
+	for _, tt := range tests {
+		server := newTestServer(t)
+		server.Config.RdbCompression = tt.compression
+		server.Config.RdbChecksum = tt.checksum
+		populateTestServer(t, server)
+		if err := server.rdbSave(); err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := os.ReadFile(server.rdbFilename())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if trailer := binary.LittleEndian.Uint64(data[len(data)-8:]); (trailer == 0) == tt.checksum {
+			t.Errorf("%+v: saved the checksum %#x", tt, trailer)
+		}
+		if compressed := bytes.Contains(data, []byte(strings.Repeat("abc", 100))); compressed == tt.compression {
+			t.Errorf("%+v: the compressible string is stored as is: %v", tt, compressed)
+		}
+
+		loaded := newTestServer(t)
+		loaded.Config.Dir = server.Config.Dir
+		if err := loaded.rdbLoad(loaded.rdbFilename()); err != nil {
+			t.Fatalf("%+v: %v", tt, err)
+		}
+
+		if loaded.Storage.Len() != server.Storage.Len() {
+			t.Errorf("%+v: loaded %d keys, saved %d", tt, loaded.Storage.Len(), server.Storage.Len())
+		}
+		server.Storage.Range(func(key string, obj *RedisObject) bool {
+			got, ok := loaded.Storage.Get(key)
+			if !ok {
+				t.Errorf("%+v: %s was not loaded", tt, key)
+			} else if got.Type != obj.Type || !reflect.DeepEqual(got.Value, obj.Value) {
+				t.Errorf("%+v: %s loaded as %v, saved %v", tt, key, got.Value, obj.Value)
+			}
+			return true
+		})
+		if loaded.Expirations.Len() != server.Expirations.Len() {
+			t.Errorf("%+v: loaded %d expires, saved %d", tt, loaded.Expirations.Len(), server.Expirations.Len())
+		}
+		server.Expirations.Range(func(key string, when time.Time) bool {
+			if got, ok := loaded.Expirations.Get(key); !ok || got.UnixMilli() != when.UnixMilli() {
+				t.Errorf("%+v: the expire of %s loaded as %v, saved %v", tt, key, got, when)
+			}
+			return true
+		})
+
+		if !reflect.DeepEqual(loaded.functionsLibraryCodes(), server.functionsLibraryCodes()) {
+			t.Errorf("%+v: the libraries were not loaded", tt)
+		}
+		if reply := newTestClient(loaded).testRun("FCALL", "echo", "0", "hi"); reply != "$2\r\nhi\r\n" {
+			t.Errorf("%+v: FCALL of the loaded function: %q", tt, reply)
+		}
+	}
+}
+
+func TestRdbChecksum(t *testing.T) {
+	server := newTestServer(t)
+	populateTestServer(t, server)
+	if err := server.rdbSave(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(server.rdbFilename())
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := bytes.Index(data, []byte("hello"))
+	if i < 0 {
+		t.Fatal("the string is not in the file")
+	}
+	data[i] = 'j'
+	if err := os.WriteFile(server.rdbFilename(), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// a loader with the checksum disabled takes the corrupted value
+	for _, checksum := range []bool{true, false} {
+		loaded := newTestServer(t)
+		loaded.Config.Dir = server.Config.Dir
+		loaded.Config.RdbChecksum = checksum
+		err := loaded.rdbLoad(loaded.rdbFilename())
+		if checksum {
+			if err == nil || err.Error() != "wrong RDB checksum" {
+				t.Errorf("loaded a corrupted file: %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("rdbchecksum no: %v", err)
+		} else if obj, _ := loaded.Storage.Get("str"); obj == nil || obj.Value != "jello" {
+			t.Errorf("rdbchecksum no: loaded %v", obj)
+		}
+	}
+}
+
+func TestRdbEvictionInfo(t *testing.T) {
+	tests := []struct {
+		policy int
+		set    func(server *RedisServer, obj *RedisObject)
+		check  func(server *RedisServer, obj *RedisObject) string
+	}{
+		{
+			// saved as IDLE, in seconds
+			policy: MAXMEMORY_ALLKEYS_LRU,
+			set: func(server *RedisServer, obj *RedisObject) {
+				obj.LRU = server.LRUClock - 100
+			},
+			check: func(server *RedisServer, obj *RedisObject) string {
+				if idle := server.estimateObjectIdleTime(obj); idle < 100000 || idle > 102000 {
+					return "idle for " + strconv.FormatUint(idle, 10) + "ms"
+				}
+				return ""
+			},
+		},
+		{
+			// saved as FREQ, the counter without its decrement time
+			policy: MAXMEMORY_ALLKEYS_LFU,
+			set: func(server *RedisServer, obj *RedisObject) {
+				obj.LRU = LFUGetTimeInMinutes()<<8 | 42
+			},
+			check: func(server *RedisServer, obj *RedisObject) string {
+				if counter := obj.LRU & 255; counter != 42 {
+					return "counter " + strconv.Itoa(int(counter))
+				}
+				return ""
+			},
+		},
+	}
+	for _, tt := range tests {
+		server := newTestServer(t)
+		server.Config.MaxmemoryPolicy = tt.policy
+		obj := createStringObject("v")
+		server.setKey("key", obj)
+		tt.set(server, obj)
+		if err := server.rdbSave(); err != nil {
+			t.Fatal(err)
+		}
+
+		loaded := newTestServer(t)
+		loaded.Config.Dir = server.Config.Dir
+		loaded.Config.MaxmemoryPolicy = tt.policy
+		if err := loaded.rdbLoad(loaded.rdbFilename()); err != nil {
+			t.Fatal(err)
+		}
+		obj, ok := loaded.Storage.Get("key")
+		if !ok {
+			t.Fatalf("policy %#x: the key was not loaded", tt.policy)
+		}
+		if problem := tt.check(loaded, obj); problem != "" {
+			t.Errorf("policy %#x: %s", tt.policy, problem)
+		}
+	}
+}
@@ -0,0 +1,1699 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	REPL_STATE_NONE       = iota // no active replication
+	REPL_STATE_CONNECT           // must connect to the master
+	REPL_STATE_CONNECTING        // handshake with the master in progress
+	REPL_STATE_TRANSFER          // receiving the RDB payload of a full sync
+	REPL_STATE_CONNECTED         // applying the command stream of the master
+)
+
+// Sync states of a replica as seen by its master
+const (
+	SLAVE_STATE_WAIT_BGSAVE_START = iota // waiting for a BGSAVE to start
+	SLAVE_STATE_WAIT_BGSAVE_END          // waiting for the BGSAVE to produce the RDB
+	SLAVE_STATE_SEND_BULK                // receiving the RDB file
+	SLAVE_STATE_ONLINE                   // receiving the command stream
+)
+
+// Capabilities a replica announces with REPLCONF capa
+const (
+	SLAVE_CAPA_EOF    = 1 << iota // can parse the RDB EOF streaming format
+	SLAVE_CAPA_PSYNC2             // understands +CONTINUE <new repl ID>
+)
+
+const (
+	CONFIG_DEFAULT_REPL_TIMEOUT             = 60
+	CONFIG_DEFAULT_REPL_PING_PERIOD         = 10
+	CONFIG_DEFAULT_REPL_BACKLOG_SIZE        = 1024 * 1024
+	CONFIG_REPL_BACKLOG_MIN_SIZE            = 16 * 1024
+	CONFIG_DEFAULT_REPL_BACKLOG_TTL         = 60 * 60
+	CONFIG_DEFAULT_REPL_DISKLESS_SYNC_DELAY = 5
+	CONFIG_DEFAULT_MIN_REPLICAS_MAX_LAG     = 10
+	CONFIG_DEFAULT_REPLICA_PRIORITY         = 100
+)
+
+// A diskless sync doesn't know the size of the RDB in advance, the payload
+// is announced as $EOF:<mark> and ends with the same random mark
+const RDB_EOF_MARK_SIZE = 40
+
+// Result of the PSYNC a replica sends to its master
+const (
+	PSYNC_FULLRESYNC = iota
+	PSYNC_CONTINUE
+)
+
+// Progress of a FAILOVER on the master
+const (
+	NO_FAILOVER            = iota
+	FAILOVER_WAIT_FOR_SYNC // writes are paused until the target catches up
+	FAILOVER_IN_PROGRESS   // we PSYNC with the target, which turns into a master
+)
+
+// replState is the replication state of the server. As a replica, the
+// master client applies the stream of the master once the link completed
+// the handshake and the full sync.
+type replState struct {
+	state        int
+	link         *replLink
+	master       *RedisClient
+	masterLastIo time.Time
+	downSince    time.Time // when the link with the master was lost
+
+	// history of the dataset, the offset counts the bytes of the stream.
+	// replid2 is the history we had before, valid up to secondReplidOffset.
+	replid             string
+	replid2            string
+	masterReplOffset   int64
+	secondReplidOffset int64
+
+	// set when replid and masterReplOffset describe a history a master may
+	// let us continue with a partial resync
+	cachedMaster bool
+
+	// our own replicas, and the recent stream they can resume from
+	slaves        []*RedisClient
+	backlog       *replBacklog
+	noSlavesSince time.Time
+	cronLoops     int64
+
+	// replicas that acked within min-replicas-max-lag
+	goodSlavesCount int
+
+	// FAILOVER hands the master role to failoverHost:failoverPort, or to
+	// any replica that caught up when no target was given
+	failoverState   int
+	failoverEndTime time.Time
+	failoverForce   bool
+	failoverHost    string
+	failoverPort    int
+}
+
+// replBacklog is a circular buffer with the end of the replication stream,
+// from which replicas that were briefly disconnected can partially resync
+type replBacklog struct {
+	buf     []byte
+	idx     int   // where the next byte is written
+	histlen int64 // bytes of history in buf
+	offset  int64 // replication offset of the first byte of history
+}
+
+// replLink is a connection to the master. The handshake and the transfer of
+// the RDB payload run on their own goroutine and hand the result to the
+// executor, which ignores links that were replaced in the meantime.
+type replLink struct {
+	mu     sync.Mutex
+	conn   net.Conn
+	closed bool
+
+	// nil unless tls-replication is set
+	tlsConfig *tls.Config
+
+	counter *countingReader
+	reader  *bufio.Reader
+
+	// progress of the transfer, read by INFO while the goroutine writes it
+	transferSize   int64
+	transferRead   int64
+	transferLastIo int64
+}
+
+func (link *replLink) dial(addr string, timeout time.Duration) error {
+	conn, err := connDial(addr, timeout, link.tlsConfig)
+	if err != nil {
+		return err
+	}
+
+	link.mu.Lock()
+	defer link.mu.Unlock()
+	if link.closed {
+		conn.Close()
+		return errors.New("replication link closed")
+	}
+	link.conn = conn
+	link.counter = &countingReader{r: conn}
+	link.reader = bufio.NewReader(link.counter)
+	return nil
+}
+
+// close aborts the link, the goroutine using it fails on its next read
+func (link *replLink) close() {
+	link.mu.Lock()
+	defer link.mu.Unlock()
+	link.closed = true
+	if link.conn != nil {
+		link.conn.Close()
+	}
+}
+
+func (link *replLink) readLine(timeout time.Duration) (string, error) {
+	link.conn.SetReadDeadline(time.Now().Add(timeout))
+	line, err := link.reader.ReadString('\n')
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+// sendCommand sends a command of the handshake and reads its one line reply
+func (link *replLink) sendCommand(timeout time.Duration, cmd string, args ...string) (string, error) {
+	var buf bytes.Buffer
+	cmdArgs := make([]interface{}, len(args))
+	for i, arg := range args {
+		cmdArgs[i] = arg
+	}
+	catAppendOnlyCommand(&buf, cmd, cmdArgs)
+
+	link.conn.SetWriteDeadline(time.Now().Add(timeout))
+	if _, err := link.conn.Write(buf.Bytes()); err != nil {
+		return "", err
+	}
+	return link.readLine(timeout)
+}
+
+// syncWithMaster runs the handshake up to the PSYNC. When the master accepts
+// to continue the history psyncReplid is at, it returns PSYNC_CONTINUE and
+// possibly the new ID of that history. Otherwise it returns the replication
+// ID and offset the stream that follows the RDB payload starts at.
+func (link *replLink) syncWithMaster(addr string, masterUser, masterAuth string, listeningPort int, announceIp string, timeout time.Duration, psyncReplid string, psyncOffset int64, failover bool) (int, string, int64, error) {
+	if err := link.dial(addr, timeout); err != nil {
+		return 0, "", 0, fmt.Errorf("unable to connect to MASTER: %w", err)
+	}
+	fmt.Println("MASTER <-> REPLICA sync started")
+
+	// a master that requires authentication still proves it is alive
+	reply, err := link.sendCommand(timeout, "PING")
+	if err != nil {
+		return 0, "", 0, err
+	}
+	if strings.HasPrefix(reply, "-") && !strings.HasPrefix(reply, "-NOAUTH") &&
+		!strings.HasPrefix(reply, "-NOPERM") && !strings.HasPrefix(reply, "-ERR operation not permitted") {
+		return 0, "", 0, fmt.Errorf("error reply to PING from master: '%s'", reply)
+	}
+	fmt.Println("Master replied to PING, replication can continue...")
+
+	if masterAuth != "" {
+		authArgs := []string{masterAuth}
+		if masterUser != "" {
+			authArgs = []string{masterUser, masterAuth}
+		}
+		reply, err = link.sendCommand(timeout, "AUTH", authArgs...)
+		if err != nil {
+			return 0, "", 0, err
+		}
+		if strings.HasPrefix(reply, "-") {
+			return 0, "", 0, fmt.Errorf("unable to AUTH to MASTER: %s", reply)
+		}
+	}
+
+	reply, err = link.sendCommand(timeout, "REPLCONF", "listening-port", strconv.Itoa(listeningPort))
+	if err != nil {
+		return 0, "", 0, err
+	}
+	if strings.HasPrefix(reply, "-") {
+		fmt.Printf("(Non critical) Master does not understand REPLCONF listening-port: %s\n", reply)
+	}
+
+	if announceIp != "" {
+		reply, err = link.sendCommand(timeout, "REPLCONF", "ip-address", announceIp)
+		if err != nil {
+			return 0, "", 0, err
+		}
+		if strings.HasPrefix(reply, "-") {
+			fmt.Printf("(Non critical) Master does not understand REPLCONF ip-address: %s\n", reply)
+		}
+	}
+
+	reply, err = link.sendCommand(timeout, "REPLCONF", "capa", "eof", "capa", "psync2")
+	if err != nil {
+		return 0, "", 0, err
+	}
+	if strings.HasPrefix(reply, "-") {
+		fmt.Printf("(Non critical) Master does not understand REPLCONF capa: %s\n", reply)
+	}
+
+	if psyncReplid == "?" {
+		fmt.Println("Partial resynchronization not possible (no cached master)")
+	} else {
+		fmt.Printf("Trying a partial resynchronization (request %s:%d).\n", psyncReplid, psyncOffset)
+	}
+	// during a FAILOVER the target turns into a master before it replies
+	psyncArgs := []string{psyncReplid, strconv.FormatInt(psyncOffset, 10)}
+	if failover {
+		psyncArgs = append(psyncArgs, "FAILOVER")
+	}
+	reply, err = link.sendCommand(timeout, "PSYNC", psyncArgs...)
+	// the master may keep the link alive with newlines before it replies,
+	// while it delays the BGSAVE of a diskless sync
+	for err == nil && reply == "" {
+		reply, err = link.readLine(timeout)
+	}
+	if err != nil {
+		return 0, "", 0, err
+	}
+
+	fields := strings.Fields(reply)
+	if len(fields) > 0 && fields[0] == "+CONTINUE" {
+		newReplid := ""
+		if len(fields) > 1 {
+			newReplid = fields[1]
+		}
+		fmt.Println("Successful partial resynchronization with master.")
+		return PSYNC_CONTINUE, newReplid, 0, nil
+	}
+	if len(fields) != 3 || fields[0] != "+FULLRESYNC" {
+		if strings.HasPrefix(reply, "-NOMASTERLINK") || strings.HasPrefix(reply, "-LOADING") {
+			return 0, "", 0, fmt.Errorf("master is currently unable to PSYNC but should be in the future: %s", reply)
+		}
+		return 0, "", 0, fmt.Errorf("unexpected reply to PSYNC from master: %s", reply)
+	}
+	replid := fields[1]
+	offset, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return 0, "", 0, fmt.Errorf("unexpected reply to PSYNC from master: %s", reply)
+	}
+	fmt.Printf("Full resync from master: %s:%d\n", replid, offset)
+	return PSYNC_FULLRESYNC, replid, offset, nil
+}
+
+// readSyncBulkPayload receives the RDB file the master sends as a bulk
+// string, or as a payload delimited by an EOF mark for a diskless sync
+func (link *replLink) readSyncBulkPayload(timeout time.Duration, tmpfile string) error {
+	var size int64
+	var eofMark []byte
+	for {
+		line, err := link.readLine(timeout)
+		if err != nil {
+			return fmt.Errorf("I/O error reading bulk count from MASTER: %w", err)
+		}
+		// newlines keep the link alive while the master prepares the payload
+		if line == "" {
+			continue
+		}
+		if line[0] == '-' {
+			return fmt.Errorf("MASTER aborted replication with an error: %s", line[1:])
+		}
+		if line[0] != '$' {
+			return fmt.Errorf("bad protocol from MASTER, the first byte is not '$' (we received '%s'), are you sure the host and port are right?", line)
+		}
+		if strings.HasPrefix(line, "$EOF:") && len(line) == 5+RDB_EOF_MARK_SIZE {
+			eofMark = []byte(line[5:])
+			break
+		}
+		if size, err = strconv.ParseInt(line[1:], 10, 64); err != nil || size < 0 {
+			return fmt.Errorf("bad bulk count from MASTER: %s", line)
+		}
+		break
+	}
+	if eofMark != nil {
+		fmt.Println("MASTER <-> REPLICA sync: receiving streamed RDB from master with EOF to disk")
+	} else {
+		fmt.Printf("MASTER <-> REPLICA sync: receiving %d bytes from master to disk\n", size)
+		atomic.StoreInt64(&link.transferSize, size)
+	}
+
+	file, err := os.Create(tmpfile)
+	if err != nil {
+		return fmt.Errorf("opening the temp file needed for MASTER <-> REPLICA synchronization: %w", err)
+	}
+	defer file.Close()
+
+	// the master sends nothing after the mark until we ACK the payload, so
+	// the last bytes read are the mark once the payload is complete
+	lastbytes := make([]byte, 0, RDB_EOF_MARK_SIZE)
+	buf := make([]byte, 16*1024)
+	for read := int64(0); eofMark != nil || read < size; {
+		chunk := buf
+		if left := size - read; eofMark == nil && left < int64(len(chunk)) {
+			chunk = chunk[:left]
+		}
+		link.conn.SetReadDeadline(time.Now().Add(timeout))
+		n, err := link.reader.Read(chunk)
+		if n > 0 {
+			if _, err := file.Write(chunk[:n]); err != nil {
+				return fmt.Errorf("write error or short write writing to the DB dump file needed for MASTER <-> REPLICA synchronization: %w", err)
+			}
+			read += int64(n)
+			atomic.StoreInt64(&link.transferRead, read)
+			atomic.StoreInt64(&link.transferLastIo, time.Now().Unix())
+
+			if eofMark != nil {
+				lastbytes = append(lastbytes, chunk[:n]...)
+				if len(lastbytes) > RDB_EOF_MARK_SIZE {
+					lastbytes = append(lastbytes[:0], lastbytes[len(lastbytes)-RDB_EOF_MARK_SIZE:]...)
+				}
+				if bytes.Equal(lastbytes, eofMark) {
+					if err := file.Truncate(read - RDB_EOF_MARK_SIZE); err != nil {
+						return fmt.Errorf("error truncating the RDB file received from the master for SYNC: %w", err)
+					}
+					break
+				}
+			}
+		}
+		if err == io.EOF {
+			return errors.New("MASTER closed the connection during the transfer")
+		}
+		if err != nil {
+			return fmt.Errorf("I/O error trying to sync with MASTER: %w", err)
+		}
+	}
+	return file.Sync()
+}
+
+func (server *RedisServer) replicationTempFilename() string {
+	return filepath.Join(server.Config.Dir, fmt.Sprintf("temp-%d.%d.rdb", time.Now().Unix(), os.Getpid()))
+}
+
+// connectWithMaster starts the handshake with the master on a new link
+func (server *RedisServer) connectWithMaster() {
+	link := &replLink{tlsConfig: server.tlsDialConfig(server.Config.TlsReplication)}
+	server.repl.link = link
+	server.repl.state = REPL_STATE_CONNECTING
+
+	addr := net.JoinHostPort(server.Config.MasterHost, strconv.Itoa(server.Config.MasterPort))
+	port := server.clientPort(server.Config.TlsReplication)
+	if server.Config.ReplicaAnnouncePort != 0 {
+		port = server.Config.ReplicaAnnouncePort
+	}
+	announceIp := server.Config.ReplicaAnnounceIp
+	masterUser, masterAuth := server.Config.MasterUser, server.Config.MasterAuth
+	timeout := time.Duration(server.Config.ReplTimeout) * time.Second
+	tmpfile := server.replicationTempFilename()
+
+	psyncReplid, psyncOffset := "?", int64(-1)
+	if server.repl.cachedMaster {
+		psyncReplid, psyncOffset = server.repl.replid, server.repl.masterReplOffset+1
+	}
+	failover := server.repl.failoverState == FAILOVER_IN_PROGRESS
+
+	go func() {
+		result, replid, offset, err := link.syncWithMaster(addr, masterUser, masterAuth, port, announceIp, timeout, psyncReplid, psyncOffset, failover)
+		if err == nil && result == PSYNC_FULLRESYNC {
+			server.runOnExecutor(func() {
+				if server.repl.link == link {
+					server.repl.state = REPL_STATE_TRANSFER
+				}
+			})
+			if err = link.readSyncBulkPayload(timeout, tmpfile); err != nil {
+				os.Remove(tmpfile)
+			}
+		}
+
+		server.runOnExecutor(func() {
+			if server.repl.link != link {
+				link.close()
+				os.Remove(tmpfile)
+				return
+			}
+			if err != nil {
+				fmt.Println(err)
+				server.cancelReplicationHandshake()
+				if server.repl.failoverState == FAILOVER_IN_PROGRESS {
+					server.abortFailover("Failover target rejected psync request")
+				}
+				return
+			}
+			// the target is our master now, the failover is over
+			if server.repl.failoverState == FAILOVER_IN_PROGRESS {
+				server.clearFailoverState()
+			}
+			if result == PSYNC_CONTINUE {
+				server.replicationResurrectCachedMaster(link, replid)
+				return
+			}
+			server.replicationLoadPayload(link, replid, offset, tmpfile)
+		})
+	}()
+}
+
+// replicationLoadPayload replaces the dataset with the RDB received from the
+// master and starts applying its stream
+func (server *RedisServer) replicationLoadPayload(link *replLink, replid string, offset int64, tmpfile string) {
+	if err := os.Rename(tmpfile, server.rdbFilename()); err != nil {
+		fmt.Println("Failed trying to rename the temp DB into dump.rdb in MASTER <-> REPLICA synchronization:", err)
+		os.Remove(tmpfile)
+		server.cancelReplicationHandshake()
+		return
+	}
+
+	// the replicas and the backlog we had belong to the old history
+	server.replicationAttachToNewMaster()
+
+	fmt.Println("MASTER <-> REPLICA sync: Flushing old data")
+	server.emptyData(false)
+	server.functionsInit()
+
+	fmt.Println("MASTER <-> REPLICA sync: Loading DB in memory")
+	if err := server.rdbLoad(server.rdbFilename()); err != nil {
+		fmt.Println("Failed trying to load the MASTER synchronization DB from disk, check server logs:", err)
+		server.cancelReplicationHandshake()
+		server.emptyData(false)
+		return
+	}
+
+	server.replicationCreateMasterClient(link, replid, offset)
+	server.clearReplicationId2()
+	if server.repl.backlog == nil {
+		server.createReplicationBacklog()
+	}
+	fmt.Println("MASTER <-> REPLICA sync: Finished with success")
+
+	// the AOF has none of the data that was just loaded
+	if server.Config.AppendOnly {
+		server.aof.rewriteScheduled = true
+	}
+}
+
+// replicationResurrectCachedMaster resumes applying the stream of the master
+// after a partial resync. A master that changed its replication ID kept our
+// history as its secondary ID.
+func (server *RedisServer) replicationResurrectCachedMaster(link *replLink, newReplid string) {
+	if newReplid != "" && newReplid != server.repl.replid {
+		server.repl.replid2 = server.repl.replid
+		server.repl.secondReplidOffset = server.repl.masterReplOffset + 1
+		server.repl.replid = newReplid
+		fmt.Printf("Master replication ID changed to %s\n", newReplid)
+		// our replicas must learn about the new ID
+		server.disconnectSlaves()
+	}
+
+	server.replicationCreateMasterClient(link, server.repl.replid, server.repl.masterReplOffset)
+	if server.repl.backlog == nil {
+		server.createReplicationBacklog()
+	}
+	fmt.Println("MASTER <-> REPLICA sync: Master accepted a Partial Resynchronization.")
+}
+
+// replicationAttachToNewMaster drops what refers to the history we had,
+// before a full sync replaces it
+func (server *RedisServer) replicationAttachToNewMaster() {
+	server.repl.cachedMaster = false
+	server.disconnectSlaves()
+	server.repl.backlog = nil
+}
+
+func (server *RedisServer) replicationCreateMasterClient(link *replLink, replid string, offset int64) {
+	client := newClient(server, link.conn)
+	client.Flags |= CLIENT_MASTER
+	// nothing of the stream was read yet, it starts where the sync ended
+	client.readReploff = offset
+
+	server.repl.link = nil
+	server.repl.master = client
+	server.repl.state = REPL_STATE_CONNECTED
+	server.repl.masterLastIo = time.Now()
+	server.repl.replid = replid
+	server.repl.masterReplOffset = offset
+	server.repl.cachedMaster = false
+
+	go server.readQueryFromMaster(client, link, offset)
+
+	// the master learns right away where our stream starts
+	server.replicationSendAck()
+}
+
+// replicationSendAck tells the master the offset of the stream we processed,
+// this is the only reply the master reads from us
+func (server *RedisServer) replicationSendAck() {
+	client := server.repl.master
+	if client == nil {
+		return
+	}
+
+	var buf bytes.Buffer
+	catAppendOnlyCommand(&buf, "REPLCONF", []interface{}{"ACK", strconv.FormatInt(server.repl.masterReplOffset, 10)})
+	client.Flags |= CLIENT_MASTER_FORCE_REPLY
+	client.addReply(buf.Bytes())
+	client.Flags &^= CLIENT_MASTER_FORCE_REPLY
+}
+
+// readQueryFromMaster forwards the command stream of the master to the
+// executor, along with the replication offset each command ends at
+func (server *RedisServer) readQueryFromMaster(client *RedisClient, link *replLink, offset int64) {
+	link.conn.SetReadDeadline(time.Time{})
+	start := link.counter.n - int64(link.reader.Buffered())
+
+	for {
+		cmd, args, err := readCommand(link.reader, PROTO_UNLIMITED_BULK_LEN)
+		if err != nil {
+			server.runOnExecutor(func() {
+				server.replicationHandleMasterDisconnection(client)
+			})
+			return
+		}
+
+		if cmd == "" {
+			continue
+		}
+
+		reploff := offset + link.counter.n - int64(link.reader.Buffered()) - start
+		atomic.StoreInt64(&client.readReploff, reploff)
+		server.requests <- CommandRequest{Client: client, Cmd: cmd, Args: args, ReplOff: reploff}
+	}
+}
+
+// replicationFeedStreamFromMasterStream forwards the stream of our master
+// as is to our own replicas and backlog, so that sub-replicas see the same
+// offsets and can partially resync with any server of the chain
+func (server *RedisServer) replicationFeedStreamFromMasterStream(cmd string, args []interface{}, reploff int64) {
+	if server.repl.backlog != nil || len(server.repl.slaves) > 0 {
+		var buf bytes.Buffer
+		catAppendOnlyCommand(&buf, cmd, args)
+		if server.repl.backlog != nil {
+			server.feedReplicationBacklog(buf.Bytes())
+		}
+		server.feedSlavesStream(buf.Bytes())
+	}
+	server.repl.masterReplOffset = reploff
+}
+
+func (server *RedisServer) replicationHandleMasterDisconnection(client *RedisClient) {
+	client.close()
+	if server.repl.master != client {
+		return
+	}
+
+	fmt.Println("Connection with master lost.")
+	fmt.Println("Caching the disconnected master state.")
+	server.repl.master = nil
+	server.repl.downSince = server.UnixTime
+	server.repl.cachedMaster = true
+	server.repl.state = REPL_STATE_CONNECT
+}
+
+// cancelReplicationHandshake aborts a handshake or transfer in progress, the
+// cron connects again later
+func (server *RedisServer) cancelReplicationHandshake() {
+	if server.repl.link != nil {
+		server.repl.link.close()
+		server.repl.link = nil
+	}
+	if server.repl.state == REPL_STATE_CONNECTING || server.repl.state == REPL_STATE_TRANSFER {
+		server.repl.state = REPL_STATE_CONNECT
+	}
+}
+
+// replicationSetMaster turns the server into a replica of host:port
+func (server *RedisServer) replicationSetMaster(host string, port int) {
+	server.Config.MasterHost, server.Config.MasterPort = host, port
+	// our replicas must sync again with the dataset of the new master
+	server.disconnectSlaves()
+	server.cancelReplicationHandshake()
+	if server.repl.master != nil {
+		server.repl.master.close()
+		server.repl.master = nil
+	}
+
+	// our own history, or the one of the previous master, may be continued
+	// by the new master
+	server.repl.cachedMaster = true
+	server.repl.state = REPL_STATE_CONNECT
+	fmt.Printf("Connecting to MASTER %s:%d\n", host, port)
+	server.connectWithMaster()
+}
+
+// replicationUnsetMaster turns a replica into a master, keeping its dataset
+func (server *RedisServer) replicationUnsetMaster() {
+	if server.Config.MasterHost == "" {
+		return
+	}
+
+	server.Config.MasterHost, server.Config.MasterPort = "", 0
+	server.cancelReplicationHandshake()
+	if server.repl.master != nil {
+		server.repl.master.close()
+		server.repl.master = nil
+	}
+	server.repl.cachedMaster = false
+
+	// a new history starts here, the replicas of our old master can still
+	// continue the previous one with a partial resync
+	server.shiftReplicationId()
+	server.disconnectSlaves()
+	server.repl.state = REPL_STATE_NONE
+	server.repl.noSlavesSince = server.UnixTime
+}
+
+// replicationCron is called every second by serverCron
+func (server *RedisServer) replicationCron() {
+	server.repl.cronLoops++
+	server.replicationPruneSlaves()
+
+	if server.Config.MasterHost != "" && server.repl.state == REPL_STATE_CONNECT {
+		fmt.Printf("Connecting to MASTER %s:%d\n", server.Config.MasterHost, server.Config.MasterPort)
+		server.connectWithMaster()
+	}
+
+	// the master sends PINGs, so a silent link is a dead one
+	timeout := time.Duration(server.Config.ReplTimeout) * time.Second
+	if server.repl.master != nil && server.UnixTime.Sub(server.repl.masterLastIo) > timeout {
+		fmt.Println("MASTER timeout: no data nor PING received...")
+		server.replicationHandleMasterDisconnection(server.repl.master)
+	}
+
+	// our ACKs let the master detect timeouts and serve WAIT
+	if server.repl.master != nil && server.repl.master.Flags&CLIENT_PRE_PSYNC == 0 {
+		server.replicationSendAck()
+	}
+
+	// and the ACKs of our replicas tell us they are still there
+	for _, slave := range server.repl.slaves {
+		if slave.replState != SLAVE_STATE_ONLINE || slave.Flags&CLIENT_PRE_PSYNC != 0 {
+			continue
+		}
+		if server.UnixTime.Sub(slave.replAckTime) > timeout {
+			fmt.Printf("Disconnecting timedout replica (streaming sync): %s\n", slave.replicationGetSlaveName())
+			slave.close()
+		}
+	}
+	server.replicationPruneSlaves()
+
+	// a master without replicas for long enough frees its backlog, the
+	// replicas that come back will need a full sync anyway
+	ttl := time.Duration(server.Config.ReplBacklogTtl) * time.Second
+	if server.Config.MasterHost == "" && len(server.repl.slaves) == 0 && server.repl.backlog != nil &&
+		ttl > 0 && server.UnixTime.Sub(server.repl.noSlavesSince) > ttl {
+		server.changeReplicationId()
+		server.clearReplicationId2()
+		server.repl.backlog = nil
+		fmt.Printf("Replication backlog freed after %d seconds without connected replicas.\n", server.Config.ReplBacklogTtl)
+	}
+
+	// the replicas use the PINGs of their master to detect timeouts. The
+	// replica of a manual failover waits for the offset we paused at, the
+	// PINGs would move it.
+	period := int64(server.Config.ReplPingReplicaPeriod)
+	manualFailoverInProgress := server.cluster != nil && server.cluster.mfEnd != 0
+	if server.Config.MasterHost == "" && len(server.repl.slaves) > 0 && server.repl.cronLoops%period == 0 && !manualFailoverInProgress {
+		server.replicationFeedSlaves("PING", nil)
+	}
+
+	// replicas waiting for their RDB get newlines so they don't time out,
+	// except the ones the RDB is being streamed to
+	for _, slave := range server.repl.slaves {
+		if slave.replState == SLAVE_STATE_WAIT_BGSAVE_START ||
+			(slave.replState == SLAVE_STATE_WAIT_BGSAVE_END && server.rdbChildType != RDB_CHILD_TYPE_SOCKET) {
+			slave.addReply([]byte("\n"))
+		}
+	}
+
+	server.replicationStartPendingFork()
+	server.refreshGoodSlavesCount()
+}
+
+func (server *RedisServer) handleReplicaofCommand(cmd string, args []interface{}) []byte {
+	if len(args) != 2 {
+		return addReplyErrorArity()
+	}
+
+	// the replicas of a cluster are set with CLUSTER REPLICATE
+	if server.cluster != nil {
+		return []byte("-ERR REPLICAOF not allowed in cluster mode.\r\n")
+	}
+
+	host, _ := args[0].(string)
+	portArg, _ := args[1].(string)
+
+	if strings.EqualFold(host, "no") && strings.EqualFold(portArg, "one") {
+		if server.Config.MasterHost != "" {
+			server.replicationUnsetMaster()
+			fmt.Println("MASTER MODE enabled (user request)")
+		}
+		return []byte("+OK\r\n")
+	}
+
+	port, err := strconv.Atoi(portArg)
+	if err != nil || port < 0 || port > 65535 {
+		return []byte("-ERR Invalid master port\r\n")
+	}
+
+	if server.Config.MasterHost != "" && strings.EqualFold(server.Config.MasterHost, host) && server.Config.MasterPort == port {
+		fmt.Println("REPLICAOF would result into synchronization with the master we are already connected with. No operation performed.")
+		return []byte("+OK Already connected to specified master\r\n")
+	}
+
+	server.replicationSetMaster(host, port)
+	fmt.Printf("REPLICAOF %s:%d enabled (user request)\n", host, port)
+	return []byte("+OK\r\n")
+}
+
+func replstateToString(state int) string {
+	switch state {
+	case SLAVE_STATE_WAIT_BGSAVE_START, SLAVE_STATE_WAIT_BGSAVE_END:
+		return "wait_bgsave"
+	case SLAVE_STATE_SEND_BULK:
+		return "send_bulk"
+	case SLAVE_STATE_ONLINE:
+		return "online"
+	default:
+		return ""
+	}
+}
+
+// replicationGetSlaveName is how a replica shows up in the logs: the address
+// it listens on for clients, or the one it connected from
+func (client *RedisClient) replicationGetSlaveName() string {
+	host := client.replicationGetSlaveIp()
+	if host == "" || client.replListeningPort == 0 {
+		return client.Conn.RemoteAddr().String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(client.replListeningPort))
+}
+
+// replicationGetSlaveIp is the IP a replica announced with REPLCONF
+// ip-address, or the one it connected from
+func (client *RedisClient) replicationGetSlaveIp() string {
+	if client.replAddr != "" {
+		return client.replAddr
+	}
+	host, _, err := net.SplitHostPort(client.Conn.RemoteAddr().String())
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+func (server *RedisServer) createReplicationBacklog() {
+	server.repl.backlog = &replBacklog{
+		buf: make([]byte, server.Config.ReplBacklogSize),
+		// the replicas ask for the byte after the last one they have
+		offset: server.repl.masterReplOffset + 1,
+	}
+}
+
+// resizeReplicationBacklog gives the backlog the size of repl-backlog-size.
+// Its content is lost, the replicas resync from the offset on.
+func (server *RedisServer) resizeReplicationBacklog() {
+	if server.repl.backlog == nil || int64(len(server.repl.backlog.buf)) == server.Config.ReplBacklogSize {
+		return
+	}
+	server.createReplicationBacklog()
+}
+
+// feedReplicationBacklog adds data to the stream, which advances the
+// replication offset
+func (server *RedisServer) feedReplicationBacklog(p []byte) {
+	server.repl.masterReplOffset += int64(len(p))
+
+	bl := server.repl.backlog
+	if bl == nil {
+		return
+	}
+	for len(p) > 0 {
+		n := copy(bl.buf[bl.idx:], p)
+		bl.idx = (bl.idx + n) % len(bl.buf)
+		bl.histlen += int64(n)
+		p = p[n:]
+	}
+	if bl.histlen > int64(len(bl.buf)) {
+		bl.histlen = int64(len(bl.buf))
+	}
+	bl.offset = server.repl.masterReplOffset - bl.histlen + 1
+}
+
+// addReplyReplicationBacklog sends the replica the backlog from offset on,
+// returning how many bytes that is
+func (server *RedisServer) addReplyReplicationBacklog(client *RedisClient, offset int64) int64 {
+	bl := server.repl.backlog
+	skip := offset - bl.offset
+	size := bl.histlen - skip
+	if size == 0 {
+		return 0
+	}
+
+	start := (int64(bl.idx) - bl.histlen + skip + int64(len(bl.buf))) % int64(len(bl.buf))
+	data := make([]byte, 0, size)
+	for int64(len(data)) < size {
+		end := start + size - int64(len(data))
+		if end > int64(len(bl.buf)) {
+			end = int64(len(bl.buf))
+		}
+		data = append(data, bl.buf[start:end]...)
+		start = 0
+	}
+	client.addReply(data)
+	return size
+}
+
+func (server *RedisServer) changeReplicationId() {
+	server.repl.replid = getRandomHexChars(CONFIG_RUN_ID_SIZE)
+}
+
+func (server *RedisServer) clearReplicationId2() {
+	server.repl.replid2 = ""
+	server.repl.secondReplidOffset = -1
+}
+
+// shiftReplicationId starts a new history, keeping the current one as the
+// secondary ID so that the replicas that followed it can continue
+func (server *RedisServer) shiftReplicationId() {
+	repl := &server.repl
+	repl.replid2 = repl.replid
+	// the replicas ask for the byte after the last one they have
+	repl.secondReplidOffset = repl.masterReplOffset + 1
+	server.changeReplicationId()
+	fmt.Printf("Setting secondary replication ID to %s, valid up to offset: %d. New replication ID is %s\n",
+		repl.replid2, repl.secondReplidOffset, repl.replid)
+}
+
+// masterTryPartialResynchronization accepts a PSYNC that continues our
+// current or previous history from an offset still in the backlog
+func (server *RedisServer) masterTryPartialResynchronization(client *RedisClient, replid string, offset int64) bool {
+	repl := &server.repl
+	if !strings.EqualFold(replid, repl.replid) &&
+		(!strings.EqualFold(replid, repl.replid2) || offset > repl.secondReplidOffset) {
+		switch {
+		case replid == "?":
+			fmt.Printf("Full resync requested by replica %s\n", client.replicationGetSlaveName())
+		case !strings.EqualFold(replid, repl.replid) && !strings.EqualFold(replid, repl.replid2):
+			fmt.Printf("Partial resynchronization not accepted: Replication ID mismatch (Replica asked for '%s', my replication IDs are '%s' and '%s')\n",
+				replid, repl.replid, repl.replid2)
+		default:
+			fmt.Printf("Partial resynchronization not accepted: Requested offset for second ID was %d, but I can reply up to %d\n",
+				offset, repl.secondReplidOffset)
+		}
+		return false
+	}
+
+	bl := repl.backlog
+	if bl == nil || offset < bl.offset || offset > bl.offset+bl.histlen {
+		fmt.Printf("Unable to partial resync with replica %s for lack of backlog (Replica request was: %d).\n",
+			client.replicationGetSlaveName(), offset)
+		if offset > repl.masterReplOffset {
+			fmt.Printf("Warning: replica %s tried to PSYNC with an offset that is greater than the master replication offset.\n",
+				client.replicationGetSlaveName())
+		}
+		return false
+	}
+
+	client.Flags |= CLIENT_SLAVE
+	client.replState = SLAVE_STATE_ONLINE
+	client.replAckTime = server.UnixTime
+	repl.slaves = append(repl.slaves, client)
+
+	// replicas that know PSYNC2 follow us to the new ID
+	if client.replCapa&SLAVE_CAPA_PSYNC2 != 0 {
+		client.addReply([]byte(fmt.Sprintf("+CONTINUE %s\r\n", repl.replid)))
+	} else {
+		client.addReply([]byte("+CONTINUE\r\n"))
+	}
+	sent := server.addReplyReplicationBacklog(client, offset)
+	fmt.Printf("Partial resynchronization request from %s accepted. Sending %d bytes of backlog starting from offset %d.\n",
+		client.replicationGetSlaveName(), sent, offset)
+	return true
+}
+
+// replicationFeedSlaves sends a write command to the replicas and the
+// backlog. Replicas that are still waiting for their RDB keep the stream
+// until it is sent.
+func (server *RedisServer) replicationFeedSlaves(cmd string, args []interface{}) {
+	if server.repl.backlog == nil && len(server.repl.slaves) == 0 {
+		return
+	}
+
+	var buf bytes.Buffer
+	catAppendOnlyCommand(&buf, cmd, args)
+	server.feedReplicationBacklog(buf.Bytes())
+	server.feedSlavesStream(buf.Bytes())
+}
+
+func (server *RedisServer) feedSlavesStream(p []byte) {
+	// the backlog still has it, for the replicas to catch up once they
+	// reconnect
+	if server.faults.dropReplicationStream {
+		return
+	}
+	for _, slave := range server.repl.slaves {
+		switch {
+		case slave.replState == SLAVE_STATE_WAIT_BGSAVE_START:
+			// the RDB it will get is taken after this command
+		case slave.replHeld != nil:
+			slave.replHeld.Write(p)
+		default:
+			slave.addReply(p)
+		}
+	}
+}
+
+// handleSyncCommand starts a full resync of the replica, for both SYNC and
+// PSYNC. The RDB is produced by a BGSAVE, which a replica joins when another
+// replica already waits for it.
+func (server *RedisServer) handleSyncCommand(cmd string, args []interface{}) []byte {
+	psync := cmd == "PSYNC"
+	if (psync && len(args) != 2 && len(args) != 3) || (!psync && len(args) != 0) {
+		return addReplyErrorArity()
+	}
+
+	// ignore SYNC if already replica
+	client := server.currentClient
+	if client.Flags&CLIENT_SLAVE != 0 {
+		return nil
+	}
+
+	// our master hands us its role, and continues as our replica
+	if psync && len(args) == 3 {
+		option, _ := args[2].(string)
+		replid, _ := args[0].(string)
+		if !strings.EqualFold(option, "FAILOVER") {
+			return []byte("-ERR syntax error\r\n")
+		}
+		if !strings.EqualFold(replid, server.repl.replid) {
+			return []byte("-ERR PSYNC FAILOVER replid must match my replid.\r\n")
+		}
+		server.replicationUnsetMaster()
+		fmt.Printf("MASTER MODE enabled (failover request from '%s')\n", client.Conn.RemoteAddr())
+	}
+	if server.Config.MasterHost != "" && server.repl.state != REPL_STATE_CONNECTED {
+		return []byte("-NOMASTERLINK Can't SYNC while not connected with my master\r\n")
+	}
+
+	fmt.Printf("Replica %s asks for synchronization\n", client.replicationGetSlaveName())
+	if psync {
+		replid, _ := args[0].(string)
+		offsetArg, _ := args[1].(string)
+		offset, err := strconv.ParseInt(offsetArg, 10, 64)
+		if err != nil {
+			return []byte("-ERR value is not an integer or out of range\r\n")
+		}
+		if server.masterTryPartialResynchronization(client, replid, offset) {
+			return nil
+		}
+	} else {
+		// old replicas don't understand +FULLRESYNC
+		client.Flags |= CLIENT_PRE_PSYNC
+	}
+
+	client.Flags |= CLIENT_SLAVE
+	client.replState = SLAVE_STATE_WAIT_BGSAVE_START
+	client.replHeld = &bytes.Buffer{}
+	client.replSyncStart = server.UnixTime
+	server.repl.slaves = append(server.repl.slaves, client)
+
+	// a new history starts with the first replica, nobody can continue
+	// the stream before it
+	if len(server.repl.slaves) == 1 && server.repl.backlog == nil {
+		server.changeReplicationId()
+		server.clearReplicationId2()
+		server.createReplicationBacklog()
+		fmt.Printf("Replication backlog created, my new replication ID is '%s'\n", server.repl.replid)
+	}
+
+	if server.rdbBgsaveInProgress && server.rdbChildType == RDB_CHILD_TYPE_DISK {
+		// the writes since the BGSAVE started are in the stream held for
+		// another replica waiting for it
+		for _, slave := range server.repl.slaves {
+			if slave != client && slave.replState == SLAVE_STATE_WAIT_BGSAVE_END {
+				client.replHeld.Write(slave.replHeld.Bytes())
+				server.replicationSetupSlaveForFullResync(client, slave.psyncInitialOffset)
+				fmt.Println("Waiting for end of BGSAVE for SYNC")
+				return nil
+			}
+		}
+		fmt.Println("Can't attach the replica to the current BGSAVE. Waiting for next BGSAVE for SYNC")
+		return nil
+	}
+	if server.rdbBgsaveInProgress {
+		// an RDB streamed to other replicas can't be joined halfway
+		fmt.Println("Current BGSAVE has socket target. Waiting for next BGSAVE for SYNC")
+		return nil
+	}
+
+	// more replicas may arrive in a moment and share the same transfer
+	if server.Config.ReplDisklessSync && client.replCapa&SLAVE_CAPA_EOF != 0 && server.Config.ReplDisklessSyncDelay > 0 {
+		fmt.Println("Delay next BGSAVE for diskless SYNC")
+		return nil
+	}
+
+	server.startBgsaveForReplication()
+	return nil
+}
+
+func (server *RedisServer) replicationSetupSlaveForFullResync(client *RedisClient, offset int64) {
+	client.psyncInitialOffset = offset
+	client.replState = SLAVE_STATE_WAIT_BGSAVE_END
+	if client.Flags&CLIENT_PRE_PSYNC == 0 {
+		client.addReply([]byte(fmt.Sprintf("+FULLRESYNC %s %d\r\n", server.repl.replid, offset)))
+	}
+}
+
+// startBgsaveForReplication starts the BGSAVE the replicas waiting to start
+// a full resync get their RDB from. It is streamed to their sockets when
+// diskless sync is enabled and all of them can parse the EOF format.
+func (server *RedisServer) startBgsaveForReplication() {
+	mincapa := -1
+	for _, slave := range server.repl.slaves {
+		if slave.replState == SLAVE_STATE_WAIT_BGSAVE_START {
+			mincapa &= slave.replCapa
+		}
+	}
+
+	var err error
+	if server.Config.ReplDisklessSync && mincapa&SLAVE_CAPA_EOF != 0 {
+		fmt.Println("Starting BGSAVE for SYNC with target: replicas sockets")
+		err = server.rdbSaveToSlavesSockets()
+	} else {
+		fmt.Println("Starting BGSAVE for SYNC with target: disk")
+		err = server.rdbSaveBackground()
+	}
+
+	for _, slave := range server.repl.slaves {
+		if slave.replState != SLAVE_STATE_WAIT_BGSAVE_START {
+			continue
+		}
+		if err != nil {
+			fmt.Println("BGSAVE for replication failed:", err)
+			slave.close()
+			continue
+		}
+		server.replicationSetupSlaveForFullResync(slave, server.repl.masterReplOffset)
+	}
+	server.replicationPruneSlaves()
+}
+
+// replicationStartPendingFork starts the BGSAVE for the replicas waiting for
+// a full sync once the diskless sync delay elapsed, or enough of them wait
+func (server *RedisServer) replicationStartPendingFork() {
+	if server.rdbBgsaveInProgress {
+		return
+	}
+
+	waiting, maxIdle := 0, time.Duration(0)
+	for _, slave := range server.repl.slaves {
+		if slave.replState != SLAVE_STATE_WAIT_BGSAVE_START {
+			continue
+		}
+		waiting++
+		if idle := server.UnixTime.Sub(slave.replSyncStart); idle > maxIdle {
+			maxIdle = idle
+		}
+	}
+	if waiting == 0 {
+		return
+	}
+
+	delay := time.Duration(server.Config.ReplDisklessSyncDelay) * time.Second
+	maxReplicas := server.Config.ReplDisklessSyncMaxReplicas
+	if !server.Config.ReplDisklessSync || maxIdle >= delay || (maxReplicas > 0 && waiting >= maxReplicas) {
+		server.startBgsaveForReplication()
+	}
+}
+
+// updateSlavesWaitingBgsave is called when a BGSAVE is done, to send the
+// RDB to the replicas that waited for it. The ones it was streamed to are
+// online already, their stream starts with their first ACK.
+func (server *RedisServer) updateSlavesWaitingBgsave(err error, childType int) {
+	for _, slave := range server.repl.slaves {
+		if slave.replState != SLAVE_STATE_WAIT_BGSAVE_END {
+			continue
+		}
+		if err != nil {
+			fmt.Println("SYNC failed. BGSAVE child returned an error")
+			slave.close()
+			continue
+		}
+		if childType == RDB_CHILD_TYPE_SOCKET {
+			fmt.Printf("Streamed RDB transfer with replica %s succeeded (socket). Waiting for REPLCONF ACK from replica to enable streaming\n",
+				slave.replicationGetSlaveName())
+			server.replicationPutSlaveOnline(slave)
+			slave.replStreamOnAck = true
+			continue
+		}
+		slave.replState = SLAVE_STATE_SEND_BULK
+		server.sendBulkToSlave(slave, server.rdbFilename())
+	}
+	server.replicationPruneSlaves()
+
+	server.replicationStartPendingFork()
+}
+
+// rdbSaveToSlavesSockets streams a snapshot to the replicas waiting for a
+// full sync, without writing it to disk
+func (server *RedisServer) rdbSaveToSlavesSockets() error {
+	if server.rdbBgsaveInProgress {
+		return errors.New("background save already in progress")
+	}
+
+	var targets []*RedisClient
+	for _, slave := range server.repl.slaves {
+		if slave.replState == SLAVE_STATE_WAIT_BGSAVE_START {
+			server.replicationSetupSlaveForFullResync(slave, server.repl.masterReplOffset)
+			targets = append(targets, slave)
+		}
+	}
+
+	start := time.Now()
+	snapshot := server.newRdbSnapshot()
+	server.latencyAddSampleIfNeeded("fork", time.Since(start))
+	server.rdbBgsaveInProgress = true
+	server.rdbChildType = RDB_CHILD_TYPE_SOCKET
+	server.RdbSaveTimeStart = time.Now()
+	mark := getRandomHexChars(RDB_EOF_MARK_SIZE)
+
+	go func() {
+		w := &slavesSocketsWriter{slaves: targets, errs: make([]error, len(targets))}
+		err := w.sendSnapshot(&snapshot, mark)
+		server.runOnExecutor(func() {
+			snapshot.release()
+			for i, slave := range targets {
+				if w.errs[i] != nil {
+					fmt.Printf("Diskless rdb transfer to replica %s failed: %s\n", slave.replicationGetSlaveName(), w.errs[i])
+					slave.close()
+				}
+			}
+			server.backgroundSaveDoneHandler(err)
+		})
+	}()
+	return nil
+}
+
+// slavesSocketsWriter writes the same RDB to the replicas of a diskless
+// sync. A replica whose connection fails is dropped, the others go on.
+type slavesSocketsWriter struct {
+	slaves []*RedisClient
+	errs   []error
+}
+
+func (w *slavesSocketsWriter) Write(p []byte) (int, error) {
+	alive := false
+	for i, slave := range w.slaves {
+		if w.errs[i] != nil {
+			continue
+		}
+		if _, err := slave.Conn.Write(p); err != nil {
+			w.errs[i] = err
+			continue
+		}
+		alive = true
+	}
+	if !alive {
+		return 0, errors.New("no replica left to transfer the RDB to")
+	}
+	return len(p), nil
+}
+
+func (w *slavesSocketsWriter) sendSnapshot(snapshot *rdbSnapshot, mark string) error {
+	// the +FULLRESYNC reply goes out first
+	for i, slave := range w.slaves {
+		if !slave.waitPendingWrites() {
+			w.errs[i] = errors.New("connection closed")
+		}
+	}
+
+	rdb := &rdbWriter{w: bufio.NewWriter(w), compression: snapshot.compression}
+	if _, err := rdb.w.WriteString("$EOF:" + mark + "\r\n"); err != nil {
+		return err
+	}
+	if err := rdb.saveSnapshot(snapshot); err != nil {
+		return err
+	}
+	if _, err := rdb.w.WriteString(mark); err != nil {
+		return err
+	}
+	return rdb.w.Flush()
+}
+
+// sendBulkToSlave streams the RDB file to the replica. Nothing else is
+// written to the replica meanwhile, the stream is held until it is online.
+func (server *RedisServer) sendBulkToSlave(client *RedisClient, filename string) {
+	go func() {
+		err := client.sendRdbFile(filename)
+		server.runOnExecutor(func() {
+			if err != nil {
+				fmt.Printf("Write error sending DB to replica %s: %s\n", client.replicationGetSlaveName(), err)
+				client.close()
+				server.replicationPruneSlaves()
+				return
+			}
+			server.replicationPutSlaveOnline(client)
+			server.replicaStartCommandStream(client)
+		})
+	}()
+}
+
+func (client *RedisClient) sendRdbFile(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	// the +FULLRESYNC reply and the newlines go out first
+	if !client.waitPendingWrites() {
+		return errors.New("connection closed")
+	}
+	if _, err := fmt.Fprintf(client.Conn, "$%d\r\n", stat.Size()); err != nil {
+		return err
+	}
+	_, err = io.Copy(client.Conn, file)
+	return err
+}
+
+func (server *RedisServer) replicationPutSlaveOnline(client *RedisClient) {
+	client.replState = SLAVE_STATE_ONLINE
+	client.replAckTime = server.UnixTime
+	fmt.Printf("Synchronization with replica %s succeeded\n", client.replicationGetSlaveName())
+}
+
+// replicaStartCommandStream sends the stream held since the full sync began
+func (server *RedisServer) replicaStartCommandStream(client *RedisClient) {
+	client.replStreamOnAck = false
+	client.addReply(client.replHeld.Bytes())
+	client.replHeld = nil
+}
+
+// replicationPruneSlaves forgets the replicas whose connection was closed
+func (server *RedisServer) replicationPruneSlaves() {
+	if len(server.repl.slaves) == 0 {
+		return
+	}
+	defer func() {
+		if len(server.repl.slaves) == 0 {
+			server.repl.noSlavesSince = server.UnixTime
+		}
+	}()
+
+	slaves := server.repl.slaves[:0]
+	for _, slave := range server.repl.slaves {
+		if slave.isClosed() {
+			fmt.Printf("Connection with replica %s lost.\n", slave.replicationGetSlaveName())
+			continue
+		}
+		slaves = append(slaves, slave)
+	}
+	for i := len(slaves); i < len(server.repl.slaves); i++ {
+		server.repl.slaves[i] = nil
+	}
+	server.repl.slaves = slaves
+}
+
+// disconnectSlaves makes the replicas sync again, when our own history changes
+func (server *RedisServer) disconnectSlaves() {
+	for _, slave := range server.repl.slaves {
+		slave.close()
+	}
+	server.replicationPruneSlaves()
+}
+
+// handleReplconfCommand receives the settings of a replica before its sync,
+// and the acknowledgements of the stream once it is online
+func (server *RedisServer) handleReplconfCommand(cmd string, args []interface{}) []byte {
+	if len(args)%2 != 0 {
+		return []byte("-ERR syntax error\r\n")
+	}
+
+	client := server.currentClient
+	for i := 0; i < len(args); i += 2 {
+		option, _ := args[i].(string)
+		value, _ := args[i+1].(string)
+
+		switch strings.ToLower(option) {
+		case "listening-port":
+			port, err := strconv.Atoi(value)
+			if err != nil || port < 0 || port > 65535 {
+				return []byte("-ERR value is not an integer or out of range\r\n")
+			}
+			client.replListeningPort = port
+		case "ip-address":
+			if len(value) >= NET_HOST_STR_LEN {
+				return []byte("-ERR REPLCONF ip-address provided by replica instance is too long\r\n")
+			}
+			client.replAddr = value
+		case "capa":
+			// capabilities we don't know about are ignored
+			switch strings.ToLower(value) {
+			case "eof":
+				client.replCapa |= SLAVE_CAPA_EOF
+			case "psync2":
+				client.replCapa |= SLAVE_CAPA_PSYNC2
+			}
+		case "ack":
+			// acknowledgements of the replica never get a reply
+			if client.Flags&CLIENT_SLAVE == 0 {
+				return nil
+			}
+			if offset, err := strconv.ParseInt(value, 10, 64); err == nil && offset > client.replAckOff {
+				client.replAckOff = offset
+			}
+			client.replAckTime = server.UnixTime
+			server.refreshGoodSlavesCount()
+			// the replica loaded the RDB it received from its socket
+			if client.replStreamOnAck && client.replState == SLAVE_STATE_ONLINE {
+				server.replicaStartCommandStream(client)
+			}
+			return nil
+		case "getack":
+			// our master wants to know where we are
+			if client == server.repl.master {
+				server.replicationSendAck()
+			}
+			return nil
+		default:
+			return []byte(fmt.Sprintf("-ERR Unrecognized REPLCONF option: %s\r\n", option))
+		}
+	}
+	return []byte("+OK\r\n")
+}
+
+// replicationCountAcksByOffset is the number of replicas that acknowledged
+// the stream up to offset
+func (server *RedisServer) replicationCountAcksByOffset(offset int64) int {
+	count := 0
+	for _, slave := range server.repl.slaves {
+		if slave.replState == SLAVE_STATE_ONLINE && slave.replAckOff >= offset {
+			count++
+		}
+	}
+	return count
+}
+
+// handleWaitCommand blocks the client until numreplicas replicas acknowledged
+// its writes, or the timeout in milliseconds elapsed. The reply is the number
+// of replicas that did.
+func (server *RedisServer) handleWaitCommand(cmd string, args []interface{}) []byte {
+	if len(args) != 2 {
+		return addReplyErrorArity()
+	}
+
+	if server.Config.MasterHost != "" {
+		return []byte("-ERR WAIT cannot be used with replica instances. Please also note that since Redis 4.0 if a replica is configured to be writable (which is not the default) writes to replicas are just local and are not propagated.\r\n")
+	}
+
+	numArg, _ := args[0].(string)
+	numreplicas, err := strconv.Atoi(numArg)
+	if err != nil {
+		return []byte("-ERR value is not an integer or out of range\r\n")
+	}
+	timeoutArg, _ := args[1].(string)
+	timeout, err := strconv.ParseInt(timeoutArg, 10, 64)
+	if err != nil {
+		return []byte("-ERR timeout is not an integer or out of range\r\n")
+	}
+	if timeout < 0 {
+		return []byte("-ERR timeout is negative\r\n")
+	}
+
+	client := server.currentClient
+	offset := client.woff
+	ackreplicas := server.replicationCountAcksByOffset(offset)
+	if ackreplicas >= numreplicas || client.Flags&CLIENT_DENY_BLOCKING != 0 {
+		return addReplyLongLong(int64(ackreplicas))
+	}
+
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(time.Duration(timeout) * time.Millisecond)
+	}
+	client.bstate.reploffset = offset
+	client.bstate.numreplicas = numreplicas
+	server.blockClient(client, BLOCKED_WAIT, deadline)
+
+	// the replicas are asked for an ACK before we sleep
+	server.getAckFromSlaves = true
+	return nil
+}
+
+// processClientsWaitingReplicas unblocks the clients in WAIT whose writes
+// were acknowledged by enough replicas
+func (server *RedisServer) processClientsWaitingReplicas() {
+	waiting := append([]*RedisClient(nil), server.clientsWaitingAcks...)
+	for _, client := range waiting {
+		ackreplicas := server.replicationCountAcksByOffset(client.bstate.reploffset)
+		if ackreplicas >= client.bstate.numreplicas {
+			server.unblockClient(client, addReplyLongLong(int64(ackreplicas)))
+		}
+	}
+}
+
+// refreshGoodSlavesCount counts the online replicas whose last ACK is at
+// most min-replicas-max-lag seconds old, for min-replicas-to-write
+func (server *RedisServer) refreshGoodSlavesCount() {
+	if server.Config.MinReplicasToWrite == 0 || server.Config.MinReplicasMaxLag == 0 {
+		return
+	}
+
+	good := 0
+	maxLag := time.Duration(server.Config.MinReplicasMaxLag) * time.Second
+	for _, slave := range server.repl.slaves {
+		if slave.replState == SLAVE_STATE_ONLINE && server.UnixTime.Sub(slave.replAckTime) <= maxLag {
+			good++
+		}
+	}
+	server.repl.goodSlavesCount = good
+}
+
+// checkGoodReplicasStatus tells if a master has enough good replicas to
+// accept writes
+func (server *RedisServer) checkGoodReplicasStatus() bool {
+	return server.Config.MasterHost != "" ||
+		server.Config.MinReplicasToWrite == 0 ||
+		server.Config.MinReplicasMaxLag == 0 ||
+		server.repl.goodSlavesCount >= server.Config.MinReplicasToWrite
+}
+
+// handleRoleCommand tells what the server is in the replication topology,
+// with its replicas when it is a master or the state of its link otherwise
+func (server *RedisServer) handleRoleCommand(cmd string, args []interface{}) []byte {
+	if len(args) != 0 {
+		return addReplyErrorArity()
+	}
+
+	if server.sentinel != nil {
+		return server.sentinelRoleReply()
+	}
+
+	repl := &server.repl
+	if server.Config.MasterHost == "" {
+		slaves := []interface{}{}
+		for _, slave := range repl.slaves {
+			if slave.replState != SLAVE_STATE_ONLINE {
+				continue
+			}
+			ip := slave.replicationGetSlaveIp()
+			if ip == "" {
+				continue
+			}
+			slaves = append(slaves, []interface{}{
+				ip, strconv.Itoa(slave.replListeningPort), strconv.FormatInt(slave.replAckOff, 10),
+			})
+		}
+		return addReplyValue([]interface{}{"master", repl.masterReplOffset, slaves})
+	}
+
+	state := "unknown"
+	switch repl.state {
+	case REPL_STATE_NONE:
+		state = "none"
+	case REPL_STATE_CONNECT:
+		state = "connect"
+	case REPL_STATE_CONNECTING:
+		state = "connecting"
+	case REPL_STATE_TRANSFER:
+		state = "sync"
+	case REPL_STATE_CONNECTED:
+		state = "connected"
+	}
+	offset := int64(-1)
+	if repl.master != nil {
+		offset = repl.masterReplOffset
+	}
+	return addReplyValue([]interface{}{"slave", server.Config.MasterHost, server.Config.MasterPort, state, offset})
+}
+
+// handleFailoverCommand starts a coordinated switch of the master role to a
+// replica: writes are paused until the target caught up with our offset,
+// then we become its replica
+func (server *RedisServer) handleFailoverCommand(cmd string, args []interface{}) []byte {
+	if server.cluster != nil {
+		return []byte("-ERR FAILOVER not allowed in cluster mode.\r\n")
+	}
+
+	host, port := "", 0
+	force, abort := false, false
+	timeout := int64(0)
+	for i := 0; i < len(args); i++ {
+		option, _ := args[i].(string)
+		switch {
+		case strings.EqualFold(option, "TO") && i+2 < len(args) && host == "":
+			host, _ = args[i+1].(string)
+			portArg, _ := args[i+2].(string)
+			n, err := strconv.Atoi(portArg)
+			if err != nil || n < 0 || n > 65535 {
+				return []byte("-ERR Invalid port\r\n")
+			}
+			port = n
+			i += 2
+		case strings.EqualFold(option, "TIMEOUT") && i+1 < len(args) && timeout == 0:
+			timeoutArg, _ := args[i+1].(string)
+			n, err := strconv.ParseInt(timeoutArg, 10, 64)
+			if err != nil {
+				return []byte("-ERR value is not an integer or out of range\r\n")
+			}
+			if n <= 0 {
+				return []byte("-ERR FAILOVER timeout must be greater than 0\r\n")
+			}
+			timeout = n
+			i++
+		case strings.EqualFold(option, "FORCE") && !force:
+			force = true
+		case strings.EqualFold(option, "ABORT") && !abort:
+			abort = true
+		default:
+			return []byte("-ERR syntax error\r\n")
+		}
+	}
+
+	repl := &server.repl
+	if abort {
+		if force || timeout > 0 || host != "" {
+			return []byte("-ERR FAILOVER abort should not be used with other options.\r\n")
+		}
+		if repl.failoverState == NO_FAILOVER {
+			return []byte("-ERR No failover in progress.\r\n")
+		}
+		server.abortFailover("Failover manually aborted")
+		return []byte("+OK\r\n")
+	}
+
+	if force && (timeout == 0 || host == "") {
+		return []byte("-ERR FAILOVER with force option requires both a timeout and target HOST and IP.\r\n")
+	}
+	if server.Config.MasterHost != "" {
+		return []byte("-ERR FAILOVER is not valid when server is a replica.\r\n")
+	}
+	if len(repl.slaves) == 0 {
+		return []byte("-ERR FAILOVER requires connected replicas.\r\n")
+	}
+	if repl.failoverState != NO_FAILOVER {
+		return []byte("-ERR FAILOVER already in progress.\r\n")
+	}
+
+	if host != "" {
+		target := server.findReplicaByAddr(host, port)
+		if target == nil {
+			return []byte("-ERR FAILOVER target HOST and PORT is not a replica.\r\n")
+		}
+		if target.replState != SLAVE_STATE_ONLINE {
+			return []byte("-ERR FAILOVER target replica is not online.\r\n")
+		}
+		fmt.Printf("FAILOVER requested to %s:%d.\n", host, port)
+	} else {
+		fmt.Println("FAILOVER requested to any replica.")
+	}
+
+	repl.failoverHost, repl.failoverPort = host, port
+	repl.failoverForce = force
+	repl.failoverEndTime = time.Time{}
+	if timeout > 0 {
+		repl.failoverEndTime = time.Now().Add(time.Duration(timeout) * time.Millisecond)
+	}
+	repl.failoverState = FAILOVER_WAIT_FOR_SYNC
+	server.pauseClients(PAUSE_DURING_FAILOVER, time.Time{}, CLIENT_PAUSE_WRITE)
+	return []byte("+OK\r\n")
+}
+
+// findReplicaByAddr finds the replica with the address it listens on
+func (server *RedisServer) findReplicaByAddr(host string, port int) *RedisClient {
+	for _, slave := range server.repl.slaves {
+		if slave.replicationGetSlaveIp() == host && slave.replListeningPort == port {
+			return slave
+		}
+	}
+	return nil
+}
+
+// updateFailoverStatus switches to the target of a FAILOVER once it acked
+// all our stream, or gives up when the timeout elapsed first
+func (server *RedisServer) updateFailoverStatus() {
+	repl := &server.repl
+	if repl.failoverState != FAILOVER_WAIT_FOR_SYNC {
+		return
+	}
+
+	if !repl.failoverEndTime.IsZero() && !time.Now().Before(repl.failoverEndTime) {
+		if !repl.failoverForce {
+			server.abortFailover("Replica never caught up before timeout")
+			return
+		}
+		fmt.Printf("FAILOVER to %s:%d timed out, forcing the failover.\n", repl.failoverHost, repl.failoverPort)
+	} else {
+		var target *RedisClient
+		if repl.failoverHost != "" {
+			target = server.findReplicaByAddr(repl.failoverHost, repl.failoverPort)
+		} else {
+			for _, slave := range repl.slaves {
+				if slave.replState == SLAVE_STATE_ONLINE && slave.replAckOff == repl.masterReplOffset {
+					target = slave
+					break
+				}
+			}
+		}
+		if target == nil || target.replState != SLAVE_STATE_ONLINE || target.replAckOff != repl.masterReplOffset {
+			return
+		}
+		if repl.failoverHost == "" {
+			repl.failoverHost = target.replicationGetSlaveIp()
+			repl.failoverPort = target.replListeningPort
+		}
+		fmt.Printf("Failover target %s:%d is synced, failing over.\n", repl.failoverHost, repl.failoverPort)
+	}
+
+	repl.failoverState = FAILOVER_IN_PROGRESS
+	server.replicationSetMaster(repl.failoverHost, repl.failoverPort)
+}
+
+// abortFailover resumes as a master, and lets the paused writes go on
+func (server *RedisServer) abortFailover(reason string) {
+	repl := &server.repl
+	if repl.failoverState == NO_FAILOVER {
+		return
+	}
+
+	if repl.failoverHost != "" {
+		fmt.Printf("FAILOVER to %s:%d aborted: %s\n", repl.failoverHost, repl.failoverPort, reason)
+	} else {
+		fmt.Printf("FAILOVER to any replica aborted: %s\n", reason)
+	}
+	if repl.failoverState == FAILOVER_IN_PROGRESS {
+		server.replicationUnsetMaster()
+	}
+	server.clearFailoverState()
+}
+
+func (server *RedisServer) clearFailoverState() {
+	repl := &server.repl
+	repl.failoverState = NO_FAILOVER
+	repl.failoverEndTime = time.Time{}
+	repl.failoverForce = false
+	repl.failoverHost, repl.failoverPort = "", 0
+	server.unpauseClients(PAUSE_DURING_FAILOVER)
+}
+
+func getFailoverStateString(state int) string {
+	switch state {
+	case FAILOVER_WAIT_FOR_SYNC:
+		return "waiting-for-sync"
+	case FAILOVER_IN_PROGRESS:
+		return "failover-in-progress"
+	default:
+		return "no-failover"
+	}
+}
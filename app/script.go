@@ -0,0 +1,313 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Flags of the script running
+const (
+	SCRIPT_WRITE_DIRTY = 1 << iota // it already ran a write command
+	SCRIPT_TIMEDOUT                // it runs past busy-reply-threshold
+	SCRIPT_KILLED                  // SCRIPT KILL asked it to stop
+	SCRIPT_EVAL_MODE               // it is an EVAL, not a function
+	SCRIPT_READ_ONLY               // it can't write, like EVAL_RO
+)
+
+// Flags a script declares, the ones of the functions given to
+// redis.register_function
+const (
+	SCRIPT_FLAG_NO_WRITES = 1 << iota
+	SCRIPT_FLAG_ALLOW_OOM
+	SCRIPT_FLAG_ALLOW_STALE
+	SCRIPT_FLAG_NO_CLUSTER
+	SCRIPT_FLAG_ALLOW_CROSS_SLOT
+)
+
+var scriptFlagsDef = []struct {
+	flag int
+	name string
+}{
+	{SCRIPT_FLAG_NO_WRITES, "no-writes"},
+	{SCRIPT_FLAG_ALLOW_OOM, "allow-oom"},
+	{SCRIPT_FLAG_ALLOW_STALE, "allow-stale"},
+	{SCRIPT_FLAG_NO_CLUSTER, "no-cluster"},
+	{SCRIPT_FLAG_ALLOW_CROSS_SLOT, "allow-cross-slot-keys"},
+}
+
+// The default of busy-reply-threshold, in milliseconds
+const CONFIG_DEFAULT_BUSY_REPLY_THRESHOLD = 5000
+
+// scriptRunCtx is the script being run: who called it, and the client its
+// commands run as
+type scriptRunCtx struct {
+	funcname string
+	caller   *RedisClient
+	client   *RedisClient
+	start    time.Time
+	flags    int
+
+	// where its commands are propagated, changed with redis.set_repl
+	replFlags int
+
+	// the script is replicated by its effects, the commands it ran. The
+	// first one waits for a second to know whether they need a MULTI.
+	pending         *scriptPropagated
+	multiPropagated bool
+}
+
+type scriptPropagated struct {
+	cmd    string
+	args   []interface{}
+	target int
+}
+
+// scriptPrepareForRun makes the script the one running, flags telling
+// whether it is an EVAL
+func (server *RedisServer) scriptPrepareForRun(funcname string, caller, client *RedisClient, flags int) {
+	server.script = &scriptRunCtx{
+		funcname: funcname,
+		caller:   caller,
+		client:   client,
+		start:    time.Now(),
+		flags:    flags,
+
+		replFlags: PROPAGATE_AOF | PROPAGATE_REPL,
+	}
+}
+
+// scriptResetRun ends the script running. Its caller, and our master, may
+// have sent commands that waited for it to end.
+func (server *RedisServer) scriptResetRun() {
+	run := server.script
+	server.script = nil
+
+	if run.pending != nil {
+		server.propagateNow(run.pending.cmd, run.pending.args, run.pending.target)
+	}
+	if run.multiPropagated {
+		server.propagate("EXEC", nil)
+	}
+
+	if run.flags&SCRIPT_TIMEDOUT != 0 {
+		for _, client := range []*RedisClient{run.caller, server.repl.master} {
+			if client != nil && len(client.deferred) > 0 && client.Flags&CLIENT_BLOCKED == 0 {
+				server.unblockedClients = append(server.unblockedClients, client)
+			}
+		}
+	}
+}
+
+// scriptIsTimedout tells whether a script runs past busy-reply-threshold,
+// in which case the other clients get -BUSY
+func (server *RedisServer) scriptIsTimedout() bool {
+	return server.script != nil && server.script.flags&SCRIPT_TIMEDOUT != 0
+}
+
+// scriptIsEval tells whether the script running is an EVAL, killed with
+// SCRIPT KILL, rather than a function killed with FUNCTION KILL
+func (server *RedisServer) scriptIsEval() bool {
+	return server.script != nil && server.script.flags&SCRIPT_EVAL_MODE != 0
+}
+
+// scriptBusyError is the -BUSY error of the commands rejected while the
+// script is busy, telling how to kill it
+func (server *RedisServer) scriptBusyError() []byte {
+	if server.scriptIsEval() {
+		return []byte("-BUSY Redis is busy running a script. You can only call SCRIPT KILL or SHUTDOWN NOSAVE.\r\n")
+	}
+	return []byte("-BUSY Redis is busy running a script. You can only call FUNCTION KILL or SHUTDOWN NOSAVE.\r\n")
+}
+
+// scriptIsWaiting tells whether the commands of the client wait for the
+// script to end: its caller, and our master once the script is busy
+func (server *RedisServer) scriptIsWaiting(client *RedisClient) bool {
+	if server.script == nil {
+		return false
+	}
+	return client == server.script.caller || (client.Flags&CLIENT_MASTER != 0 && server.scriptIsTimedout())
+}
+
+// scriptInterrupt is called from time to time while a script runs. Once it
+// ran for busy-reply-threshold the other clients are served meanwhile, so
+// they can kill it. It returns true when the script must stop.
+func (server *RedisServer) scriptInterrupt() bool {
+	run := server.script
+	if run.flags&SCRIPT_TIMEDOUT == 0 {
+		elapsed := time.Since(run.start)
+		if elapsed < time.Duration(server.Config.BusyReplyThreshold)*time.Millisecond {
+			return false
+		}
+		killCommand := "FUNCTION KILL"
+		if run.flags&SCRIPT_EVAL_MODE != 0 {
+			killCommand = "SCRIPT KILL"
+		}
+		fmt.Printf("Slow script detected: still in execution after %d milliseconds. "+
+			"You can try killing the script using the %s command. Script name is: %s.\n",
+			elapsed.Milliseconds(), killCommand, run.funcname)
+		run.flags |= SCRIPT_TIMEDOUT
+	}
+
+	// the commands run meanwhile have their own client
+	caller := server.currentClient
+	server.processEventsWhileBlocked()
+	server.currentClient = caller
+
+	return run.flags&SCRIPT_KILLED != 0
+}
+
+// scriptKill stops the script running, for SCRIPT KILL when isEval and
+// FUNCTION KILL otherwise. One that wrote to the dataset must complete, or
+// the dataset would be left halfway.
+func (server *RedisServer) scriptKill(isEval bool) []byte {
+	run := server.script
+	if run == nil {
+		return []byte("-NOTBUSY No scripts in execution right now.\r\n")
+	}
+	if run.caller != nil && run.caller.Flags&CLIENT_MASTER != 0 {
+		return []byte("-UNKILLABLE The busy script was sent by a master instance in the context of replication and cannot be killed.\r\n")
+	}
+	if run.flags&SCRIPT_WRITE_DIRTY != 0 {
+		return []byte("-UNKILLABLE Sorry the script already executed write commands against the dataset. " +
+			"You can either wait the script termination or kill the server in a hard way using the SHUTDOWN NOSAVE command.\r\n")
+	}
+	if run.flags&SCRIPT_EVAL_MODE == 0 && isEval {
+		return []byte("-BUSY Redis is busy running a script. You can only call FUNCTION KILL or SHUTDOWN NOSAVE.\r\n")
+	}
+	if run.flags&SCRIPT_EVAL_MODE != 0 && !isEval {
+		return []byte("-BUSY Redis is busy running a script. You can only call SCRIPT KILL or SHUTDOWN NOSAVE.\r\n")
+	}
+	run.flags |= SCRIPT_KILLED
+	return []byte("+OK\r\n")
+}
+
+// scriptCall runs a command for the script running, as its client. The
+// reply is the one a client would get, errors included.
+func (server *RedisServer) scriptCall(cmd string, args []interface{}) []byte {
+	run := server.script
+	command, ok := redisCommandTable[cmd]
+	if !ok {
+		return []byte("-ERR Unknown Redis command called from script\r\n")
+	}
+	if (command.Arity > 0 && len(args)+1 != command.Arity) || len(args)+1 < -command.Arity {
+		return []byte("-ERR Wrong number of args calling Redis command from script\r\n")
+	}
+	if command.CmdFlags&CMD_NOSCRIPT != 0 {
+		return []byte("-ERR This Redis command is not allowed from script\r\n")
+	}
+	// the script runs the commands as the user that called it
+	if run.caller != nil && run.caller.Flags&CLIENT_MASTER == 0 {
+		if result, errArg := server.aclCheckAllPerm(run.caller, command, cmd, args); result != ACL_OK {
+			server.addAclLogDenial(run.caller, result, ACL_LOG_CTX_LUA, cmd, errArg)
+			msg := aclErrorMessage(result, run.caller.getUser(), cmd, errArg, false)
+			return []byte("-ERR ACL failure in script: " + msg + "\r\n")
+		}
+	}
+	if command.CmdFlags&CMD_WRITE != 0 {
+		if reply := server.scriptVerifyWriteCommandAllow(run); reply != nil {
+			return reply
+		}
+		run.flags |= SCRIPT_WRITE_DIRTY
+	}
+	if reply := server.scriptVerifyClusterState(run, command, cmd, args); reply != nil {
+		return reply
+	}
+
+	// the command is propagated on its own, like the ones of EXEC, and
+	// leaves what the script propagates as it was
+	caller := server.currentClient
+	dirty := server.Dirty
+	propagateCmd, propagateArgs := server.propagateCmd, server.propagateArgs
+	server.propagateCmd, server.propagateArgs = "", nil
+	server.currentClient = run.client
+	start := time.Now()
+	reply := command.Function(server, cmd, args)
+	server.updateCommandStats(command, time.Since(start), reply)
+	server.currentClient = caller
+	if server.Dirty != dirty && run.replFlags != 0 {
+		if server.propagateCmd != "" {
+			server.scriptPropagate(server.propagateCmd, server.propagateArgs, run.replFlags)
+		} else {
+			server.scriptPropagate(cmd, args, run.replFlags)
+		}
+	}
+	server.propagateCmd, server.propagateArgs = propagateCmd, propagateArgs
+
+	if reply == nil {
+		return []byte("$-1\r\n")
+	}
+	return reply
+}
+
+// scriptVerifyWriteCommandAllow tells why the script can't run a write
+// command, if it can't: it is read-only, or the server doesn't take writes
+func (server *RedisServer) scriptVerifyWriteCommandAllow(run *scriptRunCtx) []byte {
+	if run.flags&SCRIPT_READ_ONLY != 0 {
+		return []byte("-ERR Write commands are not allowed from read-only scripts.\r\n")
+	}
+
+	// the scripts of our master, and the ones replayed from the AOF, write
+	// like the commands they ran there
+	if run.caller == nil || run.caller.Flags&CLIENT_MASTER != 0 {
+		return nil
+	}
+	if reason := server.writeCommandsDeniedByDiskError(); reason != "" {
+		return []byte(reason)
+	}
+	if server.Config.MasterHost != "" && server.Config.ReplicaReadOnly {
+		return []byte("-READONLY You can't write against a read only replica.\r\n")
+	}
+	return nil
+}
+
+// scriptVerifyClusterState keeps the script to the keys this node serves,
+// in the slot of the keys it was called with
+func (server *RedisServer) scriptVerifyClusterState(run *scriptRunCtx, command RedisCommand, cmd string, args []interface{}) []byte {
+	if server.cluster == nil || run.caller == nil || run.caller.Flags&CLIENT_MASTER != 0 {
+		return nil
+	}
+	node, _, errorCode := server.getNodeByQuery(run.client, command, cmd, args)
+	switch errorCode {
+	case CLUSTER_REDIR_NONE:
+		if node == server.cluster.myself {
+			return nil
+		}
+	case CLUSTER_REDIR_DOWN_RO_STATE:
+		return []byte("-ERR Script attempted to execute a write command while the cluster is down and readonly\r\n")
+	case CLUSTER_REDIR_DOWN_STATE:
+		return []byte("-ERR Script attempted to execute a command while the cluster is down\r\n")
+	case CLUSTER_REDIR_CROSS_SLOT:
+		return []byte(fmt.Sprintf("-ERR Command '%s' in script attempted to access keys that do not hash to the same slot\r\n", strings.ToLower(cmd)))
+	}
+	return []byte("-ERR Script attempted to access a non local key in a cluster node script\r\n")
+}
+
+// scriptPropagate propagates a command run by the script. When it runs more
+// than one they are wrapped in a MULTI, so the replicas and the AOF apply
+// them at once. The args are kept, they must not be pooled.
+func (server *RedisServer) scriptPropagate(cmd string, args []interface{}, target int) {
+	run := server.script
+
+	// EXEC already wraps what it runs
+	if server.inExec {
+		if !server.execMultiPropagated {
+			server.propagate("MULTI", nil)
+			server.execMultiPropagated = true
+		}
+		server.propagateNow(cmd, args, target)
+		return
+	}
+
+	if run.pending == nil && !run.multiPropagated {
+		run.pending = &scriptPropagated{cmd, args, target}
+		return
+	}
+	if !run.multiPropagated {
+		server.propagate("MULTI", nil)
+		server.propagateNow(run.pending.cmd, run.pending.args, run.pending.target)
+		run.pending = nil
+		run.multiPropagated = true
+	}
+	server.propagateNow(cmd, args, target)
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Levels of redis.log, as the verbosity of the server log
+const (
+	LL_DEBUG = iota
+	LL_VERBOSE
+	LL_NOTICE
+	LL_WARNING
+)
+
+// a reply nested deeper than this can't be converted, e.g. a table holding
+// itself
+const luaMaxReplyDepth = 1000
+
+// luaErrorTable is the error of the redis lib, {err="CODE message"}. The
+// message may be a Redis error reply, keeping its code, or just a message
+// getting the ERR code.
+func luaErrorTable(msg string) *luaTable {
+	code := "ERR"
+	if strings.HasPrefix(msg, "-") {
+		if i := strings.IndexByte(msg, ' '); i >= 0 {
+			code, msg = msg[1:i], msg[i+1:]
+		} else {
+			msg = msg[1:]
+		}
+	}
+	msg = strings.Trim(msg, "\r\n")
+
+	t := newLuaTable(0, 1)
+	t.set("err", code+" "+msg)
+	return t
+}
+
+// luaStatusTable is a status reply, {ok="OK"}
+func luaStatusTable(status string) *luaTable {
+	t := newLuaTable(0, 1)
+	t.set("ok", status)
+	return t
+}
+
+// luaWrapTable puts a value in a table under the field, like {map={...}}
+func luaWrapTable(field string, value luaValue) *luaTable {
+	t := newLuaTable(0, 1)
+	t.set(field, value)
+	return t
+}
+
+// scriptingInit creates the interpreter the scripts run in: the libraries
+// of Lua, the redis lib, and the globals protected from the scripts
+func (server *RedisServer) scriptingInit() {
+	L := server.luaCreateState()
+	server.lua.L = L
+	server.lua.scripts = make(map[string]*evalScript)
+	server.lua.client = server.createScriptClient()
+
+	luaSetGlobalsProtection(L, L.globals)
+	L.hook = server.luaMaskCountHook
+}
+
+// createScriptClient is the client the scripts run their commands as, it
+// never blocks
+func (server *RedisServer) createScriptClient() *RedisClient {
+	return &RedisClient{
+		ID:     atomic.AddUint64(&nextClientID, 1),
+		Flags:  CLIENT_SCRIPT | CLIENT_DENY_BLOCKING,
+		server: server,
+		resp:   2,
+	}
+}
+
+// luaCreateState creates an interpreter with the libraries of Lua, the
+// helper libraries of Redis (cjson, struct and bit) and the redis lib
+func (server *RedisServer) luaCreateState() *luaState {
+	L := newLuaState()
+	L.openCjsonLib()
+	L.openStructLib()
+	L.openBitLib()
+
+	lib := newLuaTable(0, 16)
+	L.globals.set("redis", lib)
+	L.register(lib, "call", func(L *luaState, args []luaValue) []luaValue {
+		return []luaValue{server.luaRedisGenericCommand(L, args, true)}
+	})
+	L.register(lib, "pcall", func(L *luaState, args []luaValue) []luaValue {
+		return []luaValue{server.luaRedisGenericCommand(L, args, false)}
+	})
+	L.register(lib, "error_reply", func(L *luaState, args []luaValue) []luaValue {
+		msg, ok := luaArg(args, 1).(string)
+		if len(args) != 1 || !ok {
+			L.raise(luaErrorTable("wrong number or type of arguments"))
+		}
+		if !strings.HasPrefix(msg, "-") {
+			msg = "-" + msg
+		}
+		return []luaValue{luaErrorTable(msg)}
+	})
+	L.register(lib, "status_reply", func(L *luaState, args []luaValue) []luaValue {
+		status, ok := luaArg(args, 1).(string)
+		if len(args) != 1 || !ok {
+			L.raise(luaErrorTable("wrong number or type of arguments"))
+		}
+		return []luaValue{luaStatusTable(status)}
+	})
+	luaRegisterLogFunction(L, lib)
+	L.register(lib, "setresp", func(L *luaState, args []luaValue) []luaValue {
+		if len(args) != 1 {
+			L.raise(luaErrorTable("redis.setresp() requires one argument."))
+		}
+		resp, ok := luaToNumber(args[0])
+		if !ok || (resp != 2 && resp != 3) {
+			L.raise(luaErrorTable("RESP version must be 2 or 3."))
+		}
+		server.script.client.resp = int(resp)
+		return nil
+	})
+	L.register(lib, "set_repl", func(L *luaState, args []luaValue) []luaValue {
+		if len(args) != 1 {
+			L.raise(luaErrorTable("redis.set_repl() requires one argument."))
+		}
+		flags, _ := luaToNumber(args[0])
+		if int(flags)&^(PROPAGATE_AOF|PROPAGATE_REPL) != 0 {
+			L.raise(luaErrorTable("Invalid replication flags. Use REPL_AOF, REPL_REPLICA, REPL_ALL or REPL_NONE."))
+		}
+		server.script.replFlags = int(flags)
+		return nil
+	})
+	L.register(lib, "sha1hex", func(L *luaState, args []luaValue) []luaValue {
+		if len(args) != 1 {
+			L.raise(luaErrorTable("wrong number of arguments"))
+		}
+		s, _ := luaToString(args[0])
+		return []luaValue{sha1hex(s)}
+	})
+	// scripts are always replicated by their effects, this is a no-op kept
+	// for the scripts written for the older versions
+	L.register(lib, "replicate_commands", func(L *luaState, args []luaValue) []luaValue {
+		return []luaValue{true}
+	})
+	lib.set("REPL_NONE", float64(0))
+	lib.set("REPL_AOF", float64(PROPAGATE_AOF))
+	lib.set("REPL_SLAVE", float64(PROPAGATE_REPL))
+	lib.set("REPL_REPLICA", float64(PROPAGATE_REPL))
+	lib.set("REPL_ALL", float64(PROPAGATE_AOF|PROPAGATE_REPL))
+	luaRegisterVersion(lib)
+	return L
+}
+
+// luaRegisterLogFunction adds redis.log and its levels to the lib
+func luaRegisterLogFunction(L *luaState, lib *luaTable) {
+	L.register(lib, "log", func(L *luaState, args []luaValue) []luaValue {
+		if len(args) < 2 {
+			L.raise(luaErrorTable("redis.log() requires two arguments or more."))
+		}
+		level, ok := args[0].(float64)
+		if !ok {
+			L.raise(luaErrorTable("First argument must be a number"))
+		}
+		if level < LL_DEBUG || level > LL_WARNING {
+			L.raise(luaErrorTable("Invalid debug level."))
+		}
+		parts := make([]string, 0, len(args)-1)
+		for _, arg := range args[1:] {
+			if s, ok := luaToString(arg); ok {
+				parts = append(parts, s)
+			}
+		}
+		if level >= LL_NOTICE {
+			fmt.Println(strings.Join(parts, " "))
+		}
+		return nil
+	})
+	lib.set("LOG_DEBUG", float64(LL_DEBUG))
+	lib.set("LOG_VERBOSE", float64(LL_VERBOSE))
+	lib.set("LOG_NOTICE", float64(LL_NOTICE))
+	lib.set("LOG_WARNING", float64(LL_WARNING))
+}
+
+func luaRegisterVersion(lib *luaTable) {
+	lib.set("REDIS_VERSION", REDIS_VERSION)
+	lib.set("REDIS_VERSION_NUM", float64(redisVersionNum()))
+}
+
+// luaSetGlobalsProtection makes the globals readonly. Scripts must not leave
+// state behind, so they can't create globals, and a typo in a variable name
+// is an error rather than a nil.
+func luaSetGlobalsProtection(L *luaState, globals *luaTable) {
+	meta := newLuaTable(0, 1)
+	L.register(meta, "__index", func(L *luaState, args []luaValue) []luaValue {
+		name, _ := luaToString(luaArg(args, 2))
+		L.runtimeError("Script attempted to access nonexistent global variable '%s'", name)
+		return nil
+	})
+	globals.meta = meta
+	luaSetTableProtectionRecursively(globals)
+}
+
+// luaMaskCountHook runs every few steps of the scripts, to serve the other
+// clients once a script is busy and to stop it when it is killed
+func (server *RedisServer) luaMaskCountHook(L *luaState) {
+	if server.script == nil || !server.scriptInterrupt() {
+		return
+	}
+	// the error is raised again at the next step, so that a pcall in the
+	// script can't keep it running
+	L.steps = luaHookEvery
+	L.raise(luaErrorTable("Script killed by user with SCRIPT KILL..."))
+}
+
+// luaSetTableProtectionRecursively makes the table readonly, along with the
+// tables it holds, like the libraries in the globals
+func luaSetTableProtectionRecursively(t *luaTable) {
+	if t.readonly {
+		return
+	}
+	t.readonly = true
+	for key, value, _ := t.next(nil); key != nil; key, value, _ = t.next(key) {
+		if inner, ok := value.(*luaTable); ok {
+			luaSetTableProtectionRecursively(inner)
+		}
+	}
+}
+
+// redisVersionNum is the version as 0x00MMmmpp, like REDIS_VERSION_NUM
+func redisVersionNum() int {
+	num := 0
+	for _, part := range strings.SplitN(REDIS_VERSION, ".", 3) {
+		n, _ := strconv.Atoi(part)
+		num = num<<8 | n
+	}
+	return num
+}
+
+// luaRedisGenericCommand is redis.call and redis.pcall: it runs the command
+// and converts its reply. An error reply is raised by redis.call, and
+// returned as an error table by redis.pcall.
+func (server *RedisServer) luaRedisGenericCommand(L *luaState, args []luaValue, raiseError bool) luaValue {
+	if len(args) == 0 {
+		L.raise(luaErrorTable("Please specify at least one argument for this redis lib call"))
+	}
+
+	argv := make([]interface{}, len(args))
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case string:
+			argv[i] = v
+		case float64:
+			argv[i] = luaNumberToString(v)
+		default:
+			return luaCommandError(L, "Lua redis lib command arguments must be strings or integers", raiseError)
+		}
+	}
+
+	reply := server.scriptCall(strings.ToUpper(argv[0].(string)), argv[1:])
+	if len(reply) > 0 && reply[0] == '-' {
+		return luaCommandError(L, string(reply), raiseError)
+	}
+	value, _ := luaRedisProtocolToValue(reply)
+	return value
+}
+
+// luaCommandError raises the error of a command for redis.call, or returns
+// it for redis.pcall
+func luaCommandError(L *luaState, msg string, raiseError bool) luaValue {
+	err := luaErrorTable(msg)
+	if raiseError {
+		L.raise(err)
+	}
+	return err
+}
+
+// luaRedisProtocolToValue converts the first reply encoded in buf to a Lua
+// value, and returns the bytes that follow it
+//
+// RESP2:
+//
+//	integer -> number, bulk string -> string, array -> table,
+//	status -> {ok=...}, error -> {err=...}, null bulk or array -> false
+//
+// RESP3 adds:
+//
+//	null -> nil, boolean -> boolean, double -> {double=number},
+//	big number -> {big_number=string}, map -> {map={...}},
+//	set -> {set={member=true}}
+func luaRedisProtocolToValue(buf []byte) (luaValue, []byte) {
+	end := bytes.Index(buf, []byte("\r\n"))
+	if end < 0 {
+		return nil, nil
+	}
+	line, rest := string(buf[1:end]), buf[end+2:]
+
+	switch buf[0] {
+	case '+':
+		return luaStatusTable(line), rest
+	case '-':
+		return luaErrorTable("-" + line), rest
+	case ':':
+		n, _ := strconv.ParseInt(line, 10, 64)
+		return float64(n), rest
+	case '$', '=':
+		n, _ := strconv.Atoi(line)
+		if n < 0 {
+			return false, rest
+		}
+		s := string(rest[:n])
+		if buf[0] == '=' && len(s) >= 4 {
+			// verbatim strings start with their format, like txt:
+			s = s[4:]
+		}
+		return s, rest[n+2:]
+	case '*', '~', '%':
+		n, _ := strconv.Atoi(line)
+		if n < 0 {
+			return false, rest
+		}
+		t := newLuaTable(0, 0)
+		if buf[0] == '*' {
+			t = newLuaTable(n, 0)
+		}
+		for i := 0; i < n; i++ {
+			var elem luaValue
+			elem, rest = luaRedisProtocolToValue(rest)
+			switch buf[0] {
+			case '*':
+				t.set(float64(i+1), elem)
+			case '~':
+				if elem != nil {
+					t.set(elem, true)
+				}
+			case '%':
+				var value luaValue
+				value, rest = luaRedisProtocolToValue(rest)
+				if elem != nil {
+					t.set(elem, value)
+				}
+			}
+		}
+		switch buf[0] {
+		case '~':
+			return luaWrapTable("set", t), rest
+		case '%':
+			return luaWrapTable("map", t), rest
+		}
+		return t, rest
+	case '_':
+		return nil, rest
+	case '#':
+		return line == "t", rest
+	case ',':
+		d, ok := luaStringToNumber(line)
+		if !ok {
+			switch line {
+			case "inf":
+				d = math.Inf(1)
+			case "-inf":
+				d = math.Inf(-1)
+			default:
+				d = math.NaN()
+			}
+		}
+		return luaWrapTable("double", d), rest
+	case '(':
+		return luaWrapTable("big_number", line), rest
+	}
+	return nil, rest
+}
+
+// luaReplyToRedisReply encodes the value returned by a script as a reply in
+// the protocol of the client:
+//
+//	string -> bulk string, number -> integer (truncated), true -> 1 or true,
+//	false -> null or false, {err=...} -> error, {ok=...} -> status,
+//	{double=...}, {big_number=...}, {map=...} and {set=...} -> their RESP3
+//	types, downgraded on RESP2, other tables -> array, up to the first nil
+func luaReplyToRedisReply(reply *bytes.Buffer, v luaValue, resp int, depth int) {
+	if depth > luaMaxReplyDepth {
+		reply.WriteString("-ERR reached lua stack limit\r\n")
+		return
+	}
+
+	switch v := v.(type) {
+	case string:
+		reply.WriteString(fmt.Sprintf("$%d\r\n%s\r\n", len(v), v))
+	case float64:
+		reply.WriteString(fmt.Sprintf(":%d\r\n", int64(v)))
+	case bool:
+		switch {
+		case resp > 2 && v:
+			reply.WriteString("#t\r\n")
+		case resp > 2:
+			reply.WriteString("#f\r\n")
+		case v:
+			reply.WriteString(":1\r\n")
+		default:
+			reply.WriteString("$-1\r\n")
+		}
+	case *luaTable:
+		if err, ok := v.getStr("err").(string); ok {
+			reply.WriteString("-" + luaSanitizeReplyLine(err) + "\r\n")
+			return
+		}
+		if status, ok := v.getStr("ok").(string); ok {
+			reply.WriteString("+" + luaSanitizeReplyLine(status) + "\r\n")
+			return
+		}
+		if d, ok := v.getStr("double").(float64); ok {
+			formatted := luaFormatDouble(d)
+			if resp > 2 {
+				reply.WriteString("," + formatted + "\r\n")
+			} else {
+				reply.WriteString(fmt.Sprintf("$%d\r\n%s\r\n", len(formatted), formatted))
+			}
+			return
+		}
+		if n, ok := v.getStr("big_number").(string); ok {
+			n = luaSanitizeReplyLine(n)
+			if resp > 2 {
+				reply.WriteString("(" + n + "\r\n")
+			} else {
+				reply.WriteString(fmt.Sprintf("$%d\r\n%s\r\n", len(n), n))
+			}
+			return
+		}
+		if m, ok := v.getStr("map").(*luaTable); ok {
+			var items bytes.Buffer
+			n := 0
+			for key, value, _ := m.next(nil); key != nil; key, value, _ = m.next(key) {
+				luaReplyToRedisReply(&items, key, resp, depth+1)
+				luaReplyToRedisReply(&items, value, resp, depth+1)
+				n++
+			}
+			if resp > 2 {
+				reply.WriteString(fmt.Sprintf("%%%d\r\n", n))
+			} else {
+				reply.WriteString(fmt.Sprintf("*%d\r\n", n*2))
+			}
+			reply.Write(items.Bytes())
+			return
+		}
+		if s, ok := v.getStr("set").(*luaTable); ok {
+			var items bytes.Buffer
+			n := 0
+			for key, _, _ := s.next(nil); key != nil; key, _, _ = s.next(key) {
+				luaReplyToRedisReply(&items, key, resp, depth+1)
+				n++
+			}
+			if resp > 2 {
+				reply.WriteString(fmt.Sprintf("~%d\r\n", n))
+			} else {
+				reply.WriteString(fmt.Sprintf("*%d\r\n", n))
+			}
+			reply.Write(items.Bytes())
+			return
+		}
+
+		n := 0
+		for v.getInt(n+1) != nil {
+			n++
+		}
+		reply.WriteString(fmt.Sprintf("*%d\r\n", n))
+		for i := 1; i <= n; i++ {
+			luaReplyToRedisReply(reply, v.getInt(i), resp, depth+1)
+		}
+	default:
+		// nil, and the values with no Redis type like functions
+		if resp > 2 {
+			reply.WriteString("_\r\n")
+		} else {
+			reply.WriteString("$-1\r\n")
+		}
+	}
+}
+
+// luaSanitizeReplyLine makes a string fit in a status or error line
+func luaSanitizeReplyLine(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
+
+// luaFormatDouble formats a double reply, with the inf and nan of the protocol
+func luaFormatDouble(d float64) string {
+	switch {
+	case math.IsInf(d, 1):
+		return "inf"
+	case math.IsInf(d, -1):
+		return "-inf"
+	case math.IsNaN(d):
+		return "nan"
+	}
+	return strconv.FormatFloat(d, 'g', -1, 64)
+}
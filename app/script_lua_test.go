@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLuaVM(t *testing.T) {
+	tests := []struct {
+		src  string
+		want []luaValue
+		err  string
+	}{
+		// arithmetic, with the coercion of the strings to numbers
+		{src: "return 1 + 2 * 3 - 4 / 2", want: []luaValue{5.0}},
+		{src: "return 2 ^ 10, 2 ^ -1", want: []luaValue{1024.0, 0.5}},
+		{src: "return 7 % 3, -7 % 3, 5 % -3, 5.5 % 2", want: []luaValue{1.0, 2.0, -1.0, 1.5}},
+		{src: "return '10' + 5, '0x10' * 1, ' 2 ' + 0", want: []luaValue{15.0, 16.0, 2.0}},
+		{src: "return 0x1F + 1, 1e2, .5", want: []luaValue{32.0, 100.0, 0.5}},
+		{src: "return 1e300 * 1e10 == math.huge", want: []luaValue{true}},
+		{src: "return 'x' + 1", err: "test:1: attempt to perform arithmetic on a string value"},
+		{src: "return nil + 1", err: "test:1: attempt to perform arithmetic on a nil value"},
+
+		// strings and their conversion from numbers
+		{src: "return 10 .. 20, 1 .. ''", want: []luaValue{"1020", "1"}},
+		{src: "return tostring(3.5), tostring(1e15), tostring(0.1), tostring(-0)", want: []luaValue{"3.5", "1e+15", "0.1", "-0"}},
+		{src: "return tostring(12345678901234)", want: []luaValue{"12345678901234"}},
+		{src: "return #'hello', #'\\0ab', #''", want: []luaValue{5.0, 3.0, 0.0}},
+		{src: "return '\\65\\t' .. \"\\\"q\\\"\", [[a\nb]]", want: []luaValue{"A\t\"q\"", "a\nb"}},
+		{src: "return ('x'):rep(3), ('abc'):upper():lower()", want: []luaValue{"xxx", "abc"}},
+		{src: "return string.sub('hello', 2, -2)", want: []luaValue{"ell"}},
+		{src: "return string.format('%5.2f|%-3s|%x|%d', 3.14159, 'a', 255, 5)", want: []luaValue{" 3.14|a  |ff|5"}},
+		{src: "return string.format('%q', 'a\\nb')", want: []luaValue{"\"a\\\nb\""}},
+		{src: "return string.find('hello world', 'o w')", want: []luaValue{5.0, 7.0}},
+		{src: "return string.find('a.b', '.', 1, true)", want: []luaValue{2.0, 2.0}},
+		{src: "return string.gsub('hello', 'l+', function(m) return #m end)", want: []luaValue{"he2o", 1.0}},
+		{src: "return string.match('key:123', '(%a+):(%d+)')", want: []luaValue{"key", "123"}},
+		{src: "return 3 .. nil", err: "test:1: attempt to concatenate a nil value"},
+
+		// comparisons
+		{src: "return 1 == 1.0, 7 == '7', 'abc' < 'abd', 'Z' < 'a'", want: []luaValue{true, false, true, true}},
+		{src: "return 1 < 'x'", err: "test:1: attempt to compare number with string"},
+		{src: "return not nil, not 0, nil and 1, false or 'd'", want: []luaValue{true, false, nil, "d"}},
+
+		// control flow, scopes and functions
+		{src: "local s = 0 for i = 1, 2, 0.5 do s = s + i end return s", want: []luaValue{4.5}},
+		{src: "local s = 0 for i = 10, 1, -3 do s = s + i end return s", want: []luaValue{22.0}},
+		{src: "local i = 0 repeat local j = i i = i + 1 until j >= 3 return i", want: []luaValue{4.0}},
+		{src: "local i = 0 while true do i = i + 1 if i == 5 then break end end return i", want: []luaValue{5.0}},
+		{src: "local function fib(n) if n < 2 then return n end return fib(n-1) + fib(n-2) end return fib(20)", want: []luaValue{6765.0}},
+		{src: "local function counter() local n = 0 return function() n = n + 1 return n end end local c = counter() c() return c()", want: []luaValue{2.0}},
+		{src: "local function f(...) return select('#', ...), select(2, ...) end return f(1, nil, 3)", want: []luaValue{3.0, nil, 3.0}},
+		{src: "local function f() return 1, 2, 3 end local t = {f(), f()} return #t", want: []luaValue{4.0}},
+		{src: "local a, b = 1 return b", want: []luaValue{nil}},
+		{src: "-- comment\n--[[ long\ncomment ]] return 1", want: []luaValue{1.0}},
+		{src: "return unknownfn()", err: "test:1: attempt to call a nil value (global 'unknownfn')"},
+		{src: "local t = nil return t.x", err: "test:1: attempt to index a nil value (local 't')"},
+		{src: "return 10 // 3", err: "test:1: unexpected symbol near '/'"},
+
+		// tables and metatables
+		{src: "return #{n=1}, #{1, 2, 3}", want: []luaValue{0.0, 3.0}},
+		{src: "local t = {} for k, v in pairs({a=1, b=2}) do t[#t+1] = k .. v end table.sort(t) return table.concat(t, ',')", want: []luaValue{"a1,b2"}},
+		{src: "local s = '' for i, v in ipairs({'a', 'b', nil, 'd'}) do s = s .. i .. v end return s", want: []luaValue{"1a2b"}},
+		{src: "local t = {3, 1, 2} table.insert(t, 4) table.sort(t, function(a, b) return a > b end) return table.concat(t, ' ')", want: []luaValue{"4 3 2 1"}},
+		{src: "return setmetatable({}, {__index = function(t, k) return k .. '!' end}).hi", want: []luaValue{"hi!"}},
+		{src: "return setmetatable({x=1}, {__add = function(a, b) return a.x + b end}) + 41", want: []luaValue{42.0}},
+		{src: "local t = {} t[nil] = 1", err: "test:1: table index is nil"},
+
+		// errors caught by pcall
+		{src: "return pcall(error, 'msg')", want: []luaValue{false, "test:1: msg"}},
+		{src: "return select(2, pcall(error, {code=1})).code", want: []luaValue{1.0}},
+	}
+
+	for _, test := range tests {
+		L := newLuaState()
+		fn, err := L.load(test.src, "test")
+		if err != nil {
+			if err.Error() != test.err {
+				t.Errorf("%q: compile error %q, want %q", test.src, err, test.err)
+			}
+			continue
+		}
+		rets, lerr := L.pcall(fn, nil)
+		if lerr != nil {
+			if lerr.Error() != test.err {
+				t.Errorf("%q: error %q, want %q", test.src, lerr.Error(), test.err)
+			}
+			continue
+		}
+		if test.err != "" {
+			t.Errorf("%q: returned %#v, want error %q", test.src, rets, test.err)
+		} else if !reflect.DeepEqual(rets, test.want) {
+			t.Errorf("%q: returned %#v, want %#v", test.src, rets, test.want)
+		}
+	}
+}
+
+// The replies of the scripts, their errors tell the SHA1 of the script
+// where the reply has %s
+func TestEvalReplies(t *testing.T) {
+	tests := []struct {
+		script string
+		resp   int
+		reply  string
+	}{
+		// the numbers are truncated to integers
+		{script: "return 1 + 2", reply: ":3\r\n"},
+		{script: "return 7 / 2", reply: ":3\r\n"},
+		{script: "return -7 / 2", reply: ":-3\r\n"},
+		{script: "return 3.99", reply: ":3\r\n"},
+		{script: "return -3.99", reply: ":-3\r\n"},
+		{script: "return 2^53", reply: ":9007199254740992\r\n"},
+		{script: "return {1.5, 2.7}", reply: "*2\r\n:1\r\n:2\r\n"},
+		{script: "return '10' + 5", reply: ":15\r\n"},
+		{script: "return 10 .. 20", reply: "$4\r\n1020\r\n"},
+		{script: "return tostring(3.5)", reply: "$3\r\n3.5\r\n"},
+
+		// nil and false are null, true is 1
+		{script: "return nil", reply: "$-1\r\n"},
+		{script: "return false", reply: "$-1\r\n"},
+		{script: "return true", reply: ":1\r\n"},
+
+		// the arrays stop at the first nil
+		{script: "return {1, 2, {3, 'x'}}", reply: "*3\r\n:1\r\n:2\r\n*2\r\n:3\r\n$1\r\nx\r\n"},
+		{script: "return {1, nil, 3}", reply: "*1\r\n:1\r\n"},
+		{script: "return #KEYS + #ARGV", reply: ":2\r\n"},
+		{script: "return KEYS[1] .. ARGV[1]", reply: "$6\r\nkeyarg\r\n"},
+
+		// the error and status tables
+		{script: "return {err = 'My Error'}", reply: "-My Error\r\n"},
+		{script: "return {ok = 'fine'}", reply: "+fine\r\n"},
+		{script: "return redis.error_reply('x')", reply: "-ERR x\r\n"},
+		{script: "return redis.error_reply('-x y')", reply: "-x y\r\n"},
+		{script: "return redis.status_reply('OK')", reply: "+OK\r\n"},
+
+		// RESP3 has its own types for them
+		{script: "return true", resp: 3, reply: "#t\r\n"},
+		{script: "return false", resp: 3, reply: "#f\r\n"},
+		{script: "return nil", resp: 3, reply: "_\r\n"},
+		{script: "return {double = 3.5}", resp: 3, reply: ",3.5\r\n"},
+		{script: "return {map = {a = 1}}", resp: 3, reply: "%1\r\n$1\r\na\r\n:1\r\n"},
+		{script: "return {set = {x = true}}", resp: 3, reply: "~1\r\n$1\r\nx\r\n"},
+		{script: "return {big_number = '123'}", resp: 3, reply: "(123\r\n"},
+
+		// the replies of the commands, as Lua values
+		{script: "return redis.call('SET', 'k', 'v')", reply: "+OK\r\n"},
+		{script: "return redis.call('GET', 'missing')", reply: "$-1\r\n"},
+		{script: "return redis.call('GET', 'missing') == false", reply: ":1\r\n"},
+		{script: "return type(redis.call('RPUSH', 'l', 'a', 'b'))", reply: "$6\r\nnumber\r\n"},
+		{script: "return redis.call('KEYS', 'l*')", reply: "*1\r\n$1\r\nl\r\n"},
+		{script: "redis.call('SET', 'n', 3.0) return redis.call('GET', 'n')", reply: "$1\r\n3\r\n"},
+		{script: "redis.call('SET', 'n', 1.5) return redis.call('GET', 'n')", reply: "$3\r\n1.5\r\n"},
+
+		// redis.call raises the errors, redis.pcall returns them
+		{script: "return redis.call('NOSUCH')", reply: "-ERR Unknown Redis command called from script script: %s, on @user_script:1.\r\n"},
+		{script: "return redis.pcall('NOSUCH')", reply: "-ERR Unknown Redis command called from script\r\n"},
+		{script: "return redis.call('INCRBYFLOAT', 'str', '1')", reply: "-ERR value is not a valid float script: %s, on @user_script:1.\r\n"},
+		{script: "return redis.pcall('INCRBYFLOAT', 'str', '1')", reply: "-ERR value is not a valid float\r\n"},
+		{script: "return type(redis.pcall('INCRBYFLOAT', 'str', '1'))", reply: "$5\r\ntable\r\n"},
+		{script: "local ok, err = pcall(redis.call, 'INCRBYFLOAT', 'str', '1') return err.err", reply: "$30\r\nERR value is not a valid float\r\n"},
+		{script: "return redis.call()", reply: "-ERR Please specify at least one argument for this redis lib call script: %s, on @user_script:1.\r\n"},
+		{script: "return redis.call('GET', {})", reply: "-ERR Lua redis lib command arguments must be strings or integers script: %s, on @user_script:1.\r\n"},
+		{script: "return redis.call('GET')", reply: "-ERR Wrong number of args calling Redis command from script script: %s, on @user_script:1.\r\n"},
+
+		// the errors of the scripts themselves
+		{script: "error('boom')", reply: "-ERR user_script:1: boom script: %s, on @user_script:1.\r\n"},
+		{script: "error({err = 'MY boom'})", reply: "-MY boom script: %s, on @user_script:1.\r\n"},
+		{script: "\n\nreturn nil + 1", reply: "-ERR user_script:3: attempt to perform arithmetic on a nil value script: %s, on @user_script:3.\r\n"},
+		{script: "x = 1", reply: "-ERR user_script:1: Attempt to modify a readonly table script: %s, on @user_script:1.\r\n"},
+		{script: "return +", reply: "-ERR Error compiling script (new function): user_script:1: unexpected symbol near '+'\r\n"},
+		{script: "return 1 +", reply: "-ERR Error compiling script (new function): user_script:1: unexpected symbol near '<eof>'\r\n"},
+	}
+
+	server := newTestServer(t)
+	client := newTestClient(server)
+	client.testRun("SET", "str", "abc")
+	for _, test := range tests {
+		client.resp = 2
+		if test.resp != 0 {
+			client.resp = test.resp
+		}
+		want := test.reply
+		if strings.Contains(want, "%s") {
+			want = fmt.Sprintf(want, sha1hex(test.script))
+		}
+		if reply := client.testRun("EVAL", test.script, "1", "key", "arg"); reply != want {
+			t.Errorf("EVAL %q (RESP%d): got %q, want %q", test.script, client.resp, reply, want)
+		}
+	}
+}
+
+func TestLuaRedisProtocolToValue(t *testing.T) {
+	tests := []struct {
+		reply string
+		want  luaValue
+	}{
+		{":5\r\n", 5.0},
+		{"$3\r\nabc\r\n", "abc"},
+		{"$-1\r\n", false},
+		{"*-1\r\n", false},
+		{"_\r\n", nil},
+		{"#t\r\n", true},
+		{"+OK\r\n", map[luaValue]luaValue{"ok": "OK"}},
+		{"-ERR x\r\n", map[luaValue]luaValue{"err": "ERR x"}},
+		{",3.5\r\n", map[luaValue]luaValue{"double": 3.5}},
+		{"*2\r\n:1\r\n$1\r\na\r\n", map[luaValue]luaValue{1.0: 1.0, 2.0: "a"}},
+	}
+
+	for _, test := range tests {
+		value, rest := luaRedisProtocolToValue([]byte(test.reply))
+		if len(rest) != 0 {
+			t.Errorf("%q: left %q unparsed", test.reply, rest)
+		}
+		if table, ok := value.(*luaTable); ok {
+			got := map[luaValue]luaValue{}
+			for key, value, _ := table.next(nil); key != nil; key, value, _ = table.next(key) {
+				got[key] = value
+			}
+			value = got
+		}
+		if !reflect.DeepEqual(value, test.want) {
+			t.Errorf("%q: got %#v, want %#v", test.reply, value, test.want)
+		}
+	}
+}
+
+// The busy script serves the other clients, from the goroutine of the test
+// standing in for the executor, until SCRIPT KILL stops it
+func TestScriptKill(t *testing.T) {
+	server := newTestServer(t)
+	server.Config.BusyReplyThreshold = 50
+	caller, other := newTestClient(server), newTestClient(server)
+
+	// sends a command to the executor running the script and waits for the
+	// reply
+	send := func(cmd string, args ...string) string {
+		argv := make([]interface{}, len(args))
+		for i, arg := range args {
+			argv[i] = arg
+		}
+		server.requests <- CommandRequest{Client: other, Cmd: cmd, Args: argv}
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			if reply := other.testReplies(); reply != "" {
+				return reply
+			}
+		}
+		t.Fatalf("no reply to %s while the script runs", cmd)
+		return ""
+	}
+	expect := func(what, reply, want string) {
+		t.Helper()
+		if reply != want {
+			t.Errorf("%s: got %q, want %q", what, reply, want)
+		}
+	}
+
+	script := "while true do end"
+	done := make(chan string)
+	go func() { done <- caller.testRun("EVAL", script, "0") }()
+	expect("PING", send("PING"), "-BUSY Redis is busy running a script. You can only call SCRIPT KILL or SHUTDOWN NOSAVE.\r\n")
+	expect("FUNCTION KILL", send("FUNCTION", "KILL"), "-BUSY Redis is busy running a script. You can only call SCRIPT KILL or SHUTDOWN NOSAVE.\r\n")
+	expect("SCRIPT KILL", send("SCRIPT", "KILL"), "+OK\r\n")
+	expect("EVAL", <-done, fmt.Sprintf("-ERR Script killed by user with SCRIPT KILL... script: %s, on @user_script:1.\r\n", sha1hex(script)))
+	expect("SCRIPT KILL after the script", other.testRun("SCRIPT", "KILL"), "-NOTBUSY No scripts in execution right now.\r\n")
+
+	// one that wrote must complete
+	script = "redis.call('SET', 'x', '1') local s = redis.call('TIME') " +
+		"repeat local n = redis.call('TIME') until (n[1] - s[1]) * 1e6 + (n[2] - s[2]) > 300000"
+	go func() { done <- caller.testRun("EVAL", script, "0") }()
+	expect("SCRIPT KILL", send("SCRIPT", "KILL"), "-UNKILLABLE Sorry the script already executed write commands against the dataset. "+
+		"You can either wait the script termination or kill the server in a hard way using the SHUTDOWN NOSAVE command.\r\n")
+	expect("EVAL", <-done, "$-1\r\n")
+	expect("GET", other.testRun("GET", "x"), "$1\r\n1\r\n")
+}
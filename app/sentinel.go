@@ -0,0 +1,1804 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// In sentinel mode the server holds no dataset: it monitors masters, the
+// replicas their INFO lists and the other sentinels watching them. Each
+// instance is pinged and asked for its INFO on a link of its own; one that
+// doesn't answer for down-after-milliseconds is subjectively down, and a
+// master is objectively down once a quorum of sentinels sees it so.
+
+const REDIS_SENTINEL_PORT = 26379
+
+// sentinelRedisInstance flags
+const (
+	SRI_MASTER = 1 << iota
+	SRI_SLAVE
+	SRI_SENTINEL
+	SRI_S_DOWN
+	SRI_O_DOWN
+	// the sentinel told us it sees the master down
+	SRI_MASTER_DOWN
+	// SCRIPT KILL was sent to an instance busy with a script
+	SRI_SCRIPT_KILL_SENT
+	SRI_FAILOVER_IN_PROGRESS
+	// the replica picked to replace its master
+	SRI_PROMOTED
+	// a replica told to replicate the promoted one, then seen doing it,
+	// then done syncing with it
+	SRI_RECONF_SENT
+	SRI_RECONF_INPROG
+	SRI_RECONF_DONE
+	// a failover asked by SENTINEL FAILOVER, which needs no election
+	SRI_FORCE_FAILOVER
+)
+
+// periods and defaults, in milliseconds
+const (
+	SENTINEL_INFO_PERIOD               = 10000
+	SENTINEL_PING_PERIOD               = 1000
+	SENTINEL_ASK_PERIOD                = 1000
+	SENTINEL_MIN_LINK_RECONNECT_PERIOD = 15000
+	SENTINEL_DEFAULT_DOWN_AFTER        = 30000
+	SENTINEL_DEFAULT_FAILOVER_TIMEOUT  = 60 * 3 * 1000
+	SENTINEL_PUBLISH_PERIOD            = 2000
+)
+
+// the channel the sentinels of a master announce themselves on
+const SENTINEL_HELLO_CHANNEL = "__sentinel__:hello"
+
+const (
+	SENTINEL_DEFAULT_PARALLEL_SYNCS  = 1
+	SENTINEL_DEFAULT_SLAVE_PRIORITY  = 100
+	SENTINEL_MAX_PENDING_COMMANDS    = 100
+	SENTINEL_MASTER_LINK_STATUS_UP   = 0
+	SENTINEL_MASTER_LINK_STATUS_DOWN = 1
+	SENTINEL_ASK_FORCED              = 1
+	SENTINEL_NO_FLAGS                = 0
+)
+
+// sentinelResetMaster flags
+const (
+	SENTINEL_RESET_NO_SENTINELS = 0
+	SENTINEL_RESET_SENTINELS    = 1
+	SENTINEL_GENERATE_EVENT     = 2
+)
+
+type sentinelState struct {
+	myid         string
+	currentEpoch uint64
+	masters      map[string]*sentinelRedisInstance
+}
+
+// sentinelRedisInstance is a master we monitor, or one of its replicas or
+// of the other sentinels monitoring it
+type sentinelRedisInstance struct {
+	flags       int
+	name        string // the master name, ip:port for the others
+	runid       string
+	configEpoch uint64
+	ip          string
+	port        int
+	link        *instanceLink
+
+	lastPubTime             int64
+	lastHelloTime           int64
+	lastMasterDownReplyTime int64
+	sDownSinceTime          int64
+	oDownSinceTime          int64
+	downAfterPeriod         int64
+	infoRefresh             int64
+
+	// the role of the last INFO, which may not be the one we think it has
+	roleReported        int
+	roleReportedTime    int64
+	slaveConfChangeTime int64
+
+	// master
+	sentinels       map[string]*sentinelRedisInstance
+	slaves          map[string]*sentinelRedisInstance
+	quorum          int
+	parallelSyncs   int
+	failoverTimeout int64
+
+	// the failover of a master, see sentinel_failover.go
+	failoverState           int
+	failoverStateChangeTime int64
+	failoverStartTime       int64
+	failoverEpoch           uint64
+	failoverDelayLogged     int64
+	promotedSlave           *sentinelRedisInstance
+	slaveReconfSentTime     int64
+
+	// replica, as its INFO tells
+	master                *sentinelRedisInstance
+	masterLinkDownTime    int64
+	slavePriority         int
+	replicaAnnounced      bool
+	slaveMasterHost       string
+	slaveMasterPort       int
+	slaveMasterLinkStatus int
+	slaveReplOffset       int64
+
+	// the leader a sentinel voted for, or we voted for in the failover of
+	// a master
+	leader      string
+	leaderEpoch uint64
+}
+
+// instanceLink holds the connections to an instance: the one of the
+// commands, and for masters and replicas the one subscribed to the hello
+// channel. The times are in milliseconds, actPingTime is the time of the
+// oldest PING not answered yet.
+type instanceLink struct {
+	cc              *instanceConn
+	pc              *instanceConn
+	ccConnTime      int64
+	pcConnTime      int64
+	pcLastActivity  int64
+	pendingCommands int
+	disconnected    bool
+	ccConnecting    bool
+	pcConnecting    bool
+	released        bool
+	lastReconnTime  int64
+	actPingTime     int64
+	lastPingTime    int64
+	lastPongTime    int64
+	lastAvailTime   int64
+}
+
+// instanceConn is one connection of a link, the replies it reads go to the
+// callbacks of the commands in the order they were sent
+type instanceConn struct {
+	conn      net.Conn
+	sendCh    chan []byte
+	callbacks []func(reply interface{})
+	closed    bool
+}
+
+// sentinelReplyError is an error reply, which readRESP reads like a status
+type sentinelReplyError string
+
+// sentinelInit creates the sentinel state from the directives of the
+// command line, when in sentinel mode
+func (server *RedisServer) sentinelInit() {
+	if !server.Config.SentinelMode {
+		return
+	}
+	// the state is saved in the config file, which must be there
+	if server.Config.ConfigFile == "" {
+		fmt.Println("Sentinel needs config file on disk to save state. Exiting...")
+		os.Exit(1)
+	}
+	if file, err := os.OpenFile(server.Config.ConfigFile, os.O_WRONLY, 0); err != nil {
+		fmt.Printf("Sentinel config file %s is not writable: %v. Exiting...\n", server.Config.ConfigFile, err)
+		os.Exit(1)
+	} else {
+		file.Close()
+	}
+
+	server.sentinel = &sentinelState{
+		masters: make(map[string]*sentinelRedisInstance),
+	}
+
+	for _, directive := range server.Config.SentinelDirectives {
+		if err := server.sentinelHandleConfiguration(directive); err != nil {
+			fmt.Printf("Error in sentinel directive 'sentinel %s': %v\n", strings.Join(directive, " "), err)
+			os.Exit(1)
+		}
+	}
+	if server.sentinel.myid == "" {
+		server.sentinel.myid = getRandomHexChars(CONFIG_RUN_ID_SIZE)
+	}
+
+	// a new ID is kept for the next start
+	server.sentinelFlushConfig()
+
+	fmt.Printf("Sentinel ID is %s\n", server.sentinel.myid)
+	for _, name := range server.sentinelMasterNames() {
+		master := server.sentinel.masters[name]
+		server.sentinelEvent("+monitor", master, fmt.Sprintf("quorum %d", master.quorum))
+	}
+}
+
+// sentinelFlushConfig saves the state of the sentinel in its config file,
+// so it keeps its ID, the epochs and where the masters moved across
+// restarts
+func (server *RedisServer) sentinelFlushConfig() {
+	if err := server.rewriteConfig(server.Config.ConfigFile); err != nil {
+		fmt.Printf("WARNING: Sentinel was not able to save the new configuration on disk!!!: %v\n", err)
+	}
+}
+
+// sentinelConfigLines are the "sentinel ..." lines of the config file, the
+// state sentinelHandleConfiguration reads back
+func (server *RedisServer) sentinelConfigLines() []string {
+	sentinel := server.sentinel
+	lines := []string{"sentinel myid " + sentinel.myid}
+	for _, name := range server.sentinelMasterNames() {
+		master := sentinel.masters[name]
+		// during a failover, the promoted replica once it is the master
+		ip, port := sentinelGetCurrentMasterAddress(master)
+		lines = append(lines, fmt.Sprintf("sentinel monitor %s %s %d %d", name, ip, port, master.quorum))
+		if master.downAfterPeriod != SENTINEL_DEFAULT_DOWN_AFTER {
+			lines = append(lines, fmt.Sprintf("sentinel down-after-milliseconds %s %d", name, master.downAfterPeriod))
+		}
+		if master.failoverTimeout != SENTINEL_DEFAULT_FAILOVER_TIMEOUT {
+			lines = append(lines, fmt.Sprintf("sentinel failover-timeout %s %d", name, master.failoverTimeout))
+		}
+		if master.parallelSyncs != SENTINEL_DEFAULT_PARALLEL_SYNCS {
+			lines = append(lines, fmt.Sprintf("sentinel parallel-syncs %s %d", name, master.parallelSyncs))
+		}
+		lines = append(lines, fmt.Sprintf("sentinel config-epoch %s %d", name, master.configEpoch))
+		lines = append(lines, fmt.Sprintf("sentinel leader-epoch %s %d", name, master.leaderEpoch))
+
+		for _, slave := range sentinelInstancesSorted(master.slaves) {
+			// the promoted replica is the master, the old master one of
+			// its replicas
+			slaveIp, slavePort := slave.ip, slave.port
+			if slaveIp == ip && slavePort == port {
+				slaveIp, slavePort = master.ip, master.port
+			}
+			lines = append(lines, fmt.Sprintf("sentinel known-replica %s %s %d", name, slaveIp, slavePort))
+		}
+		for _, ri := range sentinelInstancesSorted(master.sentinels) {
+			if ri.runid == "" {
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("sentinel known-sentinel %s %s %d %s", name, ri.ip, ri.port, ri.runid))
+		}
+	}
+	return append(lines, fmt.Sprintf("sentinel current-epoch %d", sentinel.currentEpoch))
+}
+
+// sentinelHandleConfiguration applies a "sentinel <directive> ..." line
+func (server *RedisServer) sentinelHandleConfiguration(args []string) error {
+	sentinel := server.sentinel
+	directive := strings.ToLower(args[0])
+
+	if directive == "myid" && len(args) == 2 {
+		if len(args[1]) != CONFIG_RUN_ID_SIZE {
+			return fmt.Errorf("malformed Sentinel id in myid option")
+		}
+		sentinel.myid = args[1]
+		return nil
+	}
+	if directive == "current-epoch" && len(args) == 2 {
+		epoch, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid current-epoch")
+		}
+		if epoch > sentinel.currentEpoch {
+			sentinel.currentEpoch = epoch
+		}
+		return nil
+	}
+	if directive == "monitor" && len(args) == 5 {
+		quorum, err := strconv.Atoi(args[4])
+		if err != nil || quorum <= 0 {
+			return fmt.Errorf("quorum must be 1 or greater")
+		}
+		port, err := strconv.Atoi(args[3])
+		if err != nil {
+			return fmt.Errorf("invalid port number")
+		}
+		_, err = server.createSentinelRedisInstance(args[1], SRI_MASTER, args[2], port, quorum, nil)
+		return err
+	}
+	if len(args) < 3 {
+		return fmt.Errorf("unrecognized sentinel configuration statement")
+	}
+
+	// the others are about a master monitored by an earlier line
+	master := sentinel.masters[args[1]]
+	if master == nil {
+		return fmt.Errorf("no such master with specified name")
+	}
+	switch {
+	case directive == "down-after-milliseconds" && len(args) == 3:
+		n, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("negative or zero time parameter")
+		}
+		master.downAfterPeriod = n
+		sentinelPropagateDownAfterPeriod(master)
+	case directive == "failover-timeout" && len(args) == 3:
+		n, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("negative or zero time parameter")
+		}
+		master.failoverTimeout = n
+	case directive == "parallel-syncs" && len(args) == 3:
+		n, err := strconv.Atoi(args[2])
+		if err != nil {
+			return fmt.Errorf("invalid parallel-syncs")
+		}
+		master.parallelSyncs = n
+	case directive == "leader-epoch" && len(args) == 3:
+		epoch, err := strconv.ParseUint(args[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid leader-epoch")
+		}
+		master.leaderEpoch = epoch
+	case directive == "config-epoch" && len(args) == 3:
+		epoch, err := strconv.ParseUint(args[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid config-epoch")
+		}
+		master.configEpoch = epoch
+		if epoch > sentinel.currentEpoch {
+			sentinel.currentEpoch = epoch
+		}
+	case (directive == "known-replica" || directive == "known-slave") && len(args) == 4:
+		port, err := strconv.Atoi(args[3])
+		if err != nil {
+			return fmt.Errorf("invalid port number")
+		}
+		_, err = server.createSentinelRedisInstance("", SRI_SLAVE, args[2], port, master.quorum, master)
+		return err
+	case directive == "known-sentinel" && (len(args) == 4 || len(args) == 5):
+		port, err := strconv.Atoi(args[3])
+		if err != nil {
+			return fmt.Errorf("invalid port number")
+		}
+		runid := ""
+		if len(args) == 5 {
+			runid = args[4]
+		}
+		ri, err := server.createSentinelRedisInstance(runid, SRI_SENTINEL, args[2], port, master.quorum, master)
+		if err != nil {
+			return err
+		}
+		ri.runid = runid
+	default:
+		return fmt.Errorf("unrecognized sentinel configuration statement")
+	}
+	return nil
+}
+
+// createSentinelRedisInstance adds a master, or a replica or a sentinel of
+// master, refusing an address or a master name already known
+func (server *RedisServer) createSentinelRedisInstance(name string, flags int, ip string, port int, quorum int,
+	master *sentinelRedisInstance) (*sentinelRedisInstance, error) {
+	if port < 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid port number")
+	}
+	if net.ParseIP(ip) == nil {
+		return nil, fmt.Errorf("invalid IP address or hostname specified")
+	}
+
+	// the replicas are known by their address, the sentinels by their run
+	// ID, or their address until they tell it
+	if flags&SRI_SLAVE != 0 || (flags&SRI_SENTINEL != 0 && name == "") {
+		name = net.JoinHostPort(ip, strconv.Itoa(port))
+	}
+	var table map[string]*sentinelRedisInstance
+	switch {
+	case flags&SRI_MASTER != 0:
+		table = server.sentinel.masters
+	case flags&SRI_SLAVE != 0:
+		table = master.slaves
+	default:
+		table = master.sentinels
+	}
+	if table[name] != nil {
+		return nil, fmt.Errorf("duplicated master name")
+	}
+
+	now := time.Now().UnixMilli()
+	ri := &sentinelRedisInstance{
+		flags:               flags,
+		name:                name,
+		ip:                  ip,
+		port:                port,
+		link:                createInstanceLink(),
+		downAfterPeriod:     SENTINEL_DEFAULT_DOWN_AFTER,
+		roleReported:        flags & (SRI_MASTER | SRI_SLAVE),
+		roleReportedTime:    now,
+		slaveConfChangeTime: now,
+		slavePriority:       SENTINEL_DEFAULT_SLAVE_PRIORITY,
+		replicaAnnounced:    true,
+		quorum:              quorum,
+		parallelSyncs:       SENTINEL_DEFAULT_PARALLEL_SYNCS,
+		failoverTimeout:     SENTINEL_DEFAULT_FAILOVER_TIMEOUT,
+		master:              master,
+	}
+	if master != nil {
+		ri.downAfterPeriod = master.downAfterPeriod
+	}
+	if flags&SRI_MASTER != 0 {
+		ri.sentinels = make(map[string]*sentinelRedisInstance)
+		ri.slaves = make(map[string]*sentinelRedisInstance)
+	}
+	table[name] = ri
+	return ri, nil
+}
+
+func createInstanceLink() *instanceLink {
+	now := time.Now().UnixMilli()
+	// the ping counts as sent so an instance we never reach goes down
+	return &instanceLink{
+		disconnected:  true,
+		actPingTime:   now,
+		lastAvailTime: now,
+		lastPongTime:  now,
+	}
+}
+
+// releaseSentinelRedisInstance closes the links of the instance, and of the
+// replicas and sentinels of a master
+func (server *RedisServer) releaseSentinelRedisInstance(ri *sentinelRedisInstance) {
+	for _, slave := range ri.slaves {
+		server.releaseSentinelRedisInstance(slave)
+	}
+	for _, sentinel := range ri.sentinels {
+		server.releaseSentinelRedisInstance(sentinel)
+	}
+	server.releaseInstanceLink(ri.link)
+}
+
+// releaseInstanceLink closes the connections of a link no longer used, and
+// the ones still being opened once they are
+func (server *RedisServer) releaseInstanceLink(link *instanceLink) {
+	link.released = true
+	server.instanceLinkCloseConnection(link, link.cc)
+	server.instanceLinkCloseConnection(link, link.pc)
+}
+
+// sentinelResetMaster forgets what we learnt of the master: its replicas,
+// its sentinels with SENTINEL_RESET_SENTINELS, and the state of its link
+// and of its failover
+func (server *RedisServer) sentinelResetMaster(ri *sentinelRedisInstance, flags int) {
+	for _, slave := range ri.slaves {
+		server.releaseSentinelRedisInstance(slave)
+	}
+	ri.slaves = make(map[string]*sentinelRedisInstance)
+	if flags&SENTINEL_RESET_SENTINELS != 0 {
+		for _, sentinel := range ri.sentinels {
+			server.releaseSentinelRedisInstance(sentinel)
+		}
+		ri.sentinels = make(map[string]*sentinelRedisInstance)
+	}
+
+	// a new link, a connection on its way to the old address is dropped
+	server.releaseInstanceLink(ri.link)
+	ri.link = createInstanceLink()
+
+	ri.flags &= SRI_MASTER
+	ri.leader = ""
+	ri.failoverState = SENTINEL_FAILOVER_STATE_NONE
+	ri.failoverStateChangeTime = 0
+	// a failover can start again right away
+	ri.failoverStartTime = 0
+	ri.promotedSlave = nil
+	ri.runid = ""
+	ri.slaveMasterHost = ""
+	ri.infoRefresh = 0
+	ri.roleReported = SRI_MASTER
+	ri.roleReportedTime = time.Now().UnixMilli()
+	if flags&SENTINEL_GENERATE_EVENT != 0 {
+		server.sentinelEvent("+reset-master", ri, "")
+	}
+}
+
+// sentinelResetMasterAndChangeAddress moves the master to a new address,
+// the old one and the replicas but the one at the new address becoming its
+// replicas. The sentinels are kept.
+func (server *RedisServer) sentinelResetMasterAndChangeAddress(master *sentinelRedisInstance, ip string, port int) error {
+	if net.ParseIP(ip) == nil {
+		return fmt.Errorf("invalid IP address or hostname specified")
+	}
+
+	type addr struct {
+		ip   string
+		port int
+	}
+	slaves := []addr{}
+	for _, slave := range sentinelInstancesSorted(master.slaves) {
+		if slave.ip == ip && slave.port == port {
+			continue
+		}
+		slaves = append(slaves, addr{slave.ip, slave.port})
+	}
+	if master.ip != ip || master.port != port {
+		slaves = append(slaves, addr{master.ip, master.port})
+	}
+
+	server.sentinelResetMaster(master, SENTINEL_RESET_NO_SENTINELS)
+	master.ip, master.port = ip, port
+	master.sDownSinceTime = 0
+	master.oDownSinceTime = 0
+	for _, slave := range slaves {
+		server.createSentinelRedisInstance("", SRI_SLAVE, slave.ip, slave.port, master.quorum, master)
+	}
+	return nil
+}
+
+// sentinelGetCurrentMasterAddress is the address of the master, or of the
+// replica promoted in its place once the others are told to follow it
+func sentinelGetCurrentMasterAddress(master *sentinelRedisInstance) (string, int) {
+	if master.flags&SRI_FAILOVER_IN_PROGRESS != 0 && master.promotedSlave != nil &&
+		master.failoverState >= SENTINEL_FAILOVER_STATE_RECONF_SLAVES {
+		return master.promotedSlave.ip, master.promotedSlave.port
+	}
+	return master.ip, master.port
+}
+
+// sentinelPropagateDownAfterPeriod gives the replicas and the sentinels of
+// the master its down-after-milliseconds
+func sentinelPropagateDownAfterPeriod(master *sentinelRedisInstance) {
+	for _, slave := range master.slaves {
+		slave.downAfterPeriod = master.downAfterPeriod
+	}
+	for _, sentinel := range master.sentinels {
+		sentinel.downAfterPeriod = master.downAfterPeriod
+	}
+}
+
+func (server *RedisServer) sentinelMasterNames() []string {
+	names := make([]string, 0, len(server.sentinel.masters))
+	for name := range server.sentinel.masters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sentinelInstancesSorted lists replicas or sentinels in a stable order
+func sentinelInstancesSorted(instances map[string]*sentinelRedisInstance) []*sentinelRedisInstance {
+	list := make([]*sentinelRedisInstance, 0, len(instances))
+	for _, ri := range instances {
+		list = append(list, ri)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	return list
+}
+
+func sentinelGetInstanceTypeString(ri *sentinelRedisInstance) string {
+	switch {
+	case ri.flags&SRI_MASTER != 0:
+		return "master"
+	case ri.flags&SRI_SLAVE != 0:
+		return "slave"
+	case ri.flags&SRI_SENTINEL != 0:
+		return "sentinel"
+	}
+	return "unknown"
+}
+
+// sentinelEvent logs an event and publishes it on the channel named after
+// it. The message starts with the instance, followed by its master for the
+// replicas and the sentinels:
+//
+//	<type> <name> <ip> <port> [@ <master-name> <master-ip> <master-port>] [extra]
+func (server *RedisServer) sentinelEvent(typ string, ri *sentinelRedisInstance, extra string) {
+	msg := ""
+	if ri != nil {
+		msg = fmt.Sprintf("%s %s %s %d", sentinelGetInstanceTypeString(ri), ri.name, ri.ip, ri.port)
+		if master := ri.master; master != nil {
+			msg += fmt.Sprintf(" @ %s %s %d", master.name, master.ip, master.port)
+		}
+	}
+	if extra != "" {
+		if msg != "" {
+			msg += " "
+		}
+		msg += extra
+	}
+
+	fmt.Printf("%s %s\n", typ, msg)
+	server.pubsubPublishMessage(typ, msg, pubsubTypeGlobal)
+}
+
+// sentinelReconnectInstance connects the link of an instance missing one
+// of its connections, at most once per ping period. A sentinel has no
+// hello connection, it is told the hellos with PUBLISH.
+func (server *RedisServer) sentinelReconnectInstance(ri *sentinelRedisInstance) {
+	link := ri.link
+	if !link.disconnected || ri.port == 0 {
+		return
+	}
+	now := time.Now().UnixMilli()
+	if now-link.lastReconnTime < SENTINEL_PING_PERIOD {
+		return
+	}
+	link.lastReconnTime = now
+
+	if link.cc == nil && !link.ccConnecting {
+		link.ccConnecting = true
+		server.sentinelConnectInstance(ri, false)
+	}
+	if ri.flags&SRI_SENTINEL == 0 && link.pc == nil && !link.pcConnecting {
+		link.pcConnecting = true
+		server.sentinelConnectInstance(ri, true)
+	}
+}
+
+func (server *RedisServer) sentinelConnectInstance(ri *sentinelRedisInstance, pubsub bool) {
+	link := ri.link
+	addr := net.JoinHostPort(ri.ip, strconv.Itoa(ri.port))
+	tlsConfig := server.tlsDialConfig(server.Config.TlsReplication)
+	go func() {
+		conn, err := connDial(addr, SENTINEL_PING_PERIOD*time.Millisecond, tlsConfig)
+		server.runOnExecutor(func() {
+			if pubsub {
+				link.pcConnecting = false
+			} else {
+				link.ccConnecting = false
+			}
+			if link.released {
+				if conn != nil {
+					conn.Close()
+				}
+				return
+			}
+			if err != nil {
+				return
+			}
+			server.instanceLinkConnected(ri, conn, pubsub)
+		})
+	}()
+}
+
+// instanceLinkConnected starts the goroutines writing the commands of the
+// connection and reading their replies, handed to the executor. The
+// command connection pings right away, the other subscribes to the hellos.
+func (server *RedisServer) instanceLinkConnected(ri *sentinelRedisInstance, conn net.Conn, pubsub bool) {
+	link := ri.link
+	cc := &instanceConn{
+		conn:   conn,
+		sendCh: make(chan []byte, 1024),
+	}
+	now := time.Now().UnixMilli()
+	if pubsub {
+		link.pc = cc
+		link.pcConnTime = now
+		link.pcLastActivity = now
+	} else {
+		link.cc = cc
+		link.ccConnTime = now
+		link.pendingCommands = 0
+	}
+	link.disconnected = link.cc == nil || (link.pc == nil && ri.flags&SRI_SENTINEL == 0)
+
+	go func() {
+		for msg := range cc.sendCh {
+			if _, err := conn.Write(msg); err != nil {
+				conn.Close()
+				return
+			}
+		}
+	}()
+
+	go func() {
+		reader := bufio.NewReader(conn)
+		for {
+			reply, err := sentinelReadReply(reader)
+			if err != nil {
+				break
+			}
+			server.runOnExecutor(func() {
+				if cc.closed {
+					return
+				}
+				if pubsub {
+					server.sentinelReceiveHelloMessages(ri, reply)
+				} else {
+					server.instanceConnProcessReply(link, cc, reply)
+				}
+			})
+		}
+		server.runOnExecutor(func() {
+			server.instanceLinkCloseConnection(link, cc)
+		})
+	}()
+
+	if pubsub {
+		cc.sendCh <- addReplyArray([]string{"SUBSCRIBE", SENTINEL_HELLO_CHANNEL})
+	} else {
+		server.sentinelSendPing(ri)
+	}
+}
+
+// sentinelReadReply reads a reply, telling the errors apart
+func sentinelReadReply(reader *bufio.Reader) (interface{}, error) {
+	prefix, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if prefix[0] != '-' {
+		return readRESP(reader, PROTO_UNLIMITED_BULK_LEN)
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	return sentinelReplyError(strings.TrimSpace(line[1:])), nil
+}
+
+func (server *RedisServer) instanceConnProcessReply(link *instanceLink, cc *instanceConn, reply interface{}) {
+	if len(cc.callbacks) == 0 {
+		return
+	}
+	callback := cc.callbacks[0]
+	cc.callbacks = cc.callbacks[1:]
+	link.pendingCommands--
+	callback(reply)
+}
+
+// instanceLinkCloseConnection drops a connection of the link, the timer
+// reconnects it. The replies still expected are lost with it.
+func (server *RedisServer) instanceLinkCloseConnection(link *instanceLink, cc *instanceConn) {
+	if cc == nil || cc.closed {
+		return
+	}
+	cc.closed = true
+	close(cc.sendCh)
+	cc.conn.Close()
+	if link.cc == cc {
+		link.cc = nil
+		link.pendingCommands = 0
+	}
+	if link.pc == cc {
+		link.pc = nil
+	}
+	link.disconnected = true
+}
+
+// sentinelSendCommand queues a command on the link of the instance, the
+// callback gets its reply. It tells if the command could be sent.
+func (server *RedisServer) sentinelSendCommand(ri *sentinelRedisInstance, callback func(reply interface{}), args ...string) bool {
+	link := ri.link
+	cc := link.cc
+	if cc == nil {
+		return false
+	}
+	select {
+	case cc.sendCh <- addReplyArray(args):
+	default:
+		// an instance that doesn't read its commands gets a new link
+		server.instanceLinkCloseConnection(link, cc)
+		return false
+	}
+	cc.callbacks = append(cc.callbacks, callback)
+	link.pendingCommands++
+	return true
+}
+
+// sentinelSendPing pings the instance, the ping the down time counts from
+// stays the oldest one not answered
+func (server *RedisServer) sentinelSendPing(ri *sentinelRedisInstance) bool {
+	sent := server.sentinelSendCommand(ri, func(reply interface{}) {
+		server.sentinelPingReplyCallback(ri, reply)
+	}, "PING")
+	if sent {
+		now := time.Now().UnixMilli()
+		ri.link.lastPingTime = now
+		if ri.link.actPingTime == 0 {
+			ri.link.actPingTime = now
+		}
+	}
+	return sent
+}
+
+// sentinelPingReplyCallback takes a PONG, or an instance loading its data
+// or without its master, for an instance that is up. One busy with a
+// script is asked to kill it once it is down.
+func (server *RedisServer) sentinelPingReplyCallback(ri *sentinelRedisInstance, reply interface{}) {
+	link := ri.link
+	now := time.Now().UnixMilli()
+	switch r := reply.(type) {
+	case string:
+		if r == "PONG" {
+			link.lastAvailTime = now
+			link.actPingTime = 0
+		}
+	case sentinelReplyError:
+		msg := string(r)
+		if strings.HasPrefix(msg, "LOADING") || strings.HasPrefix(msg, "MASTERDOWN") {
+			link.lastAvailTime = now
+			link.actPingTime = 0
+		} else if strings.HasPrefix(msg, "BUSY") && ri.flags&SRI_S_DOWN != 0 && ri.flags&SRI_SCRIPT_KILL_SENT == 0 {
+			if server.sentinelSendCommand(ri, func(reply interface{}) {}, "SCRIPT", "KILL") {
+				ri.flags |= SRI_SCRIPT_KILL_SENT
+			}
+		}
+	}
+	link.lastPongTime = now
+}
+
+// sentinelSendHello announces us, and the configuration we have of the
+// master, to the instance:
+//
+//	<ip>,<port>,<runid>,<current-epoch>,<master-name>,<master-ip>,<master-port>,<master-config-epoch>
+//
+// Masters and replicas publish it on the hello channel, for the sentinels
+// subscribed to it, while a sentinel takes the PUBLISH itself.
+func (server *RedisServer) sentinelSendHello(ri *sentinelRedisInstance) bool {
+	if ri.link.disconnected {
+		return false
+	}
+	master := ri
+	if ri.flags&SRI_MASTER == 0 {
+		master = ri.master
+	}
+	ip, _, err := net.SplitHostPort(ri.link.cc.conn.LocalAddr().String())
+	if err != nil {
+		return false
+	}
+	masterIp, masterPort := sentinelGetCurrentMasterAddress(master)
+	payload := fmt.Sprintf("%s,%d,%s,%d,%s,%s,%d,%d", ip, server.clientPort(server.Config.TlsReplication), server.sentinel.myid,
+		server.sentinel.currentEpoch, master.name, masterIp, masterPort, master.configEpoch)
+	return server.sentinelSendCommand(ri, func(reply interface{}) {
+		if _, failed := reply.(sentinelReplyError); !failed {
+			ri.lastPubTime = time.Now().UnixMilli()
+		}
+	}, "PUBLISH", SENTINEL_HELLO_CHANNEL, payload)
+}
+
+// sentinelForceHelloUpdateForMaster has the hellos of the master, its
+// replicas and its sentinels sent at the next timer
+func sentinelForceHelloUpdateForMaster(master *sentinelRedisInstance) {
+	force := func(ri *sentinelRedisInstance) {
+		if ri.lastPubTime >= SENTINEL_PUBLISH_PERIOD+1 {
+			ri.lastPubTime -= SENTINEL_PUBLISH_PERIOD + 1
+		}
+	}
+	force(master)
+	for _, slave := range master.slaves {
+		force(slave)
+	}
+	for _, sentinel := range master.sentinels {
+		force(sentinel)
+	}
+}
+
+// sentinelReceiveHelloMessages gets the messages of the hello connection,
+// our own hellos aside
+func (server *RedisServer) sentinelReceiveHelloMessages(ri *sentinelRedisInstance, reply interface{}) {
+	ri.link.pcLastActivity = time.Now().UnixMilli()
+
+	r, ok := reply.([]interface{})
+	if !ok || len(r) != 3 {
+		return
+	}
+	kind, _ := r[0].(string)
+	channel, _ := r[1].(string)
+	payload, _ := r[2].(string)
+	if kind != "message" || channel != SENTINEL_HELLO_CHANNEL || strings.Contains(payload, server.sentinel.myid) {
+		return
+	}
+	server.sentinelProcessHelloMessage(payload)
+}
+
+// sentinelProcessHelloMessage learns of the sentinel of the hello, of the
+// epoch it is at, and of the address of the master when its configuration
+// is newer than ours, as after a failover
+func (server *RedisServer) sentinelProcessHelloMessage(hello string) {
+	token := strings.Split(hello, ",")
+	if len(token) != 8 {
+		return
+	}
+	sentinel := server.sentinel
+	master := sentinel.masters[token[4]]
+	if master == nil {
+		return
+	}
+	ip, runid, masterIp := token[0], token[2], token[5]
+	port, err1 := strconv.Atoi(token[1])
+	currentEpoch, err2 := strconv.ParseUint(token[3], 10, 64)
+	masterPort, err3 := strconv.Atoi(token[6])
+	masterConfigEpoch, err4 := strconv.ParseUint(token[7], 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+		return
+	}
+
+	si := sentinelGetSentinelByAddrAndRunid(master, ip, port, runid)
+	if si == nil {
+		// a sentinel we were told of without its run ID
+		if known := master.sentinels[net.JoinHostPort(ip, token[1])]; known != nil && known.runid == "" {
+			delete(master.sentinels, known.name)
+			known.name, known.runid = runid, runid
+			master.sentinels[runid] = known
+			si = known
+		}
+	}
+	if si == nil {
+		// a sentinel that moved, or one at the address of another that
+		// must be gone
+		removed := server.removeMatchingSentinelFromMaster(master, runid)
+		if removed > 0 {
+			server.sentinelEvent("+sentinel-address-switch", master, fmt.Sprintf("ip %s port %d for %s", ip, port, runid))
+		} else if other := sentinelGetSentinelByAddrAndRunid(master, ip, port, ""); other != nil {
+			server.sentinelEvent("+sentinel-invalid-addr", other, "")
+			other.port = 0
+			server.instanceLinkCloseConnection(other.link, other.link.cc)
+		}
+
+		created, err := server.createSentinelRedisInstance(runid, SRI_SENTINEL, ip, port, master.quorum, master)
+		if err == nil {
+			created.runid = runid
+			if removed == 0 {
+				server.sentinelEvent("+sentinel", created, "")
+			}
+			si = created
+			server.sentinelFlushConfig()
+		}
+	}
+
+	if currentEpoch > sentinel.currentEpoch {
+		sentinel.currentEpoch = currentEpoch
+		server.sentinelFlushConfig()
+		server.sentinelEvent("+new-epoch", nil, strconv.FormatUint(currentEpoch, 10))
+	}
+
+	if si != nil && master.configEpoch < masterConfigEpoch {
+		master.configEpoch = masterConfigEpoch
+		if masterPort != master.port || masterIp != master.ip {
+			server.sentinelEvent("+config-update-from", si, "")
+			server.sentinelEvent("+switch-master", nil, fmt.Sprintf("%s %s %d %s %d",
+				master.name, master.ip, master.port, masterIp, masterPort))
+			server.sentinelResetMasterAndChangeAddress(master, masterIp, masterPort)
+		}
+		server.sentinelFlushConfig()
+	}
+
+	if si != nil {
+		si.lastHelloTime = time.Now().UnixMilli()
+	}
+}
+
+// sentinelGetSentinelByAddrAndRunid finds a sentinel of the master by its
+// address, and its run ID unless runid is empty
+func sentinelGetSentinelByAddrAndRunid(master *sentinelRedisInstance, ip string, port int, runid string) *sentinelRedisInstance {
+	for _, ri := range master.sentinels {
+		if ri.ip == ip && ri.port == port && (runid == "" || ri.runid == runid) {
+			return ri
+		}
+	}
+	return nil
+}
+
+// removeMatchingSentinelFromMaster drops the sentinels with the run ID,
+// telling how many there were
+func (server *RedisServer) removeMatchingSentinelFromMaster(master *sentinelRedisInstance, runid string) int {
+	removed := 0
+	for name, ri := range master.sentinels {
+		if ri.runid == runid {
+			server.releaseSentinelRedisInstance(ri)
+			delete(master.sentinels, name)
+			removed++
+		}
+	}
+	return removed
+}
+
+// sentinelPublishCommand is PUBLISH on a sentinel, which only takes the
+// hellos of the other sentinels
+func (server *RedisServer) sentinelPublishCommand(args []interface{}) []byte {
+	channel, _ := args[0].(string)
+	message, _ := args[1].(string)
+	if channel != SENTINEL_HELLO_CHANNEL {
+		return []byte("-ERR Only HELLO messages are accepted by Sentinel instances.\r\n")
+	}
+	server.sentinelProcessHelloMessage(message)
+	return addReplyLongLong(1)
+}
+
+// sentinelSendPeriodicCommands asks masters and replicas for their INFO,
+// every second rather than every ten while their master is down or failed
+// over, pings every instance and sends it our hello
+func (server *RedisServer) sentinelSendPeriodicCommands(ri *sentinelRedisInstance) {
+	link := ri.link
+	if link.disconnected || link.pendingCommands >= SENTINEL_MAX_PENDING_COMMANDS {
+		return
+	}
+	now := time.Now().UnixMilli()
+
+	infoPeriod := int64(SENTINEL_INFO_PERIOD)
+	if ri.flags&SRI_SLAVE != 0 && (ri.master.flags&(SRI_O_DOWN|SRI_FAILOVER_IN_PROGRESS) != 0 || ri.masterLinkDownTime != 0) {
+		infoPeriod = 1000
+	}
+	pingPeriod := ri.downAfterPeriod
+	if pingPeriod > SENTINEL_PING_PERIOD {
+		pingPeriod = SENTINEL_PING_PERIOD
+	}
+
+	if ri.flags&SRI_SENTINEL == 0 && (ri.infoRefresh == 0 || now-ri.infoRefresh > infoPeriod) {
+		server.sentinelSendCommand(ri, func(reply interface{}) {
+			if info, ok := reply.(string); ok {
+				server.sentinelRefreshInstanceInfo(ri, info)
+			}
+		}, "INFO")
+	}
+	if now-link.lastPongTime > pingPeriod && now-link.lastPingTime > pingPeriod/2 {
+		server.sentinelSendPing(ri)
+	}
+	if now-ri.lastPubTime > SENTINEL_PUBLISH_PERIOD {
+		server.sentinelSendHello(ri)
+	}
+}
+
+// sentinelRefreshInstanceInfo reads the role of the instance in its INFO,
+// the replicas of a master and the state of the link of a replica
+func (server *RedisServer) sentinelRefreshInstanceInfo(ri *sentinelRedisInstance, info string) {
+	role := 0
+	ri.masterLinkDownTime = 0
+
+	for _, line := range strings.Split(info, "\r\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "run_id":
+			if len(value) != CONFIG_RUN_ID_SIZE {
+				continue
+			}
+			if ri.runid != "" && ri.runid != value {
+				server.sentinelEvent("+reboot", ri, "")
+			}
+			ri.runid = value
+		case "role":
+			switch value {
+			case "master":
+				role = SRI_MASTER
+			case "slave":
+				role = SRI_SLAVE
+			}
+		case "master_link_down_since_seconds":
+			n, _ := strconv.ParseInt(value, 10, 64)
+			ri.masterLinkDownTime = n * 1000
+		case "master_host":
+			if ri.slaveMasterHost != value {
+				ri.slaveMasterHost = value
+				ri.slaveConfChangeTime = time.Now().UnixMilli()
+			}
+		case "master_port":
+			port, _ := strconv.Atoi(value)
+			if ri.slaveMasterPort != port {
+				ri.slaveMasterPort = port
+				ri.slaveConfChangeTime = time.Now().UnixMilli()
+			}
+		case "master_link_status":
+			if value == "up" {
+				ri.slaveMasterLinkStatus = SENTINEL_MASTER_LINK_STATUS_UP
+			} else {
+				ri.slaveMasterLinkStatus = SENTINEL_MASTER_LINK_STATUS_DOWN
+			}
+		case "slave_priority":
+			ri.slavePriority, _ = strconv.Atoi(value)
+		case "slave_repl_offset":
+			ri.slaveReplOffset, _ = strconv.ParseInt(value, 10, 64)
+		case "replica_announced":
+			ri.replicaAnnounced = value == "1"
+		default:
+			// slave<n>:ip=...,port=...,state=...,offset=...,lag=...
+			if ri.flags&SRI_MASTER != 0 && strings.HasPrefix(key, "slave") && isDigits(key[5:]) {
+				server.sentinelDiscoverSlave(ri, value)
+			}
+		}
+	}
+	ri.infoRefresh = time.Now().UnixMilli()
+
+	if role != 0 && role != ri.roleReported {
+		ri.roleReportedTime = time.Now().UnixMilli()
+		ri.roleReported = role
+		if role == SRI_SLAVE {
+			ri.slaveConfChangeTime = ri.roleReportedTime
+		}
+		// a role that is not the one we know is a mismatch
+		typ := "+role-change"
+		if ri.flags&(SRI_MASTER|SRI_SLAVE) != role {
+			typ = "-role-change"
+		}
+		roleName := "master"
+		if role == SRI_SLAVE {
+			roleName = "slave"
+		}
+		server.sentinelEvent(typ, ri, "new reported role is "+roleName)
+	}
+
+	if ri.flags&SRI_SLAVE == 0 {
+		return
+	}
+	master := ri.master
+	now := time.Now().UnixMilli()
+
+	// a replica turned master is the one we promote, or one to turn back
+	// into a replica once it says so for a while
+	if role == SRI_MASTER {
+		if ri.flags&SRI_PROMOTED != 0 && master.flags&SRI_FAILOVER_IN_PROGRESS != 0 &&
+			master.failoverState == SENTINEL_FAILOVER_STATE_WAIT_PROMOTION {
+			master.configEpoch = master.failoverEpoch
+			master.failoverState = SENTINEL_FAILOVER_STATE_RECONF_SLAVES
+			master.failoverStateChangeTime = now
+			server.sentinelFlushConfig()
+			server.sentinelEvent("+promoted-slave", ri, "")
+			server.sentinelEvent("+failover-state-reconf-slaves", master, "")
+			// the other sentinels learn the new configuration now
+			sentinelForceHelloUpdateForMaster(master)
+		} else {
+			waitTime := int64(SENTINEL_PUBLISH_PERIOD * 4)
+			if ri.flags&SRI_PROMOTED == 0 && sentinelMasterLooksSane(master) &&
+				sentinelRedisInstanceNoDownFor(ri, waitTime) && now-ri.roleReportedTime > waitTime {
+				if server.sentinelSendSlaveOf(ri, master.ip, master.port) {
+					server.sentinelEvent("+convert-to-slave", ri, "")
+				}
+			}
+		}
+	}
+
+	// a replica of another master is pointed back to ours, unless it just
+	// changed, as it does during a failover
+	if role == SRI_SLAVE && (ri.slaveMasterPort != master.port || ri.slaveMasterHost != master.ip) {
+		waitTime := master.failoverTimeout
+		if sentinelMasterLooksSane(master) && sentinelRedisInstanceNoDownFor(ri, waitTime) &&
+			now-ri.slaveConfChangeTime > waitTime {
+			if server.sentinelSendSlaveOf(ri, master.ip, master.port) {
+				server.sentinelEvent("+fix-slave-config", ri, "")
+			}
+		}
+	}
+
+	// the progress of a replica told to replicate the promoted one
+	if role == SRI_SLAVE && ri.flags&(SRI_RECONF_SENT|SRI_RECONF_INPROG) != 0 {
+		promoted := master.promotedSlave
+		if ri.flags&SRI_RECONF_SENT != 0 && promoted != nil &&
+			ri.slaveMasterHost == promoted.ip && ri.slaveMasterPort == promoted.port {
+			ri.flags &^= SRI_RECONF_SENT
+			ri.flags |= SRI_RECONF_INPROG
+			server.sentinelEvent("+slave-reconf-inprog", ri, "")
+		}
+		if ri.flags&SRI_RECONF_INPROG != 0 && ri.slaveMasterLinkStatus == SENTINEL_MASTER_LINK_STATUS_UP {
+			ri.flags &^= SRI_RECONF_INPROG
+			ri.flags |= SRI_RECONF_DONE
+			server.sentinelEvent("+slave-reconf-done", ri, "")
+		}
+	}
+}
+
+// sentinelDiscoverSlave adds a replica listed in the INFO of its master
+func (server *RedisServer) sentinelDiscoverSlave(master *sentinelRedisInstance, fields string) {
+	ip, port := "", 0
+	for _, field := range strings.Split(fields, ",") {
+		name, value, _ := strings.Cut(field, "=")
+		switch name {
+		case "ip":
+			ip = value
+		case "port":
+			port, _ = strconv.Atoi(value)
+		}
+	}
+	if ip == "" || port == 0 {
+		return
+	}
+	if master.slaves[net.JoinHostPort(ip, strconv.Itoa(port))] != nil {
+		return
+	}
+	if slave, err := server.createSentinelRedisInstance("", SRI_SLAVE, ip, port, master.quorum, master); err == nil {
+		server.sentinelEvent("+slave", slave, "")
+		server.sentinelFlushConfig()
+	}
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// sentinelCheckSubjectivelyDown flags an instance that didn't answer a
+// ping for down-after-milliseconds, or a master that says it is a replica
+// for longer than that and two INFO periods
+func (server *RedisServer) sentinelCheckSubjectivelyDown(ri *sentinelRedisInstance) {
+	link := ri.link
+	now := time.Now().UnixMilli()
+
+	elapsed := int64(0)
+	if link.actPingTime != 0 {
+		elapsed = now - link.actPingTime
+	} else if link.disconnected {
+		elapsed = now - link.lastAvailTime
+	}
+
+	// the connection itself may be what's broken, one that stops
+	// answering for half the down time is reconnected
+	if link.cc != nil && now-link.ccConnTime > SENTINEL_MIN_LINK_RECONNECT_PERIOD && link.actPingTime != 0 &&
+		now-link.actPingTime > ri.downAfterPeriod/2 && now-link.lastPongTime > ri.downAfterPeriod/2 {
+		server.instanceLinkCloseConnection(link, link.cc)
+	}
+	// so is a hello connection that gets no hello at all
+	if link.pc != nil && now-link.pcConnTime > SENTINEL_MIN_LINK_RECONNECT_PERIOD &&
+		now-link.pcLastActivity > SENTINEL_PUBLISH_PERIOD*3 {
+		server.instanceLinkCloseConnection(link, link.pc)
+	}
+
+	if elapsed > ri.downAfterPeriod || (ri.flags&SRI_MASTER != 0 && ri.roleReported == SRI_SLAVE &&
+		now-ri.roleReportedTime > ri.downAfterPeriod+SENTINEL_INFO_PERIOD*2) {
+		if ri.flags&SRI_S_DOWN == 0 {
+			server.sentinelEvent("+sdown", ri, "")
+			ri.sDownSinceTime = now
+			ri.flags |= SRI_S_DOWN
+		}
+	} else if ri.flags&SRI_S_DOWN != 0 {
+		server.sentinelEvent("-sdown", ri, "")
+		ri.flags &^= SRI_S_DOWN | SRI_SCRIPT_KILL_SENT
+	}
+}
+
+// sentinelCheckObjectivelyDown counts the sentinels that see the master
+// down, us included, against its quorum
+func (server *RedisServer) sentinelCheckObjectivelyDown(master *sentinelRedisInstance) {
+	quorum := 0
+	if master.flags&SRI_S_DOWN != 0 {
+		quorum = 1
+		for _, ri := range master.sentinels {
+			if ri.flags&SRI_MASTER_DOWN != 0 {
+				quorum++
+			}
+		}
+	}
+
+	if master.flags&SRI_S_DOWN != 0 && quorum >= master.quorum {
+		if master.flags&SRI_O_DOWN == 0 {
+			server.sentinelEvent("+odown", master, fmt.Sprintf("#quorum %d/%d", quorum, master.quorum))
+			master.flags |= SRI_O_DOWN
+			master.oDownSinceTime = time.Now().UnixMilli()
+		}
+	} else if master.flags&SRI_O_DOWN != 0 {
+		server.sentinelEvent("-odown", master, "")
+		master.flags &^= SRI_O_DOWN
+	}
+}
+
+// sentinelAskMasterStateToOtherSentinels asks the sentinels of a master
+// we see down if they do too, and once we try to fail it over for their
+// vote. An answer older than a few ask periods no longer counts.
+func (server *RedisServer) sentinelAskMasterStateToOtherSentinels(master *sentinelRedisInstance, flags int) {
+	now := time.Now().UnixMilli()
+	for _, ri := range master.sentinels {
+		elapsed := now - ri.lastMasterDownReplyTime
+		if elapsed > SENTINEL_ASK_PERIOD*5 {
+			ri.flags &^= SRI_MASTER_DOWN
+			ri.leader = ""
+		}
+
+		if master.flags&SRI_S_DOWN == 0 || ri.link.disconnected {
+			continue
+		}
+		if flags&SENTINEL_ASK_FORCED == 0 && elapsed < SENTINEL_ASK_PERIOD {
+			continue
+		}
+
+		runid := "*"
+		if master.failoverState > SENTINEL_FAILOVER_STATE_NONE {
+			runid = server.sentinel.myid
+		}
+		sentinel := ri
+		server.sentinelSendCommand(ri, func(reply interface{}) {
+			server.sentinelReceiveIsMasterDownReply(sentinel, reply)
+		}, "SENTINEL", "is-master-down-by-addr", master.ip, strconv.Itoa(master.port),
+			strconv.FormatUint(server.sentinel.currentEpoch, 10), runid)
+	}
+}
+
+// sentinelReceiveIsMasterDownReply reads [<down> <leader> <leader-epoch>]
+func (server *RedisServer) sentinelReceiveIsMasterDownReply(ri *sentinelRedisInstance, reply interface{}) {
+	r, ok := reply.([]interface{})
+	if !ok || len(r) != 3 {
+		return
+	}
+	down, _ := r[0].(string)
+	leader, ok := r[1].(string)
+	if !ok {
+		return
+	}
+	leaderEpoch, err := strconv.ParseUint(fmt.Sprint(r[2]), 10, 64)
+	if err != nil {
+		return
+	}
+	ri.lastMasterDownReplyTime = time.Now().UnixMilli()
+	if down == "1" {
+		ri.flags |= SRI_MASTER_DOWN
+	} else {
+		ri.flags &^= SRI_MASTER_DOWN
+	}
+	if leader != "*" {
+		if ri.leaderEpoch != leaderEpoch {
+			fmt.Printf("%s voted for %s %d\n", ri.name, leader, leaderEpoch)
+		}
+		ri.leader = leader
+		ri.leaderEpoch = leaderEpoch
+	}
+}
+
+// sentinelHandleRedisInstance does the periodic work of an instance
+func (server *RedisServer) sentinelHandleRedisInstance(ri *sentinelRedisInstance) {
+	server.sentinelReconnectInstance(ri)
+	server.sentinelSendPeriodicCommands(ri)
+
+	server.sentinelCheckSubjectivelyDown(ri)
+	if ri.flags&SRI_MASTER != 0 {
+		server.sentinelCheckObjectivelyDown(ri)
+		if server.sentinelStartFailoverIfNeeded(ri) {
+			server.sentinelAskMasterStateToOtherSentinels(ri, SENTINEL_ASK_FORCED)
+		}
+		server.sentinelFailoverStateMachine(ri)
+		server.sentinelAskMasterStateToOtherSentinels(ri, SENTINEL_NO_FLAGS)
+	}
+}
+
+// sentinelHandleDictOfRedisInstances handles the instances, and the
+// replicas and the sentinels of the masters. A master whose failover ended
+// is switched to its new address once they are all handled.
+func (server *RedisServer) sentinelHandleDictOfRedisInstances(instances map[string]*sentinelRedisInstance) {
+	var switchToPromoted *sentinelRedisInstance
+	for _, ri := range instances {
+		server.sentinelHandleRedisInstance(ri)
+		if ri.flags&SRI_MASTER != 0 {
+			server.sentinelHandleDictOfRedisInstances(ri.slaves)
+			server.sentinelHandleDictOfRedisInstances(ri.sentinels)
+			if ri.failoverState == SENTINEL_FAILOVER_STATE_UPDATE_CONFIG {
+				switchToPromoted = ri
+			}
+		}
+	}
+	if switchToPromoted != nil {
+		server.sentinelFailoverSwitchToPromotedSlave(switchToPromoted)
+	}
+}
+
+// sentinelTimer is called by serverCron in sentinel mode
+func (server *RedisServer) sentinelTimer() {
+	server.sentinelHandleDictOfRedisInstances(server.sentinel.masters)
+}
+
+func sentinelFlagsString(ri *sentinelRedisInstance) string {
+	names := []struct {
+		flag int
+		name string
+	}{
+		{SRI_S_DOWN, "s_down"},
+		{SRI_O_DOWN, "o_down"},
+		{SRI_MASTER, "master"},
+		{SRI_SLAVE, "slave"},
+		{SRI_SENTINEL, "sentinel"},
+		{SRI_MASTER_DOWN, "master_down"},
+		{SRI_SCRIPT_KILL_SENT, "script_kill_sent"},
+		{SRI_FAILOVER_IN_PROGRESS, "failover_in_progress"},
+		{SRI_PROMOTED, "promoted"},
+		{SRI_RECONF_SENT, "reconf_sent"},
+		{SRI_RECONF_INPROG, "reconf_inprog"},
+		{SRI_RECONF_DONE, "reconf_done"},
+		{SRI_FORCE_FAILOVER, "force_failover"},
+	}
+	flags := []string{}
+	for _, n := range names {
+		if ri.flags&n.flag != 0 {
+			flags = append(flags, n.name)
+		}
+		if n.flag == SRI_SENTINEL && ri.link.disconnected {
+			flags = append(flags, "disconnected")
+		}
+	}
+	return strings.Join(flags, ",")
+}
+
+// addReplySentinelRedisInstance is the field/value map of SENTINEL MASTERS
+// and the like, with the times as milliseconds ago
+func (server *RedisServer) addReplySentinelRedisInstance(client *RedisClient, ri *sentinelRedisInstance) []byte {
+	link := ri.link
+	now := time.Now().UnixMilli()
+	itoa := func(n int64) string { return strconv.FormatInt(n, 10) }
+
+	lastPingSent := int64(0)
+	if link.actPingTime != 0 {
+		lastPingSent = now - link.actPingTime
+	}
+	infoRefresh := int64(0)
+	if ri.infoRefresh != 0 {
+		infoRefresh = now - ri.infoRefresh
+	}
+	roleReported := "slave"
+	if ri.roleReported == SRI_MASTER {
+		roleReported = "master"
+	}
+
+	fields := []string{
+		"name", ri.name,
+		"ip", ri.ip,
+		"port", strconv.Itoa(ri.port),
+		"runid", ri.runid,
+		"flags", sentinelFlagsString(ri),
+		"link-pending-commands", strconv.Itoa(link.pendingCommands),
+		"link-refcount", "1",
+		"last-ping-sent", itoa(lastPingSent),
+		"last-ok-ping-reply", itoa(now - link.lastAvailTime),
+		"last-ping-reply", itoa(now - link.lastPongTime),
+	}
+	if ri.flags&SRI_S_DOWN != 0 {
+		fields = append(fields, "s-down-time", itoa(now-ri.sDownSinceTime))
+	}
+	if ri.flags&SRI_O_DOWN != 0 {
+		fields = append(fields, "o-down-time", itoa(now-ri.oDownSinceTime))
+	}
+	fields = append(fields,
+		"down-after-milliseconds", itoa(ri.downAfterPeriod),
+		"info-refresh", itoa(infoRefresh),
+		"role-reported", roleReported,
+		"role-reported-time", itoa(now-ri.roleReportedTime))
+
+	switch {
+	case ri.flags&SRI_MASTER != 0:
+		fields = append(fields,
+			"config-epoch", strconv.FormatUint(ri.configEpoch, 10),
+			"num-slaves", strconv.Itoa(len(ri.slaves)),
+			"num-other-sentinels", strconv.Itoa(len(ri.sentinels)),
+			"quorum", strconv.Itoa(ri.quorum),
+			"failover-timeout", itoa(ri.failoverTimeout),
+			"parallel-syncs", strconv.Itoa(ri.parallelSyncs))
+		if ri.flags&SRI_FAILOVER_IN_PROGRESS != 0 {
+			fields = append(fields, "failover-state", sentinelFailoverStateStr(ri.failoverState))
+		}
+	case ri.flags&SRI_SLAVE != 0:
+		linkStatus := "ok"
+		if ri.slaveMasterLinkStatus == SENTINEL_MASTER_LINK_STATUS_DOWN {
+			linkStatus = "err"
+		}
+		masterHost := ri.slaveMasterHost
+		if masterHost == "" {
+			masterHost = "?"
+		}
+		fields = append(fields,
+			"master-link-down-time", itoa(ri.masterLinkDownTime),
+			"master-link-status", linkStatus,
+			"master-host", masterHost,
+			"master-port", strconv.Itoa(ri.slaveMasterPort),
+			"slave-priority", strconv.Itoa(ri.slavePriority),
+			"slave-repl-offset", itoa(ri.slaveReplOffset),
+			"replica-announced", strconv.Itoa(boolToInt(ri.replicaAnnounced)))
+	case ri.flags&SRI_SENTINEL != 0:
+		leader := ri.leader
+		if leader == "" {
+			leader = "?"
+		}
+		fields = append(fields,
+			"last-hello-message", itoa(now-ri.lastHelloTime),
+			"voted-leader", leader,
+			"voted-leader-epoch", strconv.FormatUint(ri.leaderEpoch, 10))
+	}
+
+	reply := bytes.Buffer{}
+	reply.Write(client.addReplyMapLen(len(fields) / 2))
+	for _, field := range fields {
+		writeReplyValue(&reply, field)
+	}
+	return reply.Bytes()
+}
+
+func (server *RedisServer) addReplySentinelRedisInstances(client *RedisClient, instances []*sentinelRedisInstance) []byte {
+	reply := bytes.Buffer{}
+	reply.Write(addReplyArrayLen(len(instances)))
+	for _, ri := range instances {
+		reply.Write(server.addReplySentinelRedisInstance(client, ri))
+	}
+	return reply.Bytes()
+}
+
+// sentinelGetMasterByNameOrReplyError finds the master, or the error to
+// reply with
+func (server *RedisServer) sentinelGetMasterByNameOrReplyError(arg interface{}) (*sentinelRedisInstance, []byte) {
+	name, _ := arg.(string)
+	master := server.sentinel.masters[name]
+	if master == nil {
+		return nil, []byte("-ERR No such master with that name\r\n")
+	}
+	return master, nil
+}
+
+func (server *RedisServer) sentinelGetMasterByAddr(ip string, port int) *sentinelRedisInstance {
+	for _, master := range server.sentinel.masters {
+		if master.ip == ip && master.port == port {
+			return master
+		}
+	}
+	return nil
+}
+
+func (server *RedisServer) handleSentinelCommand(cmd string, args []interface{}) []byte {
+	subcommand, _ := args[0].(string)
+	subcommand = strings.ToUpper(subcommand)
+	client := server.currentClient
+	sentinel := server.sentinel
+
+	switch {
+	case subcommand == "HELP" && len(args) == 1:
+		return addReplyHelp("SENTINEL", []string{
+			"CKQUORUM <master-name>",
+			"    Check if the current Sentinel configuration is able to reach the quorum",
+			"    needed to failover a master and the majority needed to authorize the",
+			"    failover.",
+			"FAILOVER <master-name>",
+			"    Manually failover a master node without asking for agreement from other",
+			"    Sentinels",
+			"GET-MASTER-ADDR-BY-NAME <master-name>",
+			"    Return the ip and port number of the master with that name.",
+			"IS-MASTER-DOWN-BY-ADDR <ip> <port> <current-epoch> <runid>",
+			"    Check if the master specified by ip:port is down from current Sentinel's",
+			"    point of view.",
+			"MASTER <master-name>",
+			"    Show the state and info of the specified master.",
+			"MASTERS",
+			"    Show a list of monitored masters and their state.",
+			"MONITOR <name> <ip> <port> <quorum>",
+			"    Start monitoring a new master with the specified name, ip, port and quorum.",
+			"MYID",
+			"    Return the ID of the Sentinel instance.",
+			"REMOVE <master-name>",
+			"    Remove master from Sentinel's monitor list.",
+			"REPLICAS <master-name>",
+			"    Show a list of replicas for this master and their state.",
+			"RESET <pattern>",
+			"    Reset masters for specific master name matching this pattern.",
+			"SENTINELS <master-name>",
+			"    Show a list of Sentinel instances for this master and their state.",
+			"SET <master-name> <option> <value> [<option> <value> ...]",
+			"    Set configuration parameters for certain masters.",
+		})
+	case subcommand == "MASTERS" && len(args) == 1:
+		masters := []*sentinelRedisInstance{}
+		for _, name := range server.sentinelMasterNames() {
+			masters = append(masters, sentinel.masters[name])
+		}
+		return server.addReplySentinelRedisInstances(client, masters)
+	case subcommand == "MASTER" && len(args) == 2:
+		master, errReply := server.sentinelGetMasterByNameOrReplyError(args[1])
+		if master == nil {
+			return errReply
+		}
+		return server.addReplySentinelRedisInstance(client, master)
+	case (subcommand == "REPLICAS" || subcommand == "SLAVES") && len(args) == 2:
+		master, errReply := server.sentinelGetMasterByNameOrReplyError(args[1])
+		if master == nil {
+			return errReply
+		}
+		return server.addReplySentinelRedisInstances(client, sentinelInstancesSorted(master.slaves))
+	case subcommand == "SENTINELS" && len(args) == 2:
+		master, errReply := server.sentinelGetMasterByNameOrReplyError(args[1])
+		if master == nil {
+			return errReply
+		}
+		return server.addReplySentinelRedisInstances(client, sentinelInstancesSorted(master.sentinels))
+	case subcommand == "GET-MASTER-ADDR-BY-NAME" && len(args) == 2:
+		name, _ := args[1].(string)
+		master := sentinel.masters[name]
+		if master == nil {
+			return client.addReplyNullArray()
+		}
+		ip, port := sentinelGetCurrentMasterAddress(master)
+		return addReplyArray([]string{ip, strconv.Itoa(port)})
+	case subcommand == "IS-MASTER-DOWN-BY-ADDR" && len(args) == 5:
+		return server.sentinelIsMasterDownByAddrCommand(args[1:])
+	case subcommand == "MONITOR" && len(args) == 5:
+		return server.sentinelMonitorCommand(args[1:])
+	case subcommand == "REMOVE" && len(args) == 2:
+		master, errReply := server.sentinelGetMasterByNameOrReplyError(args[1])
+		if master == nil {
+			return errReply
+		}
+		server.sentinelEvent("-monitor", master, "")
+		server.releaseSentinelRedisInstance(master)
+		delete(sentinel.masters, master.name)
+		server.sentinelFlushConfig()
+		return []byte("+OK\r\n")
+	case subcommand == "SET" && len(args) >= 4 && len(args)%2 == 0:
+		return server.sentinelSetCommand(args[1:])
+	case subcommand == "MYID" && len(args) == 1:
+		return addReplyBulk([]interface{}{sentinel.myid})
+	case subcommand == "CKQUORUM" && len(args) == 2:
+		master, errReply := server.sentinelGetMasterByNameOrReplyError(args[1])
+		if master == nil {
+			return errReply
+		}
+		return server.sentinelCkquorumCommand(master)
+	case subcommand == "FAILOVER" && len(args) == 2:
+		master, errReply := server.sentinelGetMasterByNameOrReplyError(args[1])
+		if master == nil {
+			return errReply
+		}
+		return server.sentinelFailoverCommand(master)
+	case subcommand == "RESET" && len(args) == 2:
+		pattern, _ := args[1].(string)
+		reset := 0
+		for _, name := range server.sentinelMasterNames() {
+			master := sentinel.masters[name]
+			if master.name != "" && stringMatch(pattern, master.name, false) {
+				server.sentinelResetMaster(master, SENTINEL_RESET_SENTINELS|SENTINEL_GENERATE_EVENT)
+				reset++
+			}
+		}
+		if reset > 0 {
+			server.sentinelFlushConfig()
+		}
+		return addReplyLongLong(int64(reset))
+	}
+	return addReplySubcommandSyntaxError("SENTINEL", subcommand)
+}
+
+// sentinelIsMasterDownByAddrCommand tells another sentinel if we see the
+// master at ip:port down: [<down> <leader> <leader-epoch>]. With a run ID
+// rather than "*" it is also a request for our vote in the epoch.
+func (server *RedisServer) sentinelIsMasterDownByAddrCommand(args []interface{}) []byte {
+	ip, _ := args[0].(string)
+	portArg, _ := args[1].(string)
+	epochArg, _ := args[2].(string)
+	port, err := strconv.Atoi(portArg)
+	if err != nil {
+		return []byte("-ERR value is not an integer or out of range\r\n")
+	}
+	reqEpoch, err := strconv.ParseUint(epochArg, 10, 64)
+	if err != nil {
+		return []byte("-ERR value is not an integer or out of range\r\n")
+	}
+	runid, _ := args[3].(string)
+
+	down := 0
+	master := server.sentinelGetMasterByAddr(ip, port)
+	if master != nil && master.flags&SRI_S_DOWN != 0 {
+		down = 1
+	}
+
+	leader, leaderEpoch := "", uint64(0)
+	if master != nil && runid != "*" {
+		leader, leaderEpoch = server.sentinelVoteLeader(master, reqEpoch, runid)
+	}
+	if leader == "" {
+		leader = "*"
+	}
+	return addReplyValue([]interface{}{down, leader, int64(leaderEpoch)})
+}
+
+func (server *RedisServer) sentinelMonitorCommand(args []interface{}) []byte {
+	name, _ := args[0].(string)
+	ip, _ := args[1].(string)
+	portArg, _ := args[2].(string)
+	quorumArg, _ := args[3].(string)
+
+	quorum, err := strconv.Atoi(quorumArg)
+	if err != nil {
+		return []byte("-ERR value is not an integer or out of range\r\n")
+	}
+	if quorum <= 0 {
+		return []byte("-ERR Quorum must be 1 or greater.\r\n")
+	}
+	port, err := strconv.Atoi(portArg)
+	if err != nil {
+		return []byte("-ERR value is not an integer or out of range\r\n")
+	}
+	if port <= 0 || port > 65535 {
+		return []byte("-ERR Invalid port number\r\n")
+	}
+	if net.ParseIP(ip) == nil {
+		return []byte("-ERR Invalid IP address or hostname specified\r\n")
+	}
+	if server.sentinel.masters[name] != nil {
+		return []byte("-ERR Duplicated master name\r\n")
+	}
+
+	master, err := server.createSentinelRedisInstance(name, SRI_MASTER, ip, port, quorum, nil)
+	if err != nil {
+		return []byte(fmt.Sprintf("-ERR %v\r\n", err))
+	}
+	server.sentinelFlushConfig()
+	server.sentinelEvent("+monitor", master, fmt.Sprintf("quorum %d", master.quorum))
+	return []byte("+OK\r\n")
+}
+
+// sentinelSetCommand changes the options of a master, checking them all
+// before setting any
+func (server *RedisServer) sentinelSetCommand(args []interface{}) []byte {
+	master, errReply := server.sentinelGetMasterByNameOrReplyError(args[0])
+	if master == nil {
+		return errReply
+	}
+
+	type change struct {
+		option string
+		value  int64
+	}
+	changes := []change{}
+	for i := 1; i < len(args); i += 2 {
+		option, _ := args[i].(string)
+		value, _ := args[i+1].(string)
+		option = strings.ToLower(option)
+		switch option {
+		case "down-after-milliseconds", "failover-timeout", "parallel-syncs", "quorum":
+		default:
+			return []byte(fmt.Sprintf("-ERR Unknown option or number of arguments for SENTINEL SET '%s'\r\n", option))
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n <= 0 {
+			return []byte(fmt.Sprintf("-ERR Invalid argument '%s' for SENTINEL SET '%s'\r\n", value, option))
+		}
+		changes = append(changes, change{option, n})
+	}
+
+	for _, c := range changes {
+		switch c.option {
+		case "down-after-milliseconds":
+			master.downAfterPeriod = c.value
+			sentinelPropagateDownAfterPeriod(master)
+		case "failover-timeout":
+			master.failoverTimeout = c.value
+		case "parallel-syncs":
+			master.parallelSyncs = int(c.value)
+		case "quorum":
+			master.quorum = int(c.value)
+		}
+		server.sentinelEvent("+set", master, fmt.Sprintf("%s %d", c.option, c.value))
+	}
+	server.sentinelFlushConfig()
+	return []byte("+OK\r\n")
+}
+
+// sentinelCkquorumCommand checks that enough sentinels are reachable to
+// reach the quorum of the master, and the majority a failover needs
+func (server *RedisServer) sentinelCkquorumCommand(master *sentinelRedisInstance) []byte {
+	voters := len(master.sentinels) + 1
+	usable := 1
+	for _, ri := range master.sentinels {
+		if ri.flags&(SRI_S_DOWN|SRI_O_DOWN) == 0 {
+			usable++
+		}
+	}
+
+	if usable < master.quorum {
+		return []byte(fmt.Sprintf("-NOQUORUM %d usable Sentinels. Not enough available Sentinels to reach the "+
+			"specified quorum for this master\r\n", usable))
+	}
+	if usable < voters/2+1 {
+		return []byte(fmt.Sprintf("-NOQUORUM %d usable Sentinels. Not enough available Sentinels to reach the "+
+			"majority and authorize a failover\r\n", usable))
+	}
+	return []byte(fmt.Sprintf("+OK %d usable Sentinels. Quorum and failover authorization can be reached\r\n", usable))
+}
+
+// sentinelRoleReply is ROLE for a sentinel, the names of its masters
+func (server *RedisServer) sentinelRoleReply() []byte {
+	return addReplyValue([]interface{}{"sentinel", server.sentinelMasterNames()})
+}
+
+func (server *RedisServer) genInfoSentinel(b *strings.Builder) {
+	sentinel := server.sentinel
+	fmt.Fprintf(b, "sentinel_masters:%d\r\n", len(sentinel.masters))
+	for i, name := range server.sentinelMasterNames() {
+		master := sentinel.masters[name]
+		status := "ok"
+		if master.flags&SRI_O_DOWN != 0 {
+			status = "odown"
+		} else if master.flags&SRI_S_DOWN != 0 {
+			status = "sdown"
+		}
+		fmt.Fprintf(b, "master%d:name=%s,status=%s,address=%s,slaves=%d,sentinels=%d\r\n",
+			i, name, status, net.JoinHostPort(master.ip, strconv.Itoa(master.port)),
+			len(master.slaves), len(master.sentinels)+1)
+	}
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Once a master is objectively down, the sentinels that see it so try to
+// fail it over in a new epoch, asking the others for their vote. The one
+// voted for by the majority, and by at least the quorum, is the leader: it
+// promotes the best replica with REPLICAOF NO ONE, points the other
+// replicas to it a few at a time, then switches the master to its address.
+// Its hellos carry the new configuration, with the epoch of the failover,
+// and the other sentinels switch too.
+
+// failover states of a master
+const (
+	SENTINEL_FAILOVER_STATE_NONE = iota
+	// waiting to be elected leader
+	SENTINEL_FAILOVER_STATE_WAIT_START
+	SENTINEL_FAILOVER_STATE_SELECT_SLAVE
+	SENTINEL_FAILOVER_STATE_SEND_SLAVEOF_NOONE
+	SENTINEL_FAILOVER_STATE_WAIT_PROMOTION
+	SENTINEL_FAILOVER_STATE_RECONF_SLAVES
+	// the replicas follow the promoted one, the master is switched to it
+	SENTINEL_FAILOVER_STATE_UPDATE_CONFIG
+)
+
+// in milliseconds
+const (
+	SENTINEL_ELECTION_TIMEOUT     = 10000
+	SENTINEL_SLAVE_RECONF_TIMEOUT = 10000
+	// the sentinels start their failovers at random times within this,
+	// so one is likely to be elected first
+	SENTINEL_MAX_DESYNC = 1000
+)
+
+func sentinelFailoverStateStr(state int) string {
+	switch state {
+	case SENTINEL_FAILOVER_STATE_NONE:
+		return "none"
+	case SENTINEL_FAILOVER_STATE_WAIT_START:
+		return "wait_start"
+	case SENTINEL_FAILOVER_STATE_SELECT_SLAVE:
+		return "select_slave"
+	case SENTINEL_FAILOVER_STATE_SEND_SLAVEOF_NOONE:
+		return "send_slaveof_noone"
+	case SENTINEL_FAILOVER_STATE_WAIT_PROMOTION:
+		return "wait_promotion"
+	case SENTINEL_FAILOVER_STATE_RECONF_SLAVES:
+		return "reconf_slaves"
+	case SENTINEL_FAILOVER_STATE_UPDATE_CONFIG:
+		return "update_config"
+	}
+	return "unknown"
+}
+
+// sentinelVoteLeader votes for reqRunid as the leader of the failover of
+// the master in reqEpoch, unless we already voted in that epoch. It
+// returns the leader we voted for and the epoch of the vote.
+func (server *RedisServer) sentinelVoteLeader(master *sentinelRedisInstance, reqEpoch uint64, reqRunid string) (string, uint64) {
+	sentinel := server.sentinel
+	if reqEpoch > sentinel.currentEpoch {
+		sentinel.currentEpoch = reqEpoch
+		server.sentinelFlushConfig()
+		server.sentinelEvent("+new-epoch", nil, strconv.FormatUint(reqEpoch, 10))
+	}
+
+	if master.leaderEpoch < reqEpoch && sentinel.currentEpoch <= reqEpoch {
+		master.leader = reqRunid
+		master.leaderEpoch = sentinel.currentEpoch
+		server.sentinelFlushConfig()
+		server.sentinelEvent("+vote-for-leader", nil, fmt.Sprintf("%s %d", master.leader, master.leaderEpoch))
+		// voting for another delays our own failover
+		if master.leader != sentinel.myid {
+			master.failoverStartTime = time.Now().UnixMilli() + rand.Int63n(SENTINEL_MAX_DESYNC)
+		}
+	}
+	return master.leader, master.leaderEpoch
+}
+
+// sentinelGetLeader counts the votes of the sentinels in the epoch, and
+// gives ours to the one with the most votes, or to us. The winner needs
+// the majority of the sentinels and the quorum of the master.
+func (server *RedisServer) sentinelGetLeader(master *sentinelRedisInstance, epoch uint64) string {
+	sentinel := server.sentinel
+	voters := len(master.sentinels) + 1
+	counters := map[string]int{}
+	for _, ri := range master.sentinels {
+		if ri.leader != "" && ri.leaderEpoch == sentinel.currentEpoch {
+			counters[ri.leader]++
+		}
+	}
+
+	winner, maxVotes := "", 0
+	for leader, votes := range counters {
+		if votes > maxVotes || (votes == maxVotes && leader < winner) {
+			winner, maxVotes = leader, votes
+		}
+	}
+
+	candidate := winner
+	if candidate == "" {
+		candidate = sentinel.myid
+	}
+	myvote, leaderEpoch := server.sentinelVoteLeader(master, epoch, candidate)
+	if myvote != "" && leaderEpoch == epoch {
+		counters[myvote]++
+		if counters[myvote] > maxVotes {
+			winner, maxVotes = myvote, counters[myvote]
+		}
+	}
+
+	if maxVotes < voters/2+1 || maxVotes < master.quorum {
+		return ""
+	}
+	return winner
+}
+
+// sentinelSendSlaveOf points the instance to a master, or makes it a
+// master with an empty host
+func (server *RedisServer) sentinelSendSlaveOf(ri *sentinelRedisInstance, host string, port int) bool {
+	args := []string{"REPLICAOF", "NO", "ONE"}
+	if host != "" {
+		args = []string{"REPLICAOF", host, strconv.Itoa(port)}
+	}
+	return server.sentinelSendCommand(ri, func(reply interface{}) {}, args...)
+}
+
+// sentinelMasterLooksSane tells a master that is up and says it is a
+// master, to point replicas to it
+func sentinelMasterLooksSane(master *sentinelRedisInstance) bool {
+	return master.flags&SRI_MASTER != 0 && master.roleReported == SRI_MASTER &&
+		master.flags&(SRI_S_DOWN|SRI_O_DOWN) == 0 &&
+		time.Now().UnixMilli()-master.infoRefresh < SENTINEL_INFO_PERIOD*2
+}
+
+// sentinelRedisInstanceNoDownFor tells an instance that wasn't down in the
+// last ms milliseconds
+func sentinelRedisInstanceNoDownFor(ri *sentinelRedisInstance, ms int64) bool {
+	mostRecent := ri.sDownSinceTime
+	if ri.oDownSinceTime > mostRecent {
+		mostRecent = ri.oDownSinceTime
+	}
+	return mostRecent == 0 || time.Now().UnixMilli()-mostRecent > ms
+}
+
+// sentinelStartFailoverIfNeeded starts the failover of a master that is
+// objectively down, unless we tried, or voted for another, less than two
+// failover timeouts ago
+func (server *RedisServer) sentinelStartFailoverIfNeeded(master *sentinelRedisInstance) bool {
+	if master.flags&SRI_O_DOWN == 0 || master.flags&SRI_FAILOVER_IN_PROGRESS != 0 {
+		return false
+	}
+
+	if time.Now().UnixMilli()-master.failoverStartTime < master.failoverTimeout*2 {
+		if master.failoverDelayLogged != master.failoverStartTime {
+			next := time.UnixMilli(master.failoverStartTime + master.failoverTimeout*2)
+			fmt.Printf("Next failover delay: I will not start a failover before %s\n", next.Format(time.ANSIC))
+			master.failoverDelayLogged = master.failoverStartTime
+		}
+		return false
+	}
+
+	server.sentinelStartFailover(master)
+	return true
+}
+
+func (server *RedisServer) sentinelStartFailover(master *sentinelRedisInstance) {
+	sentinel := server.sentinel
+	master.failoverState = SENTINEL_FAILOVER_STATE_WAIT_START
+	master.flags |= SRI_FAILOVER_IN_PROGRESS
+	sentinel.currentEpoch++
+	master.failoverEpoch = sentinel.currentEpoch
+	server.sentinelFlushConfig()
+	server.sentinelEvent("+new-epoch", nil, strconv.FormatUint(sentinel.currentEpoch, 10))
+	server.sentinelEvent("+try-failover", master, "")
+	now := time.Now().UnixMilli()
+	master.failoverStartTime = now + rand.Int63n(SENTINEL_MAX_DESYNC)
+	master.failoverStateChangeTime = now
+}
+
+func (server *RedisServer) sentinelAbortFailover(master *sentinelRedisInstance) {
+	master.flags &^= SRI_FAILOVER_IN_PROGRESS | SRI_FORCE_FAILOVER
+	master.failoverState = SENTINEL_FAILOVER_STATE_NONE
+	master.failoverStateChangeTime = time.Now().UnixMilli()
+	if master.promotedSlave != nil {
+		master.promotedSlave.flags &^= SRI_PROMOTED
+		master.promotedSlave = nil
+	}
+}
+
+// sentinelSelectSlave picks the replica to promote among the ones that are
+// up, answered lately, and were not disconnected from the master for long
+// before it went down: the one with the lowest priority, then the most
+// data, then the lowest run ID
+func (server *RedisServer) sentinelSelectSlave(master *sentinelRedisInstance) *sentinelRedisInstance {
+	now := time.Now().UnixMilli()
+	maxMasterDownTime := master.downAfterPeriod * 10
+	if master.flags&SRI_S_DOWN != 0 {
+		maxMasterDownTime += now - master.sDownSinceTime
+	}
+	infoValidityTime := int64(SENTINEL_INFO_PERIOD * 3)
+	if master.flags&SRI_S_DOWN != 0 {
+		infoValidityTime = SENTINEL_PING_PERIOD * 5
+	}
+
+	candidates := []*sentinelRedisInstance{}
+	for _, slave := range master.slaves {
+		if slave.flags&(SRI_S_DOWN|SRI_O_DOWN) != 0 || slave.link.disconnected {
+			continue
+		}
+		if now-slave.link.lastAvailTime > SENTINEL_PING_PERIOD*5 {
+			continue
+		}
+		if slave.slavePriority == 0 {
+			continue
+		}
+		if now-slave.infoRefresh > infoValidityTime {
+			continue
+		}
+		if slave.masterLinkDownTime > maxMasterDownTime {
+			continue
+		}
+		candidates = append(candidates, slave)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.slavePriority != b.slavePriority {
+			return a.slavePriority < b.slavePriority
+		}
+		if a.slaveReplOffset != b.slaveReplOffset {
+			return a.slaveReplOffset > b.slaveReplOffset
+		}
+		// a replica without a run ID comes last
+		if a.runid == "" || b.runid == "" {
+			return b.runid == "" && a.runid != ""
+		}
+		return a.runid < b.runid
+	})
+	return candidates[0]
+}
+
+// sentinelFailoverWaitStart goes on with the failover once we are elected,
+// or without an election when forced, and gives up after the election
+// timeout
+func (server *RedisServer) sentinelFailoverWaitStart(master *sentinelRedisInstance) {
+	leader := server.sentinelGetLeader(master, master.failoverEpoch)
+	isLeader := leader != "" && leader == server.sentinel.myid
+
+	if !isLeader && master.flags&SRI_FORCE_FAILOVER == 0 {
+		electionTimeout := int64(SENTINEL_ELECTION_TIMEOUT)
+		if electionTimeout > master.failoverTimeout {
+			electionTimeout = master.failoverTimeout
+		}
+		if time.Now().UnixMilli()-master.failoverStartTime > electionTimeout {
+			server.sentinelEvent("-failover-abort-not-elected", master, "")
+			server.sentinelAbortFailover(master)
+		}
+		return
+	}
+
+	server.sentinelEvent("+elected-leader", master, "")
+	master.failoverState = SENTINEL_FAILOVER_STATE_SELECT_SLAVE
+	master.failoverStateChangeTime = time.Now().UnixMilli()
+	server.sentinelEvent("+failover-state-select-slave", master, "")
+}
+
+func (server *RedisServer) sentinelFailoverSelectSlave(master *sentinelRedisInstance) {
+	slave := server.sentinelSelectSlave(master)
+	if slave == nil {
+		server.sentinelEvent("-failover-abort-no-good-slave", master, "")
+		server.sentinelAbortFailover(master)
+		return
+	}
+
+	server.sentinelEvent("+selected-slave", slave, "")
+	slave.flags |= SRI_PROMOTED
+	master.promotedSlave = slave
+	master.failoverState = SENTINEL_FAILOVER_STATE_SEND_SLAVEOF_NOONE
+	master.failoverStateChangeTime = time.Now().UnixMilli()
+	server.sentinelEvent("+failover-state-send-slaveof-noone", slave, "")
+}
+
+// sentinelFailoverSendSlaveOfNoOne promotes the selected replica, as soon
+// as we are connected to it. Its INFO tells when it is a master.
+func (server *RedisServer) sentinelFailoverSendSlaveOfNoOne(master *sentinelRedisInstance) {
+	promoted := master.promotedSlave
+	if promoted.link.disconnected {
+		if time.Now().UnixMilli()-master.failoverStateChangeTime > master.failoverTimeout {
+			server.sentinelEvent("-failover-abort-slave-timeout", master, "")
+			server.sentinelAbortFailover(master)
+		}
+		return
+	}
+
+	if !server.sentinelSendSlaveOf(promoted, "", 0) {
+		return
+	}
+	server.sentinelEvent("+failover-state-wait-promotion", promoted, "")
+	master.failoverState = SENTINEL_FAILOVER_STATE_WAIT_PROMOTION
+	master.failoverStateChangeTime = time.Now().UnixMilli()
+}
+
+func (server *RedisServer) sentinelFailoverWaitPromotion(master *sentinelRedisInstance) {
+	if time.Now().UnixMilli()-master.failoverStateChangeTime > master.failoverTimeout {
+		server.sentinelEvent("-failover-abort-slave-timeout", master, "")
+		server.sentinelAbortFailover(master)
+	}
+}
+
+// sentinelFailoverDetectEnd ends the failover once every replica that is
+// up follows the promoted one, or after the failover timeout, when the
+// ones not told yet are told at once
+func (server *RedisServer) sentinelFailoverDetectEnd(master *sentinelRedisInstance) {
+	promoted := master.promotedSlave
+	if promoted == nil || promoted.flags&SRI_S_DOWN != 0 {
+		return
+	}
+
+	notReconfigured := 0
+	for _, slave := range master.slaves {
+		if slave.flags&(SRI_PROMOTED|SRI_RECONF_DONE|SRI_S_DOWN) != 0 {
+			continue
+		}
+		notReconfigured++
+	}
+
+	timeout := false
+	if time.Now().UnixMilli()-master.failoverStateChangeTime > master.failoverTimeout {
+		notReconfigured = 0
+		timeout = true
+		server.sentinelEvent("+failover-end-for-timeout", master, "")
+	}
+
+	if notReconfigured == 0 {
+		server.sentinelEvent("+failover-end", master, "")
+		master.failoverState = SENTINEL_FAILOVER_STATE_UPDATE_CONFIG
+		master.failoverStateChangeTime = time.Now().UnixMilli()
+	}
+
+	if timeout {
+		for _, slave := range master.slaves {
+			if slave.flags&(SRI_PROMOTED|SRI_RECONF_DONE|SRI_RECONF_SENT) != 0 || slave.link.disconnected {
+				continue
+			}
+			if server.sentinelSendSlaveOf(slave, promoted.ip, promoted.port) {
+				server.sentinelEvent("+slave-reconf-sent-be", slave, "")
+				slave.flags |= SRI_RECONF_SENT
+			}
+		}
+	}
+}
+
+// sentinelFailoverReconfNextSlave points the replicas to the promoted one,
+// at most parallel-syncs of them syncing at a time. A replica that doesn't
+// start syncing in time is counted as done.
+func (server *RedisServer) sentinelFailoverReconfNextSlave(master *sentinelRedisInstance) {
+	promoted := master.promotedSlave
+	inProgress := 0
+	for _, slave := range master.slaves {
+		if slave.flags&(SRI_RECONF_SENT|SRI_RECONF_INPROG) != 0 {
+			inProgress++
+		}
+	}
+
+	now := time.Now().UnixMilli()
+	for _, slave := range sentinelInstancesSorted(master.slaves) {
+		if inProgress >= master.parallelSyncs {
+			break
+		}
+		if slave.flags&(SRI_PROMOTED|SRI_RECONF_DONE) != 0 {
+			continue
+		}
+		if slave.flags&SRI_RECONF_SENT != 0 && now-slave.slaveReconfSentTime > SENTINEL_SLAVE_RECONF_TIMEOUT {
+			server.sentinelEvent("-slave-reconf-sent-timeout", slave, "")
+			slave.flags &^= SRI_RECONF_SENT
+			slave.flags |= SRI_RECONF_DONE
+		}
+		if slave.flags&(SRI_RECONF_SENT|SRI_RECONF_INPROG) != 0 || slave.link.disconnected {
+			continue
+		}
+
+		if server.sentinelSendSlaveOf(slave, promoted.ip, promoted.port) {
+			slave.flags |= SRI_RECONF_SENT
+			slave.slaveReconfSentTime = now
+			server.sentinelEvent("+slave-reconf-sent", slave, "")
+			inProgress++
+		}
+	}
+
+	server.sentinelFailoverDetectEnd(master)
+}
+
+// sentinelFailoverSwitchToPromotedSlave makes the promoted replica the
+// master, at the end of the failover
+func (server *RedisServer) sentinelFailoverSwitchToPromotedSlave(master *sentinelRedisInstance) {
+	ip, port := master.ip, master.port
+	if promoted := master.promotedSlave; promoted != nil {
+		ip, port = promoted.ip, promoted.port
+	}
+	server.sentinelEvent("+switch-master", nil, fmt.Sprintf("%s %s %d %s %d",
+		master.name, master.ip, master.port, ip, port))
+	server.sentinelResetMasterAndChangeAddress(master, ip, port)
+	server.sentinelFlushConfig()
+}
+
+func (server *RedisServer) sentinelFailoverStateMachine(master *sentinelRedisInstance) {
+	if master.flags&SRI_FAILOVER_IN_PROGRESS == 0 {
+		return
+	}
+
+	switch master.failoverState {
+	case SENTINEL_FAILOVER_STATE_WAIT_START:
+		server.sentinelFailoverWaitStart(master)
+	case SENTINEL_FAILOVER_STATE_SELECT_SLAVE:
+		server.sentinelFailoverSelectSlave(master)
+	case SENTINEL_FAILOVER_STATE_SEND_SLAVEOF_NOONE:
+		server.sentinelFailoverSendSlaveOfNoOne(master)
+	case SENTINEL_FAILOVER_STATE_WAIT_PROMOTION:
+		server.sentinelFailoverWaitPromotion(master)
+	case SENTINEL_FAILOVER_STATE_RECONF_SLAVES:
+		server.sentinelFailoverReconfNextSlave(master)
+	}
+}
+
+// sentinelFailoverCommand is SENTINEL FAILOVER, a failover of a master that
+// is up, without asking the other sentinels
+func (server *RedisServer) sentinelFailoverCommand(master *sentinelRedisInstance) []byte {
+	if master.flags&SRI_FAILOVER_IN_PROGRESS != 0 {
+		return []byte("-INPROG Failover already in progress\r\n")
+	}
+	if server.sentinelSelectSlave(master) == nil {
+		return []byte("-NOGOODSLAVE No suitable replica to promote\r\n")
+	}
+	fmt.Printf("Executing user requested FAILOVER of '%s'\n", master.name)
+	server.sentinelStartFailover(master)
+	master.flags |= SRI_FORCE_FAILOVER
+	return []byte("+OK\r\n")
+}
@@ -3,21 +3,43 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
+	"math/rand"
 	"net"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 const (
 	CMD_FAST = 1 << iota
 	CMD_SENTINEL
+	CMD_WRITE
+	CMD_READONLY
+	CMD_DENYOOM
+	CMD_ADMIN
+	CMD_LOADING
+	CMD_STALE
+	CMD_NO_MULTI
+	CMD_NOSCRIPT
+	CMD_ALLOW_BUSY
+	CMD_ASKING // runs on an importing slot without ASKING, like RESTORE-ASKING
+	CMD_PUBSUB
+	CMD_ONLY_SENTINEL
+	CMD_NO_AUTH
+	CMD_SKIP_SLOWLOG // not logged, the commands it runs are, like EXEC
+	CMD_PROTECTED    // only with enable-debug-command, like DEBUG
 )
 
 type Argument struct {
@@ -36,55 +58,568 @@ type CommandInfo struct {
 	CommandFlags  []string   `json:"command_flags"`
 	AclCategories []string   `json:"acl_categories"`
 	CommandTips   []string   `json:"command_tips"`
+	GetKeysName   string     `json:"get_keys_function"`
 	Arguments     []Argument `json:"arguments"`
 }
 
 type CommandRequest struct {
-	Cmd      string
-	Args     []interface{}
-	Response chan<- []byte
+	Client *RedisClient
+	Cmd    string
+	Args   []interface{}
+
+	// replication offset at the end of a command sent by our master
+	ReplOff int64
+
+	// set instead of the command when the client broke the protocol, it is
+	// told why and closed
+	ProtoErr string
 }
 
 type RedisCommand struct {
 	Name     string
 	Function func(server *RedisServer, cmd string, args []interface{}) []byte
 	Group    string
-	MinArgs  int
+	Arity    int // counts the command name, negative for at least -Arity
 	CmdFlags int
 	Category string
+	// bits of the ACL categories, see acl.go
+	AclCategories uint64
+
+	// positions of the keys in the arguments, counting the command name,
+	// from the key arguments of the JSON. LastKey is -1 when the keys go
+	// on to the end. Commands like EVAL give the number of their keys in
+	// the argument at NumKeysIndex instead.
+	FirstKey     int
+	LastKey      int
+	KeyStep      int
+	NumKeysIndex int
+
+	// finds the keys of the commands whose arguments can't tell, like
+	// MIGRATE with KEYS
+	GetKeysProc func(args []interface{}) []string
 }
 
 type RedisServer struct {
-	Storage     map[string]string
-	Expirations map[string]time.Time
+	Storage     *dict[*RedisObject]
+	Expirations *dict[time.Time]
+
+	Config   *ServerConfig
+	requests chan CommandRequest
+
+	clientsMu sync.Mutex
+	clients   map[uint64]*RedisClient
+
+	// what the clients connect to, closed by the shutdown
+	listeners []net.Listener
+
+	// maintained by serverCron
+	CronLoops   int64
+	UnixTime    time.Time
+	LRUClock    uint32
+	storagePeak int
+
+	usedMemory     int64
+	StatPeakMemory int64
+	evictionPool   []evictionPoolEntry
+
+	// the counters of INFO, see resetServerStats
+	stat serverStats
+
+	// the bytes read from and written to the clients, by their goroutines
+	statNetInputBytes  int64
+	statNetOutputBytes int64
+
+	// proto-max-bulk-len, for the goroutines reading the clients
+	protoMaxBulkLen int64
+
+	// the ID of this run of the server, and when it started
+	runid     string
+	startTime time.Time
+
+	expire   activeExpireState
+	lazyfree *LazyFree
+
+	// callbacks from background goroutines, run by the executor
+	executorTasks chan func()
+
+	// changes to the dataset since the last successful save
+	Dirty             int64
+	dirtyBeforeBgsave int64
+
+	aof       aofState
+	repl      replState
+	pubsub    pubsubState
+	lua       evalState
+	functions functionsState
+
+	// nil unless cluster-enabled is set
+	cluster *clusterState
+
+	// nil unless in sentinel mode
+	sentinel *sentinelState
+
+	// the TLS config of the connections, and of the links we open, nil
+	// unless TLS is configured, see tls.go
+	tlsConfig       *tls.Config
+	tlsClientConfig *tls.Config
+
+	// the ACL users by name, see acl.go
+	users       map[string]*aclUser
+	defaultUser *aclUser
+
+	// the denials ACL LOG shows, the most recent first
+	aclLog        []*aclLogEntry
+	aclLogEntryID int64
+
+	// the connections MIGRATE keeps to its targets, by address
+	migrateCachedSockets map[string]*migrateCachedSocket
+
+	// the script running, nil when there is none
+	script *scriptRunCtx
+
+	// client of the command being executed
+	currentClient *RedisClient
+
+	// clients blocked by commands like WAIT, and the ones unblocked whose
+	// queued commands still have to run
+	blockedClients       []*RedisClient
+	blockedClientsByType [BLOCKED_NUM]int
+	unblockedClients     []*RedisClient
+	clientsWaitingAcks   []*RedisClient
+	getAckFromSlaves     bool
+
+	// SLOWLOG, newest entries first
+	slowlog        []*slowlogEntry
+	slowlogEntryID int64
+
+	// LATENCY, the samples of each event
+	latencyEvents map[string]*latencyTimeSeries
+
+	// the failures DEBUG injects
+	faults faultInjection
+
+	// a shutdown waiting for the replicas to catch up, and its options
+	shutdownDeadline time.Time
+	shutdownFlags    int
+	// set by the signal handler for serverCron to shut down
+	shutdownAsap    int32
+	lastSigReceived int32
+
+	// CLIENT TRACKING: the IDs of the clients that read each key, and the
+	// keys to invalidate for the client running the command after its reply
+	trackingTable       map[string]map[uint64]struct{}
+	trackingClients     map[*RedisClient]struct{}
+	trackingPendingKeys []string
+	// BCAST mode: the clients of each prefix, and its keys modified since
+	// they were last told
+	trackingPrefixes map[string]*bcastState
+
+	clientPauseType   int
+	clientPauseEvents [NUM_PAUSE_PURPOSES]pauseEvent
+
+	// set while the dataset is loaded from disk, progress is in INFO
+	loading               bool
+	loadingStartTime      time.Time
+	loadingTotalBytes     int64
+	loadingLoadedBytes    int64
+	loadingProcessedBytes int64
+	loadingRdbUsedMem     int64
+
+	// what call propagates instead of the command itself, set by
+	// rewriteCommandVector
+	propagateCmd  string
+	propagateArgs []interface{}
+
+	// set by preventCommandPropagation and forceCommandPropagation
+	preventPropagation bool
+	forcePropagation   bool
+
+	// set while EXEC runs the queued commands, and once it propagated the
+	// MULTI that precedes their effects
+	inExec              bool
+	execMultiPropagated bool
+
+	// clients watching each key, for WATCH
+	watchedKeys     map[string]map[*RedisClient]struct{}
+	watchingClients map[*RedisClient]struct{}
+
+	LastSave            time.Time
+	LastBgsaveTry       time.Time
+	RdbSaveTimeStart    time.Time
+	RdbSaveTimeLast     time.Duration
+	RdbLastBgsaveErr    error
+	rdbBgsaveInProgress bool
+	rdbChildType        int
+	rdbBgsaveScheduled  bool
+}
+
+// serverStats are the counters of INFO stats. CONFIG RESETSTAT zeroes them,
+// unlike the gauges like the connected clients or the memory used, which
+// are about the current state.
+type serverStats struct {
+	NumCommands       int64
+	NumConnections    int64 // updated with clientsMu held
+	ExpiredKeys       int64
+	EvictedKeys       int64
+	KeyspaceHits      int64
+	KeyspaceMisses    int64
+	TotalErrorReplies int64
+
+	// active expire cycles stopped by their time limit
+	ExpiredTimeCapReachedCount int64
+
+	// the samples of the instantaneous metrics, by STATS_METRIC_*
+	instMetrics [STATS_METRIC_COUNT]instMetric
+
+	// INFO commandstats by command name, and errorstats by error code
+	commands map[string]*commandStats
+	errors   map[string]int64
+}
+
+// commandStats are the calls of a command, and the time they took
+type commandStats struct {
+	calls         int64
+	microseconds  int64
+	rejectedCalls int64 // refused before running, like with -NOPERM
+	failedCalls   int64 // ran and replied with an error
+
+	latencyHistogram *latencyHistogram // nil until called with latency-tracking
+}
+
+// The error codes errorstats tells apart, the other ones are counted
+// together
+const ERROR_STATS_NUMBER = 128
+
+// resetServerStats zeroes the counters, for CONFIG RESETSTAT
+func (server *RedisServer) resetServerStats() {
+	server.clientsMu.Lock()
+	server.stat = serverStats{}
+	server.clientsMu.Unlock()
+	atomic.StoreInt64(&server.statNetInputBytes, 0)
+	atomic.StoreInt64(&server.statNetOutputBytes, 0)
+}
+
+// The instantaneous metrics, the rates of the last samples of a counter
+const (
+	STATS_METRIC_COMMAND    = iota // commands per second
+	STATS_METRIC_NET_INPUT         // bytes read per second
+	STATS_METRIC_NET_OUTPUT        // bytes written per second
+	STATS_METRIC_COUNT
+)
+
+// The samples averaged, taken every 100ms by serverCron
+const STATS_METRIC_SAMPLES = 16
+
+type instMetric struct {
+	lastSampleTime  time.Time
+	lastSampleCount int64
+	samples         [STATS_METRIC_SAMPLES]int64
+	idx             int
+}
+
+// trackInstantaneousMetric samples the rate of a counter since the last
+// sample
+func (server *RedisServer) trackInstantaneousMetric(metric int, current int64) {
+	m := &server.stat.instMetrics[metric]
+	now := time.Now()
+	if !m.lastSampleTime.IsZero() {
+		rate := int64(0)
+		if elapsed := now.Sub(m.lastSampleTime).Milliseconds(); elapsed > 0 {
+			rate = (current - m.lastSampleCount) * 1000 / elapsed
+		}
+		m.samples[m.idx] = rate
+		m.idx = (m.idx + 1) % STATS_METRIC_SAMPLES
+	}
+	m.lastSampleTime = now
+	m.lastSampleCount = current
+}
+
+// getInstantaneousMetric is the average rate of the samples
+func (server *RedisServer) getInstantaneousMetric(metric int) int64 {
+	sum := int64(0)
+	for _, sample := range server.stat.instMetrics[metric].samples {
+		sum += sample
+	}
+	return sum / STATS_METRIC_SAMPLES
+}
+
+func (server *RedisServer) commandStats(command RedisCommand) *commandStats {
+	name := strings.ToLower(command.Name)
+	if server.stat.commands == nil {
+		server.stat.commands = map[string]*commandStats{}
+	}
+	stats := server.stat.commands[name]
+	if stats == nil {
+		stats = &commandStats{}
+		server.stat.commands[name] = stats
+	}
+	return stats
+}
+
+// updateCommandStats counts a call of the command that took duration
+func (server *RedisServer) updateCommandStats(command RedisCommand, duration time.Duration, reply []byte) {
+	stats := server.commandStats(command)
+	stats.calls++
+	stats.microseconds += duration.Microseconds()
+	server.updateLatencyHistogram(stats, duration)
+	if len(reply) > 0 && reply[0] == '-' {
+		stats.failedCalls++
+	}
+}
+
+// afterErrorReply counts an error sent to a client by its code, the first
+// word of the error
+func (server *RedisServer) afterErrorReply(reply []byte) {
+	if len(reply) == 0 || reply[0] != '-' {
+		return
+	}
+	server.stat.TotalErrorReplies++
+
+	code, _, _ := strings.Cut(strings.TrimRight(string(reply[1:]), "\r\n"), " ")
+	if server.stat.errors == nil {
+		server.stat.errors = map[string]int64{}
+	}
+	if _, ok := server.stat.errors[code]; !ok && len(server.stat.errors) >= ERROR_STATS_NUMBER {
+		if _, ok := server.stat.errors["ERRORSTATS_OVERFLOW"]; !ok {
+			fmt.Printf("Errorstats stopped adding new errors because the number of different errors reached %d; "+
+				"new errors will be counted as 'ERRORSTATS_OVERFLOW'\n", ERROR_STATS_NUMBER)
+		}
+		code = "ERRORSTATS_OVERFLOW"
+	}
+	server.stat.errors[code]++
 }
 
+const REDIS_VERSION = "7.2.0"
+
+// Length of the run and replication IDs
+const CONFIG_RUN_ID_SIZE = 40
+
 var redisCommandTable map[string]RedisCommand
 
 func main() {
+	// math/rand seeds itself only since Go 1.20, the jitter of the elections
+	// and failovers must differ between servers started together
+	rand.Seed(time.Now().UnixNano() ^ int64(os.Getpid()))
+
 	// load all redis commands with json files into RedisCommandTable map
 	redisCommandTable = loadCommandsFromJSON("app/commands")
+
+	config, err := loadServerConfig(os.Args[1:])
+	if err != nil {
+		fmt.Println("Error loading config:", err)
+		os.Exit(1)
+	}
+	if err := renameCommands(redisCommandTable, config.RenameCommands); err != nil {
+		fmt.Println("Error loading config:", err)
+		os.Exit(1)
+	}
+
+	redisServer := newServer(config)
+	if config.tlsEnabled() {
+		tlsConfig, err := tlsConfigure(config)
+		if err != nil {
+			fmt.Println("Failed to configure TLS:", err)
+			os.Exit(1)
+		}
+		redisServer.tlsConfig = tlsConfig
+		redisServer.tlsClientConfig = tlsClientConfigure(tlsConfig)
+	}
+	redisServer.aclInit()
+	redisServer.scriptingInit()
+	redisServer.functionsInit()
+	redisServer.clusterInit()
+	redisServer.sentinelInit()
+
+	redisServer.changeReplicationId()
+	redisServer.clearReplicationId2()
+	if config.MasterHost != "" && !config.SentinelMode {
+		redisServer.repl.state = REPL_STATE_CONNECT
+	}
+
+	// clients connect to the plaintext port, the TLS one, or both
+	listeners := []net.Listener{}
+	if config.Port != 0 {
+		ls, err := listenToPort(config.Port, config.Bind)
+		if err != nil {
+			fmt.Printf("Failed listening on port %d (tcp), aborting: %v\n", config.Port, err)
+			os.Exit(1)
+		}
+		listeners = append(listeners, ls...)
+	}
+	if config.TlsPort != 0 {
+		ls, err := listenToPort(config.TlsPort, config.Bind)
+		if err != nil {
+			fmt.Printf("Failed listening on port %d (tls), aborting: %v\n", config.TlsPort, err)
+			os.Exit(1)
+		}
+		for _, l := range ls {
+			listeners = append(listeners, tls.NewListener(l, redisServer.tlsConfig))
+		}
+	}
+	if config.UnixSocket != "" {
+		l, err := listenUnixSocket(config.UnixSocket, config.UnixSocketPerm)
+		if err != nil {
+			fmt.Printf("Failed opening Unix socket: %v\n", err)
+			os.Exit(1)
+		}
+		listeners = append(listeners, l)
+	}
+	if len(listeners) == 0 {
+		fmt.Println("Configured to not listen anywhere, exiting.")
+		os.Exit(1)
+	}
+
+	redisServer.listeners = listeners
+	redisServer.setupSignalHandlers()
+
+	// the dataset is loaded by the executor, which answers the clients that
+	// connect in the meantime with -LOADING. A sentinel has none.
+	go func() {
+		if !config.SentinelMode {
+			redisServer.loadDataFromDisk()
+			redisServer.verifyClusterConfigWithData()
+		}
+		fmt.Println("Ready to accept connections")
+		redisServer.processCommands()
+	}()
+
+	for _, l := range listeners[1:] {
+		go acceptConnections(redisServer, l)
+	}
+	acceptConnections(redisServer, listeners[0])
+
+	// the listeners are closed by the shutdown, which exits once done
+	select {}
+}
+
+// newServer creates the server with the empty dataset and state, before
+// its subsystems are initialized and it listens
+func newServer(config *ServerConfig) *RedisServer {
 	redisServer := &RedisServer{
-		Storage:     make(map[string]string),
-		Expirations: make(map[string]time.Time),
+		Storage:     newDict[*RedisObject](),
+		Expirations: newDict[time.Time](),
+		Config:      config,
+		requests:    make(chan CommandRequest, 1024),
+		clients:     make(map[uint64]*RedisClient),
+		lazyfree:    newLazyFree(),
+		UnixTime:    time.Now(),
+		LRUClock:    getLRUClock(),
+		runid:       getRandomHexChars(CONFIG_RUN_ID_SIZE),
+		startTime:   time.Now(),
+
+		executorTasks: make(chan func(), 64),
+		LastSave:      time.Now(),
+
+		protoMaxBulkLen: config.ProtoMaxBulkLen,
+	}
+	redisServer.watchedKeys = make(map[string]map[*RedisClient]struct{})
+	redisServer.trackingTable = make(map[string]map[uint64]struct{})
+	redisServer.trackingClients = make(map[*RedisClient]struct{})
+	redisServer.trackingPrefixes = make(map[string]*bcastState)
+	redisServer.latencyEvents = make(map[string]*latencyTimeSeries)
+	redisServer.migrateCachedSockets = make(map[string]*migrateCachedSocket)
+	redisServer.watchingClients = make(map[*RedisClient]struct{})
+	redisServer.pubsub.channels = make(map[string]map[*RedisClient]struct{})
+	redisServer.pubsub.patterns = make(map[string]map[*RedisClient]struct{})
+	redisServer.pubsub.shardChannels = make(map[string]map[*RedisClient]struct{})
+	redisServer.pubsub.literalPatterns = make(map[string]struct{})
+	redisServer.pubsub.prefixPatterns = make(map[string]string)
+	redisServer.pubsub.globPatterns = make(map[string]struct{})
+	redisServer.pubsub.clients = make(map[*RedisClient]struct{})
+	return redisServer
+}
+
+// listenToPort listens on the port of each address of bind, all the IPv4
+// and IPv6 ones when it is empty. "*" is any IPv4 address and "::*" any
+// IPv6 one. The addresses prefixed with "-" are optional, skipped when they
+// are not available on this host.
+func listenToPort(port int, bind []string) ([]net.Listener, error) {
+	if len(bind) == 0 {
+		bind = CONFIG_DEFAULT_BIND
+	}
+	listeners := []net.Listener{}
+	for _, addr := range bind {
+		optional := strings.HasPrefix(addr, "-")
+		addr = strings.TrimPrefix(addr, "-")
+
+		network := "tcp"
+		switch addr {
+		case "*":
+			network, addr = "tcp4", "0.0.0.0"
+		case "::*":
+			network, addr = "tcp6", "::"
+		}
+		l, err := net.Listen(network, net.JoinHostPort(addr, strconv.Itoa(port)))
+		if err != nil {
+			if optional && !errors.Is(err, syscall.EADDRINUSE) {
+				continue
+			}
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("could not create server TCP listening socket %s: %v", net.JoinHostPort(addr, strconv.Itoa(port)), err)
+		}
+		listeners = append(listeners, l)
+	}
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("none of the bind addresses is available")
 	}
+	return listeners, nil
+}
 
-	l, err := net.Listen("tcp", "0.0.0.0:6379")
+// listenUnixSocket listens on the socket at path, replacing the one of a
+// previous run. A perm of 0 keeps the permissions of the umask.
+func listenUnixSocket(path string, perm os.FileMode) (net.Listener, error) {
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
 	if err != nil {
-		fmt.Println("Failed to bind to port 6379")
-		os.Exit(1)
+		return nil, err
 	}
+	if perm != 0 {
+		if err := os.Chmod(path, perm); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
 
+func acceptConnections(server *RedisServer, l net.Listener) {
 	defer l.Close()
-
 	for {
 		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			fmt.Println("Error accepting connection: ", err.Error())
 			os.Exit(1)
 		}
 
-		go handleConnection(redisServer, conn)
+		go handleConnection(server, conn)
+	}
+}
+
+func (server *RedisServer) loadDataFromDisk() {
+	start := time.Now()
+	if server.Config.AppendOnly {
+		if err := server.loadAppendOnlyFiles(); err != nil {
+			fmt.Println("Error loading the append only file:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("DB loaded from append only file: %.3f seconds\n", time.Since(start).Seconds())
+
+		if err := server.openAppendOnlyFile(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		server.aofDelHistoryFiles()
+	} else {
+		if err := server.rdbLoad(server.rdbFilename()); err != nil {
+			fmt.Println("Error loading RDB file:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("DB loaded from disk: %.3f seconds\n", time.Since(start).Seconds())
 	}
 }
 
@@ -116,7 +651,7 @@ func loadCommandsFromJSON(dir string) map[string]RedisCommand {
 					Name:     cmdName,
 					Function: getFunctionByName(info.FunctionName),
 					Group:    info.Group,
-					MinArgs:  info.Arity,
+					Arity:    info.Arity,
 					Category: strings.Join(info.AclCategories, ","),
 				}
 
@@ -128,9 +663,42 @@ func loadCommandsFromJSON(dir string) map[string]RedisCommand {
 						cmdFlags |= CMD_FAST
 					case "SENTINEL":
 						cmdFlags |= CMD_SENTINEL
+					case "WRITE":
+						cmdFlags |= CMD_WRITE
+					case "READONLY":
+						cmdFlags |= CMD_READONLY
+					case "DENYOOM":
+						cmdFlags |= CMD_DENYOOM
+					case "ADMIN":
+						cmdFlags |= CMD_ADMIN
+					case "LOADING":
+						cmdFlags |= CMD_LOADING
+					case "STALE":
+						cmdFlags |= CMD_STALE
+					case "NO_MULTI":
+						cmdFlags |= CMD_NO_MULTI
+					case "NOSCRIPT":
+						cmdFlags |= CMD_NOSCRIPT
+					case "ALLOW_BUSY":
+						cmdFlags |= CMD_ALLOW_BUSY
+					case "ASKING":
+						cmdFlags |= CMD_ASKING
+					case "PUBSUB":
+						cmdFlags |= CMD_PUBSUB
+					case "ONLY_SENTINEL":
+						cmdFlags |= CMD_ONLY_SENTINEL
+					case "NO_AUTH":
+						cmdFlags |= CMD_NO_AUTH
+					case "SKIP_SLOWLOG":
+						cmdFlags |= CMD_SKIP_SLOWLOG
+					case "PROTECTED":
+						cmdFlags |= CMD_PROTECTED
 					}
 				}
 				cmd.CmdFlags = cmdFlags
+				cmd.AclCategories = commandAclCategories(info.AclCategories, cmdFlags)
+				cmd.FirstKey, cmd.LastKey, cmd.KeyStep, cmd.NumKeysIndex = commandKeyPositions(info)
+				cmd.GetKeysProc = getKeysProcByName(info.GetKeysName)
 
 				commandTable[cmdName] = cmd
 			}
@@ -140,64 +708,544 @@ func loadCommandsFromJSON(dir string) map[string]RedisCommand {
 	return commandTable
 }
 
+// renameCommands applies rename-command to the command table. The commands
+// renamed to "" can't be called at all.
+func renameCommands(commandTable map[string]RedisCommand, renames [][2]string) error {
+	for _, rename := range renames {
+		oldName, newName := strings.ToUpper(rename[0]), strings.ToUpper(rename[1])
+		command, ok := commandTable[oldName]
+		if !ok {
+			return fmt.Errorf("No such command in rename-command: %s", rename[0])
+		}
+		delete(commandTable, oldName)
+		if newName == "" {
+			continue
+		}
+		if _, exists := commandTable[newName]; exists {
+			return fmt.Errorf("Target command name already exists: %s", rename[1])
+		}
+		commandTable[newName] = command
+	}
+	return nil
+}
+
+// commandKeyPositions finds where the keys are from the arguments of the
+// command. A required key last, in a command taking any number of arguments,
+// is repeated until the end, as in DEL key [key ...].
+func commandKeyPositions(info CommandInfo) (first, last, step, numkeys int) {
+	for i, arg := range info.Arguments {
+		pos := i + 1
+		if arg.Name == "numkeys" {
+			return 0, 0, 0, pos
+		}
+		if arg.Type != "key" {
+			continue
+		}
+		if first == 0 {
+			first = pos
+		}
+		last = pos
+		if pos == len(info.Arguments) && !arg.Optional && info.Arity < 0 {
+			last = -1
+		}
+	}
+	if first != 0 {
+		step = 1
+	}
+	return first, last, step, 0
+}
+
+func getKeysProcByName(name string) func(args []interface{}) []string {
+	switch name {
+	case "migrateGetKeys":
+		return migrateGetKeys
+	case "pubsubShardChannelGetKeys":
+		return pubsubShardChannelGetKeys
+	case "pubsubShardChannelsGetKeys":
+		return pubsubShardChannelsGetKeys
+	}
+	return nil
+}
+
 func getFunctionByName(name string) func(server *RedisServer, cmd string, args []interface{}) []byte {
 	switch name {
 	case "pingCommand":
 		return handlePingCommand
 	case "echoCommand":
 		return handleEchoCommand
+	case "handleTimeCommand":
+		return (*RedisServer).handleTimeCommand
+	case "handleLastsaveCommand":
+		return (*RedisServer).handleLastsaveCommand
 	case "handleSetCommand":
 		return (*RedisServer).handleSetCommand
 	case "handleGetCommand":
 		return (*RedisServer).handleGetCommand
+	case "handleDelCommand":
+		return (*RedisServer).handleDelCommand
+	case "handleUnlinkCommand":
+		return (*RedisServer).handleUnlinkCommand
+	case "handleFlushdbCommand":
+		return (*RedisServer).handleFlushdbCommand
+	case "handleFlushallCommand":
+		return (*RedisServer).handleFlushallCommand
+	case "handleObjectCommand":
+		return (*RedisServer).handleObjectCommand
+	case "handleMemoryCommand":
+		return (*RedisServer).handleMemoryCommand
+	case "handleConfigCommand":
+		return (*RedisServer).handleConfigCommand
+	case "handleKeysCommand":
+		return (*RedisServer).handleKeysCommand
+	case "handleRpushCommand":
+		return (*RedisServer).handleRpushCommand
+	case "handleSaddCommand":
+		return (*RedisServer).handleSaddCommand
+	case "handleZaddCommand":
+		return (*RedisServer).handleZaddCommand
+	case "handleHsetCommand":
+		return (*RedisServer).handleHsetCommand
+	case "handleExpireCommand":
+		return (*RedisServer).handleExpireCommand
+	case "handlePexpireCommand":
+		return (*RedisServer).handlePexpireCommand
+	case "handleExpireatCommand":
+		return (*RedisServer).handleExpireatCommand
+	case "handlePexpireatCommand":
+		return (*RedisServer).handlePexpireatCommand
+	case "handleIncrbyfloatCommand":
+		return (*RedisServer).handleIncrbyfloatCommand
+	case "handleSremCommand":
+		return (*RedisServer).handleSremCommand
+	case "handleSpopCommand":
+		return (*RedisServer).handleSpopCommand
+	case "handleBgrewriteaofCommand":
+		return (*RedisServer).handleBgrewriteaofCommand
+	case "handleSyncCommand":
+		return (*RedisServer).handleSyncCommand
+	case "handleRoleCommand":
+		return (*RedisServer).handleRoleCommand
+	case "handleFailoverCommand":
+		return (*RedisServer).handleFailoverCommand
+	case "handleWaitCommand":
+		return (*RedisServer).handleWaitCommand
+	case "handleSubscribeCommand":
+		return (*RedisServer).handleSubscribeCommand
+	case "handleUnsubscribeCommand":
+		return (*RedisServer).handleUnsubscribeCommand
+	case "handlePsubscribeCommand":
+		return (*RedisServer).handlePsubscribeCommand
+	case "handlePunsubscribeCommand":
+		return (*RedisServer).handlePunsubscribeCommand
+	case "handleSsubscribeCommand":
+		return (*RedisServer).handleSsubscribeCommand
+	case "handleSunsubscribeCommand":
+		return (*RedisServer).handleSunsubscribeCommand
+	case "handleSpublishCommand":
+		return (*RedisServer).handleSpublishCommand
+	case "handleMultiCommand":
+		return (*RedisServer).handleMultiCommand
+	case "handleExecCommand":
+		return (*RedisServer).handleExecCommand
+	case "handleDiscardCommand":
+		return (*RedisServer).handleDiscardCommand
+	case "handleWatchCommand":
+		return (*RedisServer).handleWatchCommand
+	case "handleResetCommand":
+		return (*RedisServer).handleResetCommand
+	case "handleLolwutCommand":
+		return (*RedisServer).handleLolwutCommand
+	case "handleUnwatchCommand":
+		return (*RedisServer).handleUnwatchCommand
+	case "handleHelloCommand":
+		return (*RedisServer).handleHelloCommand
+	case "handleAuthCommand":
+		return (*RedisServer).handleAuthCommand
+	case "handleAclCommand":
+		return (*RedisServer).handleAclCommand
+	case "handleShutdownCommand":
+		return (*RedisServer).handleShutdownCommand
+	case "handleSlowlogCommand":
+		return (*RedisServer).handleSlowlogCommand
+	case "handleLatencyCommand":
+		return (*RedisServer).handleLatencyCommand
+	case "handleClientCommand":
+		return (*RedisServer).handleClientCommand
+	case "handlePubsubCommand":
+		return (*RedisServer).handlePubsubCommand
+	case "handlePublishCommand":
+		return (*RedisServer).handlePublishCommand
+	case "handleReplconfCommand":
+		return (*RedisServer).handleReplconfCommand
+	case "handleReplicaofCommand":
+		return (*RedisServer).handleReplicaofCommand
+	case "handleDebugCommand":
+		return (*RedisServer).handleDebugCommand
+	case "handleSaveCommand":
+		return (*RedisServer).handleSaveCommand
+	case "handleInfoCommand":
+		return (*RedisServer).handleInfoCommand
+	case "handleBgsaveCommand":
+		return (*RedisServer).handleBgsaveCommand
+	case "handleEvalCommand":
+		return (*RedisServer).handleEvalCommand
+	case "handleEvalshaCommand":
+		return (*RedisServer).handleEvalshaCommand
+	case "handleScriptCommand":
+		return (*RedisServer).handleScriptCommand
+	case "handleEvalRoCommand":
+		return (*RedisServer).handleEvalRoCommand
+	case "handleEvalshaRoCommand":
+		return (*RedisServer).handleEvalshaRoCommand
+	case "handleFcallCommand":
+		return (*RedisServer).handleFcallCommand
+	case "handleFcallRoCommand":
+		return (*RedisServer).handleFcallRoCommand
+	case "handleFunctionCommand":
+		return (*RedisServer).handleFunctionCommand
+	case "handleClusterCommand":
+		return (*RedisServer).handleClusterCommand
+	case "handleAskingCommand":
+		return (*RedisServer).handleAskingCommand
+	case "handleReadonlyCommand":
+		return (*RedisServer).handleReadonlyCommand
+	case "handleReadwriteCommand":
+		return (*RedisServer).handleReadwriteCommand
+	case "handleDumpCommand":
+		return (*RedisServer).handleDumpCommand
+	case "handleRestoreCommand":
+		return (*RedisServer).handleRestoreCommand
+	case "handleMigrateCommand":
+		return (*RedisServer).handleMigrateCommand
+	case "handleSentinelCommand":
+		return (*RedisServer).handleSentinelCommand
 	default:
 		return nil
 	}
 }
 
-func handleConnection(server *RedisServer, conn net.Conn) {
-	defer conn.Close()
-
-	commandChan := make(chan CommandRequest)
-	go handleCommands(server, conn, commandChan)
+// processCommands is the only goroutine that executes commands, so handlers
+// can touch the keyspace without locking. serverCron runs on it too.
+func (server *RedisServer) processCommands() {
+	hz := server.Config.Hz
+	ticker := time.NewTicker(time.Second / time.Duration(hz))
+	defer ticker.Stop()
 
-	reader := bufio.NewReader(conn)
 	for {
-		cmd, args, err := readCommand(reader)
-		if err != nil {
-			fmt.Println("Error reading from connection: ", err)
-			return
+		select {
+		case commandRequest := <-server.requests:
+			server.processCommand(commandRequest)
+		case task := <-server.executorTasks:
+			task()
+		case <-ticker.C:
+			server.serverCron()
+
+			if server.Config.Hz != hz {
+				hz = server.Config.Hz
+				ticker.Reset(time.Second / time.Duration(hz))
+			}
 		}
 
-		if cmd == "" {
-			continue
+		// the messages of the cluster bus and the cron have work for
+		// beforeSleep too, not only the commands
+		if len(server.requests) == 0 {
+			server.beforeSleep()
 		}
+	}
+}
 
-		responseChan := make(chan []byte)
-		commandChan <- CommandRequest{Cmd: cmd, Args: args, Response: responseChan}
-		response := <-responseChan
-		conn.Write(response)
+// runOnExecutor schedules fn to run on the executor goroutine, which is how
+// background goroutines hand results back to the single-threaded core
+func (server *RedisServer) runOnExecutor(fn func()) {
+	server.executorTasks <- fn
+}
 
-		fmt.Printf("Command: %s, Arguments: %v\n", cmd, args)
+// processEventsWhileBlocked runs the requests already queued while the
+// executor is busy with a long task, such as loading the dataset. Requests
+// that arrive meanwhile wait for the next round so the task keeps going.
+func (server *RedisServer) processEventsWhileBlocked() {
+	server.checkShutdownAsap()
+	for pending := len(server.requests); pending > 0; pending-- {
+		server.processCommand(<-server.requests)
 	}
 }
 
-func handleCommands(server *RedisServer, conn net.Conn, commandChan <-chan CommandRequest) {
-	for commandRequest := range commandChan {
-		cmd := commandRequest.Cmd
-		args := commandRequest.Args
+func (server *RedisServer) processCommand(commandRequest CommandRequest) {
+	// a blocked client runs its next commands once it is unblocked, the
+	// ones held by a pause once it ends
+	client := commandRequest.Client
+	if commandRequest.ProtoErr != "" {
+		// like Redis, even a blocked client is closed right away
+		client.addReply([]byte("-ERR " + commandRequest.ProtoErr + "\r\n"))
+		client.closeAfterReply()
+		return
+	}
+	if client.Flags&CLIENT_BLOCKED == 0 && len(client.deferred) == 0 && server.isCommandPaused(client, commandRequest.Cmd) {
+		server.blockClient(client, BLOCKED_POSTPONE, time.Time{})
+	}
+	if client.Flags&CLIENT_BLOCKED != 0 || len(client.deferred) > 0 || server.scriptIsWaiting(client) {
+		client.deferred = append(client.deferred, commandRequest)
+		return
+	}
 
-		if command, ok := redisCommandTable[cmd]; ok {
-			response := command.Function(server, cmd, args)
-			commandRequest.Response <- response
+	cmd := commandRequest.Cmd
+	args := commandRequest.Args
+	defer putArgs(args)
+
+	// CLIENT REPLY SKIP silences the command after it only
+	defer func() {
+		client.Flags &^= CLIENT_REPLY_SKIP
+		if client.Flags&CLIENT_REPLY_SKIP_NEXT != 0 {
+			client.Flags = client.Flags&^CLIENT_REPLY_SKIP_NEXT | CLIENT_REPLY_SKIP
+		}
+	}()
+
+	// ASKING only holds for the next command, or the ones of a transaction
+	defer func() {
+		if cmd != "ASKING" && client.Flags&CLIENT_MULTI == 0 {
+			client.Flags &^= CLIENT_ASKING
+		}
+	}()
+
+	fromMaster := commandRequest.Client.Flags&CLIENT_MASTER != 0
+	if fromMaster {
+		// the rest of the stream of a master we disconnected from
+		if commandRequest.Client != server.repl.master {
+			return
+		}
+		server.repl.masterLastIo = server.UnixTime
+		defer server.replicationFeedStreamFromMasterStream(cmd, args, commandRequest.ReplOff)
+	}
+
+	server.stat.NumCommands++
+
+	if !fromMaster && server.protectedModeDenies(client) {
+		client.addReply([]byte(PROTECTED_MODE_ERROR))
+		client.closeAfterReply()
+		return
+	}
+
+	// a sentinel only has the commands flagged for it, while SENTINEL is
+	// only known to a sentinel
+	command, ok := redisCommandTable[cmd]
+	if ok && server.sentinel != nil {
+		ok = command.CmdFlags&CMD_SENTINEL != 0
+	} else if ok {
+		ok = command.CmdFlags&CMD_ONLY_SENTINEL == 0
+	}
+	if !ok {
+		server.rejectCommand(client, cmd, []byte(fmt.Sprintf("-ERR Unknown command: %s\r\n", cmd)))
+		return
+	}
+	client.lastInteraction = server.UnixTime
+	client.lastCmd = strings.ToLower(command.Name)
+	if (command.Arity > 0 && len(args)+1 != command.Arity) || len(args)+1 < -command.Arity {
+		server.rejectCommand(client, cmd, []byte(fmt.Sprintf("-ERR wrong number of arguments for '%s' command\r\n", strings.ToLower(cmd))))
+		return
+	}
+
+	if command.CmdFlags&CMD_PROTECTED != 0 && !allowProtectedAction(server.Config.EnableDebugCmd, client) {
+		server.rejectCommand(client, cmd, []byte(fmt.Sprintf("-ERR %s command not allowed. If the enable-debug-command option is set to \"local\", "+
+			"you can run it from a local connection, otherwise you need to set this option in the configuration file, "+
+			"and then restart the server.\r\n", strings.ToUpper(cmd))))
+		return
+	}
+
+	if !fromMaster && server.authRequired(client) && command.CmdFlags&CMD_NO_AUTH == 0 {
+		server.rejectCommand(client, cmd, []byte("-NOAUTH Authentication required.\r\n"))
+		return
+	}
+
+	// the user may not run the command, or not on these keys or channels
+	if !fromMaster {
+		if result, errArg := server.aclCheckAllPerm(client, command, cmd, args); result != ACL_OK {
+			context := ACL_LOG_CTX_TOPLEVEL
+			if client.Flags&CLIENT_MULTI != 0 {
+				context = ACL_LOG_CTX_MULTI
+			}
+			server.addAclLogDenial(client, result, context, cmd, errArg)
+			msg := aclErrorMessage(result, client.getUser(), cmd, errArg, false)
+			server.rejectCommand(client, cmd, []byte("-NOPERM "+msg+"\r\n"))
+			return
+		}
+	}
+
+	// EXEC is checked as the commands it runs
+	cmdFlags := command.CmdFlags
+	if cmd == "EXEC" {
+		cmdFlags |= client.mstate.cmdFlags
+	}
+
+	// in cluster mode the keys may be served by another node
+	if server.cluster != nil && !fromMaster &&
+		(command.FirstKey != 0 || command.NumKeysIndex != 0 || command.GetKeysProc != nil || cmd == "EXEC") {
+		node, slot, errorCode := server.getNodeByQuery(client, command, cmd, args)
+		if errorCode != CLUSTER_REDIR_NONE {
+			server.clusterRedirectClient(client, cmd, node, slot, errorCode)
+			return
+		}
+	}
+
+	if server.loading && cmdFlags&CMD_LOADING == 0 {
+		server.rejectCommand(client, cmd, []byte("-LOADING Redis is loading the dataset in memory\r\n"))
+		return
+	}
+
+	// Free memory before running the command if needed, and refuse commands
+	// that may grow the dataset when nothing could be evicted
+	if server.Config.Maxmemory > 0 && !fromMaster {
+		outOfMemory := server.performEvictions() == EVICT_FAIL
+		if outOfMemory && cmdFlags&CMD_DENYOOM != 0 {
+			server.rejectCommand(client, cmd, []byte("-OOM command not allowed when used memory > 'maxmemory'.\r\n"))
+			return
+		}
+	}
+
+	if cmdFlags&CMD_WRITE != 0 && !fromMaster {
+		if reason := server.writeCommandsDeniedByDiskError(); reason != "" {
+			server.rejectCommand(client, cmd, []byte(reason))
+			return
+		}
+	}
+
+	// the writes may not reach enough replicas
+	if cmdFlags&CMD_WRITE != 0 && !fromMaster && !server.checkGoodReplicasStatus() {
+		server.rejectCommand(client, cmd, []byte("-NOREPLICAS Not enough good replicas to write.\r\n"))
+		return
+	}
+
+	// a read only replica only applies the writes of its master
+	isReplica := server.Config.MasterHost != ""
+	if isReplica && server.Config.ReplicaReadOnly && !fromMaster && cmdFlags&CMD_WRITE != 0 {
+		server.rejectCommand(client, cmd, []byte("-READONLY You can't write against a read only replica.\r\n"))
+		return
+	}
+
+	// a RESP2 connection in subscriber mode can't tell replies from messages
+	if client.Flags&CLIENT_PUBSUB != 0 && client.resp == 2 && !isPubsubContextCommand(cmd) {
+		server.rejectCommand(client, cmd, []byte(fmt.Sprintf("-ERR Can't execute '%s': only (P|S)SUBSCRIBE / "+
+			"(P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context\r\n", strings.ToLower(cmd))))
+		return
+	}
+
+	// without a link to the master the dataset may be stale
+	if isReplica && server.repl.state != REPL_STATE_CONNECTED && !server.Config.ReplicaServeStaleData &&
+		cmdFlags&CMD_STALE == 0 {
+		server.rejectCommand(client, cmd, []byte("-MASTERDOWN Link with MASTER is down and replica-serve-stale-data is set to 'no'.\r\n"))
+		return
+	}
+
+	// while a script is busy only the commands that can stop it run
+	if server.scriptIsTimedout() && cmdFlags&CMD_ALLOW_BUSY == 0 {
+		server.rejectCommand(client, cmd, server.scriptBusyError())
+		return
+	}
+
+	// in a transaction the commands are queued until EXEC
+	if client.Flags&CLIENT_MULTI != 0 && !isMultiControlCommand(cmd) {
+		if command.CmdFlags&CMD_NO_MULTI != 0 {
+			server.rejectCommand(client, cmd, []byte("-ERR Command not allowed inside a transaction\r\n"))
+			return
+		}
+		client.queueMultiCommand(command, cmd, args)
+		client.addReply([]byte("+QUEUED\r\n"))
+		return
+	}
+
+	dirty := server.Dirty
+	response := server.call(client, command, cmd, args)
+	if server.Dirty > dirty && server.Config.AppendFsync == AOF_FSYNC_ALWAYS {
+		server.flushAppendOnlyFile()
+	}
+
+	// commands like PSYNC reply on their own, or not at all
+	if response != nil {
+		client.addReply(response)
+	}
+	server.trackingHandlePendingKeyInvalidations(client)
+	server.trackingBroadcastInvalidationMessages()
+	// CLIENT CACHING holds for the command after it, or the transaction
+	if cmd != "CLIENT" && client.Flags&CLIENT_MULTI == 0 {
+		client.Flags &^= CLIENT_TRACKING_CACHING
+	}
+	if client.Flags&CLIENT_CLOSE_AFTER_COMMAND != 0 {
+		client.closeAfterReply()
+	}
+}
+
+// call runs the command for the client and propagates its effects, on its
+// own or as one of the commands of EXEC
+func (server *RedisServer) call(client *RedisClient, command RedisCommand, cmd string, args []interface{}) []byte {
+	dirty := server.Dirty
+	server.propagateCmd, server.propagateArgs = "", nil
+	server.preventPropagation = false
+	server.forcePropagation = false
+	server.currentClient = client
+	start := time.Now()
+	response, failed := server.faults.failCommands[strings.ToLower(command.Name)]
+	if !failed {
+		response = command.Function(server, cmd, args)
+	}
+	duration := time.Since(start)
+	server.updateCommandStats(command, duration, response)
+	// the commands of scripts are logged as the script
+	if command.CmdFlags&CMD_SKIP_SLOWLOG == 0 && client.Flags&CLIENT_SCRIPT == 0 {
+		server.slowlogPushEntryIfNeeded(client, cmd, args, duration)
+	}
+	if command.CmdFlags&CMD_FAST != 0 {
+		server.latencyAddSampleIfNeeded("fast-command", duration)
+	} else {
+		server.latencyAddSampleIfNeeded("command", duration)
+	}
+	server.afterErrorReply(response)
+	server.trackingAfterCommand(client, command, args, response)
+	server.currentClient = nil
+
+	// commands that changed the dataset are propagated, the ones that
+	// saved or loaded it reset the counter instead
+	if (server.Dirty > dirty || server.forcePropagation) && !server.preventPropagation {
+		if server.inExec && !server.execMultiPropagated {
+			server.propagate("MULTI", nil)
+			server.execMultiPropagated = true
+		}
+		if server.propagateCmd != "" {
+			server.propagate(server.propagateCmd, server.propagateArgs)
 		} else {
-			response := []byte(fmt.Sprintf("-ERR Unknown command: %s\r\n", cmd))
-			commandRequest.Response <- response
+			server.propagate(cmd, args)
 		}
 	}
+	server.propagateCmd, server.propagateArgs = "", nil
+	server.preventPropagation = false
+	server.forcePropagation = false
+
+	// WAIT waits for the replicas to acknowledge the writes up to here
+	client.woff = server.repl.masterReplOffset
+	return response
+}
+
+// The most elements a command may have
+const PROTO_MAX_MULTIBULK_LEN = math.MaxInt32
+
+// The bulk strings of the master and of the AOF are not limited, like in
+// Redis, the room for the CRLF aside
+const PROTO_UNLIMITED_BULK_LEN = math.MaxInt64 - 2
+
+// Arguments are given room for at most this many elements up front, the
+// rest as they are read, so a client can't have a huge array allocated by
+// announcing it
+const PROTO_MAX_ARGS_PREALLOC = 1024
+
+// protocolError is a request that breaks the protocol, the client is told
+// and disconnected
+type protocolError string
+
+func (e protocolError) Error() string {
+	return "Protocol error: " + string(e)
 }
 
-func readCommand(reader *bufio.Reader) (string, []interface{}, error) {
+// readCommand reads a command, inline or as an array of bulk strings. The
+// bulk strings longer than maxBulkLen are a protocol error.
+func readCommand(reader *bufio.Reader, maxBulkLen int64) (string, []interface{}, error) {
 	prefix, err := reader.Peek(1)
 	if err != nil {
 		return "", nil, err
@@ -212,26 +1260,50 @@ func readCommand(reader *bufio.Reader) (string, []interface{}, error) {
 		return strings.ToUpper(strings.TrimSpace(line)), nil, nil
 	}
 
-	resp, err := readRESP(reader)
+	reader.ReadByte()
+	line, err := reader.ReadString('\n')
 	if err != nil {
 		return "", nil, err
 	}
 
-	respArray, ok := resp.([]interface{})
-	if !ok || len(respArray) == 0 {
+	count, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil || count > PROTO_MAX_MULTIBULK_LEN {
+		return "", nil, protocolError("invalid multibulk length")
+	}
+
+	if count <= 0 {
 		return "", nil, nil
 	}
 
-	cmd, ok := respArray[0].(string)
+	first, err := readRESP(reader, maxBulkLen)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// arguments live in a pooled slice that the executor releases after the call
+	args := getArgs(minOf(count-1, PROTO_MAX_ARGS_PREALLOC))
+	for i := 1; i < count; i++ {
+		elem, err := readRESP(reader, maxBulkLen)
+		if err != nil {
+			putArgs(args)
+			return "", nil, err
+		}
+
+		args = append(args, elem)
+	}
+
+	cmd, ok := first.(string)
 	if !ok {
-		return "", nil, fmt.Errorf("invalid command: %v", respArray[0])
+		putArgs(args)
+		return "", nil, fmt.Errorf("invalid command: %v", first)
 	}
 
-	return strings.ToUpper(cmd), respArray[1:], nil
+	return strings.ToUpper(cmd), args, nil
 }
 
-// simple RESP reader
-func readRESP(reader *bufio.Reader) (interface{}, error) {
+// simple RESP reader, the bulk strings longer than maxBulkLen are a protocol
+// error
+func readRESP(reader *bufio.Reader, maxBulkLen int64) (interface{}, error) {
 	prefix, err := reader.ReadByte()
 	if err != nil {
 		return nil, err
@@ -250,9 +1322,9 @@ func readRESP(reader *bufio.Reader) (interface{}, error) {
 			return nil, err
 		}
 
-		size, err := strconv.Atoi(strings.TrimSpace(line))
-		if err != nil {
-			return nil, err
+		size, err := strconv.ParseInt(strings.TrimSpace(line), 10, 64)
+		if err != nil || size < -1 || size > maxBulkLen {
+			return nil, protocolError("invalid bulk length")
 		}
 
 		if size == -1 {
@@ -273,18 +1345,22 @@ func readRESP(reader *bufio.Reader) (interface{}, error) {
 		}
 
 		count, err := strconv.Atoi(strings.TrimSpace(line))
-		if err != nil {
-			return nil, err
+		if err != nil || count < -1 || count > PROTO_MAX_MULTIBULK_LEN {
+			return nil, protocolError("invalid multibulk length")
+		}
+
+		if count == -1 {
+			return nil, nil
 		}
 
-		array := make([]interface{}, count)
+		array := make([]interface{}, 0, minOf(count, PROTO_MAX_ARGS_PREALLOC))
 		for i := 0; i < count; i++ {
-			elem, err := readRESP(reader)
+			elem, err := readRESP(reader, maxBulkLen)
 			if err != nil {
 				return nil, err
 			}
 
-			array[i] = elem
+			array = append(array, elem)
 		}
 
 		return array, nil
@@ -298,6 +1374,15 @@ func handlePingCommand(server *RedisServer, cmd string, args []interface{}) []by
 		return addReplyErrorArity()
 	}
 
+	// a subscribed RESP2 client tells the reply from messages by its shape
+	if client := server.currentClient; client != nil && client.Flags&CLIENT_PUBSUB != 0 && client.resp == 2 {
+		message := ""
+		if len(args) == 1 {
+			message, _ = args[0].(string)
+		}
+		return addReplyValue([]interface{}{"pong", message})
+	}
+
 	if len(args) == 0 {
 		return addReply(redisCommandTable[cmd])
 	} else {
@@ -318,8 +1403,18 @@ func handleEchoCommand(server *RedisServer, cmd string, args []interface{}) []by
 	return addReplyBulk([]interface{}{arg})
 }
 
+// handleTimeCommand replies with the unix time in seconds and the
+// microseconds elapsed in the current second
+func (server *RedisServer) handleTimeCommand(cmd string, args []interface{}) []byte {
+	now := time.Now()
+	return addReplyValue([]interface{}{
+		strconv.FormatInt(now.Unix(), 10),
+		strconv.FormatInt(int64(now.Nanosecond()/1000), 10),
+	})
+}
+
 func (server *RedisServer) handleSetCommand(cmd string, args []interface{}) []byte {
-	if len(args) != 2 && len(args) != 4 {
+	if len(args) < 2 || len(args) > 4 {
 		return addReplyErrorArity()
 	}
 
@@ -333,9 +1428,18 @@ func (server *RedisServer) handleSetCommand(cmd string, args []interface{}) []by
 		return []byte("-ERR Invalid value type\r\n")
 	}
 
-	if len(args) == 4 {
+	if len(args) == 3 {
+		// KEEPTTL replaces the value only, the way INCRBYFLOAT is propagated
+		option, _ := args[2].(string)
+		if strings.ToUpper(option) != "KEEPTTL" {
+			return []byte("-ERR syntax error\r\n")
+		}
+		server.dbReplaceValue(key, createStringObject(value))
+		server.notifyKeyspaceEvent(NOTIFY_STRING, "set", key)
+	} else if len(args) == 4 {
 		expiryOption, ok := args[2].(string)
-		if !ok || strings.ToUpper(expiryOption) != "PX" {
+		expiryOption = strings.ToUpper(expiryOption)
+		if !ok || expiryOption != "PX" && expiryOption != "PXAT" {
 			return []byte("-ERR Invalid expiry option\r\n")
 		}
 
@@ -349,12 +1453,22 @@ func (server *RedisServer) handleSetCommand(cmd string, args []interface{}) []by
 			return []byte("-ERR Invalid expiry value\r\n")
 		}
 
-		server.Storage[key] = value
-		server.Expirations[key] = time.Now().Add(time.Duration(expiryInt) * time.Millisecond)
+		when := time.UnixMilli(int64(expiryInt))
+		if expiryOption == "PX" {
+			when = time.Now().Add(time.Duration(expiryInt) * time.Millisecond)
+		}
+
+		server.setKey(key, createStringObject(value))
+		server.setExpire(key, when)
+		server.notifyKeyspaceEvent(NOTIFY_STRING, "set", key)
+		server.notifyKeyspaceEvent(NOTIFY_GENERIC, "expire", key)
+		// an absolute time keeps the TTL right when the AOF is replayed later
+		server.rewriteCommandVector("SET", key, value, "PXAT", strconv.FormatInt(when.UnixMilli(), 10))
 	} else {
-		server.Storage[key] = value
-		delete(server.Expirations, key)
+		server.setKey(key, createStringObject(value))
+		server.notifyKeyspaceEvent(NOTIFY_STRING, "set", key)
 	}
+	server.Dirty++
 
 	return []byte("+OK\r\n")
 }
@@ -369,25 +1483,146 @@ func (server *RedisServer) handleGetCommand(cmd string, args []interface{}) []by
 		return []byte("-ERR Invalid key type\r\n")
 	}
 
-	// Check if the key has expired
-	if expiration, exists := server.Expirations[key]; exists && time.Now().After(expiration) {
-		delete(server.Storage, key)
-		delete(server.Expirations, key)
+	obj := server.lookupKeyRead(key)
+	if obj == nil {
+		server.notifyKeyspaceEvent(NOTIFY_KEY_MISS, "keymiss", key)
 		return []byte("$-1\r\n")
 	}
 
-	value, ok := server.Storage[key]
-	if !ok {
-		return []byte("$-1\r\n")
+	if obj.Type != OBJ_STRING {
+		return addReplyErrorWrongType()
 	}
 
-	return addReplyBulk([]interface{}{value})
+	return addReplyBulk([]interface{}{obj.Value})
 }
 
 func addReplyErrorArity() []byte {
 	return []byte("-ERR wrong number of arguments\r\n")
 }
 
+func addReplyErrorWrongType() []byte {
+	return []byte("-WRONGTYPE Operation against a key holding the wrong kind of value\r\n")
+}
+
+func addReplyLongLong(n int64) []byte {
+	return []byte(fmt.Sprintf(":%d\r\n", n))
+}
+
+// addReplyArray encodes a RESP array of bulk strings
+func addReplyArray(items []string) []byte {
+	reply := bytes.Buffer{}
+	reply.WriteString(fmt.Sprintf("*%d\r\n", len(items)))
+	for _, item := range items {
+		reply.WriteString(fmt.Sprintf("$%d\r\n%s\r\n", len(item), item))
+	}
+	return reply.Bytes()
+}
+
+// addReplyArrayLen starts an array whose elements are encoded by the caller
+func addReplyArrayLen(n int) []byte {
+	return []byte(fmt.Sprintf("*%d\r\n", n))
+}
+
+// addReplyNullArray is the null of the protocol of the client, for the
+// commands that reply with an array
+func (client *RedisClient) addReplyNullArray() []byte {
+	if client.resp > 2 {
+		return []byte("_\r\n")
+	}
+	return []byte("*-1\r\n")
+}
+
+// addReplyNull is the null of the protocol of the client
+func (client *RedisClient) addReplyNull() []byte {
+	if client.resp > 2 {
+		return []byte("_\r\n")
+	}
+	return []byte("$-1\r\n")
+}
+
+// addReplyVerbatim is a verbatim string of the format, like "txt", a bulk
+// string on RESP2
+func (client *RedisClient) addReplyVerbatim(s, format string) []byte {
+	if client.resp > 2 {
+		return []byte(fmt.Sprintf("=%d\r\n%s:%s\r\n", len(s)+len(format)+1, format, s))
+	}
+	return addReplyValue(s)
+}
+
+// addReplyMapLen starts a map of n keys, a flat array of the keys and their
+// values on RESP2
+func (client *RedisClient) addReplyMapLen(n int) []byte {
+	if client.resp > 2 {
+		return []byte(fmt.Sprintf("%%%d\r\n", n))
+	}
+	return addReplyArrayLen(n * 2)
+}
+
+// addReplySetLen starts a set, an array on RESP2
+func (client *RedisClient) addReplySetLen(n int) []byte {
+	if client.resp > 2 {
+		return []byte(fmt.Sprintf("~%d\r\n", n))
+	}
+	return addReplyArrayLen(n)
+}
+
+// addReplyValue encodes nested replies: strings become bulk strings, integers
+// integer replies, floats bulk strings, nil a null bulk and slices arrays
+func addReplyValue(value interface{}) []byte {
+	reply := bytes.Buffer{}
+	writeReplyValue(&reply, value)
+	return reply.Bytes()
+}
+
+func writeReplyValue(reply *bytes.Buffer, value interface{}) {
+	switch v := value.(type) {
+	case nil:
+		reply.WriteString("$-1\r\n")
+	case string:
+		reply.WriteString(fmt.Sprintf("$%d\r\n%s\r\n", len(v), v))
+	case int:
+		reply.WriteString(fmt.Sprintf(":%d\r\n", v))
+	case int64:
+		reply.WriteString(fmt.Sprintf(":%d\r\n", v))
+	case float64:
+		formatted := strconv.FormatFloat(v, 'f', -1, 64)
+		reply.WriteString(fmt.Sprintf("$%d\r\n%s\r\n", len(formatted), formatted))
+	case []string:
+		reply.WriteString(fmt.Sprintf("*%d\r\n", len(v)))
+		for _, item := range v {
+			writeReplyValue(reply, item)
+		}
+	case []interface{}:
+		reply.WriteString(fmt.Sprintf("*%d\r\n", len(v)))
+		for _, item := range v {
+			writeReplyValue(reply, item)
+		}
+	default:
+		reply.WriteString(fmt.Sprintf("-ERR Unknown reply type %T\r\n", v))
+	}
+}
+
+// addReplyPush turns an encoded array into a RESP3 push of the same items
+func addReplyPush(array []byte) []byte {
+	push := append([]byte(nil), array...)
+	push[0] = '>'
+	return push
+}
+
+// addReplyHelp formats the HELP output of container commands
+func addReplyHelp(command string, help []string) []byte {
+	lines := []string{fmt.Sprintf("%s <subcommand> [<arg> [value] [opt] ...]. Subcommands are:", command)}
+	lines = append(lines, help...)
+	lines = append(lines, "HELP", "    Print this help.")
+
+	reply := bytes.Buffer{}
+	reply.WriteString(fmt.Sprintf("*%d\r\n", len(lines)))
+	for _, line := range lines {
+		reply.WriteString(fmt.Sprintf("+%s\r\n", line))
+	}
+	return reply.Bytes()
+}
+
 func addReply(command RedisCommand) []byte {
 	switch command.Name {
 	case "PING":
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var loadCommandsOnce sync.Once
+
+// newTestServer is a server with the default config, its files in a
+// directory of the test. The test runs its commands as the executor.
+func newTestServer(t *testing.T) *RedisServer {
+	t.Helper()
+	loadCommandsOnce.Do(func() {
+		redisCommandTable = loadCommandsFromJSON("commands")
+	})
+
+	config, err := loadServerConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Dir = t.TempDir()
+
+	server := newServer(config)
+	server.aclInit()
+	server.scriptingInit()
+	server.functionsInit()
+	return server
+}
+
+// newTestClient is a client without a connection, the replies it gets are
+// kept in its pending buffer
+func newTestClient(server *RedisServer) *RedisClient {
+	return &RedisClient{
+		ID:      atomic.AddUint64(&nextClientID, 1),
+		server:  server,
+		resp:    2,
+		pending: new(bytes.Buffer),
+		wake:    make(chan struct{}, 1),
+		ctime:   time.Now(),
+	}
+}
+
+// testReplies takes the replies the client got so far
+func (client *RedisClient) testReplies() string {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	replies := client.pending.String()
+	client.pending.Reset()
+	return replies
+}
+
+// testRun runs the command as the client, on the goroutine of the test
+// acting as the executor, and returns its reply
+func (client *RedisClient) testRun(cmd string, args ...string) string {
+	argv := make([]interface{}, len(args))
+	for i, arg := range args {
+		argv[i] = arg
+	}
+	client.server.processCommand(CommandRequest{Client: client, Cmd: cmd, Args: argv})
+	return client.testReplies()
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Options of a shutdown
+const (
+	SHUTDOWN_NOFLAGS = 0
+	SHUTDOWN_SAVE    = 1 << 0 // save even without save points
+	SHUTDOWN_NOSAVE  = 1 << 1 // don't save even with save points
+	SHUTDOWN_NOW     = 1 << 2 // don't wait for the replicas to catch up
+	SHUTDOWN_FORCE   = 1 << 3 // exit even when the final save fails
+)
+
+const CONFIG_DEFAULT_SHUTDOWN_TIMEOUT = 10
+
+// How long the shutdown waits for the clients to read what was written to
+// them, before closing their connections
+const SHUTDOWN_CLIENTS_FLUSH_TIMEOUT = time.Second
+
+const SHUTDOWN_ERROR = "-ERR Errors trying to SHUTDOWN. Check logs.\r\n"
+
+// isShutdownInitiated tells a shutdown waits for the replicas or the BGSAVE
+func (server *RedisServer) isShutdownInitiated() bool {
+	return !server.shutdownDeadline.IsZero()
+}
+
+// isReadyToShutdown tells whether every replica acknowledged the whole
+// replication stream, nothing would be lost by exiting now
+func (server *RedisServer) isReadyToShutdown() bool {
+	for _, slave := range server.repl.slaves {
+		if slave.replAckOff != server.repl.masterReplOffset {
+			return false
+		}
+	}
+	return true
+}
+
+// shutdownSaves tells whether a shutdown with the flags saves the RDB
+func (server *RedisServer) shutdownSaves(flags int) bool {
+	return flags&SHUTDOWN_NOSAVE == 0 && (flags&SHUTDOWN_SAVE != 0 || len(server.Config.SaveParams) > 0)
+}
+
+// prepareForShutdown exits right away, or once the replicas caught up with
+// the writes, which are paused meanwhile, and the BGSAVE in progress ended.
+// It returns with nil while waiting, and with the error when the shutdown
+// failed.
+func (server *RedisServer) prepareForShutdown(flags int) error {
+	if server.isShutdownInitiated() {
+		// a second SHUTDOWN may not want to wait for the first one
+		if flags&SHUTDOWN_NOW == 0 {
+			return nil
+		}
+		flags |= server.shutdownFlags
+		return server.finishShutdown(flags)
+	}
+
+	fmt.Println("User requested shutdown...")
+	waitReplicas := flags&SHUTDOWN_NOW == 0 && server.Config.ShutdownTimeout != 0 && !server.isReadyToShutdown()
+	waitBgsave := server.rdbBgsaveInProgress && server.shutdownSaves(flags)
+	if !waitReplicas && !waitBgsave {
+		return server.finishShutdown(flags)
+	}
+
+	if waitReplicas {
+		fmt.Println("Waiting for replicas before shutting down.")
+		server.pauseClients(PAUSE_DURING_SHUTDOWN, time.Time{}, CLIENT_PAUSE_WRITE)
+		server.getAckFromSlaves = true
+	}
+	if waitBgsave {
+		fmt.Println("Waiting for the background save to end before shutting down.")
+	}
+	server.shutdownDeadline = time.Now().Add(time.Duration(server.Config.ShutdownTimeout) * time.Second)
+	server.shutdownFlags = flags
+	return nil
+}
+
+// checkShutdownInProgress is called by serverCron to finish the shutdown in
+// progress, once the BGSAVE ended and the replicas caught up or the time to
+// wait for them elapsed
+func (server *RedisServer) checkShutdownInProgress() {
+	if !server.isShutdownInitiated() {
+		return
+	}
+	flags := server.shutdownFlags
+	if server.rdbBgsaveInProgress && server.shutdownSaves(flags) {
+		return
+	}
+	if flags&SHUTDOWN_NOW == 0 && !server.isReadyToShutdown() && time.Now().Before(server.shutdownDeadline) {
+		return
+	}
+	if server.finishShutdown(flags) != nil {
+		fmt.Println("Errors trying to shut down the server. Check the logs for more information.")
+		server.abortShutdown()
+	}
+}
+
+// closeClientsOnShutdown writes what is buffered for the clients, the last
+// of the stream for the replicas, and closes their connections. A client
+// that doesn't read is not waited for long.
+func (server *RedisServer) closeClientsOnShutdown() {
+	server.clientsMu.Lock()
+	clients := make([]*RedisClient, 0, len(server.clients))
+	for _, client := range server.clients {
+		clients = append(clients, client)
+	}
+	server.clientsMu.Unlock()
+
+	deadline := time.Now().Add(SHUTDOWN_CLIENTS_FLUSH_TIMEOUT)
+	for _, client := range clients {
+		client.waitPendingWritesUntil(deadline)
+		client.close()
+	}
+}
+
+// setupSignalHandlers has SIGTERM and SIGINT shut the server down, from
+// serverCron. A second SIGINT while shutting down exits right away.
+func (server *RedisServer) setupSignalHandlers() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		for sig := range signals {
+			server.sigShutdownHandler(sig.(syscall.Signal))
+		}
+	}()
+}
+
+func (server *RedisServer) sigShutdownHandler(sig syscall.Signal) {
+	if atomic.LoadInt32(&server.shutdownAsap) != 0 && sig == syscall.SIGINT {
+		fmt.Println("You insist... exiting now.")
+		os.Exit(1)
+	}
+
+	if sig == syscall.SIGINT {
+		fmt.Println("Received SIGINT scheduling shutdown...")
+	} else {
+		fmt.Println("Received SIGTERM scheduling shutdown...")
+	}
+	atomic.StoreInt32(&server.lastSigReceived, int32(sig))
+	atomic.StoreInt32(&server.shutdownAsap, 1)
+}
+
+// checkShutdownAsap starts the shutdown a signal asked for, with the options
+// configured for it. While loading there is nothing worth saving.
+func (server *RedisServer) checkShutdownAsap() {
+	if atomic.LoadInt32(&server.shutdownAsap) == 0 || server.isShutdownInitiated() {
+		return
+	}
+
+	flags := server.Config.ShutdownOnSigterm
+	if syscall.Signal(atomic.LoadInt32(&server.lastSigReceived)) == syscall.SIGINT {
+		flags = server.Config.ShutdownOnSigint
+	}
+	if server.loading {
+		flags = flags&^SHUTDOWN_SAVE | SHUTDOWN_NOSAVE | SHUTDOWN_NOW
+	}
+	if err := server.prepareForShutdown(flags); err != nil {
+		fmt.Println("Errors trying to shut down the server. Check the logs for more information.")
+		atomic.StoreInt32(&server.shutdownAsap, 0)
+	}
+}
+
+// abortShutdown gives up on the shutdown in progress, the clients waiting
+// for it get an error
+func (server *RedisServer) abortShutdown() bool {
+	if !server.isShutdownInitiated() {
+		return false
+	}
+	server.shutdownDeadline = time.Time{}
+	server.shutdownFlags = SHUTDOWN_NOFLAGS
+	atomic.StoreInt32(&server.shutdownAsap, 0)
+	server.unpauseClients(PAUSE_DURING_SHUTDOWN)
+
+	blocked := append([]*RedisClient(nil), server.blockedClients...)
+	for _, client := range blocked {
+		if client.bstate.btype == BLOCKED_SHUTDOWN {
+			server.unblockClient(client, []byte(SHUTDOWN_ERROR))
+		}
+	}
+	return true
+}
+
+// finishShutdown persists what needs to be and exits. It returns only when
+// the final save failed, unless SHUTDOWN_FORCE exits anyway.
+func (server *RedisServer) finishShutdown(flags int) error {
+	for _, slave := range server.repl.slaves {
+		if slave.replAckOff != server.repl.masterReplOffset {
+			fmt.Printf("Lagging replica %s:%d reported offset %d behind master, lag=%d, state=%s.\n",
+				slave.replicationGetSlaveIp(), slave.replListeningPort, slave.replAckOff,
+				server.repl.masterReplOffset-slave.replAckOff, replstateToString(slave.replState))
+		}
+	}
+
+	// the BGSAVE that didn't end is of no use, a save that ends before the
+	// exit may leave its temp file behind nonetheless
+	if server.rdbBgsaveInProgress && server.rdbChildType == RDB_CHILD_TYPE_DISK {
+		fmt.Println("There is a child saving an .rdb. Killing it!")
+		os.Remove(rdbTempFilename(server.rdbFilename()))
+	}
+	// the rewrite of the AOF is lost, its temp files are cleaned up by the
+	// next one
+	if server.aof.rewriteInProgress {
+		fmt.Println("There is a child rewriting the AOF. Killing it!")
+	}
+
+	if server.Config.AppendOnly && server.aof.file != nil {
+		fmt.Println("Calling fsync() on the AOF file.")
+		server.flushAppendOnlyFile()
+		if err := server.aof.file.Sync(); err != nil {
+			if flags&SHUTDOWN_FORCE == 0 {
+				fmt.Println("Error syncing the AOF file, can't exit.", err)
+				return err
+			}
+			fmt.Println("Error syncing the AOF file. Exit anyway.", err)
+		}
+	}
+
+	if server.shutdownSaves(flags) && !server.loading && server.sentinel == nil {
+		fmt.Println("Saving the final RDB snapshot before exiting.")
+		if err := server.rdbSave(); err != nil {
+			if flags&SHUTDOWN_FORCE == 0 {
+				fmt.Println("Error trying to save the DB, can't exit.")
+				return err
+			}
+			fmt.Println("Error trying to save the DB. Exit anyway.")
+		}
+	}
+
+	if server.Config.UnixSocket != "" {
+		fmt.Println("Removing the unix socket file.")
+		os.Remove(server.Config.UnixSocket)
+	}
+	if server.cluster != nil {
+		if err := server.clusterSaveConfig(); err != nil {
+			fmt.Println("Error saving the cluster config on shutdown:", err)
+		}
+	}
+
+	for _, l := range server.listeners {
+		l.Close()
+	}
+	server.closeClientsOnShutdown()
+
+	fmt.Println("Redis is now ready to exit, bye bye...")
+	os.Exit(0)
+	return nil
+}
+
+func (server *RedisServer) handleShutdownCommand(cmd string, args []interface{}) []byte {
+	flags := SHUTDOWN_NOFLAGS
+	abort := false
+	for _, arg := range args {
+		option, _ := arg.(string)
+		switch strings.ToUpper(option) {
+		case "NOSAVE":
+			flags |= SHUTDOWN_NOSAVE
+		case "SAVE":
+			flags |= SHUTDOWN_SAVE
+		case "NOW":
+			flags |= SHUTDOWN_NOW
+		case "FORCE":
+			flags |= SHUTDOWN_FORCE
+		case "ABORT":
+			abort = true
+		default:
+			return []byte("-ERR syntax error\r\n")
+		}
+	}
+	if (abort && flags != SHUTDOWN_NOFLAGS) || (flags&SHUTDOWN_NOSAVE != 0 && flags&SHUTDOWN_SAVE != 0) {
+		return []byte("-ERR syntax error\r\n")
+	}
+
+	if abort {
+		if !server.abortShutdown() {
+			return []byte("-ERR No shutdown in progress.\r\n")
+		}
+		fmt.Println("Shutdown manually aborted.")
+		return []byte("+OK\r\n")
+	}
+
+	// a busy script may only be killed by a shutdown that doesn't save the
+	// writes it made
+	if flags&SHUTDOWN_NOSAVE == 0 && server.scriptIsTimedout() {
+		return server.scriptBusyError()
+	}
+
+	client := server.currentClient
+	if client.Flags&CLIENT_DENY_BLOCKING != 0 {
+		flags |= SHUTDOWN_NOW
+	}
+	if err := server.prepareForShutdown(flags); err != nil {
+		return []byte(SHUTDOWN_ERROR)
+	}
+
+	// the reply is an error if the shutdown fails, there is none otherwise
+	server.blockClient(client, BLOCKED_SHUTDOWN, time.Time{})
+	return nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An entry keeps this many arguments, and this many bytes of each, the rest
+// is summarized
+const (
+	SLOWLOG_ENTRY_MAX_ARGC   = 32
+	SLOWLOG_ENTRY_MAX_STRING = 128
+)
+
+const (
+	CONFIG_DEFAULT_SLOWLOG_LOG_SLOWER_THAN = 10000
+	CONFIG_DEFAULT_SLOWLOG_MAX_LEN         = 128
+)
+
+// slowlogEntry is a command that ran for longer than slowlog-log-slower-than
+type slowlogEntry struct {
+	id       int64
+	time     int64 // unix time it ran at
+	duration int64 // microseconds
+	args     []string
+	peerid   string
+	cname    string
+}
+
+// slowlogPushEntryIfNeeded logs the command if it ran for too long, the log
+// keeps the slowlog-max-len newest entries
+func (server *RedisServer) slowlogPushEntryIfNeeded(client *RedisClient, cmd string, args []interface{}, duration time.Duration) {
+	threshold := server.Config.SlowlogLogSlowerThan
+	if threshold < 0 || duration.Microseconds() < int64(threshold) {
+		return
+	}
+
+	entry := &slowlogEntry{
+		id:       server.slowlogEntryID,
+		time:     time.Now().Unix(),
+		duration: duration.Microseconds(),
+		args:     slowlogEntryArgs(cmd, slowlogRedactArgs(cmd, args)),
+		cname:    client.name,
+	}
+	server.slowlogEntryID++
+	if client.Conn != nil {
+		entry.peerid = client.Conn.RemoteAddr().String()
+	}
+
+	server.slowlog = append([]*slowlogEntry{entry}, server.slowlog...)
+	if len(server.slowlog) > server.Config.SlowlogMaxLen {
+		server.slowlog = server.slowlog[:server.Config.SlowlogMaxLen]
+	}
+}
+
+// slowlogEntryArgs are the arguments an entry keeps, at most
+// SLOWLOG_ENTRY_MAX_ARGC of them and SLOWLOG_ENTRY_MAX_STRING bytes of each
+func slowlogEntryArgs(cmd string, args []interface{}) []string {
+	argc := len(args) + 1
+	slargc := argc
+	if slargc > SLOWLOG_ENTRY_MAX_ARGC {
+		slargc = SLOWLOG_ENTRY_MAX_ARGC
+	}
+
+	entryArgs := make([]string, 0, slargc)
+	entryArgs = append(entryArgs, cmd)
+	for j := 1; j < slargc; j++ {
+		if j == slargc-1 && slargc != argc {
+			entryArgs = append(entryArgs, fmt.Sprintf("... (%d more arguments)", argc-slargc+1))
+			break
+		}
+		arg, _ := args[j-1].(string)
+		if len(arg) > SLOWLOG_ENTRY_MAX_STRING {
+			arg = fmt.Sprintf("%s... (%d more bytes)", arg[:SLOWLOG_ENTRY_MAX_STRING], len(arg)-SLOWLOG_ENTRY_MAX_STRING)
+		}
+		entryArgs = append(entryArgs, arg)
+	}
+	return entryArgs
+}
+
+// slowlogRedactArgs hides the passwords among the arguments of the command
+func slowlogRedactArgs(cmd string, args []interface{}) []interface{} {
+	redacted := append([]interface{}(nil), args...)
+	redact := func(from, n int) {
+		for j := from; j < from+n && j < len(redacted); j++ {
+			redacted[j] = "(redacted)"
+		}
+	}
+
+	switch strings.ToUpper(cmd) {
+	case "AUTH":
+		redact(0, len(redacted))
+	case "HELLO":
+		for j := 1; j < len(redacted); j++ {
+			if option, _ := redacted[j].(string); strings.EqualFold(option, "AUTH") {
+				redact(j+1, 2)
+				j += 2
+			}
+		}
+	case "MIGRATE":
+		for j := 5; j < len(redacted); j++ {
+			option, _ := redacted[j].(string)
+			if strings.EqualFold(option, "AUTH") {
+				redact(j+1, 1)
+				j++
+			} else if strings.EqualFold(option, "AUTH2") {
+				redact(j+1, 2)
+				j += 2
+			}
+		}
+	case "ACL":
+		if subcommand, _ := redacted[0].(string); strings.EqualFold(subcommand, "SETUSER") {
+			for j := 2; j < len(redacted); j++ {
+				if rule, _ := redacted[j].(string); strings.HasPrefix(rule, ">") || strings.HasPrefix(rule, "<") {
+					redact(j, 1)
+				}
+			}
+		}
+	case "CONFIG":
+		if subcommand, _ := redacted[0].(string); strings.EqualFold(subcommand, "SET") {
+			for j := 1; j+1 < len(redacted); j += 2 {
+				name, _ := redacted[j].(string)
+				if strings.EqualFold(name, "requirepass") || strings.EqualFold(name, "masterauth") {
+					redact(j+1, 1)
+				}
+			}
+		}
+	}
+	return redacted
+}
+
+func (server *RedisServer) handleSlowlogCommand(cmd string, args []interface{}) []byte {
+	subcommand, _ := args[0].(string)
+	subcommand = strings.ToUpper(subcommand)
+
+	switch {
+	case subcommand == "HELP" && len(args) == 1:
+		return addReplyHelp("SLOWLOG", []string{
+			"GET [<count>]",
+			"    Return top <count> entries from the slowlog (default: 10, -1 mean all).",
+			"    Entries are made of:",
+			"    id, timestamp, time in microseconds, arguments array, client IP and port,",
+			"    client name",
+			"LEN",
+			"    Return the length of the slowlog.",
+			"RESET",
+			"    Reset the slowlog.",
+		})
+	case subcommand == "RESET" && len(args) == 1:
+		server.slowlog = nil
+		return []byte("+OK\r\n")
+	case subcommand == "LEN" && len(args) == 1:
+		return addReplyLongLong(int64(len(server.slowlog)))
+	case subcommand == "GET" && (len(args) == 1 || len(args) == 2):
+		count := 10
+		if len(args) == 2 {
+			countArg, _ := args[1].(string)
+			n, err := strconv.Atoi(countArg)
+			if err != nil || n < -1 {
+				return []byte("-ERR count should be greater than or equal to -1\r\n")
+			}
+			count = n
+			if count == -1 {
+				count = len(server.slowlog)
+			}
+		}
+		if count > len(server.slowlog) {
+			count = len(server.slowlog)
+		}
+
+		entries := make([]interface{}, 0, count)
+		for _, entry := range server.slowlog[:count] {
+			entries = append(entries, []interface{}{entry.id, entry.time, entry.duration, entry.args, entry.peerid, entry.cname})
+		}
+		return addReplyValue(entries)
+	}
+	return addReplySubcommandSyntaxError("SLOWLOG", subcommand)
+}
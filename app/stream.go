@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+)
+
+type StreamID struct {
+	Ms  uint64
+	Seq uint64
+}
+
+func (id StreamID) String() string {
+	return fmt.Sprintf("%d-%d", id.Ms, id.Seq)
+}
+
+func (id StreamID) Less(other StreamID) bool {
+	return id.Ms < other.Ms || id.Ms == other.Ms && id.Seq < other.Seq
+}
+
+type StreamEntry struct {
+	ID     StreamID
+	Fields []string // alternating field and value
+}
+
+// StreamPendingEntry is an entry delivered to a consumer but not acknowledged
+type StreamPendingEntry struct {
+	ID            StreamID
+	DeliveryTime  int64 // unix time in milliseconds
+	DeliveryCount uint64
+	Consumer      string
+}
+
+type StreamConsumer struct {
+	Name       string
+	SeenTime   int64 // unix time in milliseconds
+	ActiveTime int64
+}
+
+type StreamConsumerGroup struct {
+	Name        string
+	LastID      StreamID
+	EntriesRead int64
+	PEL         []StreamPendingEntry // ordered by ID
+	Consumers   []*StreamConsumer
+}
+
+type Stream struct {
+	Entries      []StreamEntry // ordered by ID
+	LastID       StreamID
+	FirstID      StreamID
+	MaxDeletedID StreamID
+	EntriesAdded uint64
+	Groups       []*StreamConsumerGroup
+}
+
+func createStreamObject(stream *Stream) *RedisObject {
+	return &RedisObject{Type: OBJ_STREAM, Value: stream}
+}
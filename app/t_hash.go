@@ -0,0 +1,43 @@
+package main
+
+func (server *RedisServer) handleHsetCommand(cmd string, args []interface{}) []byte {
+	if len(args) < 3 || len(args)%2 != 1 {
+		return addReplyErrorArity()
+	}
+
+	key, ok := args[0].(string)
+	if !ok {
+		return []byte("-ERR Invalid key type\r\n")
+	}
+
+	var hash map[string]string
+	if obj := server.lookupKeyWrite(key); obj != nil {
+		if obj.Type != OBJ_HASH {
+			return addReplyErrorWrongType()
+		}
+		hash = obj.Value.(map[string]string)
+	}
+
+	// the old hash may be shared with a snapshot, so update a copy
+	updated := make(map[string]string, len(hash)+len(args)/2)
+	for field, value := range hash {
+		updated[field] = value
+	}
+	created := int64(0)
+	for i := 1; i < len(args); i += 2 {
+		field, ok1 := args[i].(string)
+		value, ok2 := args[i+1].(string)
+		if !ok1 || !ok2 {
+			return []byte("-ERR Invalid field type\r\n")
+		}
+		if _, exists := updated[field]; !exists {
+			created++
+		}
+		updated[field] = value
+	}
+
+	server.dbReplaceValue(key, createHashObject(updated))
+	server.notifyKeyspaceEvent(NOTIFY_HASH, "hset", key)
+	server.Dirty += int64(len(args) / 2)
+	return addReplyLongLong(created)
+}
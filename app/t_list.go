@@ -0,0 +1,36 @@
+package main
+
+func (server *RedisServer) handleRpushCommand(cmd string, args []interface{}) []byte {
+	if len(args) < 2 {
+		return addReplyErrorArity()
+	}
+
+	key, ok := args[0].(string)
+	if !ok {
+		return []byte("-ERR Invalid key type\r\n")
+	}
+
+	var list []string
+	if obj := server.lookupKeyWrite(key); obj != nil {
+		if obj.Type != OBJ_LIST {
+			return addReplyErrorWrongType()
+		}
+		list = obj.Value.([]string)
+	}
+
+	// the old list may be shared with a snapshot, so append to a copy
+	pushed := make([]string, len(list), len(list)+len(args)-1)
+	copy(pushed, list)
+	for _, arg := range args[1:] {
+		element, ok := arg.(string)
+		if !ok {
+			return []byte("-ERR Invalid element type\r\n")
+		}
+		pushed = append(pushed, element)
+	}
+
+	server.dbReplaceValue(key, createListObject(pushed))
+	server.notifyKeyspaceEvent(NOTIFY_LIST, "rpush", key)
+	server.Dirty += int64(len(args) - 1)
+	return addReplyLongLong(int64(len(pushed)))
+}
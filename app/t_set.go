@@ -0,0 +1,176 @@
+package main
+
+import (
+	"math/rand"
+	"strconv"
+)
+
+func (server *RedisServer) handleSaddCommand(cmd string, args []interface{}) []byte {
+	if len(args) < 2 {
+		return addReplyErrorArity()
+	}
+
+	key, ok := args[0].(string)
+	if !ok {
+		return []byte("-ERR Invalid key type\r\n")
+	}
+
+	var set map[string]struct{}
+	if obj := server.lookupKeyWrite(key); obj != nil {
+		if obj.Type != OBJ_SET {
+			return addReplyErrorWrongType()
+		}
+		set = obj.Value.(map[string]struct{})
+	}
+
+	// the old set may be shared with a snapshot, so add to a copy
+	updated := make(map[string]struct{}, len(set)+len(args)-1)
+	for member := range set {
+		updated[member] = struct{}{}
+	}
+	added := int64(0)
+	for _, arg := range args[1:] {
+		member, ok := arg.(string)
+		if !ok {
+			return []byte("-ERR Invalid member type\r\n")
+		}
+		if _, exists := updated[member]; !exists {
+			updated[member] = struct{}{}
+			added++
+		}
+	}
+
+	if added > 0 {
+		server.dbReplaceValue(key, createSetObject(updated))
+		server.notifyKeyspaceEvent(NOTIFY_SET, "sadd", key)
+		server.Dirty += added
+	}
+	return addReplyLongLong(added)
+}
+
+func (server *RedisServer) handleSremCommand(cmd string, args []interface{}) []byte {
+	if len(args) < 2 {
+		return addReplyErrorArity()
+	}
+
+	key, ok := args[0].(string)
+	if !ok {
+		return []byte("-ERR Invalid key type\r\n")
+	}
+
+	obj := server.lookupKeyWrite(key)
+	if obj == nil {
+		return addReplyLongLong(0)
+	}
+	if obj.Type != OBJ_SET {
+		return addReplyErrorWrongType()
+	}
+	set := obj.Value.(map[string]struct{})
+
+	removed := map[string]struct{}{}
+	for _, arg := range args[1:] {
+		member, ok := arg.(string)
+		if !ok {
+			return []byte("-ERR Invalid member type\r\n")
+		}
+		if _, exists := set[member]; exists {
+			removed[member] = struct{}{}
+		}
+	}
+	if len(removed) == 0 {
+		return addReplyLongLong(0)
+	}
+
+	server.setRemoveMembers(key, set, removed, "srem")
+	server.Dirty += int64(len(removed))
+	return addReplyLongLong(int64(len(removed)))
+}
+
+// handleSpopCommand removes random members. What it removed is propagated
+// as an SREM, replicas and the AOF would pick other members otherwise.
+func (server *RedisServer) handleSpopCommand(cmd string, args []interface{}) []byte {
+	if len(args) != 1 && len(args) != 2 {
+		return addReplyErrorArity()
+	}
+
+	key, ok := args[0].(string)
+	if !ok {
+		return []byte("-ERR Invalid key type\r\n")
+	}
+
+	count := int64(1)
+	if len(args) == 2 {
+		countArg, _ := args[1].(string)
+		n, err := strconv.ParseInt(countArg, 10, 64)
+		if err != nil {
+			return []byte("-ERR value is not an integer or out of range\r\n")
+		}
+		if n < 0 {
+			return []byte("-ERR value is out of range, must be positive\r\n")
+		}
+		count = n
+	}
+
+	obj := server.lookupKeyWrite(key)
+	if obj == nil {
+		if len(args) == 2 {
+			return addReplyArray([]string{})
+		}
+		return []byte("$-1\r\n")
+	}
+	if obj.Type != OBJ_SET {
+		return addReplyErrorWrongType()
+	}
+	set := obj.Value.(map[string]struct{})
+
+	members := make([]string, 0, len(set))
+	for member := range set {
+		members = append(members, member)
+	}
+	if count > int64(len(members)) {
+		count = int64(len(members))
+	}
+	for i := 0; i < int(count); i++ {
+		j := i + rand.Intn(len(members)-i)
+		members[i], members[j] = members[j], members[i]
+	}
+	popped := members[:count]
+	if len(popped) == 0 {
+		return addReplyArray([]string{})
+	}
+
+	removed := make(map[string]struct{}, len(popped))
+	srem := []interface{}{key}
+	for _, member := range popped {
+		removed[member] = struct{}{}
+		srem = append(srem, member)
+	}
+	server.setRemoveMembers(key, set, removed, "spop")
+	server.rewriteCommandVector("SREM", srem...)
+	server.Dirty += int64(len(popped))
+
+	if len(args) == 1 {
+		return addReplyBulk([]interface{}{popped[0]})
+	}
+	return addReplyArray(popped)
+}
+
+// setRemoveMembers stores the set without the removed members, or deletes
+// the key when none is left. The event is the one of the command.
+func (server *RedisServer) setRemoveMembers(key string, set, removed map[string]struct{}, event string) {
+	server.notifyKeyspaceEvent(NOTIFY_SET, event, key)
+	if len(removed) == len(set) {
+		server.dbGenericDelete(key, false)
+		server.notifyKeyspaceEvent(NOTIFY_GENERIC, "del", key)
+		return
+	}
+
+	// the old set may be shared with a snapshot, so remove from a copy
+	updated := make(map[string]struct{}, len(set)-len(removed))
+	for member := range set {
+		if _, ok := removed[member]; !ok {
+			updated[member] = struct{}{}
+		}
+	}
+	server.dbReplaceValue(key, createSetObject(updated))
+}
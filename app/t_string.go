@@ -0,0 +1,60 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// handleIncrbyfloatCommand is propagated as a SET of the result with
+// KEEPTTL, floating point math may round differently where it is applied
+func (server *RedisServer) handleIncrbyfloatCommand(cmd string, args []interface{}) []byte {
+	if len(args) != 2 {
+		return addReplyErrorArity()
+	}
+
+	key, ok := args[0].(string)
+	if !ok {
+		return []byte("-ERR Invalid key type\r\n")
+	}
+	incrArg, _ := args[1].(string)
+	incr, err := parseFloatArg(incrArg)
+	if err != nil {
+		return []byte("-ERR value is not a valid float\r\n")
+	}
+
+	value := float64(0)
+	if obj := server.lookupKeyWrite(key); obj != nil {
+		if obj.Type != OBJ_STRING {
+			return addReplyErrorWrongType()
+		}
+		if value, err = parseFloatArg(obj.Value.(string)); err != nil {
+			return []byte("-ERR value is not a valid float\r\n")
+		}
+	}
+
+	value += incr
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return []byte("-ERR increment would produce NaN or Infinity\r\n")
+	}
+
+	result := strconv.FormatFloat(value, 'f', -1, 64)
+	server.dbReplaceValue(key, createStringObject(result))
+	server.notifyKeyspaceEvent(NOTIFY_STRING, "incrbyfloat", key)
+	server.rewriteCommandVector("SET", key, result, "KEEPTTL")
+	server.Dirty++
+	return addReplyBulk([]interface{}{result})
+}
+
+// parseFloatArg accepts the numbers Redis does, without spaces, NaN or
+// hexadecimal forms
+func parseFloatArg(s string) (float64, error) {
+	if s == "" || strings.TrimSpace(s) != s || strings.ContainsAny(s, "xXnN") {
+		return 0, strconv.ErrSyntax
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	return value, nil
+}
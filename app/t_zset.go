@@ -0,0 +1,63 @@
+package main
+
+import (
+	"math"
+	"strconv"
+)
+
+func (server *RedisServer) handleZaddCommand(cmd string, args []interface{}) []byte {
+	if len(args) < 3 || len(args)%2 != 1 {
+		return addReplyErrorArity()
+	}
+
+	key, ok := args[0].(string)
+	if !ok {
+		return []byte("-ERR Invalid key type\r\n")
+	}
+
+	// parse everything first, a bad score must not leave a partial update
+	scores := make([]float64, 0, len(args)/2)
+	for i := 1; i < len(args); i += 2 {
+		arg, _ := args[i].(string)
+		score, err := strconv.ParseFloat(arg, 64)
+		if err != nil || math.IsNaN(score) {
+			return []byte("-ERR value is not a valid float\r\n")
+		}
+		scores = append(scores, score)
+	}
+
+	var zset map[string]float64
+	if obj := server.lookupKeyWrite(key); obj != nil {
+		if obj.Type != OBJ_ZSET {
+			return addReplyErrorWrongType()
+		}
+		zset = obj.Value.(map[string]float64)
+	}
+
+	// the old zset may be shared with a snapshot, so update a copy
+	updated := make(map[string]float64, len(zset)+len(scores))
+	for member, score := range zset {
+		updated[member] = score
+	}
+	added, changed := int64(0), int64(0)
+	for i, score := range scores {
+		member, ok := args[2+i*2].(string)
+		if !ok {
+			return []byte("-ERR Invalid member type\r\n")
+		}
+		old, exists := updated[member]
+		if !exists {
+			added++
+		} else if old != score {
+			changed++
+		}
+		updated[member] = score
+	}
+
+	if added+changed > 0 {
+		server.dbReplaceValue(key, createZsetObject(updated))
+		server.notifyKeyspaceEvent(NOTIFY_ZSET, "zadd", key)
+		server.Dirty += added + changed
+	}
+	return addReplyLongLong(added)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// TLS is configured with the files of the certificate and key the server
+// presents, the CA the peers' certificates are verified with, and the
+// protocols and ciphers allowed. The clients connect to tls-port, next to
+// the plaintext port unless it is 0. tls-replication is about the links of
+// the replicas to their master, and of the sentinels to the instances,
+// tls-cluster about the cluster bus and MIGRATE. The server presents its
+// certificate on the links it opens too, and checks the one of the peer
+// against the CA, not against the name of the host.
+
+// the protocols of tls-protocols, by name
+var tlsProtocolVersions = map[string]uint16{
+	"tlsv1":   tls.VersionTLS10,
+	"tlsv1.1": tls.VersionTLS11,
+	"tlsv1.2": tls.VersionTLS12,
+	"tlsv1.3": tls.VersionTLS13,
+}
+
+// tlsAuthClients are the values of tls-auth-clients, whether the clients
+// must present a certificate
+var tlsAuthClients = map[string]tls.ClientAuthType{
+	"yes":      tls.RequireAndVerifyClientCert,
+	"optional": tls.VerifyClientCertIfGiven,
+	"no":       tls.NoClientCert,
+}
+
+// tlsEnabled tells whether anything is configured to use TLS
+func (config *ServerConfig) tlsEnabled() bool {
+	return config.TlsPort != 0 || config.TlsReplication || config.TlsCluster
+}
+
+// tlsConfigure builds the TLS config of the connections from the tls-*
+// settings, the one of the clients connecting to us
+func tlsConfigure(config *ServerConfig) (*tls.Config, error) {
+	if config.TlsCertFile == "" || config.TlsKeyFile == "" {
+		return nil, fmt.Errorf("No tls-cert-file or tls-key-file configured")
+	}
+	if config.TlsCaCertFile == "" && (config.TlsAuthClients != "no" || config.TlsReplication || config.TlsCluster) {
+		return nil, fmt.Errorf("tls-ca-cert-file must be specified when tls-cluster, tls-replication or tls-auth-clients are enabled!")
+	}
+	cert, err := tls.LoadX509KeyPair(config.TlsCertFile, config.TlsKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load certificate: %s: %v", config.TlsCertFile, err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		ClientAuth:   tlsAuthClients[config.TlsAuthClients],
+	}
+
+	if config.TlsCaCertFile != "" {
+		pem, err := os.ReadFile(config.TlsCaCertFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to configure CA certificate(s) file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("Failed to configure CA certificate(s) file: no certificate in %s", config.TlsCaCertFile)
+		}
+		tlsConfig.RootCAs = pool
+		tlsConfig.ClientCAs = pool
+	}
+
+	if config.TlsProtocols != "" {
+		tlsConfig.MinVersion, tlsConfig.MaxVersion = 0, 0
+		for _, name := range strings.Fields(config.TlsProtocols) {
+			version, ok := tlsProtocolVersions[strings.ToLower(name)]
+			if !ok {
+				return nil, fmt.Errorf("Failed to configure protocols: invalid tls-protocols value '%s'", name)
+			}
+			if tlsConfig.MinVersion == 0 || version < tlsConfig.MinVersion {
+				tlsConfig.MinVersion = version
+			}
+			if version > tlsConfig.MaxVersion {
+				tlsConfig.MaxVersion = version
+			}
+		}
+	}
+
+	// the TLSv1.3 ciphers are not configurable, tls-ciphers is about the
+	// older protocols
+	if config.TlsCiphers != "" {
+		suites := map[string]uint16{}
+		for _, suite := range tls.CipherSuites() {
+			suites[suite.Name] = suite.ID
+		}
+		for _, name := range strings.Split(config.TlsCiphers, ":") {
+			id, ok := suites[name]
+			if !ok {
+				return nil, fmt.Errorf("Failed to configure ciphers: unknown cipher suite '%s'", name)
+			}
+			tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+		}
+	}
+	return tlsConfig, nil
+}
+
+// tlsClientConfigure is the config of the links we open, from the one of
+// the clients. The peer's certificate is verified against the CA only, the
+// nodes and masters are known by their addresses.
+func tlsClientConfigure(serverConfig *tls.Config) *tls.Config {
+	tlsConfig := serverConfig.Clone()
+	tlsConfig.ClientAuth = tls.NoClientCert
+	tlsConfig.InsecureSkipVerify = true
+	tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return errors.New("no certificate presented by the peer")
+		}
+		intermediates := x509.NewCertPool()
+		for _, cert := range state.PeerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+			Roots:         serverConfig.RootCAs,
+			Intermediates: intermediates,
+		})
+		return err
+	}
+	return tlsConfig
+}
+
+// tlsDialConfig is the config of a link to open over TLS when enabled, or
+// nil for a plaintext one
+func (server *RedisServer) tlsDialConfig(enabled bool) *tls.Config {
+	if !enabled {
+		return nil
+	}
+	return server.tlsClientConfig
+}
+
+// connDial opens a link, over TLS unless tlsConfig is nil. The handshake is
+// done within the timeout too.
+func connDial(addr string, timeout time.Duration, tlsConfig *tls.Config) (net.Conn, error) {
+	if tlsConfig == nil {
+		return net.DialTimeout("tcp", addr, timeout)
+	}
+	return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", addr, tlsConfig)
+}
+
+// tlsClusterListener accepts the links of the cluster bus over TLS, the
+// nodes presenting their certificate whatever tls-auth-clients says
+func (server *RedisServer) tlsClusterListener(l net.Listener) net.Listener {
+	tlsConfig := server.tlsConfig.Clone()
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	return tls.NewListener(l, tlsConfig)
+}
+
+// clientPort is the port the clients are told to connect to, the TLS one
+// when the links of the replication or the cluster are over TLS
+func (server *RedisServer) clientPort(useTLS bool) int {
+	if useTLS && server.Config.TlsPort != 0 {
+		return server.Config.TlsPort
+	}
+	return server.Config.Port
+}
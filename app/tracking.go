@@ -0,0 +1,430 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The channel RESP2 clients subscribe to, to get the invalidation messages
+// redirected to them
+const TRACKING_CHANNEL = "__redis__:invalidate"
+
+// bcastState is a prefix of BCAST mode: the clients told about its keys,
+// and the keys modified since, with the client that modified each
+type bcastState struct {
+	clients map[*RedisClient]struct{}
+	keys    map[string]*RedisClient
+}
+
+// enableTracking makes the server remember the keys the client reads, and
+// tell it, or the client redirect points to, once they change. In BCAST mode
+// it is told about all the keys of its prefixes instead.
+func (server *RedisServer) enableTracking(client *RedisClient, redirect uint64, options int, prefixes []string) {
+	client.Flags &^= CLIENT_TRACKING_BROKEN_REDIR | CLIENT_TRACKING_OPTIN | CLIENT_TRACKING_OPTOUT |
+		CLIENT_TRACKING_NOLOOP | CLIENT_TRACKING_CACHING
+	client.Flags |= CLIENT_TRACKING | options
+	client.trackingRedirect = redirect
+	server.trackingClients[client] = struct{}{}
+
+	if options&CLIENT_TRACKING_BCAST == 0 {
+		return
+	}
+	// no prefix is the empty one, all the keys
+	if len(prefixes) == 0 {
+		prefixes = []string{""}
+	}
+	if client.trackingPrefixes == nil {
+		client.trackingPrefixes = make(map[string]struct{})
+	}
+	for _, prefix := range prefixes {
+		bs := server.trackingPrefixes[prefix]
+		if bs == nil {
+			bs = &bcastState{clients: make(map[*RedisClient]struct{}), keys: make(map[string]*RedisClient)}
+			server.trackingPrefixes[prefix] = bs
+		}
+		bs.clients[client] = struct{}{}
+		client.trackingPrefixes[prefix] = struct{}{}
+	}
+}
+
+// disableTracking stops the invalidation messages. The keys the client read
+// stay in the table, they are dropped once they are invalidated.
+func (server *RedisServer) disableTracking(client *RedisClient) {
+	for prefix := range client.trackingPrefixes {
+		bs := server.trackingPrefixes[prefix]
+		delete(bs.clients, client)
+		if len(bs.clients) == 0 {
+			delete(server.trackingPrefixes, prefix)
+		}
+	}
+	client.trackingPrefixes = nil
+
+	client.Flags &^= CLIENT_TRACKING | CLIENT_TRACKING_BROKEN_REDIR | CLIENT_TRACKING_OPTIN |
+		CLIENT_TRACKING_OPTOUT | CLIENT_TRACKING_NOLOOP | CLIENT_TRACKING_CACHING | CLIENT_TRACKING_BCAST
+	client.trackingRedirect = 0
+	delete(server.trackingClients, client)
+}
+
+// checkPrefixCollisions rejects the prefixes that overlap, one being the
+// prefix of the other, with the ones of the client or among themselves. The
+// client would get the invalidations of the keys of both twice.
+func checkPrefixCollisions(client *RedisClient, prefixes []string) []byte {
+	overlap := func(a, b string) bool {
+		return strings.HasPrefix(a, b) || strings.HasPrefix(b, a)
+	}
+	for i, prefix := range prefixes {
+		for existing := range client.trackingPrefixes {
+			if existing != prefix && overlap(existing, prefix) {
+				return []byte(fmt.Sprintf("-ERR Prefix '%s' overlaps with an existing prefix '%s'. "+
+					"Prefixes for a single client must not overlap.\r\n", prefix, existing))
+			}
+		}
+		for _, other := range prefixes[i+1:] {
+			if overlap(prefix, other) {
+				return []byte(fmt.Sprintf("-ERR Prefix '%s' overlaps with another provided prefix '%s'. "+
+					"Prefixes for a single client must not overlap.\r\n", prefix, other))
+			}
+		}
+	}
+	return nil
+}
+
+// trackingRemoveClosedClients drops the clients that disconnected, called
+// by clientsCron
+func (server *RedisServer) trackingRemoveClosedClients() {
+	for client := range server.trackingClients {
+		if client.isClosed() {
+			server.disableTracking(client)
+		}
+	}
+}
+
+// trackingRememberKeys records the keys of a read-only command the client
+// ran, unless OPTIN or OPTOUT says otherwise for this command
+func (server *RedisServer) trackingRememberKeys(client *RedisClient, command RedisCommand, args []interface{}) {
+	optin := client.Flags&CLIENT_TRACKING_OPTIN != 0
+	optout := client.Flags&CLIENT_TRACKING_OPTOUT != 0
+	caching := client.Flags&CLIENT_TRACKING_CACHING != 0
+	if (optin && !caching) || (optout && caching) {
+		return
+	}
+
+	for _, key := range getKeysFromCommand(command, args) {
+		ids := server.trackingTable[key]
+		if ids == nil {
+			ids = make(map[uint64]struct{})
+			server.trackingTable[key] = ids
+		}
+		ids[client.ID] = struct{}{}
+	}
+}
+
+// trackingCaller is the client the command runs for, the caller of the
+// script for the commands it runs
+func (server *RedisServer) trackingCaller(client *RedisClient) *RedisClient {
+	if server.script != nil && client == server.script.client {
+		return server.script.caller
+	}
+	return client
+}
+
+// trackingAfterCommand remembers the keys a tracking client read with the
+// command. The scripts that only read are not tracked, the commands they
+// run are.
+func (server *RedisServer) trackingAfterCommand(client *RedisClient, command RedisCommand, args []interface{}, reply []byte) {
+	if command.CmdFlags&CMD_READONLY == 0 || command.Group == "scripting" || (len(reply) > 0 && reply[0] == '-') {
+		return
+	}
+	caller := server.trackingCaller(client)
+	if caller != nil && caller.Flags&CLIENT_TRACKING != 0 && caller.Flags&CLIENT_TRACKING_BCAST == 0 {
+		server.trackingRememberKeys(caller, command, args)
+	}
+}
+
+// sendTrackingMessage tells the client the keys to drop from its cache, or
+// with nil keys to drop all of it. It goes to the redirect client if any,
+// as a pubsub message when that one is on RESP2 and subscribed.
+func (server *RedisServer) sendTrackingMessage(client *RedisClient, keys []string) {
+	target := client
+	if client.trackingRedirect != 0 {
+		server.clientsMu.Lock()
+		target = server.clients[client.trackingRedirect]
+		server.clientsMu.Unlock()
+
+		if target == nil || target.isClosed() {
+			// the client is told once, if it can read pushes
+			if client.Flags&CLIENT_TRACKING_BROKEN_REDIR == 0 && client.resp > 2 {
+				client.addReply(addReplyPush(addReplyValue([]interface{}{"tracking-redir-broken", int64(client.trackingRedirect)})))
+			}
+			client.Flags |= CLIENT_TRACKING_BROKEN_REDIR
+			return
+		}
+	}
+
+	var payload []byte
+	if keys == nil {
+		payload = target.addReplyNull()
+	} else {
+		payload = addReplyValue(keys)
+	}
+	var msg []byte
+	if target.resp > 2 {
+		msg = addReplyPush(addReplyArrayLen(2))
+		msg = append(msg, addReplyValue("invalidate")...)
+	} else if target.Flags&CLIENT_PUBSUB != 0 {
+		msg = addReplyArrayLen(3)
+		msg = append(msg, addReplyValue("message")...)
+		msg = append(msg, addReplyValue(TRACKING_CHANNEL)...)
+	} else {
+		return
+	}
+	target.addReply(append(msg, payload...))
+}
+
+// trackingInvalidateKey tells the clients that read the key that it changed.
+// The client running the command gets it after its reply. The key is added
+// to the prefixes it matches for the BCAST clients.
+func (server *RedisServer) trackingInvalidateKey(key string) {
+	current := server.currentClient
+	if current != nil {
+		current = server.trackingCaller(current)
+	}
+	for prefix, bs := range server.trackingPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			bs.keys[key] = current
+		}
+	}
+
+	ids, ok := server.trackingTable[key]
+	if !ok {
+		return
+	}
+	delete(server.trackingTable, key)
+
+	server.clientsMu.Lock()
+	targets := make([]*RedisClient, 0, len(ids))
+	for id := range ids {
+		if target := server.clients[id]; target != nil {
+			targets = append(targets, target)
+		}
+	}
+	server.clientsMu.Unlock()
+
+	for _, target := range targets {
+		if target.Flags&CLIENT_TRACKING == 0 || target.Flags&CLIENT_TRACKING_BCAST != 0 {
+			continue
+		}
+		if target == current {
+			if target.Flags&CLIENT_TRACKING_NOLOOP == 0 {
+				server.trackingPendingKeys = append(server.trackingPendingKeys, key)
+			}
+			continue
+		}
+		server.sendTrackingMessage(target, []string{key})
+	}
+}
+
+// trackingHandlePendingKeyInvalidations sends the client the keys of its own
+// command it has to invalidate, once its reply is out
+func (server *RedisServer) trackingHandlePendingKeyInvalidations(client *RedisClient) {
+	if len(server.trackingPendingKeys) == 0 {
+		return
+	}
+	keys := server.trackingPendingKeys
+	server.trackingPendingKeys = nil
+	if client.Flags&CLIENT_TRACKING != 0 {
+		server.sendTrackingMessage(client, keys)
+	}
+}
+
+// trackingBroadcastInvalidationMessages tells the BCAST clients about the
+// keys of their prefixes modified since the last call, in one message per
+// prefix. NOLOOP clients are not told about the keys they modified.
+func (server *RedisServer) trackingBroadcastInvalidationMessages() {
+	for _, bs := range server.trackingPrefixes {
+		if len(bs.keys) == 0 {
+			continue
+		}
+		for client := range bs.clients {
+			if client.isClosed() {
+				continue
+			}
+			keys := make([]string, 0, len(bs.keys))
+			for key, modifiedBy := range bs.keys {
+				if client.Flags&CLIENT_TRACKING_NOLOOP != 0 && modifiedBy == client {
+					continue
+				}
+				keys = append(keys, key)
+			}
+			if len(keys) > 0 {
+				sort.Strings(keys)
+				server.sendTrackingMessage(client, keys)
+			}
+		}
+		bs.keys = make(map[string]*RedisClient)
+	}
+}
+
+// trackingInvalidateKeysOnFlush tells all the tracking clients to drop
+// their whole cache, the dataset was flushed
+func (server *RedisServer) trackingInvalidateKeysOnFlush() {
+	for client := range server.trackingClients {
+		if !client.isClosed() {
+			server.sendTrackingMessage(client, nil)
+		}
+	}
+	server.trackingTable = make(map[string]map[uint64]struct{})
+}
+
+// clientTrackingCommand is CLIENT TRACKING ON|OFF with its options
+func (server *RedisServer) clientTrackingCommand(client *RedisClient, args []interface{}) []byte {
+	mode, _ := args[0].(string)
+	var redirect uint64
+	options := 0
+	prefixes := []string{}
+	for j := 1; j < len(args); j++ {
+		option, _ := args[j].(string)
+		switch {
+		case strings.EqualFold(option, "REDIRECT") && j+1 < len(args):
+			j++
+			if redirect != 0 {
+				return []byte("-ERR A client can only redirect to a single other client\r\n")
+			}
+			idArg, _ := args[j].(string)
+			id, err := strconv.ParseUint(idArg, 10, 64)
+			if err != nil {
+				return []byte("-ERR value is not an integer or out of range\r\n")
+			}
+			server.clientsMu.Lock()
+			_, ok := server.clients[id]
+			server.clientsMu.Unlock()
+			if !ok {
+				return []byte("-ERR The client ID you want redirect to does not exist\r\n")
+			}
+			redirect = id
+		case strings.EqualFold(option, "BCAST"):
+			options |= CLIENT_TRACKING_BCAST
+		case strings.EqualFold(option, "PREFIX") && j+1 < len(args):
+			j++
+			prefix, _ := args[j].(string)
+			prefixes = append(prefixes, prefix)
+		case strings.EqualFold(option, "OPTIN"):
+			options |= CLIENT_TRACKING_OPTIN
+		case strings.EqualFold(option, "OPTOUT"):
+			options |= CLIENT_TRACKING_OPTOUT
+		case strings.EqualFold(option, "NOLOOP"):
+			options |= CLIENT_TRACKING_NOLOOP
+		default:
+			return []byte("-ERR syntax error\r\n")
+		}
+	}
+
+	switch strings.ToUpper(mode) {
+	case "ON":
+		bcast := options&CLIENT_TRACKING_BCAST != 0
+		if len(prefixes) > 0 && !bcast {
+			return []byte("-ERR PREFIX option requires BCAST mode to be enabled\r\n")
+		}
+		if client.Flags&CLIENT_TRACKING != 0 && (client.Flags&CLIENT_TRACKING_BCAST != 0) != bcast {
+			return []byte("-ERR You can't switch BCAST mode on/off before disabling tracking for this client, " +
+				"and then re-enabling it with a different mode.\r\n")
+		}
+		if options&CLIENT_TRACKING_OPTIN != 0 && options&CLIENT_TRACKING_OPTOUT != 0 {
+			return []byte("-ERR You can't use both OPTIN and OPTOUT\r\n")
+		}
+		if bcast && options&(CLIENT_TRACKING_OPTIN|CLIENT_TRACKING_OPTOUT) != 0 {
+			return []byte("-ERR OPTIN and OPTOUT are not compatible with BCAST\r\n")
+		}
+		modes := CLIENT_TRACKING_OPTIN | CLIENT_TRACKING_OPTOUT
+		if client.Flags&CLIENT_TRACKING != 0 && client.Flags&modes != options&modes {
+			return []byte("-ERR You can't switch OPTIN/OPTOUT mode before disabling tracking for this client, " +
+				"and then re-enabling it with a different mode.\r\n")
+		}
+		if bcast {
+			if errReply := checkPrefixCollisions(client, prefixes); errReply != nil {
+				return errReply
+			}
+		}
+		server.enableTracking(client, redirect, options, prefixes)
+	case "OFF":
+		server.disableTracking(client)
+	default:
+		return []byte("-ERR syntax error\r\n")
+	}
+	return []byte("+OK\r\n")
+}
+
+// clientCachingCommand is CLIENT CACHING YES|NO, which makes the next
+// command tracked in OPTIN mode, or not tracked in OPTOUT mode
+func (server *RedisServer) clientCachingCommand(client *RedisClient, value string) []byte {
+	if client.Flags&(CLIENT_TRACKING_OPTIN|CLIENT_TRACKING_OPTOUT) == 0 {
+		return []byte("-ERR CLIENT CACHING can be called only when the client is in tracking mode " +
+			"with OPTIN or OPTOUT mode enabled\r\n")
+	}
+	switch strings.ToLower(value) {
+	case "yes":
+		if client.Flags&CLIENT_TRACKING_OPTIN == 0 {
+			return []byte("-ERR CLIENT CACHING YES is only valid when tracking is enabled in OPTIN mode.\r\n")
+		}
+	case "no":
+		if client.Flags&CLIENT_TRACKING_OPTOUT == 0 {
+			return []byte("-ERR CLIENT CACHING NO is only valid when tracking is enabled in OPTOUT mode.\r\n")
+		}
+	default:
+		return []byte("-ERR syntax error\r\n")
+	}
+	client.Flags |= CLIENT_TRACKING_CACHING
+	return []byte("+OK\r\n")
+}
+
+// clientTrackingInfoCommand describes the tracking mode of the client
+func (server *RedisServer) clientTrackingInfoCommand(client *RedisClient) []byte {
+	flags := []string{}
+	if client.Flags&CLIENT_TRACKING == 0 {
+		flags = append(flags, "off")
+	} else {
+		flags = append(flags, "on")
+		for _, flag := range []struct {
+			flag int
+			name string
+		}{
+			{CLIENT_TRACKING_BCAST, "bcast"}, {CLIENT_TRACKING_OPTIN, "optin"}, {CLIENT_TRACKING_OPTOUT, "optout"},
+			{CLIENT_TRACKING_NOLOOP, "noloop"}, {CLIENT_TRACKING_BROKEN_REDIR, "broken_redirect"},
+		} {
+			if client.Flags&flag.flag != 0 {
+				flags = append(flags, flag.name)
+			}
+		}
+		if client.Flags&CLIENT_TRACKING_CACHING != 0 {
+			if client.Flags&CLIENT_TRACKING_OPTIN != 0 {
+				flags = append(flags, "caching-yes")
+			} else {
+				flags = append(flags, "caching-no")
+			}
+		}
+	}
+
+	redirect := int64(-1)
+	if client.Flags&CLIENT_TRACKING != 0 {
+		redirect = int64(client.trackingRedirect)
+	}
+
+	reply := client.addReplyMapLen(3)
+	reply = append(reply, addReplyValue("flags")...)
+	reply = append(reply, client.addReplySetLen(len(flags))...)
+	for _, flag := range flags {
+		reply = append(reply, addReplyValue(flag)...)
+	}
+	reply = append(reply, addReplyValue("redirect")...)
+	reply = append(reply, addReplyLongLong(redirect)...)
+	prefixes := make([]string, 0, len(client.trackingPrefixes))
+	for prefix := range client.trackingPrefixes {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	reply = append(reply, addReplyValue("prefixes")...)
+	reply = append(reply, addReplyValue(prefixes)...)
+	return reply
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	mathrand "math/rand"
+	"strconv"
+	"strings"
+)
+
+// getRandomHexChars returns n random hex characters, used for run and
+// replication IDs
+func getRandomHexChars(n int) string {
+	buf := make([]byte, (n+1)/2)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)[:n]
+}
+
+// integer are the types minOf and maxOf compare
+type integer interface {
+	~int | ~int32 | ~int64 | ~uint32 | ~uint64
+}
+
+// minOf and maxOf are the min and max builtins, which need Go 1.21
+func minOf[T integer](a, b T) T {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxOf[T integer](a, b T) T {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// containsString tells whether s is one of the strings of the list
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// removeString removes the occurrences of s from the list, in place
+func removeString(list []string, s string) []string {
+	kept := list[:0]
+	for _, item := range list {
+		if item != s {
+			kept = append(kept, item)
+		}
+	}
+	return kept
+}
+
+// stringMatch is a glob-style matcher with the semantics of Redis'
+// stringmatchlen: *, ?, [abc], [^abc], [a-z] and \ escaping
+func stringMatch(pattern, str string, nocase bool) bool {
+	if nocase {
+		pattern = strings.ToLower(pattern)
+		str = strings.ToLower(str)
+	}
+	skipLongerMatches := false
+	return stringMatchImpl(pattern, str, &skipLongerMatches, 0)
+}
+
+// stringMatchFuzzTest matches random patterns against random strings, made
+// of the characters that mean something to the matcher, to check it neither
+// crashes nor hangs. It returns how many of them matched.
+func stringMatchFuzzTest() int {
+	const charset = "*?[]^-\\ab"
+	random := func() string {
+		buf := make([]byte, mathrand.Intn(32))
+		for i := range buf {
+			buf[i] = charset[mathrand.Intn(len(charset))]
+		}
+		return string(buf)
+	}
+
+	matches := 0
+	for i := 0; i < 1000000; i++ {
+		if stringMatch(random(), random(), false) {
+			matches++
+		}
+	}
+	return matches
+}
+
+// stringMatchImpl is stringmatchlen_impl. Once the rest of the pattern after
+// a * matched nowhere in the rest of the string, skipLongerMatches stops the
+// earlier stars from trying longer matches, which would only try the rest
+// of the pattern on less of the string, and keeps the patterns with many
+// stars from backtracking exponentially.
+func stringMatchImpl(pattern, str string, skipLongerMatches *bool, nesting int) bool {
+	// protect against abusive patterns with many stars
+	if nesting > 1000 {
+		return false
+	}
+
+	for len(pattern) > 0 && len(str) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for len(str) > 0 {
+				if stringMatchImpl(pattern[1:], str, skipLongerMatches, nesting+1) {
+					return true
+				}
+				if *skipLongerMatches {
+					return false
+				}
+				str = str[1:]
+			}
+			*skipLongerMatches = true
+			return false
+		case '?':
+			str = str[1:]
+		case '[':
+			pattern = pattern[1:]
+			not := len(pattern) > 0 && pattern[0] == '^'
+			if not {
+				pattern = pattern[1:]
+			}
+			match := false
+			for len(pattern) > 0 {
+				if pattern[0] == '\\' && len(pattern) >= 2 {
+					pattern = pattern[1:]
+					if pattern[0] == str[0] {
+						match = true
+					}
+				} else if pattern[0] == ']' {
+					break
+				} else if len(pattern) >= 3 && pattern[1] == '-' {
+					start, end := pattern[0], pattern[2]
+					if start > end {
+						start, end = end, start
+					}
+					if str[0] >= start && str[0] <= end {
+						match = true
+					}
+					pattern = pattern[2:]
+				} else if pattern[0] == str[0] {
+					match = true
+				}
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				// unterminated class: treat the end as the closing bracket
+				pattern = " "
+			}
+			if not {
+				match = !match
+			}
+			if !match {
+				return false
+			}
+			str = str[1:]
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if pattern[0] != str[0] {
+				return false
+			}
+			str = str[1:]
+		}
+		pattern = pattern[1:]
+		if len(str) == 0 {
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			break
+		}
+	}
+
+	return len(pattern) == 0 && len(str) == 0
+}
+
+// splitArgs splits a line in arguments like sdssplitargs: separated by
+// spaces, or quoted. Double quotes take the escapes \n, \r, \t, \b, \a and
+// \xHH, single quotes only \'. A closing quote must end the argument.
+func splitArgs(line string) ([]string, error) {
+	args := []string{}
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+
+		current := []byte{}
+		inDoubleQuotes, inSingleQuotes := false, false
+		for done := false; !done; {
+			switch {
+			case inDoubleQuotes:
+				if i == len(line) {
+					return nil, fmt.Errorf("unbalanced quotes")
+				}
+				switch {
+				case line[i] == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHexDigit(line[i+2]) && isHexDigit(line[i+3]):
+					b, _ := strconv.ParseUint(line[i+2:i+4], 16, 8)
+					current = append(current, byte(b))
+					i += 3
+				case line[i] == '\\' && i+1 < len(line):
+					i++
+					switch line[i] {
+					case 'n':
+						current = append(current, '\n')
+					case 'r':
+						current = append(current, '\r')
+					case 't':
+						current = append(current, '\t')
+					case 'b':
+						current = append(current, '\b')
+					case 'a':
+						current = append(current, '\a')
+					default:
+						current = append(current, line[i])
+					}
+				case line[i] == '"':
+					// the closing quote must be followed by a space
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, fmt.Errorf("unbalanced quotes")
+					}
+					done = true
+				default:
+					current = append(current, line[i])
+				}
+			case inSingleQuotes:
+				if i == len(line) {
+					return nil, fmt.Errorf("unbalanced quotes")
+				}
+				switch {
+				case line[i] == '\\' && i+1 < len(line) && line[i+1] == '\'':
+					i++
+					current = append(current, '\'')
+				case line[i] == '\'':
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, fmt.Errorf("unbalanced quotes")
+					}
+					done = true
+				default:
+					current = append(current, line[i])
+				}
+			default:
+				if i == len(line) {
+					done = true
+					break
+				}
+				switch line[i] {
+				case ' ', '\n', '\r', '\t', 0:
+					done = true
+				case '"':
+					inDoubleQuotes = true
+				case '\'':
+					inSingleQuotes = true
+				default:
+					current = append(current, line[i])
+				}
+			}
+			if i < len(line) {
+				i++
+			}
+		}
+		args = append(args, string(current))
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '\v' || c == '\f'
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+// catRepr quotes a string the way splitArgs reads it back, with escapes for
+// the quotes and the characters that are not printable
+func catRepr(s string) string {
+	b := strings.Builder{}
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\', '"':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\n':
+			b.WriteString("\\n")
+		case '\r':
+			b.WriteString("\\r")
+		case '\t':
+			b.WriteString("\\t")
+		case '\a':
+			b.WriteString("\\a")
+		case '\b':
+			b.WriteString("\\b")
+		default:
+			if c >= 0x20 && c < 0x7f {
+				b.WriteByte(c)
+			} else {
+				fmt.Fprintf(&b, "\\x%02x", c)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}